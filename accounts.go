@@ -0,0 +1,134 @@
+package photobak
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// savedAccountsBucket is the name of the bucket that maps
+// the accounts saved in the repository to their values.
+const savedAccountsBucket = "accounts"
+
+// SavedAccount is an account saved in the repository, so that
+// it doesn't have to be configured every time it is backed up.
+type SavedAccount struct {
+	Provider string // the name of the provider
+	Username string // the username, in lower case
+	Value    string // what configures the account (see SaveAccount)
+}
+
+// String returns the account's name, as provider:username.
+func (sa SavedAccount) String() string {
+	return sa.Provider + ":" + sa.Username
+}
+
+// SaveAccount saves the account of the named provider that is
+// configured by value, which is what would be given to the
+// provider's flag: usually the username, or "username=settings"
+// for providers that need more than that (like exec). Saving an
+// account again replaces its value.
+//
+// Saved accounts are not configured automatically; a program
+// gets them from SavedAccounts and configures them with their
+// providers before opening the repository for a backup.
+func (r *Repository) SaveAccount(provider, value string) (SavedAccount, error) {
+	provider = strings.ToLower(provider)
+	if _, ok := providers[provider]; !ok {
+		return SavedAccount{}, fmt.Errorf("unknown provider '%s'", provider)
+	}
+	value = strings.TrimSpace(value)
+	username := strings.ToLower(strings.TrimSpace(strings.SplitN(value, "=", 2)[0]))
+	if username == "" {
+		return SavedAccount{}, fmt.Errorf("no username given")
+	}
+	sa := SavedAccount{Provider: provider, Username: username, Value: value}
+
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(savedAccountsBucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(sa.String()), []byte(sa.Value))
+	})
+	if err != nil {
+		return sa, fmt.Errorf("saving account %s: %v", sa, err)
+	}
+	return sa, nil
+}
+
+// SavedAccounts returns the accounts saved in
+// the repository, sorted by name.
+func (r *Repository) SavedAccounts() ([]SavedAccount, error) {
+	var saved []SavedAccount
+	err := r.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(savedAccountsBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			parts := strings.SplitN(string(k), ":", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("bad saved account '%s'", k)
+			}
+			saved = append(saved, SavedAccount{
+				Provider: parts[0],
+				Username: parts[1],
+				Value:    string(v),
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("loading saved accounts: %v", err)
+	}
+	sort.Slice(saved, func(i, j int) bool {
+		return saved[i].String() < saved[j].String()
+	})
+	return saved, nil
+}
+
+// RemoveSavedAccount removes account, which must be in the form
+// "provider:username", from the accounts saved in the repository.
+// Nothing else that is stored for the account is removed; to
+// remove that too, use PurgeAccount.
+func (r *Repository) RemoveSavedAccount(account string) error {
+	account = strings.ToLower(account)
+	deleted, err := r.db.deleteSavedAccount(account)
+	if err != nil {
+		return fmt.Errorf("removing saved account %s: %v", account, err)
+	}
+	if !deleted {
+		return fmt.Errorf("no saved account '%s'", account)
+	}
+	return nil
+}
+
+// deleteSavedAccount removes account from the saved accounts,
+// and returns true if it was one of them.
+func (db *boltDB) deleteSavedAccount(account string) (bool, error) {
+	var deleted bool
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(savedAccountsBucket))
+		if b == nil || b.Get([]byte(account)) == nil {
+			return nil
+		}
+		deleted = true
+		return b.Delete([]byte(account))
+	})
+	return deleted, err
+}
+
+// IsConfigured returns true if account, in the form
+// "provider:username", is configured with its provider.
+func IsConfigured(account string) bool {
+	account = strings.ToLower(account)
+	for _, pa := range getAccounts() {
+		if pa.String() == account {
+			return true
+		}
+	}
+	return false
+}
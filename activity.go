@@ -0,0 +1,174 @@
+package photobak
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// fullPassInterval is how often Store lists every collection
+// of an account, even the dormant ones (see DormantAfter).
+const fullPassInterval = 7 * 24 * time.Hour
+
+// mostActiveFirst sorts colls so that pa's collections that are
+// new, or in which items were added or changed most recently,
+// come first. The order of collections that are equally active
+// is kept.
+func (r *Repository) mostActiveFirst(pa providerAccount, colls []Collection) error {
+	active, err := r.lastActive(pa, colls)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(colls, func(i, j int) bool {
+		ai, aj := active[colls[i].CollectionID()], active[colls[j].CollectionID()]
+		if ai == nil || aj == nil {
+			return ai == nil && aj != nil // new collections first
+		}
+		return ai.After(*aj)
+	})
+	return nil
+}
+
+// skipDormant returns the collections in colls, except those of
+// pa's that are dormant (see DormantAfter) and were finished in
+// the previous run, unless it is time for a full pass, in which
+// case it returns all of them and true.
+func (r *Repository) skipDormant(pa providerAccount, colls []Collection) ([]Collection, bool, error) {
+	if r.DormantAfter <= 0 {
+		return colls, false, nil
+	}
+	lastFull, err := r.db.loadFullPass(pa)
+	if err != nil {
+		return nil, false, err
+	}
+	if time.Since(lastFull) >= fullPassInterval {
+		repoLog.Infof("%s: listing all collections (full pass)", pa)
+		return colls, true, nil
+	}
+
+	active, err := r.lastActive(pa, colls)
+	if err != nil {
+		return nil, false, err
+	}
+	unfinished, err := r.db.loadUnfinished(pa)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var listed []Collection
+	var skipped int
+	for _, coll := range colls {
+		collID := coll.CollectionID()
+		_, isUnfinished := unfinished[collID]
+		if t := active[collID]; t != nil && !isUnfinished && time.Since(*t) > r.DormantAfter {
+			skipped++
+			continue
+		}
+		listed = append(listed, coll)
+	}
+	if skipped > 0 {
+		repoLog.Infof("%s: skipping %d dormant collections until the next full pass", pa, skipped)
+	}
+	return listed, false, nil
+}
+
+// lastActive returns when each of pa's collections in colls was
+// last active, keyed by listed ID, or nil for those not stored.
+func (r *Repository) lastActive(pa providerAccount, colls []Collection) (map[string]*time.Time, error) {
+	stored, err := r.storedCollections(pa, colls)
+	if err != nil {
+		return nil, err
+	}
+	active := make(map[string]*time.Time, len(stored))
+	for id, dbc := range stored {
+		t := dbc.Active
+		active[id] = &t
+	}
+	return active, nil
+}
+
+// storedCollections returns pa's collections in colls as they
+// are stored, keyed by listed ID; those not stored are left out.
+func (r *Repository) storedCollections(pa providerAccount, colls []Collection) (map[string]*dbCollection, error) {
+	aliases, err := r.db.loadIDAliases(pa)
+	if err != nil {
+		return nil, fmt.Errorf("loading aliases: %v", err)
+	}
+	stored := make(map[string]*dbCollection, len(colls))
+	for _, coll := range colls {
+		dbc, err := r.db.loadCollection(pa.key(), aliases.collection(coll.CollectionID()))
+		if err != nil {
+			return nil, err
+		}
+		if dbc != nil {
+			stored[coll.CollectionID()] = dbc
+		}
+	}
+	return stored, nil
+}
+
+// saveActivity records that the collections of ar in which items
+// were added or changed during this run were active, and when
+// the account's last full pass was, if this run made one.
+func (r *Repository) saveActivity(ar accountRun) error {
+	now := time.Now()
+	for _, coll := range ar.collections {
+		run := ar.runs[coll.CollectionID()]
+		if run == nil || !run.wasActive() {
+			continue
+		}
+		dbc, err := r.db.loadCollection(ar.ac.account.key(), run.id)
+		if err != nil {
+			return err
+		}
+		if dbc == nil {
+			continue
+		}
+		dbc.Active = now
+		err = r.db.saveCollection(ar.ac.account.key(), dbc.ID, dbc)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !ar.fullPass {
+		return nil
+	}
+	for _, coll := range ar.collections {
+		if !ar.runs[coll.CollectionID()].finished() {
+			return nil // try again next run
+		}
+	}
+	return r.db.saveFullPass(ar.ac.account, now)
+}
+
+// loadFullPass returns when pa's last full pass
+// was, or the zero time if there was none.
+func (db *boltDB) loadFullPass(pa providerAccount) (time.Time, error) {
+	var t time.Time
+	err := db.View(func(tx *bolt.Tx) error {
+		accountBucket := tx.Bucket(pa.key())
+		if accountBucket == nil {
+			return fmt.Errorf("account '%s' does not exist in DB", pa)
+		}
+		return gobDecode(accountBucket.Get([]byte("full_pass")), &t)
+	})
+	return t, err
+}
+
+// saveFullPass records t as when pa's last full pass was.
+func (db *boltDB) saveFullPass(pa providerAccount, t time.Time) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		accountBucket := tx.Bucket(pa.key())
+		if accountBucket == nil {
+			return fmt.Errorf("account '%s' does not exist in DB", pa)
+		}
+		enc, err := gobEncode(t)
+		if err != nil {
+			return err
+		}
+		return accountBucket.Put([]byte("full_pass"), enc)
+	})
+}
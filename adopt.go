@@ -0,0 +1,177 @@
+package photobak
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// claimForAdoption claims the repo-relative path fpath so that
+// only one collection or item adopts it. It returns false if
+// the path was already claimed.
+func (r *Repository) claimForAdoption(fpath string) bool {
+	r.adoptedMu.Lock()
+	defer r.adoptedMu.Unlock()
+	if r.adopted == nil {
+		r.adopted = make(map[string]struct{})
+	}
+	if _, taken := r.adopted[fpath]; taken {
+		return false
+	}
+	r.adopted[fpath] = struct{}{}
+	return true
+}
+
+// adoptCollectionDir returns the name of the folder in pa's
+// account folder to use for a new collection called name, if
+// a folder of that name already exists and can be adopted.
+func (r *Repository) adoptCollectionDir(pa providerAccount, name string) (string, bool) {
+	name = SafeFilename(name)
+	dirPath := filepath.Join(pa.accountPath(), name)
+	info, err := os.Stat(r.fullPath(dirPath))
+	if err != nil || !info.IsDir() || !r.claimForAdoption(dirPath) {
+		return "", false
+	}
+	repoLog.Infof("Adopting existing folder %s for collection %s", dirPath, name)
+	return name, true
+}
+
+// adoptItem adopts the file that already exists where the new
+// item in ic would be downloaded, if there is one, instead of
+// downloading it. If the item's size is listed (see ListedSizer),
+// or the client implements SizeChecker, the file's size must
+// match the remote item, and if the client implements
+// DownloadVerifier, so must its content. The file is hashed
+// and de-duplicated like a downloaded file would be. It
+// returns true if the item was adopted.
+func (r *Repository) adoptItem(ctx context.Context, ic itemContext) (bool, error) {
+	relPath, err := r.itemPath(ic.ac.account, ic.coll.dirName, ic.item.ItemName(), ic.item.ItemID(), itemTime(ic.item))
+	if err != nil {
+		return false, err
+	}
+	fullPath := r.fullPath(relPath)
+	info, err := os.Lstat(fullPath)
+	if err != nil || !info.Mode().IsRegular() || !r.claimForAdoption(relPath) {
+		return false, nil
+	}
+
+	listed := listedSize(ic.item)
+	if listed >= 0 && listed != info.Size() {
+		repoLog.Infof("Not adopting %s: size is %d bytes but remote item is %d", relPath, info.Size(), listed)
+		return false, nil
+	}
+	if sc, ok := ic.ac.client.(SizeChecker); ok && listed < 0 {
+		remoteSize, err := sc.ItemSize(ctx, ic.item)
+		if err != nil {
+			repoLog.Errorf("checking remote size of %s before adopting it: %v", relPath, err)
+			return false, nil
+		}
+		if remoteSize != info.Size() {
+			repoLog.Infof("Not adopting %s: size is %d bytes but remote item is %d", relPath, info.Size(), remoteSize)
+			return false, nil
+		}
+	}
+
+	same, known, err := r.matchesProvider(ic.ac.client, ic.item, relPath)
+	if err != nil {
+		repoLog.Errorf("checking %s against the provider's checksum before adopting it: %v", relPath, err)
+		return false, nil
+	}
+	if known && !same {
+		repoLog.Infof("Not adopting %s: its content does not match the provider's checksum", relPath)
+		return false, nil
+	}
+
+	checksum, err := r.hash(relPath)
+	if err != nil {
+		return false, fmt.Errorf("hashing %s to adopt it: %v", relPath, err)
+	}
+
+	// as with downloads, missing or bad EXIF data is OK
+	var setting *setting
+	var x *exif.Exif
+	var vm *videoMeta
+	if f, err := os.Open(fullPath); err == nil {
+		x, _ = exif.Decode(f)
+		f.Close()
+		setting, _ = r.getSettingFromEXIF(x)
+	}
+	if x == nil {
+		vm, _ = readVideoMeta(fullPath)
+	}
+
+	meta := itemMeta{Setting: setting, Caption: ic.item.ItemCaption()}
+	describe(&meta, ic.item, x)
+	describeVideo(&meta, vm)
+	if ic.saveEverything {
+		err := r.setItemAPI(&meta, ic.item)
+		if err != nil {
+			return false, fmt.Errorf("storing API data for item: %v", err)
+		}
+	}
+
+	dbi := &dbItem{
+		ID:          ic.item.ItemID(),
+		Name:        ic.item.ItemName(),
+		FileName:    filepath.Base(relPath),
+		FilePath:    relPath,
+		Meta:        meta,
+		Saved:       time.Now(),
+		Collections: map[string]struct{}{ic.coll.id: {}},
+		Checksum:    checksum,
+		Format:      fileFormat(fullPath),
+		PHash:       imageHash(fullPath),
+	}
+	if listed > 0 {
+		dbi.RemoteSize = listed
+	}
+	setChangeKey(r.changeStrategy(ic.ac.account), ic.item, dbi)
+
+	defer r.lockChecksum(checksum)()
+
+	sameItems, err := r.db.itemsWithChecksum(checksum)
+	if err != nil {
+		return false, fmt.Errorf("de-duplicating item '%s': %v", relPath, err)
+	}
+	if len(sameItems) > 0 {
+		sameContent, err := r.db.loadItem(sameItems[0].AcctKey, sameItems[0].ItemID)
+		if err != nil {
+			return false, err
+		}
+		if sameContent.FilePath != relPath {
+			// this file is a copy of one that's already in the
+			// repository; point to that one instead, as if it
+			// had been downloaded
+			repoLog.Infof("The content of %s already exists in repository; de-duplicating", relPath)
+			err := r.writeToMediaListFile(ic.coll, sameContent.FilePath)
+			if err != nil {
+				return false, fmt.Errorf("writing to media list file: %v", err)
+			}
+			dbi.FilePath = sameContent.FilePath
+			err = os.Remove(fullPath)
+			if err != nil {
+				return false, fmt.Errorf("removing duplicate file: %v", err)
+			}
+		}
+	}
+	if dbi.FilePath == relPath && !inDir(relPath, ic.coll.dirPath) {
+		err := r.writeToMediaListFile(ic.coll, relPath)
+		if err != nil {
+			return false, fmt.Errorf("writing to media list file: %v", err)
+		}
+	}
+
+	r.recordFileStat(dbi)
+	err = r.db.saveItem(ic.ac.account.key(), dbi.ID, dbi)
+	if err != nil {
+		return false, fmt.Errorf("saving adopted item '%s' to database: %v", relPath, err)
+	}
+
+	repoLog.Infof("Adopted existing file %s", dbi.FilePath)
+	r.progress(ProgressEvent{Type: ItemCommitted, Account: ic.ac.account.String(), ItemID: dbi.ID, FilePath: dbi.FilePath})
+	return true, nil
+}
@@ -0,0 +1,290 @@
+package photobak
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// AlbumInfoName is the name of the file that is kept in the
+// folder of each collection if the repository has AlbumInfo
+// enabled. It describes the collection in JSON: its title,
+// description, cover, the dates of its items, and its items
+// in the order the provider lists them.
+const AlbumInfoName = "album.json"
+
+// CollectionDescriber is an optional interface a Collection
+// may implement if the provider has a description of it.
+type CollectionDescriber interface {
+	// CollectionDescription returns the description
+	// of the collection, or an empty string if none.
+	CollectionDescription() string
+}
+
+// CollectionCoverer is an optional interface a Collection may
+// implement if the provider shows one of its items as its cover.
+type CollectionCoverer interface {
+	// CollectionCoverID returns the ID of the cover
+	// item, or an empty string if there is none.
+	CollectionCoverID() string
+}
+
+// isGeneratedFile returns true if the file at the repo-relative
+// path fpath is one that photobak generates from the index: a
+// manifest, an album info file, or an XMP sidecar it wrote. Such
+// files don't keep a folder from being removed.
+func (r *Repository) isGeneratedFile(fpath string) bool {
+	switch name := filepath.Base(fpath); {
+	case isManifestName(name), name == AlbumInfoName:
+		return true
+	}
+	return r.wroteXMPSidecar(fpath)
+}
+
+// describeCollection records on meta what the provider
+// says about coll besides its name, if anything.
+func describeCollection(meta *collectionMeta, coll Collection) {
+	meta.Description, meta.Cover = "", ""
+	if cd, ok := coll.(CollectionDescriber); ok {
+		meta.Description = cd.CollectionDescription()
+	}
+	if cc, ok := coll.(CollectionCoverer); ok {
+		meta.Cover = cc.CollectionCoverID()
+	}
+}
+
+// albumInfo is the content of an AlbumInfoName file.
+type albumInfo struct {
+	Title       string          `json:"title"`
+	Description string          `json:"description,omitempty"`
+	Account     string          `json:"account"`
+	ID          string          `json:"id"`
+	Cover       string          `json:"cover,omitempty"` // the file of the cover item, relative to the folder
+	FirstTaken  *time.Time      `json:"first_taken,omitempty"`
+	LastTaken   *time.Time      `json:"last_taken,omitempty"`
+	Updated     time.Time       `json:"updated"` // when items were last added or changed
+	Items       []albumInfoItem `json:"items"`
+}
+
+// albumInfoItem is an item as it is listed in an albumInfo.
+type albumInfoItem struct {
+	File    string     `json:"file"` // relative to the folder; may be in another folder
+	ID      string     `json:"id"`
+	Name    string     `json:"name"`
+	Caption string     `json:"caption,omitempty"`
+	Taken   *time.Time `json:"taken,omitempty"`
+}
+
+// saveOrder records the order in which the items of those
+// of ar's collections that were listed completely were listed.
+func (r *Repository) saveOrder(ar accountRun) error {
+	aliases, err := r.db.loadIDAliases(ar.ac.account)
+	if err != nil {
+		return fmt.Errorf("loading aliases: %v", err)
+	}
+	for _, coll := range ar.collections {
+		run := ar.runs[coll.CollectionID()]
+		if !run.wasListed() || run.id == "" {
+			continue
+		}
+		dbc, err := r.db.loadCollection(ar.ac.account.key(), run.id)
+		if err != nil {
+			return err
+		}
+		if dbc == nil {
+			continue
+		}
+		order := make([]string, 0, len(run.items))
+		for _, li := range run.items {
+			order = append(order, aliases.item(li.id))
+		}
+		if sameOrder(order, dbc.Order) {
+			continue
+		}
+		dbc.Order = order
+		err = r.db.saveCollection(ar.ac.account.key(), dbc.ID, dbc)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sameOrder returns true if a and b are the same IDs in the same order.
+func sameOrder(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// writeAlbumInfos writes an AlbumInfoName file to the folder
+// of each collection. Files that would be the same are not
+// touched.
+func (r *Repository) writeAlbumInfos() error {
+	accounts, err := r.db.storedAccounts()
+	if err != nil {
+		return fmt.Errorf("listing accounts: %v", err)
+	}
+	for _, pa := range accounts {
+		aliases, err := r.db.loadIDAliases(pa)
+		if err != nil {
+			return fmt.Errorf("loading aliases: %v", err)
+		}
+		collIDs, err := r.db.collectionIDs(pa)
+		if err != nil {
+			return err
+		}
+		for _, collID := range collIDs {
+			dbc, err := r.db.loadCollection(pa.key(), collID)
+			if err != nil {
+				return err
+			}
+			if dbc == nil || len(dbc.Items) == 0 {
+				continue
+			}
+			info, err := r.albumInfo(pa, dbc, aliases)
+			if err != nil {
+				return fmt.Errorf("describing collection %s: %v", dbc.Name, err)
+			}
+			err = r.writeAlbumInfo(dbc.DirPath, info)
+			if err != nil {
+				return fmt.Errorf("writing %s of collection %s: %v", AlbumInfoName, dbc.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// albumInfo returns the album info of dbc, which belongs to pa.
+// The items are in the order they were last listed in; items
+// whose order is not known come last, sorted by when they were
+// taken.
+func (r *Repository) albumInfo(pa providerAccount, dbc *dbCollection, aliases idAliases) (albumInfo, error) {
+	info := albumInfo{
+		Title:       dbc.Name,
+		Description: dbc.Meta.Description,
+		Account:     pa.String(),
+		ID:          dbc.ID,
+		Updated:     dbc.Active,
+	}
+
+	itemIDs := make([]string, 0, len(dbc.Items))
+	ordered := make(map[string]bool)
+	for _, itemID := range dbc.Order {
+		if _, ok := dbc.Items[itemID]; ok && !ordered[itemID] {
+			itemIDs = append(itemIDs, itemID)
+			ordered[itemID] = true
+		}
+	}
+	var rest []*dbItem
+	for itemID := range dbc.Items {
+		if ordered[itemID] {
+			continue
+		}
+		dbi, err := r.db.loadItem(pa.key(), itemID)
+		if err != nil {
+			return info, err
+		}
+		if dbi != nil {
+			rest = append(rest, dbi)
+		}
+	}
+	sort.Slice(rest, func(i, j int) bool {
+		ti, tj := itemTaken(rest[i]), itemTaken(rest[j])
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return rest[i].ID < rest[j].ID
+	})
+	for _, dbi := range rest {
+		itemIDs = append(itemIDs, dbi.ID)
+	}
+
+	cover := aliases.item(dbc.Meta.Cover)
+	var firstImage string
+	for _, itemID := range itemIDs {
+		dbi, err := r.db.loadItem(pa.key(), itemID)
+		if err != nil {
+			return info, err
+		}
+		if dbi == nil {
+			continue
+		}
+		rel, err := filepath.Rel(dbc.DirPath, dbi.FilePath)
+		if err != nil {
+			return info, err
+		}
+		it := albumInfoItem{
+			File:    filepath.ToSlash(rel),
+			ID:      dbi.ID,
+			Name:    dbi.Name,
+			Caption: dbi.Meta.Caption,
+		}
+		if taken := itemTaken(dbi); !taken.IsZero() {
+			it.Taken = &taken
+			if info.FirstTaken == nil || taken.Before(*info.FirstTaken) {
+				info.FirstTaken = &taken
+			}
+			if info.LastTaken == nil || taken.After(*info.LastTaken) {
+				info.LastTaken = &taken
+			}
+		}
+		if dbi.ID == cover {
+			info.Cover = it.File
+		}
+		if firstImage == "" && hashableImage(dbi.FilePath) {
+			firstImage = it.File
+		}
+		info.Items = append(info.Items, it)
+	}
+	if info.Cover == "" {
+		info.Cover = firstImage
+	}
+	return info, nil
+}
+
+// writeAlbumInfo writes info into the repo-relative folder
+// dirPath, unless it is already there or one of its items'
+// files has the same name.
+func (r *Repository) writeAlbumInfo(dirPath string, info albumInfo) error {
+	for _, it := range info.Items {
+		if it.File == AlbumInfoName {
+			return nil
+		}
+	}
+	content, err := json.MarshalIndent(info, "", "\t")
+	if err != nil {
+		return err
+	}
+	content = append(content, '\n')
+
+	infoPath := r.fullPath(filepath.Join(dirPath, AlbumInfoName))
+	if existing, err := ioutil.ReadFile(infoPath); err == nil && bytes.Equal(existing, content) {
+		return nil
+	}
+	err = os.MkdirAll(filepath.Dir(infoPath), 0700)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := infoPath + ".tmp"
+	err = ioutil.WriteFile(tmpPath, content, 0600)
+	if err != nil {
+		return err
+	}
+	if r.SyncFriendly {
+		return overwriteFile(tmpPath, infoPath)
+	}
+	return os.Rename(tmpPath, infoPath)
+}
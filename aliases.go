@@ -0,0 +1,347 @@
+package photobak
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/boltdb/bolt"
+)
+
+// IDMapper is an optional interface a Client may implement if its
+// provider has changed the way it identifies items or collections
+// (like Google did when Picasa Web Albums became Google Photos).
+// It lets MapIDs link what is stored under the old IDs to the new
+// ones, so the backup continues without downloading everything
+// again. Providers whose items know their previous ID can implement
+// PreviousIDer instead.
+type IDMapper interface {
+	// MapIDs returns the current IDs of the items and collections
+	// with the given old IDs, keyed by old ID. IDs that it can't
+	// map, or that haven't changed, may be left out.
+	MapIDs(ctx context.Context, itemIDs, collectionIDs []string) (items, collections map[string]string, err error)
+}
+
+// The names of the buckets in each account's bucket that map
+// the current IDs of items and collections to the IDs they
+// are stored under.
+const (
+	itemAliases       = "item_aliases"
+	collectionAliases = "collection_aliases"
+)
+
+// MapIDsReport describes the aliases added by MapIDs.
+type MapIDsReport struct {
+	Items       int      // items linked to their new IDs
+	Collections int      // collections linked to their new IDs
+	Conflicts   []string // new IDs that were not linked because something is already stored under them
+}
+
+// String returns a human-readable report.
+func (mr MapIDsReport) String() string {
+	s := fmt.Sprintf("Linked %d items and %d collections to their new IDs\n", mr.Items, mr.Collections)
+	if len(mr.Conflicts) > 0 {
+		s += fmt.Sprintf("%d IDs were not linked because something else is stored under them:\n", len(mr.Conflicts))
+		for _, c := range mr.Conflicts {
+			s += "  - " + c + "\n"
+		}
+	}
+	return s
+}
+
+// MapIDs finds the current IDs of the stored items and collections
+// of every configured account whose provider identifies them
+// differently now, and records them as aliases of the stored IDs.
+// From then on, items and collections listed with their new IDs are
+// treated as the ones stored under the old IDs. The IDs are mapped
+// by the client if it implements IDMapper, or else by listing the
+// items and asking those that implement PreviousIDer. Unlike
+// RemapItemIDs, it doesn't change the stored records.
+func (r *Repository) MapIDs(ctx context.Context) (MapIDsReport, error) {
+	var report MapIDsReport
+
+	accounts, err := r.authorizedAccounts()
+	if err != nil {
+		return report, err
+	}
+
+	for _, ac := range accounts {
+		items, colls, err := r.mapAccountIDs(ctx, ac)
+		if err != nil {
+			return report, fmt.Errorf("%s: mapping IDs: %v", ac.account, err)
+		}
+		n, err := r.addAliases(ac.account, itemAliases, items, &report)
+		if err != nil {
+			return report, fmt.Errorf("%s: saving item aliases: %v", ac.account, err)
+		}
+		report.Items += n
+		n, err = r.addAliases(ac.account, collectionAliases, colls, &report)
+		if err != nil {
+			return report, fmt.Errorf("%s: saving collection aliases: %v", ac.account, err)
+		}
+		report.Collections += n
+	}
+
+	return report, nil
+}
+
+// mapAccountIDs returns maps of the old IDs of ac's stored items
+// and collections to their current IDs, for those that changed.
+func (r *Repository) mapAccountIDs(ctx context.Context, ac accountClient) (items, colls map[string]string, err error) {
+	mapper, ok := ac.client.(IDMapper)
+	if !ok {
+		items, err = r.remoteIDMapping(ctx, ac)
+		return items, nil, err
+	}
+
+	itemIDs, err := r.db.itemIDs(ac.account)
+	if err != nil {
+		return nil, nil, err
+	}
+	collIDs, err := r.db.collectionIDs(ac.account)
+	if err != nil {
+		return nil, nil, err
+	}
+	return mapper.MapIDs(ctx, itemIDs, collIDs)
+}
+
+// addAliases records the current IDs in mapping, which maps old
+// IDs to current IDs, as aliases of the old IDs in pa's bucket of
+// aliases called bucket, if something is stored under the old ID
+// and nothing under the current one. It returns how many aliases
+// were added, and records conflicts in report.
+func (r *Repository) addAliases(pa providerAccount, bucket string, mapping map[string]string, report *MapIDsReport) (int, error) {
+	oldIDs := make([]string, 0, len(mapping))
+	for oldID := range mapping {
+		oldIDs = append(oldIDs, oldID)
+	}
+	sort.Strings(oldIDs)
+
+	stored := func(id string) (bool, error) {
+		dbi, err := r.db.loadItem(pa.key(), id)
+		return dbi != nil, err
+	}
+	if bucket == collectionAliases {
+		stored = func(id string) (bool, error) {
+			dbc, err := r.db.loadCollection(pa.key(), id)
+			return dbc != nil, err
+		}
+	}
+
+	aliases := make(map[string]string)
+	for _, oldID := range oldIDs {
+		newID := mapping[oldID]
+		if newID == "" || newID == oldID {
+			continue
+		}
+		oldStored, err := stored(oldID)
+		if err != nil {
+			return 0, err
+		}
+		if !oldStored {
+			continue // not stored, or already renamed
+		}
+		newStored, err := stored(newID)
+		if err != nil {
+			return 0, err
+		}
+		if newStored {
+			repoLog.Errorf("%s: not linking %s to %s: something is already stored under it", pa, oldID, newID)
+			report.Conflicts = append(report.Conflicts, pa.String()+" "+newID)
+			continue
+		}
+		aliases[newID] = oldID
+	}
+
+	return len(aliases), r.db.saveAliases(pa, bucket, aliases)
+}
+
+// storedItemID returns the ID under which the item in ic, as
+// listed for its account, is stored: its own ID, unless it is an
+// alias of another item's. If nothing is stored under either, but
+// it implements PreviousIDer and something is stored under its
+// previous ID, or Reindex made up an ID for its file, its ID is
+// made an alias of that one, which is returned.
+func (r *Repository) storedItemID(ic itemContext) (string, error) {
+	pa, it := ic.ac.account, ic.item
+	itemID := it.ItemID()
+	stored, err := r.db.loadItem(pa.key(), itemID)
+	if err != nil || stored != nil {
+		return itemID, err
+	}
+
+	alias, err := r.db.loadAlias(pa, itemAliases, itemID)
+	if err != nil {
+		return itemID, err
+	}
+	if alias != "" {
+		stored, err := r.db.loadItem(pa.key(), alias)
+		if err != nil || stored != nil {
+			return alias, err
+		}
+	}
+
+	prevID := r.reindexedItemID(ic)
+	if pi, ok := it.(PreviousIDer); ok && pi.PreviousItemID() != "" && pi.PreviousItemID() != itemID {
+		prevID = pi.PreviousItemID()
+	}
+	if prevID == "" {
+		return itemID, nil
+	}
+	stored, err = r.db.loadItem(pa.key(), prevID)
+	if err != nil || stored == nil {
+		return itemID, err
+	}
+	err = r.db.saveAliases(pa, itemAliases, map[string]string{itemID: prevID})
+	if err != nil {
+		return itemID, fmt.Errorf("saving alias of item %s: %v", prevID, err)
+	}
+	repoLog.Infof("%s: item %s is now known as %s", pa, prevID, itemID)
+	return prevID, nil
+}
+
+// storedCollectionID returns the ID under which the collection
+// coll, as listed for pa, is stored: its own ID, unless it is an
+// alias of another collection's. If nothing is stored under
+// either, but Reindex made up an ID for its folder, its ID is
+// made an alias of that one, which is returned.
+func (r *Repository) storedCollectionID(pa providerAccount, coll Collection) (string, error) {
+	collID := coll.CollectionID()
+	stored, err := r.db.loadCollection(pa.key(), collID)
+	if err != nil || stored != nil {
+		return collID, err
+	}
+	alias, err := r.db.loadAlias(pa, collectionAliases, collID)
+	if err != nil {
+		return collID, err
+	}
+	if alias != "" {
+		stored, err = r.db.loadCollection(pa.key(), alias)
+		if err != nil || stored != nil {
+			return alias, err
+		}
+	}
+
+	prevID := reindexedCollectionID(pa, coll.CollectionName())
+	stored, err = r.db.loadCollection(pa.key(), prevID)
+	if err != nil || stored == nil {
+		return collID, err
+	}
+	err = r.db.saveAliases(pa, collectionAliases, map[string]string{collID: prevID})
+	if err != nil {
+		return collID, fmt.Errorf("saving alias of collection %s: %v", prevID, err)
+	}
+	repoLog.Infof("%s: collection %s is now known as %s", pa, prevID, collID)
+	return prevID, nil
+}
+
+// idAliases maps the current IDs of an account's items
+// and collections to the IDs they are stored under.
+type idAliases struct {
+	items, collections map[string]string
+}
+
+// item returns the ID under which the item with ID itemID is stored.
+func (a idAliases) item(itemID string) string {
+	if stored, ok := a.items[itemID]; ok {
+		return stored
+	}
+	return itemID
+}
+
+// collection returns the ID under which the
+// collection with ID collID is stored.
+func (a idAliases) collection(collID string) string {
+	if stored, ok := a.collections[collID]; ok {
+		return stored
+	}
+	return collID
+}
+
+// itemIDs returns the IDs that the listed item it may be
+// stored under: the one its ID is an alias of (or its ID),
+// and its previous ID, if it implements PreviousIDer.
+func (a idAliases) itemIDs(it Item) []string {
+	ids := []string{a.item(it.ItemID())}
+	if pi, ok := it.(PreviousIDer); ok {
+		if prevID := pi.PreviousItemID(); prevID != "" && prevID != ids[0] {
+			ids = append(ids, prevID)
+		}
+	}
+	return ids
+}
+
+// loadIDAliases loads all of pa's aliases.
+func (db *boltDB) loadIDAliases(pa providerAccount) (idAliases, error) {
+	var a idAliases
+	var err error
+	a.items, err = db.loadAliases(pa, itemAliases)
+	if err != nil {
+		return a, err
+	}
+	a.collections, err = db.loadAliases(pa, collectionAliases)
+	return a, err
+}
+
+// loadAlias returns the ID that id is an alias of in
+// pa's bucket of aliases called bucket, or "" if none.
+func (db *boltDB) loadAlias(pa providerAccount, bucket, id string) (string, error) {
+	var alias string
+	err := db.View(func(tx *bolt.Tx) error {
+		accountBucket := tx.Bucket(pa.key())
+		if accountBucket == nil {
+			return fmt.Errorf("account '%s' does not exist in DB", pa)
+		}
+		if aliases := accountBucket.Bucket([]byte(bucket)); aliases != nil {
+			alias = string(aliases.Get([]byte(id)))
+		}
+		return nil
+	})
+	return alias, err
+}
+
+// loadAliases returns all the aliases in pa's
+// bucket of aliases called bucket.
+func (db *boltDB) loadAliases(pa providerAccount, bucket string) (map[string]string, error) {
+	all := make(map[string]string)
+	err := db.View(func(tx *bolt.Tx) error {
+		accountBucket := tx.Bucket(pa.key())
+		if accountBucket == nil {
+			return fmt.Errorf("account '%s' does not exist in DB", pa)
+		}
+		aliases := accountBucket.Bucket([]byte(bucket))
+		if aliases == nil {
+			return nil
+		}
+		return aliases.ForEach(func(k, v []byte) error {
+			all[string(k)] = string(v)
+			return nil
+		})
+	})
+	return all, err
+}
+
+// saveAliases adds aliases, which maps current IDs to the IDs
+// they are stored under, to pa's bucket of aliases called bucket.
+func (db *boltDB) saveAliases(pa providerAccount, bucket string, aliases map[string]string) error {
+	if len(aliases) == 0 {
+		return nil
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		accountBucket := tx.Bucket(pa.key())
+		if accountBucket == nil {
+			return fmt.Errorf("account '%s' does not exist in DB", pa)
+		}
+		b, err := accountBucket.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		for id, stored := range aliases {
+			err := b.Put([]byte(id), []byte(stored))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
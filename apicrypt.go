@@ -0,0 +1,270 @@
+package photobak
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/boltdb/bolt"
+)
+
+// APIKeySize is the required length of a key
+// used to encrypt API metadata (AES-256).
+const APIKeySize = 32
+
+// apiBlob wraps the full API value of an item or collection
+// so that it can be encoded before being encrypted.
+type apiBlob struct {
+	Item       Item
+	Collection Collection
+}
+
+// sealedAPIRecord is an apiBlob as it is encoded before being
+// encrypted. Values encrypted by older versions are gob-encoded
+// apiBlobs instead, which can still be read.
+type sealedAPIRecord struct {
+	Item       *apiRecord `json:"item,omitempty"`
+	Collection *apiRecord `json:"collection,omitempty"`
+}
+
+// setItemAPI stores it as the full API value in meta,
+// encrypting it if the repository has an API key.
+func (r *Repository) setItemAPI(meta *itemMeta, it Item) error {
+	if r.APIKey == nil {
+		meta.API = it
+		return nil
+	}
+	sealed, err := r.sealAPI(apiBlob{Item: it})
+	if err != nil {
+		return err
+	}
+	meta.API, meta.SealedAPI = nil, sealed
+	return nil
+}
+
+// setCollectionAPI stores coll as the full API value in meta,
+// encrypting it if the repository has an API key.
+func (r *Repository) setCollectionAPI(meta *collectionMeta, coll Collection) error {
+	if r.APIKey == nil {
+		meta.API = coll
+		return nil
+	}
+	sealed, err := r.sealAPI(apiBlob{Collection: coll})
+	if err != nil {
+		return err
+	}
+	meta.API, meta.SealedAPI = nil, sealed
+	return nil
+}
+
+// itemAPI returns the full API value stored for the item
+// itemID of acctKey's account, if any, decrypting it if
+// necessary. It returns nil if the value's type is not
+// registered (see RegisterAPIType).
+func (r *Repository) itemAPI(acctKey []byte, itemID string) (Item, error) {
+	blob, err := r.loadAPI(acctKey, apiMetaItems, itemID)
+	if err != nil {
+		return nil, fmt.Errorf("API data of item %s: %v", itemID, err)
+	}
+	return blob.Item, nil
+}
+
+// collectionAPI returns the full API value stored for the
+// collection collID of acctKey's account, if any, decrypting
+// it if necessary.
+func (r *Repository) collectionAPI(acctKey []byte, collID string) (Collection, error) {
+	blob, err := r.loadAPI(acctKey, apiMetaCollections, collID)
+	if err != nil {
+		return nil, fmt.Errorf("API data of collection %s: %v", collID, err)
+	}
+	return blob.Collection, nil
+}
+
+// loadAPI loads the API value of the item or collection id of the
+// given kind in acctKey's account into the matching field of the
+// returned blob. It is left empty if nothing is stored.
+func (r *Repository) loadAPI(acctKey []byte, kind, id string) (apiBlob, error) {
+	var blob apiBlob
+	rec, err := r.db.loadAPIMeta(acctKey, kind, id)
+	if err != nil || rec == nil {
+		return blob, err
+	}
+	if rec.Sealed != nil {
+		blob, err = r.openAPI(rec.Sealed)
+		if err != nil {
+			return blob, fmt.Errorf("decrypting: %v", err)
+		}
+		return blob, nil
+	}
+	if rec.API == nil {
+		return blob, nil
+	}
+	api, err := decodeAPI(rec.API)
+	if err != nil {
+		return blob, err
+	}
+	if kind == apiMetaItems {
+		blob.Item, _ = api.(Item)
+	} else {
+		blob.Collection, _ = api.(Collection)
+	}
+	return blob, nil
+}
+
+// sealAPI encodes and encrypts blob with the API key.
+func (r *Repository) sealAPI(blob apiBlob) ([]byte, error) {
+	if len(r.APIKey) != APIKeySize {
+		return nil, fmt.Errorf("API key must be %d bytes, got %d", APIKeySize, len(r.APIKey))
+	}
+	var rec sealedAPIRecord
+	var err error
+	if blob.Item != nil {
+		if rec.Item, err = encodeAPI(blob.Item); err != nil {
+			return nil, err
+		}
+	}
+	if blob.Collection != nil {
+		if rec.Collection, err = encodeAPI(blob.Collection); err != nil {
+			return nil, err
+		}
+	}
+	plain, err := json.Marshal(rec)
+	if err != nil {
+		return nil, fmt.Errorf("encoding API data: %v", err)
+	}
+	return seal(r.APIKey, plain, nil)
+}
+
+// openAPI decrypts and decodes a value made by sealAPI.
+func (r *Repository) openAPI(sealed []byte) (apiBlob, error) {
+	var blob apiBlob
+	if r.APIKey == nil {
+		return blob, fmt.Errorf("API data is encrypted but no key was given")
+	}
+	if len(r.APIKey) != APIKeySize {
+		return blob, fmt.Errorf("API key must be %d bytes, got %d", APIKeySize, len(r.APIKey))
+	}
+	plain, err := unseal(r.APIKey, sealed, nil)
+	if err != nil {
+		return blob, err
+	}
+	if !json.Valid(plain) {
+		err = gobDecode(plain, &blob)
+		return blob, err
+	}
+	var rec sealedAPIRecord
+	err = json.Unmarshal(plain, &rec)
+	if err != nil {
+		return blob, err
+	}
+	if rec.Item != nil {
+		api, err := decodeAPI(rec.Item)
+		if err != nil {
+			return blob, err
+		}
+		blob.Item, _ = api.(Item)
+	}
+	if rec.Collection != nil {
+		api, err := decodeAPI(rec.Collection)
+		if err != nil {
+			return blob, err
+		}
+		blob.Collection, _ = api.(Collection)
+	}
+	return blob, nil
+}
+
+// seal encrypts plain with key using AES-GCM, which also
+// authenticates extra (if any) without encrypting it. The
+// random nonce is prepended to the returned ciphertext.
+func seal(key, plain, extra []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, extra), nil
+}
+
+// unseal decrypts a value made by seal with
+// the same key and extra data.
+func unseal(key, sealed, extra []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("encrypted data is too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, extra)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// KeyID returns the ID of the repository's key for the given
+// purpose, like "api" or "signing", by which a program can find
+// the key where it keeps it, like in the OS keyring. The ID is
+// random and kept in the database, so unlike the path of the
+// repository, it stays the same when the repository is moved.
+// It is made by the first call for the purpose.
+func (r *Repository) KeyID(purpose string) (string, error) {
+	name := purpose + "_key_id"
+	id, err := r.db.loadSetting(name)
+	if err != nil || id != "" {
+		return id, err
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id = hex.EncodeToString(b)
+	return id, r.db.saveSetting(name, id)
+}
+
+// HasSealedAPI returns true if the repository has API data
+// that was encrypted with an API key (see APIKey), so that
+// a program can tell that a key it doesn't have is needed.
+func (r *Repository) HasSealedAPI() (bool, error) {
+	accounts, err := r.db.storedAccounts()
+	if err != nil {
+		return false, err
+	}
+	var sealed bool
+	err = r.db.View(func(tx *bolt.Tx) error {
+		for _, pa := range accounts {
+			accountBucket := tx.Bucket(pa.key())
+			if accountBucket == nil {
+				continue
+			}
+			for _, kind := range []string{apiMetaItems, apiMetaCollections} {
+				bucket := apiMetaKindBucket(accountBucket, kind)
+				if bucket == nil {
+					continue
+				}
+				c := bucket.Cursor()
+				for k, v := c.First(); k != nil && !sealed; k, v = c.Next() {
+					var rec apiMetaRecord
+					if json.Unmarshal(v, &rec) == nil && rec.Sealed != nil {
+						sealed = true
+					}
+				}
+			}
+		}
+		return nil
+	})
+	return sealed, err
+}
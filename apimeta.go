@@ -0,0 +1,171 @@
+package photobak
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// apiMetaBucket is the name of the bucket in each account's bucket
+// that holds the full API values of its items and collections (see
+// the saveEverything argument of Store), in a sub-bucket for each
+// kind, by ID. They are kept apart from the items and collections
+// so that loading those doesn't have to decode them too.
+const apiMetaBucket = "apimeta"
+
+// The kinds of values in the apimeta bucket.
+const (
+	apiMetaItems       = "items"
+	apiMetaCollections = "collections"
+)
+
+// apiMetaRecord is an API value as it is stored in the apimeta
+// bucket: either as it is, or encrypted (see sealAPI).
+type apiMetaRecord struct {
+	Version int        `json:"v"`
+	API     *apiRecord `json:"api,omitempty"`
+	Sealed  []byte     `json:"sealed,omitempty"`
+}
+
+// putAPIMeta stores api, or if it is nil, sealed, as the API value
+// of the item or collection id of the given kind in accountBucket.
+// If both are nil, the stored value (if any) is left alone, since
+// items and collections are usually saved without their API values.
+func putAPIMeta(accountBucket *bolt.Bucket, kind, id string, api interface{}, sealed []byte) error {
+	if api == nil && sealed == nil {
+		return nil
+	}
+	rec := apiMetaRecord{Version: recordVersion}
+	if api != nil {
+		var err error
+		rec.API, err = encodeAPI(api)
+		if err != nil {
+			return err
+		}
+	} else {
+		rec.Sealed = sealed
+	}
+	return putAPIMetaRecord(accountBucket, kind, id, rec)
+}
+
+// putAPIMetaRecord stores rec under id in the
+// bucket of the given kind in accountBucket.
+func putAPIMetaRecord(accountBucket *bolt.Bucket, kind, id string, rec apiMetaRecord) error {
+	enc, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("encoding API data of %s: %v", id, err)
+	}
+	apiMeta, err := accountBucket.CreateBucketIfNotExists([]byte(apiMetaBucket))
+	if err != nil {
+		return err
+	}
+	bucket, err := apiMeta.CreateBucketIfNotExists([]byte(kind))
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(id), enc)
+}
+
+// apiMetaKindBucket returns the bucket of the given kind
+// in accountBucket's apimeta bucket, or nil if there is none.
+func apiMetaKindBucket(accountBucket *bolt.Bucket, kind string) *bolt.Bucket {
+	apiMeta := accountBucket.Bucket([]byte(apiMetaBucket))
+	if apiMeta == nil {
+		return nil
+	}
+	return apiMeta.Bucket([]byte(kind))
+}
+
+// deleteAPIMeta deletes the API value of the item or
+// collection id of the given kind in accountBucket.
+func deleteAPIMeta(accountBucket *bolt.Bucket, kind, id string) error {
+	bucket := apiMetaKindBucket(accountBucket, kind)
+	if bucket == nil {
+		return nil
+	}
+	return bucket.Delete([]byte(id))
+}
+
+// moveAPIMeta moves the API value of the item or collection
+// oldID of the given kind to newID, unless newID already
+// has one, in which case that one is kept.
+func moveAPIMeta(accountBucket *bolt.Bucket, kind, oldID, newID string) error {
+	bucket := apiMetaKindBucket(accountBucket, kind)
+	if bucket == nil {
+		return nil
+	}
+	if v := bucket.Get([]byte(oldID)); v != nil && bucket.Get([]byte(newID)) == nil {
+		err := bucket.Put([]byte(newID), append([]byte(nil), v...))
+		if err != nil {
+			return err
+		}
+	}
+	return bucket.Delete([]byte(oldID))
+}
+
+// loadAPIMeta loads the stored API value of the item or collection
+// id of the given kind in acctKey's account. It returns nil if
+// there is none.
+func (db *boltDB) loadAPIMeta(acctKey []byte, kind, id string) (*apiMetaRecord, error) {
+	var rec *apiMetaRecord
+	err := db.View(func(tx *bolt.Tx) error {
+		accountBucket := tx.Bucket(acctKey)
+		if accountBucket == nil {
+			return fmt.Errorf("account '%s' does not exist in DB", acctKey)
+		}
+		bucket := apiMetaKindBucket(accountBucket, kind)
+		if bucket == nil {
+			return nil
+		}
+		v := bucket.Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		rec = new(apiMetaRecord)
+		return json.Unmarshal(v, rec)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("loading API data of %s: %v", id, err)
+	}
+	return rec, nil
+}
+
+// PurgeAPIMeta deletes the full API values stored for the items and
+// collections of the given accounts ("provider:username"), or of
+// all accounts if none are given, and returns how many it deleted.
+// Nothing else is changed. Later runs with saveEverything (see
+// Store) store the values again. The database file does not get
+// smaller, but the space is reused.
+func (r *Repository) PurgeAPIMeta(accounts []string) (int, error) {
+	stored, err := r.db.storedAccounts()
+	if err != nil {
+		return 0, fmt.Errorf("listing accounts: %v", err)
+	}
+	var n int
+	for _, pa := range stored {
+		if !accountSelected(accounts, pa) {
+			continue
+		}
+		err := r.db.Update(func(tx *bolt.Tx) error {
+			accountBucket := tx.Bucket(pa.key())
+			if accountBucket == nil {
+				return nil
+			}
+			apiMeta := accountBucket.Bucket([]byte(apiMetaBucket))
+			if apiMeta == nil {
+				return nil
+			}
+			for _, kind := range []string{apiMetaItems, apiMetaCollections} {
+				if bucket := apiMeta.Bucket([]byte(kind)); bucket != nil {
+					n += bucket.Stats().KeyN
+				}
+			}
+			return accountBucket.DeleteBucket([]byte(apiMetaBucket))
+		})
+		if err != nil {
+			return n, fmt.Errorf("%s: deleting API data: %v", pa, err)
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,80 @@
+package photobak
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// HeadlessAuth makes providers that authorize accounts with
+// OAuth print the link to grant access instead of opening a
+// browser, and ask for the address the browser was sent to
+// afterward (see ReadAuthorizationCode). This way accounts can
+// be authorized over SSH, on a machine with no browser.
+var HeadlessAuth bool
+
+// ReadAuthorizationCode asks the user to open authURL in a
+// browser on any device to authorize the account username, and
+// to paste the address of the page that the browser is sent to
+// afterward, which won't load unless that device is this one. It
+// returns the authorization code from that address, which must
+// have the given state. The code itself may be pasted instead.
+func ReadAuthorizationCode(username, authURL, state string) (string, error) {
+	fmt.Println(Tr("To authorize %s, open this link in a browser on any device:", username))
+	fmt.Printf("\n%s\n\n", authURL)
+	fmt.Println(Tr("After you grant access, the browser is sent to a page on localhost\n" +
+		"that probably won't load. Copy the whole address of that page from\n" +
+		"the address bar and paste it here."))
+	fmt.Print(Tr("Address: "))
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("reading address: %v", err)
+	}
+	return parseAuthorizationResponse(line, state)
+}
+
+// parseAuthorizationResponse returns the authorization code
+// from input, which is either the address of the OAuth2
+// callback with the code and the expected state in its
+// query string, or the code alone.
+func parseAuthorizationResponse(input, state string) (string, error) {
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return "", fmt.Errorf("no address given")
+	}
+	if !strings.ContainsAny(input, "?=") && !strings.Contains(input, "://") {
+		if strings.ContainsAny(input, " \t") {
+			return "", fmt.Errorf("not an address or authorization code: %s", input)
+		}
+		return input, nil // just the code
+	}
+
+	query := input
+	if i := strings.Index(input, "?"); i >= 0 {
+		query = input[i+1:]
+	}
+	if i := strings.Index(query, "#"); i >= 0 {
+		query = query[:i]
+	}
+	vals, err := url.ParseQuery(query)
+	if err != nil {
+		return "", fmt.Errorf("parsing address: %v", err)
+	}
+	if e := vals.Get("error"); e != "" {
+		if desc := vals.Get("error_description"); desc != "" {
+			e += ": " + desc
+		}
+		return "", fmt.Errorf("authorization failed: %s", e)
+	}
+	if vals.Get("state") != state {
+		return "", fmt.Errorf("invalid OAuth2 state; expected '%s' but got '%s'", state, vals.Get("state"))
+	}
+	code := vals.Get("code")
+	if code == "" {
+		return "", fmt.Errorf("no authorization code in address")
+	}
+	return code, nil
+}
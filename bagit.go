@@ -0,0 +1,104 @@
+package photobak
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// bagArchive is an archiveWriter that makes the archive a BagIt
+// bag (RFC 8493): files are added to the bag's payload folder
+// and checksummed as they are written, and the bag declaration,
+// bag-info.txt, and the manifests are added when it is closed.
+type bagArchive struct {
+	archiveWriter
+	name     string            // name of the bag's top folder
+	manifest map[string]string // hex-encoded sha256 of payload files, by path in bag
+	octets   int64             // total size of payload
+}
+
+func newBagArchive(archive archiveWriter, name string) *bagArchive {
+	return &bagArchive{
+		archiveWriter: archive,
+		name:          name,
+		manifest:      make(map[string]string),
+	}
+}
+
+func (b *bagArchive) add(name string, size int64, modTime time.Time, r io.Reader) error {
+	bagPath := path.Join("data", name)
+	h := sha256.New()
+	err := b.archiveWriter.add(path.Join(b.name, bagPath), size, modTime, io.TeeReader(r, h))
+	if err != nil {
+		return err
+	}
+	b.manifest[bagPath] = hex.EncodeToString(h.Sum(nil))
+	b.octets += size
+	return nil
+}
+
+// Close adds the tag files to the bag and closes the archive.
+func (b *bagArchive) Close() error {
+	err := b.addTagFiles()
+	if closeErr := b.archiveWriter.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// addTagFiles adds the bag declaration, bag-info.txt, and
+// the payload and tag manifests to the bag.
+func (b *bagArchive) addTagFiles() error {
+	now := time.Now()
+	tags := make(map[string]string)
+
+	tagFiles := []struct {
+		name     string
+		contents []byte
+	}{
+		{"bagit.txt", []byte("BagIt-Version: 1.0\nTag-File-Character-Encoding: UTF-8\n")},
+		{"bag-info.txt", []byte(fmt.Sprintf("Bag-Software-Agent: photobak\nBagging-Date: %s\nPayload-Oxum: %d.%d\n",
+			now.Format("2006-01-02"), b.octets, len(b.manifest)))},
+		{"manifest-sha256.txt", bagManifest(b.manifest)},
+	}
+	for _, tf := range tagFiles {
+		err := b.addTagFile(tf.name, tf.contents, now)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(tf.contents)
+		tags[tf.name] = hex.EncodeToString(sum[:])
+	}
+
+	return b.addTagFile("tagmanifest-sha256.txt", bagManifest(tags), now)
+}
+
+func (b *bagArchive) addTagFile(name string, contents []byte, modTime time.Time) error {
+	return b.archiveWriter.add(path.Join(b.name, name), int64(len(contents)), modTime, bytes.NewReader(contents))
+}
+
+// bagManifest returns the contents of a BagIt manifest
+// listing the files and checksums in sums.
+func bagManifest(sums map[string]string) []byte {
+	paths := make([]string, 0, len(sums))
+	for fpath := range sums {
+		paths = append(paths, fpath)
+	}
+	sort.Strings(paths)
+
+	// as required by the spec, escape characters that
+	// would break up lines (and the escape character)
+	escaper := strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A")
+
+	var buf bytes.Buffer
+	for _, fpath := range paths {
+		fmt.Fprintf(&buf, "%s  %s\n", sums[fpath], escaper.Replace(fpath))
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,164 @@
+package photobak
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// DiskFullError is returned by Store when new items were not
+// downloaded because the repository reached MaxDisk.
+type DiskFullError struct {
+	Max     int64 // MaxDisk
+	Used    int64 // how many bytes the repository takes up
+	Needed  int64 // the total size of the items that were not downloaded, as far as it is known
+	Items   int   // how many items were not downloaded
+	Unknown int   // how many of those are of unknown size
+}
+
+func (e DiskFullError) Error() string {
+	return fmt.Sprintf("repository reached its maximum size of %d bytes (it takes %d); %d new items were not downloaded, "+
+		"which need at least %d bytes more (%d are of unknown size)", e.Max, e.Used, e.Items, e.Needed, e.Unknown)
+}
+
+// errOverBudget is returned by processItem when a new item
+// is not downloaded because it doesn't fit in MaxDisk.
+var errOverBudget = errors.New("repository would be larger than its maximum size")
+
+// diskBudget keeps track of how much of MaxDisk the repository
+// uses during a run. Once an item doesn't fit, no more new
+// items are downloaded, so that the ones that come first (see
+// AlbumOrder) are the ones that fit; the rest are counted so
+// that the run can tell how much more space they need.
+type diskBudget struct {
+	mu      sync.Mutex
+	max     int64
+	used    int64
+	full    bool
+	needed  int64
+	items   int
+	unknown int
+}
+
+// newDiskBudget returns the budget of the repository at
+// path, which may take up to max bytes.
+func newDiskBudget(path string, max int64) (*diskBudget, error) {
+	used, err := diskUsage(path)
+	if err != nil {
+		return nil, fmt.Errorf("measuring repository size: %v", err)
+	}
+	return &diskBudget{max: max, used: used}, nil
+}
+
+// diskUsage returns the total size of the files in dir.
+func diskUsage(dir string) (int64, error) {
+	var total int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+// fits returns true if a new item of size bytes (or, if size
+// is negative, of unknown size) may be downloaded. If it
+// doesn't fit, it is counted as not downloaded. A nil budget
+// fits everything.
+func (b *diskBudget) fits(size int64) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.full && (size < 0 || b.used+size <= b.max) {
+		return true
+	}
+	b.full = true
+	b.skip(size)
+	return false
+}
+
+// skip counts an item of size bytes that was not downloaded
+// (if size is negative, it is unknown); b.mu must be locked.
+func (b *diskBudget) skip(size int64) {
+	b.items++
+	if size < 0 {
+		b.unknown++
+	} else {
+		b.needed += size
+	}
+}
+
+// stopped counts an item of unknown size whose download was
+// stopped by the budget after n bytes, which are given back.
+func (b *diskBudget) stopped(n int64) {
+	b.mu.Lock()
+	b.used -= n
+	b.full = true
+	b.items++
+	b.unknown++
+	b.needed += n
+	b.mu.Unlock()
+}
+
+// release gives back n bytes that were written by
+// a download that failed and was removed.
+func (b *diskBudget) release(n int64) {
+	b.mu.Lock()
+	b.used -= n
+	b.mu.Unlock()
+}
+
+// err returns a DiskFullError if any items didn't fit.
+func (b *diskBudget) err() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.full {
+		return nil
+	}
+	return DiskFullError{Max: b.max, Used: b.used, Needed: b.needed, Items: b.items, Unknown: b.unknown}
+}
+
+// budgetWriter is a writer that takes what is written to it
+// out of a budget, and fails once the budget runs out. If
+// the budget is nil, it has no limit.
+type budgetWriter struct {
+	b        *diskBudget
+	n        int64
+	exceeded bool
+}
+
+// giveBack gives back to the budget what was written.
+func (bw *budgetWriter) giveBack() {
+	if bw.b != nil {
+		bw.b.release(bw.n)
+		bw.n = 0
+	}
+}
+
+// Write takes p out of the budget, or returns
+// errOverBudget if it doesn't fit.
+func (bw *budgetWriter) Write(p []byte) (int, error) {
+	if bw.b == nil {
+		return len(p), nil
+	}
+	bw.b.mu.Lock()
+	defer bw.b.mu.Unlock()
+	if bw.b.used+int64(len(p)) > bw.b.max {
+		bw.exceeded = true
+		return 0, errOverBudget
+	}
+	bw.b.used += int64(len(p))
+	bw.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,214 @@
+package photobak
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// CertificatesDir is the folder in the root of the repository
+// where Certify writes certificates. Its contents are ignored
+// by photobak.
+const CertificatesDir = "_certificates"
+
+// Certificate is a signed summary of what the repository contained
+// when it was made. It is written as JSON next to a copy of the
+// repository's manifest (in the format of ManifestName), which it
+// commits to by the root of a hash tree over the manifest's lines.
+// Anyone who trusts the public key can later check with
+// VerifyCertificate that the manifest is the one that was certified,
+// and with the manifest, that files are what they were.
+type Certificate struct {
+	Created      time.Time `json:"created"`
+	Accounts     int       `json:"accounts"`
+	Collections  int       `json:"collections"`
+	Items        int       `json:"items"`
+	Files        int       `json:"files"`
+	Bytes        int64     `json:"bytes"`              // total size of the files
+	Checksum     string    `json:"checksum,omitempty"` // algorithm of the checksums in the manifest; SHA-256 if empty
+	ManifestRoot string    `json:"manifest_root"`      // hex; see manifestRoot
+	PublicKey    string    `json:"public_key"`         // hex ed25519 public key
+	Signature    string    `json:"signature,omitempty"`
+}
+
+// signedBytes returns what the signature of c is made over:
+// c encoded as JSON without its signature.
+func (c Certificate) signedBytes() ([]byte, error) {
+	c.Signature = ""
+	return json.Marshal(c)
+}
+
+// Certify verifies the repository (see Verify) and, if it has no
+// problems, writes a certificate of its contents signed with key,
+// and the manifest it commits to, into CertificatesDir. It returns
+// the certificate and the repo-relative path of its file; the
+// manifest's path is the same, without ".json".
+func (r *Repository) Certify(key ed25519.PrivateKey) (Certificate, string, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return Certificate{}, "", fmt.Errorf("signing key must be %d bytes", ed25519.PrivateKeySize)
+	}
+
+	report, err := r.Verify()
+	if err != nil {
+		return Certificate{}, "", fmt.Errorf("verifying repository: %v", err)
+	}
+	if len(report.Problems) > 0 {
+		return Certificate{}, "", fmt.Errorf("repository has %d problems; not certifying", len(report.Problems))
+	}
+
+	cert := Certificate{Created: time.Now().UTC().Truncate(time.Second), Checksum: r.checksumAlgo}
+	sums, err := r.certifiedSums(&cert)
+	if err != nil {
+		return cert, "", err
+	}
+	for fpath := range sums {
+		info, err := os.Stat(r.fullPath(fpath))
+		if err != nil {
+			return cert, "", err
+		}
+		cert.Bytes += info.Size()
+	}
+	cert.Files = len(sums)
+	manifest := manifestContent(sums)
+	cert.ManifestRoot = hex.EncodeToString(manifestRoot(manifest))
+	cert.PublicKey = hex.EncodeToString(key.Public().(ed25519.PublicKey))
+
+	msg, err := cert.signedBytes()
+	if err != nil {
+		return cert, "", err
+	}
+	cert.Signature = hex.EncodeToString(ed25519.Sign(key, msg))
+
+	certJSON, err := json.MarshalIndent(cert, "", "\t")
+	if err != nil {
+		return cert, "", err
+	}
+	name := cert.Created.Format("20060102T150405Z")
+	certPath := filepath.Join(CertificatesDir, name+".json")
+	err = os.MkdirAll(r.fullPath(CertificatesDir), 0700)
+	if err != nil {
+		return cert, "", err
+	}
+	err = ioutil.WriteFile(r.fullPath(filepath.Join(CertificatesDir, name)), manifest, 0600)
+	if err != nil {
+		return cert, "", fmt.Errorf("writing certified manifest: %v", err)
+	}
+	err = ioutil.WriteFile(r.fullPath(certPath), append(certJSON, '\n'), 0600)
+	if err != nil {
+		return cert, "", fmt.Errorf("writing certificate: %v", err)
+	}
+	return cert, certPath, nil
+}
+
+// certifiedSums returns the checksums of every item's file,
+// keyed by repo-relative path, and counts the accounts,
+// collections, and items into cert.
+func (r *Repository) certifiedSums(cert *Certificate) (map[string][]byte, error) {
+	accounts, err := r.db.storedAccounts()
+	if err != nil {
+		return nil, fmt.Errorf("listing accounts: %v", err)
+	}
+	cert.Accounts = len(accounts)
+
+	sums := make(map[string][]byte)
+	for _, pa := range accounts {
+		itemIDs, err := r.db.itemIDs(pa)
+		if err != nil {
+			return nil, err
+		}
+		for _, itemID := range itemIDs {
+			dbi, err := r.db.loadItem(pa.key(), itemID)
+			if err != nil {
+				return nil, err
+			}
+			if dbi != nil {
+				sums[dbi.FilePath] = dbi.Checksum
+				cert.Items++
+			}
+		}
+		collIDs, err := r.db.collectionIDs(pa)
+		if err != nil {
+			return nil, err
+		}
+		cert.Collections += len(collIDs)
+	}
+	return sums, nil
+}
+
+// VerifyCertificate checks that the certificate in certJSON is
+// signed by the public key in it, and that manifest is the one
+// it certifies. Whether the public key is trusted is up to the
+// caller, who should compare it with a copy kept elsewhere.
+func VerifyCertificate(certJSON, manifest []byte) (Certificate, error) {
+	var cert Certificate
+	err := json.Unmarshal(certJSON, &cert)
+	if err != nil {
+		return cert, fmt.Errorf("decoding certificate: %v", err)
+	}
+	pub, err := hex.DecodeString(cert.PublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return cert, fmt.Errorf("bad public key in certificate")
+	}
+	sig, err := hex.DecodeString(cert.Signature)
+	if err != nil {
+		return cert, fmt.Errorf("bad signature in certificate: %v", err)
+	}
+	msg, err := cert.signedBytes()
+	if err != nil {
+		return cert, err
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pub), msg, sig) {
+		return cert, fmt.Errorf("signature of certificate is not valid")
+	}
+	if root := hex.EncodeToString(manifestRoot(manifest)); root != cert.ManifestRoot {
+		return cert, fmt.Errorf("manifest does not match the certificate (root %s, expected %s)", root, cert.ManifestRoot)
+	}
+	return cert, nil
+}
+
+// manifestRoot returns the root of a hash tree over the lines of
+// manifest, built as in RFC 6962 (Certificate Transparency) with
+// SHA-256, so that a single line can later be proven to be part
+// of the manifest without revealing the others.
+func manifestRoot(manifest []byte) []byte {
+	var leaves [][]byte
+	for _, line := range bytes.SplitAfter(manifest, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		h := sha256.New()
+		h.Write([]byte{0})
+		h.Write(line)
+		leaves = append(leaves, h.Sum(nil))
+	}
+	if len(leaves) == 0 {
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	}
+	return treeHash(leaves)
+}
+
+// treeHash returns the root of the hash tree over the leaf
+// hashes, splitting them at the largest power of two that
+// is less than their number.
+func treeHash(leaves [][]byte) []byte {
+	if len(leaves) == 1 {
+		return leaves[0]
+	}
+	k := 1
+	for k*2 < len(leaves) {
+		k *= 2
+	}
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(treeHash(leaves[:k]))
+	h.Write(treeHash(leaves[k:]))
+	return h.Sum(nil)
+}
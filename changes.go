@@ -0,0 +1,93 @@
+package photobak
+
+// Change detection strategies determine which value is
+// compared to decide if an item has changed remotely since
+// it was downloaded. Each API field has different
+// reliability, so the strategy can be chosen per provider
+// or per account.
+const (
+	ChangeETag    = "etag"    // the item's ETag (the default)
+	ChangeUpdated = "updated" // the item's "last updated" timestamp
+	ChangeVersion = "version" // a version or revision number
+	ChangeHash    = "hash"    // a hash of the content computed by the provider
+	ChangeSize    = "size"    // the size of the content in bytes
+)
+
+// IsChangeStrategy returns true if s is the
+// name of a known change detection strategy.
+func IsChangeStrategy(s string) bool {
+	switch s {
+	case ChangeETag, ChangeUpdated, ChangeVersion, ChangeHash, ChangeSize:
+		return true
+	}
+	return false
+}
+
+// ChangeKeyer is an optional interface an Item may implement
+// to support change detection strategies other than ETag.
+type ChangeKeyer interface {
+	// ItemChangeKey returns the value to compare for the
+	// given strategy in a consistent format, or an empty
+	// string if the strategy is not supported by the item.
+	ItemChangeKey(strategy string) string
+}
+
+// changeStrategy returns the change detection strategy to
+// use for pa. Account-specific settings take precedence over
+// provider-wide ones, which take precedence over the
+// provider's default.
+func (r *Repository) changeStrategy(pa providerAccount) string {
+	if s, ok := r.ChangeStrategies[pa.String()]; ok {
+		return s
+	}
+	if s, ok := r.ChangeStrategies[pa.provider.Name]; ok {
+		return s
+	}
+	if pa.provider.ChangeStrategy != "" {
+		return pa.provider.ChangeStrategy
+	}
+	return ChangeETag
+}
+
+// changeKey returns the strategy that is actually usable for
+// it along with the value to compare. If it does not support
+// the desired strategy, ETag is used instead.
+func changeKey(strategy string, it Item) (string, string) {
+	if strategy != ChangeETag {
+		if ck, ok := it.(ChangeKeyer); ok {
+			if key := ck.ItemChangeKey(strategy); key != "" {
+				return strategy, key
+			}
+		}
+	}
+	return ChangeETag, it.ItemETag()
+}
+
+// changedRemotely returns true if the listed item it differs
+// from what is stored in dbi according to strategy. If dbi was
+// saved using a different strategy, there is nothing to compare
+// with, so the item is assumed to be unchanged; the caller
+// should store the new key so that future runs can compare.
+// The second return value is true in that case.
+func changedRemotely(strategy string, it Item, dbi *dbItem) (changed, adopt bool) {
+	strategy, key := changeKey(strategy, it)
+	saved := dbi.ChangeStrategy
+	if saved == "" {
+		// items saved before strategies existed only have ETags
+		saved = ChangeETag
+	}
+	if saved != strategy {
+		return false, true
+	}
+	if strategy == ChangeETag {
+		return dbi.ETag != key, false
+	}
+	return dbi.ChangeKey != key, false
+}
+
+// setChangeKey records on dbi the value of it that will be
+// used to detect remote changes in the future.
+func setChangeKey(strategy string, it Item, dbi *dbItem) {
+	dbi.ChangeStrategy, dbi.ChangeKey = changeKey(strategy, it)
+	dbi.ETag = it.ItemETag()
+}
@@ -0,0 +1,259 @@
+package photobak
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// damagedChangeKey is the change key (or ETag) given to an item
+// whose file was found damaged or missing by Check, so that the
+// next run downloads it again (see markedDamaged).
+const damagedChangeKey = "photobak:damaged"
+
+// markedDamaged returns true if dbi's file is known to be
+// damaged, so it must be downloaded again even if the
+// provider reports no change to it.
+func markedDamaged(dbi *dbItem) bool {
+	for _, key := range []string{dbi.ETag, dbi.ChangeKey} {
+		if key == damagedChangeKey || key == interruptedChangeKey {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckOptions configures Check.
+type CheckOptions struct {
+	// Workers is how many files are hashed at once; since
+	// hashing is bound by the disk, more than a few rarely
+	// helps. Less than 1 means 1.
+	Workers int
+
+	// Accounts limits the check to the items of these
+	// accounts ("provider:username"); if empty, all
+	// accounts are checked.
+	Accounts []string
+
+	// Redownload marks the items whose files are damaged or
+	// missing so that the next backup downloads them again.
+	Redownload bool
+}
+
+// CheckReport describes the result of Check.
+type CheckReport struct {
+	Items     int             `json:"items"`     // number of items checked
+	Files     int             `json:"files"`     // number of files hashed
+	Bytes     int64           `json:"bytes"`     // total size of the files hashed
+	Unchanged int             `json:"unchanged"` // number of files not hashed because their size and modification time are unchanged
+	Marked    int             `json:"marked"`    // number of items marked to be downloaded again
+	Problems  []VerifyProblem `json:"problems"`  // files that are missing or damaged
+}
+
+// String returns a human-readable summary of the report.
+func (cr CheckReport) String() string {
+	s := fmt.Sprintf("Checked %d items, hashing %d files (%d bytes): %d problems\n",
+		cr.Items, cr.Files, cr.Bytes, len(cr.Problems))
+	if cr.Unchanged > 0 {
+		s += fmt.Sprintf("Skipped %d files whose size and modification time are unchanged; use -deep to hash them too\n", cr.Unchanged)
+	}
+	for _, p := range cr.Problems {
+		s += fmt.Sprintf("  %s: %s: %s\n", p.Kind, p.Path, p.Detail)
+	}
+	if cr.Marked > 0 {
+		s += fmt.Sprintf("Marked %d items to be downloaded again by the next backup\n", cr.Marked)
+	}
+	return s
+}
+
+// checkedItem is an item whose file is hashed by Check.
+type checkedItem struct {
+	pa     providerAccount
+	itemID string
+	dbi    *dbItem
+}
+
+// Check re-hashes the files of the items in the repository and
+// compares them with the checksums from when they were downloaded,
+// to find files that rotted on disk, were tampered with, or went
+// missing. Like -integrity, only files whose size or modification
+// time changed are hashed, unless DeepIntegrity is true. It is the
+// same check that -integrity makes while backing up, but done by
+// itself, with its own workers, so that it can be scheduled apart
+// from backups and run as fast as the disk allows. No requests are
+// made to providers, and nothing is changed unless opts.Redownload
+// is true. If ctx is canceled, Check stops and returns what it
+// found so far, along with the context's error.
+func (r *Repository) Check(ctx context.Context, opts CheckOptions) (CheckReport, error) {
+	var report CheckReport
+	workers := opts.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	accounts, err := r.db.storedAccounts()
+	if err != nil {
+		return report, fmt.Errorf("listing accounts: %v", err)
+	}
+	files := make(map[string][]checkedItem) // items by the file they are saved in
+	for _, pa := range accounts {
+		if !accountSelected(opts.Accounts, pa) {
+			continue
+		}
+		itemIDs, err := r.db.itemIDs(pa)
+		if err != nil {
+			return report, err
+		}
+		for _, itemID := range itemIDs {
+			dbi, err := r.db.loadItem(pa.key(), itemID)
+			if err != nil {
+				return report, err
+			}
+			if dbi == nil {
+				continue
+			}
+			report.Items++
+			files[dbi.FilePath] = append(files[dbi.FilePath], checkedItem{pa: pa, itemID: itemID, dbi: dbi})
+		}
+	}
+	paths := make([]string, 0, len(files))
+	for fpath := range files {
+		paths = append(paths, fpath)
+	}
+	sort.Strings(paths)
+
+	var mu sync.Mutex
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for fpath := range jobs {
+				problems, size, hashed := r.checkFile(fpath, files[fpath])
+				mu.Lock()
+				if hashed {
+					report.Files++
+					report.Bytes += size
+				} else if len(problems) == 0 {
+					report.Unchanged++
+				}
+				report.Problems = append(report.Problems, problems...)
+				mu.Unlock()
+			}
+		}()
+	}
+feed:
+	for _, fpath := range paths {
+		select {
+		case jobs <- fpath:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	sort.Slice(report.Problems, func(i, j int) bool {
+		if report.Problems[i].Path != report.Problems[j].Path {
+			return report.Problems[i].Path < report.Problems[j].Path
+		}
+		return report.Problems[i].ItemID < report.Problems[j].ItemID
+	})
+
+	if opts.Redownload {
+		for _, p := range report.Problems {
+			for _, ci := range files[p.Path] {
+				if ci.itemID != p.ItemID || ci.pa.String() != p.Account {
+					continue
+				}
+				err := r.markDamaged(ci)
+				if err != nil {
+					return report, err
+				}
+				report.Marked++
+			}
+		}
+	}
+	return report, ctx.Err()
+}
+
+// checkFile hashes the file at the repo-relative path fpath and
+// returns a problem for each of items whose checksum or listed
+// size it doesn't match, or for all of them if it can't be read,
+// along with the file's size and whether it was hashed. A file
+// that is not hashed and has no problems is unchanged by its
+// size and modification time.
+func (r *Repository) checkFile(fpath string, items []checkedItem) (problems []VerifyProblem, size int64, hashed bool) {
+	problem := func(kind, detail string) []VerifyProblem {
+		for _, ci := range items {
+			problems = append(problems, VerifyProblem{Kind: kind, Path: fpath,
+				Account: ci.pa.String(), ItemID: ci.itemID, Detail: detail})
+		}
+		return problems
+	}
+
+	info, err := os.Lstat(r.fullPath(fpath))
+	if err == nil && !info.Mode().IsRegular() {
+		err = fmt.Errorf("not a regular file")
+	}
+	if err != nil {
+		return problem(ProblemMissingFile, err.Error()), 0, false
+	}
+	for _, ci := range items {
+		if p, ok := sizeProblem(ci.pa, ci.itemID, ci.dbi, info.Size()); ok {
+			problems = append(problems, p)
+		}
+	}
+	if len(problems) > 0 {
+		return problems, info.Size(), false // no need to hash it
+	}
+	if !r.DeepIntegrity && statsUnchanged(info, items) {
+		return nil, 0, false
+	}
+	repoLog.Infof("Checking %s", fpath)
+	chksm, err := r.hash(fpath)
+	if err != nil {
+		return problem(ProblemMissingFile, err.Error()), 0, false
+	}
+	for _, ci := range items {
+		if !bytes.Equal(chksm, ci.dbi.Checksum) {
+			problems = append(problems, VerifyProblem{Kind: ProblemChecksumMismatch, Path: fpath,
+				Account: ci.pa.String(), ItemID: ci.itemID,
+				Detail: fmt.Sprintf("expected %x, got %x", ci.dbi.Checksum, chksm)})
+		}
+	}
+	return problems, info.Size(), true
+}
+
+// statsUnchanged returns true if the file described by info has
+// the size and modification time recorded for all of items.
+func statsUnchanged(info os.FileInfo, items []checkedItem) bool {
+	for _, ci := range items {
+		if !hasFileStat(ci.dbi) || info.Size() != ci.dbi.Size || !info.ModTime().Equal(ci.dbi.ModTime) {
+			return false
+		}
+	}
+	return true
+}
+
+// markDamaged marks the item ci so that the
+// next backup downloads its file again.
+func (r *Repository) markDamaged(ci checkedItem) error {
+	dbi, err := r.db.loadItem(ci.pa.key(), ci.itemID)
+	if err != nil {
+		return err
+	}
+	if dbi == nil {
+		return nil
+	}
+	dbi.ETag, dbi.ChangeKey = damagedChangeKey, damagedChangeKey
+	err = r.db.saveItem(ci.pa.key(), ci.itemID, dbi)
+	if err != nil {
+		return fmt.Errorf("marking %s to be downloaded again: %v", dbi.FilePath, err)
+	}
+	return nil
+}
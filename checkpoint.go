@@ -0,0 +1,203 @@
+package photobak
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// maxCheckpointAge is how long after a run was interrupted
+// the next run may still resume where it left off; after
+// that, it starts over, since the collections may have
+// changed too much in the meantime.
+const maxCheckpointAge = 7 * 24 * time.Hour
+
+// OffsetLister is implemented by clients that can start
+// listing the items of a collection after its first few
+// items, like the page offsets of an API. It lets a run that
+// was interrupted resume listing a collection where it left
+// off, rather than listing it all again.
+type OffsetLister interface {
+	// ListCollectionItemsFrom is like ListCollectionItems,
+	// but skips the first offset items of the collection.
+	ListCollectionItemsFrom(ctx context.Context, coll Collection, offset int, itemChan chan Item) error
+}
+
+// listingCheckpoint is how far an interrupted run of
+// Store got with the collections of an account, by
+// the IDs that the collections were listed with.
+type listingCheckpoint struct {
+	Saved     time.Time           // when the first of the interrupted runs was
+	Integrity bool                // whether the runs checked the integrity of files
+	Done      map[string]struct{} // collections that were listed and processed completely
+	Offsets   map[string]int      // how many of the first items of the others were processed
+}
+
+// offset returns how many of the first items of the
+// collection with ID id were processed, if any.
+func (cp *listingCheckpoint) offset(id string) int {
+	if cp == nil {
+		return 0
+	}
+	return cp.Offsets[id]
+}
+
+// itemTracker tracks which items of a collection were
+// processed, in the order they were listed, to know how
+// many of the first items were processed if the run is
+// interrupted.
+type itemTracker struct {
+	mu      sync.Mutex
+	offset  int              // how many items were processed before this run
+	done    int              // how many of the first items were processed, including offset
+	pending map[int]struct{} // the items after done that were processed
+}
+
+// resumeAt starts the tracker after the first offset items.
+func (t *itemTracker) resumeAt(offset int) {
+	t.offset, t.done = offset, offset
+}
+
+// itemProcessed records that the item at index i of the
+// listing was processed successfully.
+func (t *itemTracker) itemProcessed(i int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if i < t.done {
+		return
+	}
+	if t.pending == nil {
+		t.pending = make(map[int]struct{})
+	}
+	t.pending[i] = struct{}{}
+	for {
+		if _, ok := t.pending[t.done]; !ok {
+			break
+		}
+		delete(t.pending, t.done)
+		t.done++
+	}
+}
+
+// processedItems returns how many of the
+// first items were processed.
+func (t *itemTracker) processedItems() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.done
+}
+
+// resumeCheckpoint loads the checkpoint of ar's account, if the
+// last run was interrupted, and leaves out of ar the collections
+// that were done by then, so that the run resumes where the last
+// one left off. A checkpoint that is too old is ignored, as is
+// one without integrity checks if checkIntegrity is true.
+func (r *Repository) resumeCheckpoint(ar *accountRun, checkIntegrity bool) error {
+	cp, err := r.db.loadCheckpoint(ar.ac.account)
+	if err != nil {
+		return err
+	}
+	if cp == nil || time.Since(cp.Saved) > maxCheckpointAge || (checkIntegrity && !cp.Integrity) {
+		return nil
+	}
+	ar.checkpoint = cp
+
+	colls := ar.collections[:0]
+	for _, coll := range ar.collections {
+		if _, ok := cp.Done[coll.CollectionID()]; !ok {
+			colls = append(colls, coll)
+		}
+	}
+	skipped := len(ar.collections) - len(colls)
+	ar.collections = colls
+	if skipped > 0 {
+		ar.fullPass = false // not every collection is listed
+	}
+	repoLog.Infof("%s: resuming the run interrupted on %s: skipping %d collections it finished",
+		ar.ac.account, cp.Saved.Format("2006-01-02 15:04"), skipped)
+	return nil
+}
+
+// saveCheckpoint records how far ar got, if the run was
+// interrupted, so that the next run can resume from there;
+// otherwise it removes any checkpoint, so that the next run
+// starts over. started is when the run started.
+func (r *Repository) saveCheckpoint(ar accountRun, interrupted, checkIntegrity bool, started time.Time) error {
+	if !interrupted {
+		return r.db.saveCheckpoint(ar.ac.account, nil)
+	}
+	cp := &listingCheckpoint{
+		Saved:     started,
+		Integrity: checkIntegrity,
+		Done:      make(map[string]struct{}),
+		Offsets:   make(map[string]int),
+	}
+	if ar.checkpoint != nil {
+		cp.Saved = ar.checkpoint.Saved
+		for id := range ar.checkpoint.Done {
+			cp.Done[id] = struct{}{}
+		}
+	}
+	for _, coll := range ar.collections {
+		id := coll.CollectionID()
+		run := ar.runs[id]
+		if run.finished() {
+			cp.Done[id] = struct{}{}
+			continue
+		}
+		offset := ar.checkpoint.offset(id) // not started in this run
+		if run != nil {
+			offset = run.processedItems()
+		}
+		if offset > 0 {
+			cp.Offsets[id] = offset
+		}
+	}
+	return r.db.saveCheckpoint(ar.ac.account, cp)
+}
+
+// loadCheckpoint returns pa's checkpoint,
+// or nil if the last run was not interrupted.
+func (db *boltDB) loadCheckpoint(pa providerAccount) (*listingCheckpoint, error) {
+	var cp *listingCheckpoint
+	err := db.View(func(tx *bolt.Tx) error {
+		accountBucket := tx.Bucket(pa.key())
+		if accountBucket == nil {
+			return fmt.Errorf("account '%s' does not exist in DB", pa)
+		}
+		enc := accountBucket.Get([]byte("checkpoint"))
+		if enc == nil {
+			return nil
+		}
+		cp = new(listingCheckpoint)
+		return gobDecode(enc, cp)
+	})
+	return cp, err
+}
+
+// saveCheckpoint saves cp as pa's checkpoint,
+// or removes the checkpoint if cp is nil.
+func (db *boltDB) saveCheckpoint(pa providerAccount, cp *listingCheckpoint) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		accountBucket := tx.Bucket(pa.key())
+		if accountBucket == nil {
+			return fmt.Errorf("account '%s' does not exist in DB", pa)
+		}
+		if cp == nil {
+			if accountBucket.Get([]byte("checkpoint")) == nil {
+				// bolt fails to delete a key that's missing
+				// if the key after it is a bucket
+				return nil
+			}
+			return accountBucket.Delete([]byte("checkpoint"))
+		}
+		enc, err := gobEncode(cp)
+		if err != nil {
+			return err
+		}
+		return accountBucket.Put([]byte("checkpoint"), enc)
+	})
+}
@@ -0,0 +1,307 @@
+package photobak
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/boltdb/bolt"
+	"github.com/zeebo/blake3"
+)
+
+// Checksum algorithms, with which the repository identifies the
+// contents of files: to find duplicates, and to check that files
+// are intact (see SetChecksumAlgorithm). Both use the CPU's
+// vector or hashing instructions where it has them.
+const (
+	// ChecksumSHA256 is SHA-256, the default.
+	ChecksumSHA256 = "sha256"
+
+	// ChecksumBLAKE3 is BLAKE3 (with 256-bit output), which is
+	// faster than SHA-256, especially on CPUs without SHA
+	// extensions.
+	ChecksumBLAKE3 = "blake3"
+)
+
+// BLAKE3ManifestName is the name of the checksum manifest files
+// (see ManifestName) of a repository that uses ChecksumBLAKE3.
+// They are in the format of the b3sum program.
+const BLAKE3ManifestName = "B3SUMS"
+
+// rehashWorkers is how many files SetChecksumAlgorithm hashes at once.
+const rehashWorkers = 4
+
+// newChecksumHash returns a new hash of the checksum algorithm algo.
+func newChecksumHash(algo string) hash.Hash {
+	if algo == ChecksumBLAKE3 {
+		return blake3.New()
+	}
+	return sha256.New()
+}
+
+// checksumManifestName returns the name of the
+// manifest files of the checksum algorithm algo.
+func checksumManifestName(algo string) string {
+	if algo == ChecksumBLAKE3 {
+		return BLAKE3ManifestName
+	}
+	return ManifestName
+}
+
+// isManifestName returns true if name is the name
+// of manifest files of any checksum algorithm.
+func isManifestName(name string) bool {
+	return name == ManifestName || name == BLAKE3ManifestName
+}
+
+// newHash returns a new hash of the repository's checksum algorithm.
+func (r *Repository) newHash() hash.Hash {
+	return newChecksumHash(r.checksumAlgo)
+}
+
+// manifestName returns the name of the repository's manifest files.
+func (r *Repository) manifestName() string {
+	return checksumManifestName(r.checksumAlgo)
+}
+
+// ChecksumAlgorithm returns the checksum algorithm of the repository.
+func (r *Repository) ChecksumAlgorithm() string {
+	return r.checksumAlgo
+}
+
+// SetChecksumAlgorithm sets the checksum algorithm of the repository
+// to algo, which must be ChecksumSHA256 or ChecksumBLAKE3. It is saved
+// in the database so that it is used on later runs too. If it is
+// different from before, the file of every item is hashed again with
+// it, and checked against its old checksum at the same time, and the
+// checksums in the database are replaced all at once; if any file is
+// missing or damaged, or ctx is canceled, nothing is changed. This
+// reads the whole repository, which takes a while for a large one.
+// Manifests of the old algorithm are removed, and if Manifests is
+// enabled, written again with the new one.
+func (r *Repository) SetChecksumAlgorithm(ctx context.Context, algo string) error {
+	switch algo {
+	case ChecksumSHA256, ChecksumBLAKE3:
+	default:
+		return fmt.Errorf("unknown checksum algorithm '%s'", algo)
+	}
+	if algo == r.checksumAlgo {
+		return nil
+	}
+
+	repoLog.Infof("Hashing all files again to switch checksums from %s to %s", r.checksumAlgo, algo)
+	sums, err := r.rehash(ctx, algo)
+	if err != nil {
+		return fmt.Errorf("switching checksums to %s: %v", algo, err)
+	}
+	err = r.db.replaceChecksums(sums, algo)
+	if err != nil {
+		return fmt.Errorf("switching checksums to %s: %v", algo, err)
+	}
+
+	r.beginChanges()
+	defer r.endChanges()
+	oldName := r.manifestName()
+	r.checksumAlgo = algo
+	err = r.removeManifests(oldName)
+	if err != nil {
+		return fmt.Errorf("removing %s manifests: %v", oldName, err)
+	}
+	if r.Manifests {
+		err = r.writeManifests()
+		if err != nil {
+			return fmt.Errorf("writing manifests: %v", err)
+		}
+	}
+	return nil
+}
+
+// rehashedItem is an item whose file is hashed again by rehash.
+type rehashedItem struct {
+	acctKey  string
+	itemID   string
+	checksum []byte // with the current algorithm
+}
+
+// rehash hashes the file of every item with the checksum algorithm
+// algo, and returns the new checksums by account key and item ID.
+// It returns an error if any file is missing or doesn't have its
+// checksum.
+func (r *Repository) rehash(ctx context.Context, algo string) (map[string]map[string][]byte, error) {
+	accounts, err := r.db.storedAccounts()
+	if err != nil {
+		return nil, fmt.Errorf("listing accounts: %v", err)
+	}
+	files := make(map[string][]rehashedItem) // items by the file they are saved in
+	for _, pa := range accounts {
+		itemIDs, err := r.db.itemIDs(pa)
+		if err != nil {
+			return nil, err
+		}
+		for _, itemID := range itemIDs {
+			dbi, err := r.db.loadItem(pa.key(), itemID)
+			if err != nil {
+				return nil, err
+			}
+			if dbi != nil {
+				files[dbi.FilePath] = append(files[dbi.FilePath],
+					rehashedItem{acctKey: string(pa.key()), itemID: itemID, checksum: dbi.Checksum})
+			}
+		}
+	}
+	paths := make([]string, 0, len(files))
+	for fpath := range files {
+		paths = append(paths, fpath)
+	}
+	sort.Strings(paths)
+
+	sums := make(map[string]map[string][]byte)
+	var damaged []string
+	var mu sync.Mutex
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < rehashWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for fpath := range jobs {
+				oldSum, newSum, err := r.hashTwice(fpath, algo)
+				mu.Lock()
+				for _, ri := range files[fpath] {
+					if err != nil || !bytes.Equal(oldSum, ri.checksum) {
+						damaged = append(damaged, fpath)
+						break
+					}
+					if sums[ri.acctKey] == nil {
+						sums[ri.acctKey] = make(map[string][]byte)
+					}
+					sums[ri.acctKey][ri.itemID] = newSum
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+feed:
+	for _, fpath := range paths {
+		select {
+		case jobs <- fpath:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(damaged) > 0 {
+		sort.Strings(damaged)
+		return nil, fmt.Errorf("%d files are missing or damaged, like %s; find them with the check command and "+
+			"download them again before switching", len(damaged), damaged[0])
+	}
+	return sums, nil
+}
+
+// hashTwice hashes the file at the repo-relative path fpath
+// with the repository's checksum algorithm and with algo
+// in one pass, and returns both checksums.
+func (r *Repository) hashTwice(fpath, algo string) (current, other []byte, err error) {
+	f, err := os.Open(r.fullPath(fpath))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	repoLog.Infof("Hashing %s", fpath)
+	h1, h2 := r.newHash(), newChecksumHash(algo)
+	_, err = io.Copy(io.MultiWriter(h1, h2), f)
+	if err != nil {
+		return nil, nil, err
+	}
+	return h1.Sum(nil), h2.Sum(nil), nil
+}
+
+// replaceChecksums replaces the checksums of the items, which sums
+// has by account key and item ID, and rebuilds the checksum index
+// with them, all in one transaction that also saves algo as the
+// repository's checksum algorithm. Items not in sums are left alone.
+func (db *boltDB) replaceChecksums(sums map[string]map[string][]byte, algo string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		for acctKey, itemSums := range sums {
+			accountBucket := tx.Bucket([]byte(acctKey))
+			if accountBucket == nil {
+				return fmt.Errorf("account '%s' does not exist in DB", acctKey)
+			}
+			items := accountBucket.Bucket([]byte("items"))
+			if items == nil {
+				return fmt.Errorf("account '%s' is missing 'items' bucket", acctKey)
+			}
+			for itemID, sum := range itemSums {
+				item, err := decodeItem(items.Get([]byte(itemID)))
+				if err != nil {
+					return fmt.Errorf("loading item %s: %v", itemID, err)
+				}
+				if item == nil {
+					continue
+				}
+				item.Checksum = sum
+				enc, err := encodeItem(item)
+				if err != nil {
+					return err
+				}
+				err = items.Put([]byte(itemID), enc)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		err := rebuildChecksumIndexTx(tx)
+		if err != nil {
+			return err
+		}
+		meta, err := tx.CreateBucketIfNotExists([]byte("meta"))
+		if err != nil {
+			return err
+		}
+		return meta.Put([]byte("checksum_algorithm"), []byte(algo))
+	})
+}
+
+// removeManifests removes the manifest files called name from
+// the root of the repository and the folders of collections.
+func (r *Repository) removeManifests(name string) error {
+	dirs := []string{""}
+	accounts, err := r.db.storedAccounts()
+	if err != nil {
+		return err
+	}
+	for _, pa := range accounts {
+		collIDs, err := r.db.collectionIDs(pa)
+		if err != nil {
+			return err
+		}
+		for _, collID := range collIDs {
+			dbc, err := r.db.loadCollection(pa.key(), collID)
+			if err != nil {
+				return err
+			}
+			if dbc != nil {
+				dirs = append(dirs, dbc.DirPath)
+			}
+		}
+	}
+	for _, dir := range dirs {
+		err := os.Remove(r.fullPath(filepath.Join(dir, name)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
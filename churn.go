@@ -0,0 +1,126 @@
+package photobak
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+// When at least churnMinItems existing items have been
+// checked during a run and more than churnThreshold of
+// them report a changed ETag, the run is considered to
+// be experiencing ETag churn. This happens, for example,
+// when a provider bumps its "last updated" value for
+// every item without actually changing any content.
+const (
+	churnMinItems  = 50
+	churnThreshold = 0.5
+)
+
+// SizeChecker is an optional interface a Client may
+// implement to report the size of an item's content
+// without downloading it (for example, with an HTTP
+// HEAD request). It is used to cheaply verify that an
+// item really changed before re-downloading it.
+type SizeChecker interface {
+	// ItemSize returns the size in bytes of the
+	// item's content as it would be downloaded.
+	ItemSize(context.Context, Item) (int64, error)
+}
+
+// etagStats counts how many existing items were checked
+// for remote changes during a run, and how many of those
+// reported a different ETag than the one we have stored.
+type etagStats struct {
+	checked int64
+	changed int64
+}
+
+// record counts one checked item; changed should be
+// true if its ETag differed from the stored one.
+func (s *etagStats) record(changed bool) {
+	atomic.AddInt64(&s.checked, 1)
+	if changed {
+		atomic.AddInt64(&s.changed, 1)
+	}
+}
+
+// reset zeroes the counters so a new run can begin.
+func (s *etagStats) reset() {
+	atomic.StoreInt64(&s.checked, 0)
+	atomic.StoreInt64(&s.changed, 0)
+}
+
+// churning returns true if an unusually high fraction
+// of checked items reported changed ETags.
+func (s *etagStats) churning() bool {
+	checked := atomic.LoadInt64(&s.checked)
+	changed := atomic.LoadInt64(&s.changed)
+	if checked < churnMinItems {
+		return false
+	}
+	return float64(changed)/float64(checked) > churnThreshold
+}
+
+// warnIfChurning logs a warning if the last run
+// appears to be experiencing ETag churn.
+func (r *Repository) warnIfChurning() {
+	if !r.etags.churning() {
+		return
+	}
+	checked := atomic.LoadInt64(&r.etags.checked)
+	changed := atomic.LoadInt64(&r.etags.changed)
+	repoLog.Warnf("%d of %d existing items (%.0f%%) reported remote changes; "+
+		"the provider may be updating ETags without changing content. "+
+		"If the provider gives checksums, consider running with -verifychanges to avoid needless re-downloads.",
+		changed, checked, 100*float64(changed)/float64(checked))
+}
+
+// remoteChangeConfirmed cheaply verifies whether an item whose
+// ETag changed actually has different content than what we have
+// on disk: by the provider's checksum of the content if it gives
+// one (see DownloadVerifier), or else, only if VerifyChangesBySize
+// is set, by its size. If the client cannot tell us, or the check
+// fails, the change is assumed to be real so that the item is
+// re-downloaded as usual.
+func (r *Repository) remoteChangeConfirmed(ctx context.Context, client Client, it Item, dbi *dbItem) bool {
+	same, known, err := r.matchesProvider(client, it, dbi.FilePath)
+	if err != nil {
+		repoLog.Errorf("comparing %s with the provider's checksum: %v", dbi.FilePath, err)
+		return true
+	}
+	if known {
+		return !same
+	}
+	if !r.VerifyChangesBySize {
+		return true
+	}
+	sc, ok := client.(SizeChecker)
+	if !ok {
+		return true
+	}
+	remoteSize, err := sc.ItemSize(ctx, it)
+	if err != nil {
+		repoLog.Errorf("checking remote size of %s: %v", dbi.FilePath, err)
+		return true
+	}
+	info, err := os.Stat(r.fullPath(dbi.FilePath))
+	if err != nil {
+		return true
+	}
+	return info.Size() != remoteSize
+}
+
+// acceptChange stores the item's new ETag and change key without
+// downloading the item again; this is used when the item changed
+// but the content was verified to be the same, or when the change
+// detection strategy for the account has been switched.
+func (r *Repository) acceptChange(pa providerAccount, strategy string, it Item, dbi *dbItem) error {
+	setChangeKey(strategy, it, dbi)
+	err := r.db.saveItem(pa.key(), dbi.ID, dbi)
+	if err != nil {
+		return fmt.Errorf("saving new change key for %s: %v", dbi.FilePath, err)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/mholt/photobak"
+)
+
+// applySavedAccounts configures the accounts saved in the
+// repositories, as if they had been given as flags, unless
+// they are configured already. If a repository does not
+// exist yet, there is nothing to do for it.
+func applySavedAccounts() error {
+	for _, t := range repoTargets {
+		path := t.db
+		if path == "" {
+			path = filepath.Join(t.dir, "photobak.db")
+		}
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+
+		repo, err := openRepoAt(t)
+		if _, ok := err.(photobak.RepoLockedError); ok {
+			return err // its type decides the exit code
+		}
+		if err != nil {
+			return fmt.Errorf("opening repository: %v", err)
+		}
+		saved, err := repo.SavedAccounts()
+		repo.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, sa := range saved {
+			if photobak.IsConfigured(sa.String()) {
+				continue
+			}
+			err := setFlag(sa.Provider, sa.Value)
+			if err != nil {
+				logger.Errorf("saved account %s: %v", sa, err)
+			}
+		}
+	}
+	return nil
+}
+
+// accounts lists, adds, or removes the
+// accounts saved in the repository.
+func accounts(args []string) error {
+	usage := fmt.Errorf("usage: photobak [flags] accounts list | add <provider> <username> | remove <provider:username>")
+	if len(args) == 0 {
+		return usage
+	}
+
+	repo, err := openRepo()
+	if err != nil {
+		return fmt.Errorf("opening repository: %v", err)
+	}
+	defer repo.Close()
+
+	switch args[0] {
+	case "list":
+		if len(args) != 1 {
+			return usage
+		}
+		saved, err := repo.SavedAccounts()
+		if err != nil {
+			return err
+		}
+		for _, sa := range saved {
+			if sa.Value != sa.Username {
+				fmt.Printf("%s\t%s\n", sa, sa.Value)
+			} else {
+				fmt.Println(sa)
+			}
+		}
+		return nil
+
+	case "add":
+		if len(args) != 3 {
+			return usage
+		}
+		// make sure the provider accepts the value
+		// before it is saved and used every time
+		err := setFlag(args[1], args[2])
+		if err != nil {
+			return err
+		}
+		sa, err := repo.SaveAccount(args[1], args[2])
+		if err != nil {
+			return err
+		}
+		fmt.Println(photobak.Tr("Saved account %s", sa))
+		return nil
+
+	case "remove":
+		if len(args) != 2 {
+			return usage
+		}
+		err := repo.RemoveSavedAccount(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Println(photobak.Tr("Removed account %s; its backup is kept", args[1]))
+		return nil
+	}
+
+	return usage
+}
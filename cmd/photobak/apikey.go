@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/mholt/photobak"
+	keyring "github.com/zalando/go-keyring"
+)
+
+// keyringService is the service name under which
+// photobak's secrets are stored in the OS keyring.
+const keyringService = "photobak"
+
+// keyringKey loads the secret of the given kind (like "api-key")
+// of repo, which is at repoDir, from the OS keyring. Its entry is
+// named after the key ID that repo keeps (see KeyID), so that the
+// key is found even if the repository was moved. An entry saved by
+// older versions, which were named after the path of the repository,
+// is moved to the new name. It returns nil if there is no entry.
+func keyringKey(repo *photobak.Repository, repoDir, kind, purpose string) (string, []byte, error) {
+	keyID, err := repo.KeyID(purpose)
+	if err != nil {
+		return "", nil, fmt.Errorf("getting key ID: %v", err)
+	}
+	user := kind + ":" + keyID
+
+	stored, err := keyring.Get(keyringService, user)
+	if err == keyring.ErrNotFound {
+		absRepo, absErr := filepath.Abs(repoDir)
+		if absErr != nil {
+			return "", nil, absErr
+		}
+		legacyUser := kind + ":" + absRepo
+		stored, err = keyring.Get(keyringService, legacyUser)
+		if err == nil {
+			if setErr := keyring.Set(keyringService, user, stored); setErr != nil {
+				return "", nil, fmt.Errorf("saving key to keyring: %v", setErr)
+			}
+			keyring.Delete(keyringService, legacyUser)
+		}
+	}
+	if err == keyring.ErrNotFound {
+		return user, nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	key, err := hex.DecodeString(stored)
+	if err != nil {
+		return "", nil, fmt.Errorf("decoding key in keyring: %v", err)
+	}
+	return user, key, nil
+}
+
+// apiKey gets the key used to encrypt API metadata in repo,
+// which is at repoDir. The PHOTOBAK_API_KEY environment variable,
+// if set, must contain the key in hex. Otherwise the key is
+// loaded from the OS keyring, and if there is no key for the
+// repository yet, a new one is generated and stored, unless the
+// repository has data that was encrypted with a key already.
+func apiKey(repo *photobak.Repository, repoDir string) ([]byte, error) {
+	if env := os.Getenv("PHOTOBAK_API_KEY"); env != "" {
+		key, err := hex.DecodeString(env)
+		if err != nil {
+			return nil, fmt.Errorf("decoding PHOTOBAK_API_KEY: %v", err)
+		}
+		if len(key) != photobak.APIKeySize {
+			return nil, fmt.Errorf("PHOTOBAK_API_KEY must be %d bytes (%d hex characters)",
+				photobak.APIKeySize, photobak.APIKeySize*2)
+		}
+		return key, nil
+	}
+
+	user, key, err := keyringKey(repo, repoDir, "api-key", "api")
+	if err != nil {
+		return nil, fmt.Errorf("loading API key from keyring (set PHOTOBAK_API_KEY instead?): %v", err)
+	}
+	if key != nil {
+		if len(key) != photobak.APIKeySize {
+			return nil, fmt.Errorf("API key in keyring must be %d bytes, but it is %d", photobak.APIKeySize, len(key))
+		}
+		return key, nil
+	}
+
+	sealed, err := repo.HasSealedAPI()
+	if err != nil {
+		return nil, err
+	}
+	if sealed {
+		return nil, fmt.Errorf("the repository has API data encrypted with a key that is not in the keyring; " +
+			"set PHOTOBAK_API_KEY to that key")
+	}
+	key = make([]byte, photobak.APIKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	err = keyring.Set(keyringService, user, hex.EncodeToString(key))
+	if err != nil {
+		return nil, fmt.Errorf("saving new API key to keyring: %v", err)
+	}
+	fmt.Println(photobak.Tr("Generated a new key for encrypting API data and saved it to your keyring.\n" +
+		"Keep a copy somewhere safe; without it, that data cannot be read."))
+	return key, nil
+}
+
+// signingKey gets the key that certificates of repo, which is at
+// repoDir, are signed with. The PHOTOBAK_SIGNING_KEY environment
+// variable, if set, must contain the key's seed in hex. Otherwise
+// the seed is loaded from the OS keyring, and if there is none for
+// the repository yet, a new one is generated and stored, unless the
+// repository has certificates already, which a new key would not
+// match.
+func signingKey(repo *photobak.Repository, repoDir string) (ed25519.PrivateKey, error) {
+	if env := os.Getenv("PHOTOBAK_SIGNING_KEY"); env != "" {
+		seed, err := hex.DecodeString(env)
+		if err != nil {
+			return nil, fmt.Errorf("decoding PHOTOBAK_SIGNING_KEY: %v", err)
+		}
+		if len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("PHOTOBAK_SIGNING_KEY must be %d bytes (%d hex characters)",
+				ed25519.SeedSize, ed25519.SeedSize*2)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+
+	user, seed, err := keyringKey(repo, repoDir, "signing-key", "signing")
+	if err != nil {
+		return nil, fmt.Errorf("loading signing key from keyring (set PHOTOBAK_SIGNING_KEY instead?): %v", err)
+	}
+	if seed != nil {
+		if len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("bad signing key in keyring")
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+
+	certs, err := filepath.Glob(filepath.Join(repoDir, photobak.CertificatesDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) > 0 {
+		return nil, fmt.Errorf("the repository has certificates signed with a key that is not in the keyring; " +
+			"set PHOTOBAK_SIGNING_KEY to that key")
+	}
+	seed = make([]byte, ed25519.SeedSize)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, err
+	}
+	err = keyring.Set(keyringService, user, hex.EncodeToString(seed))
+	if err != nil {
+		return nil, fmt.Errorf("saving new signing key to keyring: %v", err)
+	}
+	key := ed25519.NewKeyFromSeed(seed)
+	fmt.Println(photobak.Tr("Generated a new key for signing certificates and saved it to your keyring.\n"+
+		"Keep a record of its public key elsewhere, to check certificates against: %s",
+		hex.EncodeToString(key.Public().(ed25519.PublicKey))))
+	return key, nil
+}
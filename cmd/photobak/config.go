@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+
+	"github.com/BurntSushi/toml"
+)
+
+// loadConfig reads the TOML file at path and applies its
+// settings as if they had been given as flags. Top-level
+// keys are flag names (including those added by providers,
+// such as maxalbums), and the [accounts] table lists the
+// accounts for each provider, for example:
+//
+//	repo = "/backups/photos"
+//	concurrency = 10
+//	every = "1d"
+//
+//	[accounts]
+//	googlephotos = ["you@yours.com", "them@theirs.com"]
+//
+// Besides repo, [[repos]] blocks may list several
+// repositories to maintain (see parseRepoBlocks).
+// Flags given on the command line take precedence
+// over the values in the file.
+func loadConfig(path string) error {
+	var cfg map[string]interface{}
+	_, err := toml.DecodeFile(path, &cfg)
+	if err != nil {
+		return fmt.Errorf("reading config file: %v", err)
+	}
+
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	// apply settings in a consistent order
+	keys := make([]string, 0, len(cfg))
+	for key := range cfg {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if key == "accounts" {
+			accounts, ok := cfg[key].(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("config: accounts must be a table of provider names to lists of accounts")
+			}
+			for provider, list := range accounts {
+				if explicit[provider] {
+					continue
+				}
+				err := setFlag(provider, list)
+				if err != nil {
+					return fmt.Errorf("config: accounts: %v", err)
+				}
+			}
+			continue
+		}
+		if key == "repos" {
+			if explicit["repo"] {
+				continue
+			}
+			configRepos, err = parseRepoBlocks(cfg[key])
+			if err != nil {
+				return fmt.Errorf("config: %v", err)
+			}
+			continue
+		}
+		if key == "config" {
+			return fmt.Errorf("config: a config file cannot load another config file")
+		}
+		if explicit[key] {
+			continue
+		}
+		err := setFlag(key, cfg[key])
+		if err != nil {
+			return fmt.Errorf("config: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// setFlag sets the flag called name to val. If val is
+// a list, the flag is set once for each element, which
+// is how repeatable flags accumulate values.
+func setFlag(name string, val interface{}) error {
+	if flag.Lookup(name) == nil {
+		return fmt.Errorf("unknown setting '%s'", name)
+	}
+	switch v := val.(type) {
+	case []interface{}:
+		for _, elem := range v {
+			err := setFlag(name, elem)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case string, bool, int64, float64:
+		err := flag.Set(name, fmt.Sprint(v))
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("%s: unsupported value type %T", name, val)
+	}
+}
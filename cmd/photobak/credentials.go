@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	keyring "github.com/zalando/go-keyring"
+
+	"github.com/mholt/photobak"
+)
+
+// keyringCredentials keeps the credentials of the accounts of
+// a repository in the OS keyring (macOS Keychain, Windows
+// Credential Manager, or the Secret Service on Linux).
+type keyringCredentials struct {
+	repo string // absolute path of the repository
+}
+
+// newKeyringCredentials returns a credential store
+// for the repository at repoDir.
+func newKeyringCredentials(repoDir string) (keyringCredentials, error) {
+	absRepo, err := filepath.Abs(repoDir)
+	return keyringCredentials{repo: absRepo}, err
+}
+
+// user returns the name under which the
+// credentials of account are stored.
+func (kc keyringCredentials) user(account string) string {
+	return "credentials:" + kc.repo + ":" + account
+}
+
+func (kc keyringCredentials) LoadCredentials(account string) ([]byte, error) {
+	stored, err := keyring.Get(keyringService, kc.user(account))
+	if err == keyring.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(stored)
+}
+
+func (kc keyringCredentials) SaveCredentials(account string, creds []byte) error {
+	return keyring.Set(keyringService, kc.user(account), base64.StdEncoding.EncodeToString(creds))
+}
+
+func (kc keyringCredentials) DeleteCredentials(account string) error {
+	err := keyring.Delete(keyringService, kc.user(account))
+	if err == keyring.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+var (
+	passphrase     string
+	passphraseErr  error
+	passphraseOnce sync.Once
+)
+
+// credentialPassphrase returns the passphrase with which
+// credentials are encrypted in the database, from the
+// PHOTOBAK_PASSPHRASE environment variable or else by
+// asking for it once.
+func credentialPassphrase() (string, error) {
+	passphraseOnce.Do(func() {
+		if passphrase = os.Getenv("PHOTOBAK_PASSPHRASE"); passphrase != "" {
+			return
+		}
+		fmt.Fprint(os.Stderr, photobak.Tr("Passphrase for credentials: "))
+		passphrase, passphraseErr = bufio.NewReader(os.Stdin).ReadString('\n')
+		passphrase = strings.TrimRight(passphrase, "\r\n")
+		if passphraseErr != nil && passphrase != "" {
+			passphraseErr = nil // no newline at the end of input
+		}
+	})
+	return passphrase, passphraseErr
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronExpr is a parsed cron expression, which gives the times
+// that runs start: "minute hour day-of-month month day-of-week".
+// Each field is a bit set of the values it matches.
+type cronExpr struct {
+	minute, hour, dom, month, dow uint64
+
+	// whether the day fields are "*"; if neither is, a day
+	// matches if either field does, as in standard cron
+	domStar, dowStar bool
+}
+
+// cronShortcuts are the names that stand for common expressions.
+var cronShortcuts = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+}
+
+var (
+	monthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	dayNames   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// isCronExpr returns true if s looks like a cron
+// expression rather than an interval like 1d.
+func isCronExpr(s string) bool {
+	return strings.HasPrefix(s, "@") || len(strings.Fields(s)) > 1
+}
+
+// parseCron parses a cron expression of five fields, like
+// "30 2 * * 1-5" (2:30 on weekdays), or a shortcut like
+// @daily. Fields can be *, numbers, ranges (1-5), lists of
+// them (1,3,5), and steps (*/15, 0-30/10); months and days
+// of the week can also be given by name (jan, mon). Sunday
+// is 0 or 7.
+func parseCron(s string) (*cronExpr, error) {
+	expr := strings.TrimSpace(s)
+	if full, ok := cronShortcuts[strings.ToLower(expr)]; ok {
+		expr = full
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression '%s' must have 5 fields: minute hour day-of-month month day-of-week", s)
+	}
+
+	c := new(cronExpr)
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("minute: %v", err)
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("hour: %v", err)
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("day of month: %v", err)
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12, monthNames); err != nil {
+		return nil, fmt.Errorf("month: %v", err)
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7, dayNames); err != nil {
+		return nil, fmt.Errorf("day of week: %v", err)
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1 // 7 is Sunday too
+	}
+	c.domStar = strings.HasPrefix(fields[2], "*")
+	c.dowStar = strings.HasPrefix(fields[4], "*")
+
+	if c.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("cron expression '%s' never matches", s)
+	}
+	return c, nil
+}
+
+// parseCronField parses one field of a cron expression, whose
+// values are from min to max. If names is not nil, it has the
+// names of the values, starting with the one for min.
+func parseCronField(field string, min, max int, names []string) (uint64, error) {
+	value := func(s string) (int, error) {
+		for i, name := range names {
+			if strings.EqualFold(s, name) {
+				return min + i, nil
+			}
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < min || n > max {
+			return 0, fmt.Errorf("bad value '%s': must be from %d to %d", s, min, max)
+		}
+		return n, nil
+	}
+
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("bad step in '%s'", part)
+			}
+			step = n
+			part = part[:i]
+		}
+		first, last := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			first, err = value(bounds[0])
+			if err != nil {
+				return 0, err
+			}
+			last = first
+			if len(bounds) == 2 {
+				last, err = value(bounds[1])
+				if err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				last = max // like 5/15, which is 5-59/15 for minutes
+			}
+			if first > last {
+				return 0, fmt.Errorf("bad range '%s'", part)
+			}
+		}
+		for v := first; v <= last; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// has returns true if the bit set contains v.
+func has(bits uint64, v int) bool {
+	return bits&(1<<uint(v)) != 0
+}
+
+// dayMatches returns true if c matches the day of t.
+func (c *cronExpr) dayMatches(t time.Time) bool {
+	dom, dow := has(c.dom, t.Day()), has(c.dow, int(t.Weekday()))
+	if !c.domStar && !c.dowStar {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// next returns the first time after t that c matches,
+// or the zero time if there is none in the next 5 years.
+// A time that clocks show twice, when they go back for
+// daylight saving time, only matches the first time.
+func (c *cronExpr) next(t time.Time) time.Time {
+	t = t.Round(0).Truncate(time.Minute)
+	from := wallClock(t)
+	t = t.Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case !has(c.month, int(t.Month())):
+			t = advance(t, time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location()))
+		case !c.dayMatches(t):
+			t = advance(t, time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location()))
+		case !has(c.hour, t.Hour()):
+			t = advance(t, time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location()))
+		case !has(c.minute, t.Minute()) || !wallClock(t).After(from):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// wallClock returns the date and time of day of t,
+// as a clock in t's location shows it, in UTC.
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+}
+
+// advance returns next, the wall clock time that t, which is on
+// a whole minute, moves on to. If that is in an hour skipped when
+// clocks go forward for daylight saving time, time.Date gives the
+// time an hour earlier, which may not be after t; then advance
+// returns the start of the hour after t instead.
+func advance(t, next time.Time) time.Time {
+	if next.After(t) {
+		return next
+	}
+	return t.Add(time.Duration(60-t.Minute()) * time.Minute)
+}
+
+// runWindow is a time of day within which runs start
+// and end, like 01:00-06:00. It may span midnight.
+type runWindow struct {
+	start, end int // minutes since midnight
+}
+
+// parseWindow parses a window like "01:00-06:00" or "22:00-05:30".
+func parseWindow(s string) (*runWindow, error) {
+	bounds := strings.SplitN(s, "-", 2)
+	if len(bounds) != 2 {
+		return nil, fmt.Errorf("window '%s' must be like 01:00-06:00", s)
+	}
+	var w runWindow
+	for i, b := range bounds {
+		t, err := time.Parse("15:04", strings.TrimSpace(b))
+		if err != nil {
+			return nil, fmt.Errorf("bad time '%s' in window: must be like 01:00", b)
+		}
+		m := t.Hour()*60 + t.Minute()
+		if i == 0 {
+			w.start = m
+		} else {
+			w.end = m
+		}
+	}
+	if w.start == w.end {
+		return nil, fmt.Errorf("window '%s' is empty", s)
+	}
+	return &w, nil
+}
+
+// at returns the time on t's day that is m minutes after midnight.
+func at(t time.Time, m int) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), m/60, m%60, 0, 0, t.Location())
+}
+
+// contains returns true if t is within w.
+func (w *runWindow) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return m >= w.start && m < w.end
+	}
+	return m >= w.start || m < w.end
+}
+
+// nextStart returns t if it is within w, or
+// else the time that w next opens after t.
+func (w *runWindow) nextStart(t time.Time) time.Time {
+	if w.contains(t) {
+		return t
+	}
+	start := at(t, w.start)
+	if start.Before(t) {
+		start = at(t.AddDate(0, 0, 1), w.start)
+	}
+	return start
+}
+
+// endAfter returns the time that w, which
+// contains t, closes after t.
+func (w *runWindow) endAfter(t time.Time) time.Time {
+	end := at(t, w.end)
+	if !end.After(t) {
+		end = at(t.AddDate(0, 0, 1), w.end)
+	}
+	return end
+}
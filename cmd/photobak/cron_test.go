@@ -0,0 +1,223 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// bits returns the bit set of vals.
+func bits(vals ...int) uint64 {
+	var b uint64
+	for _, v := range vals {
+		b |= 1 << uint(v)
+	}
+	return b
+}
+
+// rangeBits returns the bit set of first to last.
+func rangeBits(first, last int) uint64 {
+	var b uint64
+	for v := first; v <= last; v++ {
+		b |= 1 << uint(v)
+	}
+	return b
+}
+
+func TestParseCron(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		expect    cronExpr
+		shouldErr bool
+	}{
+		{
+			input:  "* * * * *",
+			expect: cronExpr{rangeBits(0, 59), rangeBits(0, 23), rangeBits(1, 31), rangeBits(1, 12), rangeBits(0, 7), true, true},
+		},
+		{
+			input:  "30 2 * * 1-5",
+			expect: cronExpr{bits(30), bits(2), rangeBits(1, 31), rangeBits(1, 12), rangeBits(1, 5), true, false},
+		},
+		{
+			input:  "*/15 0-12/6 1,15 jan-mar,DEC sat,sun",
+			expect: cronExpr{bits(0, 15, 30, 45), bits(0, 6, 12), bits(1, 15), bits(1, 2, 3, 12), bits(0, 6), false, false},
+		},
+		{
+			input:  "5/20 * * * *",
+			expect: cronExpr{bits(5, 25, 45), rangeBits(0, 23), rangeBits(1, 31), rangeBits(1, 12), rangeBits(0, 7), true, true},
+		},
+		{
+			input:  "0 0 * * 7",
+			expect: cronExpr{bits(0), bits(0), rangeBits(1, 31), rangeBits(1, 12), bits(0, 7), true, false},
+		},
+		{
+			input:  " @Daily ",
+			expect: cronExpr{bits(0), bits(0), rangeBits(1, 31), rangeBits(1, 12), rangeBits(0, 7), true, true},
+		},
+		{
+			input:  "@weekly",
+			expect: cronExpr{bits(0), bits(0), rangeBits(1, 31), rangeBits(1, 12), bits(0), true, false},
+		},
+		{input: "", shouldErr: true},
+		{input: "* * * *", shouldErr: true},
+		{input: "* * * * * *", shouldErr: true},
+		{input: "@sometimes", shouldErr: true},
+		{input: "60 * * * *", shouldErr: true},
+		{input: "* 24 * * *", shouldErr: true},
+		{input: "* * 0 * *", shouldErr: true},
+		{input: "* * 32 * *", shouldErr: true},
+		{input: "* * * 13 *", shouldErr: true},
+		{input: "* * * * 8", shouldErr: true},
+		{input: "* * * * fun", shouldErr: true},
+		{input: "5-1 * * * *", shouldErr: true},
+		{input: "*/0 * * * *", shouldErr: true},
+		{input: "*/x * * * *", shouldErr: true},
+		{input: "1,,2 * * * *", shouldErr: true},
+		{input: "0 0 30 feb *", shouldErr: true}, // never matches
+	} {
+		actual, err := parseCron(test.input)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error for '%s', didn't get one", i, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Did not expect an error for '%s', got '%v'", i, test.input, err)
+			continue
+		}
+		if *actual != test.expect {
+			t.Errorf("Test %d: Expected %+v, got %+v", i, test.expect, *actual)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("Time zone data is not available: %v", err)
+	}
+	date := func(loc *time.Location, year int, month time.Month, day, hour, min int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, loc)
+	}
+	for i, test := range []struct {
+		expr   string
+		from   time.Time
+		expect time.Time
+	}{
+		// the next minute, never the same one
+		{"* * * * *", date(time.UTC, 2026, 5, 4, 10, 20).Add(30 * time.Second), date(time.UTC, 2026, 5, 4, 10, 21)},
+		{"20 10 * * *", date(time.UTC, 2026, 5, 4, 10, 20), date(time.UTC, 2026, 5, 5, 10, 20)},
+		{"*/15 * * * *", date(time.UTC, 2026, 5, 4, 23, 50), date(time.UTC, 2026, 5, 5, 0, 0)},
+
+		// month and year ends
+		{"0 0 1 * *", date(time.UTC, 2026, 1, 31, 10, 0), date(time.UTC, 2026, 2, 1, 0, 0)},
+		{"0 0 31 * *", date(time.UTC, 2026, 2, 1, 0, 0), date(time.UTC, 2026, 3, 31, 0, 0)},
+		{"0 0 31 * *", date(time.UTC, 2026, 3, 31, 0, 0), date(time.UTC, 2026, 5, 31, 0, 0)},
+		{"0 0 29 2 *", date(time.UTC, 2026, 3, 1, 0, 0), date(time.UTC, 2028, 2, 29, 0, 0)},
+		{"59 23 31 12 *", date(time.UTC, 2026, 12, 31, 23, 59), date(time.UTC, 2027, 12, 31, 23, 59)},
+		{"@monthly", date(time.UTC, 2026, 12, 15, 0, 0), date(time.UTC, 2027, 1, 1, 0, 0)},
+
+		// days of the week, and either day field if both are given
+		{"0 9 * * mon-fri", date(time.UTC, 2026, 5, 8, 9, 0), date(time.UTC, 2026, 5, 11, 9, 0)},
+		{"0 0 * * 7", date(time.UTC, 2026, 5, 4, 0, 0), date(time.UTC, 2026, 5, 10, 0, 0)},
+		{"0 0 13 * 5", date(time.UTC, 2026, 5, 4, 0, 0), date(time.UTC, 2026, 5, 8, 0, 0)},
+		{"0 0 13 * 5", date(time.UTC, 2026, 5, 9, 0, 0), date(time.UTC, 2026, 5, 13, 0, 0)},
+
+		// clocks go forward an hour at 2:00 on 2026-03-08,
+		// so a time in the hour that is skipped runs the
+		// next day, and other times stay on the wall clock
+		{"30 2 * * *", date(ny, 2026, 3, 8, 0, 0), date(ny, 2026, 3, 9, 2, 30)},
+		{"30 3 * * *", date(ny, 2026, 3, 7, 3, 30), date(ny, 2026, 3, 8, 3, 30)},
+		{"0 * * * *", date(ny, 2026, 3, 8, 1, 0), date(ny, 2026, 3, 8, 3, 0)},
+
+		// and back at 2:00 on 2026-11-01, which makes that day
+		// 25 hours long; the hour from 1:00 that is repeated
+		// only matches the first time
+		{"0 0 * * *", date(ny, 2026, 11, 1, 0, 0), date(ny, 2026, 11, 2, 0, 0)},
+		{"30 4 * * *", date(ny, 2026, 10, 31, 4, 30), date(ny, 2026, 11, 1, 4, 30)},
+		{"30 1 * * *", date(ny, 2026, 11, 1, 0, 0), date(ny, 2026, 11, 1, 1, 30)},
+		{"30 1 * * *", date(ny, 2026, 11, 1, 1, 30), date(ny, 2026, 11, 2, 1, 30)},
+		{"0 * * * *", date(ny, 2026, 11, 1, 1, 0), date(ny, 2026, 11, 1, 2, 0)},
+	} {
+		c, err := parseCron(test.expr)
+		if err != nil {
+			t.Fatalf("Test %d: Did not expect an error for '%s', got '%v'", i, test.expr, err)
+		}
+		actual := c.next(test.from)
+		if !actual.Equal(test.expect) {
+			t.Errorf("Test %d: '%s' after %s: Expected %s, got %s", i, test.expr, test.from, test.expect, actual)
+		}
+	}
+}
+
+func TestParseWindow(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		expect    runWindow
+		shouldErr bool
+	}{
+		{input: "01:00-06:00", expect: runWindow{60, 360}},
+		{input: "22:00 - 05:30", expect: runWindow{1320, 330}},
+		{input: "00:00-23:59", expect: runWindow{0, 1439}},
+		{input: "01:00", shouldErr: true},
+		{input: "1am-6am", shouldErr: true},
+		{input: "25:00-01:00", shouldErr: true},
+		{input: "03:00-03:00", shouldErr: true},
+	} {
+		actual, err := parseWindow(test.input)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error for '%s', didn't get one", i, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Did not expect an error for '%s', got '%v'", i, test.input, err)
+			continue
+		}
+		if *actual != test.expect {
+			t.Errorf("Test %d: Expected %+v, got %+v", i, test.expect, *actual)
+		}
+	}
+}
+
+func TestRunWindow(t *testing.T) {
+	day := func(d, hour, min int) time.Time {
+		return time.Date(2026, 5, d, hour, min, 0, 0, time.UTC)
+	}
+	within := &runWindow{start: 60, end: 360}      // 01:00-06:00
+	overnight := &runWindow{start: 1320, end: 330} // 22:00-05:30
+	for i, test := range []struct {
+		window         *runWindow
+		t              time.Time
+		expectContains bool
+		expectStart    time.Time
+		expectEnd      time.Time // only if it contains t
+	}{
+		{within, day(4, 0, 59), false, day(4, 1, 0), time.Time{}},
+		{within, day(4, 1, 0), true, day(4, 1, 0), day(4, 6, 0)},
+		{within, day(4, 5, 59), true, day(4, 5, 59), day(4, 6, 0)},
+		{within, day(4, 6, 0), false, day(5, 1, 0), time.Time{}},
+		{within, day(4, 23, 30), false, day(5, 1, 0), time.Time{}},
+
+		{overnight, day(4, 12, 0), false, day(4, 22, 0), time.Time{}},
+		{overnight, day(4, 21, 59), false, day(4, 22, 0), time.Time{}},
+		{overnight, day(4, 22, 0), true, day(4, 22, 0), day(5, 5, 30)},
+		{overnight, day(4, 23, 59), true, day(4, 23, 59), day(5, 5, 30)},
+		{overnight, day(5, 0, 0), true, day(5, 0, 0), day(5, 5, 30)},
+		{overnight, day(5, 5, 29), true, day(5, 5, 29), day(5, 5, 30)},
+		{overnight, day(5, 5, 30), false, day(5, 22, 0), time.Time{}},
+	} {
+		if actual := test.window.contains(test.t); actual != test.expectContains {
+			t.Errorf("Test %d: contains(%s): Expected %v, got %v", i, test.t, test.expectContains, actual)
+		}
+		if actual := test.window.nextStart(test.t); !actual.Equal(test.expectStart) {
+			t.Errorf("Test %d: nextStart(%s): Expected %s, got %s", i, test.t, test.expectStart, actual)
+		}
+		if test.expectContains {
+			if actual := test.window.endAfter(test.t); !actual.Equal(test.expectEnd) {
+				t.Errorf("Test %d: endAfter(%s): Expected %s, got %s", i, test.t, test.expectEnd, actual)
+			}
+		}
+	}
+}
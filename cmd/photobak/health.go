@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mholt/photobak"
+)
+
+// healthFileName is the name of the file in the repository
+// that records how the last run went.
+const healthFileName = "photobak-health.json"
+
+// The exit codes of a run (other commands exit with 0 or 1).
+// Invalid flags and settings exit with 2, like the flag
+// package does.
+const (
+	exitOK          = 0 // success
+	exitFailure     = 1 // any failure not below
+	exitUsage       = 2 // invalid flags or settings
+	exitAuth        = 3 // an account's credentials are missing or refused
+	exitNetwork     = 4 // the network or a service was unreachable or down
+	exitPartial     = 5 // the run finished, but some items failed
+	exitLocked      = 6 // another photobak is using the repository
+	exitFull        = 7 // the repository reached -maxdisk, or its disk is too full (-preflight)
+	exitInterrupted = 8 // interrupted, or stopped by -max-runtime or the run window
+)
+
+// health is the record of the last run that
+// is written to the health file after each run.
+type health struct {
+	Started             time.Time  `json:"last_run_started"`
+	Finished            time.Time  `json:"last_run_finished"`
+	Result              string     `json:"result"` // success, partial, failure, or interrupted
+	ExitCode            int        `json:"exit_code"`
+	Error               string     `json:"error,omitempty"`
+	Downloaded          int64      `json:"downloaded"`
+	Failed              int64      `json:"failed"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"` // the last run that ended with success or partial
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+}
+
+// runHealth keeps the health file of the repository at dir.
+type runHealth struct {
+	path string
+	mu   sync.Mutex
+	h    health
+}
+
+// newRunHealth returns the run health of the repository at
+// dir, carrying over what its health file says about the
+// runs before, if there is one.
+func newRunHealth(dir string) *runHealth {
+	rh := &runHealth{path: filepath.Join(dir, healthFileName)}
+	data, err := ioutil.ReadFile(rh.path)
+	if err == nil {
+		err = json.Unmarshal(data, &rh.h)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		logger.Warnf("reading health file: %v", err)
+	}
+	return rh
+}
+
+// start resets the counts for a new run.
+func (rh *runHealth) start() {
+	rh.mu.Lock()
+	rh.h.Started = time.Now()
+	rh.h.Downloaded, rh.h.Failed = 0, 0
+	rh.mu.Unlock()
+}
+
+// handle counts the items that were downloaded or failed.
+func (rh *runHealth) handle(ev photobak.ProgressEvent) {
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+	switch ev.Type {
+	case photobak.ItemCommitted:
+		rh.h.Downloaded++
+	case photobak.ItemDone:
+		if ev.Err != nil && ev.Err != context.Canceled && ev.Err != context.DeadlineExceeded {
+			rh.h.Failed++
+		}
+	}
+}
+
+// end records the run that just ended with err, or that was
+// interrupted, in the health file, and returns its exit code.
+// A run that found the repository locked leaves the file to
+// the photobak that has it.
+func (rh *runHealth) end(err error, interrupted bool) int {
+	if _, ok := err.(photobak.RepoLockedError); ok {
+		return exitLocked
+	}
+	rh.mu.Lock()
+	now := time.Now()
+	rh.h.Finished = now
+	rh.h.Error = ""
+	rh.h.ExitCode = exitCode(err, rh.h.Failed)
+	switch {
+	case interrupted:
+		rh.h.Result, rh.h.ExitCode = "interrupted", exitInterrupted
+	case err != nil:
+		rh.h.Result = "failure"
+		rh.h.Error = err.Error()
+		rh.h.ConsecutiveFailures++
+	default:
+		rh.h.Result = "success"
+		if rh.h.ExitCode == exitPartial {
+			rh.h.Result = "partial"
+		}
+		rh.h.LastSuccess = &now
+		rh.h.ConsecutiveFailures = 0
+	}
+	h := rh.h
+	rh.mu.Unlock()
+
+	data, err := json.MarshalIndent(h, "", "\t")
+	if err != nil {
+		logger.Errorf("encoding health: %v", err)
+		return h.ExitCode
+	}
+	tmp := rh.path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err == nil {
+		err = os.Rename(tmp, rh.path)
+	}
+	if err != nil {
+		logger.Errorf("writing health file: %v", err)
+	}
+	return h.ExitCode
+}
+
+// exitCode returns the exit code for a run that ended
+// with err, in which failed items failed.
+func exitCode(err error, failed int64) int {
+	if err == nil {
+		if failed > 0 {
+			return exitPartial
+		}
+		return exitOK
+	}
+	var authErr photobak.AuthError
+	if errors.As(err, &authErr) {
+		return exitAuth
+	}
+	var lockErr photobak.RepoLockedError
+	if errors.As(err, &lockErr) {
+		return exitLocked
+	}
+	var fullErr photobak.DiskFullError
+	var spaceErr photobak.NotEnoughSpaceError
+	if errors.As(err, &fullErr) || errors.As(err, &spaceErr) {
+		return exitFull
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return exitNetwork
+	}
+	var sc interface{ HTTPStatusCode() int }
+	if errors.As(err, &sc) && (sc.HTTPStatusCode() >= 500 || sc.HTTPStatusCode() == 429) {
+		return exitNetwork
+	}
+	return exitFailure
+}
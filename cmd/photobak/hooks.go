@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mholt/photobak"
+)
+
+// runChangeHooks runs the -beforechanges or -afterchanges
+// command when the repository starts or finishes changing.
+// The repository waits for the command to finish, for up
+// to hookTimeout.
+func runChangeHooks(ev photobak.ProgressEvent) {
+	changeHooks(repoDir)(ev)
+}
+
+// changeHooks returns a function like runChangeHooks
+// for the repository at dir.
+func changeHooks(dir string) func(photobak.ProgressEvent) {
+	return func(ev photobak.ProgressEvent) {
+		switch ev.Type {
+		case photobak.ChangesStarted:
+			runHook(beforeChanges, dir)
+		case photobak.ChangesFinished:
+			runHook(afterChanges, dir)
+		}
+	}
+}
+
+// runHook runs command, which is split on spaces (see
+// photobak.SplitCommand), with the repo's path, dir, in the
+// PHOTOBAK_REPO environment variable. It is killed if it
+// takes longer than hookTimeout.
+func runHook(command, dir string) {
+	args, err := photobak.SplitCommand(command)
+	if err != nil {
+		logger.Errorf("running %s: %v", command, err)
+		return
+	}
+	if len(args) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), "PHOTOBAK_REPO="+dir)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		logger.Errorf("running %s: %v", command, err)
+	}
+}
+
+// heicConverter returns a function that runs the -heicjpeg
+// command, which is split like runHook's, with the paths of a
+// HEIC file and of the JPEG to write, or nil if there is none.
+func heicConverter() func(src, dst string) error {
+	args, err := photobak.SplitCommand(heicJPEG)
+	if err != nil {
+		return func(src, dst string) error {
+			return fmt.Errorf("running %s: %v", heicJPEG, err)
+		}
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return func(src, dst string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+		defer cancel()
+		cmdArgs := append(append([]string{}, args[1:]...), src, dst)
+		out, err := exec.CommandContext(ctx, args[0], cmdArgs...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("running %s: %v: %s", heicJPEG, err, bytes.TrimSpace(out))
+		}
+		return nil
+	}
+}
+
+// hookTimeout is how long a hook may take before it is
+// stopped: a run hook (see runHooks), a -beforechanges or
+// -afterchanges command, or the -heicjpeg converter.
+const hookTimeout = time.Minute
+
+// maxQueuedErrorHooks is how many -onerror hooks may wait
+// to be fired; errors beyond that are only logged.
+const maxQueuedErrorHooks = 100
+
+// hookPayload is the JSON that run hooks are given.
+type hookPayload struct {
+	Event      string     `json:"event"` // start, success, failure, or error
+	Repo       string     `json:"repo"`
+	Host       string     `json:"host"`
+	Started    time.Time  `json:"started"`
+	Finished   *time.Time `json:"finished,omitempty"`
+	Duration   float64    `json:"duration_seconds,omitempty"`
+	Queued     int64      `json:"queued"`
+	Done       int64      `json:"done"`
+	Downloaded int64      `json:"downloaded"`
+	Failed     int64      `json:"failed"`
+	Bytes      int64      `json:"bytes"`
+	Error      string     `json:"error,omitempty"`
+
+	// the item that failed, for error events
+	Account string `json:"account,omitempty"`
+	ItemID  string `json:"item_id,omitempty"`
+	File    string `json:"file,omitempty"`
+}
+
+// runHooks fires the -onstart, -onsuccess, -onfailure,
+// and -onerror hooks for the runs of the repository at dir.
+type runHooks struct {
+	dir    string
+	mu     sync.Mutex
+	report hookPayload
+	errs   chan hookPayload // -onerror hooks to fire
+	fired  chan struct{}    // closed once errs is drained
+}
+
+// newRunHooks returns the run hooks for the repository
+// at dir, or nil if no run hooks are configured.
+func newRunHooks(dir string) *runHooks {
+	if onStart == "" && onSuccess == "" && onFailure == "" && onError == "" {
+		return nil
+	}
+	return &runHooks{dir: dir}
+}
+
+// start resets the report for a new run and fires -onstart.
+// The run waits for it.
+func (h *runHooks) start() {
+	host, _ := os.Hostname()
+	h.mu.Lock()
+	h.report = hookPayload{Event: "start", Repo: h.dir, Host: host, Started: time.Now()}
+	p := h.report
+	h.errs = make(chan hookPayload, maxQueuedErrorHooks)
+	h.fired = make(chan struct{})
+	h.mu.Unlock()
+
+	go func(errs chan hookPayload, fired chan struct{}) {
+		defer close(fired)
+		for p := range errs {
+			fireHook(onError, p)
+		}
+	}(h.errs, h.fired)
+	fireHook(onStart, p)
+}
+
+// handle counts ev for the report, and queues
+// -onerror for items that failed.
+func (h *runHooks) handle(ev photobak.ProgressEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch ev.Type {
+	case photobak.ItemQueued:
+		h.report.Queued++
+	case photobak.BytesDownloaded:
+		h.report.Bytes += ev.Bytes
+	case photobak.ItemCommitted:
+		h.report.Downloaded++
+	case photobak.ItemDone:
+		h.report.Done++
+		if ev.Err == nil || ev.Err == context.Canceled || ev.Err == context.DeadlineExceeded {
+			return
+		}
+		h.report.Failed++
+		if onError == "" {
+			return
+		}
+		p := h.report
+		p.Event = "error"
+		p.Error = ev.Err.Error()
+		p.Account, p.ItemID, p.File = ev.Account, ev.ItemID, ev.FilePath
+		select {
+		case h.errs <- p:
+		default:
+			logger.Warnf("too many errors at once; not running -onerror for %s", ev.ItemID)
+		}
+	}
+}
+
+// end fires -onsuccess, or -onfailure if err is not nil, with
+// the report of the run, once the -onerror hooks are done.
+func (h *runHooks) end(err error) {
+	h.mu.Lock()
+	close(h.errs)
+	fired := h.fired
+	finished := time.Now()
+	p := h.report
+	h.mu.Unlock()
+	<-fired
+
+	p.Finished = &finished
+	p.Duration = finished.Sub(p.Started).Seconds()
+	target := onSuccess
+	p.Event = "success"
+	if err != nil {
+		target = onFailure
+		p.Event = "failure"
+		p.Error = err.Error()
+	}
+	fireHook(target, p)
+}
+
+// fireHook gives p to target: if it is an http or https URL,
+// it is POSTed there as JSON; otherwise, target is a command
+// like for runHook, which gets the JSON on its standard input
+// and the event in the PHOTOBAK_EVENT environment variable.
+func fireHook(target string, p hookPayload) {
+	if target == "" {
+		return
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		logger.Errorf("encoding %s hook: %v", p.Event, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		req, err := http.NewRequest("POST", target, bytes.NewReader(body))
+		if err != nil {
+			logger.Errorf("%s hook: %v", p.Event, err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			logger.Errorf("%s hook: %v", p.Event, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			logger.Errorf("%s hook: %s answered %s", p.Event, req.URL.Host, resp.Status)
+		}
+		return
+	}
+
+	args, err := photobak.SplitCommand(target)
+	if err != nil {
+		logger.Errorf("running %s: %v", target, err)
+		return
+	}
+	if len(args) == 0 {
+		return
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), "PHOTOBAK_REPO="+p.Repo, "PHOTOBAK_EVENT="+p.Event)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		logger.Errorf("running %s: %v", target, err)
+	}
+}
@@ -1,14 +1,23 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -16,40 +25,200 @@ import (
 	lumberjack "gopkg.in/natefinch/lumberjack.v2"
 
 	"github.com/mholt/photobak"
+	_ "github.com/mholt/photobak/dropbox"
+	_ "github.com/mholt/photobak/exec"
 	_ "github.com/mholt/photobak/googlephotos"
 )
 
 var (
+	configFile     string
 	repoDir        = "./photos_backup"
+	dbFile         string
 	keepEverything = false
+	encryptAPI     = false
+	useKeyring     = false
+	encryptCreds   = false
 	checkIntegrity = false
+	deepIntegrity  = false
+	verifyChanges  = false
+	verifyBySize   = false
+	conflicts      = photobak.ConflictKeepBoth
+	adoptExisting  = false
 	logFile        = "stderr"
+	logLevel       = "warn"
+	logFormat      = "text"
+	lang           string
 	concurrency    = 5
+	retries        = photobak.Retries.Attempts
+	backoff        = "2s,10s"
+	backoffMult    = photobak.Retries.Multiplier
+	maxBackoff     = photobak.Retries.MaxDelay
+	jitter         = photobak.Retries.Jitter
+	retryStatus    string
 	every          string
+	runWindowFlag  string
+	randomDelay    time.Duration
+	pathTemplate   string
+	dedupMode      string
+	checksumAlgo   string
+	viewList       string
+	syncFriendly   bool
+	renameFolders  bool
+	renameFiles    bool
+	fileTimes      bool
+	manifests      bool
+	xmp            bool
+	albumInfo      bool
+	heicJPEG       string
+	certify        bool
+	beforeChanges  string
+	afterChanges   string
+	onStart        string
+	onSuccess      string
+	onFailure      string
+	onError        string
+	notify         photobak.StringFlagList
+	smtpServer     string
+	notifyAfter    = 1
+	notifyErrors   int
+	maxRuntime     time.Duration
+	waitLock       time.Duration
 	prune          bool
+	syncMode       bool
+	maxPrune       = "10%"
+	force          bool
+	trashRetention = "30d"
+	listingCache   time.Duration
 	authOnly       bool
+	headless       bool
+	purgeAccount   string
 	verbose        bool
+	showProgress   bool
+	plainOutput    bool
+	writeStatus    bool
+	changes        photobak.StringFlagList
+	filters        photobak.StringFlagList
+	media          = photobak.MediaAll
+	albumOrder     = photobak.AlbumOrderRecent
+	firstAlbums    photobak.StringFlagList
+	lastAlbums     photobak.StringFlagList
+	skipDormant    string
+	maxSize        string
+	maxDisk        string
+	preflight      bool
+	dbBackups      = 3
 )
 
 func init() {
-	flag.StringVar(&repoDir, "repo", repoDir, "The directory in which to store the downloaded media")
+	flag.StringVar(&configFile, "config", configFile, "Load settings and accounts from a TOML file")
+	flag.Var(&repoDirs, "repo", "The directory in which to store the downloaded media (default "+repoDir+"); may be repeated to maintain several repositories")
+	flag.StringVar(&dbFile, "db", dbFile, "Keep the index database at this path instead of in the repo (e.g. when the repo is on a network mount)")
+	flag.IntVar(&dbBackups, "dbbackups", dbBackups, "How many copies of the database to keep, made before each run after checking it (0 for none)")
 	flag.BoolVar(&keepEverything, "everything", keepEverything, "Whether to store all metadata returned by API for each item")
+	flag.BoolVar(&encryptAPI, "encryptapi", encryptAPI, "Encrypt the metadata stored by -everything (key from PHOTOBAK_API_KEY or the OS keyring)")
+	flag.BoolVar(&encryptCreds, "encryptcreds", encryptCreds, "Encrypt account credentials in the database with a passphrase (from PHOTOBAK_PASSPHRASE or prompted)")
+	flag.BoolVar(&useKeyring, "keyring", useKeyring, "Keep account credentials in the OS keyring instead of the repo's database")
 	flag.BoolVar(&checkIntegrity, "integrity", checkIntegrity, "Enable integrity checks for items that already exist in the database")
+	flag.BoolVar(&deepIntegrity, "deep", deepIntegrity, "Hash every file in integrity checks, even if its size and modification time are unchanged")
+	flag.BoolVar(&adoptExisting, "adopt", adoptExisting, "Adopt files already in the repo folder instead of downloading them again")
+	flag.BoolVar(&verifyChanges, "verifychanges", verifyChanges, "Cheaply verify that changed items differ before re-downloading them, by the service's checksums")
+	flag.BoolVar(&verifyBySize, "verifybysize", verifyBySize, "With -verifychanges, treat changed items without a checksum as unchanged if their size is (lossy: misses edits that keep the size)")
+	flag.StringVar(&conflicts, "conflicts", conflicts, "What to do with files edited locally when their items are downloaded again: keep-both, keep-local, or keep-remote")
 	flag.StringVar(&logFile, "log", logFile, "Write logs to a file, stdout, or stderr")
-	flag.StringVar(&every, "every", every, "How often to run this command, blocking indefinitely")
+	flag.StringVar(&logLevel, "loglevel", logLevel, "Least severe level of messages to log: debug, info, warn, or error")
+	flag.StringVar(&logFormat, "logformat", logFormat, "Format of log messages: text, or json for one object per line")
+	flag.StringVar(&lang, "lang", lang, "Language of prompts and messages, like en or ru (default from the LANG environment variable)")
+	flag.StringVar(&pathTemplate, "pathtemplate", pathTemplate, "Template for the paths of new items, like \"{{.Account}}/{{.Collection}}/{{.Date}}-{{.Name}}\" (remembered by the repo)")
+	flag.StringVar(&dedupMode, "dedup", dedupMode, "How albums refer to items saved in another folder: list (others.txt), symlink, or hardlink (remembered by the repo)")
+	flag.StringVar(&checksumAlgo, "checksum", checksumAlgo, "Checksum algorithm for finding duplicates and checking files: sha256 or blake3 (remembered by the repo; switching hashes every file again)")
+	flag.StringVar(&viewList, "views", viewList, "Virtual albums to keep in the "+photobak.ViewsDir+" folder: year, camera, favorites, videos, or none (remembered by the repo)")
+	flag.BoolVar(&fileTimes, "filetimes", fileTimes, "Set the modification time of downloaded files to when their photos and videos were taken")
+	flag.BoolVar(&renameFiles, "renamefiles", renameFiles, "Rename the files of photos and videos that were renamed in the cloud")
+	flag.BoolVar(&renameFolders, "renamefolders", renameFolders, "Rename the folders of albums that were renamed in the cloud (not with -syncfriendly)")
+	flag.BoolVar(&syncFriendly, "syncfriendly", syncFriendly, "Avoid renaming files and mark the repo busy while changing it, for snapshot and sync tools")
+	flag.BoolVar(&manifests, "manifests", manifests, "Keep "+photobak.ManifestName+" (or "+photobak.BLAKE3ManifestName+") checksum files for the repo and each album up to date")
+	flag.BoolVar(&albumInfo, "albuminfo", albumInfo, "Keep an "+photobak.AlbumInfoName+" file with the title, description, cover, and item order in each album's folder")
+	flag.StringVar(&heicJPEG, "heicjpeg", heicJPEG, "Keep a JPEG copy next to each HEIC photo, made by this command (like heif-convert), which is given the photo and the JPEG to write")
+	flag.BoolVar(&xmp, "xmp", xmp, "Keep an XMP sidecar with the caption, date, and location next to each file for photo tools")
+	flag.BoolVar(&certify, "certify", certify, "After each successful run, verify the repo and write a signed certificate of its contents (key from PHOTOBAK_SIGNING_KEY or the OS keyring)")
+	flag.StringVar(&beforeChanges, "beforechanges", beforeChanges, "Command to run before the repo's files are changed")
+	flag.StringVar(&afterChanges, "afterchanges", afterChanges, "Command to run after the repo's files are changed, e.g. to take a snapshot")
+	flag.StringVar(&onStart, "onstart", onStart, "Command to run, or http(s) URL to POST to, with a JSON report when each run starts")
+	flag.StringVar(&onSuccess, "onsuccess", onSuccess, "Command to run, or http(s) URL to POST to, with a JSON report when a run succeeds")
+	flag.StringVar(&onFailure, "onfailure", onFailure, "Command to run, or http(s) URL to POST to, with a JSON report when a run fails")
+	flag.StringVar(&onError, "onerror", onError, "Command to run, or http(s) URL to POST to, with a JSON report when an item fails")
+	flag.Var(&notify, "notify", "Where to send a notification when backups fail: mailto:<address>, ntfy://host/topic, or pushover://<user key>@<app token>; may be repeated")
+	flag.StringVar(&smtpServer, "smtp", smtpServer, "Mail server for -notify mailto: addresses, as [user@]host[:port] (password from PHOTOBAK_SMTP_PASSWORD)")
+	flag.IntVar(&notifyAfter, "notifyafter", notifyAfter, "How many runs in a row must fail before -notify is notified")
+	flag.IntVar(&notifyErrors, "notifyerrors", notifyErrors, "Also notify -notify when at least this many items fail in one run (0 to not)")
+	flag.StringVar(&every, "every", every, "How often to run this command, blocking indefinitely: an interval like 1d, or a cron expression like \"30 2 * * *\" or @daily")
+	flag.StringVar(&runWindowFlag, "window", runWindowFlag, "Time of day within which runs start and end, like 01:00-06:00; runs stop cleanly when it closes")
+	flag.DurationVar(&randomDelay, "randomdelay", randomDelay, "Wait a random time up to this long (e.g. 30m) before each run, so that machines don't all start at once")
+	flag.DurationVar(&waitLock, "waitlock", waitLock, "If another photobak is using the repo, wait up to this long (e.g. 2h) for it to finish instead of failing")
+	flag.DurationVar(&maxRuntime, "max-runtime", maxRuntime, "Stop each run cleanly after this long (e.g. 4h); unfinished albums are resumed first next time")
 	flag.IntVar(&concurrency, "concurrency", concurrency, "How many downloads to do in parallel")
+	flag.IntVar(&retries, "retries", retries, "How many times to try a download or API request before giving up")
+	flag.StringVar(&backoff, "backoff", backoff, "Comma-separated durations to wait before each retry; after the last one, waits grow by -backoffmult")
+	flag.Float64Var(&backoffMult, "backoffmult", backoffMult, "How much longer to wait before each retry after the -backoff durations run out (1 to keep waiting as long as the last)")
+	flag.DurationVar(&maxBackoff, "maxbackoff", maxBackoff, "The longest to wait before a retry (0 for no limit)")
+	flag.Float64Var(&jitter, "jitter", jitter, "Fraction from 0 to 1 by which each wait before a retry may be shortened at random, to spread out retries")
+	flag.StringVar(&retryStatus, "retrystatus", retryStatus, "Comma-separated HTTP status codes or ranges to retry, like 429,500-599 (default 408,429,500-599)")
 	flag.BoolVar(&prune, "prune", prune, "Clean up removed photos and albums")
+	flag.BoolVar(&syncMode, "sync", syncMode, "Back up and then clean up removed photos and albums, listing each album only once")
+	flag.StringVar(&maxPrune, "maxprune", maxPrune, "With -sync, don't prune an account that would lose more than this percentage of its items")
+	flag.BoolVar(&force, "force", force, "Prune even if a service lists no items for an account or, with -sync, it would lose more than -maxprune of its items")
+	flag.StringVar(&trashRetention, "trashretention", trashRetention, "How long to keep pruned files in the repo's "+photobak.TrashDir+" folder before deleting them (like 30d, or 0 to delete them right away)")
+	flag.DurationVar(&listingCache, "listingcache", listingCache, "Let -prune use album listings from earlier runs made within this long (e.g. 6h) instead of listing them again")
 	flag.BoolVar(&authOnly, "authonly", authOnly, "Obtain authorizations only; do not perform backups")
-	flag.BoolVar(&verbose, "v", verbose, "Write informational log messages to stdout")
+	flag.BoolVar(&headless, "headless", headless, "Authorize accounts by pasting the address from a browser on another device, instead of opening one")
+	flag.StringVar(&purgeAccount, "purge", purgeAccount, "Permanently remove all data for an account (provider:username) from the repository")
+	flag.BoolVar(&verbose, "v", verbose, "Log informational messages too (like -loglevel info)")
+	flag.BoolVar(&showProgress, "progress", showProgress, "Show a progress bar with items remaining, download speed, and ETA")
+	flag.BoolVar(&plainOutput, "plain", plainOutput, "Write only whole lines of plain text, with no progress bar redrawing, for screen readers and log processors")
+	flag.BoolVar(&writeStatus, "status", writeStatus, "Keep a live status file ("+statusFileName+") in the repo for external monitoring")
+	flag.Var(&changes, "changes", "How to detect changed items for a provider or account, as provider[:account]=etag|updated|version|hash|size")
+	flag.StringVar(&skipDormant, "skipdormant", skipDormant, "Skip albums with no new or changed items for this long (like 90d), except in a weekly full pass")
+	flag.StringVar(&maxSize, "maxsize", maxSize, "Skip new items larger than this (like 500MiB), recording them to download later (see the skipped command)")
+	flag.StringVar(&maxDisk, "maxdisk", maxDisk, "Keep the repo's files within this size (like 500GiB); once a new item doesn't fit, no more are downloaded")
+	flag.BoolVar(&preflight, "preflight", preflight, "List everything before downloading, and stop if the new items wouldn't fit in the free disk space")
+	flag.StringVar(&media, "media", media, "Which items to back up: photos, videos, or all")
+	flag.Var(&filters, "filter", "What to back up for a provider or account, as provider[:account]=include|exclude:<album pattern>, since|until:<YYYY-MM-DD>, or media:photos|videos")
+	flag.StringVar(&albumOrder, "albumorder", albumOrder, "Which albums to back up first: recent (most recently changed), smallest, or largest")
+	flag.Var(&firstAlbums, "prioritize", "Back up albums whose names match this pattern first; may be repeated, in order")
+	flag.Var(&lastAlbums, "deprioritize", "Back up albums whose names match this pattern last, instead of the provider's automatic albums; may be repeated, in order")
 }
 
+// logger is the log of the command.
+var logger = photobak.NewLogger("cmd")
+
 type daemon struct {
-	repo       *photobak.Repository
-	repoMu     sync.Mutex
-	signalChan chan os.Signal
+	target repoTarget
+	repo   *photobak.Repository
+	repoMu sync.Mutex
+	sched  schedule
+	status *statusFile // nil unless -status
+	hooks  *runHooks   // nil unless -onstart, -onsuccess, -onfailure, or -onerror
+	notify *notifier   // nil unless -notify
+	health *runHealth  // records each run in the health file
+	paused bool        // whether downloads are paused; guarded by repoMu
+
+	// stopped is set by a run that stopped early at the
+	// end of its -max-runtime or run window.
+	stopped bool
+
+	// ctx is canceled when the program is interrupted,
+	// which stops the current run as soon as possible.
+	ctx context.Context
 }
 
-func startDaemon(interval time.Duration) {
+// interrupts receives the signals that stop the daemon; a
+// service manager can stop it by sending os.Interrupt.
+var interrupts = make(chan os.Signal, 1)
+
+// startDaemon runs a daemon for each of repoTargets at
+// once, each with its own database and download workers,
+// and keeps them running on the schedule plan.
+func startDaemon(plan schedule) {
 	if runtime.GOOS != "windows" {
 		// The default behaviour on SIGPIPE is to silently terminate the program which breaks clean shutdown, so ignore
 		// it because every program should check write() return code instead of crashing if some file descriptor became
@@ -57,37 +226,151 @@ func startDaemon(interval time.Duration) {
 		signal.Notify(make(chan os.Signal), syscall.SIGPIPE)
 	}
 
-	d := daemon{signalChan: make(chan os.Signal, 1)}
-	signal.Notify(d.signalChan, os.Interrupt, syscall.SIGTERM)
+	ctx, cancel := context.WithCancel(context.Background())
+	daemons := make([]*daemon, len(repoTargets))
+	for i, t := range repoTargets {
+		daemons[i] = &daemon{target: t, sched: plan, ctx: ctx}
+		if writeStatus {
+			daemons[i].status = newStatusFile(t.dir)
+		}
+		daemons[i].hooks = newRunHooks(t.dir)
+		daemons[i].notify = newNotifier(t.dir)
+		daemons[i].health = newRunHealth(t.dir)
+	}
+	closeStatus := func() {
+		for _, d := range daemons {
+			if d.status != nil {
+				d.status.close()
+			}
+		}
+	}
+	defer closeStatus()
 
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		<-d.signalChan
-		log.Println("[INTERRUPT] Closing database and quitting")
-		d.close(true)
+		<-interrupts
+		logger.Warnf("Interrupted; stopping (interrupt again to quit immediately)")
+		sdNotify("STOPPING=1")
+		cancel()
+		<-interrupts
+		logger.Warnf("Interrupted again; closing database and quitting")
+		for _, d := range daemons {
+			d.close(true)
+		}
+		closeStatus()
+		os.Exit(exitInterrupted)
 	}()
 
-	if err := d.run(); err != nil {
-		if interval == 0 {
-			log.Fatal(err)
-		} else {
-			log.Println(err)
+	for _, d := range daemons {
+		if d.pauseMarked() {
+			logger.Warnf("Found %s in %s; downloads are paused until it is removed", photobak.PauseMarkerName, d.target.dir)
+			d.paused = true // the first run applies it
 		}
+		go d.watchPauseMarker(ctx)
 	}
+	go handlePauseSignals(ctx, daemons)
 
-	if interval == 0 {
-		return
+	watchdogCtx, stopWatchdog := context.WithCancel(context.Background())
+	defer stopWatchdog()
+	go sdWatchdog(watchdogCtx)
+	sdNotify("READY=1")
+
+	var wg sync.WaitGroup
+	codes := make([]int, len(daemons))
+	for i, d := range daemons {
+		wg.Add(1)
+		go func(i int, d *daemon) {
+			defer wg.Done()
+			codes[i] = d.loop(len(daemons) > 1)
+		}(i, d)
+	}
+	wg.Wait()
+
+	// with several repositories, the first one
+	// that didn't succeed decides the exit code
+	for _, code := range codes {
+		if code != exitOK {
+			closeStatus()
+			os.Exit(code)
+		}
 	}
+}
+
+// loop runs d when its schedule says, until d.ctx is canceled
+// or, if there is only one run, that run is done. If named,
+// errors are logged with the repository's path. It returns
+// the exit code of the only run (see exitCode), or exitOK.
+func (d *daemon) loop(named bool) int {
+	logError := func(err error) {
+		if named {
+			err = fmt.Errorf("%s: %v", d.target.dir, err)
+		}
+		logger.Errorf("%v", err)
+	}
+
+	d.sched.first()
+	if time.Now().Before(d.sched.due) {
+		logger.Infof("First run at %s", d.sched.due.Format("2006-01-02 15:04:05"))
+	}
+	for d.sched.wait(d.ctx) {
+		if named {
+			logger.Infof("Running backup of %s", d.target.dir)
+		} else {
+			logger.Infof("Running backup")
+		}
+		sdNotify("STATUS=Running backup of " + d.target.dir)
+		if d.status != nil {
+			phase := "storing"
+			if prune {
+				phase = "pruning"
+			} else if syncMode {
+				phase = "syncing"
+			}
+			d.status.startRun(phase)
+		}
+
+		if d.hooks != nil {
+			d.hooks.start()
+		}
+		if d.notify != nil {
+			d.notify.start()
+		}
+		d.health.start()
+		d.stopped = false
+		err := d.run()
+		if err != nil {
+			logError(err)
+		}
+		if d.hooks != nil {
+			d.hooks.end(err)
+		}
+		if d.notify != nil {
+			d.notify.end(err, d.ctx.Err() != nil)
+		}
+		code := d.health.end(err, d.ctx.Err() != nil || d.stopped)
 
-	for range time.Tick(interval) {
-		log.Println("Running backup")
-		if err := d.run(); err != nil {
-			log.Println(err)
+		var next time.Time
+		if !d.sched.once && d.ctx.Err() == nil {
+			d.sched.reset()
+			next = d.sched.due
+			logger.Infof("Next run at %s", next.Format("2006-01-02 15:04:05"))
+			sdNotify("STATUS=Next run of " + d.target.dir + " at " + next.Format("2006-01-02 15:04:05"))
+		}
+		if d.status != nil {
+			d.status.endRun(err, next)
+		}
+		if d.sched.once {
+			return code
 		}
 	}
+	return exitOK
 }
 
 func (d *daemon) run() error {
-	repo, err := photobak.OpenRepo(repoDir)
+	repo, err := openRepoAt(d.target)
+	if _, ok := err.(photobak.RepoLockedError); ok {
+		return err // it says which repo; its type decides the exit code
+	}
 	if err != nil {
 		return fmt.Errorf("opening repo: %v", err)
 	}
@@ -97,15 +380,223 @@ func (d *daemon) run() error {
 	d.repoMu.Unlock()
 	defer d.close(false)
 
-	repo.NumWorkers = concurrency
+	err = repo.CheckDB()
+	if cerr, ok := err.(photobak.CorruptDBError); ok && cerr.Backup != "" {
+		return fmt.Errorf("%v; to replace it with its backup %s, run: %s recover-db", err, cerr.Backup, d.target.flags())
+	}
+	if err != nil {
+		return err
+	}
+	err = repo.BackupDB(dbBackups)
+	if err != nil {
+		return fmt.Errorf("backing up database: %v", err)
+	}
+
+	repo.NumWorkers = d.target.concurrency
+	repo.VerifyChanges = verifyChanges
+	repo.VerifyChangesBySize = verifyBySize
+	repo.Conflicts = conflicts
+	repo.DeepIntegrity = deepIntegrity
+	repo.AdoptExisting = adoptExisting
+	repo.ChangeStrategies = changeStrategies
+	repo.Filters = accountFilters
+	repo.AlbumOrder = albumOrder
+	repo.FirstAlbums = firstAlbums
+	repo.LastAlbums = lastAlbums
+	repo.Media = media
+	repo.DormantAfter = dormantAfter
+	repo.MaxSize = maxBytes
+	repo.MaxDisk = maxDiskBytes
+	repo.Preflight = preflight
+	repo.ListingMaxAge = listingCache
+	repo.SyncFriendly = syncFriendly
+	repo.RenameFolders = renameFolders
+	repo.RenameFiles = renameFiles
+	repo.FileTimes = fileTimes
+	repo.Manifests = manifests
+	repo.XMP = xmp
+	repo.AlbumInfo = albumInfo
+	repo.ConvertHEIC = heicConverter()
+
+	handlers := []func(photobak.ProgressEvent){d.health.handle}
+	if beforeChanges != "" || afterChanges != "" {
+		handlers = append(handlers, changeHooks(d.target.dir))
+	}
+	if d.status != nil {
+		handlers = append(handlers, d.status.handle)
+	}
+	if d.hooks != nil {
+		handlers = append(handlers, d.hooks.handle)
+	}
+	if d.notify != nil {
+		handlers = append(handlers, d.notify.handle)
+	}
+	if showProgress && !prune {
+		pb := newProgressBar(os.Stderr, plainOutput)
+		defer pb.finish()
+		handlers = append(handlers, pb.handle)
+	}
+	repo.Progress = func(ev photobak.ProgressEvent) {
+		for _, handle := range handlers {
+			handle(ev)
+		}
+	}
+
+	d.repoMu.Lock()
+	if d.paused {
+		repo.Pause()
+	}
+	d.repoMu.Unlock()
+
+	if pathTemplate != "" {
+		err = repo.SetPathTemplate(pathTemplate)
+		if err != nil {
+			return err
+		}
+	}
+
+	if dedupMode != "" {
+		err = repo.SetDedupMode(dedupMode)
+		if err != nil {
+			return err
+		}
+	}
+
+	if checksumAlgo != "" {
+		err = repo.SetChecksumAlgorithm(d.ctx, checksumAlgo)
+		if err != nil {
+			return err
+		}
+	}
+
+	if viewList != "" {
+		var kinds []string
+		if viewList != "none" {
+			kinds = splitList(viewList)
+		}
+		err = repo.SetViews(kinds)
+		if err != nil {
+			return err
+		}
+	}
+
+	if encryptAPI {
+		repo.APIKey, err = apiKey(repo, d.target.dir)
+		if err != nil {
+			return fmt.Errorf("getting API encryption key: %v", err)
+		}
+	}
+
+	ctx := d.ctx
+	if maxRuntime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, maxRuntime)
+		defer cancel()
+	}
+	windowEnd, inWindow := d.sched.deadline()
+	if inWindow {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, windowEnd)
+		defer cancel()
+	}
 
+	repo.ForcePrune = force
+	repo.TrashRetention = trashKept
 	if prune {
-		return repo.Prune()
+		err = repo.Prune(ctx)
+	} else if syncMode {
+		repo.PruneLimit = pruneLimit
+		err = repo.Sync(ctx, keepEverything, checkIntegrity)
+	} else {
+		err = repo.Store(ctx, keepEverything, checkIntegrity)
+	}
+	if _, ok := err.(photobak.PruneLimitError); ok {
+		err = fmt.Errorf("%v; if the items were really deleted, run again with -force", err)
+	}
+	if dfe, ok := err.(photobak.DiskFullError); ok {
+		err = diskFullError{dfe}
+	}
+	if nse, ok := err.(photobak.NotEnoughSpaceError); ok {
+		err = notEnoughSpaceError{nse}
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded && d.ctx.Err() == nil {
+		if inWindow && !time.Now().Before(windowEnd) {
+			logger.Warnf("Stopped at the end of the run window, %s", windowEnd.Format("15:04"))
+		} else {
+			logger.Warnf("Stopped after reaching the maximum run time of %s", maxRuntime)
+		}
+		d.stopped = true
+		return nil
+	}
+	if err == nil && certify && ctx.Err() == nil {
+		writeCertificate(repo, d.target.dir)
+	}
+	return err
+}
+
+// diskFullError is a photobak.DiskFullError told in units
+// that people read, with what to do about it.
+type diskFullError struct {
+	photobak.DiskFullError
+}
+
+func (e diskFullError) Error() string {
+	msg := fmt.Sprintf("the repository is full: it takes %s of its -maxdisk %s, so %d new items were not downloaded",
+		humanBytes(float64(e.Used)), humanBytes(float64(e.Max)), e.Items)
+	if e.Needed > 0 {
+		msg += fmt.Sprintf("; they need at least %s more", humanBytes(float64(e.Needed)))
+	}
+	if e.Unknown > 0 {
+		msg += fmt.Sprintf(" (%d of them are of unknown size)", e.Unknown)
+	}
+	return msg + "; raise -maxdisk or free up space to download them"
+}
+
+// Unwrap returns the photobak.DiskFullError.
+func (e diskFullError) Unwrap() error {
+	return e.DiskFullError
+}
+
+// notEnoughSpaceError is a photobak.NotEnoughSpaceError
+// told in units that people read.
+type notEnoughSpaceError struct {
+	photobak.NotEnoughSpaceError
+}
+
+func (e notEnoughSpaceError) Error() string {
+	msg := fmt.Sprintf("%s: not enough disk space for the backup: %d new items need at least %s (with room for the database), but only %s is free",
+		e.Account, e.Items, humanBytes(float64(e.Needed)), humanBytes(float64(e.Free)))
+	if e.Unknown > 0 {
+		msg += fmt.Sprintf(", and %d more items are of unknown size", e.Unknown)
 	}
+	return msg + "; nothing was downloaded"
+}
+
+// Unwrap returns the photobak.NotEnoughSpaceError.
+func (e notEnoughSpaceError) Unwrap() error {
+	return e.NotEnoughSpaceError
+}
 
-	return repo.Store(keepEverything, checkIntegrity)
+// writeCertificate verifies repo, which is at dir, and writes a
+// certificate of its contents. Failures are logged, since the
+// run itself was successful.
+func writeCertificate(repo *photobak.Repository, dir string) {
+	key, err := signingKey(repo, dir)
+	if err != nil {
+		logger.Errorf("getting signing key: %v", err)
+		return
+	}
+	_, certPath, err := repo.Certify(key)
+	if err != nil {
+		logger.Warnf("not writing a certificate: %v", err)
+		return
+	}
+	logger.Infof("Wrote certificate %s", certPath)
 }
 
+// close closes the repository of d, if it is open. If exit
+// is true, the program is about to quit without waiting
+// for the current run to stop.
 func (d *daemon) close(exit bool) {
 	d.repoMu.Lock()
 	defer d.repoMu.Unlock()
@@ -118,37 +609,113 @@ func (d *daemon) close(exit bool) {
 		}
 		d.repo = nil
 	}
-
-	if exit {
-		os.Exit(0)
-	}
 }
 
 func main() {
 	flag.Parse()
+	explicitRepo := explicitFlag("repo")
+
+	if configFile != "" {
+		err := loadConfig(configFile)
+		if err != nil {
+			usageFatal(err)
+		}
+	}
 
-	if verbose {
-		photobak.Info = log.New(os.Stdout, "", log.LstdFlags)
+	photobak.HeadlessAuth = headless
+	photobak.LockWait = waitLock
+
+	if lang != "" {
+		photobak.Locale = photobak.ParseLocale(lang)
 	}
 
+	var logOutput io.Writer
 	switch logFile {
 	case "stdout":
-		log.SetOutput(os.Stdout)
+		logOutput = os.Stdout
 	case "stderr":
-		log.SetOutput(os.Stderr)
+		logOutput = os.Stderr
 	case "":
-		log.SetOutput(ioutil.Discard)
+		logOutput = ioutil.Discard
 	default:
-		log.SetOutput(&lumberjack.Logger{
+		logOutput = &lumberjack.Logger{
 			Filename:   logFile,
 			MaxSize:    100,
 			MaxAge:     90,
 			MaxBackups: 10,
-		})
+		}
+	}
+	log.SetOutput(logOutput)
+	photobak.LogOutput = logOutput
+
+	level, err := photobak.ParseLevel(logLevel)
+	if err != nil {
+		usageFatal(err)
+	}
+	if verbose && level > photobak.LevelInfo {
+		level = photobak.LevelInfo
+	}
+	photobak.LogLevel = level
+	switch logFormat {
+	case "text":
+	case "json":
+		photobak.LogJSON = true
+	default:
+		usageFatalf("unknown log format '%s': must be text or json", logFormat)
 	}
 
 	if concurrency < 1 {
-		log.Fatal("concurrency must be at least 1")
+		usageFatal("concurrency must be at least 1")
+	}
+	if err := setRepoTargets(explicitRepo); err != nil {
+		usageFatal(err)
+	}
+	if showProgress && len(repoTargets) > 1 {
+		usageFatal("-progress can only show one repository at a time")
+	}
+
+	if retries < 1 {
+		usageFatal("retries must be at least 1")
+	}
+	backoffs, err := parseBackoff(backoff)
+	if err != nil {
+		usageFatal(err)
+	}
+	if maxBackoff < 0 {
+		usageFatal("maxbackoff must not be negative")
+	}
+	if jitter < 0 || jitter > 1 {
+		usageFatal("jitter must be from 0 to 1")
+	}
+	statuses, err := parseStatusCodes(retryStatus)
+	if err != nil {
+		usageFatal(err)
+	}
+	photobak.Retries = photobak.RetryPolicy{
+		Attempts:    retries,
+		Backoff:     backoffs,
+		Multiplier:  backoffMult,
+		MaxDelay:    maxBackoff,
+		Jitter:      jitter,
+		RetryStatus: statuses,
+	}
+
+	// the pause and resume commands work while
+	// another photobak has the repository open
+	cmd := flag.Arg(0)
+	if purgeAccount == "" && cmd != "accounts" && cmd != "pause" && cmd != "resume" {
+		err := applySavedAccounts()
+		if _, ok := err.(photobak.RepoLockedError); ok {
+			log.Print(err)
+			os.Exit(exitLocked)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = checkTargetAccounts()
+		if err != nil {
+			usageFatal(err)
+		}
 	}
 
 	if authOnly {
@@ -156,22 +723,289 @@ func main() {
 		if err != nil {
 			log.Fatalf("[ERROR] %v", err)
 		}
-		fmt.Println("All configured accounts have credentials.")
+		fmt.Println(photobak.Tr("All configured accounts have credentials."))
+		return
+	}
+
+	changeStrategies, err = parseChanges(changes)
+	if err != nil {
+		usageFatal(err)
+	}
+
+	accountFilters, err = parseFilters(filters)
+	if err != nil {
+		usageFatal(err)
+	}
+	if err := (photobak.Filter{Media: media}).Validate(); err != nil {
+		usageFatal(err)
+	}
+	if err := photobak.ValidateConflicts(conflicts); err != nil {
+		usageFatal(err)
+	}
+	if err := photobak.ValidateAlbumOrder(albumOrder, append(append([]string(nil), firstAlbums...), lastAlbums...)); err != nil {
+		usageFatal(err)
+	}
+
+	notifyTargets, err = parseNotify(notify)
+	if err != nil {
+		usageFatal(err)
+	}
+	if notifyAfter < 1 {
+		usageFatal("notifyafter must be at least 1")
+	}
+	if notifyErrors < 0 {
+		usageFatal("notifyerrors must not be negative")
+	}
+
+	if skipDormant != "" {
+		dormantAfter, err = parseEvery(skipDormant)
+		if err != nil {
+			usageFatalf("bad -skipdormant: %v", err)
+		}
+	}
+
+	if prune && syncMode {
+		usageFatal("-prune and -sync cannot be used together; -sync prunes too")
+	}
+
+	pruneLimit, err = strconv.ParseFloat(strings.TrimSuffix(maxPrune, "%"), 64)
+	if err != nil || pruneLimit <= 0 || pruneLimit > 100 {
+		usageFatalf("bad -maxprune: must be a percentage above 0, up to 100")
+	}
+	pruneLimit /= 100
+
+	if trashRetention != "0" {
+		trashKept, err = parseEvery(trashRetention)
+		if err != nil {
+			usageFatalf("bad -trashretention: %v", err)
+		}
+	}
+
+	if maxSize != "" {
+		maxBytes, err = parseSize(maxSize)
+		if err != nil {
+			usageFatalf("bad -maxsize: %v", err)
+		}
+	}
+	if maxDisk != "" {
+		maxDiskBytes, err = parseSize(maxDisk)
+		if err != nil {
+			usageFatalf("bad -maxdisk: %v", err)
+		}
+	}
+
+	if flag.NArg() > 0 {
+		err := runCommand(flag.Arg(0), flag.Args()[1:])
+		if err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+		return
+	}
+
+	if purgeAccount != "" {
+		err := purge(purgeAccount)
+		if err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
 		return
 	}
 
-	// parse the interval, if present, right away
+	// parse the schedule, if present, right away
 	// so we can report error immediately if needed.
-	var itvl time.Duration
-	if every != "" {
-		var err error
-		itvl, err = parseEvery(every)
+	plan := schedule{once: every == "", delay: randomDelay}
+	if isCronExpr(every) {
+		plan.cron, err = parseCron(every)
+	} else if every != "" {
+		plan.interval, err = parseEvery(every)
+	}
+	if err != nil {
+		usageFatal(err)
+	}
+	if runWindowFlag != "" {
+		plan.window, err = parseWindow(runWindowFlag)
 		if err != nil {
-			log.Fatal(err)
+			usageFatal(err)
+		}
+	}
+	if randomDelay < 0 {
+		usageFatal("randomdelay must not be negative")
+	}
+
+	if runningAsService() {
+		err := runService(plan)
+		if err != nil {
+			log.Fatalf("[ERROR] running as a service: %v", err)
+		}
+		return
+	}
+	startDaemon(plan)
+}
+
+// usageFatal logs v and exits with exitUsage, for
+// flags and settings that are invalid.
+func usageFatal(v ...interface{}) {
+	log.Print(v...)
+	os.Exit(exitUsage)
+}
+
+// usageFatalf is like usageFatal, with a format.
+func usageFatalf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+	os.Exit(exitUsage)
+}
+
+// changeStrategies is the parsed form of the -changes flags.
+var changeStrategies map[string]string
+
+// parseChanges parses a list of provider[:account]=strategy
+// values into a map of provider or account to strategy.
+func parseChanges(list []string) (map[string]string, error) {
+	strategies := make(map[string]string)
+	for _, val := range list {
+		parts := strings.SplitN(val, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("bad change strategy '%s': must be provider[:account]=strategy", val)
+		}
+		if !photobak.IsChangeStrategy(parts[1]) {
+			return nil, fmt.Errorf("unknown change strategy '%s'", parts[1])
+		}
+		strategies[strings.ToLower(parts[0])] = parts[1]
+	}
+	return strategies, nil
+}
+
+// dormantAfter is the parsed form of the -skipdormant flag.
+var dormantAfter time.Duration
+
+// pruneLimit is the parsed form of the -maxprune
+// flag, as a fraction.
+var pruneLimit float64
+
+// trashKept is the parsed form of the -trashretention flag.
+var trashKept time.Duration
+
+// maxBytes is the parsed form of the -maxsize flag.
+var maxBytes int64
+
+// maxDiskBytes is the parsed form of the -maxdisk flag.
+var maxDiskBytes int64
+
+// parseSize parses a size like 500MiB, 2G, or 1048576 into
+// bytes. Units are powers of 1024; an "iB" or "B" after
+// the unit's letter is optional.
+func parseSize(size string) (int64, error) {
+	num := strings.TrimRight(size, "KMGTiBkmgtb")
+	unit := strings.ToUpper(strings.TrimSpace(size[len(num):]))
+	unit = strings.TrimSuffix(strings.TrimSuffix(unit, "B"), "I")
+	n, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad size value: %v", err)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("size %s is negative", size)
+	}
+	shift := strings.Index("KMGT", unit) + 1
+	if unit == "" {
+		shift = 0
+	} else if shift == 0 || len(unit) > 1 {
+		return 0, fmt.Errorf("unknown unit in '%s': must be K, M, G, or T", size)
+	}
+	return int64(n * float64(int64(1)<<(10*uint(shift)))), nil
+}
+
+// accountFilters is the parsed form of the -filter flags.
+var accountFilters map[string]photobak.Filter
+
+// parseFilters parses a list of provider[:account]=rule values
+// into a map of provider or account to the filter made of its
+// rules. A rule is include:<pattern>, exclude:<pattern>,
+// since:<date>, until:<date> (inclusive), or media:<kind>.
+func parseFilters(list []string) (map[string]photobak.Filter, error) {
+	filters := make(map[string]photobak.Filter)
+	for _, val := range list {
+		parts := strings.SplitN(val, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("bad filter '%s': must be provider[:account]=rule", val)
+		}
+		key := strings.ToLower(parts[0])
+		rule := strings.SplitN(parts[1], ":", 2)
+		if len(rule) != 2 || rule[1] == "" {
+			return nil, fmt.Errorf("bad filter rule '%s': must be kind:value", parts[1])
+		}
+		f := filters[key]
+		switch kind, arg := strings.ToLower(rule[0]), rule[1]; kind {
+		case "include":
+			f.IncludeAlbums = append(f.IncludeAlbums, arg)
+		case "exclude":
+			f.ExcludeAlbums = append(f.ExcludeAlbums, arg)
+		case "since", "until":
+			t, err := time.ParseInLocation("2006-01-02", arg, time.Local)
+			if err != nil {
+				return nil, fmt.Errorf("bad date in filter rule '%s': must be YYYY-MM-DD", parts[1])
+			}
+			if kind == "since" {
+				f.Since = t
+			} else {
+				f.Until = t.AddDate(0, 0, 1)
+			}
+		case "media":
+			f.Media = strings.ToLower(arg)
+		default:
+			return nil, fmt.Errorf("unknown filter rule '%s': must be include, exclude, since, until, or media", kind)
+		}
+		filters[key] = f
+	}
+	for key, f := range filters {
+		if err := f.Validate(); err != nil {
+			return nil, fmt.Errorf("filter for %s: %v", key, err)
 		}
 	}
+	return filters, nil
+}
+
+// parseBackoff parses a comma-separated list of durations.
+func parseBackoff(list string) ([]time.Duration, error) {
+	var durations []time.Duration
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("bad backoff duration: %v", err)
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("backoff duration %s is negative", d)
+		}
+		durations = append(durations, d)
+	}
+	return durations, nil
+}
 
-	startDaemon(itvl)
+// parseStatusCodes parses a comma-separated list of HTTP
+// status codes and ranges of them, like "429,500-599".
+func parseStatusCodes(list string) ([]int, error) {
+	var codes []int
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		bounds := strings.SplitN(s, "-", 2)
+		first, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		last := first
+		if err == nil && len(bounds) == 2 {
+			last, err = strconv.Atoi(strings.TrimSpace(bounds[1]))
+		}
+		if err != nil || first < 100 || last > 599 || first > last {
+			return nil, fmt.Errorf("bad HTTP status code or range '%s'", s)
+		}
+		for code := first; code <= last; code++ {
+			codes = append(codes, code)
+		}
+	}
+	return codes, nil
 }
 
 func parseEvery(every string) (time.Duration, error) {
@@ -203,17 +1037,1270 @@ func parseEvery(every string) (time.Duration, error) {
 	return time.Duration(minutes) * time.Minute, nil
 }
 
+// openRepo opens the repository given by the flags.
+func openRepo() (*photobak.Repository, error) {
+	return openRepoAt(repoTarget{dir: repoDir, db: dbFile})
+}
+
+// openRepoAt opens the repository t, limited to its accounts.
+func openRepoAt(t repoTarget) (*photobak.Repository, error) {
+	repo, err := photobak.OpenRepoWithDB(t.dir, t.db)
+	if err != nil {
+		return nil, err
+	}
+	repo.Accounts = t.accounts
+	if useKeyring {
+		creds, err := newKeyringCredentials(t.dir)
+		if err != nil {
+			repo.Close()
+			return nil, err
+		}
+		repo.CredentialStore = creds
+	} else if encryptCreds {
+		repo.CredentialPassphrase = credentialPassphrase
+	}
+	return repo, nil
+}
+
 func authorize() error {
-	fmt.Println("[Authorization Mode]")
-	fmt.Println("No backups will be performed, but credentials will be obtained")
-	fmt.Println("and stored to the database in the repo. You may then use this")
-	fmt.Printf("repository headless.\n\n")
+	fmt.Println(photobak.Tr("[Authorization Mode]\n" +
+		"No backups will be performed, but credentials will be obtained\n" +
+		"and stored to the database in the repo. You may then use this\n" +
+		"repository headless."))
+	fmt.Println()
+
+	for _, t := range repoTargets {
+		repo, err := openRepoAt(t)
+		if err != nil {
+			return fmt.Errorf("opening repository %s: %v", t.dir, err)
+		}
+		err = repo.AuthorizeAllAccounts()
+		repo.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func purge(account string) error {
+	if err := oneRepo("-purge"); err != nil {
+		return err
+	}
+	fmt.Println(photobak.Tr("[Purge Mode]\n"+
+		"All files, index entries, and credentials for %s will be\n"+
+		"permanently removed from the repository. Files that other\n"+
+		"accounts share will be kept for them.", account))
+	fmt.Print(photobak.Tr("Type the account name to confirm: "))
+	var confirm string
+	fmt.Scanln(&confirm)
+	if confirm != account {
+		return fmt.Errorf("confirmation did not match; nothing was purged")
+	}
 
-	repo, err := photobak.OpenRepo(repoDir)
+	repo, err := openRepo()
 	if err != nil {
 		return fmt.Errorf("opening repository: %v", err)
 	}
 	defer repo.Close()
+	repo.SyncFriendly = syncFriendly
+	repo.Manifests = manifests
+	repo.XMP = xmp
+	repo.AlbumInfo = albumInfo
+	repo.ConvertHEIC = heicConverter()
+	repo.Progress = runChangeHooks
 
-	return repo.AuthorizeAllAccounts()
+	report, err := repo.PurgeAccount(account)
+	fmt.Print(report)
+	if err != nil {
+		return err
+	}
+	if len(report.Problems) > 0 {
+		return fmt.Errorf("purge could not be fully verified")
+	}
+	return nil
+}
+
+// runCommand runs the subcommand cmd with args.
+func runCommand(cmd string, args []string) error {
+	if err := oneRepo("the " + cmd + " command"); err != nil && cmd != "service" && cmd != "pause" && cmd != "resume" {
+		return err
+	}
+	switch cmd {
+	case "restore":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: photobak [flags] restore <dest>")
+		}
+		return restore(args[0])
+	case "export":
+		return export(args)
+	case "export-index":
+		return exportIndex(args)
+	case "import":
+		return importFolder(args)
+	case "import-takeout":
+		return importTakeout(args)
+	case "dupes":
+		return dupes(args)
+	case "info":
+		return info(args)
+	case "ls", "search":
+		return search(cmd, args)
+	case "views":
+		if len(args) > 1 {
+			return fmt.Errorf("usage: photobak [flags] views [<view>]")
+		}
+		return views(args)
+	case "fsck":
+		return fsck()
+	case "verify":
+		return verify()
+	case "check":
+		return check(args)
+	case "replicate":
+		return replicate(args)
+	case "pause", "resume":
+		return pauseCommand(cmd == "resume")
+	case "service":
+		return service(args)
+	case "verify-remote":
+		return verifyRemote(args)
+	case "verify-certificate":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: photobak [flags] verify-certificate <file>")
+		}
+		return verifyCertificate(args[0])
+	case "repair":
+		return repair(args)
+	case "orphans":
+		return orphans(args)
+	case "purge-meta":
+		return purgeMeta(args)
+	case "recover-db":
+		return recoverDB(args)
+	case "compact":
+		if len(args) > 0 {
+			return fmt.Errorf("usage: photobak [flags] compact")
+		}
+		return compact()
+	case "reindex":
+		if len(args) > 0 {
+			return fmt.Errorf("usage: photobak [flags] reindex")
+		}
+		return reindex()
+	case "trash":
+		return trash()
+	case "remap-ids":
+		return remapIDs()
+	case "map-ids":
+		return mapIDs()
+	case "accounts":
+		return accounts(args)
+	case "skipped":
+		if len(args) > 0 {
+			return fmt.Errorf("usage: photobak [flags] skipped")
+		}
+		return skipped()
+	case "serve":
+		return serve(args)
+	case "reauth":
+		return reauth(args)
+	case "revoke":
+		return revoke(args)
+	case "pin", "local-only", "unpin":
+		if len(args) == 0 {
+			return fmt.Errorf("usage: photobak [flags] %s <path>...", cmd)
+		}
+		return protect(cmd, args)
+	default:
+		return fmt.Errorf("unknown command '%s'", cmd)
+	}
+}
+
+func restore(dest string) error {
+	repo, err := openRepo()
+	if err != nil {
+		return fmt.Errorf("opening repository: %v", err)
+	}
+	defer repo.Close()
+
+	n, err := repo.Restore(dest)
+	fmt.Println(photobak.Tr("Restored %d files to %s", n, dest))
+	return err
+}
+
+// export writes albums from the repository to an archive
+// file, according to the flags in args.
+func export(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	archive := fs.String("archive", "", "The archive file to create (.zip, .tar, .tar.gz, or .tgz)")
+	albums := fs.String("albums", "", "Comma-separated patterns of album names to export, like \"Wedding*\" (default all)")
+	accounts := fs.String("accounts", "", "Comma-separated accounts (provider:username) to export (default all)")
+	sidecars := fs.Bool("sidecars", false, "Add a JSON file with the metadata of each item")
+	bag := fs.Bool("bag", false, "Make the archive a BagIt bag for archival storage (implies -sidecars)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *archive == "" || fs.NArg() > 0 {
+		return fmt.Errorf("usage: photobak [flags] export -archive <file> [-albums <patterns>] [-accounts <accounts>] [-sidecars] [-bag]")
+	}
+
+	opts := photobak.ExportOptions{Sidecars: *sidecars}
+	var ext string
+	lower := strings.ToLower(*archive)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		opts.Format, ext = photobak.ArchiveZip, ".zip"
+	case strings.HasSuffix(lower, ".tar"):
+		opts.Format, ext = photobak.ArchiveTar, ".tar"
+	case strings.HasSuffix(lower, ".tar.gz"):
+		opts.Format, ext = photobak.ArchiveTarGz, ".tar.gz"
+	case strings.HasSuffix(lower, ".tgz"):
+		opts.Format, ext = photobak.ArchiveTarGz, ".tgz"
+	default:
+		return fmt.Errorf("unknown archive type: %s (use .zip, .tar, .tar.gz, or .tgz)", *archive)
+	}
+	if *bag {
+		// the bag is named after the archive file
+		opts.Bag = filepath.Base((*archive)[:len(*archive)-len(ext)])
+		if opts.Bag == "" || opts.Bag == "." {
+			return fmt.Errorf("cannot name bag after archive file %s", *archive)
+		}
+	}
+	opts.Albums = splitList(*albums)
+	opts.Accounts = splitList(*accounts)
+
+	repo, err := openRepo()
+	if err != nil {
+		return fmt.Errorf("opening repository: %v", err)
+	}
+	defer repo.Close()
+
+	f, err := os.OpenFile(*archive, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	n, err := repo.Export(f, opts)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(*archive)
+		return err
+	}
+	fmt.Println(photobak.Tr("Exported %d items to %s", n, *archive))
+	return nil
+}
+
+// splitList returns the non-empty, trimmed
+// items of the comma-separated list s.
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// info prints everything known about the items
+// named by args, according to the flags in args.
+func info(args []string) error {
+	fs := flag.NewFlagSet("info", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "Print the information as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: photobak [flags] info [-json] <path|itemID>")
+	}
+
+	repo, err := openRepo()
+	if err != nil {
+		return fmt.Errorf("opening repository: %v", err)
+	}
+	defer repo.Close()
+	if encryptAPI {
+		repo.APIKey, err = apiKey(repo, repoDir)
+		if err != nil {
+			return fmt.Errorf("getting API encryption key: %v", err)
+		}
+	}
+
+	infos, err := repo.ItemInfo(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		return enc.Encode(infos)
+	}
+	for i, ii := range infos {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Print(ii)
+	}
+	return nil
+}
+
+// search lists the items in the index that match
+// the flags in args, as file paths or JSON.
+func search(cmd string, args []string) error {
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	accounts := fs.String("account", "", "Comma-separated accounts (provider:username) to search (default all)")
+	albums := fs.String("album", "", "Comma-separated patterns of album names, like \"Wedding*\"")
+	name := fs.String("name", "", "A pattern of item names, like \"IMG_12*.jpg\"")
+	from := fs.String("from", "", "Only items taken on or after this date (YYYY-MM-DD)")
+	to := fs.String("to", "", "Only items taken on or before this date (YYYY-MM-DD)")
+	hasGPS := fs.Bool("gps", false, "Only items whose location is known")
+	caption := fs.String("caption", "", "Only items whose caption contains this text")
+	asJSON := fs.Bool("json", false, "Print each item as a line of JSON instead of its file path")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("usage: photobak [flags] %s [-account <accounts>] [-album <patterns>] [-name <pattern>] "+
+			"[-from <date>] [-to <date>] [-gps] [-caption <text>] [-json]", cmd)
+	}
+
+	q := photobak.SearchQuery{
+		Accounts: splitList(*accounts),
+		Albums:   splitList(*albums),
+		Name:     *name,
+		HasGPS:   *hasGPS,
+		Caption:  *caption,
+	}
+	var err error
+	if *from != "" {
+		q.From, err = time.ParseInLocation("2006-01-02", *from, time.Local)
+		if err != nil {
+			return fmt.Errorf("bad -from date '%s': must be YYYY-MM-DD", *from)
+		}
+	}
+	if *to != "" {
+		q.To, err = time.ParseInLocation("2006-01-02", *to, time.Local)
+		if err != nil {
+			return fmt.Errorf("bad -to date '%s': must be YYYY-MM-DD", *to)
+		}
+		q.To = q.To.AddDate(0, 0, 1).Add(-time.Nanosecond) // the whole day
+	}
+
+	repo, err := openRepo()
+	if err != nil {
+		return fmt.Errorf("opening repository: %v", err)
+	}
+	defer repo.Close()
+
+	results, err := repo.Search(q)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, result := range results {
+			if err := enc.Encode(result); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var last string
+	for _, result := range results {
+		if result.FilePath != last { // items of several accounts may share a file
+			fmt.Println(result.FilePath)
+			last = result.FilePath
+		}
+	}
+	return nil
+}
+
+// dupes lists the photos in the repository that look
+// the same, according to the flags in args.
+func dupes(args []string) error {
+	fs := flag.NewFlagSet("dupes", flag.ContinueOnError)
+	distance := fs.Int("distance", 4, "How many bits (of 64) the perceptual hashes of photos may differ to be considered the same")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("usage: photobak [flags] dupes [-distance <bits>]")
+	}
+
+	repo, err := openRepo()
+	if err != nil {
+		return fmt.Errorf("opening repository: %v", err)
+	}
+	defer repo.Close()
+
+	groups, err := repo.Dupes(*distance)
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		for _, fpath := range group {
+			fmt.Println(fpath)
+		}
+		fmt.Println()
+	}
+	fmt.Println(photobak.Tr("Found %d groups of photos that look the same", len(groups)))
+	return nil
+}
+
+// views lists the folders of all kinds of views and how many
+// files are in each, or if args names one, the files in it.
+func views(args []string) error {
+	repo, err := openRepo()
+	if err != nil {
+		return fmt.Errorf("opening repository: %v", err)
+	}
+	defer repo.Close()
+
+	contents, err := repo.ViewContents()
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 1 {
+		files, ok := contents[filepath.Clean(filepath.FromSlash(args[0]))]
+		if !ok {
+			return fmt.Errorf("no view named '%s'", args[0])
+		}
+		for _, fpath := range files {
+			fmt.Println(fpath)
+		}
+		return nil
+	}
+
+	folders := make([]string, 0, len(contents))
+	for folder := range contents {
+		folders = append(folders, folder)
+	}
+	sort.Strings(folders)
+	for _, folder := range folders {
+		fmt.Printf("%s (%d)\n", filepath.ToSlash(folder), len(contents[folder]))
+	}
+	return nil
+}
+
+// protect sets the protection of the items and
+// collections at paths according to cmd.
+func protect(cmd string, paths []string) error {
+	p := photobak.Unprotected
+	switch cmd {
+	case "pin":
+		p = photobak.Pinned
+	case "local-only":
+		p = photobak.LocalOnly
+	}
+
+	repo, err := openRepo()
+	if err != nil {
+		return fmt.Errorf("opening repository: %v", err)
+	}
+	defer repo.Close()
+
+	for _, fpath := range paths {
+		n, err := repo.Protect(fpath, p)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: %d item(s) or collection(s) now %s\n", fpath, n, p)
+	}
+	return nil
+}
+
+func fsck() error {
+	repo, err := openRepo()
+	if err != nil {
+		return fmt.Errorf("opening repository: %v", err)
+	}
+	defer repo.Close()
+
+	report, err := repo.Fsck()
+	fmt.Print(report)
+	return err
+}
+
+// verify audits the repository and writes the report as
+// JSON to stdout and a summary to stderr. It returns an
+// error if there are problems.
+func verify() error {
+	repo, err := openRepo()
+	if err != nil {
+		return fmt.Errorf("opening repository: %v", err)
+	}
+	defer repo.Close()
+
+	report, err := repo.Verify()
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "\t")
+	err = enc.Encode(report)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(os.Stderr, report)
+	if len(report.Problems) > 0 {
+		return fmt.Errorf("found %d problems", len(report.Problems))
+	}
+	return nil
+}
+
+// verifyCertificate checks the certificate in the file at
+// certPath against the manifest beside it, and prints what
+// it certifies.
+func verifyCertificate(certPath string) error {
+	certJSON, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return err
+	}
+	manifest, err := ioutil.ReadFile(strings.TrimSuffix(certPath, ".json"))
+	if err != nil {
+		return fmt.Errorf("reading certified manifest: %v", err)
+	}
+	cert, err := photobak.VerifyCertificate(certJSON, manifest)
+	if err != nil {
+		return err
+	}
+	fmt.Println(photobak.Tr("Valid certificate of %s: %d accounts, %d albums, %d items, %d files, %d bytes",
+		cert.Created.Local().Format(time.RFC1123), cert.Accounts, cert.Collections, cert.Items, cert.Files, cert.Bytes))
+	fmt.Println(photobak.Tr("Signed by public key %s", cert.PublicKey))
+	return nil
+}
+
+// verifyRemote compares a sample of the items in the
+// repository with the remote originals.
+func verifyRemote(args []string) error {
+	fs := flag.NewFlagSet("verify-remote", flag.ContinueOnError)
+	sample := fs.String("sample", "1%", "Percentage of items to download again and compare")
+	pause := fs.Duration("pause", 0, "How long to wait between downloads")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("usage: photobak [flags] verify-remote [-sample <percent>] [-pause <duration>]")
+	}
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(*sample, "%"), 64)
+	if err != nil {
+		return fmt.Errorf("bad sample '%s': %v", *sample, err)
+	}
+
+	repo, err := openRepo()
+	if err != nil {
+		return fmt.Errorf("opening repository: %v", err)
+	}
+	defer repo.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	report, err := repo.VerifyRemote(ctx, photobak.RemoteVerifyOptions{Sample: percent / 100, Pause: *pause})
+	fmt.Print(report)
+	if err != nil {
+		return err
+	}
+	if len(report.Problems) > 0 {
+		return fmt.Errorf("%d items differ from the remote originals", len(report.Problems))
+	}
+	return nil
+}
+
+// check re-hashes the files in the repository
+// and reports the ones that are damaged or missing.
+func check(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	workers := fs.Int("workers", 4, "How many files to hash at once")
+	accounts := fs.String("account", "", "Comma-separated accounts (provider:username) to check (default all)")
+	redownload := fs.Bool("redownload", false, "Mark damaged and missing files to be downloaded again by the next backup")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("usage: photobak [flags] check [-workers <n>] [-account <accounts>] [-redownload]")
+	}
+	if *workers < 1 {
+		return fmt.Errorf("workers must be at least 1")
+	}
+
+	repo, err := openRepo()
+	if err != nil {
+		return fmt.Errorf("opening repository: %v", err)
+	}
+	defer repo.Close()
+	repo.DeepIntegrity = deepIntegrity
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	report, err := repo.Check(ctx, photobak.CheckOptions{
+		Workers:    *workers,
+		Accounts:   splitList(*accounts),
+		Redownload: *redownload,
+	})
+	fmt.Print(report)
+	if err != nil {
+		return err
+	}
+	if len(report.Problems) > 0 {
+		return fmt.Errorf("%d files are damaged or missing", len(report.Problems))
+	}
+	return nil
+}
+
+// replicate mirrors the repository into another
+// folder, according to the flags in args.
+func replicate(args []string) error {
+	fs := flag.NewFlagSet("replicate", flag.ContinueOnError)
+	del := fs.Bool("delete", false, "Delete files in the destination that are not in the repository")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: photobak [flags] replicate [-delete] <dest>")
+	}
+
+	repo, err := openRepo()
+	if err != nil {
+		return fmt.Errorf("opening repository: %v", err)
+	}
+	defer repo.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	report, err := repo.Replicate(ctx, fs.Arg(0), photobak.ReplicateOptions{Delete: *del})
+	fmt.Print(report)
+	return err
+}
+
+// repair verifies the repository and repairs the problems,
+// asking about each one unless -yes is in args.
+func repair(args []string) error {
+	fs := flag.NewFlagSet("repair", flag.ContinueOnError)
+	yes := fs.Bool("yes", false, "Repair all problems without asking")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("usage: photobak [flags] repair [-yes]")
+	}
+
+	repo, err := openRepo()
+	if err != nil {
+		return fmt.Errorf("opening repository: %v", err)
+	}
+	defer repo.Close()
+	repo.SyncFriendly = syncFriendly
+	repo.Manifests = manifests
+	repo.XMP = xmp
+	repo.AlbumInfo = albumInfo
+	repo.ConvertHEIC = heicConverter()
+	repo.Progress = runChangeHooks
+
+	fmt.Println(photobak.Tr("Verifying repository..."))
+	report, err := repo.Verify()
+	if err != nil {
+		return err
+	}
+	fmt.Print(report)
+	if len(report.Problems) == 0 {
+		return nil
+	}
+
+	var confirm func(photobak.VerifyProblem) bool
+	if !*yes {
+		var all, none bool
+		stdin := bufio.NewScanner(os.Stdin)
+		confirm = func(p photobak.VerifyProblem) bool {
+			if all || none {
+				return all
+			}
+			fmt.Printf("\n%s: %s", p.Kind, p.Path)
+			if p.Path == "" {
+				fmt.Printf("%s item %s", p.Account, p.ItemID)
+			}
+			if p.Detail != "" {
+				fmt.Printf(" (%s)", p.Detail)
+			}
+			fmt.Print("\n" + photobak.Tr("Repair? [y]es, [n]o, [a]ll, [q]uit: "))
+			stdin.Scan()
+			switch strings.ToLower(strings.TrimSpace(stdin.Text())) {
+			case "y", "yes":
+				return true
+			case "a", "all":
+				all = true
+				return true
+			case "q", "quit":
+				none = true
+			}
+			return false
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	repaired, err := repo.Repair(ctx, report.Problems, confirm)
+	fmt.Print(repaired)
+	if err != nil {
+		return err
+	}
+	if len(repaired.Failed) > 0 {
+		return fmt.Errorf("%d repairs failed", len(repaired.Failed))
+	}
+	return nil
+}
+
+// orphans lists the files in the repository that belong
+// to nothing, and quarantines them if -quarantine is in args.
+func orphans(args []string) error {
+	fs := flag.NewFlagSet("orphans", flag.ContinueOnError)
+	quarantine := fs.Bool("quarantine", false, "Move the files into the "+photobak.QuarantineDir+" folder of the repo")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("usage: photobak [flags] orphans [-quarantine]")
+	}
+
+	repo, err := openRepo()
+	if err != nil {
+		return fmt.Errorf("opening repository: %v", err)
+	}
+	defer repo.Close()
+	repo.SyncFriendly = syncFriendly
+	repo.Manifests = manifests
+	repo.XMP = xmp
+	repo.AlbumInfo = albumInfo
+	repo.ConvertHEIC = heicConverter()
+	repo.Progress = runChangeHooks
+
+	paths, err := repo.Orphans()
+	if err != nil {
+		return err
+	}
+	for _, fpath := range paths {
+		fmt.Println(fpath)
+	}
+	fmt.Println(photobak.Tr("Found %d files that belong to nothing", len(paths)))
+
+	if *quarantine && len(paths) > 0 {
+		n, err := repo.Quarantine(paths)
+		fmt.Println(photobak.Tr("Moved %d files to %s", n, filepath.Join(repoDir, photobak.QuarantineDir)))
+		return err
+	}
+	return nil
+}
+
+// purgeMeta deletes the API metadata stored by -everything,
+// for the accounts in args or all of them.
+func purgeMeta(args []string) error {
+	fs := flag.NewFlagSet("purge-meta", flag.ContinueOnError)
+	accounts := fs.String("account", "", "Comma-separated accounts (provider:username) to purge (default all)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("usage: photobak [flags] purge-meta [-account <accounts>]")
+	}
+
+	repo, err := openRepo()
+	if err != nil {
+		return fmt.Errorf("opening repository: %v", err)
+	}
+	defer repo.Close()
+
+	n, err := repo.PurgeAPIMeta(splitList(*accounts))
+	fmt.Println(photobak.Tr("Deleted the stored API metadata of %d items and albums", n))
+	return err
+}
+
+// recoverDB replaces a damaged database with its
+// newest good backup, after asking unless -yes.
+func recoverDB(args []string) error {
+	fs := flag.NewFlagSet("recover-db", flag.ContinueOnError)
+	yes := fs.Bool("yes", false, "Replace the database without asking")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("usage: photobak [flags] recover-db [-yes]")
+	}
+
+	file := photobak.DBFile(repoDir, dbFile)
+	backup, err := photobak.LatestDBBackup(file)
+	if err != nil {
+		return err
+	}
+	if backup == "" {
+		return fmt.Errorf("found no backup of %s without problems", file)
+	}
+	if !*yes {
+		var made string
+		if info, err := os.Stat(backup); err == nil {
+			made = info.ModTime().Format("2006-01-02 15:04")
+		}
+		fmt.Print(photobak.Tr("Replace %s with its backup %s from %s? [y/N]: ", file, backup, made))
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			return nil
+		}
+	}
+
+	damaged, err := photobak.RecoverDB(file, backup)
+	if err != nil {
+		return err
+	}
+	fmt.Println(photobak.Tr("Restored the database from %s; the old one is now %s", backup, damaged))
+	return nil
+}
+
+// repoFlags returns the command with the flags
+// that select the repository, for suggestions.
+func repoFlags() string {
+	return repoTarget{dir: repoDir, db: dbFile}.flags()
+}
+
+// compact shrinks the database file to what is in use.
+func compact() error {
+	repo, err := openRepo()
+	if err != nil {
+		return fmt.Errorf("opening repository: %v", err)
+	}
+	defer repo.Close()
+
+	report, err := repo.Compact()
+	if err != nil {
+		return err
+	}
+	fmt.Println(photobak.Tr("Compacted the database from %s to %s",
+		humanBytes(float64(report.Before)), humanBytes(float64(report.After))))
+	return nil
+}
+
+// reindex rebuilds a lost database from the repository's files.
+func reindex() error {
+	repo, err := openRepo()
+	if err != nil {
+		return fmt.Errorf("opening repository: %v", err)
+	}
+	defer repo.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	report, err := repo.Reindex(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Print(report)
+	return nil
+}
+
+// trash lists the items that are in their provider's
+// trash as of the last prune, but still in the repo.
+func trash() error {
+	repo, err := openRepo()
+	if err != nil {
+		return fmt.Errorf("opening repository: %v", err)
+	}
+	defer repo.Close()
+
+	trashed, err := repo.Trashed()
+	if err != nil {
+		return err
+	}
+	for _, ti := range trashed {
+		fmt.Printf("%s\t%s\t%s\n", ti.Since.Format("2006-01-02"), ti.Account, ti.FilePath)
+	}
+	fmt.Println(photobak.Tr("Found %d items that are in the trash", len(trashed)))
+	return nil
+}
+
+// skipped lists the items that were not downloaded
+// because they are larger than -maxsize.
+func skipped() error {
+	repo, err := openRepo()
+	if err != nil {
+		return fmt.Errorf("opening repository: %v", err)
+	}
+	defer repo.Close()
+
+	items, err := repo.SkippedItems()
+	if err != nil {
+		return err
+	}
+	for _, si := range items {
+		size := humanBytes(float64(si.Size))
+		if si.AtLeast {
+			size = ">" + size
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\t%s\n", si.Skipped.Format("2006-01-02"), si.Account, size, si.ItemID, si.Collection, si.Name)
+	}
+	fmt.Println(photobak.Tr("Found %d items that were skipped for their size", len(items)))
+	return nil
+}
+
+// exportIndex writes the repository's index in the format
+// given in args to the destination given in args.
+func exportIndex(args []string) error {
+	fs := flag.NewFlagSet("export-index", flag.ContinueOnError)
+	format := fs.String("format", "json", "The format to export: json, csv, sql, or sqlite")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: photobak [flags] export-index [-format json|csv|sql|sqlite] <dest>")
+	}
+	switch *format {
+	case photobak.IndexJSON, photobak.IndexCSV, photobak.IndexSQL, "sqlite":
+	default:
+		return fmt.Errorf("unknown format '%s': must be json, csv, sql, or sqlite", *format)
+	}
+	dest := fs.Arg(0)
+
+	repo, err := openRepo()
+	if err != nil {
+		return fmt.Errorf("opening repository: %v", err)
+	}
+	defer repo.Close()
+
+	switch *format {
+	case photobak.IndexCSV:
+		err = repo.ExportIndex(photobak.IndexCSV, nil, dest)
+	case "sqlite":
+		err = exportIndexSQLite(repo, dest)
+	default:
+		err = exportIndexFile(repo, *format, dest)
+	}
+	if err != nil {
+		return err
+	}
+	if dest != "-" {
+		fmt.Println(photobak.Tr("Exported the index to %s", dest))
+	}
+	return nil
+}
+
+// exportIndexFile writes the index of repo in format to the
+// file at dest, or to stdout if dest is "-".
+func exportIndexFile(repo *photobak.Repository, format, dest string) error {
+	if dest == "-" {
+		return repo.ExportIndex(format, os.Stdout, "")
+	}
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	err = repo.ExportIndex(format, f, "")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dest)
+	}
+	return err
+}
+
+// exportIndexSQLite writes the index of repo into the SQLite
+// database at dest by running the sqlite3 command with the
+// index as SQL statements.
+func exportIndexSQLite(repo *photobak.Repository, dest string) error {
+	sqlite, err := exec.LookPath("sqlite3")
+	if err != nil {
+		return fmt.Errorf("the sqlite3 command is needed for -format sqlite; use -format sql and load the file into a database yourself")
+	}
+	cmd := exec.Command(sqlite, "-bail", dest)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("running sqlite3: %v", err)
+	}
+	err = repo.ExportIndex(photobak.IndexSQL, stdin, "")
+	stdin.Close()
+	if waitErr := cmd.Wait(); err == nil && waitErr != nil {
+		err = fmt.Errorf("sqlite3: %v", waitErr)
+	}
+	return err
+}
+
+// importFolder imports a local folder into the
+// repository, according to the flags in args.
+func importFolder(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	name := fs.String("name", "", "The name of the local account to import into (default the folder's name)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: photobak [flags] import [-name <name>] <dir>")
+	}
+	dir := fs.Arg(0)
+	if *name == "" {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		*name = filepath.Base(abs)
+	}
+
+	repo, err := openRepo()
+	if err != nil {
+		return fmt.Errorf("opening repository: %v", err)
+	}
+	defer repo.Close()
+	repo.SyncFriendly = syncFriendly
+	repo.Manifests = manifests
+	repo.XMP = xmp
+	repo.AlbumInfo = albumInfo
+	repo.ConvertHEIC = heicConverter()
+	repo.Progress = runChangeHooks
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	report, err := repo.ImportFolder(ctx, dir, *name)
+	fmt.Print(report)
+	if err != nil {
+		return err
+	}
+	if len(report.Failed) > 0 {
+		return fmt.Errorf("%d files could not be imported", len(report.Failed))
+	}
+	return nil
+}
+
+// importTakeout imports a Google Takeout export into the
+// repository, according to the flags in args.
+func importTakeout(args []string) error {
+	fs := flag.NewFlagSet("import-takeout", flag.ContinueOnError)
+	account := fs.String("account", "", "The account (provider:username) to import into (default the only googlephotos account)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: photobak [flags] import-takeout [-account <provider:username>] <zip/dir>...")
+	}
+
+	repo, err := openRepo()
+	if err != nil {
+		return fmt.Errorf("opening repository: %v", err)
+	}
+	defer repo.Close()
+	repo.SyncFriendly = syncFriendly
+	repo.Manifests = manifests
+	repo.XMP = xmp
+	repo.AlbumInfo = albumInfo
+	repo.ConvertHEIC = heicConverter()
+	repo.Progress = runChangeHooks
+
+	if *account == "" {
+		saved, err := repo.SavedAccounts()
+		if err != nil {
+			return err
+		}
+		for _, sa := range saved {
+			if sa.Provider != "googlephotos" {
+				continue
+			}
+			if *account != "" {
+				return fmt.Errorf("more than one googlephotos account; choose one with -account")
+			}
+			*account = sa.String()
+		}
+		if *account == "" {
+			return fmt.Errorf("no googlephotos account; choose one with -account")
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		select {
+		case <-sigs:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	report, err := repo.ImportTakeout(ctx, *account, fs.Args())
+	fmt.Print(report)
+	if err != nil {
+		return err
+	}
+	if len(report.Failed) > 0 {
+		return fmt.Errorf("%d files could not be imported", len(report.Failed))
+	}
+	return nil
+}
+
+// serve serves the repository as a read-only web gallery
+// until the program is stopped.
+func serve(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := fs.String("addr", "localhost:8080", "The address to serve the gallery on")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("usage: photobak [flags] serve [-addr <host:port>]")
+	}
+
+	repo, err := openRepo()
+	if err != nil {
+		return fmt.Errorf("opening repository: %v", err)
+	}
+	defer repo.Close()
+
+	fmt.Println(photobak.Tr("Serving the gallery at http://%s (press Ctrl+C to stop)", *addr))
+	return http.ListenAndServe(*addr, repo.Gallery())
+}
+
+func remapIDs() error {
+	repo, err := openRepo()
+	if err != nil {
+		return fmt.Errorf("opening repository: %v", err)
+	}
+	defer repo.Close()
+
+	report, err := repo.RemapItemIDs(context.Background())
+	fmt.Print(report)
+	return err
+}
+
+func mapIDs() error {
+	repo, err := openRepo()
+	if err != nil {
+		return fmt.Errorf("opening repository: %v", err)
+	}
+	defer repo.Close()
+
+	report, err := repo.MapIDs(context.Background())
+	fmt.Print(report)
+	return err
+}
+
+// reauth obtains new credentials for the account given in args.
+func reauth(args []string) error {
+	fs := flag.NewFlagSet("reauth", flag.ContinueOnError)
+	account := fs.String("account", "", "The account (provider:username) to authorize again")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *account == "" || fs.NArg() > 0 {
+		return fmt.Errorf("usage: photobak [flags] reauth -account <provider:username>")
+	}
+
+	repo, err := openRepo()
+	if err != nil {
+		return fmt.Errorf("opening repository: %v", err)
+	}
+	defer repo.Close()
+
+	err = repo.Reauthorize(*account)
+	if err != nil {
+		return err
+	}
+	fmt.Println(photobak.Tr("Saved new credentials for %s", *account))
+	return nil
+}
+
+// revoke deletes the stored credentials of
+// the account given in args.
+func revoke(args []string) error {
+	fs := flag.NewFlagSet("revoke", flag.ContinueOnError)
+	account := fs.String("account", "", "The account (provider:username) whose credentials to delete")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *account == "" || fs.NArg() > 0 {
+		return fmt.Errorf("usage: photobak [flags] revoke -account <provider:username>")
+	}
+
+	repo, err := openRepo()
+	if err != nil {
+		return fmt.Errorf("opening repository: %v", err)
+	}
+	defer repo.Close()
+
+	err = repo.RevokeCredentials(*account)
+	if err != nil {
+		return err
+	}
+	fmt.Println(photobak.Tr("Deleted the credentials for %s. Its backup is kept.\n"+
+		"To stop Photobak's access, also remove it in the account's settings at the provider.", *account))
+	return nil
 }
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mholt/photobak"
+)
+
+// pushoverAPI is where Pushover notifications are sent.
+const pushoverAPI = "https://api.pushover.net/1/messages.json"
+
+// notifyTargets is the parsed form of the -notify flags.
+var notifyTargets []*url.URL
+
+// parseNotify parses the -notify destinations, which are
+// mailto:<address>, ntfy://[user:pass@]host/topic, or
+// pushover://<user key>@<app token>.
+func parseNotify(list []string) ([]*url.URL, error) {
+	var targets []*url.URL
+	for _, s := range list {
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("bad -notify %s: %v", s, err)
+		}
+		switch u.Scheme {
+		case "mailto":
+			if u.Opaque == "" {
+				return nil, fmt.Errorf("bad -notify %s: missing address", s)
+			}
+			if smtpServer == "" {
+				return nil, fmt.Errorf("-notify %s needs -smtp", s)
+			}
+		case "ntfy":
+			if u.Host == "" || strings.Trim(u.Path, "/") == "" {
+				return nil, fmt.Errorf("bad -notify %s: must be ntfy://host/topic", s)
+			}
+		case "pushover":
+			if u.User == nil || u.User.Username() == "" || u.Host == "" {
+				return nil, fmt.Errorf("bad -notify %s: must be pushover://<user key>@<app token>", s)
+			}
+		default:
+			return nil, fmt.Errorf("bad -notify %s: must start with mailto:, ntfy://, or pushover://", s)
+		}
+		targets = append(targets, u)
+	}
+	if len(targets) == 0 && smtpServer != "" {
+		return nil, fmt.Errorf("-smtp needs a -notify mailto: address")
+	}
+	return targets, nil
+}
+
+// notifier sends notifications about the runs of the
+// repository at dir: once a run has failed notifyAfter
+// times in a row, when a run has at least notifyErrors
+// failed items, and when runs succeed again after failing.
+type notifier struct {
+	dir      string
+	mu       sync.Mutex
+	failed   int64 // items that failed in the current run
+	failures int   // runs that failed in a row
+	alerted  bool  // whether the failures were notified
+}
+
+// newNotifier returns the notifier for the repository at
+// dir, or nil if there are no -notify destinations.
+func newNotifier(dir string) *notifier {
+	if len(notifyTargets) == 0 {
+		return nil
+	}
+	return &notifier{dir: dir}
+}
+
+// start resets the count of failed items for a new run.
+func (n *notifier) start() {
+	n.mu.Lock()
+	n.failed = 0
+	n.mu.Unlock()
+}
+
+// handle counts the items that failed.
+func (n *notifier) handle(ev photobak.ProgressEvent) {
+	if ev.Type != photobak.ItemDone || ev.Err == nil ||
+		ev.Err == context.Canceled || ev.Err == context.DeadlineExceeded {
+		return
+	}
+	n.mu.Lock()
+	n.failed++
+	n.mu.Unlock()
+}
+
+// end notifies about the run that just ended with err,
+// if it calls for it. Runs that were interrupted
+// are neither failures nor successes.
+func (n *notifier) end(err error, interrupted bool) {
+	if interrupted {
+		return
+	}
+	n.mu.Lock()
+	failed := n.failed
+	if err != nil {
+		n.failures++
+	}
+	failures, alerted := n.failures, n.alerted
+	if err == nil {
+		n.failures, n.alerted = 0, false
+	} else if failures >= notifyAfter {
+		n.alerted = true
+	}
+	n.mu.Unlock()
+
+	host, _ := os.Hostname()
+	switch {
+	case err != nil && failures == notifyAfter:
+		title := fmt.Sprintf("photobak: backup of %s on %s is failing", n.dir, host)
+		msg := fmt.Sprintf("The backup failed %d time(s) in a row. Last error: %v", failures, err)
+		if failed > 0 {
+			msg += fmt.Sprintf("\n%d item(s) failed in the last run.", failed)
+		}
+		notifyAll(title, msg)
+		return
+	case err == nil && alerted:
+		notifyAll(fmt.Sprintf("photobak: backup of %s on %s is working again", n.dir, host),
+			fmt.Sprintf("The backup succeeded after failing %d time(s) in a row.", failures))
+	}
+	if notifyErrors > 0 && failed >= int64(notifyErrors) {
+		notifyAll(fmt.Sprintf("photobak: %d items failed to back up in %s on %s", failed, n.dir, host),
+			fmt.Sprintf("%d item(s) failed in the last run; they will be tried again in the next one. See the log for why.", failed))
+	}
+}
+
+// notifyAll sends a notification with title and msg to
+// each of notifyTargets, logging the ones that fail.
+func notifyAll(title, msg string) {
+	for _, u := range notifyTargets {
+		if err := sendNotification(u, title, msg); err != nil {
+			logger.Errorf("notifying %s: %v", u.Scheme, err)
+		}
+	}
+}
+
+// sendNotification sends a notification to u, which
+// is one of notifyTargets.
+func sendNotification(u *url.URL, title, msg string) error {
+	switch u.Scheme {
+	case "mailto":
+		return sendMail(u.Opaque, title, msg)
+	case "ntfy":
+		endpoint := "https://" + u.Host + u.Path
+		req, err := http.NewRequest("POST", endpoint, strings.NewReader(msg))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Title", title)
+		req.Header.Set("Tags", "warning")
+		if u.User != nil {
+			pass, _ := u.User.Password()
+			req.SetBasicAuth(u.User.Username(), pass)
+		}
+		return postNotification(req)
+	case "pushover":
+		form := url.Values{
+			"user":    {u.User.Username()},
+			"token":   {u.Host},
+			"title":   {title},
+			"message": {msg},
+		}
+		req, err := http.NewRequest("POST", pushoverAPI, strings.NewReader(form.Encode()))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return postNotification(req)
+	}
+	return fmt.Errorf("unknown notification scheme %s", u.Scheme)
+}
+
+// postNotification sends req, waiting up to hookTimeout.
+func postNotification(req *http.Request) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s answered %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
+
+// sendMail emails title and msg to the address to through
+// the -smtp server, which is [user@]host[:port] (port 587 by
+// default); the password is in PHOTOBAK_SMTP_PASSWORD.
+func sendMail(to, title, msg string) error {
+	server, user := smtpServer, ""
+	if i := strings.LastIndex(server, "@"); i >= 0 {
+		user, server = server[:i], server[i+1:]
+	}
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		host = server
+		server = net.JoinHostPort(server, "587")
+	}
+
+	from := user
+	if !strings.Contains(from, "@") {
+		hostname, _ := os.Hostname()
+		from = "photobak@" + hostname
+	}
+	var auth smtp.Auth
+	if user != "" {
+		auth = smtp.PlainAuth("", user, os.Getenv("PHOTOBAK_SMTP_PASSWORD"), host)
+	}
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n", from, to, mime.QEncoding.Encode("utf-8", title), time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&body, "Content-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n", strings.Replace(msg, "\n", "\r\n", -1))
+	return smtp.SendMail(server, auth, from, []string{to}, body.Bytes())
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+
+	"github.com/mholt/photobak"
+)
+
+// pauseCheckInterval is how often the daemon
+// looks for the pause marker in a repository.
+const pauseCheckInterval = time.Second
+
+// pauseCommand pauses (or, if resume, resumes) the downloads
+// of the daemons running in repoTargets by creating (or
+// removing) the pause marker in each repository.
+func pauseCommand(resume bool) error {
+	for _, t := range repoTargets {
+		marker := filepath.Join(t.dir, photobak.PauseMarkerName)
+		if resume {
+			err := os.Remove(marker)
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("removing pause marker: %v", err)
+			}
+			fmt.Println(photobak.Tr("Resumed downloads in %s", t.dir))
+			continue
+		}
+		if _, err := os.Stat(t.dir); err != nil {
+			return fmt.Errorf("repository %s: %v", t.dir, err)
+		}
+		err := ioutil.WriteFile(marker, []byte(time.Now().Format(time.RFC3339)+"\n"), 0600)
+		if err != nil {
+			return fmt.Errorf("creating pause marker: %v", err)
+		}
+		fmt.Println(photobak.Tr("Paused downloads in %s; resume them with the resume command", t.dir))
+	}
+	return nil
+}
+
+// setPaused pauses or resumes the downloads of d, now if
+// a run is going and for the runs after it until changed.
+func (d *daemon) setPaused(paused bool) {
+	d.repoMu.Lock()
+	defer d.repoMu.Unlock()
+	if paused == d.paused && d.repo == nil {
+		return
+	}
+	d.paused = paused
+	if d.repo == nil {
+		// between runs; the next run applies it
+		if paused {
+			logger.Warnf("Paused downloads of %s until they are resumed", d.target.dir)
+		} else {
+			logger.Warnf("Resumed downloads of %s", d.target.dir)
+		}
+		if d.status != nil {
+			ev := photobak.ProgressEvent{Type: photobak.Resumed}
+			if paused {
+				ev.Type = photobak.Paused
+			}
+			d.status.handle(ev)
+		}
+		return
+	}
+	if paused {
+		d.repo.Pause()
+	} else {
+		d.repo.Resume()
+	}
+}
+
+// pauseMarked returns true if the pause
+// marker is in the repository of d.
+func (d *daemon) pauseMarked() bool {
+	_, err := os.Stat(filepath.Join(d.target.dir, photobak.PauseMarkerName))
+	return err == nil
+}
+
+// watchPauseMarker pauses the downloads of d when the pause
+// marker appears in its repository and resumes them when it's
+// removed, until ctx is done. Only changes count, so that a
+// pause by signal isn't undone because there is no marker.
+func (d *daemon) watchPauseMarker(ctx context.Context) {
+	last := d.pauseMarked()
+	ticker := time.NewTicker(pauseCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if now := d.pauseMarked(); now != last {
+			last = now
+			d.setPaused(now)
+		}
+	}
+}
+
+// handlePauseSignals pauses the downloads of daemons on
+// pauseSignal and resumes them on resumeSignal, which
+// also removes any pause markers, until ctx is done.
+func handlePauseSignals(ctx context.Context, daemons []*daemon) {
+	if pauseSignal == nil {
+		return
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, pauseSignal, resumeSignal)
+	defer signal.Stop(sigs)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-sigs:
+			resume := sig == resumeSignal
+			for _, d := range daemons {
+				if resume {
+					err := os.Remove(filepath.Join(d.target.dir, photobak.PauseMarkerName))
+					if err != nil && !os.IsNotExist(err) {
+						logger.Errorf("removing pause marker: %v", err)
+					}
+				}
+				d.setPaused(!resume)
+			}
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mholt/photobak"
+)
+
+// progressBar keeps totals of a run's progress
+// events and renders them on a single line.
+// A plain progress bar writes a new line now
+// and then instead of redrawing the same one.
+type progressBar struct {
+	queued    int64
+	done      int64
+	failed    int64
+	committed int64
+	bytes     int64
+
+	plain bool
+
+	start time.Time
+	stop  chan struct{}
+	ended chan struct{}
+}
+
+// newProgressBar returns a progress bar that redraws
+// itself on w until finish is called. If plain is true,
+// it writes a line of progress to w whenever there has
+// been some, at most every plainProgressInterval.
+func newProgressBar(w io.Writer, plain bool) *progressBar {
+	pb := &progressBar{
+		plain: plain,
+		start: time.Now(),
+		stop:  make(chan struct{}),
+		ended: make(chan struct{}),
+	}
+	go pb.run(w)
+	return pb
+}
+
+// handle records ev; it is safe for concurrent use.
+func (pb *progressBar) handle(ev photobak.ProgressEvent) {
+	switch ev.Type {
+	case photobak.ItemQueued:
+		atomic.AddInt64(&pb.queued, 1)
+	case photobak.BytesDownloaded:
+		atomic.AddInt64(&pb.bytes, ev.Bytes)
+	case photobak.ItemCommitted:
+		atomic.AddInt64(&pb.committed, 1)
+	case photobak.ItemDone:
+		atomic.AddInt64(&pb.done, 1)
+		if ev.Err != nil {
+			atomic.AddInt64(&pb.failed, 1)
+		}
+	}
+}
+
+// finish draws the final state of the bar and stops redrawing.
+func (pb *progressBar) finish() {
+	close(pb.stop)
+	<-pb.ended
+}
+
+func (pb *progressBar) run(w io.Writer) {
+	defer close(pb.ended)
+	if pb.plain {
+		pb.runPlain(w)
+		return
+	}
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pb.stop:
+			fmt.Fprintf(w, "\r%s\n", pb.render(time.Now()))
+			return
+		case now := <-ticker.C:
+			fmt.Fprintf(w, "\r%s", pb.render(now))
+		}
+	}
+}
+
+// runPlain writes the progress as whole lines,
+// skipping those that would repeat the last.
+func (pb *progressBar) runPlain(w io.Writer) {
+	ticker := time.NewTicker(plainProgressInterval)
+	defer ticker.Stop()
+	var last string
+	for {
+		select {
+		case <-pb.stop:
+			fmt.Fprintln(w, pb.renderPlain(time.Now()))
+			return
+		case now := <-ticker.C:
+			queued, done := atomic.LoadInt64(&pb.queued), atomic.LoadInt64(&pb.done)
+			counts := fmt.Sprintf("%d/%d", done, queued)
+			if counts != last {
+				fmt.Fprintln(w, pb.renderPlain(now))
+				last = counts
+			}
+		}
+	}
+}
+
+const (
+	progressBarWidth      = 30
+	plainProgressInterval = 15 * time.Second
+)
+
+// render returns the bar as of now.
+func (pb *progressBar) render(now time.Time) string {
+	queued := atomic.LoadInt64(&pb.queued)
+	done := atomic.LoadInt64(&pb.done)
+	filled := 0
+	if queued > 0 {
+		filled = int(done * progressBarWidth / queued)
+	}
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+
+	return fmt.Sprintf("[%s] %s   ", bar, pb.summary(now))
+}
+
+// renderPlain returns the progress as of now as
+// a line of text without the bar.
+func (pb *progressBar) renderPlain(now time.Time) string {
+	return "Progress: " + pb.summary(now)
+}
+
+// summary describes the progress as of now.
+func (pb *progressBar) summary(now time.Time) string {
+	queued := atomic.LoadInt64(&pb.queued)
+	done := atomic.LoadInt64(&pb.done)
+	failed := atomic.LoadInt64(&pb.failed)
+	committed := atomic.LoadInt64(&pb.committed)
+	bytes := atomic.LoadInt64(&pb.bytes)
+	elapsed := now.Sub(pb.start)
+
+	var rate float64
+	if secs := elapsed.Seconds(); secs > 0 {
+		rate = float64(bytes) / secs
+	}
+
+	eta := "?"
+	if done > 0 && queued > done {
+		remaining := time.Duration(float64(elapsed) / float64(done) * float64(queued-done))
+		eta = remaining.Round(time.Second).String()
+	} else if queued > 0 && queued == done {
+		eta = "0s"
+	}
+
+	return fmt.Sprintf("%d/%d items, %d downloaded, %d failed, %s/s, ETA %s",
+		done, queued, committed, failed, humanBytes(rate), eta)
+}
+
+// humanBytes formats n bytes with a binary unit.
+func humanBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
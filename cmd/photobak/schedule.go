@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// sleepCheckInterval is how often the daemon looks at the
+// clock to notice that the computer was asleep.
+const sleepCheckInterval = time.Minute
+
+// maxCatchUpJitter is the longest the daemon waits after
+// waking up before it catches up on runs it missed.
+const maxCatchUpJitter = 2 * time.Minute
+
+// maxMissedRuns is the most missed runs that are counted.
+const maxMissedRuns = 1000
+
+// schedule decides when the daemon's next run is due. It keeps
+// time by the wall clock, because the clock that timers use stops
+// while the computer sleeps, which would delay each run by however
+// long the computer slept.
+type schedule struct {
+	interval time.Duration // between runs, unless cron is set
+	cron     *cronExpr     // when runs start (-every with a cron expression)
+	window   *runWindow    // when runs may start and must end (-window); nil for any time
+	delay    time.Duration // up to how long to wait at random before each run (-randomdelay)
+	once     bool          // whether there is only one run (no -every)
+	due      time.Time     // by the wall clock
+}
+
+// first makes the first run due: right away for an interval
+// (or just one run), or at the first time of the cron
+// expression, but within the window, after a random delay.
+func (s *schedule) first() {
+	now := time.Now().Round(0)
+	due := now
+	if s.cron != nil {
+		due = s.cron.next(now)
+	}
+	s.setDue(due)
+}
+
+// reset makes the next run due one interval from now, or
+// at the next time of the cron expression, within the
+// window and after a random delay.
+func (s *schedule) reset() {
+	now := time.Now().Round(0)
+	if s.cron != nil {
+		s.setDue(s.cron.next(now))
+	} else {
+		s.setDue(now.Add(s.interval))
+	}
+}
+
+// setDue makes the next run due at t, or when the
+// window next opens after it, after a random delay.
+func (s *schedule) setDue(t time.Time) {
+	if s.window != nil {
+		t = s.window.nextStart(t)
+	}
+	if s.delay > 0 {
+		t = t.Add(time.Duration(rand.Int63n(int64(s.delay) + 1)))
+	}
+	if s.window != nil && !s.window.contains(t) {
+		t = s.window.nextStart(t) // the delay went past the window's end
+	}
+	s.due = t
+}
+
+// deadline returns when a run starting now must stop because
+// its window closes, and false if there is no window.
+func (s *schedule) deadline() (time.Time, bool) {
+	now := time.Now()
+	if s.window == nil || !s.window.contains(now) {
+		return time.Time{}, false
+	}
+	return s.window.endAfter(now), true
+}
+
+// missed returns how many runs were due from s.due until now.
+func (s *schedule) missed(now time.Time) int {
+	if s.cron == nil {
+		if s.interval == 0 {
+			return 1
+		}
+		return int(now.Sub(s.due)/s.interval) + 1
+	}
+	n := 1
+	for t := s.cron.next(s.due); !t.IsZero() && !t.After(now) && n < maxMissedRuns; t = s.cron.next(t) {
+		n++
+	}
+	return n
+}
+
+// wait blocks until the next run is due, and returns false if
+// ctx is done first. If the computer was asleep (or the clock
+// jumped ahead) when the run was due, it logs how many runs were
+// missed and waits a little longer, for a random time, so that
+// the network has a moment to come back and computers that wake
+// up together don't all start at once; but if that's outside the
+// window, it waits for the window instead.
+func (s *schedule) wait(ctx context.Context) bool {
+	check := sleepCheckInterval
+	if until := time.Until(s.due); until > 0 && until < check {
+		check = until
+	}
+	if s.interval > 0 && s.interval < check {
+		check = s.interval
+	}
+	if check <= 0 {
+		check = time.Millisecond
+	}
+	ticker := time.NewTicker(check)
+	defer ticker.Stop()
+
+	last := time.Now()
+	if !last.Round(0).Before(s.due) {
+		return true
+	}
+	for {
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			return false
+		case now = <-ticker.C:
+		}
+
+		// the wall clock keeps going while the computer is
+		// asleep, but the monotonic clock doesn't
+		jump := now.Round(0).Sub(last.Round(0)) - now.Sub(last)
+		last = now
+		if jump < -check {
+			// the clock was set back; keep the interval, but
+			// cron times are times of the clock, not intervals
+			if s.cron != nil {
+				s.setDue(s.cron.next(now))
+			} else {
+				s.due = s.due.Add(jump)
+			}
+			continue
+		}
+		if now.Round(0).Before(s.due) {
+			continue
+		}
+		if jump <= check {
+			return true // on time
+		}
+
+		missed := s.missed(now.Round(0))
+		if s.window != nil && !s.window.contains(now) {
+			s.setDue(now.Round(0))
+			logger.Warnf("Computer was asleep (or the clock jumped) for about %s and missed %d scheduled run(s); catching up when the window opens at %s",
+				jump.Round(time.Second), missed, s.due.Format("2006-01-02 15:04"))
+			continue
+		}
+		jitter := maxCatchUpJitter
+		if s.interval > 0 && s.interval/10 < jitter {
+			jitter = s.interval / 10
+		}
+		jitter = time.Duration(rand.Int63n(int64(jitter) + 1))
+		logger.Warnf("Computer was asleep (or the clock jumped) for about %s and missed %d scheduled run(s); catching up in %s",
+			jump.Round(time.Second), missed, jitter.Round(time.Second))
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(jitter):
+			return true
+		}
+	}
+}
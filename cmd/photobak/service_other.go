@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "fmt"
+
+// runningAsService returns false, since
+// only Windows has a service manager like it.
+func runningAsService() bool { return false }
+
+// runService runs the daemon on the schedule plan.
+func runService(plan schedule) error {
+	startDaemon(plan)
+	return nil
+}
+
+// service returns an error, since Windows services exist
+// only on Windows; elsewhere, use systemd or launchd.
+func service(args []string) error {
+	return fmt.Errorf("the service command is only for Windows; on Linux, run photobak with systemd (see the README)")
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+
+	"github.com/mholt/photobak"
+)
+
+// serviceName is the default name of the Windows service.
+const serviceName = "photobak"
+
+// runningAsService returns true if photobak was
+// started by the Windows service manager.
+func runningAsService() bool {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		logger.Warnf("checking if running as a service: %v", err)
+	}
+	return isService
+}
+
+// runService runs the daemon as a Windows service on the
+// schedule plan, until the service manager stops it.
+func runService(plan schedule) error {
+	return svc.Run(serviceName, windowsService{plan: plan})
+}
+
+// windowsService runs the daemon for the service manager.
+type windowsService struct {
+	plan schedule
+}
+
+// Execute runs the daemon and tells the service manager how it's
+// going; when asked to stop, it stops the daemon like an interrupt.
+func (ws windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	done := make(chan struct{})
+	go func() {
+		startDaemon(ws.plan)
+		close(done)
+	}()
+	running := svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	status <- running
+	for {
+		select {
+		case <-done:
+			status <- svc.Status{State: svc.StopPending}
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				interrupts <- os.Interrupt
+			}
+		}
+	}
+}
+
+// service installs, removes, starts, or stops the Windows
+// service that runs photobak with the flags given before
+// the command, as if they had been given on the command line.
+func service(args []string) error {
+	fs := flag.NewFlagSet("service", flag.ContinueOnError)
+	name := fs.String("name", serviceName, "The name of the service")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: photobak [flags] service [-name <name>] install | uninstall | start | stop")
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to the service manager (try as administrator): %v", err)
+	}
+	defer m.Disconnect()
+
+	if fs.Arg(0) == "install" {
+		return installService(m, *name)
+	}
+
+	s, err := m.OpenService(*name)
+	if err != nil {
+		return fmt.Errorf("opening service %s: %v", *name, err)
+	}
+	defer s.Close()
+
+	switch fs.Arg(0) {
+	case "uninstall":
+		err = s.Delete()
+		if err != nil {
+			return fmt.Errorf("removing service %s: %v", *name, err)
+		}
+		fmt.Println(photobak.Tr("Removed service %s", *name))
+	case "start":
+		err = s.Start()
+		if err != nil {
+			return fmt.Errorf("starting service %s: %v", *name, err)
+		}
+	case "stop":
+		_, err = s.Control(svc.Stop)
+		if err != nil {
+			return fmt.Errorf("stopping service %s: %v", *name, err)
+		}
+		for i := 0; i < 60; i++ {
+			st, err := s.Query()
+			if err != nil || st.State == svc.Stopped {
+				break
+			}
+			time.Sleep(time.Second)
+		}
+	default:
+		return fmt.Errorf("unknown service command '%s': must be install, uninstall, start, or stop", fs.Arg(0))
+	}
+	return nil
+}
+
+// installService installs the service called name, which runs
+// photobak with the flags that were given before the command.
+func installService(m *mgr.Mgr, name string) error {
+	if every == "" {
+		return fmt.Errorf("a service runs on a schedule; give -every")
+	}
+	// services start in the system folder, so relative
+	// paths would point somewhere else
+	for _, t := range repoTargets {
+		if !filepath.IsAbs(t.dir) {
+			return fmt.Errorf("repository %s must be an absolute path for a service", t.dir)
+		}
+	}
+	if configFile != "" && !filepath.IsAbs(configFile) {
+		return fmt.Errorf("config file %s must be an absolute path for a service", configFile)
+	}
+	if logFile == "stderr" || logFile == "stdout" {
+		return fmt.Errorf("a service has no console to log to; give -log with a file")
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	flags := os.Args[1 : len(os.Args)-flag.NArg()]
+	s, err := m.CreateService(name, exe, mgr.Config{
+		DisplayName: "Photobak",
+		Description: "Backs up photos and videos from cloud services: " + strings.Join(flags, " "),
+		StartType:   mgr.StartAutomatic,
+	}, flags...)
+	if err != nil {
+		return fmt.Errorf("installing service %s: %v", name, err)
+	}
+	defer s.Close()
+	fmt.Println(photobak.Tr("Installed service %s; start it with: photobak service -name %s start", name, name))
+	return nil
+}
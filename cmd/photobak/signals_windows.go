@@ -0,0 +1,10 @@
+package main
+
+import "os"
+
+// pauseSignal and resumeSignal are nil, since Windows has no
+// such signals; use the pause and resume commands instead.
+var (
+	pauseSignal  os.Signal
+	resumeSignal os.Signal
+)
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mholt/photobak"
+)
+
+// statusFileName is the name of the status file in the repository.
+const statusFileName = "photobak-status.json"
+
+// status is the live state of the program that is written
+// to the status file for external monitoring.
+type status struct {
+	Phase         string        `json:"phase"` // starting, storing, pruning, idle, or stopped
+	Updated       time.Time     `json:"updated"`
+	Paused        bool          `json:"paused"` // whether downloads are paused
+	RunStarted    time.Time     `json:"run_started,omitempty"`
+	RunFinished   time.Time     `json:"run_finished,omitempty"`
+	NextRun       time.Time     `json:"next_run,omitempty"`
+	Queued        int64         `json:"queued"`
+	Done          int64         `json:"done"`
+	Downloaded    int64         `json:"downloaded"`
+	Failed        int64         `json:"failed"`
+	Bytes         int64         `json:"bytes"`
+	Current       []currentItem `json:"current"`
+	LocalChanges  []localChange `json:"local_changes"`
+	LastError     string        `json:"last_error,omitempty"`
+	LastErrorTime time.Time     `json:"last_error_time,omitempty"`
+}
+
+// localChange is a file that was found changed outside
+// photobak during the current or last run.
+type localChange struct {
+	Account string `json:"account"`
+	ItemID  string `json:"item_id"`
+	File    string `json:"file"`
+	Change  string `json:"change"`
+}
+
+// currentItem is an item that is being downloaded.
+type currentItem struct {
+	Account string    `json:"account"`
+	ItemID  string    `json:"item_id"`
+	File    string    `json:"file"`
+	Since   time.Time `json:"since"`
+}
+
+// statusFile periodically writes the status to a file.
+type statusFile struct {
+	path    string
+	mu      sync.Mutex
+	st      status
+	current map[string]currentItem
+	stop    chan struct{}
+	ended   chan struct{}
+}
+
+// newStatusFile starts writing the status to the status
+// file in repoDir every few seconds until close is called.
+func newStatusFile(repoDir string) *statusFile {
+	sf := &statusFile{
+		path:    filepath.Join(repoDir, statusFileName),
+		st:      status{Phase: "starting", Current: []currentItem{}, LocalChanges: []localChange{}},
+		current: make(map[string]currentItem),
+		stop:    make(chan struct{}),
+		ended:   make(chan struct{}),
+	}
+	if err := os.MkdirAll(repoDir, 0700); err != nil {
+		logger.Errorf("creating repo folder for status file: %v", err)
+	}
+	go sf.run()
+	return sf
+}
+
+// startRun resets the counts for a new run in the given phase.
+func (sf *statusFile) startRun(phase string) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	sf.st = status{
+		Phase:         phase,
+		Paused:        sf.st.Paused,
+		RunStarted:    time.Now(),
+		Current:       []currentItem{},
+		LocalChanges:  []localChange{},
+		LastError:     sf.st.LastError,
+		LastErrorTime: sf.st.LastErrorTime,
+	}
+	sf.current = make(map[string]currentItem)
+}
+
+// endRun records the end of a run and its error, if any;
+// next is when the next run will start, if scheduled.
+func (sf *statusFile) endRun(err error, next time.Time) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	sf.st.Phase = "idle"
+	if next.IsZero() {
+		sf.st.Phase = "stopped"
+	}
+	sf.st.RunFinished = time.Now()
+	sf.st.NextRun = next
+	sf.current = make(map[string]currentItem)
+	if err != nil {
+		sf.setError(err)
+	}
+}
+
+// setError records err as the last error; sf.mu must be locked.
+func (sf *statusFile) setError(err error) {
+	sf.st.LastError = err.Error()
+	sf.st.LastErrorTime = time.Now()
+}
+
+// handle records ev; it is safe for concurrent use.
+func (sf *statusFile) handle(ev photobak.ProgressEvent) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	key := ev.Account + "/" + ev.ItemID
+	switch ev.Type {
+	case photobak.ItemQueued:
+		sf.st.Queued++
+	case photobak.DownloadStarted:
+		if _, ok := sf.current[key]; !ok {
+			sf.current[key] = currentItem{Account: ev.Account, ItemID: ev.ItemID, File: ev.FilePath, Since: time.Now()}
+		}
+	case photobak.BytesDownloaded:
+		sf.st.Bytes += ev.Bytes
+	case photobak.ItemCommitted:
+		sf.st.Downloaded++
+	case photobak.ItemDone:
+		sf.st.Done++
+		delete(sf.current, key)
+		if ev.Err != nil {
+			sf.st.Failed++
+			sf.setError(ev.Err)
+		}
+	case photobak.Paused:
+		sf.st.Paused = true
+	case photobak.Resumed:
+		sf.st.Paused = false
+	case photobak.LocalChangeFound:
+		sf.st.LocalChanges = append(sf.st.LocalChanges, localChange{Account: ev.Account, ItemID: ev.ItemID, File: ev.FilePath, Change: ev.Err.Error()})
+	}
+}
+
+// close writes the status one last time and stops.
+func (sf *statusFile) close() {
+	close(sf.stop)
+	<-sf.ended
+}
+
+func (sf *statusFile) run() {
+	defer close(sf.ended)
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	for {
+		sf.write()
+		select {
+		case <-sf.stop:
+			sf.write()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// write atomically replaces the status file with the current status.
+func (sf *statusFile) write() {
+	sf.mu.Lock()
+	st := sf.st
+	st.Updated = time.Now()
+	st.Current = make([]currentItem, 0, len(sf.current))
+	for _, ci := range sf.current {
+		st.Current = append(st.Current, ci)
+	}
+	sf.mu.Unlock()
+
+	sort.Slice(st.Current, func(i, j int) bool {
+		return st.Current[i].Since.Before(st.Current[j].Since)
+	})
+
+	data, err := json.MarshalIndent(st, "", "\t")
+	if err != nil {
+		logger.Errorf("encoding status: %v", err)
+		return
+	}
+	tmp := sf.path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err == nil {
+		err = os.Rename(tmp, sf.path)
+	}
+	if err != nil {
+		logger.Errorf("writing status file: %v", err)
+	}
+}
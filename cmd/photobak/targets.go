@@ -0,0 +1,192 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/mholt/photobak"
+)
+
+// repoTarget is a repository that a run maintains,
+// with its own database and download workers.
+type repoTarget struct {
+	dir         string
+	db          string   // empty for the default, in dir
+	accounts    []string // "provider:username"; all configured accounts if empty
+	concurrency int      // 0 for the -concurrency flag's value
+}
+
+// repoList is the value of the -repo flag, which may
+// be given more than once to maintain several repos.
+type repoList []string
+
+func (l *repoList) String() string { return strings.Join(*l, ",") }
+
+func (l *repoList) Set(val string) error {
+	*l = append(*l, val)
+	return nil
+}
+
+var (
+	// repoDirs are the directories given by -repo
+	// flags (or the repo setting of the config file).
+	repoDirs repoList
+
+	// configRepos are the repositories given
+	// by [[repos]] blocks in the config file.
+	configRepos []repoTarget
+
+	// repoTargets are the repositories to maintain;
+	// the first one is also in repoDir and dbFile.
+	repoTargets []repoTarget
+)
+
+// parseRepoBlocks parses the [[repos]] blocks of the config
+// file, which look like:
+//
+//	[[repos]]
+//	path = "/mnt/nas/photos"
+//	accounts = ["googlephotos:you@yours.com"]
+//	concurrency = 10
+//
+//	[[repos]]
+//	path = "/media/external/photos"
+//	db = "/var/lib/photobak/external.db"
+//
+// Only path is required.
+func parseRepoBlocks(val interface{}) ([]repoTarget, error) {
+	blocks, ok := val.([]map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("repos must be an array of tables, like [[repos]]")
+	}
+	var targets []repoTarget
+	for i, block := range blocks {
+		var t repoTarget
+		for key, v := range block {
+			var ok bool
+			switch key {
+			case "path":
+				t.dir, ok = v.(string)
+			case "db":
+				t.db, ok = v.(string)
+			case "concurrency":
+				var n int64
+				n, ok = v.(int64)
+				t.concurrency = int(n)
+				if ok && n < 1 {
+					return nil, fmt.Errorf("repo %d: concurrency must be at least 1", i+1)
+				}
+			case "accounts":
+				var list []interface{}
+				list, ok = v.([]interface{})
+				for _, elem := range list {
+					acct, isString := elem.(string)
+					if !isString || !strings.Contains(acct, ":") {
+						return nil, fmt.Errorf("repo %d: accounts must be a list of provider:username", i+1)
+					}
+					t.accounts = append(t.accounts, strings.ToLower(acct))
+				}
+			default:
+				return nil, fmt.Errorf("repo %d: unknown setting '%s'", i+1, key)
+			}
+			if !ok {
+				return nil, fmt.Errorf("repo %d: %s: unsupported value type %T", i+1, key, v)
+			}
+		}
+		if t.dir == "" {
+			return nil, fmt.Errorf("repo %d: path is required", i+1)
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// setRepoTargets sets repoTargets from the -repo flags and
+// the [[repos]] blocks of the config file, which are ignored
+// if -repo is given on the command line; if there are none,
+// the default repo is used. It also sets repoDir and dbFile
+// to the first one, for commands that work on one repo.
+func setRepoTargets(explicit bool) error {
+	var targets []repoTarget
+	for _, dir := range repoDirs {
+		targets = append(targets, repoTarget{dir: dir})
+	}
+	if !explicit {
+		targets = append(targets, configRepos...)
+	}
+	if len(targets) == 0 {
+		targets = []repoTarget{{dir: repoDir}}
+	}
+
+	seen := make(map[string]bool)
+	for i := range targets {
+		t := &targets[i]
+		dir := t.dir
+		if abs, err := filepath.Abs(dir); err == nil {
+			dir = abs
+		}
+		if seen[dir] {
+			return fmt.Errorf("repository %s is given more than once", t.dir)
+		}
+		seen[dir] = true
+
+		if t.db == "" && len(targets) == 1 {
+			t.db = dbFile
+		} else if dbFile != "" && len(targets) > 1 {
+			return fmt.Errorf("-db cannot be shared by several repositories; give each [[repos]] block its own db instead")
+		}
+		if t.concurrency == 0 {
+			t.concurrency = concurrency
+		}
+	}
+
+	repoTargets = targets
+	repoDir, dbFile = targets[0].dir, targets[0].db
+	return nil
+}
+
+// flags returns the command and flags that
+// open the repository t by itself.
+func (t repoTarget) flags() string {
+	cmd := "photobak -repo " + t.dir
+	if t.db != "" {
+		cmd += " -db " + t.db
+	}
+	return cmd
+}
+
+// checkTargetAccounts returns an error if an account
+// of a repo target is not configured with its provider.
+func checkTargetAccounts() error {
+	for _, t := range repoTargets {
+		for _, acct := range t.accounts {
+			if !photobak.IsConfigured(acct) {
+				return fmt.Errorf("repository %s: account %s is not configured; add it to the [accounts] table or a provider flag", t.dir, acct)
+			}
+		}
+	}
+	return nil
+}
+
+// oneRepo returns an error if more than one repository
+// is given, for commands that work on only one.
+func oneRepo(what string) error {
+	if len(repoTargets) > 1 {
+		return fmt.Errorf("%s works on one repository at a time; give a single -repo", what)
+	}
+	return nil
+}
+
+// explicitFlag returns true if the flag called name
+// was given on the command line.
+func explicitFlag(name string) bool {
+	var given bool
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	})
+	return given
+}
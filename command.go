@@ -0,0 +1,49 @@
+package photobak
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// SplitCommand splits a command line on spaces, except
+// within double or single quotes, so that paths with spaces
+// can be given, like "C:\Program Files\backup.exe" --all.
+// Backslashes are kept as they are, for Windows paths.
+// Commands that users give, like those of external
+// providers and hooks, are split this way.
+func SplitCommand(line string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	var quote rune
+	inArg := false
+	for _, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inArg = true
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote in command", quote)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
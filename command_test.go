@@ -0,0 +1,39 @@
+package photobak
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitCommand(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		expect    []string
+		shouldErr bool
+	}{
+		{input: "", expect: nil},
+		{input: "  ", expect: nil},
+		{input: "snapshot.sh", expect: []string{"snapshot.sh"}},
+		{input: " vssadmin  create shadow\t/for=D: ", expect: []string{"vssadmin", "create", "shadow", "/for=D:"}},
+		{input: `"C:\Program Files\Tools\snap.exe" --all`, expect: []string{`C:\Program Files\Tools\snap.exe`, "--all"}},
+		{input: `'/home/me/My Scripts/hook.sh' "a b" ''`, expect: []string{"/home/me/My Scripts/hook.sh", "a b", ""}},
+		{input: `say "it's" 'a "quote"'`, expect: []string{"say", "it's", `a "quote"`}},
+		{input: `a"b c"d`, expect: []string{"ab cd"}},
+		{input: `"unterminated`, shouldErr: true},
+		{input: `it's`, shouldErr: true},
+	} {
+		actual, err := SplitCommand(test.input)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error for %q, didn't get one", i, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Did not expect an error for %q, got '%v'", i, test.input, err)
+		}
+		if !reflect.DeepEqual(actual, test.expect) {
+			t.Errorf("Test %d: Expected %q, got %q", i, test.expect, actual)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package photobak
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"os"
+
+	"github.com/boltdb/bolt"
+)
+
+// compactTxSize is about how many bytes are copied
+// in each transaction when compacting the database.
+const compactTxSize = 64 << 20
+
+// CompactReport says how much a compaction shrank the database.
+type CompactReport struct {
+	Before, After int64 // the size of the database file, in bytes
+}
+
+// Compact rewrites the database into a new file that contains only
+// what is in use, and replaces the database with it. A database
+// file never shrinks by itself; space freed by deleting things,
+// like pruning or purging API metadata, is only reused. The copy
+// is checked against the database before it replaces it, and the
+// database is left alone if they differ.
+func (r *Repository) Compact() (CompactReport, error) {
+	var report CompactReport
+	file := r.db.Path()
+	info, err := os.Stat(file)
+	if err != nil {
+		return report, err
+	}
+	report.Before = info.Size()
+
+	tmpFile := file + ".compact"
+	os.Remove(tmpFile) // left over from an earlier attempt
+	dst, err := bolt.Open(tmpFile, 0600, nil)
+	if err != nil {
+		return report, fmt.Errorf("creating compacted database: %v", err)
+	}
+	err = compactDB(dst, r.db.DB)
+	if err == nil {
+		err = sameContents(dst, r.db.DB)
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		return report, fmt.Errorf("compacting database: %v", err)
+	}
+
+	err = r.db.Close()
+	if err != nil {
+		os.Remove(tmpFile)
+		return report, fmt.Errorf("closing database: %v", err)
+	}
+	renameErr := os.Rename(tmpFile, file)
+	db, err := openDB(file)
+	if err != nil {
+		return report, fmt.Errorf("reopening database: %v", err)
+	}
+	r.db = db
+	if renameErr != nil {
+		os.Remove(tmpFile)
+		return report, fmt.Errorf("replacing database: %v", renameErr)
+	}
+
+	info, err = os.Stat(file)
+	if err != nil {
+		return report, err
+	}
+	report.After = info.Size()
+	return report, nil
+}
+
+// compactDB copies every bucket and value of src into dst,
+// which should be empty, committing a transaction about
+// every compactTxSize bytes.
+func compactDB(dst, src *bolt.DB) error {
+	tx, err := dst.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer func() { tx.Rollback() }()
+
+	var size int
+	err = walkDB(src, func(keys [][]byte, k, v []byte, seq uint64) error {
+		if size+len(k)+len(v) > compactTxSize {
+			if err := tx.Commit(); err != nil {
+				return err
+			}
+			tx, err = dst.Begin(true)
+			if err != nil {
+				return err
+			}
+			size = 0
+		}
+		size += len(k) + len(v)
+
+		// buckets at the root, which can't hold values
+		if len(keys) == 0 {
+			b, err := tx.CreateBucket(k)
+			if err != nil {
+				return err
+			}
+			return b.SetSequence(seq)
+		}
+
+		b := tx.Bucket(keys[0])
+		for _, key := range keys[1:] {
+			b = b.Bucket(key)
+		}
+		b.FillPercent = 1.0 // nothing is inserted in between
+		if v == nil {
+			nested, err := b.CreateBucket(k)
+			if err != nil {
+				return err
+			}
+			return nested.SetSequence(seq)
+		}
+		return b.Put(k, v)
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// walkFunc is called by walkDB for every bucket and value, with
+// the names of the buckets it is in. For buckets, v is nil and
+// seq is the bucket's sequence.
+type walkFunc func(keys [][]byte, k, v []byte, seq uint64) error
+
+// walkDB calls fn for every bucket and value in db, in order.
+func walkDB(db *bolt.DB, fn walkFunc) error {
+	return db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			return walkBucket(b, nil, name, nil, b.Sequence(), fn)
+		})
+	})
+}
+
+// walkBucket calls fn for k and v, which are in the bucket
+// at keys, and if they are bucket b, for what is in b.
+func walkBucket(b *bolt.Bucket, keys [][]byte, k, v []byte, seq uint64, fn walkFunc) error {
+	err := fn(keys, k, v, seq)
+	if err != nil || v != nil {
+		return err
+	}
+	keys = append(keys, k)
+	return b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			nested := b.Bucket(k)
+			return walkBucket(nested, keys, k, nil, nested.Sequence(), fn)
+		}
+		return walkBucket(b, keys, k, v, 0, fn)
+	})
+}
+
+// sameContents returns an error if dst, a copy of src, doesn't
+// have the same buckets, values, and sequences as src.
+func sameContents(dst, src *bolt.DB) error {
+	dstSum, dstN, err := dbDigest(dst)
+	if err != nil {
+		return err
+	}
+	srcSum, srcN, err := dbDigest(src)
+	if err != nil {
+		return err
+	}
+	if dstN != srcN || !bytes.Equal(dstSum, srcSum) {
+		return fmt.Errorf("copy differs from the original (%d entries, original has %d)", dstN, srcN)
+	}
+	return nil
+}
+
+// dbDigest returns a hash of everything in db
+// and how many buckets and values there are.
+func dbDigest(db *bolt.DB) ([]byte, int, error) {
+	h := sha256.New()
+	var n int
+	err := walkDB(db, func(keys [][]byte, k, v []byte, seq uint64) error {
+		n++
+		writeDigestField(h, []byte{byte(len(keys))})
+		for _, key := range keys {
+			writeDigestField(h, key)
+		}
+		writeDigestField(h, k)
+		if v == nil {
+			var s [8]byte
+			binary.BigEndian.PutUint64(s[:], seq)
+			writeDigestField(h, []byte("bucket"))
+			writeDigestField(h, s[:])
+			return nil
+		}
+		writeDigestField(h, []byte("value"))
+		writeDigestField(h, v)
+		return nil
+	})
+	return h.Sum(nil), n, err
+}
+
+// writeDigestField writes field to h, prefixed by its
+// length so that fields can't run into each other.
+func writeDigestField(h hash.Hash, field []byte) {
+	var l [8]byte
+	binary.BigEndian.PutUint64(l[:], uint64(len(field)))
+	h.Write(l[:])
+	h.Write(field)
+}
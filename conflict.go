@@ -0,0 +1,73 @@
+package photobak
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// What Store does with a file that was edited outside photobak
+// when its item would be downloaded again (see Repository.Conflicts).
+const (
+	ConflictKeepBoth   = "keep-both"
+	ConflictKeepLocal  = "keep-local"
+	ConflictKeepRemote = "keep-remote"
+)
+
+// localCopySuffix is added to the name of an edited
+// file that is kept beside the item's new download.
+const localCopySuffix = "-local"
+
+// ValidateConflicts returns an error if policy is not
+// one of the Conflict* constants or empty.
+func ValidateConflicts(policy string) error {
+	switch policy {
+	case "", ConflictKeepBoth, ConflictKeepLocal, ConflictKeepRemote:
+		return nil
+	}
+	return fmt.Errorf("unknown conflict policy '%s': must be %s, %s, or %s",
+		policy, ConflictKeepBoth, ConflictKeepLocal, ConflictKeepRemote)
+}
+
+// resolveConflict decides what to do with the file of dbi, which
+// was edited outside photobak, now that its item is going to be
+// downloaded again. It returns false if the download should not
+// happen. With ConflictKeepBoth, the file is first moved aside.
+func (r *Repository) resolveConflict(dbi *dbItem) (bool, error) {
+	switch r.Conflicts {
+	case ConflictKeepRemote:
+		repoLog.Infof("File %s was edited locally; replacing it with the remote item", dbi.FilePath)
+		return true, nil
+	case ConflictKeepLocal:
+		repoLog.Infof("File %s was edited locally; keeping it instead of downloading the item again", dbi.FilePath)
+		return false, nil
+	}
+	localPath, err := r.keepLocalCopy(dbi.FilePath)
+	if err != nil {
+		return false, err
+	}
+	repoLog.Infof("File %s was edited locally; kept the edited file as %s", dbi.FilePath, localPath)
+	return true, nil
+}
+
+// keepLocalCopy moves the file at the repo-relative path fpath
+// aside to a new name with localCopySuffix, so that its item can
+// be downloaded again without losing what is in it. It returns
+// the new path of the file.
+func (r *Repository) keepLocalCopy(fpath string) (string, error) {
+	dir := filepath.Dir(fpath)
+	ext := filepath.Ext(fpath)
+	name := strings.TrimSuffix(filepath.Base(fpath), ext) + localCopySuffix + ext
+	localName, err := r.reserveUniqueFilename(dir, name, false)
+	if err != nil {
+		return "", fmt.Errorf("reserving name for local copy of %s: %v", fpath, err)
+	}
+	localPath := filepath.Join(dir, localName)
+	err = os.Rename(r.fullPath(fpath), r.fullPath(localPath))
+	if err != nil {
+		os.Remove(r.fullPath(localPath))
+		return "", fmt.Errorf("keeping local copy of %s: %v", fpath, err)
+	}
+	return localPath, nil
+}
@@ -0,0 +1,311 @@
+package photobak
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// CredentialStore stores the credentials of accounts somewhere
+// other than the repository's database, like the operating
+// system's keyring. Accounts are named "provider:username".
+type CredentialStore interface {
+	// LoadCredentials returns the credentials of account,
+	// or nil if there are none.
+	LoadCredentials(account string) ([]byte, error)
+
+	// SaveCredentials stores creds as the credentials
+	// of account, replacing any that are stored.
+	SaveCredentials(account string, creds []byte) error
+
+	// DeleteCredentials removes the credentials of account.
+	// It is not an error if there are none.
+	DeleteCredentials(account string) error
+}
+
+// The key that encrypts credentials in the database is derived
+// from the passphrase with PBKDF2-HMAC-SHA256, using a random
+// salt of credentialSaltSize bytes and this many iterations.
+const (
+	credentialIterations = 600000
+	credentialSaltSize   = 16
+)
+
+// credentialCheck is encrypted with the key derived from
+// the passphrase and stored, so that a wrong passphrase
+// can be told apart from corrupted credentials.
+var credentialCheck = []byte("photobak credentials")
+
+// loadCredentials loads pa's credentials from the credential
+// store, if the repository has one, or else from the database.
+// Credentials that are still in the database are moved to the
+// credential store, or encrypted if the repository has a
+// passphrase for them. If there are no credentials, a nil slice
+// and nil error are returned.
+func (r *Repository) loadCredentials(pa providerAccount) ([]byte, error) {
+	if r.CredentialStore != nil {
+		return r.loadStoredCredentials(pa)
+	}
+
+	sealed, err := r.db.loadCredentials(pa, sealedCredentialsKey)
+	if err != nil {
+		return nil, err
+	}
+	if sealed != nil {
+		key, err := r.credentialKey()
+		if err != nil {
+			return nil, err
+		}
+		if key == nil {
+			return nil, fmt.Errorf("credentials are encrypted, but no passphrase was given")
+		}
+		creds, err := unseal(key, sealed, pa.key())
+		if err != nil {
+			return nil, fmt.Errorf("decrypting credentials: %v", err)
+		}
+		return creds, nil
+	}
+
+	creds, err := r.db.loadCredentials(pa, credentialsKey)
+	if err != nil || creds == nil || r.CredentialPassphrase == nil {
+		return creds, err
+	}
+	err = r.saveCredentials(pa, creds)
+	if err != nil {
+		return nil, fmt.Errorf("encrypting credentials: %v", err)
+	}
+	repoLog.Infof("Encrypted credentials for %s in database", pa)
+	return creds, nil
+}
+
+// loadStoredCredentials loads pa's credentials from the
+// credential store, moving them there from the database
+// if they are still there (and not encrypted).
+func (r *Repository) loadStoredCredentials(pa providerAccount) ([]byte, error) {
+	creds, err := r.CredentialStore.LoadCredentials(pa.String())
+	if err != nil || creds != nil {
+		return creds, err
+	}
+
+	creds, err = r.db.loadCredentials(pa, credentialsKey)
+	if err != nil || creds == nil {
+		return creds, err
+	}
+	err = r.CredentialStore.SaveCredentials(pa.String(), creds)
+	if err != nil {
+		return nil, fmt.Errorf("moving credentials to credential store: %v", err)
+	}
+	err = r.db.deleteCredentials(pa)
+	if err != nil {
+		return nil, fmt.Errorf("removing credentials from database after moving them: %v", err)
+	}
+	repoLog.Infof("Moved credentials for %s from database to credential store", pa)
+	return creds, nil
+}
+
+// saveCredentials saves pa's credentials to the credential
+// store, if the repository has one, or else to the database,
+// encrypted if the repository has a passphrase for them.
+func (r *Repository) saveCredentials(pa providerAccount, creds []byte) error {
+	if r.CredentialStore != nil {
+		return r.CredentialStore.SaveCredentials(pa.String(), creds)
+	}
+	key, err := r.credentialKey()
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		return r.db.saveCredentials(pa, credentialsKey, creds)
+	}
+	sealed, err := seal(key, creds, pa.key())
+	if err != nil {
+		return err
+	}
+	return r.db.saveCredentials(pa, sealedCredentialsKey, sealed)
+}
+
+// deleteCredentials removes pa's credentials from the
+// credential store, if the repository has one, and
+// from the database.
+func (r *Repository) deleteCredentials(pa providerAccount) error {
+	if r.CredentialStore != nil {
+		err := r.CredentialStore.DeleteCredentials(pa.String())
+		if err != nil {
+			return fmt.Errorf("deleting credentials from credential store: %v", err)
+		}
+	}
+	return r.db.deleteCredentials(pa)
+}
+
+// AuthError is returned when an account's credentials can't be
+// obtained or loaded, or when its service doesn't accept them
+// (HTTP 401 or 403). Running reauth for the account usually
+// fixes it.
+type AuthError struct {
+	Account string // provider:username
+	Err     error
+}
+
+func (e AuthError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e AuthError) Unwrap() error {
+	return e.Err
+}
+
+// authError returns err as an AuthError for pa if the
+// service refused the request with HTTP 401 or 403;
+// otherwise it returns err as it is.
+func authError(pa providerAccount, err error) error {
+	var sc interface{ HTTPStatusCode() int }
+	if errors.As(err, &sc) && (sc.HTTPStatusCode() == 401 || sc.HTTPStatusCode() == 403) {
+		return AuthError{Account: pa.String(), Err: err}
+	}
+	return err
+}
+
+// Reauthorize obtains new credentials for account, which must be
+// in the form "provider:username" and stored in the repository,
+// from its provider (usually by asking the user to grant access
+// again), and saves them in place of the ones stored. Use it when
+// the stored credentials have stopped working, or to grant access
+// that the stored ones lack. If new credentials can't be obtained,
+// the stored ones are kept.
+func (r *Repository) Reauthorize(account string) error {
+	pa, err := r.storedAccount(account)
+	if err != nil {
+		return err
+	}
+	if pa.provider.Credentials == nil {
+		return fmt.Errorf("unknown provider '%s'", pa.provider.Name)
+	}
+	creds, err := pa.provider.Credentials(pa.username)
+	if err != nil {
+		return fmt.Errorf("getting credentials for %s: %v", pa.username, err)
+	}
+	err = r.deleteCredentials(pa)
+	if err != nil {
+		return fmt.Errorf("deleting old credentials for %s: %v", pa.username, err)
+	}
+	err = r.saveCredentials(pa, creds)
+	if err != nil {
+		return fmt.Errorf("saving credentials for %s: %v", pa.username, err)
+	}
+	return nil
+}
+
+// RevokeCredentials deletes the stored credentials of account,
+// which must be in the form "provider:username" and stored in the
+// repository. Everything else stored for the account is kept; if
+// it is used again, its credentials are obtained again. Access
+// that was granted to Photobak is not revoked at the provider.
+func (r *Repository) RevokeCredentials(account string) error {
+	pa, err := r.storedAccount(account)
+	if err != nil {
+		return err
+	}
+	return r.deleteCredentials(pa)
+}
+
+// newClient returns a client for pa authorized with creds. If
+// the provider's client can refresh its credentials, they are
+// saved whenever it does, so that the saved ones don't go stale.
+func (r *Repository) newClient(pa providerAccount, creds []byte) (Client, error) {
+	if pa.provider.NewRefreshingClient == nil {
+		return pa.provider.NewClient(creds)
+	}
+	return pa.provider.NewRefreshingClient(creds, func(creds []byte) error {
+		err := r.saveCredentials(pa, creds)
+		if err != nil {
+			return fmt.Errorf("saving refreshed credentials for %s: %v", pa, err)
+		}
+		repoLog.Infof("Saved refreshed credentials for %s", pa)
+		return nil
+	})
+}
+
+// credentialKey returns the key that encrypts credentials in the
+// database, deriving it from the passphrase the first time. If the
+// repository has no passphrase, it returns nil. The first time a
+// passphrase is used with the repository, a salt is generated and
+// stored with a value to check the passphrase with later.
+func (r *Repository) credentialKey() ([]byte, error) {
+	r.credentialKeyMu.Lock()
+	defer r.credentialKeyMu.Unlock()
+	if r.credentialKeyCache != nil || r.CredentialPassphrase == nil {
+		return r.credentialKeyCache, nil
+	}
+
+	passphrase, err := r.CredentialPassphrase()
+	if err != nil {
+		return nil, fmt.Errorf("getting passphrase for credentials: %v", err)
+	}
+	if passphrase == "" {
+		return nil, fmt.Errorf("passphrase for credentials is empty")
+	}
+
+	kdf, err := r.db.loadSetting("credential_kdf")
+	if err != nil {
+		return nil, err
+	}
+	if kdf == "" {
+		salt := make([]byte, credentialSaltSize)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return nil, err
+		}
+		key := pbkdf2.Key([]byte(passphrase), salt, credentialIterations, APIKeySize, sha256.New)
+		check, err := seal(key, credentialCheck, nil)
+		if err != nil {
+			return nil, err
+		}
+		kdf = fmt.Sprintf("pbkdf2-sha256 %d %x", credentialIterations, salt)
+		err = r.db.saveSetting("credential_check", hex.EncodeToString(check))
+		if err == nil {
+			err = r.db.saveSetting("credential_kdf", kdf)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("saving passphrase parameters: %v", err)
+		}
+		r.credentialKeyCache = key
+		return key, nil
+	}
+
+	fields := strings.Fields(kdf)
+	if len(fields) != 3 || fields[0] != "pbkdf2-sha256" {
+		return nil, fmt.Errorf("unknown key derivation for credentials: %s", kdf)
+	}
+	iterations, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("bad key derivation for credentials: %s", kdf)
+	}
+	salt, err := hex.DecodeString(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("bad key derivation for credentials: %s", kdf)
+	}
+	key := pbkdf2.Key([]byte(passphrase), salt, iterations, APIKeySize, sha256.New)
+
+	checkHex, err := r.db.loadSetting("credential_check")
+	if err != nil {
+		return nil, err
+	}
+	check, err := hex.DecodeString(checkHex)
+	if err != nil {
+		return nil, fmt.Errorf("bad passphrase check value: %v", err)
+	}
+	plain, err := unseal(key, check, nil)
+	if err != nil || !bytes.Equal(plain, credentialCheck) {
+		return nil, fmt.Errorf("wrong passphrase for credentials")
+	}
+	r.credentialKeyCache = key
+	return key, nil
+}
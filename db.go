@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/gob"
 	"fmt"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/boltdb/bolt"
@@ -17,11 +19,44 @@ var bucketNames = []string{
 
 type boltDB struct {
 	*bolt.DB
+
+	// batching is greater than zero while writes
+	// of items are batched (see batchWrites)
+	batching int32
+}
+
+// batchWrites makes writes of items share transactions with those
+// of up to n-1 other goroutines, until the returned function is
+// called. Committing a transaction syncs the file, which is most
+// of the cost of saving a small item, so this is for when many
+// goroutines save items at once, like the workers of Store.
+func (db *boltDB) batchWrites(n int) func() {
+	db.MaxBatchSize = n
+	atomic.AddInt32(&db.batching, 1)
+	return func() { atomic.AddInt32(&db.batching, -1) }
+}
+
+// update runs fn in a read-write transaction, like Update. While
+// writes are batched (see batchWrites), fn may share its transaction
+// with those of other goroutines and be called more than once if
+// one of them fails, so it must not change anything but tx. Either
+// way, update returns only when fn's changes are committed, so a
+// file that is saved before its item still comes first on disk.
+func (db *boltDB) update(fn func(*bolt.Tx) error) error {
+	if atomic.LoadInt32(&db.batching) > 0 {
+		return db.Batch(fn)
+	}
+	return db.Update(fn)
 }
 
 // openDB opens a database.
 func openDB(file string) (*boltDB, error) {
 	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: 2 * time.Second})
+	if err == bolt.ErrTimeout {
+		// bolt locks the file for as long as it is open, so
+		// only one process can use a repository at a time
+		return nil, fmt.Errorf("database %s is in use by another process; only one photobak can use a repository at a time", file)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -29,7 +64,16 @@ func openDB(file string) (*boltDB, error) {
 		_, err := tx.CreateBucketIfNotExists([]byte("checksums"))
 		return err
 	})
-	return &boltDB{DB: db}, err
+	if err != nil {
+		return &boltDB{DB: db}, err
+	}
+	bdb := &boltDB{DB: db}
+	err = bdb.migrate(file)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return bdb, nil
 }
 
 // createAccount creates pa in the database if it does not exist.
@@ -49,31 +93,70 @@ func (db *boltDB) createAccount(pa providerAccount) error {
 	})
 }
 
-// loadCredentials loads acct's credentials. If there are no
-// credentials stored, a nil slice and nil error will be returned.
-// The account must already be stored, or it is an error.
-func (db *boltDB) loadCredentials(acct providerAccount) ([]byte, error) {
+// The keys under which credentials are stored in an account's
+// bucket: as they are, or encrypted with a passphrase.
+const (
+	credentialsKey       = "credentials"
+	sealedCredentialsKey = "sealed_credentials"
+)
+
+// loadCredentials loads acct's credentials stored under key. If
+// there are no credentials stored, a nil slice and nil error will
+// be returned. The account must already be stored, or it is an error.
+func (db *boltDB) loadCredentials(acct providerAccount, key string) ([]byte, error) {
 	var creds []byte
 	err := db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket(acct.key())
 		if b == nil {
 			return fmt.Errorf("account '%s' does not exist in DB", acct)
 		}
-		creds = b.Get([]byte("credentials"))
+		if v := b.Get([]byte(key)); v != nil {
+			// the value is only valid during the transaction
+			creds = append([]byte(nil), v...)
+		}
 		return nil
 	})
 	return creds, err
 }
 
-// saveCredentials saves creds to account's bucket in the database.
-// The account must already be stored.
-func (db *boltDB) saveCredentials(acct providerAccount, creds []byte) error {
+// saveCredentials saves creds under key to account's bucket in
+// the database, and removes the credentials stored under the other
+// key, if any. The account must already be stored.
+func (db *boltDB) saveCredentials(acct providerAccount, key string, creds []byte) error {
 	return db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(acct.key())
 		if b == nil {
 			return fmt.Errorf("account '%s' does not exist in DB", acct)
 		}
-		return b.Put([]byte("credentials"), creds)
+		for _, k := range []string{credentialsKey, sealedCredentialsKey} {
+			if k != key && b.Get([]byte(k)) != nil {
+				if err := b.Delete([]byte(k)); err != nil {
+					return err
+				}
+			}
+		}
+		return b.Put([]byte(key), creds)
+	})
+}
+
+// deleteCredentials removes acct's credentials from the database.
+func (db *boltDB) deleteCredentials(acct providerAccount) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(acct.key())
+		if b == nil {
+			return fmt.Errorf("account '%s' does not exist in DB", acct)
+		}
+		for _, k := range []string{credentialsKey, sealedCredentialsKey} {
+			// bolt refuses to delete a missing key if
+			// the next one is a bucket, so check first
+			if b.Get([]byte(k)) == nil {
+				continue
+			}
+			if err := b.Delete([]byte(k)); err != nil {
+				return err
+			}
+		}
+		return nil
 	})
 }
 
@@ -88,7 +171,9 @@ func (db *boltDB) loadItem(acctKey []byte, itemID string) (*dbItem, error) {
 		if items == nil {
 			return fmt.Errorf("account '%s' is missing 'items' bucket", acctKey)
 		}
-		return gobDecode(items.Get([]byte(itemID)), &item)
+		var err error
+		item, err = decodeItem(items.Get([]byte(itemID)))
+		return err
 	})
 	return item, err
 }
@@ -104,8 +189,7 @@ func (db *boltDB) deleteItem(acct providerAccount, itemID string) error {
 			return fmt.Errorf("account '%s' is missing 'items' bucket", acct)
 		}
 		// delete from checksum index
-		var item *dbItem
-		err := gobDecode(items.Get([]byte(itemID)), &item)
+		item, err := decodeItem(items.Get([]byte(itemID)))
 		if err != nil {
 			return fmt.Errorf("loading item to get its hash: %v", err)
 		}
@@ -113,6 +197,10 @@ func (db *boltDB) deleteItem(acct providerAccount, itemID string) error {
 		if err != nil {
 			return err
 		}
+		err = deleteAPIMeta(accountBucket, apiMetaItems, itemID)
+		if err != nil {
+			return err
+		}
 		// finally, delete item from DB
 		return items.Delete([]byte(itemID))
 	})
@@ -164,12 +252,16 @@ func (db *boltDB) deleteCollection(acct providerAccount, collID string) error {
 		if items == nil {
 			return fmt.Errorf("account '%s' is missing 'collections' bucket", acct)
 		}
+		err := deleteAPIMeta(accountBucket, apiMetaCollections, collID)
+		if err != nil {
+			return err
+		}
 		return items.Delete([]byte(collID))
 	})
 }
 
 func (db *boltDB) saveItem(acctKey []byte, itemID string, item *dbItem) error {
-	return db.Update(func(tx *bolt.Tx) error {
+	return db.update(func(tx *bolt.Tx) error {
 		accountBucket := tx.Bucket(acctKey)
 		if accountBucket == nil {
 			return fmt.Errorf("account '%s' does not exist in DB", acctKey)
@@ -180,14 +272,13 @@ func (db *boltDB) saveItem(acctKey []byte, itemID string, item *dbItem) error {
 		if items == nil {
 			return fmt.Errorf("account '%s' is missing 'items' bucket", acctKey)
 		}
-		var savedItem *dbItem
-		err := gobDecode(items.Get([]byte(itemID)), &savedItem)
+		savedItem, err := decodeItem(items.Get([]byte(itemID)))
 		if err != nil {
 			return fmt.Errorf("loading item %s: %v", itemID, err)
 		}
 
 		// then save this item
-		itemEnc, err := gobEncode(item)
+		itemEnc, err := encodeItem(item)
 		if err != nil {
 			return err
 		}
@@ -195,6 +286,10 @@ func (db *boltDB) saveItem(acctKey []byte, itemID string, item *dbItem) error {
 		if err != nil {
 			return err
 		}
+		err = putAPIMeta(accountBucket, apiMetaItems, itemID, item.Meta.API, item.Meta.SealedAPI)
+		if err != nil {
+			return err
+		}
 
 		// then update the collections so they know they contain this item
 		collections := accountBucket.Bucket([]byte("collections"))
@@ -247,7 +342,7 @@ func (db *boltDB) saveItem(acctKey []byte, itemID string, item *dbItem) error {
 }
 
 func (db *boltDB) saveItemToCollection(pa providerAccount, itemID, collID string) error {
-	return db.Update(func(tx *bolt.Tx) error {
+	return db.update(func(tx *bolt.Tx) error {
 		accountBucket := tx.Bucket(pa.key())
 		if accountBucket == nil {
 			return fmt.Errorf("account '%s' does not exist in DB", pa)
@@ -262,17 +357,19 @@ func (db *boltDB) addItemToCollection(accountBucket *bolt.Bucket, itemID, collID
 	if items == nil {
 		return fmt.Errorf("missing 'items' bucket")
 	}
-	item := &dbItem{Collections: make(map[string]struct{})}
-	err := gobDecode(items.Get([]byte(itemID)), &item)
+	item, err := decodeItem(items.Get([]byte(itemID)))
 	if err != nil {
 		return fmt.Errorf("decoding item: %v", err)
 	}
+	if item == nil {
+		item = &dbItem{Collections: make(map[string]struct{})}
+	}
 
 	// then add the collection ID to the item
 	item.Collections[collID] = struct{}{}
 
 	// save the item
-	itemEnc, err := gobEncode(item)
+	itemEnc, err := encodeItem(item)
 	if err != nil {
 		return err
 	}
@@ -288,15 +385,17 @@ func (db *boltDB) addItemToCollection(accountBucket *bolt.Bucket, itemID, collID
 	}
 
 	// get the collection
-	coll := dbCollection{Items: make(map[string]struct{})}
-	err = gobDecode(collections.Get([]byte(collID)), &coll)
+	coll, err := decodeCollection(collections.Get([]byte(collID)))
 	if err != nil {
 		return fmt.Errorf("decoding collection: %v", err)
 	}
+	if coll == nil {
+		coll = &dbCollection{Items: make(map[string]struct{})}
+	}
 
 	// update its set of items to include this one
 	coll.Items[itemID] = struct{}{}
-	collEnc, err := gobEncode(coll)
+	collEnc, err := encodeCollection(coll)
 	if err != nil {
 		return fmt.Errorf("encoding collection: %v", err)
 	}
@@ -340,7 +439,9 @@ func (db *boltDB) loadCollection(acctKey []byte, collID string) (*dbCollection,
 		if collections == nil {
 			return fmt.Errorf("account '%s' is missing 'collections' bucket", acctKey)
 		}
-		return gobDecode(collections.Get([]byte(collID)), &coll)
+		var err error
+		coll, err = decodeCollection(collections.Get([]byte(collID)))
+		return err
 	})
 	return coll, err
 }
@@ -355,14 +456,375 @@ func (db *boltDB) saveCollection(acctKey []byte, id string, coll *dbCollection)
 		if collections == nil {
 			return fmt.Errorf("account '%s' is missing 'collections' bucket", acctKey)
 		}
-		collEnc, err := gobEncode(coll)
+		collEnc, err := encodeCollection(coll)
+		if err != nil {
+			return err
+		}
+		err = collections.Put([]byte(id), collEnc)
+		if err != nil {
+			return err
+		}
+		return putAPIMeta(accountBucket, apiMetaCollections, id, coll.Meta.API, coll.Meta.SealedAPI)
+	})
+}
+
+// storedAccounts returns all the accounts that have a bucket
+// in the database, whether or not they are configured.
+func (db *boltDB) storedAccounts() ([]providerAccount, error) {
+	var accounts []providerAccount
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			parts := strings.SplitN(string(name), ":", 2)
+			if len(parts) == 2 {
+				accounts = append(accounts, accountFromKey(parts[0], parts[1]))
+			}
+			return nil
+		})
+	})
+	return accounts, err
+}
+
+// accountExists returns true if pa has a bucket in the database.
+func (db *boltDB) accountExists(pa providerAccount) (bool, error) {
+	var exists bool
+	err := db.View(func(tx *bolt.Tx) error {
+		exists = tx.Bucket(pa.key()) != nil
+		return nil
+	})
+	return exists, err
+}
+
+// deleteAccount deletes pa's bucket, including its credentials,
+// collections, and items, and removes any references to pa's
+// items from the checksum index.
+func (db *boltDB) deleteAccount(pa providerAccount) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		err := db.removeAccountFromChecksumIndex(tx, pa.key())
+		if err != nil {
+			return err
+		}
+		return tx.DeleteBucket(pa.key())
+	})
+}
+
+// removeAccountFromChecksumIndex removes all entries belonging
+// to acctKey from the checksum index. It is meant for use by
+// already-open DB transactions.
+func (db *boltDB) removeAccountFromChecksumIndex(tx *bolt.Tx, acctKey []byte) error {
+	checksums := tx.Bucket([]byte("checksums"))
+	if checksums == nil {
+		return fmt.Errorf("no checksums bucket")
+	}
+	updates := make(map[string][]accountItem)
+	err := checksums.ForEach(func(k, v []byte) error {
+		var list []accountItem
+		err := gobDecode(v, &list)
+		if err != nil {
+			return fmt.Errorf("loading list of hashed items: %v", err)
+		}
+		var kept []accountItem
+		for _, li := range list {
+			if !bytes.Equal(li.AcctKey, acctKey) {
+				kept = append(kept, li)
+			}
+		}
+		if len(kept) != len(list) {
+			updates[string(k)] = kept
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for chksm, list := range updates {
+		if len(list) == 0 {
+			err = checksums.Delete([]byte(chksm))
+		} else {
+			var listEnc []byte
+			listEnc, err = gobEncode(list)
+			if err == nil {
+				err = checksums.Put([]byte(chksm), listEnc)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checksumRefs counts the entries in the checksum
+// index that refer to items in acctKey's account.
+func (db *boltDB) checksumRefs(acctKey []byte) (int, error) {
+	var count int
+	err := db.View(func(tx *bolt.Tx) error {
+		checksums := tx.Bucket([]byte("checksums"))
+		if checksums == nil {
+			return fmt.Errorf("no checksums bucket")
+		}
+		return checksums.ForEach(func(k, v []byte) error {
+			var list []accountItem
+			err := gobDecode(v, &list)
+			if err != nil {
+				return err
+			}
+			for _, li := range list {
+				if bytes.Equal(li.AcctKey, acctKey) {
+					count++
+				}
+			}
+			return nil
+		})
+	})
+	return count, err
+}
+
+// loadUnfinished returns the IDs of pa's collections that
+// were not finished during the last run.
+func (db *boltDB) loadUnfinished(pa providerAccount) (map[string]struct{}, error) {
+	var ids map[string]struct{}
+	err := db.View(func(tx *bolt.Tx) error {
+		accountBucket := tx.Bucket(pa.key())
+		if accountBucket == nil {
+			return fmt.Errorf("account '%s' does not exist in DB", pa)
+		}
+		return gobDecode(accountBucket.Get([]byte("unfinished")), &ids)
+	})
+	return ids, err
+}
+
+// saveUnfinished records ids as the IDs of pa's collections
+// that were not finished during this run.
+func (db *boltDB) saveUnfinished(pa providerAccount, ids []string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		accountBucket := tx.Bucket(pa.key())
+		if accountBucket == nil {
+			return fmt.Errorf("account '%s' does not exist in DB", pa)
+		}
+		if len(ids) == 0 {
+			return accountBucket.Delete([]byte("unfinished"))
+		}
+		set := make(map[string]struct{}, len(ids))
+		for _, id := range ids {
+			set[id] = struct{}{}
+		}
+		enc, err := gobEncode(set)
+		if err != nil {
+			return err
+		}
+		return accountBucket.Put([]byte("unfinished"), enc)
+	})
+}
+
+// loadSetting returns the repository setting called
+// name, or "" if it has not been set.
+func (db *boltDB) loadSetting(name string) (string, error) {
+	var val string
+	err := db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte("meta"))
+		if meta == nil {
+			return nil
+		}
+		val = string(meta.Get([]byte(name)))
+		return nil
+	})
+	return val, err
+}
+
+// saveSetting saves val as the repository setting called name.
+func (db *boltDB) saveSetting(name, val string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists([]byte("meta"))
 		if err != nil {
 			return err
 		}
-		return collections.Put([]byte(id), collEnc)
+		return meta.Put([]byte(name), []byte(val))
 	})
 }
 
+// removeDanglingChecksums removes entries from the checksum
+// index that refer to accounts or items that do not exist, or
+// to items whose content now has a different checksum. Such
+// garbage can be left behind by interrupted deletes and by
+// bugs in older versions. It returns the number of entries
+// that were removed.
+func (db *boltDB) removeDanglingChecksums() (int, error) {
+	var removed int
+	err := db.Update(func(tx *bolt.Tx) error {
+		checksums := tx.Bucket([]byte("checksums"))
+		if checksums == nil {
+			return fmt.Errorf("no checksums bucket")
+		}
+		updates := make(map[string][]accountItem)
+		err := checksums.ForEach(func(k, v []byte) error {
+			var list []accountItem
+			err := gobDecode(v, &list)
+			if err != nil {
+				return fmt.Errorf("loading list of hashed items: %v", err)
+			}
+			var kept []accountItem
+			for _, li := range list {
+				if db.checksumEntryValid(tx, k, li, kept) {
+					kept = append(kept, li)
+				}
+			}
+			if len(kept) != len(list) {
+				updates[string(k)] = kept
+				removed += len(list) - len(kept)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for chksm, list := range updates {
+			if len(list) == 0 {
+				err = checksums.Delete([]byte(chksm))
+			} else {
+				var listEnc []byte
+				listEnc, err = gobEncode(list)
+				if err == nil {
+					err = checksums.Put([]byte(chksm), listEnc)
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// danglingChecksums returns the entries of the checksum index
+// that removeDanglingChecksums would remove, keyed by checksum,
+// without removing them.
+func (db *boltDB) danglingChecksums() (map[string][]accountItem, error) {
+	dangling := make(map[string][]accountItem)
+	err := db.View(func(tx *bolt.Tx) error {
+		checksums := tx.Bucket([]byte("checksums"))
+		if checksums == nil {
+			return fmt.Errorf("no checksums bucket")
+		}
+		return checksums.ForEach(func(k, v []byte) error {
+			var list []accountItem
+			err := gobDecode(v, &list)
+			if err != nil {
+				return fmt.Errorf("loading list of hashed items: %v", err)
+			}
+			var kept []accountItem
+			for _, li := range list {
+				if db.checksumEntryValid(tx, k, li, kept) {
+					kept = append(kept, li)
+				} else {
+					dangling[string(k)] = append(dangling[string(k)], li)
+				}
+			}
+			return nil
+		})
+	})
+	return dangling, err
+}
+
+// rebuildChecksumIndex replaces the checksum
+// index with one made from all the items.
+func (db *boltDB) rebuildChecksumIndex() error {
+	return db.Update(rebuildChecksumIndexTx)
+}
+
+// rebuildChecksumIndexTx is rebuildChecksumIndex within tx.
+func rebuildChecksumIndexTx(tx *bolt.Tx) error {
+	err := tx.DeleteBucket([]byte("checksums"))
+	if err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+	checksums, err := tx.CreateBucket([]byte("checksums"))
+	if err != nil {
+		return err
+	}
+
+	index := make(map[string][]accountItem)
+	err = tx.ForEach(func(acctKey []byte, accountBucket *bolt.Bucket) error {
+		items := accountBucket.Bucket([]byte("items"))
+		if items == nil {
+			return nil // not an account
+		}
+		return items.ForEach(func(k, v []byte) error {
+			item, err := decodeItem(v)
+			if err != nil {
+				return fmt.Errorf("loading item %s: %v", k, err)
+			}
+			if item != nil {
+				key := string(item.Checksum)
+				index[key] = append(index[key], accountItem{
+					AcctKey: append([]byte(nil), acctKey...),
+					ItemID:  string(k),
+				})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for chksm, list := range index {
+		listEnc, err := gobEncode(list)
+		if err != nil {
+			return err
+		}
+		err = checksums.Put([]byte(chksm), listEnc)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checksumEntryValid returns true if li, listed in the checksum
+// index under chksm, refers to an existing item with that
+// checksum and is not a duplicate of an entry in kept.
+func (db *boltDB) checksumEntryValid(tx *bolt.Tx, chksm []byte, li accountItem, kept []accountItem) bool {
+	for _, k := range kept {
+		if bytes.Equal(k.AcctKey, li.AcctKey) && k.ItemID == li.ItemID {
+			return false
+		}
+	}
+	accountBucket := tx.Bucket(li.AcctKey)
+	if accountBucket == nil {
+		return false
+	}
+	items := accountBucket.Bucket([]byte("items"))
+	if items == nil {
+		return false
+	}
+	item, err := decodeItem(items.Get([]byte(li.ItemID)))
+	if err != nil {
+		return true // can't tell, so don't risk it
+	}
+	return item != nil && bytes.Equal(item.Checksum, chksm)
+}
+
+// itemIDs returns the IDs of all of pa's items.
+func (db *boltDB) itemIDs(pa providerAccount) ([]string, error) {
+	var list []string
+	err := db.View(func(tx *bolt.Tx) error {
+		accountBucket := tx.Bucket(pa.key())
+		if accountBucket == nil {
+			return fmt.Errorf("account '%s' does not exist in DB", pa)
+		}
+		items := accountBucket.Bucket([]byte("items"))
+		if items == nil {
+			return fmt.Errorf("account '%s' is missing 'items' bucket", pa)
+		}
+		return items.ForEach(func(k, v []byte) error {
+			list = append(list, string(k))
+			return nil
+		})
+	})
+	return list, err
+}
+
 func (db *boltDB) itemsWithChecksum(chksm []byte) ([]accountItem, error) {
 	var list []accountItem
 	err := db.View(func(tx *bolt.Tx) error {
@@ -379,16 +841,48 @@ func (db *boltDB) itemsWithChecksum(chksm []byte) ([]accountItem, error) {
 
 /*
 	ROOT
+	|-- meta
+		|-- version -> (layout version, uint64)
+		|-- path_template -> (template for paths of new items, if set)
+		|-- dedup_mode -> (how items are referenced from other collections, if set)
+		|-- views -> (comma-separated kinds of views kept in the repo, if any)
+		|-- credential_kdf -> (how the key to encrypt credentials is derived from the passphrase, if set)
+		|-- credential_check -> (a value encrypted with that key, to check the passphrase)
 	|-- checksums
 		|-- <sha> -> list of <accountKey>::<itemID>
+	|-- accounts
+		|-- (accountKey) -> (what configures the saved account, like its username)
+	|-- pending
+		|-- (repo-relative file path) -> (the download into it that is in progress)
 	|-- googlephotos:my@email.com
 		|-- credentials -> (token)
+		|-- sealed_credentials -> (token encrypted with the key from the passphrase, instead)
+		|-- unfinished -> (set of collection IDs not finished in the last run)
+		|-- checkpoint -> (how far the last run got, if it was interrupted)
+		|-- full_pass -> (when every collection was last listed, even dormant ones)
+		|-- skipped -> (items not downloaded because they were too large, by item ID)
 		|-- collections
-			|-- (collection ID) -> (collection)
+			|-- (collection ID) -> (collection, as versioned JSON)
 			|-- ...
 		|-- items
-			|-- (item ID) -> (item)
+			|-- (item ID) -> (item, as versioned JSON)
+			|-- ...
+		|-- item_aliases
+			|-- (current item ID) -> (ID the item is stored under)
+			|-- ...
+		|-- collection_aliases
+			|-- (current collection ID) -> (ID the collection is stored under)
+			|-- ...
+		|-- listings
+			|-- (collection ID) -> (IDs of the items last listed in it, and when)
 			|-- ...
+		|-- apimeta
+			|-- items
+				|-- (item ID) -> (everything the API said about the item, if requested)
+				|-- ...
+			|-- collections
+				|-- (collection ID) -> (everything the API said about the collection, if requested)
+				|-- ...
 	|-- googlephotos:foo@bar.com
 		|-- ...
 */
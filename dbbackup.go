@@ -0,0 +1,200 @@
+package photobak
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// maxDBProblems is how many problems a consistency
+// check of the database reports at most.
+const maxDBProblems = 10
+
+// CorruptDBError is returned when the database
+// fails its consistency check (see CheckDB).
+type CorruptDBError struct {
+	File     string   // the database file
+	Problems []string // what is wrong with it, maybe not all of it
+	Backup   string   // the newest backup that has no problems, if any
+}
+
+func (e CorruptDBError) Error() string {
+	return fmt.Sprintf("database %s is damaged: %s", e.File, strings.Join(e.Problems, "; "))
+}
+
+// CheckDB checks that the database is consistent, like that no
+// page of it is used twice or lost. If it isn't, it returns a
+// CorruptDBError. This only reads the database, but all of it,
+// so it takes a moment for a large one.
+func (r *Repository) CheckDB() error {
+	problems := checkDB(r.db.DB)
+	if len(problems) == 0 {
+		return nil
+	}
+	file := r.db.Path()
+	backup, err := LatestDBBackup(file)
+	if err != nil {
+		dbLog.Errorf("looking for a backup of the database: %v", err)
+	}
+	return CorruptDBError{File: file, Problems: problems, Backup: backup}
+}
+
+// checkDB returns the problems found by reading all
+// of db and checking its consistency, if any.
+func checkDB(db *bolt.DB) (problems []string) {
+	// bolt panics on some kinds of damage instead of returning an
+	// error; reading everything first, in this goroutine, finds
+	// those before the consistency check, which runs in another
+	defer func() {
+		if r := recover(); r != nil {
+			problems = append(problems, fmt.Sprint(r))
+		}
+	}()
+	err := walkDB(db, func(keys [][]byte, k, v []byte, seq uint64) error { return nil })
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	err = db.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			if len(problems) < maxDBProblems {
+				problems = append(problems, err.Error())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	return problems
+}
+
+// BackupDB saves a copy of the database next to it, keeping
+// the keep most recent copies: the newest is the database's
+// file name with ".bak" added, like photobak.db.bak, and
+// older ones are numbered, like photobak.db.bak.1. The
+// database should be checked first (see CheckDB), since a
+// damaged database would push out a good copy.
+func (r *Repository) BackupDB(keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	file := r.db.Path()
+	tmpFile := file + ".bak.tmp"
+	os.Remove(tmpFile) // left over from an earlier attempt
+	err := r.db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(tmpFile, 0600)
+	})
+	if err != nil {
+		os.Remove(tmpFile)
+		return fmt.Errorf("copying database: %v", err)
+	}
+
+	// make room for the new copy, oldest first
+	backups := dbBackupNames(file, keep)
+	os.Remove(backups[keep-1])
+	for i := keep - 1; i > 0; i-- {
+		err := os.Rename(backups[i-1], backups[i])
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("rotating database backups: %v", err)
+		}
+	}
+	return os.Rename(tmpFile, backups[0])
+}
+
+// dbBackupNames returns the names of the first n
+// backups of the database file, newest first.
+func dbBackupNames(file string, n int) []string {
+	names := []string{file + ".bak"}
+	for i := 1; i < n; i++ {
+		names = append(names, fmt.Sprintf("%s.bak.%d", file, i))
+	}
+	return names
+}
+
+// LatestDBBackup returns the newest backup of the database
+// file (see BackupDB) that passes a consistency check,
+// or "" if there is none.
+func LatestDBBackup(file string) (string, error) {
+	matches, err := filepath.Glob(file + ".bak*")
+	if err != nil {
+		return "", err
+	}
+	for _, backup := range dbBackupNames(file, len(matches)+1) {
+		if _, err := os.Stat(backup); err != nil {
+			continue
+		}
+		problems := checkDBFile(backup)
+		if len(problems) == 0 {
+			return backup, nil
+		}
+		dbLog.Warnf("Backup %s is damaged too: %s", backup, strings.Join(problems, "; "))
+	}
+	return "", nil
+}
+
+// checkDBFile opens the database file read-only and returns
+// the problems found by checkDB, or by opening it, if any.
+func checkDBFile(file string) (problems []string) {
+	defer func() {
+		if r := recover(); r != nil {
+			problems = append(problems, fmt.Sprint(r)) // see checkDB
+		}
+	}()
+	db, err := bolt.Open(file, 0600, &bolt.Options{ReadOnly: true, Timeout: 2 * time.Second})
+	if err != nil {
+		return []string{err.Error()}
+	}
+	defer db.Close()
+	return checkDB(db)
+}
+
+// RecoverDB replaces the database file with a copy of backup,
+// which is usually the result of LatestDBBackup. The database
+// must not be open. The damaged database is kept next to it,
+// with ".damaged" and the time added to its name, which is
+// returned. What was stored since the backup was taken is no
+// longer in the database, so the next run downloads it again
+// (or, with AdoptExisting, takes over the files it finds).
+func RecoverDB(file, backup string) (string, error) {
+	// make sure no one is using the database; bolt
+	// locks it for as long as it is open
+	db, err := bolt.Open(file, 0600, &bolt.Options{ReadOnly: true, Timeout: 2 * time.Second})
+	if err == bolt.ErrTimeout {
+		return "", fmt.Errorf("database %s is in use by another process", file)
+	}
+	if err == nil {
+		db.Close()
+	}
+
+	tmpFile := file + ".recover"
+	os.Remove(tmpFile)
+	err = copyFile(backup, tmpFile)
+	if err != nil {
+		return "", fmt.Errorf("copying backup: %v", err)
+	}
+	damaged := fmt.Sprintf("%s.damaged-%s", file, time.Now().Format("20060102T150405"))
+	err = os.Rename(file, damaged)
+	if err != nil && !os.IsNotExist(err) {
+		os.Remove(tmpFile)
+		return "", fmt.Errorf("moving damaged database aside: %v", err)
+	}
+	err = os.Rename(tmpFile, file)
+	if err != nil {
+		return damaged, fmt.Errorf("putting backup in place: %v", err)
+	}
+	return damaged, nil
+}
+
+// DBFile returns the path of the database of the repository at
+// location, as it is opened by OpenRepoWithDB with dbPath.
+func DBFile(location, dbPath string) string {
+	if dbPath != "" {
+		return dbPath
+	}
+	return filepath.Join(location, "photobak.db")
+}
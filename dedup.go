@@ -0,0 +1,269 @@
+package photobak
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// De-duplication modes, which decide how a collection refers
+// to an item whose file is saved elsewhere in the repository
+// (for example, in another collection's folder).
+const (
+	// DedupList writes the path of the file to a media
+	// list file ("others.txt") in the collection's folder.
+	DedupList = "list"
+
+	// DedupSymlink creates a symbolic link to the file
+	// in the collection's folder.
+	DedupSymlink = "symlink"
+
+	// DedupHardlink creates a hard link to the file
+	// in the collection's folder.
+	DedupHardlink = "hardlink"
+)
+
+// DedupMode returns the de-duplication mode of the repository.
+func (r *Repository) DedupMode() string {
+	return r.dedupMode
+}
+
+// SetDedupMode sets the de-duplication mode of the repository
+// to mode, which must be DedupList, DedupSymlink, or
+// DedupHardlink. It is saved in the database so that it is used
+// on later runs too. If the mode is different from before, all
+// the references to items in other folders are converted to the
+// new mode.
+func (r *Repository) SetDedupMode(mode string) error {
+	switch mode {
+	case DedupList, DedupSymlink, DedupHardlink:
+	default:
+		return fmt.Errorf("unknown de-duplication mode '%s'", mode)
+	}
+	if mode == r.dedupMode {
+		return nil
+	}
+	r.beginChanges()
+	err := r.convertReferences(mode)
+	r.endChanges()
+	if err != nil {
+		return fmt.Errorf("converting repository to de-duplication mode %s: %v", mode, err)
+	}
+	return r.db.saveSetting("dedup_mode", mode)
+}
+
+// reference is an item's file that is
+// referred to from a collection's folder.
+type reference struct {
+	dirPath, filePath string
+}
+
+// convertReferences removes all the references to items in
+// other folders and creates them again using mode.
+func (r *Repository) convertReferences(mode string) error {
+	accounts, err := r.db.storedAccounts()
+	if err != nil {
+		return err
+	}
+
+	var refs []reference
+	for _, pa := range accounts {
+		collIDs, err := r.db.collectionIDs(pa)
+		if err != nil {
+			return err
+		}
+		for _, collID := range collIDs {
+			dbc, err := r.db.loadCollection(pa.key(), collID)
+			if err != nil {
+				return err
+			}
+			if dbc == nil {
+				continue
+			}
+			for itemID := range dbc.Items {
+				dbi, err := r.db.loadItem(pa.key(), itemID)
+				if err != nil {
+					return err
+				}
+				if dbi == nil || inDir(dbi.FilePath, dbc.DirPath) {
+					continue
+				}
+				refs = append(refs, reference{dirPath: dbc.DirPath, filePath: dbi.FilePath})
+			}
+		}
+	}
+
+	repoLog.Infof("Converting %d references from %s to %s", len(refs), r.dedupMode, mode)
+	for _, ref := range refs {
+		err := r.replaceInMediaListFile(ref.dirPath, ref.filePath, "")
+		if err != nil {
+			return err
+		}
+	}
+	r.dedupMode = mode
+	for _, ref := range refs {
+		err := r.writeToMediaListFile(collection{dirPath: ref.dirPath}, ref.filePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeLink creates a link in dirPath to the file at
+// target, unless there already is one. Both paths must
+// be repo-relative.
+func (r *Repository) writeLink(dirPath, target string) error {
+	links, err := r.findLinks(dirPath, target)
+	if err != nil {
+		return err
+	}
+	if len(links) > 0 {
+		return nil
+	}
+	name, err := r.reserveUniqueFilename(dirPath, filepath.Base(target), false)
+	if err != nil {
+		return fmt.Errorf("reserving unique filename for link: %v", err)
+	}
+	return r.makeLink(filepath.Join(dirPath, name), target)
+}
+
+// makeLink creates a link at linkPath to target, replacing
+// whatever is at linkPath. Both paths must be repo-relative.
+func (r *Repository) makeLink(linkPath, target string) error {
+	fullLinkPath := r.fullPath(linkPath)
+	tmpPath := fullLinkPath + ".tmp"
+	if r.SyncFriendly {
+		// create the link where it goes instead of renaming it there
+		tmpPath = fullLinkPath
+	}
+	os.Remove(tmpPath)
+
+	var err error
+	if r.dedupMode == DedupSymlink {
+		var rel string
+		rel, err = filepath.Rel(filepath.Dir(fullLinkPath), r.fullPath(target))
+		if err == nil {
+			err = os.Symlink(rel, tmpPath)
+		}
+	} else {
+		err = os.Link(r.fullPath(target), tmpPath)
+	}
+	if err != nil {
+		os.Remove(fullLinkPath)
+		return fmt.Errorf("linking %s to %s: %v", linkPath, target, err)
+	}
+
+	if tmpPath == fullLinkPath {
+		return nil
+	}
+
+	// replace the placeholder (or old link) in one step
+	err = os.Rename(tmpPath, fullLinkPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("moving link into place: %v", err)
+	}
+	return nil
+}
+
+// replaceLinks replaces the links in dirPath to oldPath with
+// links to newPath. If newPath is empty, the links are removed.
+// Hard links need not be replaced when a file is moved, since
+// they refer to the file itself, not its path.
+func (r *Repository) replaceLinks(dirPath, oldPath, newPath string) error {
+	if r.dedupMode == DedupHardlink && newPath != "" {
+		return nil
+	}
+	links, err := r.findLinks(dirPath, oldPath)
+	if err != nil {
+		return err
+	}
+	for _, link := range links {
+		if newPath == "" {
+			err = os.Remove(r.fullPath(link))
+		} else {
+			err = r.makeLink(link, newPath)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findLinks returns the repo-relative paths of the links in
+// dirPath (not its subfolders) that refer to the file at target.
+// Symbolic links refer to target if they point to its path; hard
+// links refer to target if they are the same file, so target
+// must exist for hard links to be found.
+func (r *Repository) findLinks(dirPath, target string) ([]string, error) {
+	infos, err := ioutil.ReadDir(r.fullPath(dirPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	fullTarget := filepath.Clean(r.fullPath(target))
+	var targetInfo os.FileInfo
+	if r.dedupMode == DedupHardlink {
+		targetInfo, err = os.Stat(fullTarget)
+		if err != nil {
+			return nil, nil
+		}
+	}
+
+	var links []string
+	for _, info := range infos {
+		linkPath := filepath.Join(dirPath, info.Name())
+		if linkPath == target {
+			continue
+		}
+		if r.isLinkTo(linkPath, info, fullTarget, targetInfo) {
+			links = append(links, linkPath)
+		}
+	}
+	return links, nil
+}
+
+// linksTo returns true if the file at the repo-relative linkPath,
+// described by info, is a link to the file at the repo-relative
+// target, according to the de-duplication mode.
+func (r *Repository) linksTo(linkPath string, info os.FileInfo, target string) bool {
+	fullTarget := filepath.Clean(r.fullPath(target))
+	var targetInfo os.FileInfo
+	if r.dedupMode == DedupHardlink {
+		var err error
+		targetInfo, err = os.Stat(fullTarget)
+		if err != nil {
+			return false
+		}
+	}
+	return r.isLinkTo(linkPath, info, fullTarget, targetInfo)
+}
+
+// isLinkTo is like linksTo, but takes the full path of the target
+// and, for hard links, its info, so they can be reused.
+func (r *Repository) isLinkTo(linkPath string, info os.FileInfo, fullTarget string, targetInfo os.FileInfo) bool {
+	switch r.dedupMode {
+	case DedupSymlink:
+		if info.Mode()&os.ModeSymlink == 0 {
+			return false
+		}
+		dest, err := os.Readlink(r.fullPath(linkPath))
+		if err != nil {
+			return false
+		}
+		if !filepath.IsAbs(dest) {
+			dest = filepath.Join(filepath.Dir(r.fullPath(linkPath)), dest)
+		}
+		return filepath.Clean(dest) == fullTarget
+	case DedupHardlink:
+		return info.Mode().IsRegular() && os.SameFile(info, targetInfo)
+	}
+	return false
+}
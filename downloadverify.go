@@ -0,0 +1,96 @@
+package photobak
+
+import (
+	"bytes"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// DownloadVerifier is an optional interface a Client may implement
+// if its provider tells enough about items (like a checksum of their
+// content) to check that what was downloaded is really the item.
+// The check is made after each download, before the item is saved
+// to the index. If it fails, the download is tried again according
+// to Retries, and the item is not saved if it never passes.
+type DownloadVerifier interface {
+	// VerificationHash returns a new hash to which the content
+	// of it is written as it is downloaded, and the sum that
+	// the hash must have once all of the content is written.
+	// If it can't be verified (for example, because the
+	// provider has no checksum for it), h should be nil.
+	VerificationHash(it Item) (h hash.Hash, sum []byte)
+}
+
+// downloadCheck checks the content of an item as it is downloaded.
+// The zero value checks nothing.
+type downloadCheck struct {
+	h   hash.Hash
+	sum []byte
+}
+
+// newDownloadCheck returns a check of the content of it if
+// client implements DownloadVerifier and can verify it.
+func newDownloadCheck(client Client, it Item) downloadCheck {
+	dv, ok := client.(DownloadVerifier)
+	if !ok {
+		return downloadCheck{}
+	}
+	h, sum := dv.VerificationHash(it)
+	if h == nil {
+		return downloadCheck{}
+	}
+	return downloadCheck{h: h, sum: sum}
+}
+
+// Write writes p to the hash, if any.
+func (dc downloadCheck) Write(p []byte) (int, error) {
+	if dc.h == nil {
+		return len(p), nil
+	}
+	return dc.h.Write(p)
+}
+
+// verify returns an error if the content written
+// doesn't have the sum it should.
+func (dc downloadCheck) verify() error {
+	if dc.h == nil {
+		return nil
+	}
+	if got := dc.h.Sum(nil); !bytes.Equal(got, dc.sum) {
+		return fmt.Errorf("content does not match the provider's checksum (got %x, expected %x)", got, dc.sum)
+	}
+	return nil
+}
+
+// matchesProvider hashes the file at the repo-relative path
+// fpath the way a download of it would be checked, and reports
+// whether its content is what the provider has. If the client
+// can't verify it (see DownloadVerifier), known is false and
+// the file isn't read.
+func (r *Repository) matchesProvider(client Client, it Item, fpath string) (same, known bool, err error) {
+	check := newDownloadCheck(client, it)
+	if check.h == nil {
+		return false, false, nil
+	}
+	f, err := os.Open(r.fullPath(fpath))
+	if err != nil {
+		return false, true, err
+	}
+	defer f.Close()
+	if _, err := io.Copy(check, f); err != nil {
+		return false, true, err
+	}
+	return check.verify() == nil, true, nil
+}
+
+// checkListedSize returns an error if the size of it was listed
+// (see ListedSizer) and n bytes of it were downloaded instead,
+// which usually means that the download was cut short.
+func checkListedSize(it Item, n int64) error {
+	if size := listedSize(it); size >= 0 && n != size {
+		return fmt.Errorf("downloaded %d bytes, but the provider listed the item as %d bytes", n, size)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package dropbox
+
+import (
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mholt/photobak"
+)
+
+// Structures in this file describe the subset of
+// the Dropbox API v2 responses that we use:
+// https://www.dropbox.com/developers/documentation/http/documentation
+
+// listFolderResult is the response to files/list_folder
+// and files/list_folder/continue.
+type listFolderResult struct {
+	Entries []Metadata `json:"entries"`
+	Cursor  string     `json:"cursor"`
+	HasMore bool       `json:"has_more"`
+}
+
+// listSharedFoldersResult is the response to sharing/list_folders
+// and sharing/list_folders/continue.
+type listSharedFoldersResult struct {
+	Entries []SharedFolder `json:"entries"`
+	Cursor  string         `json:"cursor"`
+}
+
+// Metadata describes a file or folder in Dropbox.
+// Fields that only apply to files are empty for
+// folders.
+type Metadata struct {
+	Tag            string    `json:".tag"` // "file", "folder", or "deleted"
+	Name           string    `json:"name"`
+	ID             string    `json:"id"`
+	PathLower      string    `json:"path_lower"`
+	PathDisplay    string    `json:"path_display"`
+	ClientModified time.Time `json:"client_modified"`
+	ServerModified time.Time `json:"server_modified"`
+	Rev            string    `json:"rev"`
+	Size           int64     `json:"size"`
+	ContentHash    string    `json:"content_hash"`
+}
+
+// ItemID returns the file's unique ID.
+func (m Metadata) ItemID() string { return m.ID }
+
+// ItemName returns the file name.
+func (m Metadata) ItemName() string { return m.Name }
+
+// ItemETag returns the file's content hash, which
+// only changes when the contents of the file do.
+func (m Metadata) ItemETag() string { return m.ContentHash }
+
+// ItemChangeKey returns the value used to detect changes
+// with the given strategy.
+func (m Metadata) ItemChangeKey(strategy string) string {
+	switch strategy {
+	case photobak.ChangeHash:
+		return m.ContentHash
+	case photobak.ChangeVersion:
+		return m.Rev
+	case photobak.ChangeUpdated:
+		return m.ServerModified.UTC().Format(time.RFC3339Nano)
+	case photobak.ChangeSize:
+		return strconv.FormatInt(m.Size, 10)
+	}
+	return ""
+}
+
+// ItemCaption returns an empty string, since
+// Dropbox files do not have captions.
+func (m Metadata) ItemCaption() string { return "" }
+
+// ItemTime returns the file's modification time as
+// reported by the client that uploaded it, which is
+// usually closest to when the photo was taken.
+func (m Metadata) ItemTime() time.Time { return m.ClientModified }
+
+// ListedSize returns the size of the file in bytes.
+func (m Metadata) ListedSize() int64 { return m.Size }
+
+// SharedFolder describes a folder shared with the user.
+type SharedFolder struct {
+	Name           string `json:"name"`
+	SharedFolderID string `json:"shared_folder_id"`
+	PathLower      string `json:"path_lower"` // empty if not mounted
+}
+
+// Folder is a folder in Dropbox treated as a collection.
+// Its ID is either a file ID ("id:...") for a folder in
+// the user's own space, or the ID of a shared folder.
+type Folder struct {
+	ID   string
+	Name string
+}
+
+// CollectionID returns the folder's ID.
+func (f Folder) CollectionID() string { return f.ID }
+
+// CollectionName returns the folder's name.
+func (f Folder) CollectionName() string { return f.Name }
+
+// folderPath returns the path to use when listing the
+// folder with the given collection ID.
+func folderPath(id string) string {
+	if strings.HasPrefix(id, "id:") {
+		return id
+	}
+	return "ns:" + id // a shared folder's namespace
+}
+
+// mediaExtensions is the set of file extensions
+// (lower-case, with dot) that are backed up.
+var mediaExtensions = map[string]struct{}{
+	".jpg": {}, ".jpeg": {}, ".png": {}, ".gif": {}, ".bmp": {},
+	".tif": {}, ".tiff": {}, ".heic": {}, ".heif": {}, ".webp": {},
+	".dng": {}, ".cr2": {}, ".nef": {}, ".arw": {}, ".orf": {},
+	".mp4": {}, ".mov": {}, ".m4v": {}, ".3gp": {}, ".avi": {},
+	".mkv": {}, ".mts": {}, ".wmv": {},
+}
+
+// isMedia returns true if m is a file that
+// looks like a photo or video.
+func isMedia(m Metadata) bool {
+	if m.Tag != "file" {
+		return false
+	}
+	_, ok := mediaExtensions[strings.ToLower(path.Ext(m.Name))]
+	return ok
+}
@@ -0,0 +1,85 @@
+package dropbox
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"hash"
+
+	"github.com/mholt/photobak"
+)
+
+// contentHashBlockSize is the size of the blocks
+// that the content hash of a file is made of.
+const contentHashBlockSize = 4 * 1024 * 1024
+
+// contentHash computes a Dropbox content hash: the SHA-256 of the
+// concatenated SHA-256 sums of each 4 MiB block of the content.
+// See https://www.dropbox.com/developers/reference/content-hash
+type contentHash struct {
+	overall  hash.Hash
+	block    hash.Hash
+	blockLen int
+}
+
+func newContentHash() *contentHash {
+	return &contentHash{overall: sha256.New(), block: sha256.New()}
+}
+
+func (ch *contentHash) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		chunk := p
+		if room := contentHashBlockSize - ch.blockLen; len(chunk) > room {
+			chunk = chunk[:room]
+		}
+		ch.block.Write(chunk)
+		ch.blockLen += len(chunk)
+		p = p[len(chunk):]
+		if ch.blockLen == contentHashBlockSize {
+			ch.overall.Write(ch.block.Sum(nil))
+			ch.block.Reset()
+			ch.blockLen = 0
+		}
+	}
+	return n, nil
+}
+
+// Sum appends the content hash of what was written
+// to b, without changing the state of the hash.
+func (ch *contentHash) Sum(b []byte) []byte {
+	overall := ch.overall
+	if ch.blockLen > 0 {
+		// the partial block is summed into a copy of
+		// the overall hash, so more can be written
+		state, _ := ch.overall.(encoding.BinaryMarshaler).MarshalBinary()
+		overall = sha256.New()
+		overall.(encoding.BinaryUnmarshaler).UnmarshalBinary(state)
+		overall.Write(ch.block.Sum(nil))
+	}
+	return overall.Sum(b)
+}
+
+func (ch *contentHash) Reset() {
+	ch.overall.Reset()
+	ch.block.Reset()
+	ch.blockLen = 0
+}
+
+func (ch *contentHash) Size() int { return sha256.Size }
+
+func (ch *contentHash) BlockSize() int { return sha256.BlockSize }
+
+// VerificationHash returns a content hash and the one Dropbox
+// has for item, so that downloads can be verified.
+func (c *Client) VerificationHash(item photobak.Item) (hash.Hash, []byte) {
+	dbxItem, ok := item.(Metadata)
+	if !ok || dbxItem.ContentHash == "" {
+		return nil, nil
+	}
+	sum, err := hex.DecodeString(dbxItem.ContentHash)
+	if err != nil || len(sum) != sha256.Size {
+		return nil, nil
+	}
+	return newContentHash(), sum
+}
@@ -0,0 +1,255 @@
+// Package dropbox implements Dropbox access for photobak using
+// the Dropbox API v2. The Camera Uploads folder and any shared
+// folders mounted in the account are treated as collections.
+package dropbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/mholt/photobak"
+)
+
+const (
+	name  = "dropbox"
+	title = "Dropbox"
+)
+
+const (
+	apiURL     = "https://api.dropboxapi.com/2/"
+	contentURL = "https://content.dropboxapi.com/2/"
+
+	cameraUploadsPath = "/camera uploads"
+)
+
+var sharedFolders = true
+
+// logger is the log of this provider.
+var logger = photobak.NewLogger(name)
+
+func init() {
+	var accounts photobak.StringFlagList
+	flag.Var(&accounts, name, "Add a "+title+" account to the repository")
+	flag.BoolVar(&sharedFolders, "dropboxshared", sharedFolders, "Whether to back up shared "+title+" folders in addition to Camera Uploads")
+
+	photobak.RegisterProvider(photobak.Provider{
+		Name:                name,
+		Title:               title,
+		Accounts:            func() []string { return accounts },
+		Credentials:         getToken,
+		NewRefreshingClient: newClient,
+
+		// the content hash is the most reliable indicator of change
+		ChangeStrategy: photobak.ChangeHash,
+	})
+
+	photobak.RegisterAPIType(Metadata{})
+	photobak.RegisterAPIType(Folder{})
+}
+
+// Client acts as a client to the Dropbox API v2.
+// It requires an OAuth2-authenticated http.Client
+// in order to function properly.
+type Client struct {
+	HTTPClient *http.Client
+}
+
+// Name returns "dropbox".
+func (c *Client) Name() string {
+	return name
+}
+
+// ListCollections lists the Camera Uploads folder, if
+// it exists, and all shared folders mounted in the account.
+func (c *Client) ListCollections(ctx context.Context) ([]photobak.Collection, error) {
+	var folders []photobak.Collection
+
+	var cu Metadata
+	err := c.rpc(ctx, "files/get_metadata", map[string]string{"path": cameraUploadsPath}, &cu)
+	if err != nil && !isNotFound(err) {
+		return nil, fmt.Errorf("getting Camera Uploads folder: %v", err)
+	}
+	if err == nil && cu.Tag == "folder" {
+		folders = append(folders, Folder{ID: cu.ID, Name: cu.Name})
+	}
+
+	if !sharedFolders {
+		return folders, nil
+	}
+
+	var page listSharedFoldersResult
+	err = c.rpc(ctx, "sharing/list_folders", map[string]int{"limit": 100}, &page)
+	for {
+		if err != nil {
+			return nil, fmt.Errorf("listing shared folders: %v", err)
+		}
+		for _, sf := range page.Entries {
+			if sf.PathLower == "" {
+				continue // not mounted in this account, so nothing to list
+			}
+			folders = append(folders, Folder{ID: sf.SharedFolderID, Name: sf.Name})
+		}
+		if page.Cursor == "" {
+			break
+		}
+		cursor := page.Cursor
+		page = listSharedFoldersResult{}
+		err = c.rpc(ctx, "sharing/list_folders/continue", map[string]string{"cursor": cursor}, &page)
+	}
+
+	return folders, nil
+}
+
+// ListCollectionItems lists all the photos and videos in the
+// folder given by col and sends them down itemChan.
+func (c *Client) ListCollectionItems(ctx context.Context, col photobak.Collection, itemChan chan photobak.Item) error {
+	defer close(itemChan)
+
+	// col may be wrapped by the repository, so
+	// only rely on its methods, not its type
+	var page listFolderResult
+	err := c.rpc(ctx, "files/list_folder", map[string]interface{}{
+		"path":      folderPath(col.CollectionID()),
+		"recursive": true,
+	}, &page)
+	for {
+		if err != nil {
+			return fmt.Errorf("listing folder '%s': %v", col.CollectionName(), err)
+		}
+		for _, entry := range page.Entries {
+			if !isMedia(entry) {
+				continue
+			}
+			select {
+			case itemChan <- entry:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if !page.HasMore {
+			break
+		}
+		cursor := page.Cursor
+		page = listFolderResult{}
+		err = c.rpc(ctx, "files/list_folder/continue", map[string]string{"cursor": cursor}, &page)
+	}
+
+	return nil
+}
+
+// DownloadItemInto downloads item into w.
+func (c *Client) DownloadItemInto(ctx context.Context, item photobak.Item, w io.Writer) error {
+	dbxItem, ok := item.(Metadata)
+	if !ok {
+		return fmt.Errorf("item is not a Dropbox file")
+	}
+
+	arg, err := json.Marshal(map[string]string{"path": dbxItem.ID})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", contentURL+"files/download", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Dropbox-API-Arg", string(arg))
+
+	resp, err := c.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("downloading %s: %v", dbxItem.PathDisplay, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return photobak.HTTPError{Op: "downloading " + dbxItem.PathDisplay, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	_, err = io.Copy(w, resp.Body)
+
+	return err
+}
+
+// ItemSize returns the size of item as reported in
+// its metadata; no request is necessary.
+func (c *Client) ItemSize(ctx context.Context, item photobak.Item) (int64, error) {
+	dbxItem, ok := item.(Metadata)
+	if !ok {
+		return 0, fmt.Errorf("item is not a Dropbox file")
+	}
+	return dbxItem.Size, nil
+}
+
+// apiError is an error returned by the Dropbox API.
+type apiError struct {
+	Status  int
+	Summary string `json:"error_summary"`
+}
+
+func (e apiError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.Status, e.Summary)
+}
+
+// HTTPStatusCode returns the HTTP status code so that
+// photobak can tell whether the request should be retried.
+func (e apiError) HTTPStatusCode() int {
+	return e.Status
+}
+
+// isNotFound returns true if err is an API error
+// indicating that the requested path does not exist.
+func isNotFound(err error) bool {
+	apiErr, ok := err.(apiError)
+	return ok && strings.Contains(apiErr.Summary, "not_found")
+}
+
+// rpc calls the RPC-style API endpoint with args encoded
+// as JSON and decodes the JSON response into result. The
+// call is retried according to photobak's retry policy.
+func (c *Client) rpc(ctx context.Context, endpoint string, args, result interface{}) error {
+	body, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	return photobak.Retries.Do(ctx, func(attempt int) error {
+		return c.post(ctx, endpoint, body, result)
+	})
+}
+
+// post makes a single request to the RPC-style API endpoint.
+func (c *Client) post(ctx context.Context, endpoint string, body []byte, result interface{}) error {
+	req, err := http.NewRequest("POST", apiURL+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr := apiError{Status: resp.StatusCode}
+		if jsonErr := json.Unmarshal(data, &apiErr); jsonErr != nil {
+			logger.Debugf("unexpected error body from %s: %s", endpoint, data)
+			apiErr.Summary = resp.Status
+		}
+		return apiErr
+	}
+
+	return json.Unmarshal(data, result)
+}
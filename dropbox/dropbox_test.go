@@ -0,0 +1,68 @@
+package dropbox
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+func TestIsMedia(t *testing.T) {
+	for i, test := range []struct {
+		input  Metadata
+		expect bool
+	}{
+		{input: Metadata{Tag: "file", Name: "IMG_0001.JPG"}, expect: true},
+		{input: Metadata{Tag: "file", Name: "2017-06-01 12.00.00.mov"}, expect: true},
+		{input: Metadata{Tag: "file", Name: "notes.txt"}, expect: false},
+		{input: Metadata{Tag: "file", Name: "noextension"}, expect: false},
+		{input: Metadata{Tag: "folder", Name: "vacation.jpg"}, expect: false},
+		{input: Metadata{Tag: "deleted", Name: "gone.png"}, expect: false},
+	} {
+		actual := isMedia(test.input)
+		if actual != test.expect {
+			t.Errorf("Test %d: Expected %t for %s '%s', got %t",
+				i, test.expect, test.input.Tag, test.input.Name, actual)
+		}
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	blockSum := func(b []byte) []byte {
+		s := sha256.Sum256(b)
+		return s[:]
+	}
+	oneBlock := bytes.Repeat([]byte{'a'}, contentHashBlockSize)
+
+	for i, test := range []struct {
+		blocks [][]byte
+	}{
+		{blocks: nil},
+		{blocks: [][]byte{[]byte("hello")}},
+		{blocks: [][]byte{oneBlock}},
+		{blocks: [][]byte{oneBlock, []byte("b")}},
+	} {
+		var content, sums []byte
+		for _, b := range test.blocks {
+			content = append(content, b...)
+			sums = append(sums, blockSum(b)...)
+		}
+		expect := blockSum(sums)
+
+		// write in odd-sized chunks to cross block boundaries
+		ch := newContentHash()
+		for len(content) > 0 {
+			n := 1000003
+			if n > len(content) {
+				n = len(content)
+			}
+			ch.Write(content[:n])
+			content = content[n:]
+		}
+		if actual := ch.Sum(nil); !bytes.Equal(actual, expect) {
+			t.Errorf("Test %d: Got %x, expected %x", i, actual, expect)
+		}
+		if actual := ch.Sum(nil); !bytes.Equal(actual, expect) {
+			t.Errorf("Test %d: Second sum was %x, expected %x", i, actual, expect)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package dropbox
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mholt/photobak"
+
+	"golang.org/x/oauth2"
+)
+
+func init() {
+	// Get OAuth2 credentials from https://www.dropbox.com/developers/apps
+	oauth2Config.ClientID = os.Getenv("DROPBOX_CLIENT_ID")
+	oauth2Config.ClientSecret = os.Getenv("DROPBOX_CLIENT_SECRET")
+}
+
+// getToken gets an OAuth2 token from the user.
+func getToken(username string) ([]byte, error) {
+	if oauth2Config.ClientID == "" || oauth2Config.ClientSecret == "" {
+		return nil, fmt.Errorf("missing client ID and/or secret env variables; create an app at www.dropbox.com/developers/apps")
+	}
+	return auth.GetToken(username)
+}
+
+// newClient returns an authenticated Client given the
+// token data. Whenever the token is refreshed, it is
+// passed to save.
+func newClient(tokenData []byte, save func([]byte) error) (photobak.Client, error) {
+	oauthClient, err := auth.NewClient(tokenData, save)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{HTTPClient: oauthClient}, nil
+}
+
+// Dropbox requires redirect URIs to be registered exactly,
+// so unlike Google Photos, the path here is fixed.
+var oauth2Config = &oauth2.Config{
+	RedirectURL: "http://localhost:5014/photobak-oauth",
+	Endpoint: oauth2.Endpoint{
+		AuthURL:  "https://www.dropbox.com/oauth2/authorize",
+		TokenURL: "https://api.dropboxapi.com/oauth2/token",
+	},
+}
+
+// auth gets and refreshes the tokens of accounts. Dropbox
+// only issues refresh tokens when offline access is asked for.
+var auth = photobak.OAuth2{
+	Config:      oauth2Config,
+	AuthOptions: []oauth2.AuthCodeOption{oauth2.SetAuthURLParam("token_access_type", "offline")},
+	Logger:      logger,
+}
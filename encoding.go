@@ -0,0 +1,345 @@
+package photobak
+
+import (
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// recordVersion is the version of the JSON encoding of items and
+// collections in the database. It is stored with each of them, so
+// that a future change to the encoding can tell old records apart.
+const recordVersion = 1
+
+// apiTypes are the types of API values registered with
+// RegisterAPIType, by name.
+var (
+	apiTypes   = make(map[string]reflect.Type)
+	apiTypesMu sync.RWMutex
+)
+
+// RegisterAPIType registers the type of value, which is one of a
+// provider's Item or Collection types, so that the full API values
+// of its items and collections can be stored in the database and
+// read back (see the saveEverything argument of Store). Providers
+// should call it from init for each such type. Values are stored
+// as JSON, so only their exported fields are kept.
+func RegisterAPIType(value interface{}) {
+	t := reflect.TypeOf(value)
+	apiTypesMu.Lock()
+	apiTypes[apiTypeName(t)] = t
+	apiTypesMu.Unlock()
+
+	// values encrypted by older versions are gob-encoded
+	gob.Register(value)
+}
+
+// apiTypeName returns the name under which values of type t
+// are stored, like "github.com/mholt/photobak/googlephotos.Entry".
+func apiTypeName(t reflect.Type) string {
+	if t.Kind() == reflect.Ptr {
+		return "*" + apiTypeName(t.Elem())
+	}
+	return t.PkgPath() + "." + t.Name()
+}
+
+// apiRecord is an API value as it is stored:
+// the name of its type, and its JSON encoding.
+type apiRecord struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+// encodeAPI returns the record of the API value v.
+func encodeAPI(v interface{}) (*apiRecord, error) {
+	t := reflect.TypeOf(v)
+	name := apiTypeName(t)
+	apiTypesMu.RLock()
+	_, ok := apiTypes[name]
+	apiTypesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("API type %s is not registered (see RegisterAPIType)", name)
+	}
+	value, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("encoding API value of type %s: %v", name, err)
+	}
+	return &apiRecord{Type: name, Value: value}, nil
+}
+
+// decodeAPI returns the API value of rec. If its type is not
+// registered, it returns nil and no error; the record is kept
+// by the caller so that the value isn't lost.
+func decodeAPI(rec *apiRecord) (interface{}, error) {
+	apiTypesMu.RLock()
+	t, ok := apiTypes[rec.Type]
+	apiTypesMu.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+	ptr := reflect.New(t)
+	err := json.Unmarshal(rec.Value, ptr.Interface())
+	if err != nil {
+		return nil, fmt.Errorf("decoding API value of type %s: %v", rec.Type, err)
+	}
+	return ptr.Elem().Interface(), nil
+}
+
+// itemRecord is a dbItem as it is stored in the database.
+type itemRecord struct {
+	Version        int            `json:"v"`
+	ID             string         `json:"id"`
+	Name           string         `json:"name"`
+	FileName       string         `json:"file_name"`
+	FilePath       string         `json:"file_path"`
+	Checksum       string         `json:"checksum,omitempty"` // hex
+	Size           int64          `json:"size,omitempty"`
+	RemoteSize     int64          `json:"remote_size,omitempty"`
+	ModTime        time.Time      `json:"mod_time"`
+	Format         string         `json:"format,omitempty"`
+	PHash          string         `json:"phash,omitempty"` // hex
+	ETag           string         `json:"etag,omitempty"`
+	ChangeKey      string         `json:"change_key,omitempty"`
+	ChangeStrategy string         `json:"change_strategy,omitempty"`
+	Saved          time.Time      `json:"saved"`
+	Collections    []string       `json:"collections"`
+	Meta           itemMetaRecord `json:"meta"`
+	Protection     Protection     `json:"protection,omitempty"`
+	LivePair       string         `json:"live_pair,omitempty"`
+	Trashed        time.Time      `json:"trashed"`
+}
+
+// itemMetaRecord is an itemMeta as it is stored.
+type itemMetaRecord struct {
+	Setting   *settingRecord `json:"setting,omitempty"`
+	Caption   string         `json:"caption,omitempty"`
+	Taken     time.Time      `json:"taken"`
+	Camera    string         `json:"camera,omitempty"`
+	Favorite  bool           `json:"favorite,omitempty"`
+	Duration  time.Duration  `json:"duration,omitempty"` // nanoseconds
+	Codec     string         `json:"codec,omitempty"`
+	Described bool           `json:"described,omitempty"`
+}
+
+// settingRecord is a setting as it is stored.
+type settingRecord struct {
+	Latitude    float64   `json:"latitude"`
+	Longitude   float64   `json:"longitude"`
+	Altitude    float64   `json:"altitude,omitempty"`
+	AltitudeRef string    `json:"altitude_ref,omitempty"`
+	OriginTime  time.Time `json:"origin_time"`
+}
+
+// collectionRecord is a dbCollection as it is stored.
+type collectionRecord struct {
+	Version    int                  `json:"v"`
+	ID         string               `json:"id"`
+	Name       string               `json:"name"`
+	DirName    string               `json:"dir_name"`
+	DirPath    string               `json:"dir_path"`
+	Saved      time.Time            `json:"saved"`
+	Meta       collectionMetaRecord `json:"meta"`
+	Items      []string             `json:"items"`
+	Order      []string             `json:"order,omitempty"`
+	Protection Protection           `json:"protection,omitempty"`
+	Active     time.Time            `json:"active"`
+	Completed  time.Time            `json:"completed"`
+}
+
+// collectionMetaRecord is a collectionMeta as it is stored.
+type collectionMetaRecord struct {
+	Description string `json:"description,omitempty"`
+	Cover       string `json:"cover,omitempty"`
+}
+
+// encodeItem encodes item for storing in the database. Its API
+// value is not included; it is stored separately (see putAPIMeta).
+func encodeItem(item *dbItem) ([]byte, error) {
+	rec := itemRecord{
+		Version:        recordVersion,
+		ID:             item.ID,
+		Name:           item.Name,
+		FileName:       item.FileName,
+		FilePath:       item.FilePath,
+		Checksum:       hex.EncodeToString(item.Checksum),
+		Size:           item.Size,
+		RemoteSize:     item.RemoteSize,
+		ModTime:        item.ModTime,
+		Format:         item.Format,
+		PHash:          hex.EncodeToString(item.PHash),
+		ETag:           item.ETag,
+		ChangeKey:      item.ChangeKey,
+		ChangeStrategy: item.ChangeStrategy,
+		Saved:          item.Saved,
+		Collections:    setToList(item.Collections),
+		Meta: itemMetaRecord{
+			Caption:   item.Meta.Caption,
+			Taken:     item.Meta.Taken,
+			Camera:    item.Meta.Camera,
+			Favorite:  item.Meta.Favorite,
+			Duration:  item.Meta.Duration,
+			Codec:     item.Meta.Codec,
+			Described: item.Meta.Described,
+		},
+		Protection: item.Protection,
+		LivePair:   item.LivePair,
+		Trashed:    item.Trashed,
+	}
+	if s := item.Meta.Setting; s != nil {
+		rec.Meta.Setting = &settingRecord{
+			Latitude:    s.Latitude,
+			Longitude:   s.Longitude,
+			Altitude:    s.Altitude,
+			AltitudeRef: s.AltitudeRef,
+			OriginTime:  s.OriginTime,
+		}
+	}
+	return json.Marshal(rec)
+}
+
+// decodeItem decodes an item encoded by encodeItem.
+// It returns nil if buf is nil.
+func decodeItem(buf []byte) (*dbItem, error) {
+	if buf == nil {
+		return nil, nil
+	}
+	var rec itemRecord
+	err := json.Unmarshal(buf, &rec)
+	if err != nil {
+		return nil, err
+	}
+	if rec.Version > recordVersion {
+		return nil, fmt.Errorf("item %s was stored by a newer version of photobak (record version %d)", rec.ID, rec.Version)
+	}
+	item := &dbItem{
+		ID:             rec.ID,
+		Name:           rec.Name,
+		FileName:       rec.FileName,
+		FilePath:       rec.FilePath,
+		Size:           rec.Size,
+		RemoteSize:     rec.RemoteSize,
+		ModTime:        rec.ModTime,
+		Format:         rec.Format,
+		ETag:           rec.ETag,
+		ChangeKey:      rec.ChangeKey,
+		ChangeStrategy: rec.ChangeStrategy,
+		Saved:          rec.Saved,
+		Collections:    listToSet(rec.Collections),
+		Meta: itemMeta{
+			Caption:   rec.Meta.Caption,
+			Taken:     rec.Meta.Taken,
+			Camera:    rec.Meta.Camera,
+			Favorite:  rec.Meta.Favorite,
+			Duration:  rec.Meta.Duration,
+			Codec:     rec.Meta.Codec,
+			Described: rec.Meta.Described,
+		},
+		Protection: rec.Protection,
+		LivePair:   rec.LivePair,
+		Trashed:    rec.Trashed,
+	}
+	if item.Checksum, err = decodeHex(rec.Checksum); err != nil {
+		return nil, fmt.Errorf("item %s: checksum: %v", rec.ID, err)
+	}
+	if item.PHash, err = decodeHex(rec.PHash); err != nil {
+		return nil, fmt.Errorf("item %s: perceptual hash: %v", rec.ID, err)
+	}
+	if s := rec.Meta.Setting; s != nil {
+		item.Meta.Setting = &setting{
+			Latitude:    s.Latitude,
+			Longitude:   s.Longitude,
+			Altitude:    s.Altitude,
+			AltitudeRef: s.AltitudeRef,
+			OriginTime:  s.OriginTime,
+		}
+	}
+	return item, nil
+}
+
+// encodeCollection encodes coll for storing in the database,
+// without its API value (see putAPIMeta).
+func encodeCollection(coll *dbCollection) ([]byte, error) {
+	rec := collectionRecord{
+		Version: recordVersion,
+		ID:      coll.ID,
+		Name:    coll.Name,
+		DirName: coll.DirName,
+		DirPath: coll.DirPath,
+		Saved:   coll.Saved,
+		Meta: collectionMetaRecord{
+			Description: coll.Meta.Description,
+			Cover:       coll.Meta.Cover,
+		},
+		Items:      setToList(coll.Items),
+		Order:      coll.Order,
+		Protection: coll.Protection,
+		Active:     coll.Active,
+		Completed:  coll.Completed,
+	}
+	return json.Marshal(rec)
+}
+
+// decodeCollection decodes a collection encoded by
+// encodeCollection. It returns nil if buf is nil.
+func decodeCollection(buf []byte) (*dbCollection, error) {
+	if buf == nil {
+		return nil, nil
+	}
+	var rec collectionRecord
+	err := json.Unmarshal(buf, &rec)
+	if err != nil {
+		return nil, err
+	}
+	if rec.Version > recordVersion {
+		return nil, fmt.Errorf("collection %s was stored by a newer version of photobak (record version %d)", rec.ID, rec.Version)
+	}
+	coll := &dbCollection{
+		ID:      rec.ID,
+		Name:    rec.Name,
+		DirName: rec.DirName,
+		DirPath: rec.DirPath,
+		Saved:   rec.Saved,
+		Meta: collectionMeta{
+			Description: rec.Meta.Description,
+			Cover:       rec.Meta.Cover,
+		},
+		Items:      listToSet(rec.Items),
+		Order:      rec.Order,
+		Protection: rec.Protection,
+		Active:     rec.Active,
+		Completed:  rec.Completed,
+	}
+	return coll, nil
+}
+
+// setToList returns the keys of set, sorted.
+func setToList(set map[string]struct{}) []string {
+	list := make([]string, 0, len(set))
+	for k := range set {
+		list = append(list, k)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// listToSet returns the items of list as a set.
+func listToSet(list []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(list))
+	for _, k := range list {
+		set[k] = struct{}{}
+	}
+	return set
+}
+
+// decodeHex decodes s, returning nil if it is empty.
+func decodeHex(s string) ([]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+	return hex.DecodeString(s)
+}
@@ -0,0 +1,302 @@
+// Package exec implements a generic photobak provider that
+// shells out to an external program speaking a simple
+// JSON-over-stdio protocol. This makes it possible to back
+// up services that photobak does not support natively
+// without writing any Go.
+package exec
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	osexec "os/exec"
+	"strings"
+
+	"github.com/mholt/photobak"
+)
+
+const (
+	name  = "exec"
+	title = "External Program"
+)
+
+// commands maps account names to the
+// command that provides the account.
+var commands = make(map[string][]string)
+
+// logger is the log of this provider.
+var logger = photobak.NewLogger(name)
+
+// accountFlag collects -exec flags of
+// the form "account=command args...".
+type accountFlag struct{}
+
+func (accountFlag) String() string { return "" }
+
+func (accountFlag) Set(value string) error {
+	acct, cmd, err := parseAccount(value)
+	if err != nil {
+		return err
+	}
+	commands[acct] = cmd
+	return nil
+}
+
+func init() {
+	flag.Var(accountFlag{}, name, "Add an account backed by an external program, as account=command")
+
+	photobak.RegisterProvider(photobak.Provider{
+		Name:        name,
+		Title:       title,
+		Accounts:    accounts,
+		Credentials: func(account string) ([]byte, error) { return []byte(account), nil },
+		NewClient:   newClient,
+	})
+
+	photobak.RegisterAPIType(Item{})
+	photobak.RegisterAPIType(Collection{})
+}
+
+// parseAccount splits an "account=command args..." value
+// into the account name and the command line.
+func parseAccount(value string) (string, []string, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return "", nil, fmt.Errorf("must be in the form account=command")
+	}
+	acct := strings.ToLower(strings.TrimSpace(parts[0]))
+	cmd, err := photobak.SplitCommand(parts[1])
+	if err != nil {
+		return "", nil, err
+	}
+	if acct == "" || len(cmd) == 0 || cmd[0] == "" {
+		return "", nil, fmt.Errorf("account name and command are required")
+	}
+	return acct, cmd, nil
+}
+
+func accounts() []string {
+	var list []string
+	for acct := range commands {
+		list = append(list, acct)
+	}
+	return list
+}
+
+// newClient returns a client for the account whose
+// name is given as the credentials. The command itself
+// is not stored, so it can be changed between runs.
+func newClient(creds []byte) (photobak.Client, error) {
+	acct := string(creds)
+	cmd, ok := commands[acct]
+	if !ok {
+		return nil, fmt.Errorf("no command configured for account '%s'", acct)
+	}
+	return &Client{Account: acct, Command: cmd}, nil
+}
+
+// Client runs an external program to access a service.
+type Client struct {
+	Account string   // the name of the account
+	Command []string // the program and its arguments
+}
+
+// Name returns "exec".
+func (c *Client) Name() string {
+	return name
+}
+
+// ListCollections runs the program to list collections.
+func (c *Client) ListCollections(ctx context.Context) ([]photobak.Collection, error) {
+	var colls []photobak.Collection
+	err := c.run(ctx, verbListCollections, nil, func(dec *json.Decoder) error {
+		for dec.More() {
+			var coll Collection
+			if err := dec.Decode(&coll); err != nil {
+				return err
+			}
+			colls = append(colls, coll)
+		}
+		return nil
+	})
+	return colls, err
+}
+
+// ListCollectionItems runs the program to list the items in
+// col and sends each one down itemChan.
+func (c *Client) ListCollectionItems(ctx context.Context, col photobak.Collection, itemChan chan photobak.Item) error {
+	defer close(itemChan)
+	coll := Collection{ID: col.CollectionID(), Name: col.CollectionName()}
+	return c.run(ctx, verbListItems, coll, func(dec *json.Decoder) error {
+		for dec.More() {
+			var it Item
+			if err := dec.Decode(&it); err != nil {
+				return err
+			}
+			select {
+			case itemChan <- it:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+}
+
+// ListTrash runs the program to list the items in the
+// trash and sends each one down itemChan. Programs that
+// say they don't support it (see exitUnsupported) are
+// assumed to have no trash; other failures are errors,
+// so that items in the trash aren't pruned.
+func (c *Client) ListTrash(ctx context.Context, itemChan chan photobak.Item) error {
+	defer close(itemChan)
+	err := c.run(ctx, verbListTrash, nil, func(dec *json.Decoder) error {
+		for dec.More() {
+			var it Item
+			if err := dec.Decode(&it); err != nil {
+				return err
+			}
+			select {
+			case itemChan <- it:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+	if _, ok := err.(unsupportedError); ok && ctx.Err() == nil {
+		logger.Infof("%s: not using trash: %v", c.Account, err)
+		return nil
+	}
+	return err
+}
+
+// DownloadItemInto runs the program to download item into w.
+func (c *Client) DownloadItemInto(ctx context.Context, item photobak.Item, w io.Writer) error {
+	it, ok := item.(Item)
+	if !ok {
+		return fmt.Errorf("item is not an exec item")
+	}
+	cmd, err := c.command(ctx, verbDownload, it)
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = w
+	return c.wrapErr(verbDownload, cmd.Run())
+}
+
+// VerificationHash returns a SHA-256 hash and the sum the
+// program gave for item, if any, so that downloads can be
+// verified.
+func (c *Client) VerificationHash(item photobak.Item) (hash.Hash, []byte) {
+	it, ok := item.(Item)
+	if !ok || it.SHA256 == "" {
+		return nil, nil
+	}
+	sum, err := hex.DecodeString(it.SHA256)
+	if err != nil || len(sum) != sha256.Size {
+		logger.Errorf("item %s: bad sha256 '%s'; not verifying its download", it.ID, it.SHA256)
+		return nil, nil
+	}
+	return sha256.New(), sum
+}
+
+// run runs the program with verb, writing input (if not nil)
+// as JSON to its stdin and passing a decoder for its stdout
+// to handle. The program is killed if ctx is canceled.
+func (c *Client) run(ctx context.Context, verb string, input interface{}, handle func(*json.Decoder) error) error {
+	cmd, err := c.command(ctx, verb, input)
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("%s: starting %s: %v", c.Account, verb, err)
+	}
+	handleErr := handle(json.NewDecoder(stdout))
+	if handleErr != nil {
+		// drain the output so the program can finish
+		io.Copy(ioutil.Discard, stdout)
+	}
+	err = c.wrapErr(verb, cmd.Wait())
+	if err != nil {
+		return err
+	}
+	if handleErr != nil {
+		return fmt.Errorf("%s: reading output of %s: %v", c.Account, verb, handleErr)
+	}
+	return nil
+}
+
+// command prepares the program to be run with verb; it
+// will be killed if ctx is canceled while it is running.
+func (c *Client) command(ctx context.Context, verb string, input interface{}) (*osexec.Cmd, error) {
+	args := append(append([]string{}, c.Command[1:]...), verb)
+	cmd := osexec.CommandContext(ctx, c.Command[0], args...)
+	cmd.Env = append(os.Environ(), "PHOTOBAK_ACCOUNT="+c.Account)
+	cmd.Stderr = &logWriter{prefix: fmt.Sprintf("%s %s: ", c.Account, verb)}
+	if input != nil {
+		in, err := json.Marshal(input)
+		if err != nil {
+			return nil, err
+		}
+		cmd.Stdin = bytes.NewReader(in)
+	}
+	return cmd, nil
+}
+
+// wrapErr reports err, the result of running the program,
+// in a way that identifies the account and verb. If the
+// program exited with exitUnsupported, the error is an
+// unsupportedError.
+func (c *Client) wrapErr(verb string, err error) error {
+	if ee, ok := err.(*osexec.ExitError); ok && ee.ExitCode() == exitUnsupported {
+		return unsupportedError{account: c.Account, verb: verb}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s: %v", c.Account, verb, err)
+	}
+	return nil
+}
+
+// unsupportedError is returned when the program
+// says that it doesn't support a verb.
+type unsupportedError struct {
+	account, verb string
+}
+
+func (e unsupportedError) Error() string {
+	return fmt.Sprintf("%s: the program does not support %s", e.account, e.verb)
+}
+
+// logWriter writes each line it receives
+// to the log as a warning, with a prefix.
+type logWriter struct {
+	prefix string
+	buf    []byte
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		logger.Warnf("%s%s", w.prefix, w.buf[:i])
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
@@ -0,0 +1,108 @@
+package exec
+
+import (
+	"context"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/mholt/photobak"
+)
+
+func TestParseAccount(t *testing.T) {
+	for i, test := range []struct {
+		input      string
+		expectAcct string
+		expectCmd  []string
+		shouldErr  bool
+	}{
+		{input: "flickr=/usr/local/bin/flickr-backup", expectAcct: "flickr", expectCmd: []string{"/usr/local/bin/flickr-backup"}},
+		{input: "Me=python3 smugmug.py --user me", expectAcct: "me", expectCmd: []string{"python3", "smugmug.py", "--user", "me"}},
+		{input: "a=b=c", expectAcct: "a", expectCmd: []string{"b=c"}},
+		{input: `pc="C:\Program Files\Backup\backup.exe" --all`, expectAcct: "pc", expectCmd: []string{`C:\Program Files\Backup\backup.exe`, "--all"}},
+		{input: `me='/home/me/My Scripts/sync.sh' --name "my album" ''`, expectAcct: "me", expectCmd: []string{"/home/me/My Scripts/sync.sh", "--name", "my album", ""}},
+		{input: `me=say "it's"`, expectAcct: "me", expectCmd: []string{"say", "it's"}},
+		{input: `me=a"b c"d`, expectAcct: "me", expectCmd: []string{"ab cd"}},
+		{input: `me="unterminated`, shouldErr: true},
+		{input: `me=""`, shouldErr: true},
+		{input: "nocommand", shouldErr: true},
+		{input: "=cmd", shouldErr: true},
+		{input: "acct=  ", shouldErr: true},
+	} {
+		acct, cmd, err := parseAccount(test.input)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error, didn't get one", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Did not expect an error, got '%v'", i, err)
+		}
+		if acct != test.expectAcct {
+			t.Errorf("Test %d: Expected account '%s', got '%s'", i, test.expectAcct, acct)
+		}
+		if !reflect.DeepEqual(cmd, test.expectCmd) {
+			t.Errorf("Test %d: Expected command %v, got %v", i, test.expectCmd, cmd)
+		}
+	}
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	for i, test := range []struct {
+		input, expect string
+	}{
+		{"photo.jpg", "photo.jpg"},
+		{"../../etc/passwd", "passwd"},
+		{"a/b/c.png", "c.png"},
+		{"..", "_"},
+		{"", "_"},
+		{"what?.jpg", "what.jpg"},
+	} {
+		if actual := sanitizeFilename(test.input); actual != test.expect {
+			t.Errorf("Test %d: Expected '%s', got '%s'", i, test.expect, actual)
+		}
+	}
+}
+
+func TestListTrash(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+	for i, test := range []struct {
+		script    string
+		expect    int
+		shouldErr bool
+	}{
+		{script: `echo '{"id":"1","name":"a.jpg"}'; echo '{"id":"2","name":"b.jpg"}'`, expect: 2},
+		{script: "exit 3"},
+		{script: "exit 1", shouldErr: true},
+		{script: "kill -9 $$", shouldErr: true},
+		{script: "echo 'not json'", shouldErr: true},
+	} {
+		c := &Client{Account: "test", Command: []string{"sh", "-c", test.script}}
+		itemChan := make(chan photobak.Item)
+		var count int
+		done := make(chan struct{})
+		go func() {
+			for range itemChan {
+				count++
+			}
+			close(done)
+		}()
+		err := c.ListTrash(context.Background(), itemChan)
+		<-done
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error, didn't get one", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Did not expect an error, got '%v'", i, err)
+		}
+		if count != test.expect {
+			t.Errorf("Test %d: Expected %d items, got %d", i, test.expect, count)
+		}
+	}
+}
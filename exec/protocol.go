@@ -0,0 +1,108 @@
+package exec
+
+import (
+	"path/filepath"
+
+	"github.com/mholt/photobak"
+)
+
+// The exec protocol is deliberately simple so that providers
+// can be written in any language. The configured command is
+// run with one of the following verbs as its last argument:
+//
+//	list-collections  Write one JSON Collection per line to stdout.
+//	list-items        Read a JSON Collection from stdin, then write
+//	                  one JSON Item per line to stdout.
+//	download          Read a JSON Item from stdin, then write the
+//	                  raw content of the item to stdout.
+//	list-trash        Write one JSON Item per line to stdout for
+//	                  each item in the service's trash (optional).
+//
+// The name of the account is given in the PHOTOBAK_ACCOUNT
+// environment variable. Anything written to stderr is logged.
+// A non-zero exit status indicates failure, except for
+// exitUnsupported, which says that the program doesn't
+// support an optional verb.
+const (
+	verbListCollections = "list-collections"
+	verbListItems       = "list-items"
+	verbDownload        = "download"
+	verbListTrash       = "list-trash"
+)
+
+// exitUnsupported is the exit status of a program
+// that doesn't support the verb it was run with.
+const exitUnsupported = 3
+
+// Collection is a collection as described by the external program.
+// Cover is the ID of the item shown as the collection's cover.
+type Collection struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Cover       string `json:"cover,omitempty"`
+}
+
+// CollectionID returns the collection's ID.
+func (c Collection) CollectionID() string { return c.ID }
+
+// CollectionName returns the collection's name.
+func (c Collection) CollectionName() string { return sanitizeFilename(c.Name) }
+
+// CollectionDescription returns the collection's description.
+func (c Collection) CollectionDescription() string { return c.Description }
+
+// CollectionCoverID returns the ID of the collection's cover item.
+func (c Collection) CollectionCoverID() string { return c.Cover }
+
+// Item is an item as described by the external program. If SHA256
+// (in hex) is set, downloads of the item are checked against it.
+// Size, if set, is the size of its content in bytes. Extra can
+// hold anything else the program needs to download the item; it
+// is passed back verbatim.
+type Item struct {
+	ID       string            `json:"id"`
+	Name     string            `json:"name"`
+	ETag     string            `json:"etag,omitempty"`
+	Caption  string            `json:"caption,omitempty"`
+	Camera   string            `json:"camera,omitempty"`
+	Favorite bool              `json:"favorite,omitempty"`
+	SHA256   string            `json:"sha256,omitempty"`
+	Size     int64             `json:"size,omitempty"`
+	Extra    map[string]string `json:"extra,omitempty"`
+}
+
+// ItemID returns the item's ID.
+func (it Item) ItemID() string { return it.ID }
+
+// ItemName returns the item's file name.
+func (it Item) ItemName() string { return sanitizeFilename(it.Name) }
+
+// ItemETag returns the item's ETag.
+func (it Item) ItemETag() string { return it.ETag }
+
+// ItemCaption returns the item's caption.
+func (it Item) ItemCaption() string { return it.Caption }
+
+// ItemCamera returns the make and model of the camera.
+func (it Item) ItemCamera() string { return it.Camera }
+
+// ItemFavorite returns whether the item is a favorite.
+func (it Item) ItemFavorite() bool { return it.Favorite }
+
+// ListedSize returns the size of the item's content
+// in bytes, if the program gave it, or else -1.
+func (it Item) ListedSize() int64 {
+	if it.Size <= 0 {
+		return -1
+	}
+	return it.Size
+}
+
+// sanitizeFilename makes sure that name, which comes from
+// an external program, is a plain file name: if it is a
+// path, only its last element is kept, which is then made
+// safe like any other (see photobak.SafeFilename).
+func sanitizeFilename(name string) string {
+	return photobak.SafeFilename(filepath.Base(filepath.Clean("/" + name)))
+}
@@ -0,0 +1,289 @@
+package photobak
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Archive formats for Export.
+const (
+	ArchiveZip   = "zip"
+	ArchiveTar   = "tar"
+	ArchiveTarGz = "tar.gz"
+)
+
+// ExportOptions configures an export.
+type ExportOptions struct {
+	// Format is the archive format: ArchiveZip,
+	// ArchiveTar, or ArchiveTarGz.
+	Format string
+
+	// Accounts, if set, limits the export to the collections
+	// of these accounts, given as "provider:username".
+	Accounts []string
+
+	// Albums are patterns (as in path.Match, but not case-
+	// sensitive) that select the collections to export by
+	// name. If empty, all collections are exported.
+	Albums []string
+
+	// Sidecars adds a JSON file with each item's metadata
+	// next to it in the archive, named after the item's file
+	// with ".json" added.
+	Sidecars bool
+
+	// Bag, if set, makes the archive a BagIt bag (RFC 8493)
+	// for deposit in archival storage, with a top folder of
+	// this name. The collections are its payload, and there
+	// are always metadata files next to the items.
+	Bag string
+}
+
+// sidecar is the metadata of an exported item.
+type sidecar struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Account    string     `json:"account"`
+	Collection string     `json:"collection"`
+	Caption    string     `json:"caption,omitempty"`
+	Taken      *time.Time `json:"taken,omitempty"`
+	Latitude   float64    `json:"latitude,omitempty"`
+	Longitude  float64    `json:"longitude,omitempty"`
+	Altitude   float64    `json:"altitude,omitempty"`
+	LivePhoto  string     `json:"live_photo,omitempty"` // the other half (the still or the video) of its live photo
+	Saved      time.Time  `json:"saved"`
+}
+
+// archiveWriter writes files to an archive.
+type archiveWriter interface {
+	// add adds a file called name to the archive
+	// with the contents of r, which has the given
+	// size and modification time.
+	add(name string, size int64, modTime time.Time, r io.Reader) error
+	Close() error
+}
+
+type zipArchive struct{ *zip.Writer }
+
+func (z zipArchive) add(name string, size int64, modTime time.Time, r io.Reader) error {
+	// photos and videos are already compressed,
+	// so they are stored as they are
+	hdr := &zip.FileHeader{Name: name, Method: zip.Store}
+	hdr.SetModTime(modTime)
+	w, err := z.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+type tarArchive struct {
+	*tar.Writer
+	gz *gzip.Writer // nil unless compressed
+}
+
+func (t tarArchive) add(name string, size int64, modTime time.Time, r io.Reader) error {
+	err := t.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0600,
+		Size:     size,
+		ModTime:  modTime,
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(t.Writer, r)
+	return err
+}
+
+func (t tarArchive) Close() error {
+	err := t.Writer.Close()
+	if t.gz != nil {
+		if gzErr := t.gz.Close(); err == nil {
+			err = gzErr
+		}
+	}
+	return err
+}
+
+// Export writes the collections selected by opts, with real
+// copies of all their items, as an archive to w. Each collection
+// becomes a folder in the archive. Items that the repository
+// stores only once for several collections are included in each
+// of them. The repository is not modified. It returns the number
+// of items exported.
+func (r *Repository) Export(w io.Writer, opts ExportOptions) (int, error) {
+	for _, pattern := range opts.Albums {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return 0, fmt.Errorf("bad album pattern '%s': %v", pattern, err)
+		}
+	}
+
+	var archive archiveWriter
+	switch opts.Format {
+	case ArchiveZip:
+		archive = zipArchive{zip.NewWriter(w)}
+	case ArchiveTar:
+		archive = tarArchive{Writer: tar.NewWriter(w)}
+	case ArchiveTarGz:
+		gz := gzip.NewWriter(w)
+		archive = tarArchive{Writer: tar.NewWriter(gz), gz: gz}
+	default:
+		return 0, fmt.Errorf("unknown archive format '%s'", opts.Format)
+	}
+
+	if opts.Bag != "" {
+		if strings.ContainsAny(opts.Bag, `/\`) || opts.Bag == "." || opts.Bag == ".." {
+			return 0, fmt.Errorf("bad bag name '%s'", opts.Bag)
+		}
+		archive = newBagArchive(archive, opts.Bag)
+		opts.Sidecars = true
+	}
+
+	n, err := r.exportCollections(archive, opts)
+	if closeErr := archive.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+// exportCollections adds the collections selected by opts to archive.
+func (r *Repository) exportCollections(archive archiveWriter, opts ExportOptions) (int, error) {
+	accounts, err := r.db.storedAccounts()
+	if err != nil {
+		return 0, fmt.Errorf("listing accounts: %v", err)
+	}
+
+	var exported int
+	takenDirs := make(map[string]struct{})
+	for _, pa := range accounts {
+		if !accountSelected(opts.Accounts, pa) {
+			continue
+		}
+		collIDs, err := r.db.collectionIDs(pa)
+		if err != nil {
+			return exported, err
+		}
+		sort.Strings(collIDs)
+		for _, collID := range collIDs {
+			dbc, err := r.db.loadCollection(pa.key(), collID)
+			if err != nil {
+				return exported, err
+			}
+			if dbc == nil || !albumSelected(opts.Albums, dbc.Name) {
+				continue
+			}
+			dir := uniqueName(takenDirs, dbc.DirName)
+			n, err := r.exportCollection(archive, pa, dbc, dir, opts.Sidecars)
+			exported += n
+			if err != nil {
+				return exported, fmt.Errorf("exporting collection %s: %v", dbc.Name, err)
+			}
+		}
+	}
+
+	return exported, nil
+}
+
+// accountSelected returns true if pa is one of
+// accounts, or if there are no accounts.
+func accountSelected(accounts []string, pa providerAccount) bool {
+	if len(accounts) == 0 {
+		return true
+	}
+	for _, acct := range accounts {
+		if strings.EqualFold(acct, pa.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+// albumSelected returns true if name matches any of
+// the patterns, or if there are no patterns.
+func albumSelected(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// exportCollection adds the items in dbc to archive in dir.
+func (r *Repository) exportCollection(archive archiveWriter, pa providerAccount, dbc *dbCollection, dir string, sidecars bool) (int, error) {
+	repoLog.Infof("Exporting collection '%s'", dbc.Name)
+
+	items, names, err := r.collectionFileNames(pa, dbc)
+	if err != nil {
+		return 0, err
+	}
+
+	var exported int
+	for _, dbi := range items {
+		name := names[dbi.ID]
+		err = r.exportFile(archive, path.Join(dir, name), dbi.FilePath)
+		if err != nil {
+			return exported, fmt.Errorf("exporting %s: %v", dbi.FilePath, err)
+		}
+		exported++
+
+		if sidecars {
+			meta := sidecar{
+				ID:         dbi.ID,
+				Name:       dbi.Name,
+				Account:    pa.String(),
+				Collection: dbc.Name,
+				Caption:    dbi.Meta.Caption,
+				LivePhoto:  names[dbi.LivePair],
+				Saved:      dbi.Saved,
+			}
+			if s := dbi.Meta.Setting; s != nil {
+				if !s.OriginTime.IsZero() {
+					meta.Taken = &s.OriginTime
+				}
+				meta.Latitude, meta.Longitude, meta.Altitude = s.Latitude, s.Longitude, s.Altitude
+			}
+			data, err := json.MarshalIndent(meta, "", "\t")
+			if err != nil {
+				return exported, err
+			}
+			err = archive.add(path.Join(dir, name+".json"), int64(len(data)), dbi.Saved, bytes.NewReader(data))
+			if err != nil {
+				return exported, err
+			}
+		}
+	}
+
+	return exported, nil
+}
+
+// exportFile adds the file at the repo-relative
+// path fpath to archive as name.
+func (r *Repository) exportFile(archive archiveWriter, name, fpath string) error {
+	f, err := os.Open(r.fullPath(fpath))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return archive.add(name, info.Size(), info.ModTime(), f)
+}
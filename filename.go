@@ -0,0 +1,149 @@
+package photobak
+
+import (
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxNameBytes is the most bytes SafeFilename leaves in a name.
+// Most file systems allow 255, but photobak adds to some names,
+// like a number to make them unique or an extension for files
+// that are being downloaded or sidecars.
+const maxNameBytes = 200
+
+// maxPathLen is the longest full path, in UTF-16 code units,
+// that reserveUniqueFilename gives a file or folder: Windows'
+// MAX_PATH of 260, less the terminating NUL. Repositories are
+// kept within it on every system, so they can be copied to,
+// or restored on, Windows.
+const maxPathLen = 259
+
+// The room that fitName leaves at the end of a path within
+// maxPathLen: after a file, for the number that makes its name
+// unique and the extensions of partial downloads and sidecars,
+// and after a folder, for the names of the files in it.
+const (
+	fileRoom = 16
+	dirRoom  = 64
+)
+
+// minStemLen is how many characters of a name, before its
+// extension, fitName leaves at least, however deep its folder.
+const minStemLen = 8
+
+// windowsReserved are the names that can't be used for files
+// on Windows, with or without an extension, in any case.
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+	"COM¹": true, "COM²": true, "COM³": true,
+	"LPT¹": true, "LPT²": true, "LPT³": true,
+	"CONIN$": true, "CONOUT$": true,
+}
+
+// SafeFilename returns name, which is the name of a file or
+// folder as a provider gives it, made safe to use on Windows,
+// macOS, and Linux alike: it is normalized to Unicode NFC (macOS
+// file systems don't tell the forms apart, but others do, so the
+// same name could otherwise be saved twice), path separators,
+// control characters, and characters that Windows doesn't allow
+// are removed, trailing dots and spaces are trimmed, names that
+// Windows reserves for devices (like CON, NUL.txt, or CON .txt,
+// since Windows ignores the spaces) get an underscore, and long
+// names are shortened, keeping their extension. A name with
+// nothing left becomes "_". Store makes all names safe, so
+// providers don't have to.
+func SafeFilename(name string) string {
+	name = norm.NFC.String(name)
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimRight(strings.TrimSpace(name), ". ")
+
+	first, rest := name, ""
+	if i := strings.Index(name, "."); i >= 0 {
+		first, rest = name[:i], name[i:]
+	}
+	first = strings.TrimRight(first, " ")
+	if windowsReserved[strings.ToUpper(first)] {
+		name = first + "_" + rest
+	}
+
+	ext := filepath.Ext(name)
+	if len(ext) > 16 || ext == name {
+		ext = "" // not really an extension
+	}
+	stem := strings.TrimSuffix(name, ext)
+	if len(stem)+len(ext) > maxNameBytes {
+		n := maxNameBytes - len(ext)
+		for n > 0 && !utf8.RuneStart(stem[n]) {
+			n--
+		}
+		stem = strings.TrimRight(stem[:n], ". ")
+	}
+	name = stem + ext
+
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+	return name
+}
+
+// fitName returns name, which is safe (see SafeFilename),
+// shortened if need be so that the absolute path of dir joined
+// with name is no longer than maxPathLen, less fileRoom or, if
+// isDir, dirRoom. The extension of a file is kept, and no name
+// is shortened to fewer than minStemLen characters before it,
+// so a name in a folder that is already too deep may still be
+// too long.
+func fitName(dir, name string, isDir bool) string {
+	limit := maxPathLen - fileRoom
+	ext := filepath.Ext(name)
+	if isDir {
+		limit = maxPathLen - dirRoom
+		ext = ""
+	} else if len(ext) > 16 || ext == name {
+		ext = ""
+	}
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	over := pathLen(filepath.Join(dir, name)) - limit
+	if over <= 0 {
+		return name
+	}
+	stem := []rune(strings.TrimSuffix(name, ext))
+	for over > 0 && len(stem) > minStemLen {
+		over -= len(utf16.Encode(stem[len(stem)-1:]))
+		stem = stem[:len(stem)-1]
+	}
+	short := strings.TrimRight(string(stem), ". ")
+	if short == "" {
+		return name
+	}
+	return short + ext
+}
+
+// pathLen returns the length of fpath in UTF-16
+// code units, which is how Windows counts it.
+func pathLen(fpath string) int {
+	return len(utf16.Encode([]rune(fpath)))
+}
+
+// nameKey returns the key by which reservations of the path
+// fpath are told apart; paths that differ only in case are the
+// same file on Windows and macOS, so they share a key.
+func nameKey(fpath string) string {
+	return strings.ToLower(fpath)
+}
@@ -0,0 +1,106 @@
+package photobak
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSafeFilename(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	longUnicode := strings.Repeat("é", 150) // 300 bytes
+	for i, test := range []struct {
+		input, expect string
+	}{
+		{"photo.jpg", "photo.jpg"},
+		{"", "_"},
+		{".", "_"},
+		{"..", "_"},
+		{"...", "_"},
+		{"  ", "_"},
+		{"a/b\\c.jpg", "abc.jpg"},
+		{`what?*:"<>|.jpg`, "what.jpg"},
+		{"tab\there\x00.png", "tabhere.png"},
+		{"trailing. . ", "trailing"},
+		{"  padded.jpg  ", "padded.jpg"},
+		{"CON", "CON_"},
+		{"con", "con_"},
+		{"NUL.txt", "NUL_.txt"},
+		{"nul.tar.gz", "nul_.tar.gz"},
+		{"COM1.jpg", "COM1_.jpg"},
+		{"LPT9", "LPT9_"},
+		{"COM¹.jpg", "COM¹_.jpg"},
+		{"CONIN$", "CONIN$_"},
+		{"conout$.log", "conout$_.log"},
+		{"CON .txt", "CON_.txt"},
+		{"AUX  .jpg", "AUX_.jpg"},
+		{"CONSOLE.jpg", "CONSOLE.jpg"},
+		{"COM10.jpg", "COM10.jpg"},
+		{"café.jpg", "café.jpg"},
+		{"café.jpg", "café.jpg"}, // NFD becomes NFC
+		{long + ".jpg", long[:maxNameBytes-4] + ".jpg"},
+		{long, long[:maxNameBytes]},
+		{long + ".notreallyanextension", (long + ".notreallyanextension")[:maxNameBytes]},
+		{longUnicode + ".jpg", strings.Repeat("é", (maxNameBytes-4)/2) + ".jpg"},
+		{"é" + longUnicode + ".jpg", "é" + strings.Repeat("é", (maxNameBytes-4)/2-1) + ".jpg"},
+	} {
+		if actual := SafeFilename(test.input); actual != test.expect {
+			t.Errorf("Test %d: SafeFilename(%q): Expected %q, got %q", i, test.input, test.expect, actual)
+		}
+	}
+}
+
+func TestFitName(t *testing.T) {
+	root, err := filepath.Abs(string(filepath.Separator) + "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(root, strings.Repeat("d", 150))
+	dirLen := pathLen(dir) + 1 // with the separator
+	deep := filepath.Join(dir, strings.Repeat("e", 200))
+	for i, test := range []struct {
+		dir, name string
+		isDir     bool
+		expect    string
+	}{
+		{dir: dir, name: "photo.jpg", expect: "photo.jpg"},
+		{dir: dir, name: "album", isDir: true, expect: "album"},
+		{
+			dir:    dir,
+			name:   strings.Repeat("a", 150) + ".jpg",
+			expect: strings.Repeat("a", maxPathLen-fileRoom-dirLen-4) + ".jpg",
+		},
+		{
+			dir:    dir,
+			name:   strings.Repeat("a", 150),
+			isDir:  true,
+			expect: strings.Repeat("a", maxPathLen-dirRoom-dirLen),
+		},
+		{
+			// emoji take two UTF-16 units each
+			dir:    dir,
+			name:   strings.Repeat("😀", 100) + ".jpg",
+			expect: strings.Repeat("😀", (maxPathLen-fileRoom-dirLen-4)/2) + ".jpg",
+		},
+		{
+			dir:    dir,
+			name:   strings.Repeat("a", 80) + "... " + strings.Repeat("b", 40) + ".jpg",
+			expect: strings.Repeat("a", 80) + ".jpg",
+		},
+		{
+			dir:    deep,
+			name:   strings.Repeat("a", 20) + ".jpg",
+			expect: strings.Repeat("a", minStemLen) + ".jpg",
+		},
+		{
+			dir:    deep,
+			name:   "short.jpg",
+			expect: "short.jpg",
+		},
+	} {
+		actual := fitName(test.dir, test.name, test.isDir)
+		if actual != test.expect {
+			t.Errorf("Test %d: Expected %q, got %q", i, test.expect, actual)
+		}
+	}
+}
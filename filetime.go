@@ -0,0 +1,30 @@
+package photobak
+
+import (
+	"os"
+	"time"
+)
+
+// takenTime returns when the item of dbi was taken, or, if
+// that isn't known, the time its provider gives for it (see
+// ItemTimer); it is zero if neither is known.
+func takenTime(dbi *dbItem, it Item) time.Time {
+	if taken := itemTaken(dbi); !taken.IsZero() {
+		return taken
+	}
+	return itemTime(it)
+}
+
+// setFileTimes sets the modification time of the file at
+// fpath to t, and its creation time too on systems that
+// keep one that can be set. It does nothing if t is zero.
+func setFileTimes(fpath string, t time.Time) error {
+	if t.IsZero() {
+		return nil
+	}
+	err := os.Chtimes(fpath, t, t)
+	if err != nil {
+		return err
+	}
+	return setCreationTime(fpath, t)
+}
@@ -0,0 +1,16 @@
+package photobak
+
+import (
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// setCreationTime sets the creation time of the file at fpath to t.
+func setCreationTime(fpath string, t time.Time) error {
+	attrs := unix.Attrlist{Bitmapcount: unix.ATTR_BIT_MAP_COUNT, Commonattr: unix.ATTR_CMN_CRTIME}
+	ts := unix.NsecToTimespec(t.UnixNano())
+	buf := (*[unsafe.Sizeof(ts)]byte)(unsafe.Pointer(&ts))[:]
+	return unix.Setattrlist(fpath, &attrs, buf, 0)
+}
@@ -0,0 +1,12 @@
+//go:build !windows && !darwin
+// +build !windows,!darwin
+
+package photobak
+
+import "time"
+
+// setCreationTime does nothing, since files on this
+// operating system have no creation time that can be set.
+func setCreationTime(fpath string, t time.Time) error {
+	return nil
+}
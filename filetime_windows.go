@@ -0,0 +1,23 @@
+package photobak
+
+import (
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// setCreationTime sets the creation time of the file at fpath to t.
+func setCreationTime(fpath string, t time.Time) error {
+	path, err := windows.UTF16PtrFromString(fpath)
+	if err != nil {
+		return err
+	}
+	h, err := windows.CreateFile(path, windows.FILE_WRITE_ATTRIBUTES, windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE,
+		nil, windows.OPEN_EXISTING, windows.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		return err
+	}
+	defer windows.CloseHandle(h)
+	ctime := windows.NsecToFiletime(t.UnixNano())
+	return windows.SetFileTime(h, &ctime, nil, nil)
+}
@@ -0,0 +1,138 @@
+package photobak
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Kinds of media that a Filter can limit items to.
+const (
+	MediaPhotos = "photos"
+	MediaVideos = "videos"
+	MediaAll    = "all"
+)
+
+// Filter selects what is backed up for an account. The zero
+// value selects everything. Filters only decide what is added
+// and updated; what is already in the repository is not pruned
+// because it is filtered out.
+type Filter struct {
+	// IncludeAlbums are patterns that select the collections
+	// to back up by name; if empty, all are backed up, except
+	// those selected by ExcludeAlbums. A pattern is as in
+	// path.Match, but not case-sensitive, or a regular
+	// expression between slashes, like "/^Hangouts/".
+	IncludeAlbums []string
+	ExcludeAlbums []string
+
+	// Since and Until, if not zero, select the items that
+	// were taken at or after Since and before Until. Items
+	// whose provider doesn't tell when they were taken
+	// are always selected.
+	Since, Until time.Time
+
+	// Media selects the items that are MediaPhotos or
+	// MediaVideos; if empty or MediaAll, both are selected.
+	Media string
+}
+
+// Validate returns an error if f has a bad
+// pattern or an unknown kind of media.
+func (f Filter) Validate() error {
+	for _, pattern := range append(append([]string(nil), f.IncludeAlbums...), f.ExcludeAlbums...) {
+		if _, err := matchAlbum(pattern, ""); err != nil {
+			return fmt.Errorf("bad album pattern '%s': %v", pattern, err)
+		}
+	}
+	switch f.Media {
+	case "", MediaPhotos, MediaVideos, MediaAll:
+	default:
+		return fmt.Errorf("unknown kind of media '%s': must be %s, %s, or %s", f.Media, MediaPhotos, MediaVideos, MediaAll)
+	}
+	if !f.Since.IsZero() && !f.Until.IsZero() && !f.Until.After(f.Since) {
+		return fmt.Errorf("date range ends (%s) before it starts (%s)", f.Until, f.Since)
+	}
+	return nil
+}
+
+// includesCollection returns true if the
+// collection with the given name is selected.
+func (f Filter) includesCollection(name string) bool {
+	if len(f.IncludeAlbums) > 0 && !matchAnyAlbum(f.IncludeAlbums, name) {
+		return false
+	}
+	return !matchAnyAlbum(f.ExcludeAlbums, name)
+}
+
+// includesItem returns true if the item it is selected.
+func (f Filter) includesItem(it Item) bool {
+	if f.Media != "" && f.Media != MediaAll && isVideo(it.ItemName()) != (f.Media == MediaVideos) {
+		return false
+	}
+	if t := itemTime(it); !t.IsZero() {
+		if !f.Since.IsZero() && t.Before(f.Since) {
+			return false
+		}
+		if !f.Until.IsZero() && !t.Before(f.Until) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchAnyAlbum returns true if name matches
+// any of patterns (see Filter.IncludeAlbums).
+func matchAnyAlbum(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := matchAlbum(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAlbum returns true if name matches pattern,
+// which is a regular expression if it is between
+// slashes, or else a case-insensitive glob.
+func matchAlbum(pattern, name string) (bool, error) {
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return false, err
+		}
+		return re.MatchString(name), nil
+	}
+	return path.Match(strings.ToLower(pattern), strings.ToLower(name))
+}
+
+// filter returns the filter for pa. Account-specific
+// filters take precedence over provider-wide ones, and
+// either one's kind of media over the repository's.
+func (r *Repository) filter(pa providerAccount) Filter {
+	f, ok := r.Filters[pa.String()]
+	if !ok {
+		f = r.Filters[pa.provider.Name]
+	}
+	if f.Media == "" {
+		f.Media = r.Media
+	}
+	return f
+}
+
+// filterCollections returns the collections in colls
+// that pa's filter selects.
+func (r *Repository) filterCollections(pa providerAccount, colls []Collection) []Collection {
+	f := r.filter(pa)
+	var selected []Collection
+	for _, coll := range colls {
+		if !f.includesCollection(coll.CollectionName()) {
+			repoLog.Infof("%s: skipping collection %s: %s (filtered out)", pa, coll.CollectionID(), coll.CollectionName())
+			continue
+		}
+		selected = append(selected, coll)
+	}
+	return selected
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd && !windows
+// +build !linux,!darwin,!freebsd,!windows
+
+package photobak
+
+import "fmt"
+
+// freeSpace returns an error, since the free space of
+// a disk can't be told on this operating system.
+func freeSpace(dir string) (int64, error) {
+	return 0, fmt.Errorf("can't tell free disk space on this system")
+}
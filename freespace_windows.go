@@ -0,0 +1,17 @@
+package photobak
+
+import "golang.org/x/sys/windows"
+
+// freeSpace returns how many bytes are free for
+// this user on the disk that dir is on.
+func freeSpace(dir string) (int64, error) {
+	path, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var free, total, totalFree uint64
+	if err := windows.GetDiskFreeSpaceEx(path, &free, &total, &totalFree); err != nil {
+		return 0, err
+	}
+	return int64(free), nil
+}
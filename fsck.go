@@ -0,0 +1,30 @@
+package photobak
+
+import "fmt"
+
+// FsckReport describes the problems that
+// Fsck found and repaired in the repository.
+type FsckReport struct {
+	DanglingChecksums int // checksum index entries that referred to nothing
+}
+
+// String returns a human-readable report.
+func (fr FsckReport) String() string {
+	return fmt.Sprintf("Removed %d dangling checksum index entries\n", fr.DanglingChecksums)
+}
+
+// Fsck checks the repository's database for garbage that can
+// accumulate from interrupted operations or bugs in older
+// versions, and removes it. No requests are made to providers
+// and no files are changed.
+func (r *Repository) Fsck() (FsckReport, error) {
+	var report FsckReport
+	var err error
+
+	report.DanglingChecksums, err = r.db.removeDanglingChecksums()
+	if err != nil {
+		return report, fmt.Errorf("cleaning checksum index: %v", err)
+	}
+
+	return report, nil
+}
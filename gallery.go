@@ -0,0 +1,453 @@
+package photobak
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Gallery returns an HTTP handler that serves the repository as a
+// read-only gallery that can be browsed with a web browser: the
+// albums of every account, thumbnails of their photos, and each
+// item with its caption, when it was taken, the camera, and where.
+// Everything is looked up in the database rather than by scanning
+// the repository. Nothing is ever changed.
+func (r *Repository) Gallery() http.Handler {
+	g := &gallery{repo: r, thumbs: make(map[string][]byte)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", g.serveAlbums)
+	mux.HandleFunc("/album", g.serveAlbum)
+	mux.HandleFunc("/item", g.serveItem)
+	mux.HandleFunc("/file", g.serveFile)
+	mux.HandleFunc("/thumb", g.serveThumb)
+	return mux
+}
+
+// gallery serves the pages of the gallery.
+type gallery struct {
+	repo *Repository
+
+	thumbsMu sync.Mutex
+	thumbs   map[string][]byte // JPEG thumbnails, keyed by the path and checksum of their file
+}
+
+// The longest side of a thumbnail, in pixels, and how many
+// thumbnails are kept in memory before starting over.
+const (
+	thumbSize       = 240
+	maxCachedThumbs = 2000
+)
+
+// galleryAlbum is an album as it is shown in the gallery.
+type galleryAlbum struct {
+	Account, ID, Name string
+	Items             int
+	Cover             string // ID of the item shown for the album, if any
+}
+
+// galleryItem is an item as it is shown in the gallery.
+type galleryItem struct {
+	Account, ID, Name string
+	Caption           string
+	Taken             time.Time
+	Camera            string
+	Latitude          float64
+	Longitude         float64
+	Located           bool // whether Latitude and Longitude are known
+	Image, Video      bool
+}
+
+// serveAlbums serves the list of albums of all accounts.
+func (g *gallery) serveAlbums(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/" {
+		http.NotFound(w, req)
+		return
+	}
+	accounts, err := g.repo.db.storedAccounts()
+	if err != nil {
+		g.fail(w, err)
+		return
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].String() < accounts[j].String() })
+
+	var albums []galleryAlbum
+	for _, pa := range accounts {
+		collIDs, err := g.repo.db.collectionIDs(pa)
+		if err != nil {
+			g.fail(w, err)
+			return
+		}
+		var accountAlbums []galleryAlbum
+		for _, collID := range collIDs {
+			dbc, err := g.repo.db.loadCollection(pa.key(), collID)
+			if err != nil {
+				g.fail(w, err)
+				return
+			}
+			if dbc == nil || len(dbc.Items) == 0 {
+				continue
+			}
+			items, err := g.items(pa, dbc)
+			if err != nil {
+				g.fail(w, err)
+				return
+			}
+			album := galleryAlbum{Account: pa.String(), ID: collID, Name: dbc.Name, Items: len(items)}
+			for _, it := range items {
+				if it.Image {
+					album.Cover = it.ID
+					break
+				}
+			}
+			accountAlbums = append(accountAlbums, album)
+		}
+		sort.Slice(accountAlbums, func(i, j int) bool {
+			return strings.ToLower(accountAlbums[i].Name) < strings.ToLower(accountAlbums[j].Name)
+		})
+		albums = append(albums, accountAlbums...)
+	}
+	g.render(w, "albums", albums)
+}
+
+// serveAlbum serves the thumbnails of the items in an album.
+func (g *gallery) serveAlbum(w http.ResponseWriter, req *http.Request) {
+	pa, ok := galleryAccount(req)
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	dbc, err := g.repo.db.loadCollection(pa.key(), req.FormValue("id"))
+	if err != nil || dbc == nil {
+		http.NotFound(w, req)
+		return
+	}
+	items, err := g.items(pa, dbc)
+	if err != nil {
+		g.fail(w, err)
+		return
+	}
+	g.render(w, "album", struct {
+		Name  string
+		Items []galleryItem
+	}{dbc.Name, items})
+}
+
+// serveItem serves the page of an item.
+func (g *gallery) serveItem(w http.ResponseWriter, req *http.Request) {
+	pa, dbi, ok := g.item(req)
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	g.render(w, "item", newGalleryItem(pa, dbi))
+}
+
+// serveFile serves the file of an item as it is stored.
+func (g *gallery) serveFile(w http.ResponseWriter, req *http.Request) {
+	_, dbi, ok := g.item(req)
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	http.ServeFile(w, req, g.repo.fullPath(dbi.FilePath))
+}
+
+// serveThumb serves a thumbnail of an item, which must be an image.
+func (g *gallery) serveThumb(w http.ResponseWriter, req *http.Request) {
+	_, dbi, ok := g.item(req)
+	if !ok || !hashableImage(dbi.FilePath) {
+		http.NotFound(w, req)
+		return
+	}
+	key := dbi.FilePath + "\x00" + string(dbi.Checksum)
+
+	g.thumbsMu.Lock()
+	thumb, ok := g.thumbs[key]
+	g.thumbsMu.Unlock()
+
+	if !ok {
+		var err error
+		thumb, err = makeThumbnail(g.repo.fullPath(dbi.FilePath))
+		if err != nil {
+			repoLog.Warnf("making thumbnail of %s: %v", dbi.FilePath, err)
+			http.NotFound(w, req)
+			return
+		}
+		g.thumbsMu.Lock()
+		if len(g.thumbs) >= maxCachedThumbs {
+			g.thumbs = make(map[string][]byte)
+		}
+		g.thumbs[key] = thumb
+		g.thumbsMu.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "max-age=86400")
+	http.ServeContent(w, req, "", dbi.ModTime, bytes.NewReader(thumb))
+}
+
+// item returns the account and item named by the
+// query of req, and whether there is such an item.
+func (g *gallery) item(req *http.Request) (providerAccount, *dbItem, bool) {
+	pa, ok := galleryAccount(req)
+	if !ok {
+		return pa, nil, false
+	}
+	dbi, err := g.repo.db.loadItem(pa.key(), req.FormValue("id"))
+	if err != nil || dbi == nil {
+		return pa, nil, false
+	}
+	return pa, dbi, true
+}
+
+// items returns the items of dbc, which belongs to pa,
+// sorted by when they were taken, undated items last.
+func (g *gallery) items(pa providerAccount, dbc *dbCollection) ([]galleryItem, error) {
+	items := make([]galleryItem, 0, len(dbc.Items))
+	for itemID := range dbc.Items {
+		dbi, err := g.repo.db.loadItem(pa.key(), itemID)
+		if err != nil {
+			return nil, err
+		}
+		if dbi != nil {
+			items = append(items, newGalleryItem(pa, dbi))
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		ti, tj := items[i].Taken, items[j].Taken
+		if ti.IsZero() != tj.IsZero() {
+			return tj.IsZero()
+		}
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return items[i].Name < items[j].Name
+	})
+	return items, nil
+}
+
+// newGalleryItem returns dbi, which belongs to pa,
+// as it is shown in the gallery.
+func newGalleryItem(pa providerAccount, dbi *dbItem) galleryItem {
+	it := galleryItem{
+		Account: pa.String(),
+		ID:      dbi.ID,
+		Name:    dbi.Name,
+		Caption: dbi.Meta.Caption,
+		Taken:   itemTaken(dbi),
+		Camera:  dbi.Meta.Camera,
+		Image:   hashableImage(dbi.FilePath),
+		Video:   isVideo(dbi.FilePath),
+	}
+	if s := dbi.Meta.Setting; s != nil && (s.Latitude != 0 || s.Longitude != 0) {
+		it.Latitude, it.Longitude, it.Located = s.Latitude, s.Longitude, true
+	}
+	return it
+}
+
+// itemTaken returns when dbi was taken,
+// or the zero time if it is not known.
+func itemTaken(dbi *dbItem) time.Time {
+	taken := dbi.Meta.Taken
+	if taken.IsZero() && dbi.Meta.Setting != nil {
+		taken = dbi.Meta.Setting.OriginTime
+	}
+	return taken
+}
+
+// galleryAccount returns the account named by the query of req.
+func galleryAccount(req *http.Request) (providerAccount, bool) {
+	parts := strings.SplitN(req.FormValue("account"), ":", 2)
+	if len(parts) != 2 {
+		return providerAccount{}, false
+	}
+	return accountFromKey(parts[0], parts[1]), true
+}
+
+// render writes the page of the named template with data.
+func (g *gallery) render(w http.ResponseWriter, name string, data interface{}) {
+	var buf bytes.Buffer
+	err := galleryTemplates.ExecuteTemplate(&buf, name, data)
+	if err != nil {
+		g.fail(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// fail logs err and tells the client something went wrong.
+func (g *gallery) fail(w http.ResponseWriter, err error) {
+	repoLog.Errorf("gallery: %v", err)
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
+// makeThumbnail returns a JPEG of the image in the file at
+// fullPath, shrunk so that its longest side is thumbSize.
+func makeThumbnail(fullPath string) ([]byte, error) {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, shrink(img, thumbSize), &jpeg.Options{Quality: 80})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// shrink returns img scaled down so that its longest side is
+// at most size pixels. Each pixel is the average of the pixels
+// of img it covers, sampled like in averageGray.
+func shrink(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	sw, sh := bounds.Dx(), bounds.Dy()
+	if sw <= size && sh <= size {
+		return img
+	}
+	w, h := size, sh*size/sw
+	if sh > sw {
+		w, h = sw*size/sh, size
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	const maxSamples = 4 // per side
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0 := bounds.Min.Y + y*sh/h
+		y1 := bounds.Min.Y + (y+1)*sh/h
+		stepY := (y1-y0)/maxSamples + 1
+		for x := 0; x < w; x++ {
+			x0 := bounds.Min.X + x*sw/w
+			x1 := bounds.Min.X + (x+1)*sw/w
+			stepX := (x1-x0)/maxSamples + 1
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy += stepY {
+				for sx := x0; sx < x1; sx += stepX {
+					pr, pg, pb, pa := img.At(sx, sy).RGBA()
+					r, g, b, a = r+pr, g+pg, b+pb, a+pa
+					n++
+				}
+			}
+			if n == 0 {
+				continue
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(b / n >> 8)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+	return dst
+}
+
+// galleryQuery returns the query of the URL of
+// the item or album with the given ID in account.
+func galleryQuery(account, id string) template.URL {
+	return template.URL(url.Values{"account": {account}, "id": {id}}.Encode())
+}
+
+var galleryTemplates = template.Must(template.New("").Funcs(template.FuncMap{
+	"query": galleryQuery,
+	"date": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format("January 2, 2006 15:04")
+	},
+	"coords": func(lat, lon float64) string {
+		return fmt.Sprintf("%.5f, %.5f", lat, lon)
+	},
+}).Parse(`
+{{define "head"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.}} - Photobak</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; background: #fafafa; color: #222; }
+a { color: inherit; text-decoration: none; }
+h1 a { color: #888; }
+.grid { display: flex; flex-wrap: wrap; gap: 12px; }
+.tile { width: 240px; }
+.tile .pic { width: 240px; height: 240px; display: flex; align-items: center; justify-content: center; background: #eee; overflow: hidden; }
+.tile .pic img { max-width: 240px; max-height: 240px; }
+.tile .name { font-size: small; margin-top: 4px; overflow: hidden; text-overflow: ellipsis; white-space: nowrap; }
+.tile .sub { font-size: small; color: #888; }
+.item img, .item video { max-width: 100%; max-height: 80vh; }
+.item dl { display: grid; grid-template-columns: max-content auto; gap: 4px 1em; }
+.item dt { color: #888; }
+</style>
+</head>
+<body>
+{{end}}
+
+{{define "albums"}}{{template "head" "Albums"}}
+<h1>Albums</h1>
+<div class="grid">
+{{range .}}<a class="tile" href="/album?{{query .Account .ID}}">
+<div class="pic">{{if .Cover}}<img src="/thumb?{{query .Account .Cover}}" alt="" loading="lazy">{{end}}</div>
+<div class="name">{{.Name}}</div>
+<div class="sub">{{.Items}} items &middot; {{.Account}}</div>
+</a>
+{{else}}<p>There is nothing in the repository yet.</p>
+{{end}}</div>
+</body>
+</html>
+{{end}}
+
+{{define "album"}}{{template "head" .Name}}
+<h1><a href="/">Albums</a> / {{.Name}}</h1>
+<div class="grid">
+{{range .Items}}<a class="tile" href="/item?{{query .Account .ID}}">
+<div class="pic">{{if .Image}}<img src="/thumb?{{query .Account .ID}}" alt="" loading="lazy">{{else if .Video}}&#9654;{{end}}</div>
+<div class="name">{{if .Caption}}{{.Caption}}{{else}}{{.Name}}{{end}}</div>
+<div class="sub">{{date .Taken}}</div>
+</a>
+{{end}}</div>
+</body>
+</html>
+{{end}}
+
+{{define "item"}}{{template "head" .Name}}
+<h1><a href="/">Albums</a> / {{.Name}}</h1>
+<div class="item">
+{{if .Video}}<video src="/file?{{query .Account .ID}}" controls></video>
+{{else if .Image}}<a href="/file?{{query .Account .ID}}"><img src="/file?{{query .Account .ID}}" alt=""></a>
+{{else}}<p><a href="/file?{{query .Account .ID}}">Download {{.Name}}</a></p>
+{{end}}
+<dl>
+{{if .Caption}}<dt>Caption</dt><dd>{{.Caption}}</dd>{{end}}
+{{if not .Taken.IsZero}}<dt>Taken</dt><dd>{{date .Taken}}</dd>{{end}}
+{{if .Camera}}<dt>Camera</dt><dd>{{.Camera}}</dd>{{end}}
+{{if .Located}}<dt>Location</dt><dd>{{coords .Latitude .Longitude}}</dd>{{end}}
+<dt>Account</dt><dd>{{.Account}}</dd>
+</dl>
+</div>
+</body>
+</html>
+{{end}}
+`))
@@ -3,23 +3,19 @@
 package googlephotos
 
 import (
-	"encoding/gob"
+	"context"
 	"encoding/xml"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"path"
-	"regexp"
-	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/mholt/photobak"
-	"errors"
 )
 
 const (
@@ -30,23 +26,41 @@ const (
 var (
 	maxAlbums = -1
 	maxPhotos = -1
+	idScheme  = "photos"
+	rate      = 10.0
 )
 
+// limiter spaces out the requests made to Google,
+// by all accounts and workers together.
+var limiter photobak.RateLimiter
+
+// logger is the log of this provider.
+var logger = photobak.NewLogger(name)
+
 func init() {
 	var accounts photobak.StringFlagList
 	flag.Var(&accounts, name, "Add a "+title+" account to the repository")
 	flag.IntVar(&maxAlbums, "maxalbums", maxAlbums, "Maximum number of albums to process (-1 for all)")
 	flag.IntVar(&maxPhotos, "maxphotos", maxPhotos, "Maximum number of photos per album to process (-1 for all)")
+	flag.StringVar(&idScheme, "googlephotosids", idScheme, "How to identify "+title+" items: photos (Google's IDs) or exif (EXIF unique IDs)")
+	flag.Float64Var(&rate, "googlephotosrate", rate, "Maximum number of requests per second to "+title+", for all accounts together (0 for no limit)")
 
 	photobak.RegisterProvider(photobak.Provider{
-		Name:        name,
-		Title:       title,
-		Accounts:    func() []string { return accounts },
-		Credentials: getToken,
-		NewClient:   newClient,
+		Name:                name,
+		Title:               title,
+		Accounts:            func() []string { return accounts },
+		Credentials:         getToken,
+		NewRefreshingClient: newClient,
+
+		// generally users will want the physical files in the
+		// albums they've curated, rather than the default
+		// 'everything' album with thousands of items in it or
+		// automatically generated albums for the specific
+		// date or service.
+		LastAlbums: []string{"Auto Backup", "Автозагрузка", "Hangout *", `/^(\d+|\d{4}-\d{2}-\d{2})$/`},
 	})
 
-	gob.Register(Entry{})
+	photobak.RegisterAPIType(Entry{})
 }
 
 // Client acts as a client to the Picasa Web Albums
@@ -64,7 +78,7 @@ func (c *Client) Name() string {
 }
 
 // ListCollections lists the albums belonging to the user.
-func (c *Client) ListCollections() ([]photobak.Collection, error) {
+func (c *Client) ListCollections(ctx context.Context) ([]photobak.Collection, error) {
 	if maxAlbums == 0 {
 		return []photobak.Collection{}, nil
 	}
@@ -76,7 +90,7 @@ func (c *Client) ListCollections() ([]photobak.Collection, error) {
 	if maxAlbums > -1 {
 		url += fmt.Sprintf("?max-results=%d", maxAlbums)
 	}
-	data, err := c.getFeed(url)
+	data, err := c.getFeed(ctx, url)
 	if err != nil {
 		return nil, err
 	}
@@ -89,12 +103,9 @@ func (c *Client) ListCollections() ([]photobak.Collection, error) {
 
 	albums := make([]photobak.Collection, len(results.Entries))
 	for i := range results.Entries {
-		results.Entries[i].Title = sanitizeFilename(results.Entries[i].Title)
 		albums[i] = results.Entries[i]
 	}
 
-	sort.Stable(albumSorter(albums))
-
 	return albums, nil
 }
 
@@ -108,30 +119,41 @@ func (c *Client) ListCollections() ([]photobak.Collection, error) {
 //
 // Note that, due to a bug in the Picasa Web Albums API, there is a limit as to how
 // many photos can be retrieved on very large albums. See the README for more info.
-func (c *Client) ListCollectionItems(col photobak.Collection, itemChan chan photobak.Item) (err error) {
+func (c *Client) ListCollectionItems(ctx context.Context, col photobak.Collection, itemChan chan photobak.Item) (err error) {
 	defer close(itemChan)
 	url := "https://picasaweb.google.com/data/feed/api/user/default/albumid/" + col.CollectionID()
 
-	// try a few times in case there's a network error
-	for i := 0; i < 3; i++ {
-		err = c.listAllPhotos(url, itemChan)
-		if err == nil {
-			break
-		}
-		log.Printf("[DEBUG] listing photos in album '%s' (attempt %d): %v", col.CollectionName(), i+1, err)
+	// each page is retried if there's a network error
+	err = c.listAllPhotos(ctx, url, 0, itemChan)
+	if err != nil {
+		logger.Debugf("listing photos in album '%s': %v", col.CollectionName(), err)
 	}
 
 	return
 }
 
-// listAllPhotos gets all photos in the album designated by the baseURL and pipes
-// them down itemChan.
-func (c *Client) listAllPhotos(baseURL string, itemChan chan photobak.Item) error {
+// ListCollectionItemsFrom lists the items in col like
+// ListCollectionItems, but starts after the first offset items.
+func (c *Client) ListCollectionItemsFrom(ctx context.Context, col photobak.Collection, offset int, itemChan chan photobak.Item) (err error) {
+	defer close(itemChan)
+	url := "https://picasaweb.google.com/data/feed/api/user/default/albumid/" + col.CollectionID()
+
+	err = c.listAllPhotos(ctx, url, offset, itemChan)
+	if err != nil {
+		logger.Debugf("listing photos in album '%s' after %d items: %v", col.CollectionName(), offset, err)
+	}
+
+	return
+}
+
+// listAllPhotos gets all photos in the album designated by the baseURL, after
+// the first offset photos, and pipes them down itemChan.
+func (c *Client) listAllPhotos(ctx context.Context, baseURL string, offset int, itemChan chan photobak.Item) error {
 	var page Atom
 	var err error
 
-	start := 1
-	count := 0
+	start := 1 + offset
+	count := offset
 
 	// we can't rely on NumPhotos in an album to be correct,
 	// and the number of photos can change while download is
@@ -142,13 +164,17 @@ func (c *Client) listAllPhotos(baseURL string, itemChan chan photobak.Item) erro
 			break
 		}
 
-		page, err = c.listPhotosPage(baseURL, start, maxPhotos-count)
+		page, err = c.listPhotosPage(ctx, baseURL, start, maxPhotos-count)
 		if err != nil {
 			return err
 		}
 
 		for _, entry := range page.Entries {
-			itemChan <- entry
+			select {
+			case itemChan <- entry:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 		}
 
 		start += len(page.Entries)
@@ -159,7 +185,7 @@ func (c *Client) listAllPhotos(baseURL string, itemChan chan photobak.Item) erro
 }
 
 // DownloadItemInto downloads item into w.
-func (c *Client) DownloadItemInto(item photobak.Item, w io.Writer) error {
+func (c *Client) DownloadItemInto(ctx context.Context, item photobak.Item, w io.Writer) error {
 	gpItem, ok := item.(Entry)
 	if !ok {
 		return fmt.Errorf("item is not a Google Photos entry")
@@ -177,14 +203,25 @@ func (c *Client) DownloadItemInto(item photobak.Item, w io.Writer) error {
 		return fmt.Errorf("identifying the best download URL: %v", err)
 	}
 
-	resp, err := http.Get(url)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	err = limiter.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
 	if err != nil {
 		return fmt.Errorf("HTTP GET %s: %v", url, err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("HTTP GET %s: %s", url, resp.Status)
+		err := photobak.NewHTTPError("HTTP GET "+url, resp)
+		limiter.SlowDown(err)
+		return err
 	}
 
 	_, err = io.Copy(w, resp.Body)
@@ -192,6 +229,46 @@ func (c *Client) DownloadItemInto(item photobak.Item, w io.Writer) error {
 	return err
 }
 
+// ItemSize gets the size of item's content with a HEAD
+// request, without downloading it.
+func (c *Client) ItemSize(ctx context.Context, item photobak.Item) (int64, error) {
+	gpItem, ok := item.(Entry)
+	if !ok {
+		return 0, fmt.Errorf("item is not a Google Photos entry")
+	}
+
+	url, err := getBestDownloadURL(gpItem)
+	if err != nil {
+		return 0, fmt.Errorf("identifying the best download URL: %v", err)
+	}
+
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	err = limiter.Wait(ctx)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, fmt.Errorf("HTTP HEAD %s: %v", url, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err := photobak.NewHTTPError("HTTP HEAD "+url, resp)
+		limiter.SlowDown(err)
+		return 0, err
+	}
+	if resp.ContentLength < 0 {
+		return 0, fmt.Errorf("HTTP HEAD %s: no content length", url)
+	}
+
+	return resp.ContentLength, nil
+}
+
 // getBestDownloadURL gets the URL to the highest-resolution
 // non-Flash video, if possible. If the entry is for a photo,
 // there won't be a video of it, in which case we just download
@@ -242,7 +319,7 @@ func getBestDownloadURL(e Entry) (string, error) {
 // To get all the photos in an album, you will need to call this until there are
 // no more results. If max is > 0, no more than that many results will be returned
 // per page.
-func (c *Client) listPhotosPage(baseURL string, start, max int) (Atom, error) {
+func (c *Client) listPhotosPage(ctx context.Context, baseURL string, start, max int) (Atom, error) {
 	url, err := url.Parse(baseURL)
 	if err != nil {
 		return Atom{}, err
@@ -255,7 +332,7 @@ func (c *Client) listPhotosPage(baseURL string, start, max int) (Atom, error) {
 	}
 	url.RawQuery = qs.Encode()
 
-	data, err := c.getFeed(url.String())
+	data, err := c.getFeed(ctx, url.String())
 	if err != nil {
 		return Atom{}, err
 	}
@@ -263,96 +340,43 @@ func (c *Client) listPhotosPage(baseURL string, start, max int) (Atom, error) {
 	var results Atom
 	err = xml.Unmarshal(data, &results)
 
-	// sanitize titles (file names)
+	// titles (file names) may be paths
 	for i := 0; i < len(results.Entries); i++ {
 		results.Entries[i].Title = path.Base(results.Entries[i].Title) // https://github.com/tgulacsi/picago/pull/6
-		results.Entries[i].Title = sanitizeFilename(results.Entries[i].Title)
 	}
 
 	return results, err
 }
 
-func (c *Client) getFeed(endpoint string) ([]byte, error) {
-	req, err := http.NewRequest("GET", endpoint, nil)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("GData-Version", "2")
-
-	res, err := c.HTTPClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer res.Body.Close()
-
-	if res.StatusCode != http.StatusOK {
-		return nil, errors.New(res.Status)
-	}
-
-	return ioutil.ReadAll(res.Body)
-}
-
-// sanitizeFilename replaces common special characters in filename.
-// Only the file name should be passed in, NOT the whole path.
-// It does map more than one character to empty string, meaning
-// that it could introduce collisions, for example: "$5.jpg" and
-// "5.jpg" will have the same output value. It is unfortunate.
-func sanitizeFilename(filename string) string {
-	r := strings.NewReplacer(
-		"/", "",
-		"\\", "",
-		":", "",
-		"@", "_at_",
-		"+", "_",
-		"*", "",
-		"<", "",
-		">", "",
-		"{", "",
-		"}", "",
-		"^", "",
-		"#", "",
-		"!", "",
-		"~", "",
-		"$", "",
-		"[", "",
-		"]", "",
-		"=", "",
-		"|", "",
-		"?", "",
-		"`", "",
-		"●", "-", // common with Google Hangouts albums
-	)
-	return r.Replace(filename)
-}
-
-// Sorts out all automatic albums to the end of the list, since I think generally
-// users will want the physical files in the albums they've curated, rather than
-// the default 'everything' album with thousands of items in it or automatically
-// generated albums for the specific date or service.
-type albumSorter []photobak.Collection
-
-func (a albumSorter) Len() int {
-	return len(a)
-}
+// getFeed gets the feed at endpoint, retrying
+// according to the retry policy if it fails.
+func (c *Client) getFeed(ctx context.Context, endpoint string) ([]byte, error) {
+	var data []byte
+	err := photobak.Retries.Do(ctx, func(attempt int) error {
+		req, err := http.NewRequest("GET", endpoint, nil)
+		if err != nil {
+			return photobak.Permanent(err)
+		}
+		req.Header.Set("GData-Version", "2")
 
-func (a albumSorter) Swap(i, j int) {
-	a[i], a[j] = a[j], a[i]
-}
+		err = limiter.Wait(ctx)
+		if err != nil {
+			return err
+		}
+		res, err := c.HTTPClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
 
-func (a albumSorter) Less(i, j int) bool {
-	return prioritizeAlbum(a[i].CollectionName()) < prioritizeAlbum(a[j].CollectionName())
-}
+		if res.StatusCode != http.StatusOK {
+			err := photobak.NewHTTPError("HTTP GET "+endpoint, res)
+			limiter.SlowDown(err)
+			return err
+		}
 
-var automaticAlbumRe = regexp.MustCompile(`^(\d+|\d{4}-\d{2}-\d{2})$`)
-
-func prioritizeAlbum(name string) int {
-	if name == "Auto Backup" || name == "Автозагрузка" {
-		return 1
-	} else if strings.HasPrefix(name, "Hangout ") {
-		return 2
-	} else if automaticAlbumRe.MatchString(name) {
-		return 3
-	} else {
-		return 0
-	}
+		data, err = ioutil.ReadAll(res.Body)
+		return err
+	})
+	return data, err
 }
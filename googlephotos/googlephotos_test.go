@@ -1,6 +1,14 @@
 package googlephotos
 
-import "testing"
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mholt/photobak"
+)
 
 func TestBestDownloadURL(t *testing.T) {
 	fb := &EntryContent{URL: "fallback"}
@@ -61,3 +69,124 @@ func TestBestDownloadURL(t *testing.T) {
 		}
 	}
 }
+
+func TestItemIDScheme(t *testing.T) {
+	defer func(s string) { idScheme = s }(idScheme)
+
+	withExif := Entry{ID: "gp1", Exif: &EntryExif{UID: "exif1"}}
+	noExif := Entry{ID: "gp2"}
+
+	for i, test := range []struct {
+		scheme     string
+		input      Entry
+		expectID   string
+		expectPrev string
+	}{
+		{scheme: "photos", input: withExif, expectID: "gp1", expectPrev: "exif1"},
+		{scheme: "exif", input: withExif, expectID: "exif1", expectPrev: "gp1"},
+		{scheme: "photos", input: noExif, expectID: "gp2", expectPrev: "gp2"},
+		{scheme: "exif", input: noExif, expectID: "gp2", expectPrev: "gp2"},
+	} {
+		idScheme = test.scheme
+		if actual := test.input.ItemID(); actual != test.expectID {
+			t.Errorf("Test %d: Got ID '%s', expected '%s'", i, actual, test.expectID)
+		}
+		if actual := test.input.PreviousItemID(); actual != test.expectPrev {
+			t.Errorf("Test %d: Got previous ID '%s', expected '%s'", i, actual, test.expectPrev)
+		}
+	}
+}
+
+func TestItemTime(t *testing.T) {
+	for i, test := range []struct {
+		timestamp string
+		expect    string
+	}{
+		{timestamp: "1467331200000", expect: "2016-07-01T00:00:00Z"},
+		{timestamp: "1467374400500", expect: "2016-07-01T12:00:00.5Z"},
+		{timestamp: "", expect: "0001-01-01T00:00:00Z"},
+		{timestamp: "abc", expect: "0001-01-01T00:00:00Z"},
+	} {
+		actual := Entry{Timestamp: test.timestamp}.ItemTime().Format(time.RFC3339Nano)
+		if actual != test.expect {
+			t.Errorf("Test %d: Got %s, expected %s", i, actual, test.expect)
+		}
+	}
+}
+
+func TestItemCamera(t *testing.T) {
+	for i, test := range []struct {
+		exif   *EntryExif
+		expect string
+	}{
+		{exif: &EntryExif{Make: "Canon", Model: "Canon EOS 5D"}, expect: "Canon EOS 5D"},
+		{exif: &EntryExif{Make: "Apple", Model: "iPhone 6"}, expect: "Apple iPhone 6"},
+		{exif: &EntryExif{Model: "DSC-RX100"}, expect: "DSC-RX100"},
+		{exif: &EntryExif{}, expect: ""},
+		{exif: nil, expect: ""},
+	} {
+		actual := Entry{Exif: test.exif}.ItemCamera()
+		if actual != test.expect {
+			t.Errorf("Test %d: Got '%s', expected '%s'", i, actual, test.expect)
+		}
+	}
+}
+
+func TestGetFeedRetryAfter(t *testing.T) {
+	oldRetries := photobak.Retries
+	defer func() { photobak.Retries = oldRetries }()
+	photobak.Retries = photobak.RetryPolicy{Attempts: 2, Backoff: []time.Duration{time.Millisecond}}
+
+	var requests []time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, time.Now())
+		if len(requests) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte("feed"))
+	}))
+	defer srv.Close()
+
+	c := &Client{HTTPClient: srv.Client()}
+	data, err := c.getFeed(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if string(data) != "feed" {
+		t.Errorf("Expected feed, got '%s'", data)
+	}
+	if len(requests) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(requests))
+	}
+	if waited := requests[1].Sub(requests[0]); waited < time.Second {
+		t.Errorf("Expected to wait at least 1s as asked by Retry-After, waited %v", waited)
+	}
+}
+
+func TestListAllPhotosOffset(t *testing.T) {
+	var starts []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		starts = append(starts, r.URL.Query().Get("start-index"))
+		if len(starts) == 1 {
+			w.Write([]byte(`<feed><entry><id>a</id></entry><entry><id>b</id></entry></feed>`))
+			return
+		}
+		w.Write([]byte(`<feed></feed>`))
+	}))
+	defer srv.Close()
+
+	c := &Client{HTTPClient: srv.Client()}
+	itemChan := make(chan photobak.Item, 10)
+	err := c.listAllPhotos(context.Background(), srv.URL, 5, itemChan)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(starts) != 2 || starts[0] != "6" || starts[1] != "8" {
+		t.Errorf("Expected pages to start at 6 and 8, got %v", starts)
+	}
+	if len(itemChan) != 2 {
+		t.Errorf("Expected 2 items, got %d", len(itemChan))
+	}
+}
@@ -2,7 +2,11 @@ package googlephotos
 
 import (
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/mholt/photobak"
 )
 
 // Structures in this file shamelessly borrowed
@@ -53,6 +57,7 @@ type Entry struct {
 	Author        *Author        `xml:"author"`
 	Location      string         `xml:"http://schemas.google.com/photos/2007 location"`
 	NumPhotos     int            `xml:"numphotos"`
+	Size          int64          `xml:"http://schemas.google.com/photos/2007 size"`
 	Content       *EntryContent  `xml:"content"`
 	Media         *EntryMedia    `xml:"group"`
 	Exif          *EntryExif     `xml:"tags"`
@@ -65,6 +70,9 @@ func (e Entry) CollectionID() string { return e.ID }
 // CollectionName returns the collection name.
 func (e Entry) CollectionName() string { return e.Title }
 
+// CollectionDescription returns the album's description.
+func (e Entry) CollectionDescription() string { return e.Summary }
+
 // ItemID returns the item ID. Unfortunately, Google's "id" field
 // is sometimes too unique: the same photo can have different IDs
 // if in different albums. There is usually an ID in the exif
@@ -99,14 +107,27 @@ func (e Entry) CollectionName() string { return e.Title }
 // Long story short, I'm fairly confident using the Google
 // Photos ID is sufficient to be unique without overwriting.
 // But there will be some duplication of the item in the DB
-// and maybe on disk too. If we ever want to go back to using
-// EXIF IDs, we can try it... but people will have to
-// re-download their whole collections unless we write some
-// sort of subcommand to convert their DB.
+// and maybe on disk too. So the EXIF ID is only used if the
+// -googlephotosids flag is "exif". Existing repositories can
+// be converted with the remap-ids command rather than
+// re-downloading whole collections.
 func (e Entry) ItemID() string {
-	// if e.Exif != nil && e.Exif.UID != "" {
-	// 	return e.Exif.UID
-	// }
+	if idScheme == "exif" && e.Exif != nil && e.Exif.UID != "" {
+		return e.Exif.UID
+	}
+	return e.ID
+}
+
+// PreviousItemID returns the item's ID under the ID scheme
+// that is not in use, so that items can be remapped when
+// switching between Google's IDs and EXIF IDs.
+func (e Entry) PreviousItemID() string {
+	if idScheme == "exif" {
+		return e.ID
+	}
+	if e.Exif != nil && e.Exif.UID != "" {
+		return e.Exif.UID
+	}
 	return e.ID
 }
 
@@ -139,9 +160,61 @@ func (e Entry) ItemName() string {
 // Edited, or ImageVersion if needed.
 func (e Entry) ItemETag() string { return e.ETag }
 
+// ItemChangeKey returns the value used to detect changes
+// with the given strategy. Updated and ImageVersion are
+// available as alternatives to the ETag.
+func (e Entry) ItemChangeKey(strategy string) string {
+	switch strategy {
+	case photobak.ChangeUpdated:
+		if e.Updated.IsZero() {
+			return ""
+		}
+		return e.Updated.UTC().Format(time.RFC3339Nano)
+	case photobak.ChangeVersion:
+		return e.ImageVersion
+	}
+	return ""
+}
+
 // ItemCaption returns the item's summary/description.
 func (e Entry) ItemCaption() string { return e.Summary }
 
+// ItemTime returns when the item was taken, from its
+// timestamp, which is in milliseconds since the epoch.
+// Google gives the local time of the photo as if it were
+// UTC, so it is kept in UTC to get the right date.
+func (e Entry) ItemTime() time.Time {
+	ms, err := strconv.ParseInt(e.Timestamp, 10, 64)
+	if err != nil || ms <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC()
+}
+
+// ListedSize returns the size of the original file in
+// bytes, if the feed gave it, or else -1. Videos are
+// downloaded as Google encoded them, not as they were
+// uploaded, so their size is not known.
+func (e Entry) ListedSize() int64 {
+	if e.Size <= 0 || e.OriginalVideo != nil || e.VideoStatus != "" {
+		return -1
+	}
+	return e.Size
+}
+
+// ItemCamera returns the make and model of the camera
+// that took the item, from the EXIF tags Google gives.
+func (e Entry) ItemCamera() string {
+	if e.Exif == nil {
+		return ""
+	}
+	mk, model := strings.TrimSpace(e.Exif.Make), strings.TrimSpace(e.Exif.Model)
+	if mk == "" || strings.HasPrefix(strings.ToLower(model), strings.ToLower(mk)) {
+		return model
+	}
+	return mk + " " + model
+}
+
 // OriginalVideo is info about the originally-uploaded video.
 type OriginalVideo struct {
 	AudioCodec   string `xml:" audioCodec,attr"`
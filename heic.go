@@ -0,0 +1,223 @@
+package photobak
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// JPEGCompanionExt is the extension of the JPEG companions that
+// are kept in the repository if it has ConvertHEIC set. The
+// companion of a HEIC or HEIF file is named like the file with
+// JPEGCompanionExt added, like "IMG_1234.HEIC.jpg", so it sorts
+// next to it. The original file is always kept as it is.
+const JPEGCompanionExt = ".jpg"
+
+// fileFormat returns the format of the file at fpath, like
+// "jpeg", "heic", or "mp4", according to its first bytes (not
+// its name), or an empty string if it can't be told.
+func fileFormat(fpath string) string {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return ""
+	}
+	return sniffFormat(head[:n])
+}
+
+// sniffFormat returns the format of a file that starts with
+// head (see fileFormat).
+func sniffFormat(head []byte) string {
+	if len(head) >= 12 && string(head[4:8]) == "ftyp" {
+		return isoFormat(head)
+	}
+	if bytes.HasPrefix(head, []byte("II*\x00")) || bytes.HasPrefix(head, []byte("MM\x00*")) {
+		return "tiff" // including most raw formats
+	}
+	switch http.DetectContentType(head) {
+	case "image/jpeg":
+		return "jpeg"
+	case "image/png":
+		return "png"
+	case "image/gif":
+		return "gif"
+	case "image/webp":
+		return "webp"
+	case "image/bmp":
+		return "bmp"
+	case "video/avi":
+		return "avi"
+	case "video/webm":
+		return "webm"
+	}
+	return ""
+}
+
+// isoFormat returns the format of a file in the ISO base media
+// file format (like MP4, QuickTime, and HEIF) that starts with
+// head, which starts with its file type box, by its brands.
+func isoFormat(head []byte) string {
+	end := int(head[0])<<24 | int(head[1])<<16 | int(head[2])<<8 | int(head[3])
+	if end > len(head) || end < 12 {
+		end = len(head)
+	}
+	brands := map[string]bool{string(head[8:12]): true}
+	for i := 16; i+4 <= end; i += 4 {
+		brands[string(head[i:i+4])] = true
+	}
+	major := string(head[8:12])
+	switch {
+	case brands["heic"] || brands["heix"] || brands["heim"] || brands["heis"] || brands["hevc"] || brands["hevx"]:
+		return "heic"
+	case brands["avif"] || brands["avis"]:
+		return "avif"
+	case brands["mif1"] || brands["msf1"]:
+		return "heif"
+	case major == "crx ":
+		return "cr3"
+	case major == "qt  ":
+		return "mov"
+	}
+	return "mp4"
+}
+
+// isHEIF returns true if format (see fileFormat) is HEIC or
+// another format of HEIF that viewers may not be able to open.
+func isHEIF(format string) bool {
+	return format == "heic" || format == "heif"
+}
+
+// itemFormat returns the format of the file of dbi, as recorded
+// or, for items saved before formats were recorded, as told by
+// the file itself if its name says it may be a HEIC or HEIF file.
+func (r *Repository) itemFormat(dbi *dbItem) string {
+	if dbi.Format != "" {
+		return dbi.Format
+	}
+	switch strings.ToLower(filepath.Ext(dbi.FilePath)) {
+	case ".heic", ".heif", ".hif":
+		return fileFormat(r.fullPath(dbi.FilePath))
+	}
+	return ""
+}
+
+// isJPEGCompanion returns true if the repo-relative fpath is
+// named like the JPEG companion of a HEIC or HEIF file.
+func isJPEGCompanion(fpath string) bool {
+	if !strings.HasSuffix(fpath, JPEGCompanionExt) {
+		return false
+	}
+	switch strings.ToLower(filepath.Ext(strings.TrimSuffix(fpath, JPEGCompanionExt))) {
+	case ".heic", ".heif", ".hif":
+		return true
+	}
+	return false
+}
+
+// writeJPEGCompanions converts every HEIC or HEIF file in the
+// repository that has no JPEG companion, or whose companion is
+// older than it, with ConvertHEIC, and removes the companions
+// of files that are gone.
+func (r *Repository) writeJPEGCompanions() error {
+	accounts, err := r.db.storedAccounts()
+	if err != nil {
+		return fmt.Errorf("listing accounts: %v", err)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].String() < accounts[j].String() })
+
+	files := make(map[string]bool)   // the files of all items, by repo-relative path
+	want := make(map[string]*dbItem) // the item of each companion, by repo-relative path
+	for _, pa := range accounts {
+		itemIDs, err := r.db.itemIDs(pa)
+		if err != nil {
+			return err
+		}
+		sort.Strings(itemIDs)
+		for _, itemID := range itemIDs {
+			dbi, err := r.db.loadItem(pa.key(), itemID)
+			if err != nil {
+				return err
+			}
+			if dbi == nil || files[dbi.FilePath] {
+				continue
+			}
+			files[dbi.FilePath] = true
+			if isHEIF(r.itemFormat(dbi)) {
+				want[dbi.FilePath+JPEGCompanionExt] = dbi
+			}
+		}
+	}
+
+	for companionPath, dbi := range want {
+		if files[companionPath] {
+			continue // an item's file is there already
+		}
+		err := r.writeJPEGCompanion(dbi, companionPath)
+		if err != nil {
+			repoLog.Errorf("converting %s to JPEG: %v", dbi.FilePath, err)
+		}
+	}
+
+	root := filepath.Clean(r.path)
+	return filepath.Walk(root, func(fullPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		fpath := r.repoRelative(fullPath)
+		if info.IsDir() {
+			if fullPath != root && (isJunkFile(info.Name()) || fpath == QuarantineDir || fpath == ViewsDir || fpath == CertificatesDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if _, ok := want[fpath]; ok || files[fpath] || !isJPEGCompanion(fpath) {
+			return nil
+		}
+		repoLog.Infof("Removing JPEG companion %s", fpath)
+		return os.Remove(fullPath)
+	})
+}
+
+// writeJPEGCompanion converts the file of dbi to a JPEG at the
+// repo-relative companionPath, unless it is there already and
+// was written since the file was last changed or downloaded.
+func (r *Repository) writeJPEGCompanion(dbi *dbItem, companionPath string) error {
+	fpath := dbi.FilePath
+	info, err := os.Stat(r.fullPath(fpath))
+	if err != nil {
+		return err
+	}
+	fullPath := r.fullPath(companionPath)
+	if existing, err := os.Stat(fullPath); err == nil &&
+		!existing.ModTime().Before(info.ModTime()) && !existing.ModTime().Before(dbi.Saved) {
+		return nil
+	}
+
+	// the converter is given a path that ends in the extension
+	// of a JPEG, since some converters go by it
+	tmpPath := strings.TrimSuffix(fullPath, JPEGCompanionExt) + ".tmp" + JPEGCompanionExt
+	err = r.ConvertHEIC(r.fullPath(fpath), tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if fileFormat(tmpPath) != "jpeg" {
+		os.Remove(tmpPath)
+		return fmt.Errorf("the converter did not write a JPEG")
+	}
+	repoLog.Infof("Converted %s to JPEG", fpath)
+	if r.SyncFriendly {
+		return overwriteFile(tmpPath, fullPath)
+	}
+	return os.Rename(tmpPath, fullPath)
+}
@@ -0,0 +1,113 @@
+package photobak
+
+import (
+	"fmt"
+	"html"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Locale is the language of the messages meant for people, like
+// prompts and the page shown after authorizing an account, as a
+// language code such as "en" or "ru". It is detected from the
+// environment (see DetectLocale). Log messages are not translated.
+var Locale = DetectLocale()
+
+var (
+	catalogs   = make(map[string]map[string]string)
+	catalogsMu sync.RWMutex
+)
+
+// RegisterMessages adds translations of messages into the
+// language lang to its catalog. The catalog is keyed by the
+// English message, which is also the fallback if there is no
+// translation. Formatting verbs in a translation must match
+// those in the English message.
+func RegisterMessages(lang string, messages map[string]string) {
+	catalogsMu.Lock()
+	defer catalogsMu.Unlock()
+	if catalogs[lang] == nil {
+		catalogs[lang] = make(map[string]string)
+	}
+	for msg, translation := range messages {
+		catalogs[lang][msg] = translation
+	}
+}
+
+// Tr translates the English message msg into the language of
+// Locale, if there is a translation, and formats it with args
+// like fmt.Sprintf (unless there are no args).
+func Tr(msg string, args ...interface{}) string {
+	catalogsMu.RLock()
+	if translation, ok := catalogs[Locale][msg]; ok {
+		msg = translation
+	}
+	catalogsMu.RUnlock()
+	if len(args) == 0 {
+		return msg
+	}
+	return fmt.Sprintf(msg, args...)
+}
+
+// DetectLocale returns the language of the user according to
+// the LANGUAGE, LC_ALL, LC_MESSAGES, and LANG environment
+// variables, in that order, or "en" if none of them is set.
+// A value like "ru_RU.UTF-8" gives "ru".
+func DetectLocale() string {
+	for _, name := range []string{"LANGUAGE", "LC_ALL", "LC_MESSAGES", "LANG"} {
+		if lang := ParseLocale(os.Getenv(name)); lang != "" {
+			return lang
+		}
+	}
+	return "en"
+}
+
+// ParseLocale returns the language code of the locale
+// name, like "ru" for "ru_RU.UTF-8" or "pt-BR", or ""
+// if it doesn't name a language. If name is a list of
+// locales separated by colons, the first one is used.
+func ParseLocale(name string) string {
+	if i := strings.Index(name, ":"); i >= 0 {
+		name = name[:i]
+	}
+	if i := strings.IndexAny(name, "_-.@"); i >= 0 {
+		name = name[:i]
+	}
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "c" || name == "posix" {
+		return ""
+	}
+	return name
+}
+
+// AuthSuccessPage returns the HTML page that is shown in the
+// browser after an account has been authorized, in the
+// language of Locale.
+func AuthSuccessPage() string {
+	return fmt.Sprintf(authSuccessPage,
+		html.EscapeString(Locale),
+		html.EscapeString(Tr("Authorization Successful")),
+		html.EscapeString(Tr("Authorization successful, thank you!")),
+		html.EscapeString(Tr("You may now close this window and return to the program.")))
+}
+
+const authSuccessPage = `<!DOCTYPE html>
+<html lang="%s">
+	<head>
+		<title>%s</title>
+		<meta charset="utf-8">
+		<style>
+			body { text-align: center; padding: 5%%; font-family: sans-serif; }
+			h1 { font-size: 20px; }
+			p { font-size: 16px; color: #444; }
+		</style>
+	</head>
+	<body>
+		<h1>%s</h1>
+		<p>
+			%s
+		</p>
+	</body>
+</html>
+`
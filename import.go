@@ -0,0 +1,397 @@
+package photobak
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// LocalProvider is the name of the provider of the accounts
+// that local folders are imported into (see ImportFolder).
+// There is no such provider to back up from; the accounts
+// only hold what was imported.
+const LocalProvider = "local"
+
+// ImportReport summarizes an import of a local folder.
+type ImportReport struct {
+	Account  string
+	Files    int      // photos and videos found in the folder
+	Existing int      // files that were imported before
+	Added    int      // files copied into the repository
+	Deduped  int      // files whose content was already in the repository, so they weren't copied
+	Failed   []string // files that could not be imported, and why
+}
+
+// String returns a human-readable report.
+func (ir ImportReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Imported into %s:\n", ir.Account)
+	fmt.Fprintf(&b, "  Photos and videos:   %d\n", ir.Files)
+	fmt.Fprintf(&b, "  Already imported:    %d\n", ir.Existing)
+	fmt.Fprintf(&b, "  Copied:              %d\n", ir.Added)
+	fmt.Fprintf(&b, "  Already stored:      %d\n", ir.Deduped)
+	if len(ir.Failed) > 0 {
+		fmt.Fprintf(&b, "  Failed:              %d\n", len(ir.Failed))
+		for _, f := range ir.Failed {
+			fmt.Fprintf(&b, "    - %s\n", f)
+		}
+	}
+	return b.String()
+}
+
+// ImportFolder imports the photos and videos in the local folder
+// dir, and its subfolders, into the account LocalProvider:name of
+// the repository, so that they are kept with the backups of cloud
+// accounts. Each folder that has photos or videos becomes a
+// collection, named after the folder's path within dir.
+//
+// Files are hashed, and those whose content is already in the
+// repository, for any account, are not copied again; the item
+// refers to the existing file, as with duplicate downloads. EXIF
+// data is read like it is for downloads. Files that were imported
+// before are only added to the collections they weren't in, so
+// a folder can be imported again as it grows. Imported items are
+// LocalOnly, and nothing in dir is changed.
+func (r *Repository) ImportFolder(ctx context.Context, dir, name string) (ImportReport, error) {
+	pa := accountFromKey(LocalProvider, name)
+	report := ImportReport{Account: pa.String()}
+	if name == "" || strings.ContainsAny(name, `:/\`) {
+		return report, fmt.Errorf("bad account name '%s'", name)
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return report, err
+	}
+	if !info.IsDir() {
+		return report, fmt.Errorf("%s is not a folder", dir)
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return report, err
+	}
+	if inDir(dir, r.fullPath(".")) || dir == filepath.Clean(r.fullPath(".")) {
+		return report, fmt.Errorf("%s is in the repository", dir)
+	}
+
+	folders := make(map[string][]importedFile) // by slash-separated path within dir
+	err = filepath.Walk(dir, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if fpath != dir && (isJunkFile(info.Name()) || strings.HasPrefix(info.Name(), ".")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || !isMediaFile(info.Name()) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, filepath.Dir(fpath))
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		folders[rel] = append(folders[rel], importedFile{
+			path:    fpath,
+			name:    info.Name(),
+			modTime: info.ModTime(),
+			open:    func() (io.ReadCloser, error) { return os.Open(fpath) },
+		})
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("reading %s: %v", dir, err)
+	}
+
+	err = r.db.createAccount(pa)
+	if err != nil {
+		return report, err
+	}
+
+	r.beginChanges()
+	defer r.endChanges()
+
+	rels := make([]string, 0, len(folders))
+	for rel := range folders {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+
+	for _, rel := range rels {
+		collName := filepath.Base(dir)
+		if rel != "." {
+			collName = rel
+		}
+		for _, f := range folders[rel] {
+			if ctx.Err() != nil {
+				return report, ctx.Err()
+			}
+			report.Files++
+			err := r.importLocalFile(pa, collName, f, &report)
+			if err != nil {
+				repoLog.Errorf("importing %s: %v", f.path, err)
+				report.Failed = append(report.Failed, fmt.Sprintf("%s: %v", f.path, err))
+			}
+		}
+	}
+	return report, nil
+}
+
+// importLocalFile imports f into the collection of pa
+// named collName, which is created if needed.
+func (r *Repository) importLocalFile(pa providerAccount, collName string, f importedFile, report *ImportReport) error {
+	checksum, err := f.checksum(r.newHash())
+	if err != nil {
+		return fmt.Errorf("reading file: %v", err)
+	}
+	defer r.lockChecksum(checksum)()
+
+	coll, err := r.importCollection(pa, collName, collName, "")
+	if err != nil {
+		return err
+	}
+
+	itemID := hex.EncodeToString(checksum)
+	dbi, err := r.db.loadItem(pa.key(), itemID)
+	if err != nil {
+		return err
+	}
+	if dbi != nil {
+		report.Existing++
+		if _, ok := dbi.Collections[coll.id]; ok {
+			return nil
+		}
+		dbi.Collections[coll.id] = struct{}{}
+		if !inDir(dbi.FilePath, coll.dirPath) {
+			err := r.writeToMediaListFile(coll, dbi.FilePath)
+			if err != nil {
+				return fmt.Errorf("writing to media list file: %v", err)
+			}
+		}
+		return r.db.saveItem(pa.key(), dbi.ID, dbi)
+	}
+
+	sameItems, err := r.db.itemsWithChecksum(checksum)
+	if err != nil {
+		return err
+	}
+	dbi, err = r.importFile(pa, coll, localItem{id: itemID, name: f.name}, f, checksum, sameItems)
+	if err != nil {
+		return err
+	}
+	err = r.db.saveItem(pa.key(), dbi.ID, dbi)
+	if err != nil {
+		return fmt.Errorf("saving item to database: %v", err)
+	}
+	if len(sameItems) > 0 {
+		report.Deduped++
+	} else {
+		report.Added++
+	}
+	repoLog.Infof("Imported %s as %s", f.path, dbi.FilePath)
+	r.progress(ProgressEvent{Type: ItemCommitted, Account: pa.String(), ItemID: dbi.ID, FilePath: dbi.FilePath})
+	return nil
+}
+
+// importCollection returns pa's collection with the given ID,
+// creating it as a LocalOnly collection with the given name
+// and description if it doesn't exist yet.
+func (r *Repository) importCollection(pa providerAccount, id, name, description string) (collection, error) {
+	dbc, err := r.db.loadCollection(pa.key(), id)
+	if err != nil {
+		return collection{}, err
+	}
+	if dbc == nil {
+		dirName, err := r.reserveUniqueFilename(pa.accountPath(), strings.Replace(name, "/", " - ", -1), true)
+		if err != nil {
+			return collection{}, err
+		}
+		now := time.Now()
+		dbc = &dbCollection{
+			ID:         id,
+			Name:       name,
+			DirName:    dirName,
+			DirPath:    r.repoRelative(filepath.Join(pa.accountPath(), dirName)),
+			Saved:      now,
+			Active:     now,
+			Items:      make(map[string]struct{}),
+			Protection: LocalOnly,
+		}
+		dbc.Meta.Description = description
+		err = r.db.saveCollection(pa.key(), dbc.ID, dbc)
+		if err != nil {
+			return collection{}, fmt.Errorf("saving collection: %v", err)
+		}
+		repoLog.Infof("Created collection %s", dbc.DirPath)
+	}
+	return collection{
+		Collection: importedCollection{id: dbc.ID, name: dbc.Name},
+		id:         dbc.ID,
+		dirName:    dbc.DirName,
+		dirPath:    dbc.DirPath,
+	}, nil
+}
+
+// importFile returns a new LocalOnly item of pa for f, whose
+// content has the given checksum, as it in coll; the caller
+// saves it. The file is copied into the repository where it
+// would be downloaded to, unless sameItems (the items with
+// the same checksum) is not empty, in which case the item
+// refers to their file instead.
+func (r *Repository) importFile(pa providerAccount, coll collection, it Item, f importedFile, checksum []byte, sameItems []accountItem) (*dbItem, error) {
+	dbi := &dbItem{
+		ID:          it.ItemID(),
+		Name:        it.ItemName(),
+		Checksum:    checksum,
+		Saved:       time.Now(),
+		Collections: map[string]struct{}{coll.id: {}},
+		Protection:  LocalOnly,
+	}
+
+	// as with downloads, missing or bad EXIF data is OK
+	var x *exif.Exif
+	if rc, err := f.open(); err == nil {
+		x, _ = exif.Decode(rc)
+		rc.Close()
+	}
+
+	if len(sameItems) > 0 {
+		sameContent, err := r.db.loadItem(sameItems[0].AcctKey, sameItems[0].ItemID)
+		if err != nil {
+			return nil, err
+		}
+		if sameContent == nil {
+			return nil, fmt.Errorf("checksum index refers to missing item %s", sameItems[0].ItemID)
+		}
+		dbi.FilePath, dbi.FileName, dbi.PHash = sameContent.FilePath, sameContent.FileName, sameContent.PHash
+		err = r.writeToMediaListFile(coll, dbi.FilePath)
+		if err != nil {
+			return nil, fmt.Errorf("writing to media list file: %v", err)
+		}
+	} else {
+		t := itemTime(it)
+		if t.IsZero() && x != nil {
+			t, _ = x.DateTime()
+		}
+		targetPath, err := r.itemPath(pa, coll.dirName, it.ItemName(), it.ItemID(), t)
+		if err != nil {
+			return nil, err
+		}
+		targetDir := filepath.Dir(targetPath)
+		err = os.MkdirAll(r.fullPath(targetDir), 0700)
+		if err != nil {
+			return nil, fmt.Errorf("creating folder for item: %v", err)
+		}
+		fileName, err := r.reserveUniqueFilename(targetDir, filepath.Base(targetPath), false)
+		if err != nil {
+			return nil, fmt.Errorf("reserving unique filename: %v", err)
+		}
+		dbi.FileName = fileName
+		dbi.FilePath = r.repoRelative(filepath.Join(targetDir, fileName))
+		err = f.copyTo(r.fullPath(dbi.FilePath))
+		if err != nil {
+			os.Remove(r.fullPath(dbi.FilePath))
+			return nil, fmt.Errorf("copying file: %v", err)
+		}
+		if !f.modTime.IsZero() {
+			os.Chtimes(r.fullPath(dbi.FilePath), f.modTime, f.modTime)
+		}
+		dbi.PHash = imageHash(r.fullPath(dbi.FilePath))
+		if !inDir(dbi.FilePath, coll.dirPath) {
+			err := r.writeToMediaListFile(coll, dbi.FilePath)
+			if err != nil {
+				return nil, fmt.Errorf("writing to media list file: %v", err)
+			}
+		}
+	}
+
+	dbi.Format = fileFormat(r.fullPath(dbi.FilePath))
+	dbi.Meta.Setting, _ = r.getSettingFromEXIF(x)
+	dbi.Meta.Caption = it.ItemCaption()
+	describe(&dbi.Meta, it, x)
+	if x == nil {
+		vm, _ := readVideoMeta(r.fullPath(dbi.FilePath))
+		describeVideo(&dbi.Meta, vm)
+	}
+	r.recordFileStat(dbi)
+	return dbi, nil
+}
+
+// isMediaFile returns true if the file named name
+// is a photo or video, according to its extension.
+func isMediaFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".bmp", ".tif", ".tiff", ".webp", ".heic", ".heif",
+		".dng", ".cr2", ".cr3", ".nef", ".arw", ".orf", ".rw2", ".raf":
+		return true
+	}
+	return isVideo(name)
+}
+
+// importedCollection is a collection that was
+// imported rather than listed by a provider.
+type importedCollection struct{ id, name string }
+
+func (ic importedCollection) CollectionID() string   { return ic.id }
+func (ic importedCollection) CollectionName() string { return ic.name }
+
+// localItem is a file in a local folder as an Item.
+type localItem struct{ id, name string }
+
+func (li localItem) ItemID() string      { return li.id }
+func (li localItem) ItemName() string    { return li.name }
+func (li localItem) ItemETag() string    { return "" }
+func (li localItem) ItemCaption() string { return "" }
+
+// importedFile is a file outside the
+// repository that is being imported.
+type importedFile struct {
+	path    string // where it is, for messages
+	name    string
+	modTime time.Time
+	open    func() (io.ReadCloser, error)
+}
+
+// checksum returns the checksum of the file's content made with h,
+// which should be new and of the repository's checksum algorithm.
+func (f importedFile) checksum(h hash.Hash) ([]byte, error) {
+	rc, err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	_, err = io.Copy(h, rc)
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// copyTo copies the file's content to the file at fullPath.
+func (f importedFile) copyTo(fullPath string) error {
+	rc, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	out, err := os.Create(fullPath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, rc)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
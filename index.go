@@ -0,0 +1,359 @@
+package photobak
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// The formats the index can be exported in (see ExportIndex).
+const (
+	IndexJSON = "json" // one JSON object with an array of rows for each table
+	IndexCSV  = "csv"  // a folder with a CSV file for each table
+	IndexSQL  = "sql"  // SQL statements that create and fill the tables, for SQLite
+)
+
+// indexTable is a table of the exported index.
+type indexTable struct {
+	name    string
+	columns []indexColumn
+	rows    [][]interface{} // each value is a string, int64, float64, bool, or nil
+}
+
+// indexColumn is a column of an indexTable
+// and its type in SQL (TEXT, INTEGER, or REAL).
+type indexColumn struct {
+	name, sqlType string
+}
+
+// ExportIndex writes what the database knows about the repository
+// in an open format, so that it can be queried with standard tools.
+// There are four tables: collections, items, collection_items (which
+// item is in which collection, at which position if it is known),
+// and checksums (which items have which content). Times are in
+// RFC 3339 format, and checksums and perceptual hashes are in hex.
+//
+// The format is one of IndexJSON, IndexSQL, or IndexCSV. For JSON
+// and SQL, the index is written to w; for CSV, a file for each
+// table is written into the folder dir, which is created if needed.
+// Nothing in the repository is changed.
+func (r *Repository) ExportIndex(format string, w io.Writer, dir string) error {
+	tables, err := r.indexTables()
+	if err != nil {
+		return err
+	}
+	switch format {
+	case IndexJSON:
+		return writeIndexJSON(w, tables)
+	case IndexSQL:
+		return writeIndexSQL(w, tables)
+	case IndexCSV:
+		return writeIndexCSV(dir, tables)
+	}
+	return fmt.Errorf("unknown index format '%s': must be %s, %s, or %s", format, IndexJSON, IndexSQL, IndexCSV)
+}
+
+// indexTables reads the tables of the index from the database.
+func (r *Repository) indexTables() ([]*indexTable, error) {
+	collections := &indexTable{name: "collections", columns: []indexColumn{
+		{"account", "TEXT"}, {"id", "TEXT"}, {"name", "TEXT"}, {"dir_path", "TEXT"},
+		{"description", "TEXT"}, {"cover_item_id", "TEXT"}, {"saved", "TEXT"}, {"active", "TEXT"},
+		{"completed", "TEXT"}, {"protection", "TEXT"}, {"items", "INTEGER"},
+	}}
+	items := &indexTable{name: "items", columns: []indexColumn{
+		{"account", "TEXT"}, {"id", "TEXT"}, {"name", "TEXT"}, {"file_name", "TEXT"}, {"file_path", "TEXT"},
+		{"checksum", "TEXT"}, {"size", "INTEGER"}, {"remote_size", "INTEGER"}, {"mod_time", "TEXT"},
+		{"format", "TEXT"}, {"phash", "TEXT"}, {"etag", "TEXT"}, {"change_key", "TEXT"}, {"change_strategy", "TEXT"}, {"saved", "TEXT"},
+		{"caption", "TEXT"}, {"taken", "TEXT"}, {"camera", "TEXT"}, {"favorite", "INTEGER"},
+		{"latitude", "REAL"}, {"longitude", "REAL"}, {"altitude", "REAL"}, {"duration", "REAL"}, {"codec", "TEXT"},
+		{"protection", "TEXT"}, {"trashed", "TEXT"}, {"live_pair", "TEXT"},
+	}}
+	collectionItems := &indexTable{name: "collection_items", columns: []indexColumn{
+		{"account", "TEXT"}, {"collection_id", "TEXT"}, {"item_id", "TEXT"}, {"position", "INTEGER"},
+	}}
+	checksums := &indexTable{name: "checksums", columns: []indexColumn{
+		{"checksum", "TEXT"}, {"account", "TEXT"}, {"item_id", "TEXT"},
+	}}
+
+	accounts, err := r.db.storedAccounts()
+	if err != nil {
+		return nil, fmt.Errorf("listing accounts: %v", err)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].String() < accounts[j].String() })
+
+	for _, pa := range accounts {
+		collIDs, err := r.db.collectionIDs(pa)
+		if err != nil {
+			return nil, err
+		}
+		for _, collID := range collIDs {
+			dbc, err := r.db.loadCollection(pa.key(), collID)
+			if err != nil {
+				return nil, err
+			}
+			if dbc == nil {
+				continue
+			}
+			collections.rows = append(collections.rows, []interface{}{
+				pa.String(), dbc.ID, dbc.Name, filepath.ToSlash(dbc.DirPath),
+				indexString(dbc.Meta.Description), indexString(dbc.Meta.Cover),
+				indexTime(dbc.Saved), indexTime(dbc.Active),
+				indexTime(dbc.Completed), dbc.Protection.String(), int64(len(dbc.Items)),
+			})
+
+			positions := make(map[string]int64)
+			for i, itemID := range dbc.Order {
+				if _, ok := positions[itemID]; !ok {
+					positions[itemID] = int64(i + 1)
+				}
+			}
+			itemIDs := make([]string, 0, len(dbc.Items))
+			for itemID := range dbc.Items {
+				itemIDs = append(itemIDs, itemID)
+			}
+			sort.Strings(itemIDs)
+			for _, itemID := range itemIDs {
+				var position interface{}
+				if pos, ok := positions[itemID]; ok {
+					position = pos
+				}
+				collectionItems.rows = append(collectionItems.rows, []interface{}{pa.String(), dbc.ID, itemID, position})
+			}
+		}
+
+		itemIDs, err := r.db.itemIDs(pa)
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(itemIDs)
+		for _, itemID := range itemIDs {
+			dbi, err := r.db.loadItem(pa.key(), itemID)
+			if err != nil {
+				return nil, err
+			}
+			if dbi == nil {
+				continue
+			}
+			var lat, lon, alt interface{}
+			if s := dbi.Meta.Setting; s != nil && (s.Latitude != 0 || s.Longitude != 0) {
+				lat, lon, alt = s.Latitude, s.Longitude, s.Altitude
+			}
+			items.rows = append(items.rows, []interface{}{
+				pa.String(), dbi.ID, dbi.Name, dbi.FileName, filepath.ToSlash(dbi.FilePath),
+				indexHex(dbi.Checksum), dbi.Size, indexSize(dbi.RemoteSize), indexTime(dbi.ModTime),
+				indexString(dbi.Format), indexHex(dbi.PHash),
+				indexString(dbi.ETag), indexString(dbi.ChangeKey), indexString(dbi.ChangeStrategy), indexTime(dbi.Saved),
+				indexString(dbi.Meta.Caption), indexTime(itemTaken(dbi)), indexString(dbi.Meta.Camera), dbi.Meta.Favorite,
+				lat, lon, alt, indexDuration(dbi.Meta.Duration), indexString(dbi.Meta.Codec),
+				dbi.Protection.String(), indexTime(dbi.Trashed), indexString(dbi.LivePair),
+			})
+		}
+	}
+
+	err = r.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("checksums"))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var list []accountItem
+			err := gobDecode(v, &list)
+			if err != nil {
+				return fmt.Errorf("decoding items with checksum %x: %v", k, err)
+			}
+			for _, ai := range list {
+				checksums.rows = append(checksums.rows, []interface{}{hex.EncodeToString(k), string(ai.AcctKey), ai.ItemID})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading checksums: %v", err)
+	}
+
+	return []*indexTable{collections, items, collectionItems, checksums}, nil
+}
+
+// indexString returns s, or nil if it is empty.
+func indexString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// indexTime returns t in RFC 3339 format, or nil if it is zero.
+func indexTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.Format(time.RFC3339)
+}
+
+// indexSize returns n, or nil if it is not
+// positive (that is, if the size is unknown).
+func indexSize(n int64) interface{} {
+	if n <= 0 {
+		return nil
+	}
+	return n
+}
+
+// indexDuration returns d in seconds, or nil if it is zero.
+func indexDuration(d time.Duration) interface{} {
+	if d <= 0 {
+		return nil
+	}
+	return d.Seconds()
+}
+
+// indexHex returns b in hex, or nil if it is empty.
+func indexHex(b []byte) interface{} {
+	if len(b) == 0 {
+		return nil
+	}
+	return hex.EncodeToString(b)
+}
+
+// writeIndexJSON writes tables to w as one JSON object, with
+// an array for each table of an object for each row.
+func writeIndexJSON(w io.Writer, tables []*indexTable) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("{")
+	for i, t := range tables {
+		if i > 0 {
+			bw.WriteString(",")
+		}
+		fmt.Fprintf(bw, "\n\t%q: [", t.name)
+		for j, row := range t.rows {
+			obj := make(map[string]interface{}, len(row))
+			for k, col := range t.columns {
+				obj[col.name] = row[k]
+			}
+			enc, err := json.Marshal(obj)
+			if err != nil {
+				return err
+			}
+			if j > 0 {
+				bw.WriteString(",")
+			}
+			bw.WriteString("\n\t\t")
+			bw.Write(enc)
+		}
+		if len(t.rows) > 0 {
+			bw.WriteString("\n\t")
+		}
+		bw.WriteString("]")
+	}
+	bw.WriteString("\n}\n")
+	return bw.Flush()
+}
+
+// writeIndexSQL writes tables to w as SQL statements that
+// create them and insert their rows, in one transaction.
+func writeIndexSQL(w io.Writer, tables []*indexTable) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("BEGIN TRANSACTION;\n")
+	for _, t := range tables {
+		cols := make([]string, len(t.columns))
+		for i, col := range t.columns {
+			cols[i] = col.name + " " + col.sqlType
+		}
+		fmt.Fprintf(bw, "DROP TABLE IF EXISTS %s;\nCREATE TABLE %s (%s);\n", t.name, t.name, strings.Join(cols, ", "))
+		for _, row := range t.rows {
+			vals := make([]string, len(row))
+			for i, v := range row {
+				vals[i] = sqlValue(v)
+			}
+			fmt.Fprintf(bw, "INSERT INTO %s VALUES (%s);\n", t.name, strings.Join(vals, ", "))
+		}
+	}
+	bw.WriteString("CREATE INDEX items_checksum ON items (checksum);\n")
+	bw.WriteString("CREATE INDEX collection_items_item ON collection_items (account, item_id);\n")
+	bw.WriteString("COMMIT;\n")
+	return bw.Flush()
+}
+
+// sqlValue returns v as an SQL literal.
+func sqlValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return "'" + strings.Replace(v, "'", "''", -1) + "'"
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	}
+	panic(fmt.Sprintf("unexpected type %T in index", v))
+}
+
+// writeIndexCSV writes each of tables to a CSV file named
+// after it in the folder dir, with a header row. Missing
+// values are empty.
+func writeIndexCSV(dir string, tables []*indexTable) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	for _, t := range tables {
+		err := writeIndexCSVFile(filepath.Join(dir, t.name+".csv"), t)
+		if err != nil {
+			return fmt.Errorf("writing %s: %v", t.name, err)
+		}
+	}
+	return nil
+}
+
+// writeIndexCSVFile writes t to a CSV file at fpath.
+func writeIndexCSVFile(fpath string, t *indexTable) error {
+	f, err := os.Create(fpath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cw := csv.NewWriter(f)
+	header := make([]string, len(t.columns))
+	for i, col := range t.columns {
+		header[i] = col.name
+	}
+	cw.Write(header)
+	for _, row := range t.rows {
+		record := make([]string, len(row))
+		for i, v := range row {
+			switch v := v.(type) {
+			case nil:
+			case string:
+				record[i] = v
+			case bool:
+				record[i] = strconv.FormatBool(v)
+			default:
+				record[i] = sqlValue(v)
+			}
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
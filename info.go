@@ -0,0 +1,267 @@
+package photobak
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ItemInfo is everything the index knows about an item.
+type ItemInfo struct {
+	Account        string               `json:"account"`
+	ID             string               `json:"id"`
+	Aliases        []string             `json:"aliases,omitempty"` // other IDs the provider has given the item
+	Name           string               `json:"name"`
+	FilePath       string               `json:"file_path"` // relative to the repository
+	Collections    []ItemInfoCollection `json:"collections"`
+	Checksum       string               `json:"checksum"`
+	Size           int64                `json:"size"`
+	RemoteSize     int64                `json:"remote_size,omitempty"` // as the provider listed it, if it did
+	ModTime        time.Time            `json:"mod_time"`
+	Format         string               `json:"format,omitempty"` // like jpeg or heic, by the file's content
+	PHash          string               `json:"phash,omitempty"`
+	ETag           string               `json:"etag,omitempty"`
+	ChangeKey      string               `json:"change_key,omitempty"`
+	ChangeStrategy string               `json:"change_strategy,omitempty"`
+	Saved          time.Time            `json:"saved"`
+	Caption        string               `json:"caption,omitempty"`
+	Taken          *time.Time           `json:"taken,omitempty"`
+	Camera         string               `json:"camera,omitempty"`
+	Favorite       bool                 `json:"favorite,omitempty"`
+	Duration       float64              `json:"duration,omitempty"` // in seconds, for videos
+	Codec          string               `json:"codec,omitempty"`    // for videos
+	Setting        *ItemInfoSetting     `json:"setting,omitempty"`
+	Protection     string               `json:"protection"`
+	LivePair       string               `json:"live_pair,omitempty"` // the ID of the other half of its live photo
+	Trashed        *time.Time           `json:"trashed,omitempty"`
+
+	// API is everything the provider's API said about the
+	// item, if it was stored (see the saveEverything argument
+	// of Store); APIError says why it could not be read.
+	API      interface{} `json:"api,omitempty"`
+	APIError string      `json:"api_error,omitempty"`
+}
+
+// ItemInfoCollection is a collection an item is in.
+type ItemInfoCollection struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	DirPath string `json:"dir_path"`
+}
+
+// ItemInfoSetting is where and when an item was taken,
+// according to its EXIF data or, for videos, their metadata.
+type ItemInfoSetting struct {
+	Latitude   float64   `json:"latitude"`
+	Longitude  float64   `json:"longitude"`
+	Altitude   float64   `json:"altitude,omitempty"`
+	OriginTime time.Time `json:"origin_time"`
+}
+
+// String returns a human-readable description of the item.
+func (ii ItemInfo) String() string {
+	var b strings.Builder
+	field := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(&b, "%-16s %s\n", name+":", value)
+		}
+	}
+	timeField := func(name string, t time.Time) {
+		if !t.IsZero() {
+			field(name, t.Format(time.RFC3339))
+		}
+	}
+
+	field("Account", ii.Account)
+	field("ID", ii.ID)
+	field("Aliases", strings.Join(ii.Aliases, ", "))
+	field("Name", ii.Name)
+	field("File", ii.FilePath)
+	for i, c := range ii.Collections {
+		label := ""
+		if i == 0 {
+			label = "Collections:"
+		}
+		fmt.Fprintf(&b, "%-16s %s (%s, ID %s)\n", label, c.Name, c.DirPath, c.ID)
+	}
+	field("Checksum", ii.Checksum)
+	field("Size", fmt.Sprintf("%d bytes", ii.Size))
+	if ii.RemoteSize > 0 {
+		field("Listed size", fmt.Sprintf("%d bytes", ii.RemoteSize))
+	}
+	timeField("Modified", ii.ModTime)
+	field("Format", ii.Format)
+	field("Perceptual hash", ii.PHash)
+	field("ETag", ii.ETag)
+	if ii.ChangeKey != "" {
+		field("Change key", fmt.Sprintf("%s (%s)", ii.ChangeKey, ii.ChangeStrategy))
+	}
+	timeField("Saved", ii.Saved)
+	field("Caption", ii.Caption)
+	if ii.Taken != nil {
+		timeField("Taken", *ii.Taken)
+	}
+	field("Camera", ii.Camera)
+	if ii.Favorite {
+		field("Favorite", "yes")
+	}
+	if ii.Duration > 0 {
+		field("Duration", time.Duration(ii.Duration*float64(time.Second)).Round(time.Second/10).String())
+	}
+	field("Codec", ii.Codec)
+	if s := ii.Setting; s != nil {
+		field("Location", fmt.Sprintf("%f, %f (altitude %.1f m)", s.Latitude, s.Longitude, s.Altitude))
+		timeField("Time in file", s.OriginTime)
+	}
+	field("Protection", ii.Protection)
+	field("Live photo with", ii.LivePair)
+	if ii.Trashed != nil {
+		timeField("In trash since", *ii.Trashed)
+	}
+	if ii.API != nil {
+		api, err := json.MarshalIndent(ii.API, "", "  ")
+		if err != nil {
+			api = []byte(fmt.Sprintf("%+v", ii.API))
+		}
+		fmt.Fprintf(&b, "API data:\n%s\n", api)
+	}
+	field("API data", ii.APIError)
+	return b.String()
+}
+
+// ItemInfo returns everything known about the items that ref
+// refers to. ref is the path of an item's file, absolute or
+// relative to the repository or the current directory, or an
+// item ID (or an alias of one). Several items may share a
+// file, and items of different accounts may have the same ID.
+func (r *Repository) ItemInfo(ref string) ([]ItemInfo, error) {
+	accounts, err := r.db.storedAccounts()
+	if err != nil {
+		return nil, fmt.Errorf("listing accounts: %v", err)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].String() < accounts[j].String() })
+
+	relPath, pathErr := r.toRepoRelative(ref)
+
+	var infos []ItemInfo
+	for _, pa := range accounts {
+		aliases, err := r.db.loadIDAliases(pa)
+		if err != nil {
+			return nil, fmt.Errorf("loading aliases: %v", err)
+		}
+
+		var found []*dbItem
+		if pathErr == nil {
+			itemIDs, err := r.db.itemIDs(pa)
+			if err != nil {
+				return nil, err
+			}
+			sort.Strings(itemIDs)
+			for _, itemID := range itemIDs {
+				dbi, err := r.db.loadItem(pa.key(), itemID)
+				if err != nil {
+					return nil, err
+				}
+				if dbi != nil && dbi.FilePath == relPath {
+					found = append(found, dbi)
+				}
+			}
+		}
+		if len(found) == 0 {
+			dbi, err := r.db.loadItem(pa.key(), aliases.item(ref))
+			if err != nil {
+				return nil, err
+			}
+			if dbi != nil {
+				found = append(found, dbi)
+			}
+		}
+
+		for _, dbi := range found {
+			info, err := r.itemInfo(pa, dbi, aliases)
+			if err != nil {
+				return nil, err
+			}
+			infos = append(infos, info)
+		}
+	}
+	if len(infos) == 0 {
+		return nil, fmt.Errorf("no item has the file or ID '%s'", ref)
+	}
+	return infos, nil
+}
+
+// itemInfo returns what is known about dbi, which belongs to pa.
+func (r *Repository) itemInfo(pa providerAccount, dbi *dbItem, aliases idAliases) (ItemInfo, error) {
+	info := ItemInfo{
+		Account:        pa.String(),
+		ID:             dbi.ID,
+		Name:           dbi.Name,
+		FilePath:       dbi.FilePath,
+		Checksum:       hex.EncodeToString(dbi.Checksum),
+		Size:           dbi.Size,
+		RemoteSize:     dbi.RemoteSize,
+		Format:         dbi.Format,
+		ModTime:        dbi.ModTime,
+		PHash:          hex.EncodeToString(dbi.PHash),
+		ETag:           dbi.ETag,
+		ChangeKey:      dbi.ChangeKey,
+		ChangeStrategy: dbi.ChangeStrategy,
+		Saved:          dbi.Saved,
+		Caption:        dbi.Meta.Caption,
+		Camera:         dbi.Meta.Camera,
+		Favorite:       dbi.Meta.Favorite,
+		Duration:       dbi.Meta.Duration.Seconds(),
+		Codec:          dbi.Meta.Codec,
+		Protection:     dbi.Protection.String(),
+		LivePair:       dbi.LivePair,
+	}
+	for alias, itemID := range aliases.items {
+		if itemID == dbi.ID {
+			info.Aliases = append(info.Aliases, alias)
+		}
+	}
+	sort.Strings(info.Aliases)
+	if taken := itemTaken(dbi); !taken.IsZero() {
+		info.Taken = &taken
+	}
+	if s := dbi.Meta.Setting; s != nil {
+		info.Setting = &ItemInfoSetting{
+			Latitude:   s.Latitude,
+			Longitude:  s.Longitude,
+			Altitude:   s.Altitude,
+			OriginTime: s.OriginTime,
+		}
+	}
+	if !dbi.Trashed.IsZero() {
+		info.Trashed = &dbi.Trashed
+	}
+
+	collIDs := make([]string, 0, len(dbi.Collections))
+	for collID := range dbi.Collections {
+		collIDs = append(collIDs, collID)
+	}
+	sort.Strings(collIDs)
+	for _, collID := range collIDs {
+		dbc, err := r.db.loadCollection(pa.key(), collID)
+		if err != nil {
+			return info, err
+		}
+		ic := ItemInfoCollection{ID: collID}
+		if dbc != nil {
+			ic.Name, ic.DirPath = dbc.Name, dbc.DirPath
+		}
+		info.Collections = append(info.Collections, ic)
+	}
+
+	api, err := r.itemAPI(pa.key(), dbi.ID)
+	if err != nil {
+		info.APIError = err.Error()
+	} else if api != nil {
+		info.API = api
+	}
+	return info, nil
+}
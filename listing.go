@@ -0,0 +1,183 @@
+package photobak
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// cachedListing is what was listed in a collection: the IDs
+// its items are stored under, and when they were listed.
+type cachedListing struct {
+	Listed time.Time
+	Items  idSet
+}
+
+// listedItem is an item as it was listed during a run
+// of Store: its ID and, if any, its previous ID (see
+// PreviousIDer).
+type listedItem struct {
+	id, prevID string
+}
+
+// newListedItem returns the listed item for it.
+func newListedItem(it Item) listedItem {
+	li := listedItem{id: it.ItemID()}
+	if pi, ok := it.(PreviousIDer); ok {
+		li.prevID = pi.PreviousItemID()
+	}
+	return li
+}
+
+// Sync stores new and changed items like Store, and then, if that
+// was successful, prunes like Prune, but without listing again the
+// collections whose items Store listed completely.
+func (r *Repository) Sync(ctx context.Context, saveEverything bool, checkIntegrity bool) error {
+	started := time.Now()
+	err := r.Store(ctx, saveEverything, checkIntegrity)
+	if err != nil {
+		return err
+	}
+	since := started
+	if r.ListingMaxAge > 0 && started.Add(-r.ListingMaxAge).Before(since) {
+		since = started.Add(-r.ListingMaxAge)
+	}
+	return r.prune(ctx, since)
+}
+
+// saveListings caches the items that were listed in those of
+// ar's collections whose items were listed completely, as of
+// when the run started. The cached listings of collections that
+// items were added to without listing them completely are
+// dropped, since they lack those items.
+func (r *Repository) saveListings(ar accountRun, started time.Time) error {
+	aliases, err := r.db.loadIDAliases(ar.ac.account)
+	if err != nil {
+		return fmt.Errorf("loading aliases: %v", err)
+	}
+	listings := make(map[string]cachedListing)
+	var stale []string
+	for _, coll := range ar.collections {
+		run := ar.runs[coll.CollectionID()]
+		if run == nil || run.id == "" {
+			continue
+		}
+		if !run.wasListed() {
+			if run.wasActive() {
+				stale = append(stale, run.id)
+			}
+			continue
+		}
+		ids := make(idSet, len(run.items))
+		for _, li := range run.items {
+			ids[aliases.item(li.id)] = struct{}{}
+			if li.prevID != "" {
+				ids[li.prevID] = struct{}{}
+			}
+		}
+		listings[run.id] = cachedListing{Listed: started, Items: ids}
+	}
+	if len(stale) > 0 {
+		err := r.db.dropListings(ar.ac.account, stale)
+		if err != nil {
+			return err
+		}
+	}
+	if len(listings) == 0 {
+		return nil
+	}
+	return r.db.saveListings(ar.ac.account, listings, nil)
+}
+
+// loadListings returns pa's cached listings,
+// keyed by the ID their collection is stored under.
+func (db *boltDB) loadListings(pa providerAccount) (map[string]cachedListing, error) {
+	listings := make(map[string]cachedListing)
+	err := db.View(func(tx *bolt.Tx) error {
+		accountBucket := tx.Bucket(pa.key())
+		if accountBucket == nil {
+			return fmt.Errorf("account '%s' does not exist in DB", pa)
+		}
+		b := accountBucket.Bucket([]byte("listings"))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var cl cachedListing
+			err := gobDecode(v, &cl)
+			if err != nil {
+				return fmt.Errorf("decoding listing of collection %s: %v", k, err)
+			}
+			listings[string(k)] = cl
+			return nil
+		})
+	})
+	return listings, err
+}
+
+// saveListings saves pa's listings, keyed by the ID their
+// collection is stored under. If keep is not nil, the cached
+// listings of collections that are not in it are deleted.
+func (db *boltDB) saveListings(pa providerAccount, listings map[string]cachedListing, keep idSet) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		accountBucket := tx.Bucket(pa.key())
+		if accountBucket == nil {
+			return fmt.Errorf("account '%s' does not exist in DB", pa)
+		}
+		b, err := accountBucket.CreateBucketIfNotExists([]byte("listings"))
+		if err != nil {
+			return err
+		}
+		if keep != nil {
+			var gone [][]byte
+			err := b.ForEach(func(k, _ []byte) error {
+				if _, ok := keep[string(k)]; !ok {
+					gone = append(gone, append([]byte(nil), k...))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, k := range gone {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		for collID, cl := range listings {
+			enc, err := gobEncode(cl)
+			if err != nil {
+				return err
+			}
+			err = b.Put([]byte(collID), enc)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// dropListings deletes the cached listings of pa's
+// collections that are stored under collIDs.
+func (db *boltDB) dropListings(pa providerAccount, collIDs []string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		accountBucket := tx.Bucket(pa.key())
+		if accountBucket == nil {
+			return fmt.Errorf("account '%s' does not exist in DB", pa)
+		}
+		b := accountBucket.Bucket([]byte("listings"))
+		if b == nil {
+			return nil
+		}
+		for _, collID := range collIDs {
+			if err := b.Delete([]byte(collID)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,256 @@
+package photobak
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// livePhotoKey returns what the names of the still and
+// the video of a live photo (or motion photo) have in
+// common, like "img_1234" for "IMG_1234.HEIC" and
+// "IMG_1234.MOV".
+func livePhotoKey(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, filepath.Ext(name)))
+}
+
+// isStill returns true if the file named name is a photo.
+func isStill(name string) bool {
+	return isMediaFile(name) && !isVideo(name)
+}
+
+// pairLivePhotos pairs the stills and videos of live photos
+// in those of ar's collections that were processed: Apple and
+// Google give them as a photo and a video with the same name
+// but for the extension, like "IMG_1234.HEIC" and "IMG_1234.MOV".
+// The items of a pair refer to each other (see dbItem.LivePair),
+// and the file of the video is renamed to be named like the file
+// of the still, if it can be, so that the two are next to each
+// other. Names that more than one photo or video of a collection
+// have are not paired, since it can't be told which go together.
+func (r *Repository) pairLivePhotos(ar accountRun) error {
+	pa := ar.ac.account
+	for _, coll := range ar.collections {
+		run := ar.runs[coll.CollectionID()]
+		if run == nil || run.id == "" {
+			continue
+		}
+		dbc, err := r.db.loadCollection(pa.key(), run.id)
+		if err != nil {
+			return err
+		}
+		if dbc == nil {
+			continue
+		}
+		err = r.pairCollectionLivePhotos(pa, dbc)
+		if err != nil {
+			return fmt.Errorf("collection %s: %v", dbc.Name, err)
+		}
+	}
+	return nil
+}
+
+// pairCollectionLivePhotos pairs the live photos of pa's
+// collection dbc (see pairLivePhotos).
+func (r *Repository) pairCollectionLivePhotos(pa providerAccount, dbc *dbCollection) error {
+	itemIDs := make([]string, 0, len(dbc.Items))
+	for itemID := range dbc.Items {
+		itemIDs = append(itemIDs, itemID)
+	}
+	sort.Strings(itemIDs)
+
+	stills, videos := make(map[string]*dbItem), make(map[string]*dbItem)
+	ambiguous := make(map[string]bool)
+	var paired, allStills []*dbItem
+	for _, itemID := range itemIDs {
+		dbi, err := r.db.loadItem(pa.key(), itemID)
+		if err != nil {
+			return err
+		}
+		if dbi == nil {
+			continue
+		}
+		if dbi.LivePair != "" {
+			paired = append(paired, dbi)
+		}
+		byKey := stills
+		if isVideo(dbi.Name) {
+			byKey = videos
+		} else if isStill(dbi.Name) {
+			allStills = append(allStills, dbi)
+		} else {
+			continue
+		}
+		key := livePhotoKey(dbi.Name)
+		if _, ok := byKey[key]; ok {
+			ambiguous[key] = true
+		}
+		byKey[key] = dbi
+	}
+
+	// items whose other half is gone are no longer paired
+	for _, dbi := range paired {
+		other, err := r.db.loadItem(pa.key(), dbi.LivePair)
+		if err != nil {
+			return err
+		}
+		if other != nil && other.LivePair == dbi.ID {
+			continue
+		}
+		dbi.LivePair = ""
+		err = r.db.saveItem(pa.key(), dbi.ID, dbi)
+		if err != nil {
+			return err
+		}
+	}
+
+	keys := make([]string, 0, len(stills))
+	for key := range stills {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		still, video := stills[key], videos[key]
+		if video == nil || ambiguous[key] {
+			continue
+		}
+		if still.LivePair != video.ID || video.LivePair != still.ID {
+			if still.LivePair != "" || video.LivePair != "" {
+				continue // paired with others
+			}
+			still.LivePair, video.LivePair = video.ID, still.ID
+			if err := r.db.saveItem(pa.key(), still.ID, still); err != nil {
+				return err
+			}
+			if err := r.db.saveItem(pa.key(), video.ID, video); err != nil {
+				return err
+			}
+			repoLog.Infof("Paired %s and %s as a live photo", still.FilePath, video.FilePath)
+		}
+	}
+
+	// the video of each live photo goes with its still, even
+	// if one of them was renamed since they were paired
+	for _, still := range allStills {
+		if still.LivePair == "" {
+			continue
+		}
+		video, err := r.db.loadItem(pa.key(), still.LivePair)
+		if err != nil {
+			return err
+		}
+		if video == nil || video.LivePair != still.ID {
+			continue
+		}
+		err = r.placeLiveVideo(pa, still, video)
+		if err != nil {
+			repoLog.Errorf("putting %s next to %s: %v", video.FilePath, still.FilePath, err)
+		}
+	}
+	return nil
+}
+
+// placeLiveVideo renames the file of video, the video of the live
+// photo whose still is still, to be named like the still's file, if
+// both files are their own and in the same folder. If the name is
+// taken, the file keeps its name.
+func (r *Repository) placeLiveVideo(pa providerAccount, still, video *dbItem) error {
+	dir := filepath.Dir(video.FilePath)
+	if filepath.Base(still.FilePath) != still.FileName || filepath.Base(video.FilePath) != video.FileName ||
+		filepath.Dir(still.FilePath) != dir {
+		return nil
+	}
+	want := strings.TrimSuffix(still.FileName, filepath.Ext(still.FileName)) + filepath.Ext(video.FileName)
+	if strings.EqualFold(want, video.FileName) {
+		return nil
+	}
+	fileName, err := r.reserveUniqueFilename(dir, want, false)
+	if err != nil {
+		return fmt.Errorf("reserving filename: %v", err)
+	}
+	if fileName != SafeFilename(want) {
+		return os.Remove(r.fullPath(filepath.Join(dir, fileName)))
+	}
+	oldPath := video.FilePath
+	err = r.moveItemFile(pa, video, fileName)
+	if err != nil {
+		return err
+	}
+	repoLog.Infof("Renamed %s to %s to go with its still", oldPath, fileName)
+	return nil
+}
+
+// keptLivePair returns the other half of the live photo of pa's
+// item dbi, which is no longer listed in the collection whose
+// listing is listed, if that half is still listed there, in the
+// provider's trash (see trash), or protected. A still and its video
+// are one photo, so dbi is kept along with it; the two are pruned
+// together once neither is. It returns nil if dbi isn't paired or
+// its other half is gone as well.
+func (r *Repository) keptLivePair(pa providerAccount, dbi *dbItem, listed, trash idSet) (*dbItem, error) {
+	if dbi.LivePair == "" {
+		return nil, nil
+	}
+	other, err := r.db.loadItem(pa.key(), dbi.LivePair)
+	if err != nil || other == nil || other.LivePair != dbi.ID {
+		return nil, err
+	}
+	_, isListed := listed[other.ID]
+	_, inTrash := trash[other.ID]
+	if isListed || inTrash || other.Protection != Unprotected {
+		return other, nil
+	}
+	return nil, nil
+}
+
+// collectionFileNames returns the items of pa's collection dbc,
+// sorted by ID, and the name that the file of each one gets (by
+// ID) when the collection is copied into a folder of its own, so
+// that names that are taken resolve the same way each time. The
+// video of a live photo is named like its still, so that the two
+// are next to each other.
+func (r *Repository) collectionFileNames(pa providerAccount, dbc *dbCollection) ([]*dbItem, map[string]string, error) {
+	itemIDs := make([]string, 0, len(dbc.Items))
+	for itemID := range dbc.Items {
+		itemIDs = append(itemIDs, itemID)
+	}
+	sort.Strings(itemIDs)
+
+	items := make([]*dbItem, 0, len(itemIDs))
+	for _, itemID := range itemIDs {
+		dbi, err := r.db.loadItem(pa.key(), itemID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if dbi == nil {
+			repoLog.Errorf("item %s in collection %s is missing from database", itemID, dbc.Name)
+			continue
+		}
+		items = append(items, dbi)
+	}
+
+	liveVideo := func(dbi *dbItem) bool {
+		_, ok := dbc.Items[dbi.LivePair]
+		return ok && isVideo(dbi.Name)
+	}
+	names := make(map[string]string)
+	taken := make(map[string]struct{})
+	for _, dbi := range items {
+		if !liveVideo(dbi) {
+			names[dbi.ID] = uniqueName(taken, dbi.FileName)
+		}
+	}
+	for _, dbi := range items {
+		if !liveVideo(dbi) {
+			continue
+		}
+		name := dbi.FileName
+		if still, ok := names[dbi.LivePair]; ok {
+			name = strings.TrimSuffix(still, filepath.Ext(still)) + filepath.Ext(dbi.FileName)
+		}
+		names[dbi.ID] = uniqueName(taken, name)
+	}
+	return items, names, nil
+}
@@ -0,0 +1,55 @@
+package photobak
+
+import "testing"
+
+func TestKeptLivePair(t *testing.T) {
+	r, err := OpenRepo(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	pa := providerAccount{provider: Provider{Name: "test"}, username: "me"}
+	if err := r.db.createAccount(pa); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, test := range []struct {
+		videoPair  string // the video's LivePair
+		protection Protection
+		listed     idSet
+		trash      idSet
+		expectKept bool
+	}{
+		{videoPair: "still", listed: idSet{"video": {}}, expectKept: true},
+		{videoPair: "still", trash: idSet{"video": {}}, expectKept: true},
+		{videoPair: "still", protection: Pinned, expectKept: true},
+		{videoPair: "still", listed: idSet{"other": {}}, trash: idSet{"other": {}}},
+		{videoPair: "", listed: idSet{"video": {}}}, // not paired back
+	} {
+		still := &dbItem{ID: "still", Name: "IMG_1.HEIC", Checksum: []byte("1"), LivePair: "video"}
+		video := &dbItem{ID: "video", Name: "IMG_1.MOV", Checksum: []byte("2"), LivePair: test.videoPair, Protection: test.protection}
+		for _, dbi := range []*dbItem{still, video} {
+			if err := r.db.saveItem(pa.key(), dbi.ID, dbi); err != nil {
+				t.Fatal(err)
+			}
+		}
+		other, err := r.keptLivePair(pa, still, test.listed, test.trash)
+		if err != nil {
+			t.Fatalf("Test %d: Did not expect an error, got '%v'", i, err)
+		}
+		if kept := other != nil; kept != test.expectKept {
+			t.Errorf("Test %d: Expected kept to be %v, got %v", i, test.expectKept, kept)
+		}
+	}
+
+	// an item that isn't paired, or whose other half is gone
+	for i, dbi := range []*dbItem{
+		{ID: "alone", Name: "IMG_2.jpg"},
+		{ID: "orphan", Name: "IMG_3.HEIC", LivePair: "missing"},
+	} {
+		other, err := r.keptLivePair(pa, dbi, idSet{"missing": {}}, nil)
+		if err != nil || other != nil {
+			t.Errorf("Test %d: Expected nothing to keep, got %v and '%v'", i, other, err)
+		}
+	}
+}
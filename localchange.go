@@ -0,0 +1,128 @@
+package photobak
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// localChanges collects the files that were found changed
+// outside photobak during a run, keyed by repo-relative path.
+type localChanges struct {
+	mu    sync.Mutex
+	files map[string]string // path -> description of the change
+}
+
+// record notes that the file at fpath changed as described.
+func (lc *localChanges) record(fpath, desc string) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.files == nil {
+		lc.files = make(map[string]string)
+	}
+	lc.files[fpath] = desc
+}
+
+// reset forgets the changes so a new run can begin.
+func (lc *localChanges) reset() {
+	lc.mu.Lock()
+	lc.files = nil
+	lc.mu.Unlock()
+}
+
+// warnIfLocalChanges logs a summary of the files that were
+// found changed outside photobak during the last run.
+func (r *Repository) warnIfLocalChanges() {
+	r.localChanges.mu.Lock()
+	defer r.localChanges.mu.Unlock()
+	if len(r.localChanges.files) == 0 {
+		return
+	}
+	paths := make([]string, 0, len(r.localChanges.files))
+	for fpath := range r.localChanges.files {
+		paths = append(paths, fpath)
+	}
+	sort.Strings(paths)
+	msg := fmt.Sprintf("%d files were changed outside photobak since they were saved; "+
+		"they may have been edited, tampered with, or corrupted. Run with -integrity to download them again:",
+		len(paths))
+	for _, fpath := range paths {
+		msg += fmt.Sprintf("\n  %s: %s", fpath, r.localChanges.files[fpath])
+	}
+	repoLog.Warnf("%s", msg)
+}
+
+// recordFileStat records on dbi the size and modification time
+// of its file as photobak leaves it, so that later runs can tell
+// whether the file was changed by something else.
+func (r *Repository) recordFileStat(dbi *dbItem) {
+	info, err := os.Stat(r.fullPath(dbi.FilePath))
+	if err != nil {
+		return
+	}
+	dbi.Size, dbi.ModTime = info.Size(), info.ModTime()
+}
+
+// hasFileStat returns true if the size and modification
+// time of dbi's file were recorded (see recordFileStat).
+func hasFileStat(dbi *dbItem) bool {
+	return dbi.Size != 0 || !dbi.ModTime.IsZero()
+}
+
+// fileStatUnchanged returns true if the file of dbi has the
+// size and modification time that were recorded for it,
+// which means that it most likely wasn't changed since.
+func (r *Repository) fileStatUnchanged(dbi *dbItem) bool {
+	if !hasFileStat(dbi) {
+		return false
+	}
+	info, err := os.Stat(r.fullPath(dbi.FilePath))
+	return err == nil && info.Size() == dbi.Size && info.ModTime().Equal(dbi.ModTime)
+}
+
+// localDeleted is how checkLocalFile describes
+// a file that was deleted outside photobak.
+const localDeleted = "deleted"
+
+// checkLocalFile returns a description of how the file of dbi
+// was changed outside photobak since it was saved, or "" if it
+// was not. It is cheap for unchanged files: only if the size or
+// modification time differs from the recorded ones is the file
+// hashed, and if its contents are still intact (for example, it
+// was merely copied or touched), the new size and modification
+// time are recorded. Files saved before sizes and modification
+// times were recorded get them recorded without being checked.
+func (r *Repository) checkLocalFile(pa providerAccount, dbi *dbItem) (string, error) {
+	info, err := os.Stat(r.fullPath(dbi.FilePath))
+	if os.IsNotExist(err) {
+		return localDeleted, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if info.Size() == dbi.Size && info.ModTime().Equal(dbi.ModTime) {
+		return "", nil
+	}
+
+	if hasFileStat(dbi) {
+		checksum, err := r.hash(dbi.FilePath)
+		if err != nil {
+			return "", err
+		}
+		if !bytes.Equal(checksum, dbi.Checksum) {
+			if info.Size() != dbi.Size {
+				return fmt.Sprintf("modified (size changed from %d to %d bytes)", dbi.Size, info.Size()), nil
+			}
+			return fmt.Sprintf("modified (contents changed at %s)", info.ModTime().Format("2006-01-02 15:04:05")), nil
+		}
+	}
+
+	dbi.Size, dbi.ModTime = info.Size(), info.ModTime()
+	err = r.db.saveItem(pa.key(), dbi.ID, dbi)
+	if err != nil {
+		return "", fmt.Errorf("saving size and modification time of %s: %v", dbi.FilePath, err)
+	}
+	return "", nil
+}
@@ -0,0 +1,193 @@
+package photobak
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// LockFileName is the name of the file that exists in the
+// repository while a photobak process has it open, so that
+// another one can tell which process that is.
+const LockFileName = ".photobak.lock"
+
+// LockWait is how long OpenRepo waits for another process to
+// close the repository before giving up; if zero, it doesn't.
+var LockWait time.Duration
+
+// lockCheckInterval is how often a lock is checked while waiting.
+const lockCheckInterval = time.Second
+
+// heldLocks are the absolute paths of the lock files
+// of the repositories that this process has open.
+var (
+	heldLocks   = make(map[string]bool)
+	heldLocksMu sync.Mutex
+)
+
+// repoLock describes the process that has a repository open.
+type repoLock struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Started time.Time `json:"started"`
+}
+
+// RepoLockedError is returned by OpenRepo when another
+// process has the repository open.
+type RepoLockedError struct {
+	Path    string    // the repository
+	PID     int       // the process that has it open
+	Host    string    // the host the process is running on
+	Started time.Time // when the process opened it
+}
+
+func (e RepoLockedError) Error() string {
+	return fmt.Sprintf("another photobak is using repository %s (pid %d on %s, started at %s); "+
+		"only one can use a repository at a time; if it is no longer running, remove %s",
+		e.Path, e.PID, e.Host, e.Started.Format(time.RFC3339), filepath.Join(e.Path, LockFileName))
+}
+
+// lockRepo makes the lock file in the repository at path,
+// waiting up to LockWait for another process to remove its
+// own first. A lock left by a process on this host that is
+// no longer running is taken over. It returns the path of
+// the lock file, to be removed by unlockRepo.
+func lockRepo(path string) (string, error) {
+	lockPath, err := filepath.Abs(filepath.Join(path, LockFileName))
+	if err != nil {
+		return "", err
+	}
+	host, _ := os.Hostname()
+	ours := repoLock{PID: os.Getpid(), Host: host, Started: time.Now()}
+	content, err := json.Marshal(ours)
+	if err != nil {
+		return "", err
+	}
+
+	deadline := time.Now().Add(LockWait)
+	var waiting bool
+	for {
+		f, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			_, err = f.Write(content)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(lockPath)
+				return "", fmt.Errorf("writing lock file: %v", err)
+			}
+			heldLocksMu.Lock()
+			heldLocks[lockPath] = true
+			heldLocksMu.Unlock()
+			return lockPath, nil
+		}
+		if !os.IsExist(err) {
+			return "", fmt.Errorf("making lock file: %v", err)
+		}
+
+		var theirs repoLock
+		lockContent, err := ioutil.ReadFile(lockPath)
+		if os.IsNotExist(err) {
+			continue // removed just now
+		}
+		if err == nil {
+			err = json.Unmarshal(lockContent, &theirs)
+		}
+		if err != nil {
+			// being written, or garbled if it's been a while
+			theirs = repoLock{}
+			if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > time.Minute {
+				repoLog.Warnf("Removing unreadable lock file %s", lockPath)
+				removeLockIf(lockPath, lockContent)
+				continue
+			}
+		} else if theirs.Host == host && !lockAlive(lockPath, theirs.PID) {
+			repoLog.Warnf("Removing stale lock of pid %d, which is no longer running", theirs.PID)
+			removeLockIf(lockPath, lockContent)
+			continue
+		}
+
+		if !time.Now().Before(deadline) {
+			return "", RepoLockedError{Path: path, PID: theirs.PID, Host: theirs.Host, Started: theirs.Started}
+		}
+		if !waiting {
+			repoLog.Warnf("Waiting for pid %d on %s to finish using the repository", theirs.PID, theirs.Host)
+			waiting = true
+		}
+		time.Sleep(lockCheckInterval)
+	}
+}
+
+// readRepoLock reads the lock file at lockPath.
+func readRepoLock(lockPath string) (repoLock, error) {
+	var lock repoLock
+	content, err := ioutil.ReadFile(lockPath)
+	if err != nil {
+		return lock, err
+	}
+	err = json.Unmarshal(content, &lock)
+	return lock, err
+}
+
+// unlockRepo removes the lock file at lockPath, if it is ours.
+func unlockRepo(lockPath string) {
+	heldLocksMu.Lock()
+	delete(heldLocks, lockPath)
+	heldLocksMu.Unlock()
+	lock, err := readRepoLock(lockPath)
+	if err == nil && lock.PID == os.Getpid() {
+		os.Remove(lockPath)
+	}
+}
+
+// removeLockIf removes the lock file at lockPath if it still has
+// the given content, so that if another process removed the same
+// stale lock and took the repository in the meantime, its lock
+// isn't removed too.
+func removeLockIf(lockPath string, content []byte) {
+	current, err := ioutil.ReadFile(lockPath)
+	if err == nil && bytes.Equal(current, content) {
+		os.Remove(lockPath)
+	}
+}
+
+// lockAlive returns true if the lock file at lockPath, which was
+// made on this host by the process with the given ID, is held by
+// a process that is running. A lock with the ID of this process
+// is only alive if this process made it: otherwise, it was left
+// by an earlier process that had the same ID, as happens when a
+// program that runs as PID 1 in a container is restarted.
+func lockAlive(lockPath string, pid int) bool {
+	if pid == os.Getpid() {
+		heldLocksMu.Lock()
+		defer heldLocksMu.Unlock()
+		return heldLocks[lockPath]
+	}
+	return processRunning(pid)
+}
+
+// processRunning returns true if the process
+// with the given ID is running on this host.
+func processRunning(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false // on Windows, it doesn't exist
+	}
+	defer p.Release()
+	if runtime.GOOS == "windows" {
+		return true
+	}
+	err = p.Signal(syscall.Signal(0))
+	if se, ok := err.(*os.SyscallError); ok && se.Err == syscall.EPERM {
+		return true // running as another user
+	}
+	return err == nil
+}
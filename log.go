@@ -0,0 +1,141 @@
+package photobak
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is how severe a log message is.
+type Level int
+
+// The levels of log messages, from least to most severe.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// String returns the name of the level, like "warn".
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return fmt.Sprintf("level%d", int(l))
+}
+
+// ParseLevel returns the level with the given
+// name: debug, info, warn (or warning), or error.
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level '%s': must be debug, info, warn, or error", name)
+}
+
+// tag returns how the level is marked in text logs.
+func (l Level) tag() string {
+	if l == LevelWarn {
+		return "WARNING"
+	}
+	return strings.ToUpper(l.String())
+}
+
+var (
+	// LogLevel is the least severe level of
+	// messages that are written to the log.
+	LogLevel = LevelWarn
+
+	// LogOutput is where log messages are written.
+	LogOutput io.Writer = os.Stderr
+
+	// LogJSON makes log messages be written as JSON objects,
+	// one per line, with the fields time, level, module,
+	// and msg, instead of as lines of text.
+	LogJSON bool
+
+	// logMu keeps messages written at the
+	// same time from being mixed up.
+	logMu sync.Mutex
+)
+
+// Logger writes messages about one module of the
+// program to the log, according to the Log variables.
+// The zero value is a logger with no module.
+type Logger struct {
+	module string
+}
+
+// NewLogger returns a logger for the named module, like
+// "repo", "db", or the name of a provider.
+func NewLogger(module string) Logger {
+	return Logger{module: module}
+}
+
+// The loggers of the modules of this package.
+var (
+	repoLog = NewLogger("repo")
+	dbLog   = NewLogger("db")
+)
+
+// Debugf logs a message for debugging.
+func (l Logger) Debugf(format string, args ...interface{}) { l.logf(LevelDebug, format, args...) }
+
+// Infof logs an informational message.
+func (l Logger) Infof(format string, args ...interface{}) { l.logf(LevelInfo, format, args...) }
+
+// Warnf logs a warning.
+func (l Logger) Warnf(format string, args ...interface{}) { l.logf(LevelWarn, format, args...) }
+
+// Errorf logs an error.
+func (l Logger) Errorf(format string, args ...interface{}) { l.logf(LevelError, format, args...) }
+
+// logf writes the message at level, unless
+// it is less severe than LogLevel.
+func (l Logger) logf(level Level, format string, args ...interface{}) {
+	if level < LogLevel {
+		return
+	}
+	now := time.Now()
+	msg := strings.TrimSuffix(fmt.Sprintf(format, args...), "\n")
+
+	var line []byte
+	if LogJSON {
+		line, _ = json.Marshal(struct {
+			Time   time.Time `json:"time"`
+			Level  string    `json:"level"`
+			Module string    `json:"module,omitempty"`
+			Msg    string    `json:"msg"`
+		}{now, level.String(), l.module, msg})
+		line = append(line, '\n')
+	} else {
+		prefix := "[" + level.tag() + "] "
+		if l.module != "" {
+			prefix += l.module + ": "
+		}
+		line = []byte(now.Format("2006/01/02 15:04:05 ") + prefix + msg + "\n")
+	}
+
+	logMu.Lock()
+	LogOutput.Write(line)
+	logMu.Unlock()
+}
@@ -0,0 +1,153 @@
+package photobak
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ManifestName is the name of the checksum manifest files that
+// are kept in the repository if it has Manifests enabled, unless
+// it uses another checksum algorithm than SHA-256 (see
+// BLAKE3ManifestName). They are in the format of the sha256sum
+// program, so the files can be verified by running
+// `sha256sum -c SHA256SUMS` in the folder of the manifest,
+// without photobak.
+const ManifestName = "SHA256SUMS"
+
+// writeManifests writes a manifest to the root of the repository,
+// listing every item's file once with its path relative to the
+// repository, and one to the folder of each collection, listing
+// the files of the collection's items (including those saved in
+// other folders) with paths relative to that folder. The
+// checksums are the ones computed when the files were downloaded.
+func (r *Repository) writeManifests() error {
+	accounts, err := r.db.storedAccounts()
+	if err != nil {
+		return fmt.Errorf("listing accounts: %v", err)
+	}
+
+	all := make(map[string][]byte)
+	for _, pa := range accounts {
+		itemIDs, err := r.db.itemIDs(pa)
+		if err != nil {
+			return err
+		}
+		for _, itemID := range itemIDs {
+			dbi, err := r.db.loadItem(pa.key(), itemID)
+			if err != nil {
+				return err
+			}
+			if dbi != nil {
+				all[dbi.FilePath] = dbi.Checksum
+			}
+		}
+
+		collIDs, err := r.db.collectionIDs(pa)
+		if err != nil {
+			return err
+		}
+		for _, collID := range collIDs {
+			dbc, err := r.db.loadCollection(pa.key(), collID)
+			if err != nil {
+				return err
+			}
+			if dbc == nil {
+				continue
+			}
+			sums := make(map[string][]byte)
+			for itemID := range dbc.Items {
+				dbi, err := r.db.loadItem(pa.key(), itemID)
+				if err != nil {
+					return err
+				}
+				if dbi == nil {
+					continue
+				}
+				rel, err := filepath.Rel(dbc.DirPath, dbi.FilePath)
+				if err != nil {
+					return err
+				}
+				sums[rel] = dbi.Checksum
+			}
+			err = r.writeManifest(dbc.DirPath, sums)
+			if err != nil {
+				return fmt.Errorf("writing manifest of collection %s: %v", dbc.Name, err)
+			}
+		}
+	}
+
+	err = r.writeManifest("", all)
+	if err != nil {
+		return fmt.Errorf("writing manifest of repository: %v", err)
+	}
+	return nil
+}
+
+// writeManifest writes a manifest of sums, which maps file
+// paths relative to the repo-relative folder dirPath to their
+// checksums, into dirPath. The file is not touched if its
+// contents would be the same.
+func (r *Repository) writeManifest(dirPath string, sums map[string][]byte) error {
+	content := manifestContent(sums)
+
+	manifestPath := r.fullPath(filepath.Join(dirPath, r.manifestName()))
+	if existing, err := ioutil.ReadFile(manifestPath); err == nil && bytes.Equal(existing, content) {
+		return nil
+	}
+	if len(sums) == 0 {
+		err := os.Remove(manifestPath)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	err := os.MkdirAll(filepath.Dir(manifestPath), 0700)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := manifestPath + ".tmp"
+	err = ioutil.WriteFile(tmpPath, content, 0600)
+	if err != nil {
+		return err
+	}
+	if r.SyncFriendly {
+		return overwriteFile(tmpPath, manifestPath)
+	}
+	return os.Rename(tmpPath, manifestPath)
+}
+
+// manifestContent returns a manifest of sums, which maps
+// file paths to their checksums, sorted by path.
+func manifestContent(sums map[string][]byte) []byte {
+	paths := make([]string, 0, len(sums))
+	for fpath := range sums {
+		paths = append(paths, fpath)
+	}
+	sort.Strings(paths)
+
+	var buf bytes.Buffer
+	for _, fpath := range paths {
+		buf.WriteString(manifestLine(hex.EncodeToString(sums[fpath]), filepath.ToSlash(fpath)))
+	}
+	return buf.Bytes()
+}
+
+// manifestLine returns the line of a manifest for the file
+// at fpath with the hex-encoded checksum. Like sha256sum, it
+// escapes backslashes and newlines in the path and marks
+// such lines with a leading backslash.
+func manifestLine(checksum, fpath string) string {
+	if strings.ContainsAny(fpath, "\\\n") {
+		fpath = strings.Replace(fpath, "\\", "\\\\", -1)
+		fpath = strings.Replace(fpath, "\n", "\\n", -1)
+		return "\\" + checksum + "  " + fpath + "\n"
+	}
+	return checksum + "  " + fpath + "\n"
+}
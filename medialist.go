@@ -9,13 +9,17 @@ import (
 )
 
 // writeToMediaListFile adds dlPath to the media list file
-// in the given collection. The collection must have its
-// proper repo-relative path set.
+// in the given collection, or links to it from there,
+// depending on the de-duplication mode. The collection
+// must have its proper repo-relative path set.
 func (r *Repository) writeToMediaListFile(coll collection, dlPath string) error {
 	err := os.MkdirAll(r.fullPath(coll.dirPath), 0700)
 	if err != nil {
 		return fmt.Errorf("making folder %s: %v", coll.dirPath, err)
 	}
+	if r.dedupMode != DedupList {
+		return r.writeLink(coll.dirPath, dlPath)
+	}
 	mediaListFile := r.fullPath(r.mediaListPath(coll.dirPath))
 	of, err := os.OpenFile(mediaListFile, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
 	if err != nil {
@@ -31,8 +35,18 @@ func (r *Repository) writeToMediaListFile(coll collection, dlPath string) error
 
 // replaceInMediaListFile goes through the media list file in dirPath (repo-relative)
 // and replaces any occurrence of oldPath with newPath. If newPath is empty string,
-// the line will be deleted instead.
+// the line will be deleted instead. If the de-duplication mode uses links, the
+// links in dirPath are replaced or deleted instead.
 func (r *Repository) replaceInMediaListFile(dirPath, oldPath, newPath string) error {
+	if r.dedupMode != DedupList {
+		return r.replaceLinks(dirPath, oldPath, newPath)
+	}
+	return r.replaceInListFile(dirPath, oldPath, newPath)
+}
+
+// replaceInListFile is like replaceInMediaListFile, but always
+// changes the media list file, whatever the de-duplication mode.
+func (r *Repository) replaceInListFile(dirPath, oldPath, newPath string) error {
 	permFilePath := r.fullPath(r.mediaListPath(dirPath))
 	tmpFilePath := r.fullPath(r.mediaListPath(dirPath) + ".tmp")
 
@@ -71,21 +85,35 @@ func (r *Repository) replaceInMediaListFile(dirPath, oldPath, newPath string) er
 		return err
 	}
 
+	if !wroteAtLeastOneEntry {
+		// the file was emptied
+		os.Remove(tmpFilePath)
+		return os.Remove(permFilePath)
+	}
+
 	// replace original file with the updated temporary one
+	if r.SyncFriendly {
+		err = overwriteFile(tmpFilePath, permFilePath)
+		if err != nil {
+			return fmt.Errorf("copying temporary file into place: %v", err)
+		}
+		return nil
+	}
 	err = os.Rename(tmpFilePath, permFilePath)
 	if err != nil {
 		return fmt.Errorf("moving temporary file into place: %v", err)
 	}
 
-	if !wroteAtLeastOneEntry {
-		// the file was emptied
-		return os.Remove(permFilePath)
-	}
-
 	return nil
 }
 
+// mediaListHasItem returns true if the media list file in
+// collDirPath (or a link there) refers to dbi's file.
 func (r *Repository) mediaListHasItem(collDirPath string, dbi *dbItem) (bool, error) {
+	if r.dedupMode != DedupList {
+		links, err := r.findLinks(collDirPath, dbi.FilePath)
+		return len(links) > 0, err
+	}
 	file, err := os.Open(r.fullPath(r.mediaListPath(collDirPath)))
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -0,0 +1,72 @@
+package photobak
+
+func init() {
+	RegisterMessages("ru", map[string]string{
+		// authorizing accounts
+		"Credentials needed for %s (%s).": "Нужны учётные данные для %s (%s).",
+		"Photobak needs authorization to access the photos and\n" +
+			"videos for %s. To obtain this, a browser\n" +
+			"tab will be opened where you can grant access.\n" +
+			"Press [ENTER] to continue.": "Photobak нужно разрешение на доступ к фотографиям\n" +
+			"и видео %s. Для этого откроется вкладка\n" +
+			"браузера, где можно предоставить доступ.\n" +
+			"Нажмите [ENTER], чтобы продолжить.",
+		"To authorize %s, open this link in a browser on any device:": "Чтобы авторизовать %s, откройте эту ссылку в браузере на любом устройстве:",
+		"After you grant access, the browser is sent to a page on localhost\n" +
+			"that probably won't load. Copy the whole address of that page from\n" +
+			"the address bar and paste it here.": "После того как вы предоставите доступ, браузер перейдёт на страницу\n" +
+			"на localhost, которая, скорее всего, не откроется. Скопируйте полный\n" +
+			"адрес этой страницы из адресной строки и вставьте его сюда.",
+		"Address: ": "Адрес: ",
+		"[ OK ] Successfully authenticated. Performing backup (could take hours)...": "[ OK ] Вход выполнен. Идёт резервное копирование (это может занять несколько часов)...",
+		"Authorization Successful":                                 "Доступ разрешён",
+		"Authorization successful, thank you!":                     "Доступ разрешён, спасибо!",
+		"You may now close this window and return to the program.": "Теперь можно закрыть это окно и вернуться в программу.",
+		"All configured accounts have credentials.":                "Для всех настроенных аккаунтов есть учётные данные.",
+		"[Authorization Mode]\n" +
+			"No backups will be performed, but credentials will be obtained\n" +
+			"and stored to the database in the repo. You may then use this\n" +
+			"repository headless.": "[Режим авторизации]\n" +
+			"Резервное копирование выполняться не будет, но учётные данные\n" +
+			"будут получены и сохранены в базе данных репозитория. После этого\n" +
+			"репозиторий можно использовать без монитора и браузера.",
+		"Passphrase for credentials: ": "Пароль для учётных данных: ",
+		"Generated a new key for encrypting API data and saved it to your keyring.\n" +
+			"Keep a copy somewhere safe; without it, that data cannot be read.": "Создан новый ключ для шифрования данных API, он сохранён в связке ключей.\n" +
+			"Сохраните его копию в надёжном месте: без неё эти данные не прочитать.",
+		"Generated a new key for signing certificates and saved it to your keyring.\n" +
+			"Keep a record of its public key elsewhere, to check certificates against: %s": "Создан новый ключ для подписи сертификатов, он сохранён в связке ключей.\n" +
+			"Запишите его открытый ключ в другом месте, чтобы проверять по нему сертификаты: %s",
+		"Valid certificate of %s: %d accounts, %d albums, %d items, %d files, %d bytes": "Действительный сертификат от %s: аккаунтов: %d, альбомов: %d, элементов: %d, файлов: %d, байт: %d",
+		"Signed by public key %s": "Подписан открытым ключом %s",
+
+		// commands
+		"[Purge Mode]\n" +
+			"All files, index entries, and credentials for %s will be\n" +
+			"permanently removed from the repository. Files that other\n" +
+			"accounts share will be kept for them.": "[Режим удаления]\n" +
+			"Все файлы, записи индекса и учётные данные %s будут\n" +
+			"безвозвратно удалены из репозитория. Файлы, общие с другими\n" +
+			"аккаунтами, останутся для них.",
+		"Type the account name to confirm: ":                                   "Введите имя аккаунта для подтверждения: ",
+		"Restored %d files to %s":                                              "Восстановлено файлов: %d, в %s",
+		"Exported the index to %s":                                             "Индекс экспортирован в %s",
+		"Exported %d items to %s":                                              "Экспортировано элементов: %d, в %s",
+		"Found %d groups of photos that look the same":                         "Найдено групп похожих фотографий: %d",
+		"Verifying repository...":                                              "Проверка репозитория...",
+		"Repair? [y]es, [n]o, [a]ll, [q]uit: ":                                 "Исправить? [y] да, [n] нет, [a] все, [q] выход: ",
+		"Found %d files that belong to nothing":                                "Найдено файлов, которые ни к чему не относятся: %d",
+		"Deleted the stored API metadata of %d items and albums":               "Удалены сохранённые метаданные API элементов и альбомов: %d",
+		"Compacted the database from %s to %s":                                 "База данных сжата с %s до %s",
+		"Replace %s with its backup %s from %s? [y/N]: ":                       "Заменить %s резервной копией %s от %s? [y/N]: ",
+		"Restored the database from %s; the old one is now %s":                 "База данных восстановлена из %s; старая теперь называется %s",
+		"Found %d items that are in the trash":                                 "Найдено элементов в корзине: %d",
+		"Found %d items that were skipped for their size":                      "Найдено элементов, пропущенных из-за размера: %d",
+		"Serving the gallery at http://%s (press Ctrl+C to stop)":              "Галерея доступна по адресу http://%s (нажмите Ctrl+C, чтобы остановить)",
+		"Moved %d files to %s":                                                 "Перемещено файлов: %d, в %s",
+		"Removed service %s":                                                   "Служба %s удалена",
+		"Installed service %s; start it with: photobak service -name %s start": "Служба %s установлена; запустите её командой: photobak service -name %s start",
+		"Paused downloads in %s; resume them with the resume command":          "Загрузки в %s приостановлены; возобновите их командой resume",
+		"Resumed downloads in %s":                                              "Загрузки в %s возобновлены",
+	})
+}
@@ -0,0 +1,574 @@
+package photobak
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// dbVersion is the version of the database layout
+// used by this version of photobak. Increment it and
+// add a migration whenever the layout changes.
+const dbVersion = 3
+
+// migrations upgrade the database layout one version at a
+// time; migrations[i] upgrades a database from version i to
+// version i+1. A database without a version is version 0,
+// which is every repository made before versions were
+// recorded.
+var migrations = []func(tx *bolt.Tx) error{
+	migrateLegacy,
+	migrateRecords,
+	migrateAPIMeta,
+}
+
+// migrate upgrades the database at file to dbVersion, if needed.
+// Before any changes are made, a copy of the database is saved
+// next to it so that nothing is lost if the upgrade goes wrong.
+func (db *boltDB) migrate(file string) error {
+	version, err := db.version()
+	if err != nil {
+		return err
+	}
+	if version > dbVersion {
+		return fmt.Errorf("database version %d is newer than this version of photobak supports (%d); please upgrade photobak",
+			version, dbVersion)
+	}
+	if version == dbVersion {
+		return nil
+	}
+
+	empty, err := db.empty()
+	if err != nil {
+		return err
+	}
+	if !empty {
+		backup := fmt.Sprintf("%s.v%d.bak", file, version)
+		dbLog.Warnf("Upgrading repository database from version %d to %d; a copy of the old one is in %s",
+			version, dbVersion, backup)
+		err := db.View(func(tx *bolt.Tx) error {
+			return tx.CopyFile(backup, 0600)
+		})
+		if err != nil {
+			return fmt.Errorf("backing up database before upgrade: %v", err)
+		}
+	}
+
+	for v := version; v < dbVersion; v++ {
+		err := db.Update(func(tx *bolt.Tx) error {
+			err := migrations[v](tx)
+			if err != nil {
+				return err
+			}
+			return setVersion(tx, v+1)
+		})
+		if err != nil {
+			return fmt.Errorf("upgrading database from version %d: %v", v, err)
+		}
+	}
+
+	return nil
+}
+
+// version returns the version of the database layout.
+func (db *boltDB) version() (int, error) {
+	var version int
+	err := db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte("meta"))
+		if meta == nil {
+			return nil
+		}
+		v := meta.Get([]byte("version"))
+		if v == nil {
+			return nil
+		}
+		if len(v) != 8 {
+			return fmt.Errorf("malformed database version")
+		}
+		version = int(binary.BigEndian.Uint64(v))
+		return nil
+	})
+	return version, err
+}
+
+// setVersion records version as the version of the database layout.
+func setVersion(tx *bolt.Tx, version int) error {
+	meta, err := tx.CreateBucketIfNotExists([]byte("meta"))
+	if err != nil {
+		return err
+	}
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(version))
+	return meta.Put([]byte("version"), v)
+}
+
+// empty returns true if the database has no
+// accounts and nothing in the checksum index.
+func (db *boltDB) empty() (bool, error) {
+	empty := true
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if k, _ := b.Cursor().First(); k != nil {
+				empty = false
+			}
+			return nil
+		})
+	})
+	return empty, err
+}
+
+// legacyItem is a dbItem as far as it can be decoded when
+// the gob type of its API value is no longer registered,
+// for example because the provider's types were renamed.
+type legacyItem struct {
+	ID          string
+	Name        string
+	FileName    string
+	FilePath    string
+	Checksum    []byte
+	ETag        string
+	Saved       time.Time
+	Collections map[string]struct{}
+	Meta        struct {
+		Setting *setting
+		Caption string
+	}
+}
+
+// legacyCollection is a dbCollection as far as it can
+// be decoded when the gob type of its API value is no
+// longer registered.
+type legacyCollection struct {
+	ID      string
+	Name    string
+	DirName string
+	DirPath string
+	Saved   time.Time
+	Items   map[string]struct{}
+}
+
+// migrateLegacy upgrades a database from before layout versions
+// were recorded. It creates missing account buckets, converts
+// checksum index entries stored as "<accountKey>::<itemID>"
+// strings, and drops stored API values that can no longer be
+// decoded (which would otherwise make the whole item or
+// collection unreadable). Nothing needs to be downloaded again.
+func migrateLegacy(tx *bolt.Tx) error {
+	var accounts [][]byte
+	err := tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		if strings.Contains(string(name), ":") {
+			accounts = append(accounts, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, acctKey := range accounts {
+		accountBucket := tx.Bucket(acctKey)
+		for _, b := range bucketNames {
+			_, err := accountBucket.CreateBucketIfNotExists([]byte(b))
+			if err != nil {
+				return fmt.Errorf("create account bucket %s: %v", b, err)
+			}
+		}
+		n, err := migrateLegacyValues(accountBucket.Bucket([]byte("items")), func(v []byte) ([]byte, error) {
+			var li legacyItem
+			err := gobDecode(v, &li)
+			if err != nil {
+				return nil, err
+			}
+			return gobEncode(&dbItem{
+				ID:          li.ID,
+				Name:        li.Name,
+				FileName:    li.FileName,
+				FilePath:    li.FilePath,
+				Checksum:    li.Checksum,
+				ETag:        li.ETag,
+				Saved:       li.Saved,
+				Collections: li.Collections,
+				Meta:        itemMeta{Setting: li.Meta.Setting, Caption: li.Meta.Caption},
+			})
+		}, new(*dbItem))
+		if err != nil {
+			return fmt.Errorf("%s: upgrading items: %v", acctKey, err)
+		}
+		if n > 0 {
+			dbLog.Warnf("%s: dropped unreadable API data from %d items", acctKey, n)
+		}
+		n, err = migrateLegacyValues(accountBucket.Bucket([]byte("collections")), func(v []byte) ([]byte, error) {
+			var lc legacyCollection
+			err := gobDecode(v, &lc)
+			if err != nil {
+				return nil, err
+			}
+			return gobEncode(&dbCollection{
+				ID:      lc.ID,
+				Name:    lc.Name,
+				DirName: lc.DirName,
+				DirPath: lc.DirPath,
+				Saved:   lc.Saved,
+				Items:   lc.Items,
+			})
+		}, new(*dbCollection))
+		if err != nil {
+			return fmt.Errorf("%s: upgrading collections: %v", acctKey, err)
+		}
+		if n > 0 {
+			dbLog.Warnf("%s: dropped unreadable API data from %d collections", acctKey, n)
+		}
+	}
+
+	checksums, err := tx.CreateBucketIfNotExists([]byte("checksums"))
+	if err != nil {
+		return err
+	}
+	_, err = migrateLegacyValues(checksums, func(v []byte) ([]byte, error) {
+		var old []string
+		err := gobDecode(v, &old)
+		if err != nil {
+			return nil, err
+		}
+		list := make([]accountItem, 0, len(old))
+		for _, s := range old {
+			parts := strings.SplitN(s, "::", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("malformed checksum index entry: %s", s)
+			}
+			list = append(list, accountItem{AcctKey: []byte(parts[0]), ItemID: parts[1]})
+		}
+		return gobEncode(list)
+	}, new([]accountItem))
+	if err != nil {
+		return fmt.Errorf("upgrading checksum index: %v", err)
+	}
+
+	return nil
+}
+
+// migrateLegacyValues converts every value in bucket that cannot
+// be decoded into current with the convert function, and returns
+// how many values were converted.
+func migrateLegacyValues(bucket *bolt.Bucket, convert func([]byte) ([]byte, error), current interface{}) (int, error) {
+	updates := make(map[string][]byte)
+	err := bucket.ForEach(func(k, v []byte) error {
+		if gobDecode(v, current) == nil {
+			return nil
+		}
+		newVal, err := convert(v)
+		if err != nil {
+			return fmt.Errorf("%s: %v", k, err)
+		}
+		updates[string(k)] = newVal
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for k, v := range updates {
+		err := bucket.Put([]byte(k), v)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(updates), nil
+}
+
+// v1Item is a dbItem as it was gob-encoded in version 1 of the
+// layout, except for its API value, which is decoded separately
+// (see v1ItemAPI) so that the rest can be read even if its type
+// is no longer registered.
+type v1Item struct {
+	ID             string
+	Name           string
+	FileName       string
+	FilePath       string
+	Checksum       []byte
+	Size           int64
+	ModTime        time.Time
+	PHash          []byte
+	ETag           string
+	ChangeKey      string
+	ChangeStrategy string
+	Saved          time.Time
+	Collections    map[string]struct{}
+	Meta           v1ItemMeta
+	Protection     Protection
+	Trashed        time.Time
+}
+
+// v1ItemMeta is the itemMeta of a v1Item.
+type v1ItemMeta struct {
+	SealedAPI []byte
+	Setting   *setting
+	Caption   string
+	Taken     time.Time
+	Camera    string
+	Favorite  bool
+	Described bool
+}
+
+// v1ItemAPI is the API value of a v1Item.
+type v1ItemAPI struct {
+	Meta struct{ API Item }
+}
+
+// v1Collection is a dbCollection as it was gob-encoded in
+// version 1 of the layout, except for its API value (see
+// v1CollectionAPI).
+type v1Collection struct {
+	ID         string
+	Name       string
+	DirName    string
+	DirPath    string
+	Saved      time.Time
+	Meta       v1CollectionMeta
+	Items      map[string]struct{}
+	Order      []string
+	Protection Protection
+	Active     time.Time
+}
+
+// v1CollectionMeta is the collectionMeta of a v1Collection.
+type v1CollectionMeta struct {
+	SealedAPI   []byte
+	Description string
+	Cover       string
+}
+
+// v1CollectionAPI is the API value of a v1Collection.
+type v1CollectionAPI struct {
+	Meta struct{ API Collection }
+}
+
+// migrateRecords upgrades a database from version 1, in which items
+// and collections were gob-encoded, to version 2, in which they are
+// stored as versioned JSON (see encodeItem and encodeCollection), so
+// that changes to their types can no longer make them unreadable.
+// API values whose types are not registered can't be converted and
+// are dropped. Encrypted API values are kept as they are. API
+// values are stored in the apimeta bucket, as in version 3.
+func migrateRecords(tx *bolt.Tx) error {
+	return tx.ForEach(func(acctKey []byte, accountBucket *bolt.Bucket) error {
+		if !strings.Contains(string(acctKey), ":") {
+			return nil // not an account
+		}
+
+		var dropped int
+		apiMeta := make(map[string]map[string]apiMetaRecord) // by kind, then ID
+		keepAPI := func(kind string, k []byte, api interface{}, sealed []byte) {
+			rec := apiMetaRecord{Version: recordVersion, Sealed: sealed}
+			if api != nil {
+				enc, err := encodeAPI(api)
+				if err != nil {
+					dropped++
+					return
+				}
+				rec.API, rec.Sealed = enc, nil
+			} else if sealed == nil {
+				return
+			}
+			if apiMeta[kind] == nil {
+				apiMeta[kind] = make(map[string]apiMetaRecord)
+			}
+			apiMeta[kind][string(k)] = rec
+		}
+
+		items := accountBucket.Bucket([]byte("items"))
+		if items != nil {
+			err := migrateRecordValues(items, func(k, v []byte) ([]byte, error) {
+				var old v1Item
+				err := gobDecode(v, &old)
+				if err != nil {
+					return nil, err
+				}
+				item := &dbItem{
+					ID:             old.ID,
+					Name:           old.Name,
+					FileName:       old.FileName,
+					FilePath:       old.FilePath,
+					Checksum:       old.Checksum,
+					Size:           old.Size,
+					ModTime:        old.ModTime,
+					PHash:          old.PHash,
+					ETag:           old.ETag,
+					ChangeKey:      old.ChangeKey,
+					ChangeStrategy: old.ChangeStrategy,
+					Saved:          old.Saved,
+					Collections:    old.Collections,
+					Meta: itemMeta{
+						Setting:   old.Meta.Setting,
+						Caption:   old.Meta.Caption,
+						Taken:     old.Meta.Taken,
+						Camera:    old.Meta.Camera,
+						Favorite:  old.Meta.Favorite,
+						Described: old.Meta.Described,
+					},
+					Protection: old.Protection,
+					Trashed:    old.Trashed,
+				}
+				var api v1ItemAPI
+				if gobDecode(v, &api) != nil {
+					dropped++
+				} else if api.Meta.API != nil {
+					keepAPI(apiMetaItems, k, api.Meta.API, nil)
+				} else {
+					keepAPI(apiMetaItems, k, nil, old.Meta.SealedAPI)
+				}
+				return encodeItem(item)
+			})
+			if err != nil {
+				return fmt.Errorf("%s: upgrading items: %v", acctKey, err)
+			}
+		}
+
+		collections := accountBucket.Bucket([]byte("collections"))
+		if collections != nil {
+			err := migrateRecordValues(collections, func(k, v []byte) ([]byte, error) {
+				var old v1Collection
+				err := gobDecode(v, &old)
+				if err != nil {
+					return nil, err
+				}
+				coll := &dbCollection{
+					ID:      old.ID,
+					Name:    old.Name,
+					DirName: old.DirName,
+					DirPath: old.DirPath,
+					Saved:   old.Saved,
+					Meta: collectionMeta{
+						Description: old.Meta.Description,
+						Cover:       old.Meta.Cover,
+					},
+					Items:      old.Items,
+					Order:      old.Order,
+					Protection: old.Protection,
+					Active:     old.Active,
+				}
+				var api v1CollectionAPI
+				if gobDecode(v, &api) != nil {
+					dropped++
+				} else if api.Meta.API != nil {
+					keepAPI(apiMetaCollections, k, api.Meta.API, nil)
+				} else {
+					keepAPI(apiMetaCollections, k, nil, old.Meta.SealedAPI)
+				}
+				return encodeCollection(coll)
+			})
+			if err != nil {
+				return fmt.Errorf("%s: upgrading collections: %v", acctKey, err)
+			}
+		}
+
+		if dropped > 0 {
+			dbLog.Warnf("%s: dropped API data of %d items and collections whose type is not registered", acctKey, dropped)
+		}
+		return putAPIMetaRecords(accountBucket, apiMeta)
+	})
+}
+
+// migrateRecordValues replaces every value in bucket
+// with what the convert function returns for it.
+func migrateRecordValues(bucket *bolt.Bucket, convert func(k, v []byte) ([]byte, error)) error {
+	updates := make(map[string][]byte)
+	err := bucket.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return nil // a nested bucket
+		}
+		newVal, err := convert(k, v)
+		if err != nil {
+			return fmt.Errorf("%s: %v", k, err)
+		}
+		updates[string(k)] = newVal
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for k, v := range updates {
+		err := bucket.Put([]byte(k), v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// v2Record holds the API value of an item or collection
+// as it was stored in version 2 of the layout.
+type v2Record struct {
+	Meta struct {
+		API       *apiRecord `json:"api"`
+		SealedAPI []byte     `json:"sealed_api"`
+	} `json:"meta"`
+}
+
+// migrateAPIMeta upgrades a database from version 2, in which
+// the API values of items and collections were stored with
+// them, to version 3, in which they are in the apimeta bucket
+// of their account so that loading items doesn't decode them.
+func migrateAPIMeta(tx *bolt.Tx) error {
+	return tx.ForEach(func(acctKey []byte, accountBucket *bolt.Bucket) error {
+		if !strings.Contains(string(acctKey), ":") {
+			return nil // not an account
+		}
+		apiMeta := make(map[string]map[string]apiMetaRecord) // by kind, then ID
+		for _, kind := range []string{apiMetaItems, apiMetaCollections} {
+			bucket := accountBucket.Bucket([]byte(kind))
+			if bucket == nil {
+				continue
+			}
+			apiMeta[kind] = make(map[string]apiMetaRecord)
+			err := migrateRecordValues(bucket, func(k, v []byte) ([]byte, error) {
+				var old v2Record
+				err := json.Unmarshal(v, &old)
+				if err != nil {
+					return nil, err
+				}
+				if old.Meta.API != nil || old.Meta.SealedAPI != nil {
+					apiMeta[kind][string(k)] = apiMetaRecord{
+						Version: recordVersion,
+						API:     old.Meta.API,
+						Sealed:  old.Meta.SealedAPI,
+					}
+				}
+				// the record types no longer have these fields
+				if kind == apiMetaItems {
+					item, err := decodeItem(v)
+					if err != nil {
+						return nil, err
+					}
+					return encodeItem(item)
+				}
+				coll, err := decodeCollection(v)
+				if err != nil {
+					return nil, err
+				}
+				return encodeCollection(coll)
+			})
+			if err != nil {
+				return fmt.Errorf("%s: moving API data of %s: %v", acctKey, kind, err)
+			}
+		}
+		return putAPIMetaRecords(accountBucket, apiMeta)
+	})
+}
+
+// putAPIMetaRecords stores the records of apiMeta,
+// which are by kind and then ID, in accountBucket.
+func putAPIMetaRecords(accountBucket *bolt.Bucket, apiMeta map[string]map[string]apiMetaRecord) error {
+	for kind, records := range apiMeta {
+		for id, rec := range records {
+			err := putAPIMetaRecord(accountBucket, kind, id, rec)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+package photobak
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+
+	"golang.org/x/oauth2"
+)
+
+// OAuth2 gets and refreshes the OAuth 2.0 tokens of the accounts
+// of a provider whose service uses it, like Google Photos and
+// Dropbox. To get a token, a browser is opened where the user
+// grants access, and the service sends the browser back to
+// Config.RedirectURL, which must be an address on localhost
+// with the port and path that the service expects, where a
+// server waits for it. With HeadlessAuth, the user grants access
+// on any device instead (see ReadAuthorizationCode).
+type OAuth2 struct {
+	Config *oauth2.Config
+
+	// AuthOptions are added to the link where access is
+	// granted; for example, some services issue refresh
+	// tokens only if offline access is asked for.
+	AuthOptions []oauth2.AuthCodeOption
+
+	// Logger is the log of the provider.
+	Logger Logger
+}
+
+// GetToken gets a new token for the account username from the
+// user, encoded so that NewClient can use it.
+func (o OAuth2) GetToken(username string) ([]byte, error) {
+	var token *oauth2.Token
+	var err error
+	if HeadlessAuth {
+		token, err = o.getTokenHeadless(username)
+	} else {
+		fmt.Println(Tr("Photobak needs authorization to access the photos and\n"+
+			"videos for %s. To obtain this, a browser\n"+
+			"tab will be opened where you can grant access.\n"+
+			"Press [ENTER] to continue.", username))
+		fmt.Scanln()
+		token, err = o.getToken()
+	}
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println(Tr("[ OK ] Successfully authenticated. Performing backup (could take hours)..."))
+
+	// no particular reason we use JSON except that
+	// we used to write it to a file and JSON just
+	// seemed more sensible if a human needed to
+	// inspect it; also the type is external and
+	// struct tags may afford more compatibility than
+	// a gob encoding, should the type def change.
+	return json.Marshal(token)
+}
+
+// NewClient returns an HTTP client that is authenticated with
+// the token in tokenData (see GetToken). Whenever the token is
+// refreshed, the new one is passed to save.
+func (o OAuth2) NewClient(tokenData []byte, save func([]byte) error) (*http.Client, error) {
+	var token *oauth2.Token
+	err := json.Unmarshal(tokenData, &token)
+	if err != nil {
+		return nil, fmt.Errorf("parsing token data: %v", err)
+	}
+	ts := &savingTokenSource{
+		src:    o.Config.TokenSource(oauth2.NoContext, token),
+		save:   save,
+		last:   token.AccessToken,
+		logger: o.Logger,
+	}
+	return oauth2.NewClient(oauth2.NoContext, ts), nil
+}
+
+// savingTokenSource is a TokenSource that saves
+// the token whenever it has been refreshed.
+type savingTokenSource struct {
+	src    oauth2.TokenSource
+	save   func(tokenData []byte) error
+	logger Logger
+
+	mu   sync.Mutex
+	last string // access token last saved (or loaded)
+}
+
+// Token returns a valid token from s.src,
+// saving it if it is a new one.
+func (s *savingTokenSource) Token() (*oauth2.Token, error) {
+	token, err := s.src.Token()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if token.AccessToken != s.last {
+		tokenJSON, err := json.Marshal(token)
+		if err == nil {
+			err = s.save(tokenJSON)
+		}
+		if err != nil {
+			// the token is still good to use for now
+			s.logger.Errorf("saving refreshed OAuth2 token: %v", err)
+		} else {
+			s.last = token.AccessToken
+		}
+	}
+	return token, nil
+}
+
+// getToken gets a new token from the user by opening
+// the browser for them.
+func (o OAuth2) getToken() (*oauth2.Token, error) {
+	o.Logger.Infof("Getting new OAuth2 token")
+
+	cbURL, err := url.Parse(o.Config.RedirectURL)
+	if err != nil {
+		return nil, fmt.Errorf("bad redirect URL: %v", err)
+	}
+
+	stateVal, err := RandomString(14)
+	if err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen("tcp", cbURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+
+	ch := make(chan *oauth2.Token, 1)
+	errCh := make(chan error, 1)
+
+	go func() {
+		http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			state := r.FormValue("state")
+			code := r.FormValue("code")
+
+			if r.Method != "GET" || r.URL.Path != cbURL.Path || state == "" || code == "" {
+				http.Error(w, "This endpoint is for OAuth2 callbacks only", http.StatusNotFound)
+				return
+			}
+
+			if state != stateVal {
+				select {
+				case errCh <- fmt.Errorf("invalid OAuth2 state; expected '%s' but got '%s'", stateVal, state):
+				default:
+				}
+				http.Error(w, "invalid state", http.StatusUnauthorized)
+				return
+			}
+
+			token, err := o.Config.Exchange(oauth2.NoContext, code)
+			if err != nil {
+				select {
+				case errCh <- fmt.Errorf("code exchange failed: %v", err):
+				default:
+				}
+				http.Error(w, "code exchange failed", http.StatusUnauthorized)
+				return
+			}
+
+			select {
+			case ch <- token:
+			default:
+			}
+
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, AuthSuccessPage())
+		}))
+	}()
+
+	err = openBrowser(o.Config.AuthCodeURL(stateVal, o.AuthOptions...))
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case token := <-ch:
+		return token, nil
+	case err := <-errCh:
+		return nil, err
+	}
+}
+
+// getTokenHeadless gets a new token for username without
+// opening a browser, by asking the user to open the link
+// somewhere else and paste the address they end up at.
+func (o OAuth2) getTokenHeadless(username string) (*oauth2.Token, error) {
+	o.Logger.Infof("Getting new OAuth2 token (headless)")
+
+	stateVal, err := RandomString(14)
+	if err != nil {
+		return nil, err
+	}
+	code, err := ReadAuthorizationCode(username, o.Config.AuthCodeURL(stateVal, o.AuthOptions...), stateVal)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := o.Config.Exchange(oauth2.NoContext, code)
+	if err != nil {
+		return nil, fmt.Errorf("code exchange failed: %v", err)
+	}
+	return token, nil
+}
+
+// openBrowser opens the browser to url.
+func openBrowser(url string) error {
+	osCommand := map[string][]string{
+		"darwin":  {"open"},
+		"freebsd": {"xdg-open"},
+		"linux":   {"xdg-open"},
+		"netbsd":  {"xdg-open"},
+		"openbsd": {"xdg-open"},
+		"windows": {"cmd", "/c", "start"},
+	}
+
+	if runtime.GOOS == "windows" {
+		// escape characters not allowed by cmd
+		url = strings.Replace(url, "&", `^&`, -1)
+	}
+
+	all, ok := osCommand[runtime.GOOS]
+	if !ok {
+		return fmt.Errorf("don't know how to open a browser on %s; use headless authorization", runtime.GOOS)
+	}
+	exe := all[0]
+	args := all[1:]
+
+	cmd := exec.Command(exe, append(args, url)...)
+	return cmd.Run()
+}
+
+// RandomString returns a string of n random letters and
+// digits from a cryptographically secure source, as is
+// needed for the state of OAuth2 requests.
+func RandomString(n int) (string, error) {
+	const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	max := big.NewInt(int64(len(letterBytes)))
+	b := make([]byte, n)
+	for i := range b {
+		j, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = letterBytes[j.Int64()]
+	}
+	return string(b), nil
+}
@@ -0,0 +1,55 @@
+package photobak
+
+import (
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+// tokenSequence returns its tokens in order,
+// repeating the last one.
+type tokenSequence []*oauth2.Token
+
+func (ts *tokenSequence) Token() (*oauth2.Token, error) {
+	t := (*ts)[0]
+	if len(*ts) > 1 {
+		*ts = (*ts)[1:]
+	}
+	return t, nil
+}
+
+func TestSavingTokenSource(t *testing.T) {
+	var saved int
+	ts := &savingTokenSource{
+		src: &tokenSequence{
+			{AccessToken: "a"},
+			{AccessToken: "a"},
+			{AccessToken: "b", RefreshToken: "r"},
+			{AccessToken: "b", RefreshToken: "r"},
+		},
+		save: func([]byte) error { saved++; return nil },
+		last: "a",
+	}
+	for i, expect := range []int{0, 0, 1, 1} {
+		if _, err := ts.Token(); err != nil {
+			t.Fatalf("Test %d: Did not expect an error, got '%v'", i, err)
+		}
+		if saved != expect {
+			t.Errorf("Test %d: Got %d saves, expected %d", i, saved, expect)
+		}
+	}
+}
+
+func TestRandomString(t *testing.T) {
+	a, err := RandomString(14)
+	if err != nil {
+		t.Fatalf("Did not expect an error, got '%v'", err)
+	}
+	b, _ := RandomString(14)
+	if len(a) != 14 || len(b) != 14 {
+		t.Errorf("Expected 14 characters, got '%s' and '%s'", a, b)
+	}
+	if a == b {
+		t.Errorf("Expected different strings, got '%s' twice", a)
+	}
+}
@@ -0,0 +1,98 @@
+package photobak
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Orders in which Store can process the collections
+// of an account (see Repository.AlbumOrder).
+const (
+	AlbumOrderRecent   = "recent"
+	AlbumOrderSmallest = "smallest"
+	AlbumOrderLargest  = "largest"
+)
+
+// ValidateAlbumOrder returns an error if order is not
+// one of the AlbumOrder* constants or empty, or if
+// one of patterns is not a valid album pattern.
+func ValidateAlbumOrder(order string, patterns []string) error {
+	switch order {
+	case "", AlbumOrderRecent, AlbumOrderSmallest, AlbumOrderLargest:
+	default:
+		return fmt.Errorf("unknown album order '%s': must be %s, %s, or %s", order, AlbumOrderRecent, AlbumOrderSmallest, AlbumOrderLargest)
+	}
+	for _, pattern := range patterns {
+		if _, err := matchAlbum(pattern, ""); err != nil {
+			return fmt.Errorf("bad album pattern '%s': %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// orderCollections sorts pa's collections in colls by
+// AlbumOrder, and then puts those matching FirstAlbums
+// first and those matching LastAlbums (or else the
+// provider's) last, in the order of the patterns.
+func (r *Repository) orderCollections(pa providerAccount, colls []Collection) error {
+	switch r.AlbumOrder {
+	case AlbumOrderSmallest, AlbumOrderLargest:
+		err := r.sizeOrder(pa, colls, r.AlbumOrder == AlbumOrderLargest)
+		if err != nil {
+			return err
+		}
+	default:
+		err := r.mostActiveFirst(pa, colls)
+		if err != nil {
+			return err
+		}
+	}
+
+	last := r.LastAlbums
+	if last == nil {
+		last = pa.provider.LastAlbums
+	}
+	if len(r.FirstAlbums) == 0 && len(last) == 0 {
+		return nil
+	}
+	// the first patterns rank from -len(FirstAlbums) to -1,
+	// the last ones from 1 up, and the rest are 0
+	rank := func(name string) int {
+		for i, pattern := range r.FirstAlbums {
+			if ok, _ := matchAlbum(pattern, name); ok {
+				return i - len(r.FirstAlbums)
+			}
+		}
+		for i, pattern := range last {
+			if ok, _ := matchAlbum(pattern, name); ok {
+				return i + 1
+			}
+		}
+		return 0
+	}
+	sort.SliceStable(colls, func(i, j int) bool {
+		return rank(colls[i].CollectionName()) < rank(colls[j].CollectionName())
+	})
+	return nil
+}
+
+// sizeOrder sorts pa's collections in colls by how many items
+// they had in the last run, the smallest first unless largest
+// is true. New collections, whose size is unknown, come first.
+func (r *Repository) sizeOrder(pa providerAccount, colls []Collection, largest bool) error {
+	stored, err := r.storedCollections(pa, colls)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(colls, func(i, j int) bool {
+		ci, cj := stored[colls[i].CollectionID()], stored[colls[j].CollectionID()]
+		if ci == nil || cj == nil {
+			return ci == nil && cj != nil
+		}
+		if largest {
+			return len(ci.Items) > len(cj.Items)
+		}
+		return len(ci.Items) < len(cj.Items)
+	})
+	return nil
+}
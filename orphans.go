@@ -0,0 +1,83 @@
+package photobak
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// QuarantineDir is the folder in the root of the repository
+// where Quarantine moves files to. Its contents are ignored
+// by photobak.
+const QuarantineDir = "_quarantine"
+
+// Orphans returns the repo-relative paths of the files in the
+// repository that do not belong to any item and are not listed
+// in any media list file, like leftovers from crashes or files
+// copied into the repository by hand. Photobak's own files and
+// the contents of QuarantineDir are not included. Files are not
+// hashed, so this is much faster than Verify.
+func (r *Repository) Orphans() ([]string, error) {
+	v := newVerification(r, true)
+
+	accounts, err := r.db.storedAccounts()
+	if err != nil {
+		return nil, fmt.Errorf("listing accounts: %v", err)
+	}
+	for _, pa := range accounts {
+		err := v.checkItems(pa)
+		if err != nil {
+			return nil, fmt.Errorf("checking items of %s: %v", pa, err)
+		}
+		err = v.checkReferences(pa)
+		if err != nil {
+			return nil, fmt.Errorf("checking references of %s: %v", pa, err)
+		}
+	}
+	err = v.checkTree()
+	if err != nil {
+		return nil, fmt.Errorf("checking files: %v", err)
+	}
+
+	var orphans []string
+	for _, p := range v.report.Problems {
+		if p.Kind == ProblemUnindexedFile && !v.listed[p.Path] {
+			orphans = append(orphans, p.Path)
+		}
+	}
+	return orphans, nil
+}
+
+// Quarantine moves the files at the repo-relative paths into
+// QuarantineDir, keeping their paths within it, rather than
+// deleting them. It returns the number of files moved.
+func (r *Repository) Quarantine(paths []string) (int, error) {
+	r.beginChanges()
+	defer r.endChanges()
+
+	var moved int
+	for _, fpath := range paths {
+		if fpath == QuarantineDir || inDir(fpath, QuarantineDir) {
+			continue
+		}
+		destDir := filepath.Join(QuarantineDir, filepath.Dir(fpath))
+		err := os.MkdirAll(r.fullPath(destDir), 0700)
+		if err != nil {
+			return moved, fmt.Errorf("making quarantine folder: %v", err)
+		}
+		name, err := r.reserveUniqueFilename(destDir, filepath.Base(fpath), false)
+		if err != nil {
+			return moved, fmt.Errorf("reserving filename in quarantine: %v", err)
+		}
+		dest := filepath.Join(destDir, name)
+		repoLog.Infof("Moving %s to %s", fpath, dest)
+		err = r.moveFile(fpath, dest)
+		if err != nil {
+			os.Remove(r.fullPath(dest))
+			repoLog.Errorf("moving %s to quarantine: %v", fpath, err)
+			continue
+		}
+		moved++
+	}
+	return moved, nil
+}
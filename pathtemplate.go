@@ -0,0 +1,162 @@
+package photobak
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// DefaultPathTemplate is the path, relative to the repository,
+// at which new items are saved if no other template is set:
+// a folder for each account, and in it, a folder for each
+// collection.
+const DefaultPathTemplate = "{{.Account}}/{{.Collection}}/{{.Name}}"
+
+// ItemTimer is an optional interface for Items that know when
+// they were taken or created. It is used for the dates in path
+// templates.
+type ItemTimer interface {
+	// ItemTime returns when the item was taken or
+	// created, or the zero time if it isn't known.
+	ItemTime() time.Time
+}
+
+// pathData is what a path template is executed with.
+type pathData struct {
+	Provider   string    // the name of the provider, like "googlephotos"
+	Username   string    // the username, as used in folder names
+	Account    string    // the account's folder, like "googlephotos/me_at_gmail.com"
+	Collection string    // the name of the collection's folder
+	Name       string    // the file name of the item
+	ID         string    // the ID of the item
+	Time       time.Time // when the item was taken; may be zero
+}
+
+// Date returns the date of the item as YYYY-MM-DD,
+// or "undated" if it is not known.
+func (d pathData) Date() string {
+	if d.Time.IsZero() {
+		return "undated"
+	}
+	return d.Time.Format("2006-01-02")
+}
+
+// Year returns the year of the item, or "undated".
+func (d pathData) Year() string {
+	if d.Time.IsZero() {
+		return "undated"
+	}
+	return d.Time.Format("2006")
+}
+
+// Month returns the month of the item as two
+// digits, or "undated".
+func (d pathData) Month() string {
+	if d.Time.IsZero() {
+		return "undated"
+	}
+	return d.Time.Format("01")
+}
+
+// newPathData returns the data for the path of an item
+// with the given name, ID, and time in pa's collection
+// folder collDirName.
+func newPathData(pa providerAccount, collDirName, name, id string, t time.Time) pathData {
+	acctPath := pa.accountPath()
+	return pathData{
+		Provider:   pa.provider.Name,
+		Username:   filepath.Base(acctPath),
+		Account:    filepath.ToSlash(acctPath),
+		Collection: collDirName,
+		Name:       SafeFilename(name),
+		ID:         id,
+		Time:       t,
+	}
+}
+
+// parsePathTemplate parses and checks a path template.
+func parsePathTemplate(text string) (*template.Template, error) {
+	tpl, err := template.New("path").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parsing path template: %v", err)
+	}
+	sample := pathData{
+		Provider:   "provider",
+		Username:   "user",
+		Account:    "provider/user",
+		Collection: "album",
+		Name:       "photo.jpg",
+		ID:         "id",
+		Time:       time.Now(),
+	}
+	if _, err := renderPath(tpl, sample); err != nil {
+		return nil, err
+	}
+	return tpl, nil
+}
+
+// renderPath executes tpl with data and returns the resulting
+// repo-relative path. It is an error for the path to be empty
+// or to lead outside the repository.
+func renderPath(tpl *template.Template, data pathData) (string, error) {
+	var buf bytes.Buffer
+	err := tpl.Execute(&buf, data)
+	if err != nil {
+		return "", fmt.Errorf("executing path template: %v", err)
+	}
+	fpath := filepath.Clean(filepath.FromSlash(strings.TrimSpace(buf.String())))
+	if fpath == "." || filepath.IsAbs(fpath) ||
+		fpath == ".." || strings.HasPrefix(fpath, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path template gives invalid path '%s'", buf.String())
+	}
+	return fpath, nil
+}
+
+// SetPathTemplate sets the template used for the paths of new
+// items. It is saved in the database so that it is used on
+// later runs too, until it is changed again. Items that are
+// already in the repository are not moved.
+//
+// The template is a Go text/template which is given the item's
+// Provider, Username, Account (the account's folder), Collection
+// (the collection's folder), Name, ID, and Time, and also has
+// Date, Year, and Month. It must produce a path relative to the
+// repository, like DefaultPathTemplate.
+func (r *Repository) SetPathTemplate(text string) error {
+	tpl, err := parsePathTemplate(text)
+	if err != nil {
+		return err
+	}
+	err = r.db.saveSetting("path_template", text)
+	if err != nil {
+		return fmt.Errorf("saving path template: %v", err)
+	}
+	r.pathTemplate = tpl
+	return nil
+}
+
+// itemPath returns the repo-relative path at which to save an
+// item with the given name, ID, and time in pa's collection
+// folder collDirName, according to the path template.
+func (r *Repository) itemPath(pa providerAccount, collDirName, name, id string, t time.Time) (string, error) {
+	return renderPath(r.pathTemplate, newPathData(pa, collDirName, name, id, t))
+}
+
+// itemTime returns when it was taken, if it is known.
+func itemTime(it Item) time.Time {
+	if timer, ok := it.(ItemTimer); ok {
+		return timer.ItemTime()
+	}
+	return time.Time{}
+}
+
+// inDir returns true if fpath is inside dirPath,
+// at any depth. Both paths must be repo-relative.
+func inDir(fpath, dirPath string) bool {
+	rel, err := filepath.Rel(dirPath, fpath)
+	return err == nil && rel != "." && rel != ".." &&
+		!strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,79 @@
+package photobak
+
+import (
+	"context"
+	"sync"
+)
+
+// PauseMarkerName is the name of the file that pauses the
+// downloads of a photobak process using the repository while
+// it exists, if the process watches for it (the photobak
+// command does; see Pause).
+const PauseMarkerName = ".photobak-paused"
+
+// pauser holds the state of Pause and Resume.
+type pauser struct {
+	mu      sync.Mutex
+	paused  bool
+	resumed chan struct{} // closed by Resume
+}
+
+// Pause pauses the downloads of Store and Sync: items being
+// downloaded are finished, but no more are started until
+// Resume is called, so that the bandwidth can be used for
+// something else for a while. Listing items goes on until
+// the queue is full, and nothing is lost by pausing; if the
+// run is canceled while paused, it stops as usual. A Paused
+// progress event is reported. It is safe to call at any time,
+// even before a run starts, which then starts paused.
+func (r *Repository) Pause() {
+	r.pause.mu.Lock()
+	if r.pause.paused {
+		r.pause.mu.Unlock()
+		return
+	}
+	r.pause.paused = true
+	r.pause.resumed = make(chan struct{})
+	r.pause.mu.Unlock()
+	repoLog.Warnf("Paused downloads; items being downloaded will be finished")
+	r.progress(ProgressEvent{Type: Paused})
+}
+
+// Resume resumes downloads paused by Pause,
+// and reports a Resumed progress event.
+func (r *Repository) Resume() {
+	r.pause.mu.Lock()
+	if !r.pause.paused {
+		r.pause.mu.Unlock()
+		return
+	}
+	r.pause.paused = false
+	close(r.pause.resumed)
+	r.pause.mu.Unlock()
+	repoLog.Warnf("Resumed downloads")
+	r.progress(ProgressEvent{Type: Resumed})
+}
+
+// Paused returns true if downloads are paused (see Pause).
+func (r *Repository) Paused() bool {
+	r.pause.mu.Lock()
+	defer r.pause.mu.Unlock()
+	return r.pause.paused
+}
+
+// waitWhilePaused blocks while downloads are paused, and
+// returns the context's error if ctx is done first.
+func (r *Repository) waitWhilePaused(ctx context.Context) error {
+	r.pause.mu.Lock()
+	paused, resumed := r.pause.paused, r.pause.resumed
+	r.pause.mu.Unlock()
+	if !paused {
+		return nil
+	}
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,209 @@
+package photobak
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// pendingBucket is the name of the bucket that journals the
+// downloads in progress, by the repo-relative path of the file
+// being written, so that files left behind by a crash or power
+// loss can be cleaned up the next time the repository is opened
+// (see recoverDownloads).
+const pendingBucket = "pending"
+
+// partialExt is added to the name of an item's file to get the
+// name of the file it is downloaded into, which replaces it once
+// the item is committed to the database (see commitPartial).
+const partialExt = ".part"
+
+// interruptedChangeKey is the change key (or ETag) given to an
+// item whose file was damaged by an interrupted download, so that
+// the next run sees it as changed remotely and downloads it again.
+const interruptedChangeKey = "photobak:interrupted"
+
+// commitPartial puts the finished download of the file at the
+// repo-relative path fpath in place, replacing the file there.
+// If the repository is SyncFriendly, the download is copied
+// instead of renamed.
+func (r *Repository) commitPartial(fpath string) error {
+	partial, full := r.fullPath(fpath)+partialExt, r.fullPath(fpath)
+	if !r.SyncFriendly {
+		return os.Rename(partial, full)
+	}
+	err := os.Remove(full)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = copyFile(partial, full)
+	if err != nil {
+		return err
+	}
+	return os.Remove(partial)
+}
+
+// pendingDownload is a download in progress, as journaled.
+type pendingDownload struct {
+	Account string    `json:"account"` // the key of the item's account
+	ItemID  string    `json:"item_id"`
+	New     bool      `json:"new"` // whether the item was new, rather than changed
+	Started time.Time `json:"started"`
+}
+
+// addPending journals the download of pd into the file at fpath.
+// It must be committed before the file is written.
+func (db *boltDB) addPending(fpath string, pd pendingDownload) error {
+	enc, err := json.Marshal(pd)
+	if err != nil {
+		return err
+	}
+	return db.update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(pendingBucket))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(fpath), enc)
+	})
+}
+
+// removePending removes the download into the file
+// at fpath from the journal, if it is there.
+func (db *boltDB) removePending(fpath string) error {
+	return db.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(pendingBucket))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(fpath))
+	})
+}
+
+// pendingDownloads returns the journaled downloads, by file.
+func (db *boltDB) pendingDownloads() (map[string]pendingDownload, error) {
+	pending := make(map[string]pendingDownload)
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(pendingBucket))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var pd pendingDownload
+			if err := json.Unmarshal(v, &pd); err != nil {
+				return fmt.Errorf("decoding pending download of %s: %v", k, err)
+			}
+			pending[string(k)] = pd
+			return nil
+		})
+	})
+	return pending, err
+}
+
+// endPending removes the download of di from the
+// journal once it has finished, one way or another.
+func (r *Repository) endPending(di *downloadingItem) {
+	if di.journaled == "" {
+		return
+	}
+	err := r.db.removePending(di.journaled)
+	if err != nil {
+		repoLog.Errorf("removing finished download of %s from the journal: %v", di.journaled, err)
+		return
+	}
+	di.journaled = ""
+}
+
+// recoverDownloads cleans up after the downloads that were still
+// in the journal when the repository was last closed, which means
+// photobak was stopped in the middle of them without a chance to
+// clean up, like by a crash or power loss. Downloads that were
+// committed to the database are put in place, and the others are
+// removed, along with the files reserved for new items. If the
+// file of an item that was downloaded again is damaged anyway,
+// the item is marked to be downloaded again by the next run.
+func (r *Repository) recoverDownloads() error {
+	pending, err := r.db.pendingDownloads()
+	if err != nil {
+		return err
+	}
+	for fpath, pd := range pending {
+		err := r.recoverDownload(fpath, pd)
+		if err != nil {
+			return fmt.Errorf("recovering interrupted download of %s: %v", fpath, err)
+		}
+		err = r.db.removePending(fpath)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recoverDownload cleans up after the interrupted
+// download pd into the file at fpath.
+func (r *Repository) recoverDownload(fpath string, pd pendingDownload) error {
+	parts := strings.SplitN(pd.Account, ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("bad account '%s'", pd.Account)
+	}
+	pa := accountFromKey(parts[0], parts[1])
+	exists, err := r.db.accountExists(pa)
+	if err != nil {
+		return err
+	}
+	var dbi *dbItem
+	if exists {
+		dbi, err = r.db.loadItem(pa.key(), pd.ItemID)
+		if err != nil {
+			return err
+		}
+	}
+
+	partial := fpath + partialExt
+	if dbi == nil || dbi.FilePath != fpath {
+		// the item never got saved, or was de-duplicated
+		// and saved with another item's file
+		files := []string{partial}
+		if pd.New {
+			files = append(files, fpath)
+		}
+		for _, file := range files {
+			err := os.Remove(r.fullPath(file))
+			if err == nil {
+				repoLog.Warnf("Removed %s, which was being downloaded when photobak was stopped", file)
+			} else if !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if r.fileExists(partial) {
+		checksum, err := r.hash(partial)
+		if err == nil && bytes.Equal(checksum, dbi.Checksum) {
+			// committed, but not yet put in place
+			repoLog.Warnf("Finishing the download of %s, which was cut off when photobak was stopped", fpath)
+			return r.commitPartial(fpath)
+		}
+		err = os.Remove(r.fullPath(partial))
+		if err != nil {
+			return err
+		}
+		repoLog.Warnf("Removed %s, which was being downloaded when photobak was stopped", partial)
+	}
+
+	checksum, err := r.hash(fpath)
+	if err == nil && bytes.Equal(checksum, dbi.Checksum) {
+		return nil // the file is as it was
+	}
+	repoLog.Warnf("%s: %s was being downloaded again when photobak was stopped; it will be downloaded again next time",
+		pa, fpath)
+	dbi.ETag, dbi.ChangeKey = interruptedChangeKey, interruptedChangeKey
+	r.recordFileStat(dbi) // not a change made outside photobak
+	return r.db.saveItem(pa.key(), dbi.ID, dbi)
+}
@@ -0,0 +1,268 @@
+package photobak
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	// image formats that can be perceptually hashed
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+// imageHash returns the perceptual hash of the image in the file
+// at fullPath, or nil if the file is not an image that can be
+// decoded. Unlike a checksum, the perceptual hash of a photo
+// stays (nearly) the same if the photo is re-encoded, resized,
+// or stripped of its metadata, as providers sometimes do.
+//
+// The hash is a difference hash ("dHash"): the image is shrunk
+// to 9x8 gray pixels, and each bit tells whether a pixel is
+// brighter than the one to its right.
+func imageHash(fullPath string) []byte {
+	if !hashableImage(fullPath) {
+		return nil
+	}
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil
+	}
+
+	const w, h = 9, 8
+	var gray [h][w]float64
+	bounds := img.Bounds()
+	if bounds.Dx() < w || bounds.Dy() < h {
+		return nil
+	}
+	for y := 0; y < h; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/h
+		y1 := bounds.Min.Y + (y+1)*bounds.Dy()/h
+		for x := 0; x < w; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/w
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/w
+			gray[y][x] = averageGray(img, x0, y0, x1, y1)
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w-1; x++ {
+			hash <<= 1
+			if gray[y][x] > gray[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, hash)
+	return buf
+}
+
+// averageGray returns the average luminance of the pixels of
+// img in the rectangle from (x0, y0) to (x1, y1). Large areas
+// are sampled instead of visiting every pixel.
+func averageGray(img image.Image, x0, y0, x1, y1 int) float64 {
+	const maxSamples = 16 // per side
+	stepX := (x1-x0)/maxSamples + 1
+	stepY := (y1-y0)/maxSamples + 1
+	var sum float64
+	var n int
+	for y := y0; y < y1; y += stepY {
+		for x := x0; x < x1; x += stepX {
+			r, g, b, _ := img.At(x, y).RGBA()
+			sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return sum / float64(n)
+}
+
+// hashableImage returns true if the file at fpath is
+// named like an image that imageHash can decode.
+func hashableImage(fpath string) bool {
+	switch strings.ToLower(filepath.Ext(fpath)) {
+	case ".jpg", ".jpeg", ".png", ".gif":
+		return true
+	}
+	return false
+}
+
+// hashDistance returns the number of bits
+// that differ between perceptual hashes a and b.
+func hashDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// Dupes finds photos in the repository that look the same,
+// even if their contents are not identical (for example, if
+// a provider re-encoded one of them). Photos are considered
+// the same if their perceptual hashes differ by no more than
+// maxDistance bits (out of 64); 0 finds only photos that look
+// exactly alike. Photos that were downloaded before perceptual
+// hashes were computed are hashed and updated first.
+//
+// It returns groups of the repo-relative paths of files that
+// look the same. Items whose content is identical are already
+// stored only once, so each file appears only once. The still
+// of a live photo is followed by its video, since the two are
+// one photo and should be kept or removed together.
+func (r *Repository) Dupes(maxDistance int) ([][]string, error) {
+	if maxDistance < 0 || maxDistance > 15 {
+		return nil, fmt.Errorf("distance must be between 0 and 15")
+	}
+
+	hashes, liveVideos, err := r.perceptualHashes()
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, len(hashes))
+	for fpath := range hashes {
+		files = append(files, fpath)
+	}
+	sort.Strings(files)
+
+	// if two hashes differ by at most maxDistance bits,
+	// at least one of maxDistance+1 chunks of them must
+	// be the same; so only compare hashes that share one
+	chunks := maxDistance + 1
+	candidates := make(map[[2]uint64][]int)
+	for i, fpath := range files {
+		for c := 0; c < chunks; c++ {
+			key := [2]uint64{uint64(c), hashChunk(hashes[fpath], c, chunks)}
+			candidates[key] = append(candidates[key], i)
+		}
+	}
+
+	// group the files that are alike
+	parent := make([]int, len(files))
+	for i := range parent {
+		parent[i] = i
+	}
+	var root func(int) int
+	root = func(i int) int {
+		if parent[i] != i {
+			parent[i] = root(parent[i])
+		}
+		return parent[i]
+	}
+	for _, list := range candidates {
+		for i := 0; i < len(list); i++ {
+			for j := i + 1; j < len(list); j++ {
+				a, b := list[i], list[j]
+				if hashDistance(hashes[files[a]], hashes[files[b]]) <= maxDistance {
+					ra, rb := root(a), root(b)
+					if ra < rb {
+						parent[rb] = ra
+					} else {
+						parent[ra] = rb
+					}
+				}
+			}
+		}
+	}
+
+	groupOf := make(map[int]int)
+	var groups [][]string
+	for i, fpath := range files {
+		rt := root(i)
+		g, ok := groupOf[rt]
+		if !ok {
+			g = len(groups)
+			groupOf[rt] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], fpath)
+	}
+	dupes := groups[:0]
+	for _, group := range groups {
+		if len(group) < 2 {
+			continue
+		}
+		withVideos := make([]string, 0, len(group))
+		for _, fpath := range group {
+			withVideos = append(withVideos, fpath)
+			if video, ok := liveVideos[fpath]; ok {
+				withVideos = append(withVideos, video)
+			}
+		}
+		dupes = append(dupes, withVideos)
+	}
+	return dupes, nil
+}
+
+// hashChunk returns the c'th of n equal chunks of
+// hash's bits; the last chunk gets the leftover bits.
+func hashChunk(hash uint64, c, n int) uint64 {
+	size := uint(64 / n)
+	chunk := hash >> (uint(c) * size)
+	if c < n-1 {
+		chunk &= 1<<size - 1
+	}
+	return chunk
+}
+
+// perceptualHashes returns the perceptual hashes of all the
+// photos in the repository, keyed by repo-relative file path,
+// and the file of the video of each that is the still of a live
+// photo. Items without a hash yet are hashed and saved.
+func (r *Repository) perceptualHashes() (map[string]uint64, map[string]string, error) {
+	accounts, err := r.db.storedAccounts()
+	if err != nil {
+		return nil, nil, fmt.Errorf("listing accounts: %v", err)
+	}
+
+	hashes := make(map[string]uint64)
+	liveVideos := make(map[string]string)
+	for _, pa := range accounts {
+		itemIDs, err := r.db.itemIDs(pa)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, itemID := range itemIDs {
+			dbi, err := r.db.loadItem(pa.key(), itemID)
+			if err != nil {
+				return nil, nil, err
+			}
+			if dbi == nil {
+				continue
+			}
+			if dbi.PHash == nil && hashableImage(dbi.FilePath) {
+				dbi.PHash = imageHash(r.fullPath(dbi.FilePath))
+				if dbi.PHash != nil {
+					err := r.db.saveItem(pa.key(), itemID, dbi)
+					if err != nil {
+						repoLog.Errorf("saving perceptual hash of %s: %v", dbi.FilePath, err)
+					}
+				}
+			}
+			if len(dbi.PHash) == 8 {
+				hashes[dbi.FilePath] = binary.BigEndian.Uint64(dbi.PHash)
+				if dbi.LivePair != "" && !isVideo(dbi.Name) {
+					video, err := r.db.loadItem(pa.key(), dbi.LivePair)
+					if err != nil {
+						return nil, nil, err
+					}
+					if video != nil {
+						liveVideos[dbi.FilePath] = video.FilePath
+					}
+				}
+			}
+		}
+	}
+
+	return hashes, liveVideos, nil
+}
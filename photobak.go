@@ -1,19 +1,14 @@
 package photobak
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
 	"path/filepath"
 	"strings"
 	"time"
 )
 
-// Info is a log to write informational and
-// notice messages to.
-var Info = log.New(ioutil.Discard, "", 0)
-
 // Client is a type that can interfact with a media
 // storage service.
 type Client interface {
@@ -26,17 +21,20 @@ type Client interface {
 	// ListCollections should return the list of all the
 	// collections of media (i.e. albums) from which
 	// photos (and videos, etc.) will be downloaded.
-	ListCollections() ([]Collection, error)
+	ListCollections(context.Context) ([]Collection, error)
 
 	// ListCollectionItems gets all the media in the
 	// collection and sends each one down the channel.
 	// The implementation MUST close the Item channel
-	// when there are no more items to list!
-	ListCollectionItems(Collection, chan Item) error
+	// when there are no more items to list! It should
+	// stop listing and return when the context is
+	// canceled.
+	ListCollectionItems(context.Context, Collection, chan Item) error
 
 	// DownloadItemInto gets the item from the service
-	// and writes it to the writer.
-	DownloadItemInto(Item, io.Writer) error
+	// and writes it to the writer. It should abort the
+	// download when the context is canceled.
+	DownloadItemInto(context.Context, Item, io.Writer) error
 }
 
 // Collection is a collection of media, like a
@@ -50,10 +48,9 @@ type Collection interface {
 
 	// CollectionName returns the human-readable
 	// name (or a filename) for this collection.
-	// No sanitization is performed on this
-	// name, so implementations must ensure the
-	// return value is safe to use as a directory
-	// name on the file system.
+	// The repository makes the name safe to use
+	// as the name of a folder (see SafeFilename)
+	// when it makes the collection's folder.
 	CollectionName() string
 }
 
@@ -72,9 +69,9 @@ type Item interface {
 	ItemID() string
 
 	// ItemName returns the file name of the item (with
-	// extension). No sanitization is performed on the
-	// name, so implementations must ensure that the
-	// name is safe to use as a filename.
+	// extension). The repository makes it safe to use
+	// as a file name (see SafeFilename) when it saves
+	// the item's file.
 	ItemName() string
 
 	// ItemETag returns the ETag of this item. If the
@@ -92,9 +89,13 @@ type Item interface {
 
 // collection wraps a Collection with
 // vital name+path information used
-// for creating/updating one.
+// for creating/updating one. id is
+// the ID it is stored under, which
+// is not CollectionID() if that is
+// an alias (see MapIDs).
 type collection struct {
 	Collection
+	id      string
 	dirName string
 	dirPath string
 }
@@ -111,6 +112,7 @@ type item struct {
 	filePath    string
 	isNew       bool
 	collections map[string]struct{}
+	protection  Protection
 }
 
 type itemContext struct {
@@ -119,46 +121,74 @@ type itemContext struct {
 	ac             accountClient
 	saveEverything bool
 	checkIntegrity bool
+	deepIntegrity  bool // hash the file even if its size and modification time are unchanged
+	run            *collectionRun
+	index          int // of the item in the listing of the collection
 }
 
 // dbCollection represents a collection (album,
 // bucket, or stream) of photos/videos stored in
 // the database.
 type dbCollection struct {
-	ID      string    // unique ID
-	Name    string    // name of collection
-	DirName string    // the name of the directory representing this collection
-	DirPath string    // the repo-relative path to collection directory on disk
-	Saved   time.Time // when this collection was put into the DB (or updated)
-	Meta    collectionMeta
-	Items   map[string]struct{} // the IDs of items that are in this collection
+	ID         string    // unique ID
+	Name       string    // name of collection
+	DirName    string    // the name of the directory representing this collection
+	DirPath    string    // the repo-relative path to collection directory on disk
+	Saved      time.Time // when this collection was put into the DB (or updated)
+	Meta       collectionMeta
+	Items      map[string]struct{} // the IDs of items that are in this collection
+	Order      []string            // the IDs of the items in the order the provider last listed them
+	Protection Protection          // whether this collection is protected from pruning
+	Active     time.Time           // when items were last added to this collection or changed
+	Completed  time.Time           // when all of its items were last listed and processed in one run; zero if never
 }
 
 // collectionMeta is extra information
 // about a collection.
 type collectionMeta struct {
-	API Collection // everything given by remote/API; only stored if requested
+	API       Collection // everything given by remote/API; only stored if requested, and not loaded (see collectionAPI)
+	SealedAPI []byte     // API, but encrypted; used instead of API if the repository has an API key
+
+	Description string // the description of the collection, if the provider has one
+	Cover       string // the ID of the item the provider shows for the collection, if any
 }
 
 // dbItem represents an item stored in the database.
 type dbItem struct {
-	ID          string              // unique ID for this item (should be same across all collections)
-	Name        string              // name as given by the API, usually the file name
-	FileName    string              // same as Name, unless there is another file with the same name in its folder
-	FilePath    string              // repo-relative path to the file on disk
-	Checksum    []byte              // sha256 of the contents that we make while downloading it
-	ETag        string              // ETag, like a hash but given by the API so we can know if it changed remotely
-	Saved       time.Time           // when this item was put into the DB (or updated)
-	Collections map[string]struct{} // the IDs of the collections this photo appears in
-	Meta        itemMeta            // extra info that we don't rely on to function correctly
+	ID             string              // unique ID for this item (should be same across all collections)
+	Name           string              // name as given by the API, usually the file name
+	FileName       string              // same as Name, unless there is another file with the same name in its folder
+	FilePath       string              // repo-relative path to the file on disk
+	Checksum       []byte              // checksum of the contents that we make while downloading it (see SetChecksumAlgorithm)
+	Size           int64               // size of the file on disk when photobak last checked or changed it
+	ModTime        time.Time           // modification time of the file on disk when photobak last checked or changed it
+	RemoteSize     int64               // size of the content as the provider listed it when it was downloaded; 0 if unknown
+	Format         string              // format of the file, like "jpeg" or "heic", by its content (see fileFormat); empty if unknown
+	PHash          []byte              // perceptual hash of the image, to find photos that look the same; nil if not an image
+	ETag           string              // ETag, like a hash but given by the API so we can know if it changed remotely
+	ChangeKey      string              // value compared to detect remote changes, if not using ETag
+	ChangeStrategy string              // the change detection strategy ChangeKey is for; empty means ETag
+	Saved          time.Time           // when this item was put into the DB (or updated)
+	Collections    map[string]struct{} // the IDs of the collections this photo appears in
+	Meta           itemMeta            // extra info that we don't rely on to function correctly
+	Protection     Protection          // whether this item is protected from pruning and updates
+	LivePair       string              // the ID of the other half (the still or the video) of the live photo this item is part of, if any
+	Trashed        time.Time           // when the item was first found in the provider's trash; zero if it isn't there
 }
 
 // itemMeta holds extra information about an item.
 // Fields on this struct might not be set.
 type itemMeta struct {
-	API     Item     // everything given by remote/API; only stored if requested
-	Setting *setting // obtained directly from embedded EXIF
-	Caption string   // the caption/summary/description of the item
+	API       Item          // everything given by remote/API; only stored if requested, and not loaded (see itemAPI)
+	SealedAPI []byte        // API, but encrypted; used instead of API if the repository has an API key
+	Setting   *setting      // obtained directly from embedded EXIF, or the metadata of a video
+	Caption   string        // the caption/summary/description of the item
+	Taken     time.Time     // when the item was taken, from the API or EXIF; zero if unknown
+	Camera    string        // make and model of the camera, from the API or EXIF
+	Favorite  bool          // whether the provider says the item is a favorite
+	Duration  time.Duration // how long the item is, if it is a video whose metadata says
+	Codec     string        // the codec of the video, if it is a video whose metadata says
+	Described bool          // whether Taken, Camera, and Favorite were filled in (see views)
 }
 
 // setting is a place and time. This information
@@ -205,7 +235,6 @@ func (pa providerAccount) String() string {
 }
 
 // getAccounts gets a list of all the accounts
-//
 func getAccounts() []providerAccount {
 	var accounts []providerAccount
 	for _, p := range providers {
@@ -244,6 +273,27 @@ type Provider struct {
 	// that can access the provider's API. The credentials
 	// to be used in the client are passed in.
 	NewClient func(credentials []byte) (Client, error)
+
+	// A function like NewClient that is also given a
+	// function to call with the account's credentials
+	// whenever the client changes them, for example when
+	// it refreshes an OAuth2 token, so that they are saved
+	// in place of the old ones. If set, it is used instead
+	// of NewClient.
+	NewRefreshingClient func(credentials []byte, save func(credentials []byte) error) (Client, error)
+
+	// The default change detection strategy for items
+	// from this provider (one of the Change* constants).
+	// If empty, ChangeETag is used.
+	ChangeStrategy string
+
+	// Patterns of the names of collections that the
+	// provider makes automatically, like one with
+	// everything in it, which are processed after the
+	// others, in the order of the patterns, unless the
+	// repository says otherwise (see Repository.LastAlbums).
+	// Patterns are as in Filter.IncludeAlbums.
+	LastAlbums []string
 }
 
 // StringFlagList is used to store flags of repeating
@@ -0,0 +1,140 @@
+package photobak
+
+import (
+	"context"
+	"fmt"
+)
+
+// preflightMargin is how much free space the preflight check
+// leaves beyond the new items, for the database and the
+// other files that Store writes.
+const preflightMargin = 64 << 20
+
+// ListedSizer is an optional interface an Item may implement if
+// its listing says how large it is, without another request. It
+// lets Store check that there is room for the new items before
+// downloading them (see Preflight), skip the ones that are too
+// large (see MaxSize) without asking, and tell when a download
+// was cut short. The size is recorded with the item.
+type ListedSizer interface {
+	// ListedSize returns the size in bytes of the item's
+	// content as it was listed, or -1 if it wasn't.
+	ListedSize() int64
+}
+
+// listedSize returns the size of it as it was listed,
+// or -1 if it wasn't (see ListedSizer).
+func listedSize(it Item) int64 {
+	if ls, ok := it.(ListedSizer); ok {
+		return ls.ListedSize()
+	}
+	return -1
+}
+
+// NotEnoughSpaceError is returned by Store, if Preflight is
+// set, when the new items of an account wouldn't fit in the
+// free space of the repository's disk. None of them were
+// downloaded.
+type NotEnoughSpaceError struct {
+	Account string // provider:username
+	Needed  int64  // the size of the new items that is known, plus some room for the database
+	Free    int64  // the free space of the disk
+	Items   int    // how many new items there are
+	Unknown int    // how many of those are of unknown size
+}
+
+func (e NotEnoughSpaceError) Error() string {
+	return fmt.Sprintf("%s: not enough disk space: %d new items need at least %d bytes, but %d are free",
+		e.Account, e.Items, e.Needed, e.Free)
+}
+
+// preflight lists the items of ar's collections, and returns a
+// NotEnoughSpaceError if the new ones whose listings give their
+// sizes wouldn't fit in the free space of the repository's
+// disk. It returns the listed items by collection ID, so that
+// they don't have to be listed again. If the free space can't
+// be told, it returns nil and doesn't list anything.
+func (r *Repository) preflight(ctx context.Context, ar accountRun) (map[string][]Item, error) {
+	free, err := freeSpace(r.path)
+	if err != nil {
+		repoLog.Warnf("%s: not checking for free space before downloading: %v", ar.ac.account, err)
+		return nil, nil
+	}
+
+	filter := r.filter(ar.ac.account)
+	listed := make(map[string][]Item)
+	seen := make(map[string]bool)
+	var needed int64
+	var items, unknown int
+	for _, coll := range ar.collections {
+		itemChan := make(chan Item)
+		list := []Item{}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for it := range itemChan {
+				list = append(list, it)
+			}
+		}()
+		err := ar.ac.client.ListCollectionItems(ctx, coll, itemChan)
+		<-done
+		if err != nil {
+			return nil, fmt.Errorf("%s: listing %s for preflight check: %v", ar.ac.account, coll.CollectionName(), err)
+		}
+		listed[coll.CollectionID()] = list
+
+		for _, it := range list {
+			if seen[it.ItemID()] || !filter.includesItem(it) {
+				continue
+			}
+			seen[it.ItemID()] = true
+			stored, err := r.db.loadItem(ar.ac.account.key(), it.ItemID())
+			if err != nil {
+				return nil, fmt.Errorf("loading item '%s' from database: %v", it.ItemID(), err)
+			}
+			if stored != nil {
+				continue
+			}
+			items++
+			size := int64(-1)
+			if ls, ok := it.(ListedSizer); ok {
+				size = ls.ListedSize()
+			}
+			if size < 0 {
+				unknown++
+			} else if r.MaxSize <= 0 || size <= r.MaxSize {
+				needed += size
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	repoLog.Infof("%s: %d new items need at least %d bytes (%d are of unknown size); %d bytes are free",
+		ar.ac.account, items, needed, unknown, free)
+	if needed > 0 && needed+preflightMargin > free {
+		return nil, NotEnoughSpaceError{
+			Account: ar.ac.account.String(),
+			Needed:  needed + preflightMargin,
+			Free:    free,
+			Items:   items,
+			Unknown: unknown,
+		}
+	}
+	return listed, nil
+}
+
+// replayItems sends items down itemChan like a client's
+// ListCollectionItems, for items that were already listed.
+func replayItems(ctx context.Context, items []Item, itemChan chan Item) error {
+	defer close(itemChan)
+	for _, it := range items {
+		select {
+		case itemChan <- it:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package photobak
+
+import (
+	"io"
+	"io/ioutil"
+)
+
+// ProgressEventType is the kind of a ProgressEvent.
+type ProgressEventType int
+
+const (
+	// ItemQueued means an item was listed by a
+	// provider and is waiting to be processed.
+	ItemQueued ProgressEventType = iota
+
+	// DownloadStarted means an item is about to be
+	// downloaded (again, if this is a retry).
+	DownloadStarted
+
+	// BytesDownloaded means Bytes more bytes of
+	// the item were downloaded.
+	BytesDownloaded
+
+	// ItemCommitted means a downloaded item was
+	// saved to the repository.
+	ItemCommitted
+
+	// ItemDone means processing of a queued item
+	// finished, whether or not it was downloaded.
+	// If it failed, Err is set.
+	ItemDone
+
+	// ChangesStarted means the repository's files are
+	// about to be changed. The operation waits for the
+	// Progress function to return, so it can be used to
+	// prepare a snapshot or sync tool for the changes.
+	ChangesStarted
+
+	// ChangesFinished means the repository's files are
+	// done being changed, for now; it is a good time to
+	// take a snapshot. The operation waits for the
+	// Progress function to return.
+	ChangesFinished
+
+	// LocalChangeFound means the file of an item was
+	// changed outside photobak (edited, tampered with,
+	// corrupted, or deleted) since it was saved. Err
+	// describes the change.
+	LocalChangeFound
+
+	// Paused means downloads were paused (see Pause);
+	// items being downloaded are still finished.
+	Paused
+
+	// Resumed means paused downloads were resumed.
+	Resumed
+)
+
+// ProgressEvent describes progress of a Store operation.
+type ProgressEvent struct {
+	Type     ProgressEventType
+	Account  string // provider:username
+	ItemID   string
+	FilePath string // repo-relative; only set once known
+	Bytes    int64  // for BytesDownloaded
+	Err      error  // for ItemDone and LocalChangeFound
+}
+
+// progress reports ev to r.Progress, if set.
+func (r *Repository) progress(ev ProgressEvent) {
+	if r.Progress != nil {
+		r.Progress(ev)
+	}
+}
+
+// progressWriter reports every write to
+// the repository as BytesDownloaded.
+type progressWriter struct {
+	r  *Repository
+	ev ProgressEvent
+}
+
+func (pw progressWriter) Write(p []byte) (int, error) {
+	ev := pw.ev
+	ev.Type = BytesDownloaded
+	ev.Bytes = int64(len(p))
+	pw.r.progress(ev)
+	return len(p), nil
+}
+
+// progressWriterFor returns a writer that reports bytes
+// written to it as progress for the given item, or
+// ioutil.Discard if nobody is listening for progress.
+func (r *Repository) progressWriterFor(ev ProgressEvent) io.Writer {
+	if r.Progress == nil {
+		return ioutil.Discard
+	}
+	return progressWriter{r: r, ev: ev}
+}
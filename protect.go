@@ -0,0 +1,145 @@
+package photobak
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Protection describes how an item or collection is
+// protected from changes that come from the remote.
+type Protection int
+
+const (
+	// Unprotected items and collections are kept in
+	// sync with the remote as usual.
+	Unprotected Protection = iota
+
+	// Pinned items and collections are never pruned,
+	// even if they are deleted remotely.
+	Pinned
+
+	// LocalOnly items and collections exist only in the
+	// repository, for example because they were deleted
+	// from the cloud on purpose. They are never pruned
+	// and never updated from the remote.
+	LocalOnly
+)
+
+// String returns the name of the protection.
+func (p Protection) String() string {
+	switch p {
+	case Pinned:
+		return "pinned"
+	case LocalOnly:
+		return "local-only"
+	}
+	return "unprotected"
+}
+
+// Protect sets the protection of the item or collection at fpath,
+// which is a path to a file or collection folder, either absolute
+// or relative to the repository. If a file's content is shared by
+// several items, all of them are protected. It returns the number
+// of items and collections that were changed.
+func (r *Repository) Protect(fpath string, p Protection) (int, error) {
+	relPath, err := r.toRepoRelative(fpath)
+	if err != nil {
+		return 0, err
+	}
+
+	accounts, err := r.db.storedAccounts()
+	if err != nil {
+		return 0, err
+	}
+
+	var changed int
+	for _, pa := range accounts {
+		collIDs, err := r.db.collectionIDs(pa)
+		if err != nil {
+			return changed, err
+		}
+		for _, collID := range collIDs {
+			dbc, err := r.db.loadCollection(pa.key(), collID)
+			if err != nil {
+				return changed, err
+			}
+			if dbc.DirPath != relPath {
+				continue
+			}
+			dbc.Protection = p
+			err = r.db.saveCollection(pa.key(), dbc.ID, dbc)
+			if err != nil {
+				return changed, fmt.Errorf("saving collection %s: %v", dbc.Name, err)
+			}
+			changed++
+		}
+
+		itemIDs, err := r.db.itemIDs(pa)
+		if err != nil {
+			return changed, err
+		}
+		for _, itemID := range itemIDs {
+			dbi, err := r.db.loadItem(pa.key(), itemID)
+			if err != nil {
+				return changed, err
+			}
+			if dbi.FilePath != relPath {
+				continue
+			}
+			dbi.Protection = p
+			err = r.db.saveItem(pa.key(), dbi.ID, dbi)
+			if err != nil {
+				return changed, fmt.Errorf("saving item %s: %v", dbi.Name, err)
+			}
+			changed++
+		}
+	}
+
+	if changed == 0 {
+		return 0, fmt.Errorf("no item or collection found at %s", relPath)
+	}
+
+	return changed, nil
+}
+
+// hasProtectedItems returns true if any of the items
+// in dbc, which belongs to pa, are protected.
+func (r *Repository) hasProtectedItems(pa providerAccount, dbc *dbCollection) (bool, error) {
+	for itemID := range dbc.Items {
+		dbi, err := r.db.loadItem(pa.key(), itemID)
+		if err != nil {
+			return false, err
+		}
+		if dbi != nil && dbi.Protection != Unprotected {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// toRepoRelative converts fpath, which may be absolute or
+// relative to the current directory or to the repository,
+// into a repo-relative path.
+func (r *Repository) toRepoRelative(fpath string) (string, error) {
+	absRepo, err := filepath.Abs(r.path)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(fpath) && !r.fileExists(fpath) {
+		// not relative to the repository, so it
+		// must be relative to the current directory
+		fpath, err = filepath.Abs(fpath)
+		if err != nil {
+			return "", err
+		}
+	}
+	if filepath.IsAbs(fpath) {
+		rel, err := filepath.Rel(absRepo, fpath)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			return "", fmt.Errorf("%s is not inside the repository", fpath)
+		}
+		fpath = rel
+	}
+	return filepath.Clean(fpath), nil
+}
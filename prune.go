@@ -2,33 +2,83 @@ package photobak
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 )
 
 // Prune will update the local repository to match deletions
 // and removals from the remote. It does not perform additive
-// operations.
-func (r *Repository) Prune() error {
+// operations. Items that are in the provider's trash (see
+// TrashLister) are kept until they are deleted for good.
+// Accounts that would lose more than PruneLimit of their
+// items, or whose provider lists no items, are not pruned,
+// and a PruneLimitError is returned (see ForcePrune). Files
+// are kept in TrashDir for a while if TrashRetention is set.
+// Pruning stops early if ctx is canceled.
+func (r *Repository) Prune(ctx context.Context) error {
+	var since time.Time
+	if r.ListingMaxAge > 0 {
+		since = time.Now().Add(-r.ListingMaxAge)
+	}
+	return r.prune(ctx, since)
+}
+
+// prune prunes like Prune, using the cached listings of
+// collections that were made since the given time, unless
+// it is zero.
+func (r *Repository) prune(ctx context.Context, since time.Time) error {
 	accounts, err := r.authorizedAccounts()
 	if err != nil {
 		return err
 	}
 
+	r.beginChanges()
+	defer r.endChanges()
+
+	r.expireTrash()
+	r.trashBatch = time.Now().UTC().Format(trashBatchFormat)
+
+	var limitErr error
 	for _, ac := range accounts {
-		state, err := r.getRemoteState(ac)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		state, listedAt, err := r.getRemoteState(ctx, ac, since)
+		if ctx.Err() != nil {
+			// the remote state may be incomplete, and pruning
+			// based on it could delete items that still exist
+			return ctx.Err()
+		}
 		if err != nil {
-			log.Printf("[ERROR] %v", err)
+			repoLog.Errorf("%v", err)
+			continue
+		}
+		trash, err := r.listTrash(ctx, ac)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			// without knowing what's in the trash, pruning
+			// could delete items that can still be rescued
+			repoLog.Errorf("%s: %v; not pruning it", ac.account, err)
+			continue
+		}
+		err = r.checkPruneLimit(ac.account, state, trash)
+		if err != nil {
+			repoLog.Errorf("%v", err)
+			limitErr = err
 			continue
 		}
 
 		localCollections, err := r.db.collectionIDs(ac.account)
 		if err != nil {
-			log.Printf("[ERROR] %v", err)
+			repoLog.Errorf("%v", err)
 			continue
 		}
 
@@ -38,15 +88,29 @@ func (r *Repository) Prune() error {
 				return err
 			}
 
+			if coll.Protection != Unprotected {
+				repoLog.Infof("Collection '%s' is %s; not pruning it", coll.DirName, coll.Protection)
+				continue
+			}
+
 			if _, ok := state[collID]; !ok {
-				// collection does not exist remotely anymore; delete locally.
-				Info.Printf("Collection '%s' does not exist remotely anymore; deleting local copy", coll.DirName)
-				err := r.deleteCollection(ac.account, coll)
+				protected, err := r.hasProtectedItems(ac.account, coll)
 				if err != nil {
-					log.Printf("[ERROR] %v", err)
+					return err
+				}
+				if !protected && !hasTrashedItems(coll, trash) {
+					// collection does not exist remotely anymore; delete locally.
+					repoLog.Infof("Collection '%s' does not exist remotely anymore; deleting local copy", coll.DirName)
+					err := r.deleteCollection(ac.account, coll)
+					if err != nil {
+						repoLog.Errorf("%v", err)
+						continue
+					}
 					continue
 				}
-				continue
+				// keep the collection for the sake of its protected
+				// or trashed items, but remove all the others from it below
+				repoLog.Infof("Collection '%s' does not exist remotely anymore, but has protected items or items in the trash; keeping it", coll.DirName)
 			}
 
 			// check for items in the collection that may
@@ -59,7 +123,35 @@ func (r *Repository) Prune() error {
 					if err != nil {
 						return err
 					}
-					Info.Printf("Item '%s' does not exist in '%s' anymore; deleting local copy", item.FileName, coll.DirName)
+					if item.Protection != Unprotected {
+						repoLog.Infof("Item '%s' does not exist in '%s' anymore, but it is %s; keeping it",
+							item.FileName, coll.DirName, item.Protection)
+						continue
+					}
+					if _, ok := trash[itemID]; ok {
+						err := r.setTrashed(ac.account, item, true)
+						if err != nil {
+							return err
+						}
+						continue
+					}
+					other, err := r.keptLivePair(ac.account, item, state[collID], trash)
+					if err != nil {
+						return err
+					}
+					if other != nil {
+						repoLog.Infof("Item '%s' does not exist in '%s' anymore, but it is half of a live photo with '%s', which is kept; keeping it",
+							item.FileName, coll.DirName, other.FileName)
+						continue
+					}
+					if listed, ok := listedAt[collID]; ok && item.Saved.After(listed) {
+						// saved since the collection was listed, so
+						// it may just be too new to be in the listing
+						repoLog.Infof("Item '%s' is not listed in '%s', but it was saved after the listing was made; keeping it",
+							item.FileName, coll.DirName)
+						continue
+					}
+					repoLog.Infof("Item '%s' does not exist in '%s' anymore; deleting local copy", item.FileName, coll.DirName)
 					err = r.deleteItemFromCollection(ac.account, item, coll)
 					if err != nil {
 						return err
@@ -69,7 +161,7 @@ func (r *Repository) Prune() error {
 		}
 	}
 
-	return nil
+	return limitErr
 }
 
 func (r *Repository) deleteCollection(pa providerAccount, dbc *dbCollection) error {
@@ -98,7 +190,7 @@ func (r *Repository) deleteCollection(pa providerAccount, dbc *dbCollection) err
 	if err != nil {
 		return err
 	}
-	names, err := f.Readdirnames(2)
+	names, err := f.Readdirnames(-1)
 	f.Close()
 	if err != nil && err != io.EOF {
 		return err
@@ -107,9 +199,12 @@ func (r *Repository) deleteCollection(pa providerAccount, dbc *dbCollection) err
 	// delete the folder if empty or if the
 	// only files are those stupid hidden
 	// ones created by file explorer programs
+	// (or our generated files, or moved files
+	// yet to be removed)
 	delFolder := len(names) == 0
 	for _, name := range names {
-		if len(name) > 0 && name[0] != '.' && name != "Thumbs.db" {
+		fpath := filepath.Join(dbc.DirPath, name)
+		if !isJunkFile(name) && !r.isGeneratedFile(fpath) && !r.removingLater(fpath) {
 			delFolder = false
 			break
 		}
@@ -122,39 +217,82 @@ func (r *Repository) deleteCollection(pa providerAccount, dbc *dbCollection) err
 	return nil
 }
 
+// isJunkFile returns true if name is one of those
+// hidden files created by file explorer programs.
+func isJunkFile(name string) bool {
+	return (len(name) > 0 && name[0] == '.') || name == "Thumbs.db"
+}
+
 type idSet map[string]struct{}
 
-func (r *Repository) getRemoteState(ac accountClient) (map[string]idSet, error) {
+// getRemoteState returns the IDs of the items in each of ac's
+// collections that exist remotely, keyed by the ID the collection
+// is stored under, and when each collection was listed. Listings
+// cached since the given time are used, unless it is zero.
+func (r *Repository) getRemoteState(ctx context.Context, ac accountClient, since time.Time) (map[string]idSet, map[string]time.Time, error) {
 	remote := make(map[string]idSet)
+	listedAt := make(map[string]time.Time)
 
-	collections, err := ac.client.ListCollections()
+	// items and collections are stored under their old
+	// IDs if their current ones are aliases of them
+	aliases, err := r.db.loadIDAliases(ac.account)
 	if err != nil {
-		return remote, err
+		return remote, listedAt, fmt.Errorf("loading aliases: %v", err)
+	}
+	cached, err := r.db.loadListings(ac.account)
+	if err != nil {
+		return remote, listedAt, fmt.Errorf("loading cached listings: %v", err)
 	}
 
+	collections, err := ac.client.ListCollections(ctx)
+	if err != nil {
+		return remote, listedAt, err
+	}
+
+	listed := make(map[string]cachedListing)
 	for _, coll := range collections {
-		itemChan := make(chan Item)
-		collID := coll.CollectionID()
+		collID := aliases.collection(coll.CollectionID())
+		if cl, ok := cached[collID]; ok && !since.IsZero() && !cl.Listed.Before(since) {
+			remote[collID] = cl.Items
+			listedAt[collID] = cl.Listed
+			continue
+		}
 
+		itemChan := make(chan Item)
 		remote[collID] = make(idSet)
+		listedAt[collID] = time.Now()
 
 		var wg sync.WaitGroup
 		wg.Add(1)
 		go func(collID string, itemChan chan Item) {
 			defer wg.Done()
 			for item := range itemChan {
-				remote[collID][item.ItemID()] = struct{}{}
+				for _, itemID := range aliases.itemIDs(item) {
+					remote[collID][itemID] = struct{}{}
+				}
 			}
 		}(collID, itemChan)
 
-		err = ac.client.ListCollectionItems(coll, itemChan)
+		err = ac.client.ListCollectionItems(ctx, coll, itemChan)
 		if err != nil {
-			return remote, fmt.Errorf("listing collection items: %v", err)
+			return remote, listedAt, fmt.Errorf("listing collection items: %v", err)
 		}
 		wg.Wait()
+		listed[collID] = cachedListing{Listed: listedAt[collID], Items: remote[collID]}
+	}
+
+	if ctx.Err() == nil {
+		keep := make(idSet, len(remote))
+		for collID := range remote {
+			keep[collID] = struct{}{}
+		}
+		err := r.db.saveListings(ac.account, listed, keep)
+		if err != nil {
+			repoLog.Errorf("%s: saving listings: %v", ac.account, err)
+		}
 	}
 
-	return remote, nil
+	return remote, listedAt, nil
 }
 
 // deleteItem cleanly removes from the repository the item dbi
@@ -169,7 +307,13 @@ func (r *Repository) deleteItem(pa providerAccount, dbc *dbCollection, dbi *dbIt
 	// with the same checksum point to it) or by moving it to another item
 	// with the same checksum and re-pointing everything to the new path.
 
-	if r.fileExists(filepath.Join(dbc.DirPath, dbi.FileName)) {
+	// if the path template put the file outside of every collection's
+	// folder, it is deleted when no other items use it, but not moved.
+	ownsFile := inDir(dbi.FilePath, dbc.DirPath)
+	standalone := !ownsFile && !r.inCollectionFolder(pa, dbi)
+
+	var deleteFile bool
+	if (ownsFile || standalone) && r.fileExists(dbi.FilePath) {
 		// find out if this is the last item that uses this file
 		list, err := r.db.itemsWithChecksum(dbi.Checksum)
 		if err != nil {
@@ -183,12 +327,11 @@ func (r *Repository) deleteItem(pa providerAccount, dbc *dbCollection, dbi *dbIt
 			}
 		}
 		if len(list) == 0 {
-			// that was the last one, so we're good to delete the file
-			err := os.Remove(r.fullPath(dbi.FilePath))
-			if err != nil {
-				log.Printf("[ERROR] deleting file for %s: %v", dbi.Name, err)
-			}
-		} else {
+			// that was the last one, so we're good to delete the file,
+			// after the references to it (hard links need the file
+			// to be found) are removed
+			deleteFile = true
+		} else if ownsFile {
 			// other items still reference this file, so move it to any one of them
 			otherItem, err := r.db.loadItem(list[0].AcctKey, list[0].ItemID)
 			if err != nil {
@@ -206,15 +349,38 @@ func (r *Repository) deleteItem(pa providerAccount, dbc *dbCollection, dbi *dbIt
 	for collID := range dbi.Collections {
 		err := r.removeItemFromCollection(pa, dbi, collID)
 		if err != nil {
-			log.Printf("[ERROR] %v", err)
+			repoLog.Errorf("%v", err)
 			continue
 		}
 	}
 
+	if deleteFile {
+		err := r.discardFile(dbi.FilePath)
+		if err != nil {
+			repoLog.Errorf("deleting file for %s: %v", dbi.Name, err)
+		}
+	}
+
 	// delete item from the database
 	return r.db.deleteItem(pa, dbi.ID)
 }
 
+// inCollectionFolder returns true if the file of pa's item dbi
+// is in the folder of any of the collections it belongs to, or
+// if that can't be determined.
+func (r *Repository) inCollectionFolder(pa providerAccount, dbi *dbItem) bool {
+	for collID := range dbi.Collections {
+		dbc, err := r.db.loadCollection(pa.key(), collID)
+		if err != nil || dbc == nil {
+			return true
+		}
+		if inDir(dbi.FilePath, dbc.DirPath) {
+			return true
+		}
+	}
+	return false
+}
+
 // removeItemFromCollection removes pa's item dbi from collID.
 // It does not delete the file on disk but just removes it
 // from the collection. dbi is saved to the DB at the end.
@@ -252,7 +418,7 @@ func (r *Repository) deleteItemFromCollection(pa providerAccount, dbi *dbItem, d
 		return r.deleteItem(pa, dbc, dbi)
 	}
 
-	if r.fileExists(filepath.Join(dbc.DirPath, dbi.FileName)) {
+	if inDir(dbi.FilePath, dbc.DirPath) && r.fileExists(dbi.FilePath) {
 		// this collection is the lucky one with the hard copy of
 		// the file, so we need to move it to another collection
 		// that has it and re-point all the references on disk to
@@ -294,24 +460,57 @@ func (r *Repository) movePhysicalFile(originAcctKey []byte, originColl *dbCollec
 		return "", err
 	}
 
-	// find unique filename in the collection
-	itemFileName, err := r.reserveUniqueFilename(destColl.DirPath, dest.Name, false)
+	// find where the file goes according to the path
+	// template, and a unique filename there
+	destAcctParts := strings.SplitN(string(destAcctKey), ":", 2)
+	if len(destAcctParts) != 2 {
+		return "", fmt.Errorf("malformed account key: %s", destAcctKey)
+	}
+	var taken time.Time
+	if dest.Meta.Setting != nil {
+		taken = dest.Meta.Setting.OriginTime
+	}
+	targetPath, err := r.itemPath(accountFromKey(destAcctParts[0], destAcctParts[1]),
+		destColl.DirName, dest.Name, dest.ID, taken)
+	if err != nil {
+		return "", err
+	}
+	targetDir := filepath.Dir(targetPath)
+	err = os.MkdirAll(r.fullPath(targetDir), 0700)
+	if err != nil {
+		return "", fmt.Errorf("creating folder for item: %v", err)
+	}
+
+	// that destination should have this item in its media list file
+	// (or a link to it), so delete that entry, because now it lives in
+	// that collection (unless the path template put it outside the
+	// collection's folder). this is done before the move so that the
+	// link's name becomes available and hard links can be found.
+	movingIn := inDir(targetPath, destColl.DirPath)
+	if movingIn {
+		err = r.replaceInMediaListFile(destColl.DirPath, origin.FilePath, "")
+		if err != nil {
+			return "", err
+		}
+	}
+
+	itemFileName, err := r.reserveUniqueFilename(targetDir, filepath.Base(targetPath), false)
 	if err != nil {
 		return "", fmt.Errorf("reserving unique filename: %v", err)
 	}
 
 	// get destination path and move file
-	newFilePath := filepath.Join(destColl.DirPath, itemFileName)
-	err = os.Rename(r.fullPath(origin.FilePath), r.fullPath(newFilePath))
+	newFilePath := filepath.Join(targetDir, itemFileName)
+	err = r.moveFile(origin.FilePath, newFilePath)
 	if err != nil {
 		return newFilePath, err
 	}
 
-	// that destination should have this item in its media list file,
-	// so delete that entry, because now it lives in that collection.
-	err = r.replaceInMediaListFile(destColl.DirPath, origin.FilePath, "")
-	if err != nil {
-		return newFilePath, err
+	if !movingIn {
+		err = r.replaceInMediaListFile(destColl.DirPath, origin.FilePath, newFilePath)
+		if err != nil {
+			return newFilePath, err
+		}
 	}
 
 	// update all other media list files to point to the new file path.
@@ -0,0 +1,89 @@
+package photobak
+
+import "fmt"
+
+// PruneLimitError is returned by Prune and Sync when an account
+// was not pruned because too many of its items would be removed
+// (see PruneLimit), or because its provider listed no items at
+// all, which is more likely a glitch than a fact.
+type PruneLimitError struct {
+	Account        string  // the account, as provider:username
+	Removed, Total int     // how many items would be removed, of how many
+	Limit          float64 // the PruneLimit that was exceeded, if any
+	Empty          bool    // whether the provider listed no items
+}
+
+func (e PruneLimitError) Error() string {
+	if e.Empty {
+		return fmt.Sprintf("%s: the service listed no items, but %d are stored; refusing to prune, in case the listing is wrong",
+			e.Account, e.Total)
+	}
+	return fmt.Sprintf("%s: refusing to prune %d of %d items (%.1f%%), which is more than the limit of %.1f%%",
+		e.Account, e.Removed, e.Total, 100*float64(e.Removed)/float64(e.Total), 100*e.Limit)
+}
+
+// checkPruneLimit returns a PruneLimitError if pa's remote state
+// is empty while items are stored for it, or if pruning pa according
+// to its remote state and trash would remove more than PruneLimit of
+// its items from their collections, unless ForcePrune is set.
+func (r *Repository) checkPruneLimit(pa providerAccount, state map[string]idSet, trash idSet) error {
+	if r.ForcePrune {
+		return nil
+	}
+	itemIDs, err := r.db.itemIDs(pa)
+	if err != nil {
+		return err
+	}
+	if len(itemIDs) == 0 {
+		return nil
+	}
+	empty := true
+	for _, listed := range state {
+		if len(listed) > 0 {
+			empty = false
+			break
+		}
+	}
+	if empty {
+		return PruneLimitError{Account: pa.String(), Removed: len(itemIDs), Total: len(itemIDs), Empty: true}
+	}
+	if r.PruneLimit <= 0 {
+		return nil
+	}
+	collIDs, err := r.db.collectionIDs(pa)
+	if err != nil {
+		return err
+	}
+
+	removed := make(idSet)
+	for _, collID := range collIDs {
+		coll, err := r.db.loadCollection(pa.key(), collID)
+		if err != nil {
+			return err
+		}
+		if coll == nil || coll.Protection != Unprotected {
+			continue
+		}
+		listed, collExists := state[collID]
+		for itemID := range coll.Items {
+			if _, ok := listed[itemID]; ok && collExists {
+				continue
+			}
+			if _, ok := trash[itemID]; ok {
+				continue
+			}
+			dbi, err := r.db.loadItem(pa.key(), itemID)
+			if err != nil {
+				return err
+			}
+			if dbi != nil && dbi.Protection == Unprotected {
+				removed[itemID] = struct{}{}
+			}
+		}
+	}
+
+	if float64(len(removed)) > r.PruneLimit*float64(len(itemIDs)) {
+		return PruneLimitError{Account: pa.String(), Removed: len(removed), Total: len(itemIDs), Limit: r.PruneLimit}
+	}
+	return nil
+}
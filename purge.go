@@ -0,0 +1,266 @@
+package photobak
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PurgeReport describes what was removed from the
+// repository by PurgeAccount, and anything that
+// could not be verified as removed afterward.
+type PurgeReport struct {
+	Account      string
+	Collections  int      // number of collections removed
+	Items        int      // number of items removed
+	FilesDeleted int      // files whose content belonged only to this account
+	FilesShared  int      // files kept because other accounts have the same content
+	Problems     []string // anything left behind, found during verification
+}
+
+// String returns a human-readable report.
+func (pr PurgeReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Purged account %s:\n", pr.Account)
+	fmt.Fprintf(&b, "  Collections removed: %d\n", pr.Collections)
+	fmt.Fprintf(&b, "  Items removed:       %d\n", pr.Items)
+	fmt.Fprintf(&b, "  Files deleted:       %d\n", pr.FilesDeleted)
+	fmt.Fprintf(&b, "  Files kept (shared): %d\n", pr.FilesShared)
+	if len(pr.Problems) == 0 {
+		fmt.Fprintf(&b, "Verification: no data for this account remains in the repository.\n")
+	} else {
+		fmt.Fprintf(&b, "Verification found %d problem(s):\n", len(pr.Problems))
+		for _, p := range pr.Problems {
+			fmt.Fprintf(&b, "  - %s\n", p)
+		}
+	}
+	return b.String()
+}
+
+// PurgeAccount removes all data pertaining to account, which
+// must be in the form "provider:username", from the repository:
+// its files, database entries, stored credentials, and its place
+// among the saved accounts (see SaveAccount). Files whose content
+// is shared with items in other accounts are kept for those
+// accounts. The account does not need to be configured, and no
+// requests are made to the provider.
+//
+// After purging, the repository is checked to verify that
+// nothing remains; anything found is listed in the report.
+func (r *Repository) PurgeAccount(account string) (PurgeReport, error) {
+	report := PurgeReport{Account: account}
+
+	parts := strings.SplitN(account, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return report, fmt.Errorf("account must be in the form provider:username")
+	}
+	pa := accountFromKey(parts[0], parts[1])
+
+	exists, err := r.db.accountExists(pa)
+	if err != nil {
+		return report, err
+	}
+	if !exists {
+		return report, fmt.Errorf("account '%s' does not exist in the repository", pa)
+	}
+
+	r.beginChanges()
+	defer r.endChanges()
+
+	// tally the files before anything is deleted, so
+	// we know which content is shared with others
+	itemIDs, err := r.db.itemIDs(pa)
+	if err != nil {
+		return report, err
+	}
+	seen := make(map[string]struct{})
+	for _, itemID := range itemIDs {
+		dbi, err := r.db.loadItem(pa.key(), itemID)
+		if err != nil {
+			return report, err
+		}
+		if _, ok := seen[string(dbi.Checksum)]; ok {
+			continue
+		}
+		seen[string(dbi.Checksum)] = struct{}{}
+		list, err := r.db.itemsWithChecksum(dbi.Checksum)
+		if err != nil {
+			return report, err
+		}
+		shared := false
+		for _, li := range list {
+			if !bytes.Equal(li.AcctKey, pa.key()) {
+				shared = true
+				break
+			}
+		}
+		if shared {
+			report.FilesShared++
+		} else {
+			report.FilesDeleted++
+		}
+	}
+	report.Items = len(itemIDs)
+
+	// remove every collection, which removes its items
+	collIDs, err := r.db.collectionIDs(pa)
+	if err != nil {
+		return report, err
+	}
+	for _, collID := range collIDs {
+		dbc, err := r.db.loadCollection(pa.key(), collID)
+		if err != nil {
+			return report, err
+		}
+		repoLog.Infof("Purging collection '%s'", dbc.DirName)
+		err = r.deleteCollection(pa, dbc)
+		if err != nil {
+			return report, fmt.Errorf("purging collection %s: %v", dbc.Name, err)
+		}
+		report.Collections++
+	}
+
+	// remove any items that didn't belong to a collection
+	itemIDs, err = r.db.itemIDs(pa)
+	if err != nil {
+		return report, err
+	}
+	for _, itemID := range itemIDs {
+		dbi, err := r.db.loadItem(pa.key(), itemID)
+		if err != nil {
+			return report, err
+		}
+		repoLog.Infof("Purging item '%s'", dbi.FileName)
+		err = r.purgeLooseItem(pa, dbi)
+		if err != nil {
+			return report, fmt.Errorf("purging item %s: %v", dbi.Name, err)
+		}
+	}
+
+	// finally, remove the account and its credentials
+	err = r.db.deleteAccount(pa)
+	if err != nil {
+		return report, fmt.Errorf("deleting account from database: %v", err)
+	}
+	if r.CredentialStore != nil {
+		err = r.CredentialStore.DeleteCredentials(pa.String())
+		if err != nil {
+			return report, fmt.Errorf("deleting credentials from credential store: %v", err)
+		}
+	}
+	_, err = r.db.deleteSavedAccount(pa.String())
+	if err != nil {
+		return report, fmt.Errorf("removing saved account: %v", err)
+	}
+	err = r.removeEmptyDirs(pa.accountPath())
+	if err != nil && !os.IsNotExist(err) {
+		return report, fmt.Errorf("removing account folder: %v", err)
+	}
+
+	report.Problems, err = r.verifyPurged(pa)
+	return report, err
+}
+
+// purgeLooseItem deletes dbi, which is not in any collection,
+// keeping its file if other items have the same content.
+func (r *Repository) purgeLooseItem(pa providerAccount, dbi *dbItem) error {
+	list, err := r.db.itemsWithChecksum(dbi.Checksum)
+	if err != nil {
+		return err
+	}
+	var others int
+	for _, li := range list {
+		if !bytes.Equal(li.AcctKey, pa.key()) || li.ItemID != dbi.ID {
+			others++
+		}
+	}
+	if others == 0 {
+		err := os.Remove(r.fullPath(dbi.FilePath))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return r.db.deleteItem(pa, dbi.ID)
+}
+
+// removeEmptyDirs removes the repo-relative directory dir
+// and all directories within it, as long as they contain
+// no files other than those created by file browsers (and
+// generated files; see isGeneratedFile).
+func (r *Repository) removeEmptyDirs(dir string) error {
+	full := r.fullPath(dir)
+	var files []string
+	err := filepath.Walk(full, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && !isJunkFile(info.Name()) && !r.isGeneratedFile(r.repoRelative(fpath)) {
+			files = append(files, fpath)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(files) > 0 {
+		return nil
+	}
+	return os.RemoveAll(full)
+}
+
+// verifyPurged checks that nothing is left of pa in the
+// repository and returns a description of anything found.
+func (r *Repository) verifyPurged(pa providerAccount) ([]string, error) {
+	var problems []string
+
+	exists, err := r.db.accountExists(pa)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		problems = append(problems, "account still exists in database")
+	}
+
+	if r.CredentialStore != nil {
+		creds, err := r.CredentialStore.LoadCredentials(pa.String())
+		if err != nil {
+			return nil, err
+		}
+		if creds != nil {
+			problems = append(problems, "credentials still exist in credential store")
+		}
+	}
+
+	refs, err := r.db.checksumRefs(pa.key())
+	if err != nil {
+		return nil, err
+	}
+	if refs > 0 {
+		problems = append(problems, fmt.Sprintf("%d checksum index entries still refer to the account", refs))
+	}
+
+	full := r.fullPath(pa.accountPath())
+	filepath.Walk(full, func(fpath string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			problems = append(problems, "file remains on disk: "+r.repoRelative(fpath))
+		}
+		return nil
+	})
+
+	return problems, nil
+}
+
+// accountFromKey returns the providerAccount for the given
+// provider name and username. The provider need not be
+// registered, since only its name is needed to locate the
+// account's data in the repository.
+func accountFromKey(providerName, username string) providerAccount {
+	providerName = strings.ToLower(providerName)
+	p, ok := providers[providerName]
+	if !ok {
+		p = Provider{Name: providerName}
+	}
+	return providerAccount{provider: p, username: strings.ToLower(username)}
+}
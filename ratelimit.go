@@ -0,0 +1,102 @@
+package photobak
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RateLimiter spaces out the requests a provider makes to its
+// service, across all of its clients and workers, so that high
+// concurrency doesn't get the account blocked for a while. It
+// also holds off all requests when the service says it is
+// overloaded or rate-limiting (see SlowDown). The zero value
+// doesn't limit the rate, but still slows down when asked to.
+type RateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration // the least time between requests
+	next     time.Time     // when the next request may be made
+	paused   time.Time     // when requests may be made again after SlowDown
+}
+
+// SetRate sets how many requests per second may be made
+// at most; 0 (or less) means as many as are made.
+func (l *RateLimiter) SetRate(perSecond float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if perSecond <= 0 {
+		l.interval = 0
+		return
+	}
+	l.interval = time.Duration(float64(time.Second) / perSecond)
+}
+
+// Wait blocks until a request may be made, or ctx is
+// canceled, in which case it returns the context's error.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	for {
+		at, ok := l.reserve()
+		if ok {
+			return ctx.Err()
+		}
+		timer := time.NewTimer(time.Until(at))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		// it may have been paused in the meantime
+		l.mu.Lock()
+		paused := l.paused.After(time.Now())
+		l.mu.Unlock()
+		if !paused {
+			return nil
+		}
+	}
+}
+
+// reserve reserves the next time a request may be made, and
+// returns it, or ok if that is now and there is no need to wait.
+func (l *RateLimiter) reserve() (at time.Time, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	at = now
+	if l.next.After(at) {
+		at = l.next
+	}
+	if l.paused.After(at) {
+		at = l.paused
+	}
+	l.next = at.Add(l.interval)
+	return at, !at.After(now)
+}
+
+// SlowDown holds off all requests made through l if err says the
+// service is rate-limiting or overloaded (HTTP 429 or 503): for as
+// long as the service asked to wait, if it did, or otherwise for
+// the first wait of the retry policy (see Retries). Requests that
+// are already waiting wait longer too.
+func (l *RateLimiter) SlowDown(err error) {
+	var sc interface{ HTTPStatusCode() int }
+	if !errors.As(err, &sc) {
+		return
+	}
+	if code := sc.HTTPStatusCode(); code != http.StatusTooManyRequests && code != http.StatusServiceUnavailable {
+		return
+	}
+	d := retryAfter(err)
+	if d == 0 && len(Retries.Backoff) > 0 {
+		d = Retries.Backoff[0]
+	}
+	until := time.Now().Add(d)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until.After(l.paused) {
+		l.paused = until
+	}
+}
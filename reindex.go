@@ -0,0 +1,517 @@
+package photobak
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// changeReindexed is the change strategy of the items rebuilt by
+// Reindex, whose change keys are not known. Since it is not the
+// strategy of any account, the next run records the key the
+// provider lists instead of downloading the item again (see
+// changedRemotely).
+const changeReindexed = "reindexed"
+
+// reindexedPrefix starts the IDs Reindex makes up for the items
+// and collections whose real IDs it can't tell, which are made of
+// the path of their file or folder. When they are listed again,
+// their real IDs are made aliases of these (see storedItemID).
+// Items and collections of the local provider are given the IDs
+// ImportFolder would give them instead.
+const reindexedPrefix = "reindexed:"
+
+// reindexedCollectionID returns the ID Reindex gives to the
+// collection of pa in the folder called dirName.
+func reindexedCollectionID(pa providerAccount, dirName string) string {
+	if pa.provider.Name == LocalProvider {
+		return dirName
+	}
+	return reindexedPrefix + dirName
+}
+
+// reindexedItemID returns the ID Reindex would have given the
+// item in ic if its file is where it would be downloaded to,
+// or "" if that can't be told.
+func (r *Repository) reindexedItemID(ic itemContext) string {
+	if ic.ac.account.provider.Name == LocalProvider {
+		return ""
+	}
+	relPath, err := r.itemPath(ic.ac.account, ic.coll.dirName, ic.item.ItemName(), ic.item.ItemID(), itemTime(ic.item))
+	if err != nil {
+		return ""
+	}
+	return reindexedPrefix + filepath.ToSlash(relPath)
+}
+
+// ReindexReport says what Reindex found.
+type ReindexReport struct {
+	Accounts    int      // accounts found
+	Collections int      // collections rebuilt
+	Items       int      // items rebuilt
+	Identified  int      // items whose IDs are known from album info files
+	Skipped     []string // files that are not in a collection's folder
+	Missing     []string // files listed in album info files that don't exist
+}
+
+// String returns a summary of the report.
+func (rr ReindexReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Rebuilt the index:\n")
+	fmt.Fprintf(&b, "  Accounts:             %d\n", rr.Accounts)
+	fmt.Fprintf(&b, "  Collections:          %d\n", rr.Collections)
+	fmt.Fprintf(&b, "  Items:                %d\n", rr.Items)
+	fmt.Fprintf(&b, "  Items with known IDs: %d\n", rr.Identified)
+	if len(rr.Skipped) > 0 {
+		fmt.Fprintf(&b, "%d files are not in a collection's folder and were left out:\n", len(rr.Skipped))
+		for _, fpath := range rr.Skipped {
+			fmt.Fprintf(&b, "  - %s\n", fpath)
+		}
+	}
+	if len(rr.Missing) > 0 {
+		fmt.Fprintf(&b, "%d files listed in %s files are missing:\n", len(rr.Missing), AlbumInfoName)
+		for _, fpath := range rr.Missing {
+			fmt.Fprintf(&b, "  - %s\n", fpath)
+		}
+	}
+	return b.String()
+}
+
+// Reindex rebuilds the database from the files in the repository,
+// for when the database was lost but the files are intact. The
+// database must not have any items or collections yet. Collections
+// and the IDs of items are taken from album info files (see
+// AlbumInfo) where there are any; then, with the default path
+// template, every folder in an account's folder is a collection.
+// Other items and collections get IDs made up from their paths;
+// the next run of their account finds them where it would save
+// them and takes them over, and a prune removes the rest. Captions
+// and times are also read from XMP sidecars. Settings, like the
+// path template, and credentials are not restored.
+func (r *Repository) Reindex(ctx context.Context) (ReindexReport, error) {
+	var report ReindexReport
+	stored, err := r.db.storedAccounts()
+	if err != nil {
+		return report, fmt.Errorf("listing accounts: %v", err)
+	}
+	for _, pa := range stored {
+		itemIDs, err := r.db.itemIDs(pa)
+		if err != nil {
+			return report, err
+		}
+		collIDs, err := r.db.collectionIDs(pa)
+		if err != nil {
+			return report, err
+		}
+		if len(itemIDs) > 0 || len(collIDs) > 0 {
+			return report, fmt.Errorf("the database is not empty (%s has items or collections); reindexing only rebuilds a database that was lost", pa)
+		}
+	}
+
+	ri := &reindexing{
+		r:         r,
+		report:    &report,
+		infos:     make(map[string]albumInfo),
+		links:     make(map[string]string),
+		lists:     make(map[string][]string),
+		checksums: make(map[string][]byte),
+		accounts:  make(map[string]providerAccount),
+		colls:     make(map[string]map[string]*dbCollection),
+		collByDir: make(map[string]*dbCollection),
+		acctByDir: make(map[string]providerAccount),
+		items:     make(map[string]map[string]*dbItem),
+		claimed:   make(map[string]bool),
+	}
+	err = ri.scan()
+	if err != nil {
+		return report, fmt.Errorf("scanning repository: %v", err)
+	}
+	for _, fpath := range ri.files {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		ri.checksums[fpath], err = r.hash(fpath)
+		if err != nil {
+			return report, fmt.Errorf("hashing %s: %v", fpath, err)
+		}
+	}
+
+	ri.indexAlbumInfos()
+	ri.indexFolders()
+
+	return report, ri.save()
+}
+
+// reindexing is the state of a Reindex.
+type reindexing struct {
+	r      *Repository
+	report *ReindexReport
+
+	// what is in the repository, by repo-relative path
+	infos     map[string]albumInfo // album info files, by folder
+	files     []string             // files that may be those of items, sorted
+	links     map[string]string    // where symbolic links point to
+	lists     map[string][]string  // the files in media list files, by folder
+	checksums map[string][]byte    // of files
+
+	// what is being rebuilt
+	accounts  map[string]providerAccount          // by key
+	colls     map[string]map[string]*dbCollection // by account key, then ID
+	collByDir map[string]*dbCollection            // by folder
+	acctByDir map[string]providerAccount          // the account of each collection folder
+	items     map[string]map[string]*dbItem       // by account key, then ID
+	claimed   map[string]bool                     // files listed in album info files
+}
+
+// scan finds the album info files, media list files, symbolic
+// links, and other files in the repository.
+func (ri *reindexing) scan() error {
+	root := filepath.Clean(ri.r.path)
+	return filepath.Walk(root, func(fullPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fullPath == root {
+			return nil
+		}
+		fpath := ri.r.repoRelative(fullPath)
+		name := info.Name()
+		dir := filepath.Dir(fpath)
+
+		if info.IsDir() {
+			if isJunkFile(name) || fpath == QuarantineDir || fpath == ViewsDir || fpath == CertificatesDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		switch {
+		case isJunkFile(name), isManifestName(name):
+		case dir == "." && strings.HasPrefix(name, "photobak"):
+			// the database, its backups, and other files of ours
+		case name == AlbumInfoName:
+			content, err := ioutil.ReadFile(fullPath)
+			if err != nil {
+				return err
+			}
+			var ai albumInfo
+			if err := json.Unmarshal(content, &ai); err != nil {
+				repoLog.Errorf("reading %s: %v", fpath, err)
+				return nil
+			}
+			ri.infos[dir] = ai
+		case fpath == ri.r.mediaListPath(dir):
+			content, err := ioutil.ReadFile(fullPath)
+			if err != nil {
+				return err
+			}
+			for _, line := range strings.Split(string(content), "\n") {
+				if line = strings.TrimSpace(line); line != "" {
+					ri.lists[dir] = append(ri.lists[dir], filepath.Clean(line))
+				}
+			}
+		case info.Mode()&os.ModeSymlink != 0:
+			dest, err := os.Readlink(fullPath)
+			if err != nil {
+				return err
+			}
+			if !filepath.IsAbs(dest) {
+				dest = filepath.Join(filepath.Dir(fullPath), dest)
+			}
+			ri.links[fpath] = ri.r.repoRelative(dest)
+		case strings.HasSuffix(name, XMPExt) && ri.r.fileExists(strings.TrimSuffix(fpath, XMPExt)):
+			// the sidecar of a file
+		case isJPEGCompanion(name) && ri.r.fileExists(strings.TrimSuffix(fpath, JPEGCompanionExt)):
+			// the JPEG companion of a file
+		case info.Mode().IsRegular():
+			ri.files = append(ri.files, fpath)
+		}
+		return nil
+	})
+}
+
+// indexAlbumInfos rebuilds the collections that have
+// album info files, and the items listed in them.
+func (ri *reindexing) indexAlbumInfos() {
+	dirs := make([]string, 0, len(ri.infos))
+	for dir := range ri.infos {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	for _, dir := range dirs {
+		info := ri.infos[dir]
+		parts := strings.SplitN(info.Account, ":", 2)
+		if len(parts) != 2 || info.ID == "" {
+			repoLog.Errorf("%s: no account or collection ID", filepath.Join(dir, AlbumInfoName))
+			continue
+		}
+		pa := accountFromKey(parts[0], parts[1])
+		dbc := ri.collection(pa, info.ID, info.Title, dir)
+		dbc.Meta.Description = info.Description
+		dbc.Active = info.Updated
+
+		for _, ii := range info.Items {
+			fpath := filepath.Join(dir, filepath.FromSlash(ii.File))
+			if target, ok := ri.links[fpath]; ok {
+				fpath = target
+			}
+			checksum, ok := ri.checksums[fpath]
+			if !ok {
+				ri.report.Missing = append(ri.report.Missing, fpath)
+				continue
+			}
+			dbi := ri.items[string(pa.key())][ii.ID]
+			if dbi == nil {
+				dbi = ri.item(pa, ii.ID, fpath, checksum)
+				ri.report.Identified++
+			}
+			dbi.Name, dbi.Meta.Caption = ii.Name, ii.Caption
+			if ii.Taken != nil {
+				dbi.Meta.Taken = *ii.Taken
+			}
+			dbi.Collections[dbc.ID] = struct{}{}
+			dbc.Items[dbi.ID] = struct{}{}
+			dbc.Order = append(dbc.Order, dbi.ID)
+			if ii.File == info.Cover {
+				dbc.Meta.Cover = dbi.ID
+			}
+			ri.claimed[fpath] = true
+		}
+	}
+}
+
+// indexFolders rebuilds the items whose files are not listed in
+// album info files, and the collections of their folders, with
+// what they link to and list in their media list files.
+func (ri *reindexing) indexFolders() {
+	for _, fpath := range ri.files {
+		if ri.claimed[fpath] {
+			continue
+		}
+		pa, dbc, ok := ri.folderCollection(fpath)
+		if !ok {
+			ri.report.Skipped = append(ri.report.Skipped, fpath)
+			continue
+		}
+		ri.addFile(pa, dbc, fpath, fpath)
+	}
+
+	// a symbolic link to a file, or a file listed in a media list
+	// file, is an item of the collection of the folder it is in
+	// that shares the file, as if it were there; album info files
+	// already list those of their folders
+	type reference struct{ at, target string }
+	var refs []reference
+	for fpath, target := range ri.links {
+		refs = append(refs, reference{fpath, target})
+	}
+	for dir, list := range ri.lists {
+		for _, target := range list {
+			refs = append(refs, reference{filepath.Join(dir, filepath.Base(target)), target})
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].at < refs[j].at })
+	for _, ref := range refs {
+		if _, ok := ri.infos[filepath.Dir(ref.at)]; ok {
+			continue
+		}
+		if _, ok := ri.checksums[ref.target]; !ok {
+			continue
+		}
+		pa, dbc, ok := ri.folderCollection(ref.at)
+		if ok {
+			ri.addFile(pa, dbc, ref.at, ref.target)
+		}
+	}
+}
+
+// addFile adds the item whose file is at fpath, and which is
+// at the path at in the folder of dbc, to dbc, which belongs to
+// pa. Its ID is made of the path at, except for the local
+// provider, whose items are identified by their content.
+func (ri *reindexing) addFile(pa providerAccount, dbc *dbCollection, at, fpath string) {
+	checksum := ri.checksums[fpath]
+	id := reindexedPrefix + filepath.ToSlash(at)
+	if pa.provider.Name == LocalProvider {
+		id = hex.EncodeToString(checksum)
+	}
+	dbi := ri.items[string(pa.key())][id]
+	if dbi == nil {
+		dbi = ri.item(pa, id, fpath, checksum)
+		dbi.Name = filepath.Base(at)
+	}
+	dbi.Collections[dbc.ID] = struct{}{}
+	dbc.Items[dbi.ID] = struct{}{}
+}
+
+// folderCollection returns the collection that the file at fpath
+// is in according to its folder: the nearest folder above it
+// with an album info file, or else the third folder of its path,
+// below the provider's and the account's.
+func (ri *reindexing) folderCollection(fpath string) (providerAccount, *dbCollection, bool) {
+	for dir := filepath.Dir(fpath); dir != "."; dir = filepath.Dir(dir) {
+		if dbc, ok := ri.collByDir[dir]; ok {
+			return ri.acctByDir[dir], dbc, true
+		}
+	}
+	parts := strings.Split(fpath, string(filepath.Separator))
+	if len(parts) < 4 {
+		return providerAccount{}, nil, false
+	}
+	pa := ri.folderAccount(parts[0], parts[1])
+	id := reindexedCollectionID(pa, parts[2])
+	return pa, ri.collection(pa, id, parts[2], filepath.Join(parts[:3]...)), true
+}
+
+// folderAccount returns the account whose folder is userDir
+// in the folder of the provider named providerDir.
+func (ri *reindexing) folderAccount(providerDir, userDir string) providerAccount {
+	accountPath := filepath.Join(providerDir, userDir)
+	for _, pa := range getAccounts() {
+		if pa.accountPath() == accountPath {
+			return pa
+		}
+	}
+	for _, pa := range ri.accounts {
+		if pa.accountPath() == accountPath {
+			return pa
+		}
+	}
+	return accountFromKey(providerDir, strings.Replace(userDir, "_at_", "@", -1))
+}
+
+// collection returns the collection id of pa,
+// making it in the folder dir if it is new.
+func (ri *reindexing) collection(pa providerAccount, id, name, dir string) *dbCollection {
+	key := string(pa.key())
+	if _, ok := ri.accounts[key]; !ok {
+		ri.accounts[key] = pa
+		ri.colls[key] = make(map[string]*dbCollection)
+		ri.items[key] = make(map[string]*dbItem)
+	}
+	dbc := ri.colls[key][id]
+	if dbc == nil {
+		dbc = &dbCollection{
+			ID:      id,
+			Name:    name,
+			DirName: filepath.Base(dir),
+			DirPath: dir,
+			Saved:   time.Now(),
+			Items:   make(map[string]struct{}),
+		}
+		if pa.provider.Name == LocalProvider {
+			dbc.Protection = LocalOnly
+		}
+		ri.colls[key][id] = dbc
+		ri.collByDir[dir] = dbc
+		ri.acctByDir[dir] = pa
+	}
+	return dbc
+}
+
+// item makes the item id of pa, whose file is at fpath.
+func (ri *reindexing) item(pa providerAccount, id, fpath string, checksum []byte) *dbItem {
+	key := string(pa.key())
+	dbi := &dbItem{
+		ID:             id,
+		FileName:       filepath.Base(fpath),
+		FilePath:       fpath,
+		Checksum:       checksum,
+		ChangeStrategy: changeReindexed,
+		Saved:          time.Now(),
+		Collections:    make(map[string]struct{}),
+	}
+	if pa.provider.Name == LocalProvider {
+		dbi.Protection = LocalOnly
+	}
+	ri.items[key][id] = dbi
+	return dbi
+}
+
+// save describes the rebuilt items from their files
+// and stores everything in the database.
+func (ri *reindexing) save() error {
+	keys := make([]string, 0, len(ri.accounts))
+	for key := range ri.accounts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		pa := ri.accounts[key]
+		err := ri.r.db.createAccount(pa)
+		if err != nil {
+			return err
+		}
+		ri.report.Accounts++
+		for _, dbc := range ri.colls[key] {
+			if len(dbc.Items) == 0 {
+				continue
+			}
+			err := ri.r.db.saveCollection(pa.key(), dbc.ID, dbc)
+			if err != nil {
+				return fmt.Errorf("saving collection %s: %v", dbc.DirPath, err)
+			}
+			ri.report.Collections++
+		}
+		for _, dbi := range ri.items[key] {
+			ri.describe(dbi)
+			err := ri.r.db.saveItem(pa.key(), dbi.ID, dbi)
+			if err != nil {
+				return fmt.Errorf("saving item %s: %v", dbi.FilePath, err)
+			}
+			ri.report.Items++
+		}
+	}
+	return nil
+}
+
+// describe fills in what the file of dbi and its
+// XMP sidecar, if it has one, tell about it.
+func (ri *reindexing) describe(dbi *dbItem) {
+	fullPath := ri.r.fullPath(dbi.FilePath)
+	if caption, taken, err := readXMPSidecar(fullPath + XMPExt); err == nil {
+		if dbi.Meta.Caption == "" {
+			dbi.Meta.Caption = caption
+		}
+		if dbi.Meta.Taken.IsZero() {
+			dbi.Meta.Taken = taken
+		}
+	}
+
+	// as with downloads, missing or bad EXIF data is OK
+	var x *exif.Exif
+	if f, err := os.Open(fullPath); err == nil {
+		x, _ = exif.Decode(f)
+		f.Close()
+	}
+	dbi.Meta.Setting, _ = ri.r.getSettingFromEXIF(x)
+	describe(&dbi.Meta, reindexedItem{dbi}, x)
+	if x == nil {
+		vm, _ := readVideoMeta(fullPath)
+		describeVideo(&dbi.Meta, vm)
+	}
+	dbi.Format = fileFormat(fullPath)
+	dbi.PHash = imageHash(fullPath)
+	ri.r.recordFileStat(dbi)
+}
+
+// reindexedItem is an Item made from
+// what Reindex knows about dbi.
+type reindexedItem struct{ dbi *dbItem }
+
+func (ri reindexedItem) ItemID() string      { return ri.dbi.ID }
+func (ri reindexedItem) ItemName() string    { return ri.dbi.Name }
+func (ri reindexedItem) ItemETag() string    { return "" }
+func (ri reindexedItem) ItemCaption() string { return ri.dbi.Meta.Caption }
+func (ri reindexedItem) ItemTime() time.Time { return ri.dbi.Meta.Taken }
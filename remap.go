@@ -0,0 +1,257 @@
+package photobak
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/boltdb/bolt"
+)
+
+// PreviousIDer is an optional interface an Item may implement
+// if its provider can change the way items are identified (for
+// example, with a flag). It allows the items stored in the
+// repository to be given their new IDs with RemapItemIDs
+// instead of being downloaded all over again.
+type PreviousIDer interface {
+	// PreviousItemID returns the ID this item would
+	// have had with the provider's other ID scheme.
+	PreviousItemID() string
+}
+
+// RemapReport describes the changes made by RemapItemIDs.
+type RemapReport struct {
+	Renamed   int      // items that were given their new ID
+	Merged    int      // items merged into another item with the same new ID and content
+	Conflicts []string // items left alone because another item with the same new ID has different content
+}
+
+// String returns a human-readable report.
+func (rr RemapReport) String() string {
+	s := fmt.Sprintf("Renamed %d items, merged %d duplicates\n", rr.Renamed, rr.Merged)
+	if len(rr.Conflicts) > 0 {
+		s += fmt.Sprintf("%d items kept their old ID because their content differs from the item with the new ID:\n", len(rr.Conflicts))
+		for _, c := range rr.Conflicts {
+			s += "  - " + c + "\n"
+		}
+	}
+	return s
+}
+
+// RemapItemIDs lists the items of every configured account and,
+// for those that implement PreviousIDer, changes the ID stored in
+// the database from the previous ID to the current one. Items that
+// end up with the same new ID and have the same content (which
+// means they share a file on disk) are merged into one item that
+// belongs to all of their collections. Nothing is downloaded and
+// no files are changed.
+func (r *Repository) RemapItemIDs(ctx context.Context) (RemapReport, error) {
+	var report RemapReport
+
+	accounts, err := r.authorizedAccounts()
+	if err != nil {
+		return report, err
+	}
+
+	for _, ac := range accounts {
+		mapping, err := r.remoteIDMapping(ctx, ac)
+		if err != nil {
+			return report, fmt.Errorf("%s: listing items: %v", ac.account, err)
+		}
+		if len(mapping) == 0 {
+			repoLog.Infof("%s: no item IDs to remap", ac.account)
+			continue
+		}
+		err = r.db.remapItemIDs(ac.account.key(), mapping, &report)
+		if err != nil {
+			return report, fmt.Errorf("%s: remapping item IDs: %v", ac.account, err)
+		}
+	}
+
+	return report, nil
+}
+
+// remoteIDMapping lists all of ac's items and returns a map of
+// their previous IDs to their current IDs, for items whose ID
+// has changed.
+func (r *Repository) remoteIDMapping(ctx context.Context, ac accountClient) (map[string]string, error) {
+	mapping := make(map[string]string)
+
+	collections, err := ac.client.ListCollections(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, coll := range collections {
+		itemChan := make(chan Item)
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for it := range itemChan {
+				pi, ok := it.(PreviousIDer)
+				if !ok {
+					continue
+				}
+				prev, cur := pi.PreviousItemID(), it.ItemID()
+				if prev != "" && prev != cur {
+					mapping[prev] = cur
+				}
+			}
+		}()
+
+		err = ac.client.ListCollectionItems(ctx, coll, itemChan)
+		wg.Wait()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return mapping, nil
+}
+
+// remapItemIDs changes the IDs of the items in acctKey's account
+// according to mapping, which maps old IDs to new IDs, and records
+// what it did in report. All changes are made in one transaction.
+func (db *boltDB) remapItemIDs(acctKey []byte, mapping map[string]string, report *RemapReport) error {
+	oldIDs := make([]string, 0, len(mapping))
+	for oldID := range mapping {
+		oldIDs = append(oldIDs, oldID)
+	}
+	sort.Strings(oldIDs)
+
+	return db.Update(func(tx *bolt.Tx) error {
+		accountBucket := tx.Bucket(acctKey)
+		if accountBucket == nil {
+			return fmt.Errorf("account '%s' does not exist in DB", acctKey)
+		}
+		items := accountBucket.Bucket([]byte("items"))
+		collections := accountBucket.Bucket([]byte("collections"))
+		checksums := tx.Bucket([]byte("checksums"))
+		if items == nil || collections == nil || checksums == nil {
+			return fmt.Errorf("account '%s' is missing buckets", acctKey)
+		}
+
+		for _, oldID := range oldIDs {
+			newID := mapping[oldID]
+
+			oldItem, err := decodeItem(items.Get([]byte(oldID)))
+			if err != nil {
+				return fmt.Errorf("loading item %s: %v", oldID, err)
+			}
+			if oldItem == nil {
+				continue // not in the repository, or already remapped
+			}
+			newItem, err := decodeItem(items.Get([]byte(newID)))
+			if err != nil {
+				return fmt.Errorf("loading item %s: %v", newID, err)
+			}
+
+			if newItem != nil {
+				if !bytes.Equal(newItem.Checksum, oldItem.Checksum) {
+					repoLog.Errorf("not remapping %s to %s: content differs from %s", oldItem.FilePath, newID, newItem.FilePath)
+					report.Conflicts = append(report.Conflicts, oldItem.FilePath)
+					continue
+				}
+				if newItem.Collections == nil {
+					newItem.Collections = make(map[string]struct{})
+				}
+				for collID := range oldItem.Collections {
+					newItem.Collections[collID] = struct{}{}
+				}
+				if oldItem.Protection > newItem.Protection {
+					newItem.Protection = oldItem.Protection
+				}
+				report.Merged++
+			} else {
+				renamed := *oldItem
+				renamed.ID = newID
+				newItem = &renamed
+				report.Renamed++
+			}
+
+			// replace the old item with the new one...
+			itemEnc, err := encodeItem(newItem)
+			if err != nil {
+				return err
+			}
+			err = items.Put([]byte(newID), itemEnc)
+			if err != nil {
+				return err
+			}
+			err = items.Delete([]byte(oldID))
+			if err != nil {
+				return err
+			}
+			err = moveAPIMeta(accountBucket, apiMetaItems, oldID, newID)
+			if err != nil {
+				return err
+			}
+			if aliases := accountBucket.Bucket([]byte(itemAliases)); aliases != nil {
+				// the new ID is no longer an alias of the old one
+				err = aliases.Delete([]byte(newID))
+				if err != nil {
+					return err
+				}
+			}
+
+			// ...in the checksum index...
+			err = db.removeItemFromChecksumIndex(tx, oldItem, acctKey)
+			if err != nil {
+				return err
+			}
+			var list []accountItem
+			err = gobDecode(checksums.Get(newItem.Checksum), &list)
+			if err != nil {
+				return fmt.Errorf("getting list of items with same checksum: %v", err)
+			}
+			found := false
+			for _, li := range list {
+				if bytes.Equal(li.AcctKey, acctKey) && li.ItemID == newID {
+					found = true
+					break
+				}
+			}
+			if !found {
+				list = append(list, accountItem{AcctKey: acctKey, ItemID: newID})
+				listEnc, err := gobEncode(list)
+				if err != nil {
+					return err
+				}
+				err = checksums.Put(newItem.Checksum, listEnc)
+				if err != nil {
+					return err
+				}
+			}
+
+			// ...and in its collections
+			for collID := range newItem.Collections {
+				coll, err := decodeCollection(collections.Get([]byte(collID)))
+				if err != nil {
+					return fmt.Errorf("loading collection %s: %v", collID, err)
+				}
+				if coll == nil {
+					continue
+				}
+				if coll.Items == nil {
+					coll.Items = make(map[string]struct{})
+				}
+				delete(coll.Items, oldID)
+				coll.Items[newID] = struct{}{}
+				collEnc, err := encodeCollection(coll)
+				if err != nil {
+					return err
+				}
+				err = collections.Put([]byte(collID), collEnc)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,112 @@
+package photobak
+
+import (
+	"context"
+	"fmt"
+)
+
+// storedAccount returns the account in the database
+// whose name ("provider:username") is acct.
+func (r *Repository) storedAccount(acct string) (providerAccount, error) {
+	accounts, err := r.db.storedAccounts()
+	if err != nil {
+		return providerAccount{}, err
+	}
+	for _, pa := range accounts {
+		if pa.String() == acct {
+			return pa, nil
+		}
+	}
+	return providerAccount{}, fmt.Errorf("no account '%s' in repository", acct)
+}
+
+// storedAccountClient returns pa, which must be stored
+// in the database, with a client authorized to access it.
+func (r *Repository) storedAccountClient(pa providerAccount) (accountClient, error) {
+	if pa.provider.NewClient == nil && pa.provider.NewRefreshingClient == nil {
+		return accountClient{}, fmt.Errorf("unknown provider '%s'", pa.provider.Name)
+	}
+	creds, err := r.getCredentials(pa)
+	if err != nil {
+		return accountClient{}, err
+	}
+	client, err := r.newClient(pa, creds)
+	if err != nil {
+		return accountClient{}, fmt.Errorf("getting authenticated client: %v", err)
+	}
+	return accountClient{account: pa, client: client}, nil
+}
+
+// findRemoteItems looks for the items of ac with the given IDs
+// remotely, and calls found for each of them when it is listed,
+// along with the collection it was listed in and the ID it is
+// stored under (which differs from its ID if that is an alias;
+// see MapIDs). Since providers
+// can't be asked for items by ID, only the collections that the
+// items belong to (according to the database) are listed. It
+// returns the IDs of the items that were not found.
+func (r *Repository) findRemoteItems(ctx context.Context, ac accountClient, itemIDs []string,
+	found func(coll collection, it Item, itemID string)) (map[string]struct{}, error) {
+	wanted := make(map[string]struct{})
+	collIDs := make(map[string]struct{})
+	for _, itemID := range itemIDs {
+		wanted[itemID] = struct{}{}
+		dbi, err := r.db.loadItem(ac.account.key(), itemID)
+		if err != nil {
+			return wanted, fmt.Errorf("loading item %s: %v", itemID, err)
+		}
+		if dbi == nil {
+			continue
+		}
+		for collID := range dbi.Collections {
+			collIDs[collID] = struct{}{}
+		}
+	}
+
+	aliases, err := r.db.loadIDAliases(ac.account)
+	if err != nil {
+		return wanted, fmt.Errorf("loading aliases: %v", err)
+	}
+
+	listedColls, err := ac.client.ListCollections(ctx)
+	if err != nil {
+		return wanted, fmt.Errorf("listing collections: %v", err)
+	}
+	for _, listedColl := range listedColls {
+		if len(wanted) == 0 || ctx.Err() != nil {
+			break
+		}
+		collID := aliases.collection(listedColl.CollectionID())
+		if _, ok := collIDs[collID]; !ok {
+			continue
+		}
+		dbc, err := r.db.loadCollection(ac.account.key(), collID)
+		if err != nil || dbc == nil {
+			continue
+		}
+		coll := collection{Collection: listedColl, id: collID, dirName: dbc.DirName, dirPath: dbc.DirPath}
+
+		itemChan := make(chan Item)
+		listErr := make(chan error, 1)
+		go func() {
+			listErr <- ac.client.ListCollectionItems(ctx, coll, itemChan)
+		}()
+		for it := range itemChan {
+			if ctx.Err() != nil {
+				continue // keep draining so the client can finish
+			}
+			for _, itemID := range aliases.itemIDs(it) {
+				if _, ok := wanted[itemID]; ok {
+					delete(wanted, itemID)
+					found(coll, it, itemID)
+					break
+				}
+			}
+		}
+		if err := <-listErr; err != nil {
+			repoLog.Infof("Listing items of collection %s: %v", dbc.Name, err)
+		}
+	}
+
+	return wanted, nil
+}
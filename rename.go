@@ -0,0 +1,273 @@
+package photobak
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/boltdb/bolt"
+)
+
+// movedItem is an item whose file was moved along
+// with the folder of a collection that was renamed.
+type movedItem struct {
+	acctKey []byte
+	item    *dbItem
+	oldPath string
+}
+
+// renameCollectionDirs renames the folders of pa's collections
+// in colls that were renamed remotely since they were saved, if
+// RenameFolders is set. A folder that can't be renamed is kept.
+func (r *Repository) renameCollectionDirs(pa providerAccount, colls []Collection) {
+	if !r.RenameFolders || r.SyncFriendly {
+		return
+	}
+	for _, coll := range colls {
+		collID, err := r.storedCollectionID(pa, coll)
+		if err != nil {
+			repoLog.Errorf("%s: %v", pa, err)
+			continue
+		}
+		dbc, err := r.db.loadCollection(pa.key(), collID)
+		if err != nil {
+			repoLog.Errorf("%s: loading collection %s: %v", pa, collID, err)
+			continue
+		}
+		if dbc == nil || dbc.Name == coll.CollectionName() {
+			continue
+		}
+		err = r.renameCollectionDir(pa, dbc, coll.CollectionName())
+		if err != nil {
+			repoLog.Errorf("%s: %v", pa, err)
+		}
+	}
+}
+
+// renameCollectionDir moves the folder of pa's collection dbc,
+// which was renamed remotely to name, to a folder of that name,
+// and updates the paths of the files that were in it and the
+// references to them. The folder is renamed first and then the
+// database is updated in one transaction; if that fails, the
+// folder is renamed back.
+func (r *Repository) renameCollectionDir(pa providerAccount, dbc *dbCollection, name string) error {
+	dirName, err := r.reserveUniqueFilename(pa.accountPath(), name, true)
+	if err != nil {
+		return fmt.Errorf("reserving folder for renamed collection %s: %v", name, err)
+	}
+	dirPath := r.repoRelative(filepath.Join(pa.accountPath(), dirName))
+
+	// the reserved folder is replaced by the old one
+	err = os.Remove(r.fullPath(dirPath))
+	if err != nil {
+		return fmt.Errorf("replacing reserved folder %s: %v", dirPath, err)
+	}
+	err = os.Rename(r.fullPath(dbc.DirPath), r.fullPath(dirPath))
+	if err != nil {
+		return fmt.Errorf("renaming folder %s to %s: %v", dbc.DirPath, dirPath, err)
+	}
+
+	renamed := *dbc
+	renamed.Name, renamed.DirName, renamed.DirPath = name, dirName, dirPath
+	moved, err := r.db.moveCollectionDir(pa.key(), &renamed, dbc.DirPath)
+	if err != nil {
+		if err2 := os.Rename(r.fullPath(dirPath), r.fullPath(dbc.DirPath)); err2 != nil {
+			repoLog.Errorf("renaming folder %s back to %s: %v", dirPath, dbc.DirPath, err2)
+		}
+		return fmt.Errorf("saving renamed collection %s: %v", name, err)
+	}
+	repoLog.Infof("Collection %s was renamed to %s; moved its folder to %s", dbc.Name, name, dirPath)
+
+	// the other collections that refer to the moved
+	// files must now refer to them at their new paths
+	for _, m := range moved {
+		for collID := range m.item.Collections {
+			if bytes.Equal(m.acctKey, pa.key()) && collID == dbc.ID {
+				continue
+			}
+			other, err := r.db.loadCollection(m.acctKey, collID)
+			if err != nil {
+				return err
+			}
+			if other == nil {
+				continue
+			}
+			err = r.replaceInMediaListFile(other.DirPath, m.oldPath, m.item.FilePath)
+			if err != nil {
+				return fmt.Errorf("referring to %s from %s: %v", m.item.FilePath, other.DirPath, err)
+			}
+		}
+	}
+
+	*dbc = renamed
+	return nil
+}
+
+// moveCollectionDir saves acctKey's collection dbc, whose folder
+// was moved from oldDirPath to dbc.DirPath, along with the items
+// of any account whose files were in that folder, at their new
+// paths, all in one transaction. It returns the items it moved.
+func (db *boltDB) moveCollectionDir(acctKey []byte, dbc *dbCollection, oldDirPath string) ([]movedItem, error) {
+	var moved []movedItem
+	err := db.Update(func(tx *bolt.Tx) error {
+		moved = nil
+		checksums := tx.Bucket([]byte("checksums"))
+		if checksums == nil {
+			return fmt.Errorf("no 'checksums' bucket")
+		}
+		itemsOf := func(key []byte) (*bolt.Bucket, error) {
+			accountBucket := tx.Bucket(key)
+			if accountBucket == nil {
+				return nil, fmt.Errorf("account '%s' does not exist in DB", key)
+			}
+			items := accountBucket.Bucket([]byte("items"))
+			if items == nil {
+				return nil, fmt.Errorf("account '%s' is missing 'items' bucket", key)
+			}
+			return items, nil
+		}
+		items, err := itemsOf(acctKey)
+		if err != nil {
+			return err
+		}
+
+		// the items whose files were in the folder are the items of
+		// the collection that have them there, and any items with the
+		// same content (which refer to the same files)
+		done := make(map[string]bool)
+		for itemID := range dbc.Items {
+			dbi, err := decodeItem(items.Get([]byte(itemID)))
+			if err != nil {
+				return fmt.Errorf("loading item %s: %v", itemID, err)
+			}
+			if dbi == nil || !inDir(dbi.FilePath, oldDirPath) {
+				continue
+			}
+			var list []accountItem
+			err = gobDecode(checksums.Get(dbi.Checksum), &list)
+			if err != nil {
+				return fmt.Errorf("getting list of items with same checksum: %v", err)
+			}
+			list = append(list, accountItem{AcctKey: acctKey, ItemID: itemID})
+			for _, li := range list {
+				if done[string(li.AcctKey)+"\x00"+li.ItemID] {
+					continue
+				}
+				done[string(li.AcctKey)+"\x00"+li.ItemID] = true
+				liItems, err := itemsOf(li.AcctKey)
+				if err != nil {
+					return err
+				}
+				same, err := decodeItem(liItems.Get([]byte(li.ItemID)))
+				if err != nil {
+					return fmt.Errorf("loading item %s: %v", li.ItemID, err)
+				}
+				if same == nil || !inDir(same.FilePath, oldDirPath) {
+					continue
+				}
+				rel, err := filepath.Rel(oldDirPath, same.FilePath)
+				if err != nil {
+					return err
+				}
+				oldPath := same.FilePath
+				same.FilePath = filepath.Join(dbc.DirPath, rel)
+				enc, err := encodeItem(same)
+				if err != nil {
+					return err
+				}
+				err = liItems.Put([]byte(li.ItemID), enc)
+				if err != nil {
+					return err
+				}
+				moved = append(moved, movedItem{acctKey: li.AcctKey, item: same, oldPath: oldPath})
+			}
+		}
+
+		collections := tx.Bucket(acctKey).Bucket([]byte("collections"))
+		if collections == nil {
+			return fmt.Errorf("account '%s' is missing 'collections' bucket", acctKey)
+		}
+		enc, err := encodeCollection(dbc)
+		if err != nil {
+			return err
+		}
+		return collections.Put([]byte(dbc.ID), enc)
+	})
+	return moved, err
+}
+
+// renameItemFile renames the file of pa's item dbi, whose name
+// was changed remotely (it is the item as listed now), to what
+// it would be named if it were downloaded now (in the same
+// folder), and updates dbi, the items with the same content, and
+// the references to the file. A file that was saved under another
+// item's name (because the two have the same content), or whose
+// name doesn't depend on the item's, keeps its name; only the
+// item's name is updated.
+func (r *Repository) renameItemFile(pa providerAccount, coll collection, dbi *dbItem, it Item) error {
+	target, err := r.itemPath(pa, coll.dirName, it.ItemName(), dbi.ID, itemTime(it))
+	if err != nil {
+		return err
+	}
+	if filepath.Base(dbi.FilePath) != dbi.FileName || filepath.Base(target) == dbi.FileName {
+		dbi.Name = it.ItemName()
+		return r.db.saveItem(pa.key(), dbi.ID, dbi)
+	}
+
+	dir := filepath.Dir(dbi.FilePath)
+	fileName, err := r.reserveUniqueFilename(dir, filepath.Base(target), false)
+	if err != nil {
+		return fmt.Errorf("reserving unique filename: %v", err)
+	}
+	oldPath, oldName := dbi.FilePath, dbi.Name
+	dbi.Name = it.ItemName()
+	err = r.moveItemFile(pa, dbi, fileName)
+	if err != nil {
+		dbi.Name = oldName
+		return err
+	}
+	repoLog.Infof("Item %s was renamed remotely; renamed %s to %s", dbi.ID, oldPath, fileName)
+	return nil
+}
+
+// moveItemFile renames the file of pa's item dbi to fileName,
+// which was reserved in the same folder, and updates dbi, the
+// items with the same content, and the references to the file.
+func (r *Repository) moveItemFile(pa providerAccount, dbi *dbItem, fileName string) error {
+	defer r.lockChecksum(dbi.Checksum)()
+
+	oldPath, newPath := dbi.FilePath, filepath.Join(filepath.Dir(dbi.FilePath), fileName)
+	err := r.moveFile(oldPath, newPath)
+	if err != nil {
+		os.Remove(r.fullPath(newPath))
+		return fmt.Errorf("renaming %s to %s: %v", oldPath, fileName, err)
+	}
+
+	// the items with the same content, and the collections
+	// that refer to the file, must refer to the new path
+	err = r.moveSharedChecksumFile(pa.key(), dbi, newPath)
+	if err != nil {
+		return err
+	}
+	for collID := range dbi.Collections {
+		other, err := r.db.loadCollection(pa.key(), collID)
+		if err != nil {
+			return err
+		}
+		if other == nil || inDir(oldPath, other.DirPath) {
+			continue
+		}
+		err = r.replaceInMediaListFile(other.DirPath, oldPath, newPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	dbi.FileName, dbi.FilePath = fileName, newPath
+	err = r.db.saveItem(pa.key(), dbi.ID, dbi)
+	if err != nil {
+		return fmt.Errorf("saving renamed item: %v", err)
+	}
+	return nil
+}
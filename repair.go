@@ -0,0 +1,297 @@
+package photobak
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// RepairReport describes what Repair did.
+type RepairReport struct {
+	Repaired int      // problems that were repaired
+	Skipped  int      // problems that were not confirmed or can't be repaired
+	Failed   []string // descriptions of repairs that failed
+}
+
+// String returns a human-readable report.
+func (rr RepairReport) String() string {
+	s := fmt.Sprintf("Repaired %d problems, skipped %d, failed %d\n", rr.Repaired, rr.Skipped, len(rr.Failed))
+	for _, f := range rr.Failed {
+		s += "  " + f + "\n"
+	}
+	return s
+}
+
+func (rr *RepairReport) fail(p VerifyProblem, err error) {
+	desc := p.Kind
+	if p.Path != "" {
+		desc += " " + p.Path
+	} else if p.ItemID != "" {
+		desc += " " + p.Account + " item " + p.ItemID
+	}
+	rr.Failed = append(rr.Failed, fmt.Sprintf("%s: %v", desc, err))
+}
+
+// Repairable returns true if Repair can repair p.
+func Repairable(p VerifyProblem) bool {
+	switch p.Kind {
+	case ProblemMissingFile, ProblemChecksumMismatch, ProblemChecksumIndex,
+		ProblemBadReference, ProblemMissingReference, ProblemOrphanedRecord:
+		return true
+	}
+	return false
+}
+
+// Repair repairs the problems found by Verify. If confirm is not
+// nil, only the problems for which it returns true are repaired.
+//
+// Items whose files are missing or corrupted are downloaded again,
+// which requires the accounts' credentials; only the collections
+// that contain them are listed. Missing references to items are
+// created again, and invalid ones removed. The checksum index is
+// rebuilt from the items. Items that belong to no collection are
+// removed from the database (their files are not deleted), and
+// collections stop listing items that do not exist. Files that do
+// not belong to any item are left alone.
+func (r *Repository) Repair(ctx context.Context, problems []VerifyProblem, confirm func(VerifyProblem) bool) (RepairReport, error) {
+	var report RepairReport
+
+	byKind := make(map[string][]VerifyProblem)
+	for _, p := range problems {
+		if !Repairable(p) || (confirm != nil && !confirm(p)) {
+			report.Skipped++
+			continue
+		}
+		byKind[p.Kind] = append(byKind[p.Kind], p)
+	}
+
+	r.beginChanges()
+	defer r.endChanges()
+
+	// database records first, so that the index
+	// rebuilt next does not include orphaned items
+	for _, p := range byKind[ProblemOrphanedRecord] {
+		err := r.repairOrphanedRecord(p)
+		if err != nil {
+			report.fail(p, err)
+			continue
+		}
+		report.Repaired++
+	}
+
+	if len(byKind[ProblemChecksumIndex]) > 0 {
+		repoLog.Infof("Rebuilding checksum index")
+		err := r.db.rebuildChecksumIndex()
+		if err != nil {
+			return report, fmt.Errorf("rebuilding checksum index: %v", err)
+		}
+		report.Repaired += len(byKind[ProblemChecksumIndex])
+	}
+
+	for _, p := range byKind[ProblemBadReference] {
+		err := r.removeBadReference(p)
+		if err != nil {
+			report.fail(p, err)
+			continue
+		}
+		report.Repaired++
+	}
+
+	for _, p := range byKind[ProblemMissingReference] {
+		err := r.restoreReference(p)
+		if err != nil {
+			report.fail(p, err)
+			continue
+		}
+		report.Repaired++
+	}
+
+	// download the files again, grouped by account
+	redownloads := make(map[string][]VerifyProblem)
+	for _, kind := range []string{ProblemMissingFile, ProblemChecksumMismatch} {
+		for _, p := range byKind[kind] {
+			redownloads[p.Account] = append(redownloads[p.Account], p)
+		}
+	}
+	accounts := make([]string, 0, len(redownloads))
+	for acct := range redownloads {
+		accounts = append(accounts, acct)
+	}
+	sort.Strings(accounts)
+	for _, acct := range accounts {
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+		r.redownload(ctx, acct, redownloads[acct], &report)
+	}
+
+	return report, nil
+}
+
+// repairOrphanedRecord removes the item of p from the
+// database, or removes it from the collection of p.
+func (r *Repository) repairOrphanedRecord(p VerifyProblem) error {
+	pa, err := r.storedAccount(p.Account)
+	if err != nil {
+		return err
+	}
+
+	if p.Collection != "" {
+		// the collection lists an item that does not exist
+		dbc, err := r.db.loadCollection(pa.key(), p.Collection)
+		if err != nil {
+			return err
+		}
+		if dbc == nil {
+			return nil
+		}
+		delete(dbc.Items, p.ItemID)
+		return r.db.saveCollection(pa.key(), dbc.ID, dbc)
+	}
+
+	// the item belongs to no collection
+	dbi, err := r.db.loadItem(pa.key(), p.ItemID)
+	if err != nil {
+		return err
+	}
+	if dbi == nil {
+		return nil
+	}
+	if dbi.Protection != Unprotected {
+		return fmt.Errorf("item is %s", dbi.Protection)
+	}
+	repoLog.Infof("Removing item %s, which belongs to no collection, from database", p.ItemID)
+	return r.db.deleteItem(pa, p.ItemID)
+}
+
+// removeBadReference removes the reference of p: its line
+// in a media list file, or the link itself.
+func (r *Repository) removeBadReference(p VerifyProblem) error {
+	repoLog.Infof("Removing reference to %s from %s", p.Target, p.Path)
+	if p.Path == r.mediaListPath(filepath.Dir(p.Path)) {
+		return r.replaceInListFile(filepath.Dir(p.Path), p.Target, "")
+	}
+	info, err := os.Lstat(r.fullPath(p.Path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return fmt.Errorf("not a link")
+	}
+	return os.Remove(r.fullPath(p.Path))
+}
+
+// restoreReference refers to the file of the item
+// of p from the folder of the collection of p.
+func (r *Repository) restoreReference(p VerifyProblem) error {
+	pa, err := r.storedAccount(p.Account)
+	if err != nil {
+		return err
+	}
+	dbc, err := r.db.loadCollection(pa.key(), p.Collection)
+	if err != nil {
+		return err
+	}
+	dbi, err := r.db.loadItem(pa.key(), p.ItemID)
+	if err != nil {
+		return err
+	}
+	if dbc == nil || dbi == nil {
+		return fmt.Errorf("collection or item no longer exists")
+	}
+	repoLog.Infof("Referring to %s from %s", dbi.FilePath, dbc.DirPath)
+	return r.writeToMediaListFile(collection{dirPath: dbc.DirPath}, dbi.FilePath)
+}
+
+// redownload downloads the files of the items of problems,
+// which all belong to the account acct, again. The problems
+// are counted in report.
+func (r *Repository) redownload(ctx context.Context, acct string, problems []VerifyProblem, report *RepairReport) {
+	pa, err := r.storedAccount(acct)
+	if err == nil {
+		var ac accountClient
+		ac, err = r.storedAccountClient(pa)
+		if err == nil {
+			r.redownloadFrom(ctx, ac, problems, report)
+			return
+		}
+	}
+	for _, p := range problems {
+		report.fail(p, err)
+	}
+}
+
+// redownloadFrom downloads the files of the items
+// of problems again using ac.
+func (r *Repository) redownloadFrom(ctx context.Context, ac accountClient, problems []VerifyProblem, report *RepairReport) {
+	wanted := make(map[string]VerifyProblem)
+	var itemIDs []string
+	for _, p := range problems {
+		wanted[p.ItemID] = p
+		itemIDs = append(itemIDs, p.ItemID)
+	}
+
+	notFound, err := r.findRemoteItems(ctx, ac, itemIDs, func(coll collection, it Item, itemID string) {
+		p := wanted[itemID]
+		err := r.redownloadItem(ctx, ac, coll, it, itemID)
+		if err != nil {
+			report.fail(p, err)
+			return
+		}
+		report.Repaired++
+	})
+	if err == nil {
+		err = ctx.Err()
+	}
+	for itemID := range notFound {
+		if err != nil {
+			report.fail(wanted[itemID], err)
+		} else {
+			report.fail(wanted[itemID], fmt.Errorf("item not found remotely"))
+		}
+	}
+}
+
+// redownloadItem downloads the file of it, which is in coll
+// and stored under itemID, again, keeping the metadata from
+// the API that was stored before, and checks that it is
+// intact afterwards.
+func (r *Repository) redownloadItem(ctx context.Context, ac accountClient, coll collection, it Item, itemID string) error {
+	before, err := r.db.loadItem(ac.account.key(), itemID)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(r.fullPath(filepath.Dir(before.FilePath)), 0700)
+	if err != nil {
+		return err
+	}
+
+	repoLog.Infof("Downloading %s again to repair it", before.FilePath)
+	err = r.processItem(ctx, itemContext{item: it, coll: coll, ac: ac, checkIntegrity: true, deepIntegrity: true})
+	if err != nil {
+		return err
+	}
+
+	after, err := r.db.loadItem(ac.account.key(), itemID)
+	if err != nil {
+		return err
+	}
+	if after == nil {
+		return fmt.Errorf("item disappeared from database")
+	}
+
+	chksm, err := r.hash(after.FilePath)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(chksm, after.Checksum) {
+		return fmt.Errorf("file is still corrupted after downloading it again")
+	}
+	return nil
+}
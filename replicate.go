@@ -0,0 +1,425 @@
+package photobak
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// ReplicaDBName is the name of the database file in a replica
+// made by Replicate, so that the replica can be opened as a
+// repository of its own.
+const ReplicaDBName = "photobak.db"
+
+// ReplicateOptions configures Replicate.
+type ReplicateOptions struct {
+	// Delete removes files from the destination that
+	// are not in the repository, like rsync --delete.
+	Delete bool
+}
+
+// ReplicateReport describes the result of Replicate.
+type ReplicateReport struct {
+	Files     int   `json:"files"`     // number of files and links in the repository
+	Unchanged int   `json:"unchanged"` // number already in the replica
+	Copied    int   `json:"copied"`    // number of files copied
+	Moved     int   `json:"moved"`     // number of files moved within the replica instead of copied
+	Linked    int   `json:"linked"`    // number of hard and symbolic links made
+	Deleted   int   `json:"deleted"`   // number of files removed from the replica (see ReplicateOptions.Delete)
+	Bytes     int64 `json:"bytes"`     // total size of the files copied
+}
+
+// String returns a human-readable summary of the report.
+func (rr ReplicateReport) String() string {
+	s := fmt.Sprintf("Replicated %d files: %d unchanged, %d copied (%d bytes), %d moved, %d linked\n",
+		rr.Files, rr.Unchanged, rr.Copied, rr.Bytes, rr.Moved, rr.Linked)
+	if rr.Deleted > 0 {
+		s += fmt.Sprintf("Deleted %d files that are no longer in the repository\n", rr.Deleted)
+	}
+	return s
+}
+
+// replicaFile is a file or link of the repository to replicate.
+type replicaFile struct {
+	path string // relative to the repository
+	info os.FileInfo
+}
+
+// Replicate mirrors the repository into the folder dest, which
+// may be a mounted remote (like with rclone or sshfs), to keep a second
+// copy without downloading everything from providers again. Like
+// rsync, files whose size and modification time are the same in
+// dest are not copied again. Files of items are hashed as they are
+// copied and checked against their checksums, and if the replica
+// has a file with the same checksum at an old path (for example,
+// after the path template changed), it is moved into place instead
+// of copied. Links are made again as links.
+//
+// A snapshot of the database is written into dest as ReplicaDBName
+// after all the files are in place, so the replica is a repository
+// that can be opened by itself. If ctx is canceled, Replicate stops
+// without replacing the replica's database; running it again
+// completes the replica.
+func (r *Repository) Replicate(ctx context.Context, dest string, opts ReplicateOptions) (ReplicateReport, error) {
+	var report ReplicateReport
+	absDest, err := filepath.Abs(dest)
+	if err != nil {
+		return report, err
+	}
+	absRepo, err := filepath.Abs(r.path)
+	if err != nil {
+		return report, err
+	}
+	if absDest == absRepo || strings.HasPrefix(absDest, absRepo+string(filepath.Separator)) ||
+		strings.HasPrefix(absRepo, absDest+string(filepath.Separator)) {
+		return report, fmt.Errorf("destination must not be inside the repository, or the repository inside it")
+	}
+	err = os.MkdirAll(dest, 0700)
+	if err != nil {
+		return report, err
+	}
+
+	// the replica's old database tells where its files of
+	// items are by checksum, so moved files can be found;
+	// opening it also makes sure it isn't in use
+	destDB := filepath.Join(dest, ReplicaDBName)
+	oldSums, err := replicaChecksums(destDB)
+	if err != nil {
+		return report, err
+	}
+
+	// snapshot the database and the checksums of the files
+	// of items at the same time, so they match each other
+	tmpDB := destDB + ".tmp"
+	var sums map[string][]byte
+	err = r.db.View(func(tx *bolt.Tx) error {
+		sums, err = fileChecksums(tx)
+		if err != nil {
+			return err
+		}
+		return tx.CopyFile(tmpDB, 0600)
+	})
+	if err != nil {
+		os.Remove(tmpDB)
+		return report, fmt.Errorf("copying database: %v", err)
+	}
+	defer os.Remove(tmpDB) // if it wasn't put in place
+
+	files, err := r.replicaFiles()
+	if err != nil {
+		return report, fmt.Errorf("listing files: %v", err)
+	}
+	report.Files = len(files)
+	inRepo := make(map[string]struct{}, len(files))
+	for _, f := range files {
+		inRepo[f.path] = struct{}{}
+	}
+	oldPaths := make(map[string]string) // stale file in the replica by checksum
+	for fpath, sum := range oldSums {
+		if _, ok := inRepo[fpath]; !ok {
+			oldPaths[string(sum)] = fpath
+		}
+	}
+
+	linked := make(map[int64][]replicaFile) // files copied so far by size, to find hard links
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		to := filepath.Join(dest, f.path)
+		err := os.MkdirAll(filepath.Dir(to), 0700)
+		if err != nil {
+			return report, err
+		}
+
+		if f.info.Mode()&os.ModeSymlink != 0 {
+			changed, err := replicateSymlink(r.fullPath(f.path), to)
+			if err != nil {
+				return report, fmt.Errorf("replicating link %s: %v", f.path, err)
+			}
+			if changed {
+				report.Linked++
+			} else {
+				report.Unchanged++
+			}
+			continue
+		}
+
+		if orig, ok := hardLinked(linked, f); ok {
+			origTo := filepath.Join(dest, orig.path)
+			if sameFiles(to, origTo) {
+				report.Unchanged++
+				continue
+			}
+			os.Remove(to)
+			err := os.Link(origTo, to)
+			if err != nil {
+				return report, fmt.Errorf("linking %s: %v", f.path, err)
+			}
+			report.Linked++
+			continue
+		}
+		linked[f.info.Size()] = append(linked[f.info.Size()], f)
+
+		if info, err := os.Lstat(to); err == nil && info.Mode().IsRegular() &&
+			info.Size() == f.info.Size() && info.ModTime().Equal(f.info.ModTime()) {
+			report.Unchanged++
+			continue
+		}
+
+		sum := sums[f.path]
+		if oldPath, ok := oldPaths[string(sum)]; ok && sum != nil {
+			delete(oldPaths, string(sum))
+			info, err := os.Lstat(filepath.Join(dest, oldPath))
+			if err == nil && info.Mode().IsRegular() && info.Size() == f.info.Size() {
+				err := os.Rename(filepath.Join(dest, oldPath), to)
+				if err != nil {
+					return report, fmt.Errorf("moving %s to %s in replica: %v", oldPath, f.path, err)
+				}
+				os.Chtimes(to, f.info.ModTime(), f.info.ModTime())
+				report.Moved++
+				continue
+			}
+		}
+
+		repoLog.Infof("Replicating %s", f.path)
+		err = r.replicateFile(f.path, to, sum)
+		if err != nil {
+			return report, fmt.Errorf("copying %s: %v", f.path, err)
+		}
+		report.Copied++
+		report.Bytes += f.info.Size()
+	}
+
+	if opts.Delete {
+		n, err := deleteExtraFiles(dest, inRepo)
+		report.Deleted = n
+		if err != nil {
+			return report, fmt.Errorf("deleting files: %v", err)
+		}
+	}
+
+	err = os.Rename(tmpDB, destDB)
+	if err != nil {
+		return report, fmt.Errorf("putting database in place: %v", err)
+	}
+	return report, nil
+}
+
+// replicaFiles returns the files and symbolic links in the
+// repository, except its database and copies of it, its
+// lock file, and its pause marker, in order.
+func (r *Repository) replicaFiles() ([]replicaFile, error) {
+	dbPath, err := filepath.Abs(r.db.Path())
+	if err != nil {
+		return nil, err
+	}
+	var files []replicaFile
+	err = filepath.Walk(r.path, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !(info.Mode().IsRegular() || info.Mode()&os.ModeSymlink != 0) {
+			return nil
+		}
+		if abs, err := filepath.Abs(fpath); err == nil && strings.HasPrefix(abs, dbPath) {
+			return nil // the database, its backups, and temporary copies
+		}
+		rel, err := filepath.Rel(r.path, fpath)
+		if err != nil {
+			return err
+		}
+		if rel == LockFileName || rel == PauseMarkerName {
+			return nil
+		}
+		files = append(files, replicaFile{path: rel, info: info})
+		return nil
+	})
+	return files, err
+}
+
+// fileChecksums returns the checksums of the files
+// of all items in the database, by their paths.
+func fileChecksums(tx *bolt.Tx) (map[string][]byte, error) {
+	sums := make(map[string][]byte)
+	err := tx.ForEach(func(acctKey []byte, accountBucket *bolt.Bucket) error {
+		items := accountBucket.Bucket([]byte("items"))
+		if items == nil {
+			return nil // not an account
+		}
+		return items.ForEach(func(k, v []byte) error {
+			item, err := decodeItem(v)
+			if err != nil {
+				return fmt.Errorf("loading item %s: %v", k, err)
+			}
+			if item != nil && item.FilePath != "" {
+				sums[filepath.FromSlash(item.FilePath)] = item.Checksum
+			}
+			return nil
+		})
+	})
+	return sums, err
+}
+
+// replicaChecksums returns the checksums of the files of
+// items in the replica's database at file, by their paths,
+// or nothing if there is no database. It returns an error
+// if the database is in use, since the replica is then
+// being used as a repository.
+func replicaChecksums(file string) (map[string][]byte, error) {
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return nil, nil
+	}
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: 2 * time.Second, ReadOnly: true})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("database %s of the replica is in use by another process", file)
+	}
+	if err != nil {
+		repoLog.Warnf("Not using the replica's database to find moved files: %v", err)
+		return nil, nil
+	}
+	defer db.Close()
+	var sums map[string][]byte
+	err = db.View(func(tx *bolt.Tx) error {
+		sums, err = fileChecksums(tx)
+		return err
+	})
+	if err != nil {
+		repoLog.Warnf("Not using the replica's database to find moved files: %v", err)
+		return nil, nil
+	}
+	return sums, nil
+}
+
+// replicateFile copies the file at the repo-relative path fpath
+// to the path to, replacing what is there only once the copy is
+// complete, and preserving its modification time. If sum is not
+// nil, the copy must have that checksum.
+func (r *Repository) replicateFile(fpath, to string, sum []byte) error {
+	in, err := os.Open(r.fullPath(fpath))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp := to + ".photobak-tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	h := r.newHash()
+	_, err = io.Copy(io.MultiWriter(out, h), in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && sum != nil && !bytes.Equal(h.Sum(nil), sum) {
+		err = fmt.Errorf("checksum mismatch: expected %x, got %x; the file in the repository may be damaged (see the check command)", sum, h.Sum(nil))
+	}
+	if err == nil {
+		err = os.Chtimes(tmp, info.ModTime(), info.ModTime())
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, to)
+}
+
+// replicateSymlink makes the link at to point where the link at
+// from does, and returns true if it had to be changed.
+func replicateSymlink(from, to string) (bool, error) {
+	target, err := os.Readlink(from)
+	if err != nil {
+		return false, err
+	}
+	if current, err := os.Readlink(to); err == nil && current == target {
+		return false, nil
+	}
+	os.Remove(to)
+	return true, os.Symlink(target, to)
+}
+
+// hardLinked returns the file among linked that f
+// is a hard link to, if any.
+func hardLinked(linked map[int64][]replicaFile, f replicaFile) (replicaFile, bool) {
+	for _, other := range linked[f.info.Size()] {
+		if os.SameFile(other.info, f.info) {
+			return other, true
+		}
+	}
+	return replicaFile{}, false
+}
+
+// sameFiles returns true if the paths a and b are the same file.
+func sameFiles(a, b string) bool {
+	ai, err := os.Lstat(a)
+	if err != nil {
+		return false
+	}
+	bi, err := os.Lstat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(ai, bi)
+}
+
+// deleteExtraFiles removes the files and links in dest whose
+// paths are not in keep, except the replica's database, then
+// the folders left empty, and returns how many files it removed.
+func deleteExtraFiles(dest string, keep map[string]struct{}) (int, error) {
+	var extra, dirs []string
+	err := filepath.Walk(dest, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dest, fpath)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if rel != "." {
+				dirs = append(dirs, fpath)
+			}
+			return nil
+		}
+		if strings.HasPrefix(rel, ReplicaDBName) {
+			return nil
+		}
+		if _, ok := keep[rel]; !ok {
+			extra = append(extra, fpath)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	var deleted int
+	for _, fpath := range extra {
+		err := os.Remove(fpath)
+		if err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	// deepest first, so parents are empty by the time they're tried
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		os.Remove(dir) // fails if not empty
+	}
+	return deleted, nil
+}
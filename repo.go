@@ -2,16 +2,16 @@ package photobak
 
 import (
 	"bytes"
-	"crypto/sha256"
+	"context"
 	"encoding/hex"
 	"fmt"
 	"hash"
 	"io"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"text/template"
 	"time"
 
 	"github.com/rwcarlsen/goexif/exif"
@@ -32,6 +32,9 @@ type Repository struct {
 	// of the path should be empty if it exists.
 	path string
 
+	// the path of the lock file (see LockFileName).
+	lockPath string
+
 	// the database to operate on; should be opened.
 	db *boltDB
 
@@ -55,9 +58,291 @@ type Repository struct {
 	itemChecksums   map[string]chan struct{}
 	itemChecksumsMu sync.Mutex
 
+	// counts of remote changes seen during the current run,
+	// used to detect ETag churn.
+	etags etagStats
+
+	// the files found changed outside photobak during
+	// the current run.
+	localChanges localChanges
+
+	// the set of repo-relative paths of existing folders and
+	// files that were adopted (see AdoptExisting).
+	adopted   map[string]struct{}
+	adoptedMu sync.Mutex
+
+	// the template for the paths of new items
+	// (see SetPathTemplate).
+	pathTemplate *template.Template
+
+	// how collections refer to items whose files are
+	// elsewhere in the repository (see SetDedupMode).
+	dedupMode string
+
+	// the algorithm of the checksums of files
+	// (see SetChecksumAlgorithm).
+	checksumAlgo string
+
+	// the kinds of views kept in ViewsDir (see SetViews).
+	views []string
+
+	// the key derived from CredentialPassphrase,
+	// once it has been needed.
+	credentialKeyCache []byte
+	credentialKeyMu    sync.Mutex
+
+	// the repo-relative paths of files that were moved
+	// and are to be removed by endChanges (see SyncFriendly).
+	movedFiles   map[string]struct{}
+	movedFilesMu sync.Mutex
+
+	// the folder in TrashDir into which the
+	// current run of Prune moves deleted files.
+	trashBatch string
+
+	// whether downloads are paused (see Pause).
+	pause pauser
+
+	// how much of MaxDisk the current run of Store
+	// uses; nil if it has no limit.
+	budget *diskBudget
+
 	// NumWorkers is how many download workers to operate
 	// in parallel.
 	NumWorkers int
+
+	// VerifyChanges enables a cheap check before re-downloading
+	// an item whose ETag has changed: if the provider's checksum
+	// of the content (see DownloadVerifier) matches the local
+	// file, only the ETag is updated. Clients that give no
+	// checksum are downloaded from as usual, unless
+	// VerifyChangesBySize is set too.
+	VerifyChanges bool
+
+	// VerifyChangesBySize makes VerifyChanges compare the remote
+	// size (see SizeChecker) with the local file for items that
+	// have no checksum, and treat the item as unchanged if they
+	// are the same. This is lossy: edits that keep the size of
+	// the file, like a rotation that only changes the EXIF
+	// orientation, are never downloaded.
+	VerifyChangesBySize bool
+
+	// Accounts, if not empty, limits Store, Sync, and Prune
+	// to these of the configured accounts (in the form
+	// "provider:username"), so that several repositories
+	// can back up different accounts in one process.
+	// Items of other accounts in the repository are left
+	// alone.
+	Accounts []string
+
+	// DeepIntegrity makes integrity checks (see Store and
+	// Check) hash every file, instead of only those whose size
+	// or modification time changed since they were saved.
+	// Changes that keep both, like bits rotting on disk, are
+	// only found this way.
+	DeepIntegrity bool
+
+	// ChangeStrategies maps a provider name or an account
+	// (in the form "provider:username") to the change
+	// detection strategy to use for it; account entries
+	// take precedence. Providers and accounts not listed
+	// use the provider's default strategy.
+	ChangeStrategies map[string]string
+
+	// Filters maps a provider name or an account (in the
+	// form "provider:username") to the filter that selects
+	// what Store backs up for it; account entries take
+	// precedence. Providers and accounts not listed have
+	// everything backed up.
+	Filters map[string]Filter
+
+	// DormantAfter, if not zero, makes Store skip collections
+	// in which no items were added or changed for this long,
+	// so that each run gets to the active ones sooner. Every
+	// collection is still listed once a week (a full pass), to
+	// catch changes to dormant ones.
+	DormantAfter time.Duration
+
+	// Conflicts is what Store does when an item would be
+	// downloaded again, because it changed remotely or (with
+	// integrity checks) its file doesn't match its checksum,
+	// but the file was edited outside photobak since it was
+	// saved: ConflictKeepBoth (the default) moves the edited
+	// file aside, ConflictKeepLocal leaves it as it is and
+	// doesn't download the item, and ConflictKeepRemote
+	// downloads the item over it. Files that were deleted, or
+	// that were damaged without their size or modification
+	// time changing, are always downloaded again.
+	Conflicts string
+
+	// AlbumOrder is the order in which Store processes the
+	// collections of each account: AlbumOrderRecent (the
+	// default) for those in which items were added or changed
+	// most recently first, or AlbumOrderSmallest or
+	// AlbumOrderLargest for those with the fewest or the most
+	// items first. Either way, new collections come first.
+	// Since an item that is in several collections is stored
+	// in the first one that gets to it, the order also decides
+	// where files go.
+	AlbumOrder string
+
+	// FirstAlbums and LastAlbums are patterns (as in
+	// Filter.IncludeAlbums) of the names of collections that
+	// Store processes before and after the others, in the
+	// order of the patterns, whatever the AlbumOrder. If
+	// LastAlbums is nil, the provider's are used (see
+	// Provider.LastAlbums). Collections that were cut short
+	// in the last run are still processed first.
+	FirstAlbums []string
+	LastAlbums  []string
+
+	// Media, if MediaPhotos or MediaVideos, makes Store back
+	// up only that kind of item, for accounts whose filter
+	// doesn't say which kind (see Filters). If empty or
+	// MediaAll, both are backed up.
+	Media string
+
+	// MaxSize, if positive, is the size in bytes above which
+	// Store doesn't download new items; they are recorded as
+	// skipped instead (see SkippedItems), and downloaded by
+	// the first run that allows them. If the client implements
+	// SizeChecker, the size is checked before downloading;
+	// otherwise the download is stopped once it exceeds MaxSize.
+	MaxSize int64
+
+	// Preflight makes Store list all the items of each account
+	// before downloading any, and return a NotEnoughSpaceError
+	// if the new ones whose sizes are listed (see ListedSizer)
+	// wouldn't fit in the free space of the repository's disk,
+	// instead of running out of space halfway through.
+	Preflight bool
+
+	// MaxDisk, if positive, is the most bytes the files in
+	// the repository may take up. Once a new item doesn't fit,
+	// Store downloads no more new ones, lists the rest anyway
+	// to tell how much more space they need, and returns a
+	// DiskFullError. Albums are processed one at a time, in
+	// order (see AlbumOrder), so the first ones fill it first.
+	// Changed items that are downloaded again don't count.
+	MaxDisk int64
+
+	// PruneLimit, if positive, is the fraction of an account's
+	// items (like 0.1 for 10%) above which Prune and Sync don't
+	// prune the account, in case the provider listed fewer items
+	// than it has, for example because of an outage.
+	PruneLimit float64
+
+	// ForcePrune makes Prune and Sync prune accounts even if
+	// that exceeds PruneLimit, or their provider listed no
+	// items at all, which they otherwise refuse to do.
+	ForcePrune bool
+
+	// TrashRetention, if positive, makes Prune move the files
+	// of the items it deletes into TrashDir instead of deleting
+	// them, where they are kept for this long.
+	TrashRetention time.Duration
+
+	// ListingMaxAge, if positive, lets Prune use the items
+	// that were listed in a collection during an earlier run,
+	// if it was at most this long ago, instead of listing them
+	// again. Collections themselves are always listed again.
+	ListingMaxAge time.Duration
+
+	// APIKey, if set, is used to encrypt everything the API
+	// provides about items and collections before it is
+	// stored in the database (see Store's saveEverything).
+	// It must be APIKeySize bytes long. The same key is
+	// needed to read that information back.
+	APIKey []byte
+
+	// AdoptExisting makes Store adopt folders and files that
+	// already exist where new collections and items would be
+	// saved, instead of downloading them again. This is useful
+	// when the repository's files were restored from another
+	// backup but its database was not.
+	AdoptExisting bool
+
+	// RenameFolders makes Store rename the folder of each
+	// collection that was renamed remotely since it was saved,
+	// before processing any of the account's collections, and
+	// update the paths of the files that were in it and the
+	// references to them. Otherwise, a collection keeps the
+	// folder it was first saved in. It has no effect if the
+	// repository is SyncFriendly.
+	RenameFolders bool
+
+	// RenameFiles makes Store rename the file of each item
+	// that was renamed remotely since it was saved, in the
+	// same folder, to what it would be named if it were
+	// downloaded now, and update the references to it.
+	// Local-only items and files saved under the name of
+	// another item with the same content keep their names.
+	RenameFiles bool
+
+	// FileTimes makes Store set the modification time of each
+	// file it downloads (and its creation time, on Windows and
+	// macOS) to when its item was taken, so that file browsers
+	// and other tools sort the files in the order they were
+	// taken. Files of items whose time isn't known keep the
+	// time they were downloaded.
+	FileTimes bool
+
+	// SyncFriendly makes changes to the repository easier on
+	// snapshot and file synchronization tools that watch it
+	// (like Windows VSS, Syncthing, or OneDrive): files are
+	// not renamed in place, moved files are copied to their
+	// new paths and their old paths removed together when the
+	// operation finishes, and a busy marker file (see
+	// BusyMarkerName) exists while files are being changed.
+	SyncFriendly bool
+
+	// Manifests makes the repository keep checksum manifests
+	// (see ManifestName) of its files up to date, so that they
+	// can be verified with standard tools. They are written
+	// whenever an operation finishes changing the repository.
+	Manifests bool
+
+	// XMP makes the repository keep an XMP sidecar (see XMPExt)
+	// next to each file with the caption, time taken, camera, and
+	// location of its item, so that photo tools can import them.
+	// They are written whenever an operation finishes changing
+	// the repository.
+	XMP bool
+
+	// AlbumInfo makes the repository keep a file (see
+	// AlbumInfoName) in the folder of each collection that
+	// describes it, so that what is known about collections
+	// is not only in the database. They are written whenever
+	// an operation finishes changing the repository.
+	AlbumInfo bool
+
+	// ConvertHEIC, if set, makes the repository keep a JPEG
+	// companion (see JPEGCompanionExt) next to each HEIC or HEIF
+	// file, for viewers that can't open them; it is called to
+	// convert the file at src to a JPEG at dst. The originals
+	// are kept as they are. Companions are written whenever an
+	// operation finishes changing the repository.
+	ConvertHEIC func(src, dst string) error
+
+	// CredentialStore, if set, is where the credentials of
+	// accounts are kept instead of the database. Credentials
+	// that are in the database are moved to it when needed.
+	CredentialStore CredentialStore
+
+	// CredentialPassphrase, if set, is called to get the
+	// passphrase with which credentials are encrypted in the
+	// database, the first time credentials are needed. Unless
+	// there is a CredentialStore, credentials that are not
+	// encrypted yet are encrypted when they are used. The same
+	// passphrase must be given every time, or the credentials
+	// can't be used.
+	CredentialPassphrase func() (string, error)
+
+	// Progress, if set, is called with events that describe
+	// the progress of Store, and when other operations start
+	// and finish changing files. It is called concurrently
+	// from many goroutines and should return quickly.
+	Progress func(ProgressEvent)
 }
 
 type downloadingItem struct {
@@ -67,31 +352,79 @@ type downloadingItem struct {
 	path   string
 	pathMu sync.Mutex
 
+	// the path of the file reserved for a new item, which
+	// its download replaces when it is committed
+	reserved string
+
+	// the repo-relative path under which the download
+	// is journaled, if it is (see addPending)
+	journaled string
+
 	// a channel used for waiting for item downloading completion
 	// (either successful or not).
 	completed chan struct{}
 }
 
-// Removes the downloading file.
+// Removes the downloading file, and the file
+// reserved for it if the item is new.
 func (i *downloadingItem) remove() {
 	if i.path != "" {
 		os.Remove(i.path)
 		i.path = ""
 	}
+	if i.reserved != "" {
+		os.Remove(i.reserved)
+		i.reserved = ""
+	}
 }
 
 // OpenRepo opens a repository that is ready to store backups
-// in. It is initiated with a path, where a folder will be created
-// if it does not already exists, and a database will be created
-// inside it. The path is where all saved assets will be stored.
-// An opened repository should be closed when finished with it.
-func OpenRepo(path string) (*Repository, error) {
+// in. It is initiated with a path, where a folder will be
+// created if it does not already exists, and a database will
+// be created inside it.
+// The path is where all saved assets will be stored. An opened
+// repository should be closed when finished with it.
+func OpenRepo(location string) (*Repository, error) {
+	return OpenRepoWithDB(location, "")
+}
+
+// OpenRepoWithDB is like OpenRepo, but keeps the database at
+// dbPath instead of inside the repository, unless dbPath is
+// empty. This is useful when the repository is on a network
+// file system, where the database should not be. The same
+// dbPath must be used every time the repository is opened.
+//
+// Only one process can have a repository open at a time. If
+// another one has it open, a RepoLockedError is returned,
+// after waiting up to LockWait for it to close it.
+func OpenRepoWithDB(location, dbPath string) (*Repository, error) {
+	path := location
 	err := os.MkdirAll(path, 0700)
 	if err != nil {
 		return nil, err
 	}
+	lockPath, err := lockRepo(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := openRepo(path, dbPath)
+	if err != nil {
+		unlockRepo(lockPath)
+		return nil, err
+	}
+	r.lockPath = lockPath
+	return r, nil
+}
+
+// openRepo opens the repository at path, which is locked,
+// with its database at dbPath, or in path if empty.
+func openRepo(path, dbPath string) (*Repository, error) {
 
-	dbPath := filepath.Join(path, "photobak.db")
+	if dbPath == "" {
+		dbPath = filepath.Join(path, "photobak.db")
+	} else if err := os.MkdirAll(filepath.Dir(dbPath), 0700); err != nil {
+		return nil, err
+	}
 	db, err := openDB(dbPath)
 	if err != nil {
 		return nil, err
@@ -101,22 +434,80 @@ func OpenRepo(path string) (*Repository, error) {
 	for _, account := range getAccounts() {
 		err := db.createAccount(account)
 		if err != nil {
+			db.Close()
 			return nil, err
 		}
 	}
 
-	return &Repository{
+	tplText, err := db.loadSetting("path_template")
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("loading path template: %v", err)
+	}
+	if tplText == "" {
+		tplText = DefaultPathTemplate
+	}
+	tpl, err := parsePathTemplate(tplText)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	dedupMode, err := db.loadSetting("dedup_mode")
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("loading de-duplication mode: %v", err)
+	}
+	if dedupMode == "" {
+		dedupMode = DedupList
+	}
+
+	checksumAlgo, err := db.loadSetting("checksum_algorithm")
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("loading checksum algorithm: %v", err)
+	}
+	if checksumAlgo == "" {
+		checksumAlgo = ChecksumSHA256
+	}
+
+	views, err := db.loadSetting("views")
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("loading views: %v", err)
+	}
+
+	r := &Repository{
 		path:          path,
 		db:            db,
 		downloading:   make(map[string]*downloadingItem),
 		itemNames:     make(map[string]chan struct{}),
 		itemChecksums: make(map[string]chan struct{}),
-	}, nil
+		pathTemplate:  tpl,
+		dedupMode:     dedupMode,
+		checksumAlgo:  checksumAlgo,
+		views:         splitViews(views),
+	}
+
+	// clean up after downloads that were cut off
+	// without a chance to, like by a power loss
+	err = r.recoverDownloads()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return r, nil
 }
 
 // Close closes a repository cleanly.
 func (r *Repository) Close() error {
-	return r.db.Close()
+	err := r.db.Close()
+	if r.lockPath != "" {
+		unlockRepo(r.lockPath)
+		r.lockPath = ""
+	}
+	return err
 }
 
 // Unsafe version of Close() which is expected to be called in the
@@ -133,8 +524,8 @@ func (r *Repository) CloseUnsafeOnExit() {
 		downloadingItem.pathMu.Lock()
 
 		if downloadingItem.path != "" {
-			Info.Printf("Removing partially downloaded %s", r.repoRelative(downloadingItem.path))
-			os.Remove(downloadingItem.path)
+			repoLog.Infof("Removing partially downloaded %s", r.repoRelative(downloadingItem.path))
+			downloadingItem.remove()
 		}
 	}
 
@@ -145,19 +536,19 @@ func (r *Repository) CloseUnsafeOnExit() {
 // are none, it will ask for new ones and save them, returning the
 // byte representation of the credentials.
 func (r *Repository) getCredentials(pa providerAccount) ([]byte, error) {
-	// see if credentials are in database already
-	creds, err := r.db.loadCredentials(pa)
+	// see if credentials are stored already
+	creds, err := r.loadCredentials(pa)
 	if err != nil {
 		return nil, fmt.Errorf("loading credentials for %s: %v", pa.username, err)
 	}
 	if creds == nil {
-		fmt.Printf("Credentials needed for %s (%s).\n", pa.username, pa.provider.Title)
+		fmt.Println(Tr("Credentials needed for %s (%s).", pa.username, pa.provider.Title))
 		// we need to get credentials to access cloud provider
 		creds, err = pa.provider.Credentials(pa.username)
 		if err != nil {
 			return nil, fmt.Errorf("getting credentials for %s: %v", pa.username, err)
 		}
-		err = r.db.saveCredentials(pa, creds)
+		err = r.saveCredentials(pa, creds)
 		if err != nil {
 			return nil, fmt.Errorf("saving credentials for %s: %v", pa.username, err)
 		}
@@ -188,12 +579,15 @@ func (r *Repository) AuthorizeAllAccounts() error {
 // you, set it to true.
 //
 // If checkIntegrity is true, consistency of the items that
-// are already stored in the database will be checked.
+// are already stored in the database will be checked. Only
+// files whose size or modification time changed since they
+// were saved are hashed, unless DeepIntegrity is true.
 //
 // Store operates per-collection (per-album), that is, it
 // iterates each collection and downloads all the items for
 // each collection, and organizes them by collection name
-// on disk.
+// on disk. Collections and items that aren't selected by
+// the account's filter (see Filters) are skipped.
 //
 // Store does not download multiple copies of the same
 // photo, assuming the provider correctly IDs each item.
@@ -207,11 +601,42 @@ func (r *Repository) AuthorizeAllAccounts() error {
 // will not disappear locally by running this method. It
 // will, however, update existing items if they are outdated,
 // missing, or corrupted locally.
-func (r *Repository) Store(saveEverything bool, checkIntegrity bool) error {
+//
+// If ctx is canceled, listings and downloads in progress are
+// aborted, partially-downloaded files are removed, and Store
+// returns the context's error once everything has stopped.
+func (r *Repository) Store(ctx context.Context, saveEverything bool, checkIntegrity bool) error {
+	for key, f := range r.Filters {
+		if err := f.Validate(); err != nil {
+			return fmt.Errorf("filter for %s: %v", key, err)
+		}
+	}
+	if err := (Filter{Media: r.Media}).Validate(); err != nil {
+		return err
+	}
+
 	accounts, err := r.authorizedAccounts()
 	if err != nil {
 		return err
 	}
+	started := time.Now()
+
+	if r.MaxDisk > 0 {
+		r.budget, err = newDiskBudget(r.path, r.MaxDisk)
+		if err != nil {
+			return err
+		}
+		defer func() { r.budget = nil }()
+	}
+
+	r.beginChanges()
+	defer r.endChanges()
+
+	r.etags.reset()
+	defer r.warnIfChurning()
+
+	r.localChanges.reset()
+	defer r.warnIfLocalChanges()
 
 	// prepare to start a number of workers that will perform downloads
 	var workerWg sync.WaitGroup
@@ -220,6 +645,7 @@ func (r *Repository) Store(saveEverything bool, checkIntegrity bool) error {
 	if numWorkers < 1 {
 		numWorkers = 1
 	}
+	defer r.db.batchWrites(numWorkers)()
 
 	// spawn worker goroutines
 	for i := 0; i < numWorkers; i++ {
@@ -227,10 +653,26 @@ func (r *Repository) Store(saveEverything bool, checkIntegrity bool) error {
 		go func() {
 			defer workerWg.Done()
 			for itemCtx := range ctxChan {
-				err := r.processItem(itemCtx)
-				if err != nil {
-					log.Println(err)
+				var err error
+				if ctx.Err() != nil {
+					err = ctx.Err() // canceled; just drain the channel
+				} else if err = r.waitWhilePaused(ctx); err == nil {
+					err = r.processItem(ctx, itemCtx)
+					if err != nil && err != errOverBudget && ctx.Err() == nil {
+						repoLog.Errorf("%v", err)
+					}
+				}
+				if err == nil {
+					itemCtx.run.itemProcessed(itemCtx.index)
+				} else if ctx.Err() != nil {
+					itemCtx.run.interrupt()
 				}
+				r.progress(ProgressEvent{
+					Type:    ItemDone,
+					Account: itemCtx.ac.account.String(),
+					ItemID:  itemCtx.item.ItemID(),
+					Err:     err,
+				})
 			}
 		}()
 	}
@@ -238,22 +680,65 @@ func (r *Repository) Store(saveEverything bool, checkIntegrity bool) error {
 	// perform downloads for each account
 	var collWg sync.WaitGroup
 	numCollWorkers := r.NumWorkers / 2
-	if numCollWorkers < 1 {
-		numCollWorkers = 1
+	if numCollWorkers < 1 || r.budget != nil {
+		numCollWorkers = 1 // with a budget, the first albums come first
 	}
 	throttle := make(chan struct{}, numCollWorkers)
+	var listErr error
+	var accountRuns []accountRun
 	for _, ac := range accounts {
-		listedCollections, err := ac.client.ListCollections()
+		if ctx.Err() != nil {
+			break
+		}
+		listedCollections, err := ac.client.ListCollections(ctx)
 		if err != nil {
-			return err
+			listErr = authError(ac.account, err)
+			break
+		}
+		listedCollections = r.filterCollections(ac.account, listedCollections)
+		listedCollections, fullPass, err := r.skipDormant(ac.account, listedCollections)
+		if err != nil {
+			listErr = fmt.Errorf("%s: finding dormant collections: %v", ac.account, err)
+			break
+		}
+		err = r.orderCollections(ac.account, listedCollections)
+		if err != nil {
+			repoLog.Errorf("%s: ordering collections: %v", ac.account, err)
+		}
+		err = r.staleFirst(ac.account, listedCollections)
+		if err != nil {
+			repoLog.Errorf("%s: loading unfinished collections: %v", ac.account, err)
+		}
+		r.renameCollectionDirs(ac.account, listedCollections)
+		ar := accountRun{ac: ac, collections: listedCollections, runs: make(map[string]*collectionRun), fullPass: fullPass}
+		err = r.resumeCheckpoint(&ar, checkIntegrity)
+		if err != nil {
+			repoLog.Errorf("%s: loading checkpoint: %v", ac.account, err)
 		}
-		for _, listedColl := range listedCollections {
+		var prelisted map[string][]Item
+		if r.Preflight {
+			prelisted, err = r.preflight(ctx, ar)
+			if err != nil {
+				listErr = err
+				break
+			}
+		}
+		accountRuns = append(accountRuns, ar)
+		for _, listedColl := range ar.collections {
 			throttle <- struct{}{}
+			if ctx.Err() != nil {
+				<-throttle
+				break
+			}
+			run := new(collectionRun)
+			run.resumeAt(ar.checkpoint.offset(listedColl.CollectionID()))
+			run.prelisted = prelisted[listedColl.CollectionID()]
+			ar.runs[listedColl.CollectionID()] = run
 			go func(listedColl Collection) {
 				defer func() { <-throttle }()
-				err := r.processCollection(listedColl, ac, ctxChan, saveEverything, checkIntegrity, &collWg)
+				err := r.processCollection(ctx, listedColl, ac, ctxChan, saveEverything, checkIntegrity, run, &collWg)
 				if err != nil {
-					log.Printf("[ERROR] processing %s: %v", listedColl.CollectionName(), err)
+					repoLog.Errorf("processing %s: %v", listedColl.CollectionName(), err)
 					return
 				}
 			}(listedColl)
@@ -261,6 +746,9 @@ func (r *Repository) Store(saveEverything bool, checkIntegrity bool) error {
 		for i := 0; i < cap(throttle); i++ {
 			throttle <- struct{}{} // make sure all goroutines finish
 		}
+		for i := 0; i < cap(throttle); i++ {
+			<-throttle // and free the slots for the next account
+		}
 	}
 
 	// block until the processCollection() goroutines have finished
@@ -275,22 +763,64 @@ func (r *Repository) Store(saveEverything bool, checkIntegrity bool) error {
 	// block until all the workers are finished
 	workerWg.Wait()
 
-	return nil
+	// remember which collections were cut short so that
+	// the next run can start with them
+	for _, ar := range accountRuns {
+		err := r.saveUnfinished(ar)
+		if err != nil {
+			repoLog.Errorf("%s: saving unfinished collections: %v", ar.ac.account, err)
+		}
+		err = r.saveActivity(ar)
+		if err != nil {
+			repoLog.Errorf("%s: saving collection activity: %v", ar.ac.account, err)
+		}
+		err = r.saveCompleted(ar)
+		if err != nil {
+			repoLog.Errorf("%s: saving completed collections: %v", ar.ac.account, err)
+		}
+		err = r.saveListings(ar, started)
+		if err != nil {
+			repoLog.Errorf("%s: saving listings: %v", ar.ac.account, err)
+		}
+		err = r.saveOrder(ar)
+		if err != nil {
+			repoLog.Errorf("%s: saving order of items: %v", ar.ac.account, err)
+		}
+		err = r.pairLivePhotos(ar)
+		if err != nil {
+			repoLog.Errorf("%s: pairing live photos: %v", ar.ac.account, err)
+		}
+		err = r.saveCheckpoint(ar, ctx.Err() != nil, checkIntegrity, started)
+		if err != nil {
+			repoLog.Errorf("%s: saving checkpoint: %v", ar.ac.account, err)
+		}
+	}
+
+	if listErr != nil {
+		return listErr
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return r.budget.err()
 }
 
 // authorizedAccounts gets a list of all the configured accounts
-// and attaches an authorized client to each one; it will obtain
-// credentials if needed.
+// (limited to Accounts, if set) and attaches an authorized client
+// to each one; it will obtain credentials if needed.
 func (r *Repository) authorizedAccounts() ([]accountClient, error) {
 	var accounts []accountClient
 	for _, pa := range getAccounts() {
+		if !accountSelected(r.Accounts, pa) {
+			continue
+		}
 		creds, err := r.getCredentials(pa)
 		if err != nil {
-			return nil, fmt.Errorf("getting credentials: %v", err)
+			return nil, AuthError{Account: pa.String(), Err: fmt.Errorf("getting credentials: %v", err)}
 		}
-		client, err := pa.provider.NewClient(creds)
+		client, err := r.newClient(pa, creds)
 		if err != nil {
-			return nil, fmt.Errorf("getting authenticated client: %v", err)
+			return nil, AuthError{Account: pa.String(), Err: fmt.Errorf("getting authenticated client: %v", err)}
 		}
 		accounts = append(accounts, accountClient{
 			account: pa,
@@ -301,12 +831,16 @@ func (r *Repository) authorizedAccounts() ([]accountClient, error) {
 }
 
 // processCollection will process a collection from a provider.
-func (r *Repository) processCollection(listedColl Collection, ac accountClient, ctxChan chan itemContext,
-	saveEverything bool, checkIntegrity bool, wg *sync.WaitGroup) error {
-	Info.Printf("Processing collection %s: %s", listedColl.CollectionID(), listedColl.CollectionName())
+func (r *Repository) processCollection(ctx context.Context, listedColl Collection, ac accountClient, ctxChan chan itemContext,
+	saveEverything bool, checkIntegrity bool, run *collectionRun, wg *sync.WaitGroup) error {
+	repoLog.Infof("Processing collection %s: %s", listedColl.CollectionID(), listedColl.CollectionName())
 
 	// see if we have the collection in the db already
-	dbc, err := r.db.loadCollection(ac.account.key(), listedColl.CollectionID())
+	collID, err := r.storedCollectionID(ac.account, listedColl)
+	if err != nil {
+		return err
+	}
+	dbc, err := r.db.loadCollection(ac.account.key(), collID)
 	if err != nil {
 		return err
 	}
@@ -314,13 +848,21 @@ func (r *Repository) processCollection(listedColl Collection, ac accountClient,
 	// carefully craft the collection object... if it is a new collection,
 	// we need to choose a folder name that's not in use (in case the name
 	// is the same as an existing collection), otherwise use existing path.
-	coll := collection{Collection: listedColl}
+	coll := collection{Collection: listedColl, id: collID}
+	run.id = collID
 	if dbc == nil {
 		// it's new! great, make sure we don't overwrite (merge) with
-		// an existing collection of the same name in this account.
-		coll.dirName, err = r.reserveUniqueFilename(ac.account.accountPath(), listedColl.CollectionName(), true)
-		if err != nil {
-			return err
+		// an existing collection of the same name in this account,
+		// unless we're supposed to adopt what's already there.
+		var adopted bool
+		if r.AdoptExisting {
+			coll.dirName, adopted = r.adoptCollectionDir(ac.account, listedColl.CollectionName())
+		}
+		if !adopted {
+			coll.dirName, err = r.reserveUniqueFilename(ac.account.accountPath(), listedColl.CollectionName(), true)
+			if err != nil {
+				return err
+			}
 		}
 	} else {
 		// we've seen this collection before, so use folder already on disk.
@@ -331,7 +873,7 @@ func (r *Repository) processCollection(listedColl Collection, ac accountClient,
 	// save collection to database
 	if dbc == nil {
 		dbc = &dbCollection{
-			ID:      coll.CollectionID(),
+			ID:      coll.id,
 			Name:    coll.CollectionName(),
 			DirName: coll.dirName,
 			DirPath: coll.dirPath,
@@ -339,8 +881,16 @@ func (r *Repository) processCollection(listedColl Collection, ac accountClient,
 		}
 	}
 	dbc.Saved = time.Now()
+	if dbc.Active.IsZero() {
+		// new, or stored before activity was recorded
+		dbc.Active = dbc.Saved
+	}
+	describeCollection(&dbc.Meta, coll.Collection)
 	if saveEverything {
-		dbc.Meta.API = coll.Collection
+		err = r.setCollectionAPI(&dbc.Meta, coll.Collection)
+		if err != nil {
+			return fmt.Errorf("storing API data for collection: %v", err)
+		}
 	}
 	err = r.db.saveCollection(ac.account.key(), dbc.ID, dbc)
 	if err != nil {
@@ -356,40 +906,87 @@ func (r *Repository) processCollection(listedColl Collection, ac accountClient,
 	// wrap it in a context and pass it to the workers
 	// to do the processing & downloading.
 	itemChan := make(chan Item)
+	filter := r.filter(ac.account)
+
+	// if the last run was interrupted, skip the items it
+	// processed; if the client can, don't even list them
+	var first int
+	offsetLister, canOffset := ac.client.(OffsetLister)
+	if run.offset > 0 && canOffset && run.prelisted == nil {
+		first = run.offset
+		repoLog.Infof("%s: resuming listing after %d items", listedColl.CollectionName(), first)
+	}
 
 	wg.Add(1)
 	go func(wg *sync.WaitGroup) {
 		defer wg.Done()
+		index := first
 		for receivedItem := range itemChan {
-			ctxChan <- itemContext{
+			i := index
+			index++
+			run.items = append(run.items, newListedItem(receivedItem))
+			if ctx.Err() != nil {
+				run.interrupt()
+				continue // canceled; keep draining so the client can finish
+			}
+			if i < run.offset {
+				continue // processed in the last run
+			}
+			if !filter.includesItem(receivedItem) {
+				run.itemProcessed(i)
+				continue
+			}
+			r.progress(ProgressEvent{Type: ItemQueued, Account: ac.account.String(), ItemID: receivedItem.ItemID()})
+			select {
+			case ctxChan <- itemContext{
 				item:           receivedItem,
 				coll:           coll,
 				ac:             ac,
 				saveEverything: saveEverything,
 				checkIntegrity: checkIntegrity,
+				run:            run,
+				index:          i,
+			}:
+			case <-ctx.Done():
+				run.interrupt()
+				r.progress(ProgressEvent{Type: ItemDone, Account: ac.account.String(), ItemID: receivedItem.ItemID(), Err: ctx.Err()})
 			}
 		}
 	}(wg)
 
 	// begin processing all the items for this collection
-	err = ac.client.ListCollectionItems(coll, itemChan)
+	if run.prelisted != nil {
+		err = replayItems(ctx, run.prelisted, itemChan)
+	} else if first > 0 {
+		err = offsetLister.ListCollectionItemsFrom(ctx, coll, first, itemChan)
+	} else {
+		err = ac.client.ListCollectionItems(ctx, coll, itemChan)
+	}
 	if err != nil {
 		return fmt.Errorf("client error listing collection items, giving up: %v", err)
 	}
+	if ctx.Err() == nil && first == 0 {
+		// a listing that started at an offset is incomplete,
+		// so it doesn't count for pruning or the order of items
+		run.setListed()
+	}
 
 	return nil
 }
 
 // processItem will process an item from a provider.
-func (r *Repository) processItem(ctx itemContext) error {
+func (r *Repository) processItem(ctx context.Context, ic itemContext) error {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("[PANIC] recovered from processItem: %v", r)
+			repoLog.Errorf("recovered from panic in processItem: %v", r)
 		}
 	}()
 
-	itemID := ctx.item.ItemID()
-	mapKey := ctx.ac.account.provider.Name + ":" + itemID
+	itemID, err := r.storedItemID(ic)
+	if err != nil {
+		return fmt.Errorf("looking up item '%s' in database: %v", ic.item.ItemID(), err)
+	}
+	mapKey := ic.ac.account.provider.Name + ":" + itemID
 	downloadingItem := &downloadingItem{completed: make(chan struct{})}
 
 	for {
@@ -400,7 +997,11 @@ func (r *Repository) processItem(ctx itemContext) error {
 
 			// it's already being downloaded.
 			// waiting for completion of download process...
-			<-otherDownloadingItem.completed
+			select {
+			case <-otherDownloadingItem.completed:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 		} else {
 			// not being downloaded; claim it for us.
 			r.downloading[mapKey] = downloadingItem
@@ -409,6 +1010,7 @@ func (r *Repository) processItem(ctx itemContext) error {
 		}
 	}
 	defer func() {
+		r.endPending(downloadingItem)
 		r.downloadingMu.Lock()
 		delete(r.downloading, mapKey)
 		r.downloadingMu.Unlock()
@@ -416,43 +1018,78 @@ func (r *Repository) processItem(ctx itemContext) error {
 	}()
 
 	// check if we already have it
-	loadedItem, err := r.db.loadItem(ctx.ac.account.key(), itemID)
+	loadedItem, err := r.db.loadItem(ic.ac.account.key(), itemID)
 	if err != nil {
 		return fmt.Errorf("loading item '%s' from database: %v", itemID, err)
 	}
 
+	if loadedItem == nil && r.AdoptExisting {
+		// we don't have it yet, but maybe it's already on disk.
+		adopted, err := r.adoptItem(ctx, ic)
+		if err != nil {
+			return err
+		}
+		if adopted {
+			ic.run.setActive()
+			if err := r.db.unskip(ic.ac.account, itemID); err != nil {
+				repoLog.Errorf("%v", err)
+			}
+			return nil
+		}
+	}
+
+	if loadedItem == nil {
+		size := r.newItemSize(ctx, ic)
+		if r.MaxSize > 0 && size > r.MaxSize {
+			return r.skipItem(ic, size, false)
+		}
+		if !r.budget.fits(size) {
+			return errOverBudget
+		}
+	}
+
 	if loadedItem == nil {
 		// we don't have it yet; download and save item.
 
 		it := item{
-			Item:        ctx.item,
-			fileName:    ctx.item.ItemName(),
-			filePath:    r.repoRelative(filepath.Join(ctx.ac.account.accountPath(), ctx.coll.dirName, ctx.item.ItemName())),
+			Item:        ic.item,
+			fileName:    ic.item.ItemName(),
 			isNew:       true,
-			collections: map[string]struct{}{ctx.coll.CollectionID(): {}},
+			collections: map[string]struct{}{ic.coll.id: {}},
 		}
 
-		Info.Printf("Getting new item %s: %s", it.ItemID(), it.ItemName())
-		err = r.downloadAndSaveItem(ctx.ac.client, downloadingItem, it, ctx.coll, ctx.ac.account, ctx.saveEverything)
+		repoLog.Infof("Getting new item %s: %s", it.ItemID(), it.ItemName())
+		err = r.downloadAndSaveItem(ctx, ic.ac.client, downloadingItem, it, ic.coll, ic.ac.account, ic.saveEverything)
 		if err != nil {
 			downloadingItem.pathMu.Lock()
 			downloadingItem.remove()
 			downloadingItem.pathMu.Unlock()
+			if err == errTooLarge {
+				return r.skipItem(ic, r.MaxSize+1, true)
+			}
+			if err == errOverBudget {
+				return err
+			}
 			return fmt.Errorf("downloading and saving new item: %v", err)
 		}
+		ic.run.setActive()
+		if err := r.db.unskip(ic.ac.account, itemID); err != nil {
+			repoLog.Errorf("%v", err)
+		}
 	} else {
 		// we already have this item in the DB
 
-		_, dbHas := loadedItem.Collections[ctx.coll.CollectionID()]
+		_, dbHas := loadedItem.Collections[ic.coll.id]
 		corrupted := false
+		statKnown := hasFileStat(loadedItem) // before checkLocalFile records it
 
-		if !dbHas || ctx.checkIntegrity {
+		if !dbHas || ic.checkIntegrity {
 			// if we don't have it on disk as a file or in the media list file for
 			// this collection already, add path to text file in this collection.
-			if folderHas, err := r.localCollectionHasItemOnDisk(ctx.ac.account, ctx.coll, loadedItem); err != nil {
+			if folderHas, err := r.localCollectionHasItemOnDisk(ic.ac.account, ic.coll, loadedItem); err != nil {
 				return fmt.Errorf("checking if local collection has item: %v", err)
 			} else if !folderHas {
-				if err := r.writeToMediaListFile(ctx.coll, loadedItem.FilePath); err != nil {
+				if err := r.writeToMediaListFile(ic.coll, loadedItem.FilePath); err != nil {
 					return fmt.Errorf("writing to media list file: %v", err)
 				}
 			}
@@ -460,48 +1097,118 @@ func (r *Repository) processItem(ctx itemContext) error {
 			if !dbHas {
 				// the fact that this item belongs to this collection is new information.
 				// save it to the collection in the DB.
-				if err := r.db.saveItemToCollection(ctx.ac.account, itemID, ctx.coll.CollectionID()); err != nil {
+				if err := r.db.saveItemToCollection(ic.ac.account, itemID, ic.coll.id); err != nil {
 					return fmt.Errorf("saving item to collection in DB: %v", err)
 				}
+				ic.run.setActive()
 			}
 		}
 
-		if ctx.checkIntegrity {
+		// see if the file was changed by something other than us,
+		// which is different from being changed remotely
+		var edited bool
+		if change, err := r.checkLocalFile(ic.ac.account, loadedItem); err != nil {
+			repoLog.Errorf("checking for local changes: %v", err)
+		} else if change != "" && !markedDamaged(loadedItem) {
+			edited = change != localDeleted
+			repoLog.Infof("File %s was changed outside photobak: %s", loadedItem.FilePath, change)
+			r.localChanges.record(loadedItem.FilePath, change)
+			r.progress(ProgressEvent{
+				Type:     LocalChangeFound,
+				Account:  ic.ac.account.String(),
+				ItemID:   itemID,
+				FilePath: loadedItem.FilePath,
+				Err:      fmt.Errorf("%s", change),
+			})
+		}
+
+		if err := r.updateDescription(ic.ac.account, ic.item, loadedItem); err != nil {
+			repoLog.Errorf("%v", err)
+		}
+
+		if r.RenameFiles && loadedItem.Name != ic.item.ItemName() && loadedItem.Protection != LocalOnly {
+			if err := r.renameItemFile(ic.ac.account, ic.coll, loadedItem, ic.item); err != nil {
+				repoLog.Errorf("renaming file of item %s: %v", itemID, err)
+			}
+		}
+
+		// it was listed, so it's not in the trash (anymore)
+		if err := r.setTrashed(ic.ac.account, loadedItem, false); err != nil {
+			repoLog.Errorf("%v", err)
+		}
+
+		deep := r.DeepIntegrity || ic.deepIntegrity || !statKnown
+		if ic.checkIntegrity && (deep || !r.fileStatUnchanged(loadedItem)) {
 			// compare checksums; if different, file was corrupted or deleted.
 
 			checksum, err := r.hash(loadedItem.FilePath)
 			if err != nil {
-				log.Printf("[ERROR] checking file integrity: %v", err)
+				repoLog.Errorf("checking file integrity: %v", err)
 			}
 
 			corrupted = err != nil || !bytes.Equal(checksum, loadedItem.Checksum)
 		}
+		if markedDamaged(loadedItem) {
+			corrupted = true // found by Check or an interrupted download
+		}
 
-		// also check etag to see if modified remotely after it was downloaded.
-		modifiedRemotely := loadedItem.ETag != ctx.item.ItemETag()
+		// also check to see if modified remotely after it was downloaded.
+		strategy := r.changeStrategy(ic.ac.account)
+		modifiedRemotely, adopt := changedRemotely(strategy, ic.item, loadedItem)
+		r.etags.record(modifiedRemotely)
+
+		if modifiedRemotely && !corrupted && r.VerifyChanges &&
+			!r.remoteChangeConfirmed(ctx, ic.ac.client, ic.item, loadedItem) {
+			repoLog.Infof("File %s appears changed remotely but has the same content; not re-downloading", loadedItem.FilePath)
+			adopt = true
+			modifiedRemotely = false
+		}
+		if adopt && !corrupted {
+			if err := r.acceptChange(ic.ac.account, strategy, ic.item, loadedItem); err != nil {
+				return err
+			}
+		}
+
+		if modifiedRemotely && loadedItem.Protection == LocalOnly {
+			repoLog.Infof("File %s modified remotely, but it is local-only; not re-downloading", loadedItem.FilePath)
+			modifiedRemotely = false
+		}
+
+		// don't lose local edits to a download unless asked to
+		if (corrupted || modifiedRemotely) && edited {
+			download, err := r.resolveConflict(loadedItem)
+			if err != nil {
+				return err
+			}
+			if !download {
+				corrupted, modifiedRemotely = false, false
+			}
+		}
 
 		if corrupted || modifiedRemotely {
 			if corrupted {
-				log.Printf("[ERROR] checksum mismatch, re-downloading: %s", loadedItem.FilePath)
+				repoLog.Errorf("checksum mismatch, re-downloading: %s", loadedItem.FilePath)
 			}
 			if modifiedRemotely {
-				Info.Printf("File %s modified remotely; re-downloading", loadedItem.FilePath)
+				repoLog.Infof("File %s modified remotely; re-downloading", loadedItem.FilePath)
 			}
 
 			it := item{
-				Item:        ctx.item,
+				Item:        ic.item,
 				fileName:    loadedItem.FileName,
 				filePath:    loadedItem.FilePath,
 				collections: loadedItem.Collections,
+				protection:  loadedItem.Protection,
 				// being very careful to NOT set isNew to true ;) - this is an existing item!
 			}
-			err := r.downloadAndSaveItem(ctx.ac.client, downloadingItem, it, ctx.coll, ctx.ac.account, ctx.saveEverything)
+			err := r.downloadAndSaveItem(ctx, ic.ac.client, downloadingItem, it, ic.coll, ic.ac.account, ic.saveEverything)
 			if err != nil {
 				downloadingItem.pathMu.Lock()
 				downloadingItem.remove()
 				downloadingItem.pathMu.Unlock()
 				return fmt.Errorf("re-downloading and saving existing item: %v", err)
 			}
+			ic.run.setActive()
 		}
 	}
 
@@ -509,27 +1216,32 @@ func (r *Repository) processItem(ctx itemContext) error {
 }
 
 // reserveUniqueFilename will look in dir (which must be repo-relative)
-// for targetName. If it is taken, it will change the filename by
-// adding a counter to the end of it, up to a certain limit, until it
-// finds an available filename. This is safe for concurrent use.
+// for targetName, made safe (see SafeFilename) and short enough for
+// the full path to fit on Windows (see fitName). If it is taken, it
+// will change the filename by adding a counter to the end of it, up
+// to a certain limit, until it finds an available filename. This is
+// safe for concurrent use.
 // It reserves the filename by creating it in dir, and returns the
 // name of the file (or directory, depending on isDir) created in dir.
 func (r *Repository) reserveUniqueFilename(dir, targetName string, isDir bool) (string, error) {
+	targetName = fitName(r.fullPath(dir), SafeFilename(targetName), isDir)
+
 	// ensure that only one reservation takes place for this name at a time
 	targetPath := filepath.Join(dir, targetName)
+	key := nameKey(targetPath)
 	r.itemNamesMu.Lock()
-	ch, taken := r.itemNames[targetPath]
+	ch, taken := r.itemNames[key]
 	if taken {
 		r.itemNamesMu.Unlock()
 		<-ch // wait for it to be available again
 		r.itemNamesMu.Lock()
 	}
 	ch = make(chan struct{})
-	r.itemNames[targetPath] = ch
+	r.itemNames[key] = ch
 	r.itemNamesMu.Unlock()
 	defer func() {
 		r.itemNamesMu.Lock()
-		delete(r.itemNames, targetPath)
+		delete(r.itemNames, key)
 		close(ch)
 		r.itemNamesMu.Unlock()
 	}()
@@ -576,7 +1288,7 @@ func (r *Repository) hash(fpath string) ([]byte, error) {
 	}
 	defer f.Close()
 
-	h := sha256.New()
+	h := r.newHash()
 	_, err = io.Copy(h, f)
 	if err != nil {
 		return nil, err
@@ -606,17 +1318,17 @@ func (w dishonestWriter) Write(p []byte) (int, error) {
 	return n, err
 }
 
-func (r *Repository) downloadAndSaveItem(client Client, downloadingItem *downloadingItem, it item, coll collection, pa providerAccount, saveEverything bool) error {
+func (r *Repository) downloadAndSaveItem(ctx context.Context, client Client, downloadingItem *downloadingItem, it item, coll collection, pa providerAccount, saveEverything bool) error {
 	saveToMediaListFile := func(pa providerAccount, coll collection, pointedPath, itemID string) error {
 		err := r.writeToMediaListFile(coll, pointedPath)
 		if err != nil {
 			return err
 		}
-		return r.db.saveItemToCollection(pa, itemID, coll.CollectionID())
+		return r.db.saveItemToCollection(pa, itemID, coll.id)
 	}
 
 	itemID := it.ItemID()
-	it.collections[coll.CollectionID()] = struct{}{}
+	it.collections[coll.id] = struct{}{}
 
 	err := os.MkdirAll(r.fullPath(coll.dirPath), 0700)
 	if err != nil {
@@ -625,35 +1337,75 @@ func (r *Repository) downloadAndSaveItem(client Client, downloadingItem *downloa
 
 	downloadingItem.pathMu.Lock()
 	if it.isNew {
-		itemFileName, err := r.reserveUniqueFilename(coll.dirPath, it.ItemName(), false)
+		targetPath, err := r.itemPath(pa, coll.dirName, it.ItemName(), itemID, itemTime(it.Item))
+		if err != nil {
+			downloadingItem.pathMu.Unlock()
+			return err
+		}
+		targetDir := filepath.Dir(targetPath)
+		err = os.MkdirAll(r.fullPath(targetDir), 0700)
+		if err != nil {
+			downloadingItem.pathMu.Unlock()
+			return fmt.Errorf("creating folder for item: %v", err)
+		}
+		itemFileName, err := r.reserveUniqueFilename(targetDir, filepath.Base(targetPath), false)
 		if err != nil {
 			downloadingItem.pathMu.Unlock()
 			return fmt.Errorf("reserving unique filename: %v", err)
 		}
 		it.fileName = itemFileName
-		it.filePath = r.repoRelative(filepath.Join(coll.dirPath, itemFileName))
+		it.filePath = r.repoRelative(filepath.Join(targetDir, itemFileName))
+		downloadingItem.reserved = r.fullPath(it.filePath)
 	}
-	downloadingItem.path = r.fullPath(it.filePath)
+	// download next to the file, so that it isn't replaced (and a
+	// new item's file doesn't look complete) until it is committed
+	downloadingItem.path = r.fullPath(it.filePath) + partialExt
 	downloadingItem.pathMu.Unlock()
 
-	// try a few times in case of network trouble
+	// journal the download before writing the file, so
+	// that it can be cleaned up if we don't get to it
+	err = r.db.addPending(it.filePath, pendingDownload{
+		Account: pa.String(),
+		ItemID:  itemID,
+		New:     it.isNew,
+		Started: time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("journaling download: %v", err)
+	}
+	downloadingItem.journaled = it.filePath
+
+	// try again according to the retry policy in case of network trouble
 	var h hash.Hash
 	var x *exif.Exif
-	var downloadErr error
-	for i := 0; i < 3; i++ {
+	var tooLarge, overBudget bool
+	downloadErr := Retries.Do(ctx, func(attempt int) error {
 		downloadingItem.pathMu.Lock()
 		outFile, err := os.Create(downloadingItem.path)
 		downloadingItem.pathMu.Unlock()
 
 		if err != nil {
-			return fmt.Errorf("opening output file %s: %v", it.filePath, err)
+			return Permanent(fmt.Errorf("opening output file %s: %v", it.filePath, err))
 		}
 
-		h = sha256.New()
+		h = r.newHash()
+		check := newDownloadCheck(client, it.Item)
+		var limit *sizeLimit
+		budget := new(budgetWriter)
+		if it.isNew {
+			limit = &sizeLimit{max: r.MaxSize}
+			budget.b = r.budget
+		} else {
+			limit = &sizeLimit{} // it was already allowed
+		}
 		pr, pw := io.Pipe()
-		mw := io.MultiWriter(outFile, h, dishonestWriter{pw})
+		progEv := ProgressEvent{Account: pa.String(), ItemID: itemID, FilePath: it.filePath}
+		mw := io.MultiWriter(limit, budget, outFile, h, check, dishonestWriter{pw}, r.progressWriterFor(progEv))
 
+		exifDone := make(chan struct{})
 		go func() {
+			defer close(exifDone)
+
 			// an item may not have EXIF data, and that is not
 			// an error, it just means we don't have any meta
 			// data from the file. if it does have EXIF data
@@ -675,29 +1427,84 @@ func (r *Repository) downloadAndSaveItem(client Client, downloadingItem *downloa
 			pr.Close()
 		}()
 
-		Info.Printf("[attempt %d] Downloading %s into %s", i+1, it.ItemID(), it.filePath)
-		downloadErr = client.DownloadItemInto(it.Item, mw)
+		repoLog.Infof("[attempt %d] Downloading %s into %s", attempt, it.ItemID(), it.filePath)
+		progEv.Type = DownloadStarted
+		r.progress(progEv)
+		err = client.DownloadItemInto(ctx, it.Item, mw)
+		pw.Close()
+		<-exifDone
 		outFile.Close()
-		if downloadErr == nil {
-			break
+		if limit.exceeded {
+			tooLarge = true
+			budget.giveBack()
+			return Permanent(errTooLarge)
+		}
+		if budget.exceeded {
+			overBudget = true
+			r.budget.stopped(budget.n)
+			return Permanent(errOverBudget)
+		}
+		if err == nil {
+			err = check.verify()
+		}
+		if err == nil {
+			err = checkListedSize(it.Item, limit.n)
 		}
-		log.Printf("[ERROR] downloading %s, attempt %d: %v; retrying", it.filePath, i+1, downloadErr)
+		if err != nil {
+			budget.giveBack() // the file is written again, or removed
+		}
+		if err != nil && ctx.Err() == nil {
+			repoLog.Errorf("downloading %s, attempt %d: %v", it.filePath, attempt, err)
+		}
+		return err
+	})
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if tooLarge {
+		return errTooLarge
+	}
+	if overBudget {
+		return errOverBudget
 	}
 	if downloadErr != nil {
-		return fmt.Errorf("repeatedly failed downloading %s: %v", it.filePath, downloadErr)
+		return fmt.Errorf("failed downloading %s: %v", it.filePath, downloadErr)
 	}
 
 	// I don't care about the error here. Not having EXIF data is OK.
 	setting, _ := r.getSettingFromEXIF(x)
 
+	// videos have no EXIF data, but they may have metadata of
+	// their own; likewise, not having it (or any video) is OK
+	var vm *videoMeta
+	if x == nil {
+		downloadingItem.pathMu.Lock()
+		vm, _ = readVideoMeta(downloadingItem.path)
+		downloadingItem.pathMu.Unlock()
+	}
+
 	meta := itemMeta{Setting: setting, Caption: it.ItemCaption()}
+	describe(&meta, it.Item, x)
+	describeVideo(&meta, vm)
 	if saveEverything {
 		// NOTE: If the item caption is already stored as
 		// part of the Item, this will duplicate it in
 		// the database. Oh well. Hopefully it's small.
-		meta.API = it.Item
+		err := r.setItemAPI(&meta, it.Item)
+		if err != nil {
+			return fmt.Errorf("storing API data for item: %v", err)
+		}
 	}
 
+	downloadingItem.pathMu.Lock()
+	phash := imageHash(downloadingItem.path)
+	format := fileFormat(downloadingItem.path)
+	downloadingItem.pathMu.Unlock()
+
+	remoteSize := listedSize(it.Item)
+	if remoteSize < 0 {
+		remoteSize = 0
+	}
 	dbi := &dbItem{
 		ID:          itemID,
 		Name:        it.ItemName(),
@@ -707,35 +1514,17 @@ func (r *Repository) downloadAndSaveItem(client Client, downloadingItem *downloa
 		Saved:       time.Now(),
 		Collections: it.collections,
 		Checksum:    h.Sum(nil),
-		ETag:        it.ItemETag(),
+		Format:      format,
+		PHash:       phash,
+		RemoteSize:  remoteSize,
+		Protection:  it.protection,
 	}
+	setChangeKey(r.changeStrategy(pa), it.Item, dbi)
 
 	// de-duplicate at the content level: if we already have
 	// an item with this checksum in the repository, point
-	// to it instead of saving it again. the operations on
-	// the database are not within the same transaction,
-	// so we use a map with channels to synchronize.
-	hashStr := hex.EncodeToString(dbi.Checksum)
-	hashChan := make(chan struct{})
-	for {
-		r.itemChecksumsMu.Lock()
-		if ch, taken := r.itemChecksums[hashStr]; taken {
-			// another goroutine is processing the same content
-			// (different item) right now; wait until it is done.
-			r.itemChecksumsMu.Unlock()
-			<-ch
-		} else {
-			r.itemChecksums[hashStr] = hashChan
-			r.itemChecksumsMu.Unlock()
-			break
-		}
-	}
-	defer func() {
-		r.itemChecksumsMu.Lock()
-		delete(r.itemChecksums, hashStr)
-		r.itemChecksumsMu.Unlock()
-		close(hashChan)
-	}()
+	// to it instead of saving it again.
+	defer r.lockChecksum(dbi.Checksum)()
 
 	// if this item is new, see if its content is unique
 	if it.isNew {
@@ -744,7 +1533,7 @@ func (r *Repository) downloadAndSaveItem(client Client, downloadingItem *downloa
 			return fmt.Errorf("de-duplicating item '%s': %v", it.fileName, err)
 		}
 		if len(sameItems) > 0 {
-			Info.Printf("The content of item %s already exists in repository; de-duplicating", it.ItemID())
+			repoLog.Infof("The content of item %s already exists in repository; de-duplicating", it.ItemID())
 
 			// this content is not unique; it exists elsewhere in the repo.
 			// save this item to this collection, but we'll delete the
@@ -769,22 +1558,83 @@ func (r *Repository) downloadAndSaveItem(client Client, downloadingItem *downloa
 			if err != nil {
 				return err
 			}
+		} else if !inDir(dbi.FilePath, coll.dirPath) {
+			// the path template put the file outside of the
+			// collection's folder, so refer to it from there
+			err = r.writeToMediaListFile(coll, dbi.FilePath)
+			if err != nil {
+				return fmt.Errorf("writing to media list file: %v", err)
+			}
 		}
 	}
 
 	downloadingItem.pathMu.Lock()
+	defer downloadingItem.pathMu.Unlock()
+
+	if r.FileTimes && downloadingItem.path != "" {
+		err := setFileTimes(downloadingItem.path, takenTime(dbi, it.Item))
+		if err != nil {
+			repoLog.Errorf("setting time of %s: %v", it.filePath, err)
+		}
+	}
+
+	// the download keeps its size and modification time
+	// when it is put in place, so record them now
+	if info, err := os.Stat(downloadingItem.path); downloadingItem.path != "" && err == nil {
+		dbi.Size, dbi.ModTime = info.Size(), info.ModTime()
+	} else {
+		r.recordFileStat(dbi)
+	}
 
 	// we've got everything on disk that we need,
 	// now commit this item to the database!
 	if err := r.db.saveItem(pa.key(), itemID, dbi); err != nil {
 		downloadingItem.remove() // no record of it in the database, so don't keep it on disk...
-		downloadingItem.pathMu.Unlock()
 		return fmt.Errorf("saving item '%s' to database: %v", it.fileName, err)
-	} else {
-		downloadingItem.path = ""
-		downloadingItem.pathMu.Unlock()
-		Info.Printf("Committed item '%s' to disk and database", it.fileName)
-		return nil
+	}
+
+	// and then put the file in place
+	if downloadingItem.path != "" {
+		err := r.commitPartial(it.filePath)
+		if err != nil {
+			// the item is saved, so keep the download and its entry
+			// in the journal; recoverDownloads will try again
+			downloadingItem.path, downloadingItem.reserved, downloadingItem.journaled = "", "", ""
+			return fmt.Errorf("putting downloaded file %s in place: %v", it.filePath, err)
+		}
+	}
+	downloadingItem.path, downloadingItem.reserved = "", ""
+	repoLog.Infof("Committed item '%s' to disk and database", it.fileName)
+	r.progress(ProgressEvent{Type: ItemCommitted, Account: pa.String(), ItemID: itemID, FilePath: dbi.FilePath})
+	return nil
+}
+
+// lockChecksum waits until no other goroutine is processing
+// content with the given checksum, then claims it; the returned
+// function releases it. The operations on the database that
+// de-duplicate content are not within the same transaction,
+// so this map with channels is used to synchronize them.
+func (r *Repository) lockChecksum(checksum []byte) func() {
+	hashStr := hex.EncodeToString(checksum)
+	hashChan := make(chan struct{})
+	for {
+		r.itemChecksumsMu.Lock()
+		if ch, taken := r.itemChecksums[hashStr]; taken {
+			// another goroutine is processing the same content
+			// (different item) right now; wait until it is done.
+			r.itemChecksumsMu.Unlock()
+			<-ch
+		} else {
+			r.itemChecksums[hashStr] = hashChan
+			r.itemChecksumsMu.Unlock()
+			break
+		}
+	}
+	return func() {
+		r.itemChecksumsMu.Lock()
+		delete(r.itemChecksums, hashStr)
+		r.itemChecksumsMu.Unlock()
+		close(hashChan)
 	}
 }
 
@@ -870,10 +1720,13 @@ func (r *Repository) getSettingFromEXIF(x *exif.Exif) (*setting, error) {
 
 // localCollectionHasItemOnDisk returns true if the given collection
 // has the item in it, either as an actual file or a reference
-// in the media list file.
+// in the media list file. An item whose file belongs in the
+// collection's folder is always in it, even if the file is
+// missing: the integrity check downloads it again, and a
+// reference to it would only refer to itself.
 func (r *Repository) localCollectionHasItemOnDisk(pa providerAccount, coll collection, localItem *dbItem) (bool, error) {
 	// check for item on disk first
-	if r.fileExists(filepath.Join(coll.dirPath, localItem.FileName)) {
+	if inDir(localItem.FilePath, coll.dirPath) {
 		return true, nil
 	}
 
@@ -0,0 +1,163 @@
+package photobak
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Restore materializes every collection of every account in the
+// repository into a plain folder structure at dest, so that the
+// backup can be used without photobak or its database. Each
+// collection gets its own folder containing real copies of all
+// its items, including those that are only referenced by the
+// collection's media list file in the repository.
+//
+// Restore does not modify the repository. Each file is copied
+// under a temporary name and renamed into place once it is
+// complete, and files that already exist at dest are left alone,
+// so an interrupted restore can be run again. Collections whose
+// items can't all be copied don't stop the others from being
+// restored, but an error is returned at the end. It returns the
+// number of files copied.
+func (r *Repository) Restore(dest string) (int, error) {
+	absDest, err := filepath.Abs(dest)
+	if err != nil {
+		return 0, err
+	}
+	absRepo, err := filepath.Abs(r.path)
+	if err != nil {
+		return 0, err
+	}
+	if absDest == absRepo || strings.HasPrefix(absDest, absRepo+string(filepath.Separator)) {
+		return 0, fmt.Errorf("destination must not be inside the repository")
+	}
+
+	accounts, err := r.db.storedAccounts()
+	if err != nil {
+		return 0, fmt.Errorf("listing accounts: %v", err)
+	}
+
+	var copied, failed int
+	for _, pa := range accounts {
+		collIDs, err := r.db.collectionIDs(pa)
+		if err != nil {
+			return copied, err
+		}
+		for _, collID := range collIDs {
+			dbc, err := r.db.loadCollection(pa.key(), collID)
+			if err != nil {
+				return copied, err
+			}
+			n, err := r.restoreCollection(pa, dbc, filepath.Join(dest, dbc.DirPath))
+			copied += n
+			if err != nil {
+				repoLog.Errorf("restoring collection %s: %v", dbc.Name, err)
+				failed++
+			}
+		}
+	}
+
+	if failed > 0 {
+		return copied, fmt.Errorf("%d collections were not restored completely; run the restore again to retry", failed)
+	}
+	return copied, nil
+}
+
+// restoreCollection copies all the items in dbc into destDir.
+func (r *Repository) restoreCollection(pa providerAccount, dbc *dbCollection, destDir string) (int, error) {
+	repoLog.Infof("Restoring collection '%s' into %s", dbc.Name, destDir)
+
+	err := os.MkdirAll(destDir, 0700)
+	if err != nil {
+		return 0, err
+	}
+
+	// names are given so that name collisions resolve
+	// the same way each time the restore is run
+	items, names, err := r.collectionFileNames(pa, dbc)
+	if err != nil {
+		return 0, err
+	}
+
+	var copied, failed int
+	for _, dbi := range items {
+		destPath := filepath.Join(destDir, names[dbi.ID])
+		if _, err := os.Stat(destPath); err == nil {
+			continue // already restored
+		}
+
+		// a file that was being copied when the restore
+		// was stopped is left under its temporary name
+		tmpPath := destPath + partialExt
+		os.Remove(tmpPath)
+		err = copyFile(r.fullPath(dbi.FilePath), tmpPath)
+		if err == nil {
+			err = os.Rename(tmpPath, destPath)
+		}
+		if err != nil {
+			os.Remove(tmpPath)
+			repoLog.Errorf("restoring %s: %v", dbi.FilePath, err)
+			failed++
+			continue
+		}
+		copied++
+	}
+
+	if failed > 0 {
+		return copied, fmt.Errorf("%d items could not be copied", failed)
+	}
+	return copied, nil
+}
+
+// uniqueName returns name, or if it is already in taken,
+// name with a counter added before its extension. The
+// returned name is added to taken.
+func uniqueName(taken map[string]struct{}, name string) string {
+	candidate := name
+	for i := 2; ; i++ {
+		if _, ok := taken[strings.ToLower(candidate)]; !ok {
+			break
+		}
+		ext := filepath.Ext(name)
+		candidate = fmt.Sprintf("%s-%03d%s", strings.TrimSuffix(name, ext), i, ext)
+	}
+	taken[strings.ToLower(candidate)] = struct{}{}
+	return candidate
+}
+
+// copyFile copies the file at src to a new file at dst,
+// preserving its modification time, and syncs it to disk.
+// If copying fails, the partial file at dst is removed.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
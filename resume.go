@@ -0,0 +1,144 @@
+package photobak
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// collectionRun tracks whether a collection was processed
+// completely during a run of Store, so that collections that
+// were cut short (for example, because the run was stopped at
+// its maximum duration) can be resumed first in the next run.
+type collectionRun struct {
+	id          string // the ID the collection is stored under, once it is known
+	listed      int32  // set when all the items have been listed
+	interrupted int32  // set when an item was not processed because the run stopped
+	active      int32  // set when an item was added to the collection or changed
+
+	// items are the items that were listed, which
+	// are complete once all have been listed
+	items []listedItem
+
+	// prelisted are the items listed by the preflight
+	// check, if any, so that they aren't listed again
+	prelisted []Item
+
+	// which of the items were processed,
+	// for the checkpoint if the run stops
+	itemTracker
+}
+
+func (cr *collectionRun) setListed() { atomic.StoreInt32(&cr.listed, 1) }
+func (cr *collectionRun) interrupt() { atomic.StoreInt32(&cr.interrupted, 1) }
+func (cr *collectionRun) setActive() {
+	if cr != nil { // repairs process items outside of a run
+		atomic.StoreInt32(&cr.active, 1)
+	}
+}
+func (cr *collectionRun) wasActive() bool {
+	return cr != nil && atomic.LoadInt32(&cr.active) == 1
+}
+func (cr *collectionRun) wasListed() bool {
+	return cr != nil && atomic.LoadInt32(&cr.listed) == 1
+}
+func (cr *collectionRun) finished() bool {
+	return cr != nil && atomic.LoadInt32(&cr.listed) == 1 && atomic.LoadInt32(&cr.interrupted) == 0
+}
+
+// accountRun is the state of one account during a run of Store.
+type accountRun struct {
+	ac          accountClient
+	collections []Collection
+	runs        map[string]*collectionRun
+	fullPass    bool               // whether all collections were listed, even dormant ones
+	checkpoint  *listingCheckpoint // how far the last run got, if it was interrupted
+}
+
+// staleFirst sorts colls so that the collections of pa that were
+// never completed (see dbCollection.Completed) come first, then
+// the others that were not finished in the previous run, those
+// completed longest ago first; otherwise, the order of the
+// collections is kept. That way, runs that keep being cut short
+// still get through every collection.
+func (r *Repository) staleFirst(pa providerAccount, colls []Collection) error {
+	unfinished, err := r.db.loadUnfinished(pa)
+	if err != nil {
+		return err
+	}
+	stored, err := r.storedCollections(pa, colls)
+	if err != nil {
+		return err
+	}
+	completed := func(coll Collection) time.Time {
+		if dbc := stored[coll.CollectionID()]; dbc != nil {
+			return dbc.Completed
+		}
+		return time.Time{}
+	}
+	// 0 for never completed, 1 for unfinished, 2 for the rest
+	rank := func(coll Collection) int {
+		if completed(coll).IsZero() {
+			return 0
+		}
+		if _, ok := unfinished[coll.CollectionID()]; ok {
+			return 1
+		}
+		return 2
+	}
+	var stale int
+	for _, coll := range colls {
+		if rank(coll) < 2 {
+			stale++
+		}
+	}
+	if stale == 0 {
+		return nil
+	}
+	sort.SliceStable(colls, func(i, j int) bool {
+		ri, rj := rank(colls[i]), rank(colls[j])
+		if ri != rj {
+			return ri < rj
+		}
+		return ri == 1 && completed(colls[i]).Before(completed(colls[j]))
+	})
+	repoLog.Infof("%s: starting with %d unfinished or never completed collections", pa, stale)
+	return nil
+}
+
+// saveCompleted records that the collections of ar
+// that were finished during this run were completed.
+func (r *Repository) saveCompleted(ar accountRun) error {
+	now := time.Now()
+	for _, coll := range ar.collections {
+		run := ar.runs[coll.CollectionID()]
+		if !run.finished() || run.id == "" {
+			continue
+		}
+		dbc, err := r.db.loadCollection(ar.ac.account.key(), run.id)
+		if err != nil {
+			return err
+		}
+		if dbc == nil {
+			continue
+		}
+		dbc.Completed = now
+		err = r.db.saveCollection(ar.ac.account.key(), dbc.ID, dbc)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveUnfinished records which of ar's collections were not
+// finished during this run.
+func (r *Repository) saveUnfinished(ar accountRun) error {
+	var ids []string
+	for _, coll := range ar.collections {
+		if !ar.runs[coll.CollectionID()].finished() {
+			ids = append(ids, coll.CollectionID())
+		}
+	}
+	return r.db.saveUnfinished(ar.ac.account, ids)
+}
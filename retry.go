@@ -0,0 +1,255 @@
+package photobak
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryPolicy describes how operations that fail, like
+// downloads and listings, are retried.
+type RetryPolicy struct {
+	// Attempts is the total number of times
+	// to try; less than 1 means 1.
+	Attempts int
+
+	// Backoff is how long to wait before each retry:
+	// Backoff[0] before the second attempt, and so on.
+	// If there are more retries than durations, the
+	// last one is used again, multiplied by Multiplier
+	// for each retry after it; if it is empty, retries
+	// happen immediately.
+	Backoff []time.Duration
+
+	// Multiplier is how much longer to wait before each
+	// retry after the durations in Backoff run out, like
+	// 2 to double the wait each time. 1 or less means to
+	// keep waiting as long as the last one.
+	Multiplier float64
+
+	// MaxDelay is the longest to wait before a retry;
+	// 0 means no limit.
+	MaxDelay time.Duration
+
+	// Jitter is the fraction, from 0 to 1, by which each wait
+	// may be shortened at random, so that many requests that
+	// failed at once, like during an outage, are not all tried
+	// again at once.
+	Jitter float64
+
+	// RetryStatus lists the HTTP status codes of errors
+	// that are worth retrying (see Retryable). If it is
+	// empty, server errors (5xx), 408, and 429 are.
+	RetryStatus []int
+}
+
+// Retries is the retry policy used by the repository for
+// downloads, and by providers for their API requests.
+var Retries = RetryPolicy{
+	Attempts:   3,
+	Backoff:    []time.Duration{2 * time.Second, 10 * time.Second},
+	Multiplier: 2,
+	MaxDelay:   5 * time.Minute,
+	Jitter:     0.2,
+}
+
+// Do calls fn until it succeeds, it returns an error that is not
+// worth retrying (see Retryable), the attempts run out, or ctx is
+// canceled. It returns the last error from fn, or the context's
+// error if it was canceled while waiting to retry. If the error
+// says how long to wait before trying again, like an HTTPError
+// from a response with a Retry-After header, Do waits at least
+// that long, or gives up if that is longer than MaxDelay.
+func (p RetryPolicy) Do(ctx context.Context, fn func(attempt int) error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn(attempt)
+		if err == nil || ctx.Err() != nil || attempt >= p.Attempts || !p.Retryable(err) {
+			return err
+		}
+		wait := p.wait(attempt)
+		if after := retryAfter(err); after > wait {
+			if p.MaxDelay > 0 && after > p.MaxDelay {
+				return err
+			}
+			wait = after
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// wait returns how long to wait after the given attempt failed.
+func (p RetryPolicy) wait(attempt int) time.Duration {
+	if len(p.Backoff) == 0 {
+		return 0
+	}
+	var d time.Duration
+	if attempt <= len(p.Backoff) {
+		d = p.Backoff[attempt-1]
+	} else {
+		d = p.Backoff[len(p.Backoff)-1]
+		for i := len(p.Backoff); i < attempt && p.Multiplier > 1; i++ {
+			next := float64(d) * p.Multiplier
+			if p.MaxDelay > 0 && next >= float64(p.MaxDelay) {
+				d = p.MaxDelay
+				break
+			}
+			if next >= math.MaxInt64 {
+				d = math.MaxInt64
+				break
+			}
+			d = time.Duration(next)
+		}
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		d -= time.Duration(rand.Float64() * math.Min(p.Jitter, 1) * float64(d))
+	}
+	return d
+}
+
+// HTTPError is an error response from an HTTP server.
+// Providers should return it (or another error with an
+// HTTPStatusCode method) when a request fails with an
+// error status, so that Retryable can tell whether the
+// request is worth trying again.
+type HTTPError struct {
+	Op         string // what was being done, like "HTTP GET <url>"
+	StatusCode int
+	Status     string
+	RetryAfter time.Duration // from the Retry-After header, if any
+}
+
+// NewHTTPError returns an HTTPError for the error
+// response resp to the request described by op.
+func NewHTTPError(op string, resp *http.Response) HTTPError {
+	return HTTPError{
+		Op:         op,
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		RetryAfter: ParseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+func (e HTTPError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Op, e.Status)
+}
+
+// HTTPStatusCode returns the HTTP status code.
+func (e HTTPError) HTTPStatusCode() int {
+	return e.StatusCode
+}
+
+// HTTPRetryAfter returns how long the server
+// asked to wait before trying again, if it did.
+func (e HTTPError) HTTPRetryAfter() time.Duration {
+	return e.RetryAfter
+}
+
+// ParseRetryAfter parses the value of a Retry-After header, which
+// is either a number of seconds or an HTTP date, and returns how
+// long from now that is. It returns 0 if the value is empty or
+// malformed, or if the date has already passed.
+func ParseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if secs <= 0 {
+			return 0
+		}
+		if secs > int64(math.MaxInt64/time.Second) {
+			return math.MaxInt64
+		}
+		return time.Duration(secs) * time.Second
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0
+	}
+	if d := time.Until(date); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// retryAfter returns how long err says to wait before
+// trying again, or 0 if it doesn't say.
+func retryAfter(err error) time.Duration {
+	var ra interface{ HTTPRetryAfter() time.Duration }
+	if errors.As(err, &ra) {
+		return ra.HTTPRetryAfter()
+	}
+	return 0
+}
+
+// permanentError is an error that should not be retried.
+type permanentError struct {
+	error
+}
+
+// Permanent wraps err so that it is not retried.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err}
+}
+
+// Retryable returns true if the operation that returned err
+// might succeed if it is tried again, according to Retries.
+// Client errors (HTTP 4xx, except for timeouts and rate
+// limiting), permanent errors, and canceled contexts are not
+// retryable; server errors, network errors, and any other
+// errors are.
+func Retryable(err error) bool {
+	return Retries.Retryable(err)
+}
+
+// Retryable returns true if the operation that returned err might
+// succeed if it is tried again. Errors with an HTTP status code
+// are retryable if p.RetryStatus has it (or, if it is empty, if it
+// is a server error, a timeout, or rate limiting); permanent
+// errors and canceled contexts are not; and any other errors,
+// like network errors, are.
+func (p RetryPolicy) Retryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var perm permanentError
+	if errors.As(err, &perm) {
+		return false
+	}
+	var sc interface{ HTTPStatusCode() int }
+	if errors.As(err, &sc) {
+		code := sc.HTTPStatusCode()
+		if len(p.RetryStatus) == 0 {
+			return code >= 500 || code == 408 || code == 429
+		}
+		for _, c := range p.RetryStatus {
+			if c == code {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,179 @@
+package photobak
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SearchQuery selects items in the index (see Search).
+// Items must match all of the criteria that are set.
+type SearchQuery struct {
+	// Accounts, if set, limits the search to the items
+	// of these accounts, given as "provider:username".
+	Accounts []string
+
+	// Albums are patterns (as in path.Match, but not case-
+	// sensitive) of collection names; if set, only items
+	// in a matching collection are selected.
+	Albums []string
+
+	// Name is a pattern (as in path.Match, but not case-
+	// sensitive) that the item's name must match.
+	Name string
+
+	// From and To, if not zero, are the earliest and latest
+	// times an item may have been taken. Items for which
+	// this is not known are not selected.
+	From, To time.Time
+
+	// HasGPS selects only items whose location is known.
+	HasGPS bool
+
+	// Caption is text that the item's caption must
+	// contain, not case-sensitive.
+	Caption string
+}
+
+// SearchResult is an item found by Search.
+type SearchResult struct {
+	Account   string     `json:"account"`
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	FilePath  string     `json:"file_path"` // relative to the repository
+	Albums    []string   `json:"albums"`
+	Caption   string     `json:"caption,omitempty"`
+	Taken     *time.Time `json:"taken,omitempty"`
+	Latitude  float64    `json:"latitude,omitempty"`
+	Longitude float64    `json:"longitude,omitempty"`
+	Size      int64      `json:"size"`
+	Checksum  string     `json:"checksum"`
+}
+
+// Search returns the items in the index that match q, sorted by
+// file path and then account. Only the database is read, so it
+// works even if the files are somewhere else, like on a disk
+// that isn't attached.
+func (r *Repository) Search(q SearchQuery) ([]SearchResult, error) {
+	for _, pattern := range append([]string{q.Name}, q.Albums...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad pattern '%s': %v", pattern, err)
+		}
+	}
+
+	accounts, err := r.db.storedAccounts()
+	if err != nil {
+		return nil, fmt.Errorf("listing accounts: %v", err)
+	}
+
+	var results []SearchResult
+	for _, pa := range accounts {
+		if !accountSelected(q.Accounts, pa) {
+			continue
+		}
+		collIDs, err := r.db.collectionIDs(pa)
+		if err != nil {
+			return nil, err
+		}
+		albums := make(map[string]string) // collection name by ID
+		for _, collID := range collIDs {
+			dbc, err := r.db.loadCollection(pa.key(), collID)
+			if err != nil {
+				return nil, err
+			}
+			if dbc != nil {
+				albums[dbc.ID] = dbc.Name
+			}
+		}
+
+		itemIDs, err := r.db.itemIDs(pa)
+		if err != nil {
+			return nil, err
+		}
+		for _, itemID := range itemIDs {
+			dbi, err := r.db.loadItem(pa.key(), itemID)
+			if err != nil {
+				return nil, err
+			}
+			if dbi == nil {
+				continue
+			}
+			var itemAlbums []string
+			for collID := range dbi.Collections {
+				if name, ok := albums[collID]; ok {
+					itemAlbums = append(itemAlbums, name)
+				}
+			}
+			sort.Strings(itemAlbums)
+			if !q.matches(dbi, itemAlbums) {
+				continue
+			}
+			result := SearchResult{
+				Account:  pa.String(),
+				ID:       dbi.ID,
+				Name:     dbi.Name,
+				FilePath: dbi.FilePath,
+				Albums:   itemAlbums,
+				Caption:  dbi.Meta.Caption,
+				Size:     dbi.Size,
+				Checksum: fmt.Sprintf("%x", dbi.Checksum),
+			}
+			if taken := itemTaken(dbi); !taken.IsZero() {
+				result.Taken = &taken
+			}
+			if s := dbi.Meta.Setting; s != nil {
+				result.Latitude, result.Longitude = s.Latitude, s.Longitude
+			}
+			results = append(results, result)
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].FilePath != results[j].FilePath {
+			return results[i].FilePath < results[j].FilePath
+		}
+		return results[i].Account < results[j].Account
+	})
+	return results, nil
+}
+
+// matches returns true if dbi, which is in
+// the collections named albums, matches q.
+func (q SearchQuery) matches(dbi *dbItem, albums []string) bool {
+	if len(q.Albums) > 0 {
+		var inAlbum bool
+		for _, name := range albums {
+			if albumSelected(q.Albums, name) {
+				inAlbum = true
+				break
+			}
+		}
+		if !inAlbum {
+			return false
+		}
+	}
+	if q.Name != "" {
+		if ok, _ := path.Match(strings.ToLower(q.Name), strings.ToLower(dbi.Name)); !ok {
+			return false
+		}
+	}
+	if !q.From.IsZero() || !q.To.IsZero() {
+		taken := itemTaken(dbi)
+		if taken.IsZero() ||
+			(!q.From.IsZero() && taken.Before(q.From)) ||
+			(!q.To.IsZero() && taken.After(q.To)) {
+			return false
+		}
+	}
+	if q.HasGPS {
+		if s := dbi.Meta.Setting; s == nil || (s.Latitude == 0 && s.Longitude == 0) {
+			return false
+		}
+	}
+	if q.Caption != "" && !strings.Contains(strings.ToLower(dbi.Meta.Caption), strings.ToLower(q.Caption)) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,178 @@
+package photobak
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// SkippedItem is an item that was not downloaded because
+// it is larger than MaxSize. It is downloaded in the first
+// run that allows it, and then it is no longer skipped.
+type SkippedItem struct {
+	Account    string    // the account, as provider:username
+	ItemID     string    // the item's ID
+	Name       string    // the item's file name
+	Collection string    // the name of the collection it was listed in
+	Size       int64     // its size in bytes
+	AtLeast    bool      // if Size is only how much was downloaded before it was stopped
+	Skipped    time.Time // when it was last skipped
+}
+
+// errTooLarge is returned by downloadAndSaveItem when
+// the download is stopped because it exceeds MaxSize.
+var errTooLarge = errors.New("item is larger than the maximum size")
+
+// sizeLimit is a writer that fails once more than max bytes
+// are written to it. If max is not positive, it has no limit.
+type sizeLimit struct {
+	max, n   int64
+	exceeded bool
+}
+
+// Write counts p and returns errTooLarge if it
+// takes the total over the limit.
+func (sl *sizeLimit) Write(p []byte) (int, error) {
+	sl.n += int64(len(p))
+	if sl.max > 0 && sl.n > sl.max {
+		sl.exceeded = true
+		return 0, errTooLarge
+	}
+	return len(p), nil
+}
+
+// newItemSize returns the size of the new item of ic, as far
+// as can be told before downloading it, or -1 if it can't be
+// told: only items that implement ListedSizer, or clients that
+// implement SizeChecker, can tell. It only asks the client if
+// MaxSize or MaxDisk need to know.
+func (r *Repository) newItemSize(ctx context.Context, ic itemContext) int64 {
+	if r.MaxSize <= 0 && r.budget == nil {
+		return -1
+	}
+	if size := listedSize(ic.item); size >= 0 {
+		return size
+	}
+	sc, ok := ic.ac.client.(SizeChecker)
+	if !ok {
+		return -1
+	}
+	size, err := sc.ItemSize(ctx, ic.item)
+	if err != nil {
+		repoLog.Errorf("getting size of item %s: %v", ic.item.ItemID(), err)
+		return -1
+	}
+	return size
+}
+
+// skipItem records that the item of ic was skipped
+// because it is size bytes (or, if atLeast, more).
+func (r *Repository) skipItem(ic itemContext, size int64, atLeast bool) error {
+	repoLog.Infof("Skipping item %s: %s (%d bytes is more than the maximum size)", ic.item.ItemID(), ic.item.ItemName(), size)
+	return r.db.saveSkipped(ic.ac.account, SkippedItem{
+		Account:    ic.ac.account.String(),
+		ItemID:     ic.item.ItemID(),
+		Name:       ic.item.ItemName(),
+		Collection: ic.coll.CollectionName(),
+		Size:       size,
+		AtLeast:    atLeast,
+		Skipped:    time.Now(),
+	})
+}
+
+// SkippedItems returns the items that were skipped because they
+// are larger than MaxSize and have not been downloaded since,
+// sorted by account and then by size, largest first.
+func (r *Repository) SkippedItems() ([]SkippedItem, error) {
+	accounts, err := r.db.storedAccounts()
+	if err != nil {
+		return nil, fmt.Errorf("listing accounts: %v", err)
+	}
+	var all []SkippedItem
+	for _, pa := range accounts {
+		skipped, err := r.db.loadSkipped(pa)
+		if err != nil {
+			return nil, fmt.Errorf("loading skipped items of %s: %v", pa, err)
+		}
+		for _, si := range skipped {
+			all = append(all, si)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Account != all[j].Account {
+			return all[i].Account < all[j].Account
+		}
+		return all[i].Size > all[j].Size
+	})
+	return all, nil
+}
+
+// loadSkipped returns pa's skipped items, keyed by item ID.
+func (db *boltDB) loadSkipped(pa providerAccount) (map[string]SkippedItem, error) {
+	var skipped map[string]SkippedItem
+	err := db.View(func(tx *bolt.Tx) error {
+		accountBucket := tx.Bucket(pa.key())
+		if accountBucket == nil {
+			return fmt.Errorf("account '%s' does not exist in DB", pa)
+		}
+		return gobDecode(accountBucket.Get([]byte("skipped")), &skipped)
+	})
+	return skipped, err
+}
+
+// saveSkipped records si as one of pa's skipped items.
+func (db *boltDB) saveSkipped(pa providerAccount, si SkippedItem) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		accountBucket := tx.Bucket(pa.key())
+		if accountBucket == nil {
+			return fmt.Errorf("account '%s' does not exist in DB", pa)
+		}
+		skipped := make(map[string]SkippedItem)
+		err := gobDecode(accountBucket.Get([]byte("skipped")), &skipped)
+		if err != nil {
+			return err
+		}
+		skipped[si.ItemID] = si
+		enc, err := gobEncode(skipped)
+		if err != nil {
+			return err
+		}
+		return accountBucket.Put([]byte("skipped"), enc)
+	})
+}
+
+// unskip removes the item with the given ID from pa's
+// skipped items, if it is one of them.
+func (db *boltDB) unskip(pa providerAccount, itemID string) error {
+	skipped, err := db.loadSkipped(pa)
+	if err != nil || len(skipped) == 0 {
+		return err
+	}
+	if _, ok := skipped[itemID]; !ok {
+		return nil
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		accountBucket := tx.Bucket(pa.key())
+		if accountBucket == nil {
+			return fmt.Errorf("account '%s' does not exist in DB", pa)
+		}
+		skipped := make(map[string]SkippedItem)
+		err := gobDecode(accountBucket.Get([]byte("skipped")), &skipped)
+		if err != nil {
+			return err
+		}
+		delete(skipped, itemID)
+		if len(skipped) == 0 {
+			return accountBucket.Delete([]byte("skipped"))
+		}
+		enc, err := gobEncode(skipped)
+		if err != nil {
+			return err
+		}
+		return accountBucket.Put([]byte("skipped"), enc)
+	})
+}
@@ -0,0 +1,140 @@
+package photobak
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// BusyMarkerName is the name of the file that exists in the
+// root of the repository while photobak is changing it, if
+// the repository is SyncFriendly.
+const BusyMarkerName = ".photobak-busy"
+
+// beginChanges is called before the repository's files are
+// changed. It creates the busy marker, if the repository is
+// SyncFriendly, and reports ChangesStarted.
+func (r *Repository) beginChanges() {
+	if r.SyncFriendly {
+		marker := fmt.Sprintf("photobak (pid %d) has been changing this repository since %s\n",
+			os.Getpid(), time.Now().Format(time.RFC3339))
+		err := ioutil.WriteFile(r.fullPath(BusyMarkerName), []byte(marker), 0600)
+		if err != nil {
+			repoLog.Errorf("creating busy marker: %v", err)
+		}
+	}
+	r.progress(ProgressEvent{Type: ChangesStarted})
+}
+
+// endChanges is called when the repository's files are done
+// being changed. It removes the files that were moved, updates
+// the manifests, XMP sidecars, album info, JPEG companions, and
+// views if enabled, removes the busy marker, and reports
+// ChangesFinished.
+func (r *Repository) endChanges() {
+	r.removeMovedFiles()
+	if r.Manifests {
+		err := r.writeManifests()
+		if err != nil {
+			repoLog.Errorf("updating manifests: %v", err)
+		}
+	}
+	if r.XMP {
+		err := r.writeXMPSidecars()
+		if err != nil {
+			repoLog.Errorf("updating XMP sidecars: %v", err)
+		}
+	}
+	if r.AlbumInfo {
+		err := r.writeAlbumInfos()
+		if err != nil {
+			repoLog.Errorf("updating album info: %v", err)
+		}
+	}
+	if r.ConvertHEIC != nil {
+		err := r.writeJPEGCompanions()
+		if err != nil {
+			repoLog.Errorf("updating JPEG companions: %v", err)
+		}
+	}
+	if len(r.views) > 0 {
+		err := r.writeViews()
+		if err != nil {
+			repoLog.Errorf("updating views: %v", err)
+		}
+	}
+	if r.SyncFriendly {
+		err := os.Remove(r.fullPath(BusyMarkerName))
+		if err != nil && !os.IsNotExist(err) {
+			repoLog.Errorf("removing busy marker: %v", err)
+		}
+	}
+	r.progress(ProgressEvent{Type: ChangesFinished})
+}
+
+// moveFile moves the file at the repo-relative path from to
+// the repo-relative path to, replacing anything there. If the
+// repository is SyncFriendly, the file is not renamed; instead,
+// it is linked (or copied) to its new path right away, and the
+// old path is removed by endChanges.
+func (r *Repository) moveFile(from, to string) error {
+	if !r.SyncFriendly {
+		return os.Rename(r.fullPath(from), r.fullPath(to))
+	}
+
+	os.Remove(r.fullPath(to))
+	err := os.Link(r.fullPath(from), r.fullPath(to))
+	if err != nil {
+		err = copyFile(r.fullPath(from), r.fullPath(to))
+		if err != nil {
+			return err
+		}
+	}
+
+	r.movedFilesMu.Lock()
+	if r.movedFiles == nil {
+		r.movedFiles = make(map[string]struct{})
+	}
+	r.movedFiles[from] = struct{}{}
+	r.movedFilesMu.Unlock()
+
+	return nil
+}
+
+// removingLater returns true if the file at the repo-relative
+// path fpath was moved and will be removed by endChanges.
+func (r *Repository) removingLater(fpath string) bool {
+	r.movedFilesMu.Lock()
+	defer r.movedFilesMu.Unlock()
+	_, ok := r.movedFiles[fpath]
+	return ok
+}
+
+// removeMovedFiles removes the old paths of the
+// files that were moved since beginChanges.
+func (r *Repository) removeMovedFiles() {
+	r.movedFilesMu.Lock()
+	defer r.movedFilesMu.Unlock()
+	for fpath := range r.movedFiles {
+		err := os.Remove(r.fullPath(fpath))
+		if err != nil && !os.IsNotExist(err) {
+			repoLog.Errorf("removing %s after moving it: %v", fpath, err)
+		}
+	}
+	r.movedFiles = nil
+}
+
+// overwriteFile replaces the contents of dst with those of
+// src without renaming anything, then removes src.
+func overwriteFile(src, dst string) error {
+	contents, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(dst, contents, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,565 @@
+package photobak
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// takeoutIDPrefix starts the IDs of the items and collections
+// that were imported from a Google Takeout export rather than
+// listed by the provider.
+const takeoutIDPrefix = "takeout:"
+
+// TakeoutReport summarizes an import of a Google Takeout export.
+type TakeoutReport struct {
+	Account       string
+	Matched       int      // files whose content was already stored for the account
+	MatchedByName int      // files with different content than the item of the same name in the same album
+	Added         int      // files added to the repository as new items
+	Described     int      // items whose caption, time taken, location, or favorite was filled in
+	Failed        []string // files that could not be imported, and why
+}
+
+// String returns a human-readable report.
+func (tr TakeoutReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Imported Takeout export into %s:\n", tr.Account)
+	fmt.Fprintf(&b, "  Already stored:          %d\n", tr.Matched)
+	fmt.Fprintf(&b, "  Matched by name:         %d\n", tr.MatchedByName)
+	fmt.Fprintf(&b, "  Added:                   %d\n", tr.Added)
+	fmt.Fprintf(&b, "  Metadata filled in:      %d\n", tr.Described)
+	if len(tr.Failed) > 0 {
+		fmt.Fprintf(&b, "  Failed:                  %d\n", len(tr.Failed))
+		for _, f := range tr.Failed {
+			fmt.Fprintf(&b, "    - %s\n", f)
+		}
+	}
+	return b.String()
+}
+
+// ImportTakeout imports a Google Takeout export of Google Photos
+// into account (given as provider:username), which is usually a
+// googlephotos account. The sources are the export's .zip files
+// or the folders they were extracted to; an export split into
+// several archives should be imported all at once, since the
+// metadata of a file is not always in the same archive as it.
+//
+// Each photo or video in the export is matched to the account's
+// items: first by content, then by name within the album of the
+// same name. The caption, time taken, location, and favorite
+// status from Takeout's JSON metadata are filled in where the
+// items have none. Files that match no item are added to the
+// repository without downloading them, to the collection with
+// the name of their album (which is created if needed), as
+// LocalOnly items, since they are not known to the provider by
+// the IDs they are stored under.
+func (r *Repository) ImportTakeout(ctx context.Context, account string, sources []string) (TakeoutReport, error) {
+	report := TakeoutReport{Account: account}
+
+	parts := strings.SplitN(account, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return report, fmt.Errorf("account must be in the form provider:username")
+	}
+	pa := accountFromKey(parts[0], parts[1])
+	err := r.db.createAccount(pa)
+	if err != nil {
+		return report, err
+	}
+
+	export, err := openTakeout(sources)
+	if err != nil {
+		return report, err
+	}
+	defer export.close()
+
+	r.beginChanges()
+	defer r.endChanges()
+
+	albums := make([]string, 0, len(export.albums))
+	for album := range export.albums {
+		albums = append(albums, album)
+	}
+	sort.Strings(albums)
+
+	for _, album := range albums {
+		ta := export.albums[album]
+		for _, tf := range ta.media {
+			if ctx.Err() != nil {
+				return report, ctx.Err()
+			}
+			meta := ta.sidecar(tf.name)
+			err := r.importTakeoutFile(pa, ta, tf, meta, &report)
+			if err != nil {
+				repoLog.Errorf("importing %s from Takeout: %v", tf.path, err)
+				report.Failed = append(report.Failed, fmt.Sprintf("%s: %v", tf.path, err))
+			}
+		}
+	}
+	return report, nil
+}
+
+// importTakeoutFile imports tf, which is in the album ta and has
+// the metadata meta (which may be nil), into pa's items.
+func (r *Repository) importTakeoutFile(pa providerAccount, ta *takeoutAlbum, tf importedFile, meta *takeoutMeta, report *TakeoutReport) error {
+	checksum, err := tf.checksum(r.newHash())
+	if err != nil {
+		return fmt.Errorf("reading file: %v", err)
+	}
+	defer r.lockChecksum(checksum)()
+
+	sameItems, err := r.db.itemsWithChecksum(checksum)
+	if err != nil {
+		return err
+	}
+	for _, ai := range sameItems {
+		if string(ai.AcctKey) != pa.String() {
+			continue
+		}
+		dbi, err := r.db.loadItem(ai.AcctKey, ai.ItemID)
+		if err != nil {
+			return err
+		}
+		if dbi == nil {
+			continue
+		}
+		report.Matched++
+		if strings.HasPrefix(dbi.ID, takeoutIDPrefix) {
+			// an item imported earlier, maybe from
+			// another album; it belongs in this one too
+			coll, err := r.takeoutCollection(pa, ta)
+			if err != nil {
+				return err
+			}
+			if _, ok := dbi.Collections[coll.id]; !ok {
+				dbi.Collections[coll.id] = struct{}{}
+				if !inDir(dbi.FilePath, coll.dirPath) {
+					err := r.writeToMediaListFile(coll, dbi.FilePath)
+					if err != nil {
+						return fmt.Errorf("writing to media list file: %v", err)
+					}
+				}
+				err = r.db.saveItem(pa.key(), dbi.ID, dbi)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return r.fillInTakeoutMeta(pa, dbi, meta, report)
+	}
+
+	if dbi, err := r.takeoutItemByName(pa, ta, tf.name); err != nil || dbi != nil {
+		if err != nil {
+			return err
+		}
+		report.MatchedByName++
+		return r.fillInTakeoutMeta(pa, dbi, meta, report)
+	}
+
+	return r.addTakeoutFile(pa, ta, tf, meta, checksum, sameItems, report)
+}
+
+// takeoutItemByName returns the item of pa's collection with
+// the name of ta that has the given name, if there is exactly
+// one; or for a year folder, pa's only item with that name.
+func (r *Repository) takeoutItemByName(pa providerAccount, ta *takeoutAlbum, name string) (*dbItem, error) {
+	var candidates []string
+	if dbc, err := r.collectionNamed(pa, ta.title); err != nil {
+		return nil, err
+	} else if dbc != nil {
+		for itemID := range dbc.Items {
+			candidates = append(candidates, itemID)
+		}
+	} else if ta.year {
+		itemIDs, err := r.db.itemIDs(pa)
+		if err != nil {
+			return nil, err
+		}
+		candidates = itemIDs
+	}
+
+	var found *dbItem
+	for _, itemID := range candidates {
+		dbi, err := r.db.loadItem(pa.key(), itemID)
+		if err != nil {
+			return nil, err
+		}
+		if dbi == nil || !strings.EqualFold(dbi.Name, name) {
+			continue
+		}
+		if found != nil {
+			return nil, nil // ambiguous
+		}
+		found = dbi
+	}
+	return found, nil
+}
+
+// collectionNamed returns pa's collection with the given
+// name, if there is exactly one, preferring those listed
+// by the provider over those imported from Takeout.
+func (r *Repository) collectionNamed(pa providerAccount, name string) (*dbCollection, error) {
+	collIDs, err := r.db.collectionIDs(pa)
+	if err != nil {
+		return nil, err
+	}
+	var listed, imported []*dbCollection
+	for _, collID := range collIDs {
+		dbc, err := r.db.loadCollection(pa.key(), collID)
+		if err != nil {
+			return nil, err
+		}
+		if dbc == nil || dbc.Name != name {
+			continue
+		}
+		if strings.HasPrefix(dbc.ID, takeoutIDPrefix) {
+			imported = append(imported, dbc)
+		} else {
+			listed = append(listed, dbc)
+		}
+	}
+	if len(listed) == 1 {
+		return listed[0], nil
+	}
+	if len(listed) == 0 && len(imported) == 1 {
+		return imported[0], nil
+	}
+	return nil, nil
+}
+
+// takeoutCollection returns the collection of pa that files of
+// ta are added to: the collection with the same name, or else a
+// new LocalOnly one, which is created the first time.
+func (r *Repository) takeoutCollection(pa providerAccount, ta *takeoutAlbum) (collection, error) {
+	dbc, err := r.collectionNamed(pa, ta.title)
+	if err != nil {
+		return collection{}, err
+	}
+	if dbc != nil {
+		return r.importCollection(pa, dbc.ID, dbc.Name, "")
+	}
+	return r.importCollection(pa, takeoutIDPrefix+ta.title, ta.title, ta.description)
+}
+
+// addTakeoutFile adds tf, which has the given checksum and is
+// in the album ta, to the repository as a new item of pa. If
+// sameItems (the items with the same checksum) is not empty,
+// the file is not copied; the item refers to their file.
+func (r *Repository) addTakeoutFile(pa providerAccount, ta *takeoutAlbum, tf importedFile, meta *takeoutMeta, checksum []byte, sameItems []accountItem, report *TakeoutReport) error {
+	coll, err := r.takeoutCollection(pa, ta)
+	if err != nil {
+		return err
+	}
+	it := takeoutItem{id: takeoutIDPrefix + hex.EncodeToString(checksum), name: tf.name, meta: meta}
+	dbi, err := r.importFile(pa, coll, it, tf, checksum, sameItems)
+	if err != nil {
+		return err
+	}
+	if dbi.Meta.Setting == nil && meta != nil {
+		dbi.Meta.Setting = meta.setting()
+	}
+	err = r.db.saveItem(pa.key(), dbi.ID, dbi)
+	if err != nil {
+		return fmt.Errorf("saving item to database: %v", err)
+	}
+	report.Added++
+	repoLog.Infof("Added %s from Takeout as %s", tf.path, dbi.FilePath)
+	r.progress(ProgressEvent{Type: ItemCommitted, Account: pa.String(), ItemID: dbi.ID, FilePath: dbi.FilePath})
+	return nil
+}
+
+// fillInTakeoutMeta fills in what dbi, which belongs to pa, is
+// missing from meta (which may be nil), and saves it if any.
+func (r *Repository) fillInTakeoutMeta(pa providerAccount, dbi *dbItem, meta *takeoutMeta, report *TakeoutReport) error {
+	if meta == nil {
+		return nil
+	}
+	var filled bool
+	if dbi.Meta.Caption == "" && meta.Description != "" {
+		dbi.Meta.Caption = meta.Description
+		filled = true
+	}
+	if itemTaken(dbi).IsZero() && !meta.taken().IsZero() {
+		dbi.Meta.Taken = meta.taken()
+		filled = true
+	}
+	if dbi.Meta.Setting == nil {
+		if s := meta.setting(); s != nil {
+			dbi.Meta.Setting = s
+			filled = true
+		}
+	}
+	if !dbi.Meta.Favorite && meta.Favorited {
+		dbi.Meta.Favorite = true
+		filled = true
+	}
+	if !filled {
+		return nil
+	}
+	report.Described++
+	return r.db.saveItem(pa.key(), dbi.ID, dbi)
+}
+
+// takeoutItem is a file of a Takeout export
+// as an Item, with its metadata, if any.
+type takeoutItem struct {
+	id, name string
+	meta     *takeoutMeta
+}
+
+func (ti takeoutItem) ItemID() string   { return ti.id }
+func (ti takeoutItem) ItemName() string { return ti.name }
+func (ti takeoutItem) ItemETag() string { return "" }
+
+func (ti takeoutItem) ItemCaption() string {
+	if ti.meta == nil {
+		return ""
+	}
+	return ti.meta.Description
+}
+
+func (ti takeoutItem) ItemTime() time.Time {
+	if ti.meta == nil {
+		return time.Time{}
+	}
+	return ti.meta.taken()
+}
+
+func (ti takeoutItem) ItemFavorite() bool {
+	return ti.meta != nil && ti.meta.Favorited
+}
+
+// takeoutMeta is the metadata of a photo or video in a Takeout
+// export, from the JSON file next to it, or of an album, from
+// the metadata.json file in its folder.
+type takeoutMeta struct {
+	Title          string           `json:"title"`
+	Description    string           `json:"description"`
+	PhotoTakenTime *takeoutTime     `json:"photoTakenTime"`
+	GeoData        *takeoutLocation `json:"geoData"`
+	GeoDataExif    *takeoutLocation `json:"geoDataExif"`
+	Favorited      bool             `json:"favorited"`
+}
+
+// takeoutTime is a time in Takeout's metadata.
+type takeoutTime struct {
+	Timestamp string `json:"timestamp"` // seconds since the epoch
+}
+
+// takeoutLocation is a location in Takeout's metadata;
+// it is all zeros if the location is not known.
+type takeoutLocation struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Altitude  float64 `json:"altitude"`
+}
+
+// taken returns when the item was taken, if it is known.
+func (tm *takeoutMeta) taken() time.Time {
+	if tm.PhotoTakenTime == nil {
+		return time.Time{}
+	}
+	sec, err := strconv.ParseInt(tm.PhotoTakenTime.Timestamp, 10, 64)
+	if err != nil || sec <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0).UTC()
+}
+
+// setting returns where and when the item was taken,
+// or nil if where is not known.
+func (tm *takeoutMeta) setting() *setting {
+	for _, loc := range []*takeoutLocation{tm.GeoData, tm.GeoDataExif} {
+		if loc != nil && (loc.Latitude != 0 || loc.Longitude != 0) {
+			return &setting{
+				Latitude:   loc.Latitude,
+				Longitude:  loc.Longitude,
+				Altitude:   loc.Altitude,
+				OriginTime: tm.taken(),
+			}
+		}
+	}
+	return nil
+}
+
+// takeoutExport is the contents of a Takeout export.
+type takeoutExport struct {
+	albums  map[string]*takeoutAlbum // by folder name
+	closers []io.Closer
+}
+
+func (te *takeoutExport) close() {
+	for _, c := range te.closers {
+		c.Close()
+	}
+}
+
+// takeoutAlbum is a folder of a Takeout export, which is either
+// an album or one of the folders with all photos of a year.
+type takeoutAlbum struct {
+	title       string // from the album's metadata, or else the folder name
+	description string
+	year        bool // whether the folder is for a year rather than an album
+	media       []importedFile
+	sidecars    map[string]*takeoutMeta // by file name
+}
+
+// takeoutYearFolder matches the names of the folders
+// of Takeout exports that hold the photos of a year.
+var takeoutYearFolder = regexp.MustCompile(`^Photos from \d{4}$`)
+
+// takeoutNumbered matches file names like "IMG_1234(1).jpg",
+// whose metadata is in a file like "IMG_1234.jpg(1).json".
+var takeoutNumbered = regexp.MustCompile(`^(.*)(\(\d+\))(\.[^.]*)$`)
+
+// takeoutMaxSidecarName is how long the name of a metadata
+// file in a Takeout export can be, without ".json", before it
+// is cut short.
+const takeoutMaxSidecarName = 46
+
+// sidecar returns the metadata of the file in ta with the
+// given name, or nil if there is none.
+func (ta *takeoutAlbum) sidecar(name string) *takeoutMeta {
+	var candidates []string
+	add := func(base, suffix string) {
+		if len(base) > takeoutMaxSidecarName {
+			base = base[:takeoutMaxSidecarName]
+		}
+		candidates = append(candidates, base+suffix+".json")
+	}
+	for _, n := range []string{name, strings.Replace(name, "-edited", "", 1)} {
+		add(n, "")
+		add(n+".supplemental-metadata", "")
+		if m := takeoutNumbered.FindStringSubmatch(n); m != nil {
+			add(m[1]+m[3], m[2])
+			add(m[1]+m[3]+".supplemental-metadata", m[2])
+		}
+	}
+	for _, candidate := range candidates {
+		if meta, ok := ta.sidecars[candidate]; ok {
+			return meta
+		}
+	}
+	// as a last resort, find the one titled like the file
+	var found *takeoutMeta
+	for _, meta := range ta.sidecars {
+		if meta.Title == name {
+			if found != nil {
+				return nil
+			}
+			found = meta
+		}
+	}
+	return found
+}
+
+// openTakeout reads the contents of the Takeout export made of
+// sources, which are .zip files or folders they were extracted to.
+func openTakeout(sources []string) (*takeoutExport, error) {
+	te := &takeoutExport{albums: make(map[string]*takeoutAlbum)}
+	for _, source := range sources {
+		info, err := os.Stat(source)
+		if err != nil {
+			te.close()
+			return nil, err
+		}
+		if info.IsDir() {
+			err = filepath.Walk(source, func(fpath string, info os.FileInfo, err error) error {
+				if err != nil || !info.Mode().IsRegular() {
+					return err
+				}
+				rel, err := filepath.Rel(source, fpath)
+				if err != nil {
+					return err
+				}
+				return te.add(filepath.ToSlash(rel), fpath, info.ModTime(), func() (io.ReadCloser, error) {
+					return os.Open(fpath)
+				})
+			})
+		} else {
+			var zr *zip.ReadCloser
+			zr, err = zip.OpenReader(source)
+			if err == nil {
+				te.closers = append(te.closers, zr)
+				for _, zf := range zr.File {
+					if zf.FileInfo().IsDir() {
+						continue
+					}
+					err = te.add(zf.Name, source+":"+zf.Name, zf.Modified, zf.Open)
+					if err != nil {
+						break
+					}
+				}
+			}
+		}
+		if err != nil {
+			te.close()
+			return nil, fmt.Errorf("reading %s: %v", source, err)
+		}
+	}
+
+	for folder, ta := range te.albums {
+		if ta.title == "" {
+			ta.title = folder
+		}
+		ta.year = takeoutYearFolder.MatchString(folder)
+	}
+	return te, nil
+}
+
+// add adds the file at the slash-separated path rel within
+// the export, which is at fpath and opened with open.
+// Only files in the folders of Google Photos are added.
+func (te *takeoutExport) add(rel, fpath string, modTime time.Time, open func() (io.ReadCloser, error)) error {
+	parts := strings.Split(rel, "/")
+	for i, part := range parts {
+		if part == "Google Photos" {
+			parts = parts[i+1:]
+			break
+		}
+	}
+	if len(parts) != 2 || isJunkFile(parts[1]) {
+		return nil
+	}
+	folder, name := parts[0], parts[1]
+	ta, ok := te.albums[folder]
+	if !ok {
+		ta = &takeoutAlbum{sidecars: make(map[string]*takeoutMeta)}
+		te.albums[folder] = ta
+	}
+
+	if strings.ToLower(path.Ext(name)) != ".json" {
+		ta.media = append(ta.media, importedFile{path: fpath, name: name, modTime: modTime, open: open})
+		return nil
+	}
+
+	rc, err := open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	var meta takeoutMeta
+	err = json.NewDecoder(rc).Decode(&meta)
+	if err != nil {
+		repoLog.Warnf("skipping %s: not Takeout metadata: %v", fpath, err)
+		return nil
+	}
+	if meta.PhotoTakenTime == nil && meta.GeoData == nil {
+		// the metadata of the album itself
+		ta.title, ta.description = meta.Title, meta.Description
+		return nil
+	}
+	ta.sidecars[name] = &meta
+	return nil
+}
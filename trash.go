@@ -0,0 +1,131 @@
+package photobak
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TrashLister is an optional interface a Client may implement
+// if its provider keeps deleted items in a trash, where they can
+// still be restored, before deleting them for good. Items that
+// are in the trash are not pruned, so that the backup still has
+// them if they are deleted for good by mistake.
+type TrashLister interface {
+	// ListTrash sends the account's items that are in the
+	// trash down itemChan, and closes it when done.
+	ListTrash(ctx context.Context, itemChan chan Item) error
+}
+
+// TrashedItem is an item that is in its provider's trash
+// but still in the repository.
+type TrashedItem struct {
+	Account  string    // the account, as provider:username
+	ItemID   string    // the ID of the item
+	FilePath string    // the repo-relative path of its file
+	Since    time.Time // when it was first found in the trash
+}
+
+// Trashed returns the items in the repository that were in their
+// provider's trash when the repository was last pruned, oldest
+// first. They can be rescued from the repository (or restored in
+// the provider's trash) before the provider deletes them for good.
+func (r *Repository) Trashed() ([]TrashedItem, error) {
+	accounts, err := r.db.storedAccounts()
+	if err != nil {
+		return nil, fmt.Errorf("listing accounts: %v", err)
+	}
+
+	var trashed []TrashedItem
+	for _, pa := range accounts {
+		itemIDs, err := r.db.itemIDs(pa)
+		if err != nil {
+			return nil, err
+		}
+		for _, itemID := range itemIDs {
+			dbi, err := r.db.loadItem(pa.key(), itemID)
+			if err != nil {
+				return nil, err
+			}
+			if dbi == nil || dbi.Trashed.IsZero() {
+				continue
+			}
+			trashed = append(trashed, TrashedItem{
+				Account:  pa.String(),
+				ItemID:   dbi.ID,
+				FilePath: dbi.FilePath,
+				Since:    dbi.Trashed,
+			})
+		}
+	}
+
+	sort.Slice(trashed, func(i, j int) bool {
+		if !trashed[i].Since.Equal(trashed[j].Since) {
+			return trashed[i].Since.Before(trashed[j].Since)
+		}
+		return trashed[i].FilePath < trashed[j].FilePath
+	})
+	return trashed, nil
+}
+
+// listTrash returns the IDs under which the items in ac's trash
+// are stored, or nil if ac's client doesn't implement TrashLister.
+func (r *Repository) listTrash(ctx context.Context, ac accountClient) (idSet, error) {
+	tl, ok := ac.client.(TrashLister)
+	if !ok {
+		return nil, nil
+	}
+	aliases, err := r.db.loadIDAliases(ac.account)
+	if err != nil {
+		return nil, fmt.Errorf("loading aliases: %v", err)
+	}
+
+	trash := make(idSet)
+	itemChan := make(chan Item)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for it := range itemChan {
+			for _, itemID := range aliases.itemIDs(it) {
+				trash[itemID] = struct{}{}
+			}
+		}
+	}()
+	err = tl.ListTrash(ctx, itemChan)
+	wg.Wait()
+	if err != nil {
+		return nil, fmt.Errorf("listing trash: %v", err)
+	}
+	return trash, nil
+}
+
+// setTrashed marks dbi, an item of pa, as being in the
+// provider's trash (if trashed is true) or not, and saves
+// it if that is new.
+func (r *Repository) setTrashed(pa providerAccount, dbi *dbItem, trashed bool) error {
+	if trashed == !dbi.Trashed.IsZero() {
+		return nil
+	}
+	if trashed {
+		repoLog.Infof("Item '%s' is in the trash; keeping it until it is deleted for good", dbi.FilePath)
+		dbi.Trashed = time.Now()
+	} else {
+		repoLog.Infof("Item '%s' is no longer in the trash", dbi.FilePath)
+		dbi.Trashed = time.Time{}
+	}
+	return r.db.saveItem(pa.key(), dbi.ID, dbi)
+}
+
+// hasTrashedItems returns true if any of
+// the items in dbc are in trash.
+func hasTrashedItems(dbc *dbCollection, trash idSet) bool {
+	for itemID := range dbc.Items {
+		if _, ok := trash[itemID]; ok {
+			return true
+		}
+	}
+	return false
+}
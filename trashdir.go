@@ -0,0 +1,60 @@
+package photobak
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// TrashDir is the folder in the root of the repository where
+// Prune moves the files of deleted items to, if TrashRetention
+// is set. Each run of Prune gets a folder in it named after
+// when the run started, which keeps the repo-relative paths
+// of the files. Its contents are ignored by photobak, and
+// removed once they are older than TrashRetention.
+const TrashDir = ".trash"
+
+// trashBatchFormat is the format of the names
+// of the folders in TrashDir.
+const trashBatchFormat = "20060102T150405Z"
+
+// discardFile deletes the file at the repo-relative path
+// fpath, by moving it into TrashDir if TrashRetention is set.
+func (r *Repository) discardFile(fpath string) error {
+	if r.TrashRetention <= 0 || r.trashBatch == "" {
+		return os.Remove(r.fullPath(fpath))
+	}
+	dest := r.fullPath(filepath.Join(TrashDir, r.trashBatch, fpath))
+	err := os.MkdirAll(filepath.Dir(dest), 0700)
+	if err != nil {
+		return err
+	}
+	return os.Rename(r.fullPath(fpath), dest)
+}
+
+// expireTrash removes the folders in TrashDir that are
+// older than TrashRetention, if it is set.
+func (r *Repository) expireTrash() {
+	if r.TrashRetention <= 0 {
+		return
+	}
+	infos, err := ioutil.ReadDir(r.fullPath(TrashDir))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			repoLog.Errorf("reading %s: %v", TrashDir, err)
+		}
+		return
+	}
+	for _, info := range infos {
+		t, err := time.Parse(trashBatchFormat, info.Name())
+		if err != nil || !info.IsDir() || time.Since(t) < r.TrashRetention {
+			continue
+		}
+		repoLog.Infof("Removing files pruned on %s from %s", t.Local().Format("2006-01-02"), TrashDir)
+		err = os.RemoveAll(r.fullPath(filepath.Join(TrashDir, info.Name())))
+		if err != nil {
+			repoLog.Errorf("removing expired trash: %v", err)
+		}
+	}
+}
@@ -0,0 +1,461 @@
+package photobak
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Kinds of problems that Verify can find.
+const (
+	// ProblemMissingFile is an item whose file does not exist.
+	ProblemMissingFile = "missing_file"
+
+	// ProblemChecksumMismatch is an item whose file does
+	// not have the checksum it had when it was downloaded.
+	ProblemChecksumMismatch = "checksum_mismatch"
+
+	// ProblemSizeMismatch is an item whose file is not the
+	// size that the provider listed it as when it was
+	// downloaded, which usually means it was cut short.
+	ProblemSizeMismatch = "size_mismatch"
+
+	// ProblemUnindexedFile is a file in the repository
+	// that does not belong to any item.
+	ProblemUnindexedFile = "unindexed_file"
+
+	// ProblemChecksumIndex is an entry in the checksum index
+	// that refers to an item that does not exist or has a
+	// different checksum, or an item that is missing from it.
+	ProblemChecksumIndex = "checksum_index"
+
+	// ProblemBadReference is a line of a media list file, or
+	// a symbolic link, that does not refer to an item's file.
+	ProblemBadReference = "bad_reference"
+
+	// ProblemMissingReference is an item whose file is saved
+	// outside of a collection's folder, but that is not referred
+	// to from that folder's media list file (or by a link).
+	ProblemMissingReference = "missing_reference"
+
+	// ProblemOrphanedRecord is an item in the database that
+	// belongs to no existing collection, or a collection that
+	// lists an item that does not exist.
+	ProblemOrphanedRecord = "orphaned_record"
+)
+
+// VerifyProblem is a problem found by Verify.
+type VerifyProblem struct {
+	Kind       string `json:"kind"`                 // one of the Problem* constants
+	Path       string `json:"path,omitempty"`       // repo-relative path of the file concerned
+	Account    string `json:"account,omitempty"`    // account of the item concerned
+	ItemID     string `json:"item_id,omitempty"`    // ID of the item concerned
+	Collection string `json:"collection,omitempty"` // ID of the collection concerned
+	Target     string `json:"target,omitempty"`     // repo-relative path a bad reference refers to
+	Detail     string `json:"detail,omitempty"`     // more information
+}
+
+// VerifyReport describes the problems that Verify found.
+type VerifyReport struct {
+	Items    int             `json:"items"` // number of items checked
+	Files    int             `json:"files"` // number of files re-hashed
+	Problems []VerifyProblem `json:"problems"`
+}
+
+// String returns a human-readable summary of the report.
+func (vr VerifyReport) String() string {
+	counts := make(map[string]int)
+	for _, p := range vr.Problems {
+		counts[p.Kind]++
+	}
+	kinds := make([]string, 0, len(counts))
+	for kind := range counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	s := fmt.Sprintf("Checked %d items and %d files: %d problems\n", vr.Items, vr.Files, len(vr.Problems))
+	for _, kind := range kinds {
+		s += fmt.Sprintf("  %s: %d\n", kind, counts[kind])
+	}
+	return s
+}
+
+// Verify audits the repository: it re-hashes the file of every
+// item and compares it with the checksum from when it was
+// downloaded, checks that the checksum index agrees with the
+// items, checks that collections refer to their items saved in
+// other folders and that those references are valid, looks for
+// database records that belong to nothing, and looks for files
+// that do not belong to any item. No requests are made to
+// providers and nothing is changed.
+func (r *Repository) Verify() (VerifyReport, error) {
+	v := newVerification(r, false)
+
+	accounts, err := r.db.storedAccounts()
+	if err != nil {
+		return v.report, fmt.Errorf("listing accounts: %v", err)
+	}
+
+	for _, pa := range accounts {
+		err := v.checkItems(pa)
+		if err != nil {
+			return v.report, fmt.Errorf("checking items of %s: %v", pa, err)
+		}
+	}
+
+	err = v.checkChecksumIndex()
+	if err != nil {
+		return v.report, fmt.Errorf("checking checksum index: %v", err)
+	}
+
+	for _, pa := range accounts {
+		err := v.checkReferences(pa)
+		if err != nil {
+			return v.report, fmt.Errorf("checking references of %s: %v", pa, err)
+		}
+	}
+
+	err = v.checkTree()
+	if err != nil {
+		return v.report, fmt.Errorf("checking files: %v", err)
+	}
+
+	return v.report, nil
+}
+
+// verification is the state of a run of Verify.
+type verification struct {
+	r      *Repository
+	report VerifyReport
+	quick  bool // if true, files are not hashed and the checksum index is not checked
+
+	hashed  map[string][]byte // checksums of files that were hashed, by repo-relative path
+	missing map[string]bool   // item files that do not exist
+	known   map[string]bool   // files that belong to items or refer to them
+	colls   map[string]bool   // whether collections exist, by account key and ID
+	listed  map[string]bool   // files that are listed in media list files
+}
+
+func newVerification(r *Repository, quick bool) *verification {
+	return &verification{
+		r:       r,
+		quick:   quick,
+		hashed:  make(map[string][]byte),
+		missing: make(map[string]bool),
+		known:   make(map[string]bool),
+		colls:   make(map[string]bool),
+		listed:  make(map[string]bool),
+	}
+}
+
+func (v *verification) problem(p VerifyProblem) {
+	v.report.Problems = append(v.report.Problems, p)
+}
+
+// checkItems checks that the files of pa's items exist and
+// have the right checksums, and that the items are in the
+// checksum index. If the verification is quick, it only
+// checks whether the files exist.
+func (v *verification) checkItems(pa providerAccount) error {
+	itemIDs, err := v.r.db.itemIDs(pa)
+	if err != nil {
+		return err
+	}
+	sort.Strings(itemIDs)
+
+	for _, itemID := range itemIDs {
+		dbi, err := v.r.db.loadItem(pa.key(), itemID)
+		if err != nil {
+			return err
+		}
+		if dbi == nil {
+			continue
+		}
+		v.report.Items++
+		v.known[dbi.FilePath] = true
+
+		var inCollection bool
+		for collID := range dbi.Collections {
+			exists, err := v.collectionExists(pa, collID)
+			if err != nil {
+				return err
+			}
+			if exists {
+				inCollection = true
+				break
+			}
+		}
+		if !inCollection {
+			v.problem(VerifyProblem{Kind: ProblemOrphanedRecord, Path: dbi.FilePath,
+				Account: pa.String(), ItemID: itemID, Detail: "item belongs to no collection"})
+		}
+
+		if info, err := os.Stat(v.r.fullPath(dbi.FilePath)); err == nil {
+			if p, ok := sizeProblem(pa, itemID, dbi, info.Size()); ok {
+				v.problem(p)
+			}
+		}
+
+		if v.quick {
+			if !v.r.fileExists(dbi.FilePath) {
+				v.missing[dbi.FilePath] = true
+			}
+			continue
+		}
+
+		chksm, err := v.checksum(dbi.FilePath)
+		if err != nil {
+			v.problem(VerifyProblem{Kind: ProblemMissingFile, Path: dbi.FilePath,
+				Account: pa.String(), ItemID: itemID, Detail: err.Error()})
+		} else if !bytes.Equal(chksm, dbi.Checksum) {
+			v.problem(VerifyProblem{Kind: ProblemChecksumMismatch, Path: dbi.FilePath,
+				Account: pa.String(), ItemID: itemID,
+				Detail: fmt.Sprintf("expected %x, got %x", dbi.Checksum, chksm)})
+		}
+
+		list, err := v.r.db.itemsWithChecksum(dbi.Checksum)
+		if err != nil {
+			return err
+		}
+		var indexed bool
+		for _, li := range list {
+			if bytes.Equal(li.AcctKey, pa.key()) && li.ItemID == itemID {
+				indexed = true
+				break
+			}
+		}
+		if !indexed {
+			v.problem(VerifyProblem{Kind: ProblemChecksumIndex, Path: dbi.FilePath,
+				Account: pa.String(), ItemID: itemID, Detail: "item is not in checksum index"})
+		}
+	}
+
+	return nil
+}
+
+// sizeProblem returns a problem if the file of dbi, which is
+// the item itemID of pa, is not the size the provider listed
+// it as; size is the size of the file.
+func sizeProblem(pa providerAccount, itemID string, dbi *dbItem, size int64) (VerifyProblem, bool) {
+	if dbi.RemoteSize <= 0 || size == dbi.RemoteSize {
+		return VerifyProblem{}, false
+	}
+	return VerifyProblem{Kind: ProblemSizeMismatch, Path: dbi.FilePath, Account: pa.String(), ItemID: itemID,
+		Detail: fmt.Sprintf("file is %d bytes, but the provider listed it as %d", size, dbi.RemoteSize)}, true
+}
+
+// collectionExists returns true if pa has a collection with ID collID.
+func (v *verification) collectionExists(pa providerAccount, collID string) (bool, error) {
+	key := pa.String() + "/" + collID
+	if exists, ok := v.colls[key]; ok {
+		return exists, nil
+	}
+	dbc, err := v.r.db.loadCollection(pa.key(), collID)
+	if err != nil {
+		return false, err
+	}
+	v.colls[key] = dbc != nil
+	return dbc != nil, nil
+}
+
+// checksum returns the checksum of the file at the repo-relative
+// path fpath, hashing it only the first time it is asked for.
+func (v *verification) checksum(fpath string) ([]byte, error) {
+	if chksm, ok := v.hashed[fpath]; ok {
+		return chksm, nil
+	}
+	if v.missing[fpath] {
+		return nil, fmt.Errorf("file does not exist")
+	}
+	info, err := os.Lstat(v.r.fullPath(fpath))
+	if err == nil && !info.Mode().IsRegular() {
+		err = fmt.Errorf("not a regular file")
+	}
+	if err != nil {
+		v.missing[fpath] = true
+		return nil, err
+	}
+	repoLog.Infof("Verifying %s", fpath)
+	chksm, err := v.r.hash(fpath)
+	if err != nil {
+		v.missing[fpath] = true
+		return nil, err
+	}
+	v.report.Files++
+	v.hashed[fpath] = chksm
+	return chksm, nil
+}
+
+// checkChecksumIndex reports entries in the checksum index
+// that refer to items that do not exist or have changed.
+func (v *verification) checkChecksumIndex() error {
+	dangling, err := v.r.db.danglingChecksums()
+	if err != nil {
+		return err
+	}
+	chksms := make([]string, 0, len(dangling))
+	for chksm := range dangling {
+		chksms = append(chksms, chksm)
+	}
+	sort.Strings(chksms)
+	for _, chksm := range chksms {
+		for _, li := range dangling[chksm] {
+			v.problem(VerifyProblem{Kind: ProblemChecksumIndex, Account: string(li.AcctKey), ItemID: li.ItemID,
+				Detail: fmt.Sprintf("index entry for checksum %s refers to no such item", hex.EncodeToString([]byte(chksm)))})
+		}
+	}
+	return nil
+}
+
+// checkReferences checks that each of pa's collections refers
+// to its items that are saved outside of its folder.
+func (v *verification) checkReferences(pa providerAccount) error {
+	collIDs, err := v.r.db.collectionIDs(pa)
+	if err != nil {
+		return err
+	}
+	sort.Strings(collIDs)
+
+	for _, collID := range collIDs {
+		dbc, err := v.r.db.loadCollection(pa.key(), collID)
+		if err != nil {
+			return err
+		}
+		if dbc == nil {
+			continue
+		}
+		for itemID := range dbc.Items {
+			dbi, err := v.r.db.loadItem(pa.key(), itemID)
+			if err != nil {
+				return err
+			}
+			if dbi == nil {
+				v.problem(VerifyProblem{Kind: ProblemOrphanedRecord, Account: pa.String(),
+					ItemID: itemID, Collection: collID, Detail: "collection lists an item that does not exist"})
+				continue
+			}
+			if inDir(dbi.FilePath, dbc.DirPath) || v.missing[dbi.FilePath] {
+				continue
+			}
+
+			var found bool
+			if v.r.dedupMode == DedupList {
+				found, err = v.r.mediaListHasItem(dbc.DirPath, dbi)
+				if err != nil {
+					return err
+				}
+			} else {
+				links, err := v.r.findLinks(dbc.DirPath, dbi.FilePath)
+				if err != nil {
+					return err
+				}
+				for _, link := range links {
+					v.known[link] = true
+				}
+				found = len(links) > 0
+			}
+			if !found {
+				v.problem(VerifyProblem{Kind: ProblemMissingReference, Path: dbi.FilePath,
+					Account: pa.String(), ItemID: itemID, Collection: collID,
+					Detail: fmt.Sprintf("not referred to from %s", dbc.DirPath)})
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkTree walks the repository and reports files that do
+// not belong to any item, and references that are invalid.
+func (v *verification) checkTree() error {
+	root := filepath.Clean(v.r.path)
+	return filepath.Walk(root, func(fullPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fullPath == root {
+			return nil
+		}
+		fpath := v.r.repoRelative(fullPath)
+		name := info.Name()
+
+		if info.IsDir() {
+			if isJunkFile(name) || fpath == QuarantineDir || fpath == ViewsDir || fpath == CertificatesDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		switch {
+		case isJunkFile(name), isManifestName(name):
+			return nil
+		case name == AlbumInfoName && !v.known[fpath]:
+			return nil
+		case strings.HasSuffix(fpath, XMPExt) && v.known[strings.TrimSuffix(fpath, XMPExt)]:
+			return nil // the XMP sidecar of an item's file
+		case isJPEGCompanion(fpath) && v.known[strings.TrimSuffix(fpath, JPEGCompanionExt)]:
+			return nil // the JPEG companion of an item's file
+		case filepath.Dir(fpath) == "." && strings.HasPrefix(name, "photobak"):
+			return nil // the database, its backups, and other files of ours
+		case fpath == v.r.mediaListPath(filepath.Dir(fpath)):
+			return v.checkMediaList(fpath)
+		case info.Mode()&os.ModeSymlink != 0:
+			v.checkSymlink(fpath)
+			return nil
+		case !v.known[fpath]:
+			v.problem(VerifyProblem{Kind: ProblemUnindexedFile, Path: fpath})
+		}
+		return nil
+	})
+}
+
+// checkMediaList reports the lines of the media list file at
+// the repo-relative path fpath that do not refer to an item.
+func (v *verification) checkMediaList(fpath string) error {
+	f, err := os.Open(v.r.fullPath(fpath))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		v.listed[line] = true
+		if !v.known[line] {
+			v.problem(VerifyProblem{Kind: ProblemBadReference, Path: fpath, Target: line,
+				Detail: fmt.Sprintf("%s is not the file of an item", line)})
+		} else if v.missing[line] {
+			v.problem(VerifyProblem{Kind: ProblemBadReference, Path: fpath, Target: line,
+				Detail: fmt.Sprintf("%s does not exist", line)})
+		}
+	}
+	return scanner.Err()
+}
+
+// checkSymlink reports the symbolic link at the repo-relative
+// path fpath if it does not point to the file of an item.
+func (v *verification) checkSymlink(fpath string) {
+	dest, err := os.Readlink(v.r.fullPath(fpath))
+	if err != nil {
+		v.problem(VerifyProblem{Kind: ProblemBadReference, Path: fpath, Detail: err.Error()})
+		return
+	}
+	if !filepath.IsAbs(dest) {
+		dest = filepath.Join(filepath.Dir(v.r.fullPath(fpath)), dest)
+	}
+	target := v.r.repoRelative(filepath.Clean(dest))
+	if !v.known[target] || v.missing[target] {
+		v.problem(VerifyProblem{Kind: ProblemBadReference, Path: fpath, Target: target,
+			Detail: fmt.Sprintf("link to %s, which is not the file of an item", target)})
+	}
+}
@@ -0,0 +1,288 @@
+package photobak
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+)
+
+// ProblemRemoteMismatch is an item whose local file is
+// different from the one the provider has, even though
+// the item has not changed remotely since it was saved.
+const ProblemRemoteMismatch = "remote_mismatch"
+
+// RemoteVerifyOptions configures VerifyRemote.
+type RemoteVerifyOptions struct {
+	// Sample is the fraction of all items to compare,
+	// between 0 and 1. At least one item is compared.
+	Sample float64
+
+	// Pause is how long to wait between downloads, to
+	// go easy on the providers and the network.
+	Pause time.Duration
+}
+
+// RemoteVerifyReport describes the result of VerifyRemote.
+type RemoteVerifyReport struct {
+	Items    int             `json:"items"`    // number of items in the repository
+	Sampled  int             `json:"sampled"`  // number of items chosen to compare
+	Matched  int             `json:"matched"`  // number of items identical to the remote ones
+	Changed  int             `json:"changed"`  // number of items changed remotely since saved; not compared
+	Problems []VerifyProblem `json:"problems"` // items that differ from the remote ones
+	Failed   []string        `json:"failed"`   // items that could not be compared, and why
+}
+
+// Compared returns the number of items that were compared.
+func (rr RemoteVerifyReport) Compared() int {
+	return rr.Matched + len(rr.Problems)
+}
+
+// MismatchBound returns the upper bound of the 95% confidence
+// interval of the fraction of all items that differ from the
+// remote ones, estimated from the sample (Wilson score interval).
+func (rr RemoteVerifyReport) MismatchBound() float64 {
+	n := float64(rr.Compared())
+	if n == 0 {
+		return 1
+	}
+	const z = 1.96
+	p := float64(len(rr.Problems)) / n
+	center := p + z*z/(2*n)
+	spread := z * math.Sqrt(p*(1-p)/n+z*z/(4*n*n))
+	return math.Min(1, (center+spread)/(1+z*z/n))
+}
+
+// String returns a human-readable summary of the report.
+func (rr RemoteVerifyReport) String() string {
+	s := fmt.Sprintf("Compared %d of %d items with the remote originals: %d matched, %d differ",
+		rr.Compared(), rr.Items, rr.Matched, len(rr.Problems))
+	if rr.Changed > 0 {
+		s += fmt.Sprintf(" (%d changed remotely; not compared)", rr.Changed)
+	}
+	s += "\n"
+	for _, p := range rr.Problems {
+		s += fmt.Sprintf("  %s: %s\n", p.Path, p.Detail)
+	}
+	for _, f := range rr.Failed {
+		s += "  failed: " + f + "\n"
+	}
+	if rr.Compared() > 0 {
+		s += fmt.Sprintf("With 95%% confidence, at most %.2f%% of all items differ\n", rr.MismatchBound()*100)
+	}
+	return s
+}
+
+// sampledItem is an item chosen by VerifyRemote.
+type sampledItem struct {
+	pa     providerAccount
+	itemID string
+}
+
+// VerifyRemote downloads a random sample of the items in the
+// repository again and compares them, byte by byte, with the
+// local files, to find out how well the backup matches what the
+// providers have. It catches files that rotted on disk as well
+// as files that were saved wrong in the first place. Items that
+// changed remotely since they were saved are not compared, and
+// LocalOnly items are left out, since they have no remote
+// original. Downloads are done one at a time, and the repository is not
+// changed.
+func (r *Repository) VerifyRemote(ctx context.Context, opts RemoteVerifyOptions) (RemoteVerifyReport, error) {
+	var report RemoteVerifyReport
+	if opts.Sample <= 0 || opts.Sample > 1 {
+		return report, fmt.Errorf("sample must be more than 0 and at most 1")
+	}
+
+	accounts, err := r.db.storedAccounts()
+	if err != nil {
+		return report, fmt.Errorf("listing accounts: %v", err)
+	}
+	var all []sampledItem
+	for _, pa := range accounts {
+		itemIDs, err := r.db.itemIDs(pa)
+		if err != nil {
+			return report, err
+		}
+		for _, itemID := range itemIDs {
+			dbi, err := r.db.loadItem(pa.key(), itemID)
+			if err != nil {
+				return report, err
+			}
+			if dbi == nil || dbi.Protection == LocalOnly {
+				continue // there is no remote original to compare with
+			}
+			all = append(all, sampledItem{pa: pa, itemID: itemID})
+		}
+	}
+	report.Items = len(all)
+	if len(all) == 0 {
+		return report, nil
+	}
+
+	n := int(math.Ceil(opts.Sample * float64(len(all))))
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	byAccount := make(map[string][]string)
+	var accountNames []string
+	pas := make(map[string]providerAccount)
+	for _, i := range rnd.Perm(len(all))[:n] {
+		acct := all[i].pa.String()
+		if _, ok := byAccount[acct]; !ok {
+			accountNames = append(accountNames, acct)
+			pas[acct] = all[i].pa
+		}
+		byAccount[acct] = append(byAccount[acct], all[i].itemID)
+	}
+	report.Sampled = n
+	sort.Strings(accountNames)
+
+	var downloaded bool
+	for _, acct := range accountNames {
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+		itemIDs := byAccount[acct]
+		ac, err := r.storedAccountClient(pas[acct])
+		if err != nil {
+			for _, itemID := range itemIDs {
+				report.Failed = append(report.Failed, fmt.Sprintf("%s item %s: %v", acct, itemID, err))
+			}
+			continue
+		}
+
+		strategy := r.changeStrategy(ac.account)
+		notFound, err := r.findRemoteItems(ctx, ac, itemIDs, func(coll collection, it Item, itemID string) {
+			dbi, err := r.db.loadItem(ac.account.key(), itemID)
+			if err != nil || dbi == nil {
+				report.Failed = append(report.Failed, fmt.Sprintf("%s item %s: loading item: %v", acct, itemID, err))
+				return
+			}
+			if changed, _ := changedRemotely(strategy, it, dbi); changed {
+				report.Changed++
+				return
+			}
+
+			if downloaded && opts.Pause > 0 {
+				select {
+				case <-time.After(opts.Pause):
+				case <-ctx.Done():
+					return
+				}
+			}
+			downloaded = true
+
+			repoLog.Infof("Comparing %s with remote original", dbi.FilePath)
+			mismatch, err := r.compareWithRemote(ctx, ac.client, it, dbi.FilePath)
+			switch {
+			case err != nil:
+				if ctx.Err() == nil {
+					report.Failed = append(report.Failed, fmt.Sprintf("%s: %v", dbi.FilePath, err))
+				}
+			case mismatch != "":
+				report.Problems = append(report.Problems, VerifyProblem{Kind: ProblemRemoteMismatch,
+					Path: dbi.FilePath, Account: acct, ItemID: dbi.ID, Detail: mismatch})
+			default:
+				report.Matched++
+			}
+		})
+		if err != nil {
+			report.Failed = append(report.Failed, fmt.Sprintf("%s: %v", acct, err))
+			continue
+		}
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+		for itemID := range notFound {
+			report.Failed = append(report.Failed, fmt.Sprintf("%s item %s: not found remotely", acct, itemID))
+		}
+	}
+
+	return report, nil
+}
+
+// compareWithRemote downloads it and compares it with the file
+// at the repo-relative path fpath. If they differ, it returns a
+// description of the difference.
+func (r *Repository) compareWithRemote(ctx context.Context, client Client, it Item, fpath string) (string, error) {
+	var mismatch string
+	err := Retries.Do(ctx, func(attempt int) error {
+		f, err := os.Open(r.fullPath(fpath))
+		if err != nil {
+			return Permanent(err)
+		}
+		defer f.Close()
+
+		cw := &compareWriter{local: f}
+		err = client.DownloadItemInto(ctx, it, cw)
+		if err != nil {
+			return err
+		}
+		mismatch = cw.result()
+		return nil
+	})
+	return mismatch, err
+}
+
+// compareWriter compares what is written to it with
+// what is read from local, without storing either.
+type compareWriter struct {
+	local    io.Reader
+	offset   int64  // number of bytes compared so far
+	mismatch string // description of the first difference
+	buf      []byte
+}
+
+func (cw *compareWriter) Write(p []byte) (int, error) {
+	if cw.mismatch != "" {
+		return len(p), nil // already know they differ; drain the download
+	}
+	if cap(cw.buf) < len(p) {
+		cw.buf = make([]byte, len(p))
+	}
+	buf := cw.buf[:len(p)]
+	n, err := io.ReadFull(cw.local, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return 0, err
+	}
+	if i := firstDifference(buf[:n], p[:n]); i >= 0 {
+		cw.mismatch = fmt.Sprintf("contents differ at byte %d", cw.offset+int64(i))
+	} else if n < len(p) {
+		cw.mismatch = fmt.Sprintf("local file is shorter (%d bytes)", cw.offset+int64(n))
+	}
+	cw.offset += int64(n)
+	return len(p), nil
+}
+
+// result returns the description of the first difference,
+// after the whole remote file was written, or "" if the
+// local and remote files are the same.
+func (cw *compareWriter) result() string {
+	if cw.mismatch != "" {
+		return cw.mismatch
+	}
+	var extra [1]byte
+	if n, _ := cw.local.Read(extra[:]); n > 0 {
+		return fmt.Sprintf("local file is longer (remote has %d bytes)", cw.offset)
+	}
+	return ""
+}
+
+// firstDifference returns the index of the first
+// byte that differs between a and b, which must be
+// the same length, or -1 if they are the same.
+func firstDifference(a, b []byte) int {
+	if bytes.Equal(a, b) {
+		return -1
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return -1
+}
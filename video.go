@@ -0,0 +1,317 @@
+package photobak
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// videoMeta is what the metadata of an MP4 or
+// QuickTime video says about it. Fields are zero
+// for what it doesn't say.
+type videoMeta struct {
+	Created   time.Time
+	Duration  time.Duration
+	Codec     string // of the first video track
+	Latitude  float64
+	Longitude float64
+	Altitude  float64
+}
+
+// videoEpoch is the Unix time of 1904-01-01, from which
+// the times in MP4 and QuickTime files are counted.
+const videoEpoch = -2082844800
+
+// videoCodecs are the names of common video codecs
+// by the identifier of their sample entry.
+var videoCodecs = map[string]string{
+	"avc1": "H.264", "avc3": "H.264",
+	"hvc1": "HEVC", "hev1": "HEVC",
+	"av01": "AV1", "vp08": "VP8", "vp09": "VP9",
+	"mp4v": "MPEG-4", "jpeg": "Motion JPEG", "mjpa": "Motion JPEG",
+	"apch": "ProRes", "apcn": "ProRes", "apcs": "ProRes", "apco": "ProRes", "ap4h": "ProRes",
+}
+
+// readVideoMeta reads the metadata of the video at fpath, which
+// must be an MP4 or QuickTime (MOV) file; that includes most
+// videos taken with phones and cameras. Like EXIF data for
+// photos, this is read from the file itself, so it doesn't
+// depend on the provider; but only the boxes that hold the
+// metadata are read, not the whole file.
+func readVideoMeta(fpath string) (*videoMeta, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	vm := new(videoMeta)
+	var isVideo, found bool
+	err = walkBoxes(f, 0, info.Size(), func(typ string, start, end int64) error {
+		if !isVideo {
+			switch typ {
+			case "ftyp", "moov", "mdat", "wide", "free", "skip":
+				isVideo = true
+			default:
+				return fmt.Errorf("not an MP4 or QuickTime file")
+			}
+		}
+		if typ != "moov" {
+			return nil
+		}
+		found = true
+		return vm.readMovie(f, start, end)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("no movie metadata")
+	}
+	return vm, nil
+}
+
+// readMovie reads the boxes of the movie box (moov)
+// of f, which is between start and end, into vm.
+func (vm *videoMeta) readMovie(f io.ReaderAt, start, end int64) error {
+	return walkBoxes(f, start, end, func(typ string, start, end int64) error {
+		switch typ {
+		case "mvhd":
+			buf, err := readBox(f, start, end)
+			if err != nil {
+				return err
+			}
+			var created, timescale, duration uint64
+			switch {
+			case len(buf) >= 32 && buf[0] == 1:
+				created = binary.BigEndian.Uint64(buf[4:])
+				timescale = uint64(binary.BigEndian.Uint32(buf[20:]))
+				duration = binary.BigEndian.Uint64(buf[24:])
+			case len(buf) >= 20:
+				created = uint64(binary.BigEndian.Uint32(buf[4:]))
+				timescale = uint64(binary.BigEndian.Uint32(buf[12:]))
+				duration = uint64(binary.BigEndian.Uint32(buf[16:]))
+			default:
+				return fmt.Errorf("movie header is too short")
+			}
+			// many cameras leave the creation time at 0, which is 1904
+			if created > 0 && created < 1<<40 {
+				vm.Created = time.Unix(int64(created)+videoEpoch, 0).UTC()
+			}
+			if timescale > 0 && duration < 1<<40 {
+				vm.Duration = time.Duration(float64(duration) / float64(timescale) * float64(time.Second))
+			}
+		case "trak":
+			if vm.Codec == "" {
+				vm.Codec = videoTrackCodec(f, start, end)
+			}
+		case "udta":
+			return walkBoxes(f, start, end, func(typ string, start, end int64) error {
+				if typ != "\xa9xyz" {
+					return nil
+				}
+				buf, err := readBox(f, start, end)
+				if err != nil || len(buf) < 4 {
+					return err
+				}
+				vm.Latitude, vm.Longitude, vm.Altitude = parseISO6709(string(buf[4:]))
+				return nil
+			})
+		}
+		return nil
+	})
+}
+
+// videoTrackCodec returns the name of the codec of the track
+// (trak box) of f between start and end, or an empty string
+// if it isn't a video track.
+func videoTrackCodec(f io.ReaderAt, start, end int64) string {
+	var handler, codec string
+	var visit func(typ string, start, end int64) error
+	visit = func(typ string, start, end int64) error {
+		switch typ {
+		case "mdia", "minf", "stbl":
+			return walkBoxes(f, start, end, visit)
+		case "hdlr":
+			// version and flags, pre-defined (the component
+			// type in QuickTime), then the handler type
+			buf, err := readBox(f, start, end)
+			if err == nil && len(buf) >= 12 {
+				handler = string(buf[8:12])
+			}
+		case "stsd":
+			// version and flags, number of entries, then
+			// the first entry: its size and then its type
+			buf, err := readBox(f, start, end)
+			if err == nil && len(buf) >= 16 {
+				codec = string(buf[12:16])
+			}
+		}
+		return nil
+	}
+	if walkBoxes(f, start, end, visit) != nil || handler != "vide" || codec == "" {
+		return ""
+	}
+	if name, ok := videoCodecs[codec]; ok {
+		return name
+	}
+	return strings.TrimSpace(codec)
+}
+
+// walkBoxes calls fn with the type of each box of f between
+// start and end (the boxes in a file, or in another box), and
+// where the box's content starts and ends. It stops at the
+// first error fn returns, and returns it.
+func walkBoxes(f io.ReaderAt, start, end int64, fn func(typ string, start, end int64) error) error {
+	for pos := start; pos+8 <= end; {
+		var hdr [16]byte
+		if _, err := f.ReadAt(hdr[:8], pos); err != nil {
+			return err
+		}
+		size, hdrSize := int64(binary.BigEndian.Uint32(hdr[:4])), int64(8)
+		switch size {
+		case 0: // to the end
+			size = end - pos
+		case 1: // 64-bit size follows the type
+			if _, err := f.ReadAt(hdr[8:], pos+8); err != nil {
+				return err
+			}
+			size, hdrSize = int64(binary.BigEndian.Uint64(hdr[8:])), 16
+		}
+		if size < hdrSize || size > end-pos {
+			return fmt.Errorf("box at %d has a bad size", pos)
+		}
+		err := fn(string(hdr[4:8]), pos+hdrSize, pos+size)
+		if err != nil {
+			return err
+		}
+		pos += size
+	}
+	return nil
+}
+
+// readBox returns the content of a box of f between start
+// and end. Only boxes with a little metadata are read, so it
+// returns an error if the box is larger than that could be.
+func readBox(f io.ReaderAt, start, end int64) ([]byte, error) {
+	if end-start > 1<<16 {
+		return nil, fmt.Errorf("box at %d is too large", start)
+	}
+	buf := make([]byte, end-start)
+	_, err := f.ReadAt(buf, start)
+	return buf, err
+}
+
+// parseISO6709 returns the coordinates in loc, which is a
+// location in ISO 6709 format as phones write it in videos,
+// like "+37.7858-122.4064+012.000/". It returns zeros for
+// what it can't read.
+func parseISO6709(loc string) (lat, lon, alt float64) {
+	var parts []string
+	for i := 0; i < len(loc); i++ {
+		if loc[i] != '+' && loc[i] != '-' {
+			continue
+		}
+		j := i + 1
+		for j < len(loc) && (loc[j] >= '0' && loc[j] <= '9' || loc[j] == '.') {
+			j++
+		}
+		parts = append(parts, loc[i:j])
+		i = j - 1
+	}
+	if len(parts) < 2 {
+		return 0, 0, 0
+	}
+	lat, errLat := iso6709Degrees(parts[0], 2)
+	lon, errLon := iso6709Degrees(parts[1], 3)
+	if errLat != nil || errLon != nil || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return 0, 0, 0
+	}
+	if len(parts) > 2 {
+		alt, _ = strconv.ParseFloat(parts[2], 64)
+	}
+	return lat, lon, alt
+}
+
+// iso6709Degrees returns the angle s, a signed number in
+// degrees (with degDigits digits before any decimal point),
+// degrees and minutes, or degrees, minutes, and seconds,
+// in degrees.
+func iso6709Degrees(s string, degDigits int) (float64, error) {
+	sign := 1.0
+	if s[0] == '-' {
+		sign = -1
+	}
+	s = s[1:]
+	intDigits := strings.IndexByte(s, '.')
+	if intDigits < 0 {
+		intDigits = len(s)
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	switch intDigits {
+	case degDigits:
+	case degDigits + 2: // DDMM.MM
+		deg := float64(int(v / 100))
+		v = deg + (v-deg*100)/60
+	case degDigits + 4: // DDMMSS.SS
+		deg, min := float64(int(v/10000)), float64(int(v/100)%100)
+		v = deg + min/60 + (v-deg*10000-min*100)/3600
+	default:
+		return 0, fmt.Errorf("bad coordinate '%s'", s)
+	}
+	return sign * v, nil
+}
+
+// setting returns where and when the video was taken,
+// or nil if its metadata doesn't say either.
+func (vm *videoMeta) setting() *setting {
+	if vm.Created.IsZero() && vm.Latitude == 0 && vm.Longitude == 0 {
+		return nil
+	}
+	return &setting{
+		Latitude:   vm.Latitude,
+		Longitude:  vm.Longitude,
+		Altitude:   vm.Altitude,
+		OriginTime: vm.Created,
+	}
+}
+
+// videoUndescribed returns true if the file of dbi is an MP4
+// or QuickTime video whose metadata hasn't been read, as far as
+// can be told: none of what it would say is known.
+func videoUndescribed(dbi *dbItem) bool {
+	switch strings.ToLower(filepath.Ext(dbi.FilePath)) {
+	case ".mp4", ".m4v", ".mov", ".3gp":
+		return dbi.Meta.Duration == 0 && dbi.Meta.Codec == "" && dbi.Meta.Setting == nil
+	}
+	return false
+}
+
+// describeVideo fills in meta, which describe filled in, with
+// what vm (which may be nil) says about the video: its duration
+// and codec, and where and when it was taken if that isn't
+// known already, as the EXIF data of photos would.
+func describeVideo(meta *itemMeta, vm *videoMeta) {
+	if vm == nil {
+		return
+	}
+	meta.Duration, meta.Codec = vm.Duration, vm.Codec
+	if meta.Setting == nil {
+		meta.Setting = vm.setting()
+	}
+	if meta.Taken.IsZero() {
+		meta.Taken = vm.Created
+	}
+}
@@ -0,0 +1,258 @@
+package photobak
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// box returns a box of type typ with the given content
+// and a 32-bit size.
+func box(typ string, content ...[]byte) []byte {
+	body := bytes.Join(content, nil)
+	b := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(b, uint32(8+len(body)))
+	copy(b[4:], typ)
+	return append(b, body...)
+}
+
+// rawBox returns the header of a box of type typ whose
+// size field is size32 and, if that is 1, size64.
+func rawBox(typ string, size32 uint32, size64 uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, size32)
+	copy(b[4:], typ)
+	if size32 == 1 {
+		b = append(b, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(b[8:], size64)
+	}
+	return b
+}
+
+func TestWalkBoxes(t *testing.T) {
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	for i, test := range []struct {
+		data      []byte
+		end       int64 // if not 0; otherwise len(data)
+		expect    []string
+		shouldErr bool
+	}{
+		{data: nil, expect: nil},
+		{
+			data:   join(box("ftyp", []byte("isom")), box("moov"), box("free", make([]byte, 3))),
+			expect: []string{"ftyp 8-12", "moov 20-20", "free 28-31"},
+		},
+		{
+			// size 0 goes to the end
+			data:   join(box("ftyp"), rawBox("mdat", 0, 0), make([]byte, 10)),
+			expect: []string{"ftyp 8-8", "mdat 16-26"},
+		},
+		{
+			// 64-bit size
+			data:   join(rawBox("mdat", 1, 20), make([]byte, 4), box("moov")),
+			expect: []string{"mdat 16-20", "moov 28-28"},
+		},
+		{
+			// fewer bytes left than a header are ignored
+			data:   join(box("moov"), []byte{0, 0, 0}),
+			expect: []string{"moov 8-8"},
+		},
+		{
+			// only walks up to end
+			data:   join(box("moov"), box("free")),
+			end:    8,
+			expect: []string{"moov 8-8"},
+		},
+		{
+			// truncated: larger than what's left
+			data:      join(box("ftyp"), rawBox("moov", 100, 0), make([]byte, 10)),
+			expect:    []string{"ftyp 8-8"},
+			shouldErr: true,
+		},
+		{
+			// smaller than its own header
+			data:      join(rawBox("moov", 4, 0), make([]byte, 10)),
+			shouldErr: true,
+		},
+		{
+			// a 64-bit size smaller than its header
+			data:      join(rawBox("mdat", 1, 8), make([]byte, 10)),
+			shouldErr: true,
+		},
+		{
+			// 64-bit size past the end of the file, or too
+			// large for an int64
+			data:      join(rawBox("mdat", 1, 1<<40), make([]byte, 10)),
+			shouldErr: true,
+		},
+		{
+			data:      join(rawBox("mdat", 1, math.MaxUint64), make([]byte, 10)),
+			shouldErr: true,
+		},
+		{
+			// the 64-bit size is cut off
+			data:      join(rawBox("mdat", 1, 0)[:12]),
+			end:       20,
+			shouldErr: true,
+		},
+	} {
+		end := test.end
+		if end == 0 {
+			end = int64(len(test.data))
+		}
+		var actual []string
+		err := walkBoxes(bytes.NewReader(test.data), 0, end, func(typ string, start, end int64) error {
+			actual = append(actual, fmt.Sprintf("%s %d-%d", typ, start, end))
+			return nil
+		})
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected an error, didn't get one", i)
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: Did not expect an error, got '%v'", i, err)
+		}
+		if !reflect.DeepEqual(actual, test.expect) {
+			t.Errorf("Test %d: Expected boxes %v, got %v", i, test.expect, actual)
+		}
+	}
+
+	// errors from fn stop the walk
+	data := append(box("ftyp"), box("moov")...)
+	var visited int
+	err := walkBoxes(bytes.NewReader(data), 0, int64(len(data)), func(string, int64, int64) error {
+		visited++
+		return fmt.Errorf("stop")
+	})
+	if err == nil || err.Error() != "stop" || visited != 1 {
+		t.Errorf("Expected to stop after 1 box with the error, got %d boxes and '%v'", visited, err)
+	}
+}
+
+func TestReadBox(t *testing.T) {
+	data := make([]byte, 1<<16+1)
+	if _, err := readBox(bytes.NewReader(data), 0, int64(len(data))); err == nil {
+		t.Errorf("Expected an error for an oversized box, didn't get one")
+	}
+	if _, err := readBox(bytes.NewReader(data[:10]), 0, 20); err == nil {
+		t.Errorf("Expected an error for a truncated box, didn't get one")
+	}
+	buf, err := readBox(bytes.NewReader([]byte("0123456789")), 2, 5)
+	if err != nil || string(buf) != "234" {
+		t.Errorf("Expected '234', got '%s' and '%v'", buf, err)
+	}
+}
+
+func TestReadMovieHeader(t *testing.T) {
+	mvhd0 := func(created, timescale, duration uint32) []byte {
+		b := make([]byte, 100)
+		binary.BigEndian.PutUint32(b[4:], created)
+		binary.BigEndian.PutUint32(b[12:], timescale)
+		binary.BigEndian.PutUint32(b[16:], duration)
+		return box("mvhd", b)
+	}
+	mvhd1 := func(created uint64, timescale uint32, duration uint64) []byte {
+		b := make([]byte, 112)
+		b[0] = 1
+		binary.BigEndian.PutUint64(b[4:], created)
+		binary.BigEndian.PutUint32(b[20:], timescale)
+		binary.BigEndian.PutUint64(b[24:], duration)
+		return box("mvhd", b)
+	}
+	const unixEpoch = 2082844800 // 1970-01-01 in seconds since 1904
+	for i, test := range []struct {
+		mvhd           []byte
+		expectCreated  time.Time
+		expectDuration time.Duration
+		shouldErr      bool
+	}{
+		{
+			mvhd:           mvhd0(unixEpoch+1500000000, 600, 9000),
+			expectCreated:  time.Unix(1500000000, 0).UTC(),
+			expectDuration: 15 * time.Second,
+		},
+		{
+			// many cameras leave it at 0
+			mvhd:           mvhd0(0, 1000, 2500),
+			expectDuration: 2500 * time.Millisecond,
+		},
+		{
+			mvhd:          mvhd0(1, 0, 100),
+			expectCreated: time.Date(1904, 1, 1, 0, 0, 1, 0, time.UTC),
+		},
+		{
+			// too far for a time.Duration since 1904
+			mvhd:           mvhd1(unixEpoch+13569465600, 90000, 90000*60),
+			expectCreated:  time.Date(2400, 1, 1, 0, 0, 0, 0, time.UTC),
+			expectDuration: time.Minute,
+		},
+		{
+			mvhd:          mvhd1(1<<40-1, 1, 1<<40),
+			expectCreated: time.Unix(1<<40-1-unixEpoch, 0).UTC(),
+		},
+		{
+			mvhd: mvhd1(1<<40, 1, 1),
+			// out of range: left zero
+			expectDuration: time.Second,
+		},
+		{
+			mvhd:      box("mvhd", make([]byte, 10)),
+			shouldErr: true,
+		},
+	} {
+		vm := new(videoMeta)
+		err := vm.readMovie(bytes.NewReader(test.mvhd), 0, int64(len(test.mvhd)))
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error, didn't get one", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Did not expect an error, got '%v'", i, err)
+		}
+		if !vm.Created.Equal(test.expectCreated) {
+			t.Errorf("Test %d: Expected creation time %s, got %s", i, test.expectCreated, vm.Created)
+		}
+		if vm.Duration != test.expectDuration {
+			t.Errorf("Test %d: Expected duration %s, got %s", i, test.expectDuration, vm.Duration)
+		}
+	}
+}
+
+func TestParseISO6709(t *testing.T) {
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-6 }
+	for i, test := range []struct {
+		input         string
+		lat, lon, alt float64
+	}{
+		{"+37.7858-122.4064+012.000/", 37.7858, -122.4064, 12},
+		{"+37.7858-122.4064/", 37.7858, -122.4064, 0},
+		{"-33.8688+151.2093-005.5/", -33.8688, 151.2093, -5.5},
+		{"+00.0000+000.0000/", 0, 0, 0},
+		{"+90-180/", 90, -180, 0},
+		// degrees and minutes, and degrees, minutes, and seconds
+		{"+4030.5-07400.25/", 40.508333, -74.004167, 0},
+		{"+403030-0740015.5/", 40.508333, -74.004306, 0},
+		// what can't be read
+		{"", 0, 0, 0},
+		{"+37.7858/", 0, 0, 0},
+		{"garbage", 0, 0, 0},
+		{"+91.0000+000.0000/", 0, 0, 0},
+		{"+45.0000+181.0000/", 0, 0, 0},
+		{"+123.45+010.00/", 0, 0, 0},
+		{"+1.2.3+010.00/", 0, 0, 0},
+		{"+-+", 0, 0, 0},
+		{strings.Repeat("+", 100), 0, 0, 0},
+	} {
+		lat, lon, alt := parseISO6709(test.input)
+		if !near(lat, test.lat) || !near(lon, test.lon) || !near(alt, test.alt) {
+			t.Errorf("Test %d: %q: Expected %v, %v, %v, got %v, %v, %v",
+				i, test.input, test.lat, test.lon, test.alt, lat, lon, alt)
+		}
+	}
+}
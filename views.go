@@ -0,0 +1,411 @@
+package photobak
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// ViewsDir is the folder in the root of the repository where
+// views are kept (see SetViews). Its contents are generated
+// from the index and should not be changed.
+const ViewsDir = "_views"
+
+// Views are virtual collections that are generated from what is
+// known about the items, rather than listed by the providers.
+// They give structure to accounts that have only one big
+// collection, like an automatic backup of a phone's camera.
+const (
+	ViewYear      = "year"      // "By Year/2019", or "By Year/Undated"
+	ViewCamera    = "camera"    // "By Camera/Canon EOS 5D"; items with no known camera are left out
+	ViewFavorites = "favorites" // "Favorites", for items the provider says are favorites
+	ViewVideos    = "videos"    // "Videos"
+)
+
+// AllViews lists every kind of view.
+var AllViews = []string{ViewYear, ViewCamera, ViewFavorites, ViewVideos}
+
+// CameraNamer is an optional interface an Item may implement
+// if the provider knows which camera took it. Otherwise, the
+// camera is read from the item's EXIF data, if any.
+type CameraNamer interface {
+	// ItemCamera returns the make and model of the
+	// camera, or an empty string if it isn't known.
+	ItemCamera() string
+}
+
+// Favoriter is an optional interface an Item may implement
+// if the provider lets users mark items as favorites.
+type Favoriter interface {
+	// ItemFavorite returns true if the item is a favorite.
+	ItemFavorite() bool
+}
+
+// Views returns the kinds of views the repository keeps.
+func (r *Repository) Views() []string {
+	return r.views
+}
+
+// SetViews sets the kinds of views that the repository keeps
+// in ViewsDir to views, which may be any of AllViews. It is
+// saved in the database so that the views are kept up to date
+// on later runs too, whenever files are changed. If views is
+// empty, ViewsDir is removed. Views refer to the items' files
+// according to the de-duplication mode.
+func (r *Repository) SetViews(views []string) error {
+	seen := make(map[string]bool)
+	var clean []string
+	for _, view := range views {
+		if !isView(view) {
+			return fmt.Errorf("unknown view '%s'", view)
+		}
+		if !seen[view] {
+			seen[view] = true
+			clean = append(clean, view)
+		}
+	}
+	sort.Strings(clean)
+	if strings.Join(clean, ",") == strings.Join(r.views, ",") {
+		return nil
+	}
+
+	err := r.db.saveSetting("views", strings.Join(clean, ","))
+	if err != nil {
+		return fmt.Errorf("saving views: %v", err)
+	}
+	r.views = clean
+
+	r.beginChanges()
+	defer r.endChanges()
+	if len(clean) == 0 {
+		repoLog.Infof("Removing views")
+		return os.RemoveAll(r.fullPath(ViewsDir))
+	}
+	return nil // endChanges writes the views
+}
+
+// splitViews splits the comma-separated
+// list of views saved in the database.
+func splitViews(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// isView returns true if view is the name of a kind of view.
+func isView(view string) bool {
+	for _, v := range AllViews {
+		if v == view {
+			return true
+		}
+	}
+	return false
+}
+
+// ViewContents returns the contents of the given kinds of views
+// (all of them, if none are given), whether or not the repository
+// keeps them in ViewsDir. The map is keyed by the path of each
+// view's folder relative to ViewsDir (like "By Year/2019"), and
+// the values are the sorted repo-relative paths of the files in it.
+func (r *Repository) ViewContents(views ...string) (map[string][]string, error) {
+	if len(views) == 0 {
+		views = AllViews
+	}
+	for _, view := range views {
+		if !isView(view) {
+			return nil, fmt.Errorf("unknown view '%s'", view)
+		}
+	}
+
+	accounts, err := r.db.storedAccounts()
+	if err != nil {
+		return nil, fmt.Errorf("listing accounts: %v", err)
+	}
+
+	contents := make(map[string][]string)
+	seen := make(map[string]struct{})
+	for _, pa := range accounts {
+		itemIDs, err := r.db.itemIDs(pa)
+		if err != nil {
+			return nil, err
+		}
+		for _, itemID := range itemIDs {
+			dbi, err := r.db.loadItem(pa.key(), itemID)
+			if err != nil {
+				return nil, err
+			}
+			if dbi == nil {
+				continue
+			}
+			if _, ok := seen[dbi.FilePath]; ok {
+				continue // the same file as another item's
+			}
+			seen[dbi.FilePath] = struct{}{}
+			for _, view := range views {
+				if folder := viewFolder(view, dbi); folder != "" {
+					contents[folder] = append(contents[folder], dbi.FilePath)
+				}
+			}
+		}
+	}
+	for _, files := range contents {
+		sort.Strings(files)
+	}
+	return contents, nil
+}
+
+// viewFolder returns the folder of the given kind of view that
+// dbi belongs in, relative to ViewsDir, or "" if none.
+func viewFolder(view string, dbi *dbItem) string {
+	switch view {
+	case ViewYear:
+		taken := itemTaken(dbi)
+		if taken.IsZero() {
+			return filepath.Join("By Year", "Undated")
+		}
+		return filepath.Join("By Year", taken.Format("2006"))
+	case ViewCamera:
+		if name := viewFolderName(dbi.Meta.Camera); name != "" {
+			return filepath.Join("By Camera", name)
+		}
+	case ViewFavorites:
+		if dbi.Meta.Favorite {
+			return "Favorites"
+		}
+	case ViewVideos:
+		if isVideo(dbi.FilePath) {
+			return "Videos"
+		}
+	}
+	return ""
+}
+
+// viewFolderName makes name, which comes from metadata,
+// safe to use as the name of a folder.
+func viewFolderName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < ' ' || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return ' '
+		}
+		return r
+	}, name)
+	name = strings.Join(strings.Fields(name), " ")
+	return strings.Trim(name, ".")
+}
+
+// isVideo returns true if the file at fpath
+// is a video, according to its extension.
+func isVideo(fpath string) bool {
+	switch strings.ToLower(filepath.Ext(fpath)) {
+	case ".mp4", ".m4v", ".mov", ".avi", ".mkv", ".webm", ".wmv", ".mpg", ".mpeg", ".3gp", ".mts", ".m2ts":
+		return true
+	}
+	return false
+}
+
+// describe records on meta what views need to know about the
+// item it, using its EXIF data x (which may be nil) for what
+// the provider doesn't tell.
+func describe(meta *itemMeta, it Item, x *exif.Exif) {
+	meta.Described = true
+	meta.Taken = itemTime(it)
+	if meta.Taken.IsZero() && x != nil {
+		if t, err := x.DateTime(); err == nil {
+			meta.Taken = t
+		}
+	}
+	meta.Camera = ""
+	if cn, ok := it.(CameraNamer); ok {
+		meta.Camera = cn.ItemCamera()
+	}
+	if meta.Camera == "" && x != nil {
+		meta.Camera = exifCamera(x)
+	}
+	meta.Favorite = false
+	if f, ok := it.(Favoriter); ok {
+		meta.Favorite = f.ItemFavorite()
+	}
+}
+
+// exifCamera returns the make and model of the camera
+// according to x, or an empty string if it doesn't say.
+func exifCamera(x *exif.Exif) string {
+	field := func(name exif.FieldName) string {
+		tag, err := x.Get(name)
+		if err != nil {
+			return ""
+		}
+		val, err := tag.StringVal()
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(strings.Trim(val, "\x00"))
+	}
+	mk, model := field(exif.Make), field(exif.Model)
+	if mk == "" || strings.HasPrefix(strings.ToLower(model), strings.ToLower(mk)) {
+		return model // like "Canon" "Canon EOS 5D"
+	}
+	return strings.TrimSpace(mk + " " + model)
+}
+
+// updateDescription describes the existing item dbi again using
+// the listed item it, if it was saved before items were described
+// (or is a video that was saved before their metadata was read)
+// or if it is no longer a favorite (or has become one), and saves
+// it if anything changed.
+func (r *Repository) updateDescription(pa providerAccount, it Item, dbi *dbItem) error {
+	if dbi.Meta.Described && !videoUndescribed(dbi) {
+		f, ok := it.(Favoriter)
+		if !ok || f.ItemFavorite() == dbi.Meta.Favorite {
+			return nil
+		}
+		dbi.Meta.Favorite = f.ItemFavorite()
+	} else {
+		var x *exif.Exif
+		if f, err := os.Open(r.fullPath(dbi.FilePath)); err == nil {
+			x, _ = exif.Decode(f) // not having EXIF data is OK
+			f.Close()
+		}
+		describe(&dbi.Meta, it, x)
+		if x == nil {
+			vm, _ := readVideoMeta(r.fullPath(dbi.FilePath))
+			describeVideo(&dbi.Meta, vm)
+		}
+	}
+	err := r.db.saveItem(pa.key(), dbi.ID, dbi)
+	if err != nil {
+		return fmt.Errorf("saving description of %s: %v", dbi.FilePath, err)
+	}
+	return nil
+}
+
+// writeViews brings the views that the repository keeps in
+// ViewsDir up to date, and removes folders of views that
+// are empty or no longer kept.
+func (r *Repository) writeViews() error {
+	contents, err := r.ViewContents(r.views...)
+	if err != nil {
+		return err
+	}
+
+	keep := map[string]bool{ViewsDir: true}
+	for folder, files := range contents {
+		dirPath := filepath.Join(ViewsDir, folder)
+		err := r.writeView(dirPath, files)
+		if err != nil {
+			return fmt.Errorf("writing view %s: %v", folder, err)
+		}
+		for d := dirPath; d != "."; d = filepath.Dir(d) {
+			keep[d] = true
+		}
+	}
+
+	root := r.fullPath(ViewsDir)
+	err = filepath.Walk(root, func(fullPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() && !keep[r.repoRelative(fullPath)] {
+			repoLog.Infof("Removing view %s", r.repoRelative(fullPath))
+			err := os.RemoveAll(fullPath)
+			if err != nil {
+				return err
+			}
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("removing old views: %v", err)
+	}
+	return nil
+}
+
+// writeView makes the folder at the repo-relative dirPath refer
+// to exactly the files at the repo-relative paths in files,
+// according to the de-duplication mode.
+func (r *Repository) writeView(dirPath string, files []string) error {
+	err := os.MkdirAll(r.fullPath(dirPath), 0700)
+	if err != nil {
+		return err
+	}
+
+	// what the folder should contain, by name
+	want := make(map[string]string)
+	if r.dedupMode == DedupList {
+		var buf bytes.Buffer
+		for _, fpath := range files {
+			fmt.Fprintln(&buf, fpath)
+		}
+		listName := filepath.Base(r.mediaListPath(dirPath))
+		want[listName] = ""
+		err := r.writeViewList(r.mediaListPath(dirPath), buf.Bytes())
+		if err != nil {
+			return err
+		}
+	} else {
+		taken := make(map[string]struct{})
+		for _, fpath := range files {
+			want[uniqueName(taken, filepath.Base(fpath))] = fpath
+		}
+	}
+
+	infos, err := ioutil.ReadDir(r.fullPath(dirPath))
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.IsDir() || isJunkFile(info.Name()) {
+			continue
+		}
+		linkPath := filepath.Join(dirPath, info.Name())
+		target, wanted := want[info.Name()]
+		if wanted && (target == "" || r.linksTo(linkPath, info, target)) {
+			delete(want, info.Name())
+			continue
+		}
+		err := os.Remove(r.fullPath(linkPath))
+		if err != nil {
+			return err
+		}
+	}
+
+	for name, target := range want {
+		if target == "" {
+			continue
+		}
+		err := r.makeLink(filepath.Join(dirPath, name), target)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeViewList writes data to the media list file at the
+// repo-relative path listPath, unless it already has it.
+func (r *Repository) writeViewList(listPath string, data []byte) error {
+	fullPath := r.fullPath(listPath)
+	if existing, err := ioutil.ReadFile(fullPath); err == nil && bytes.Equal(existing, data) {
+		return nil
+	}
+	tmpPath := fullPath + ".tmp"
+	err := ioutil.WriteFile(tmpPath, data, 0600)
+	if err != nil {
+		return err
+	}
+	if r.SyncFriendly {
+		return overwriteFile(tmpPath, fullPath)
+	}
+	return os.Rename(tmpPath, fullPath)
+}
@@ -0,0 +1,226 @@
+package photobak
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// XMPExt is the extension of the XMP sidecar files that are kept
+// in the repository if it has XMP enabled. The sidecar of a file
+// is named like the file with XMPExt added, like "IMG_1234.jpg.xmp",
+// which is how digiKam, darktable, and other photo tools find them.
+const XMPExt = ".xmp"
+
+// xmpCreatorTool marks the sidecars written by photobak,
+// so that they are the only ones that are ever removed.
+const xmpCreatorTool = `xmp:CreatorTool="photobak"`
+
+// writeXMPSidecars writes an XMP sidecar next to the file of every
+// item that has a caption, time taken, camera, or location, and
+// removes the sidecars photobak wrote for files that are gone or
+// no longer have any of these. Sidecars that would be the same,
+// and sidecars that photobak did not write, are not touched.
+func (r *Repository) writeXMPSidecars() error {
+	accounts, err := r.db.storedAccounts()
+	if err != nil {
+		return fmt.Errorf("listing accounts: %v", err)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].String() < accounts[j].String() })
+
+	want := make(map[string][]byte) // content of each sidecar, by repo-relative path
+	for _, pa := range accounts {
+		itemIDs, err := r.db.itemIDs(pa)
+		if err != nil {
+			return err
+		}
+		sort.Strings(itemIDs)
+		for _, itemID := range itemIDs {
+			dbi, err := r.db.loadItem(pa.key(), itemID)
+			if err != nil {
+				return err
+			}
+			if dbi == nil {
+				continue
+			}
+			sidecarPath := dbi.FilePath + XMPExt
+			if _, ok := want[sidecarPath]; ok {
+				continue // the same file as another item's
+			}
+			if content := xmpContent(dbi); content != nil {
+				want[sidecarPath] = content
+			}
+		}
+	}
+
+	for sidecarPath, content := range want {
+		err := r.writeXMPSidecar(sidecarPath, content)
+		if err != nil {
+			return fmt.Errorf("writing %s: %v", sidecarPath, err)
+		}
+	}
+
+	root := filepath.Clean(r.path)
+	return filepath.Walk(root, func(fullPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		fpath := r.repoRelative(fullPath)
+		if info.IsDir() {
+			if fullPath != root && (isJunkFile(info.Name()) || fpath == QuarantineDir || fpath == ViewsDir || fpath == CertificatesDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if _, ok := want[fpath]; ok || !r.wroteXMPSidecar(fpath) {
+			return nil
+		}
+		repoLog.Infof("Removing XMP sidecar %s", fpath)
+		return os.Remove(fullPath)
+	})
+}
+
+// wroteXMPSidecar returns true if the file at the
+// repo-relative path fpath is an XMP sidecar that
+// photobak wrote.
+func (r *Repository) wroteXMPSidecar(fpath string) bool {
+	if !strings.HasSuffix(fpath, XMPExt) {
+		return false
+	}
+	content, err := ioutil.ReadFile(r.fullPath(fpath))
+	return err == nil && bytes.Contains(content, []byte(xmpCreatorTool))
+}
+
+// writeXMPSidecar writes content to the sidecar at the
+// repo-relative sidecarPath, unless it is already there
+// or there is a sidecar that photobak did not write.
+func (r *Repository) writeXMPSidecar(sidecarPath string, content []byte) error {
+	fullPath := r.fullPath(sidecarPath)
+	if existing, err := ioutil.ReadFile(fullPath); err == nil {
+		if bytes.Equal(existing, content) {
+			return nil
+		}
+		if !bytes.Contains(existing, []byte(xmpCreatorTool)) {
+			repoLog.Infof("Leaving XMP sidecar %s as it is, since photobak did not write it", sidecarPath)
+			return nil
+		}
+	}
+	tmpPath := fullPath + ".tmp"
+	err := ioutil.WriteFile(tmpPath, content, 0600)
+	if err != nil {
+		return err
+	}
+	if r.SyncFriendly {
+		return overwriteFile(tmpPath, fullPath)
+	}
+	return os.Rename(tmpPath, fullPath)
+}
+
+// xmpContent returns the XMP sidecar of dbi, or nil if
+// nothing is known about it that would go in one.
+func xmpContent(dbi *dbItem) []byte {
+	var attrs []string
+	attr := func(name, value string) {
+		attrs = append(attrs, fmt.Sprintf("%s=\"%s\"", name, xmlEscape(value)))
+	}
+
+	if taken := itemTaken(dbi); !taken.IsZero() {
+		attr("photoshop:DateCreated", taken.Format("2006-01-02T15:04:05Z07:00"))
+		attr("exif:DateTimeOriginal", taken.Format("2006-01-02T15:04:05Z07:00"))
+	}
+	if dbi.Meta.Camera != "" {
+		attr("tiff:Model", dbi.Meta.Camera)
+	}
+	if s := dbi.Meta.Setting; s != nil && (s.Latitude != 0 || s.Longitude != 0) {
+		attr("exif:GPSLatitude", xmpCoordinate(s.Latitude, "N", "S"))
+		attr("exif:GPSLongitude", xmpCoordinate(s.Longitude, "E", "W"))
+		if s.Altitude != 0 {
+			ref := "0" // above sea level
+			if s.Altitude < 0 {
+				ref = "1"
+			}
+			attr("exif:GPSAltitude", fmt.Sprintf("%d/100", int64(math.Round(math.Abs(s.Altitude)*100))))
+			attr("exif:GPSAltitudeRef", ref)
+		}
+	}
+	if len(attrs) == 0 && dbi.Meta.Caption == "" {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:dc="http://purl.org/dc/elements/1.1/"
+    xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+    xmlns:photoshop="http://ns.adobe.com/photoshop/1.0/"
+    xmlns:exif="http://ns.adobe.com/exif/1.0/"
+    xmlns:tiff="http://ns.adobe.com/tiff/1.0/"
+    ` + xmpCreatorTool)
+	for _, a := range attrs {
+		buf.WriteString("\n    " + a)
+	}
+	buf.WriteString(">\n")
+	if dbi.Meta.Caption != "" {
+		fmt.Fprintf(&buf, "   <dc:description>\n    <rdf:Alt>\n     <rdf:li xml:lang=\"x-default\">%s</rdf:li>\n    </rdf:Alt>\n   </dc:description>\n",
+			xmlEscape(dbi.Meta.Caption))
+	}
+	buf.WriteString("  </rdf:Description>\n </rdf:RDF>\n</x:xmpmeta>\n")
+	return buf.Bytes()
+}
+
+// xmpSidecar is what readXMPSidecar reads from an XMP sidecar.
+type xmpSidecar struct {
+	Description struct {
+		DateCreated string   `xml:"DateCreated,attr"`
+		Caption     []string `xml:"description>Alt>li"`
+	} `xml:"RDF>Description"`
+}
+
+// readXMPSidecar returns the caption and the time taken that
+// the XMP sidecar at fullPath gives, if any. Sidecars written
+// by other tools are read too, as far as they are alike.
+func readXMPSidecar(fullPath string) (string, time.Time, error) {
+	content, err := ioutil.ReadFile(fullPath)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	var sidecar xmpSidecar
+	err = xml.Unmarshal(content, &sidecar)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	var caption string
+	if len(sidecar.Description.Caption) > 0 {
+		caption = strings.TrimSpace(sidecar.Description.Caption[0])
+	}
+	taken, _ := time.Parse("2006-01-02T15:04:05Z07:00", sidecar.Description.DateCreated)
+	return caption, taken, nil
+}
+
+// xmpCoordinate formats the latitude or longitude deg like XMP
+// does, as degrees and decimal minutes followed by pos if it is
+// positive or neg if it is negative, like "40,26.7670N".
+func xmpCoordinate(deg float64, pos, neg string) string {
+	dir := pos
+	if deg < 0 {
+		dir, deg = neg, -deg
+	}
+	whole := math.Floor(deg)
+	return fmt.Sprintf("%d,%.4f%s", int(whole), (deg-whole)*60, dir)
+}
+
+// xmlEscape returns s escaped for use in XML text or attributes.
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}